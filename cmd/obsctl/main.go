@@ -0,0 +1,193 @@
+// Command obsctl helps operate services instrumented with the observability
+// module.
+//
+//	obsctl doctor -config instrumentation.json
+//	obsctl routes -source main.go -routes routes.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jculley01/observability-module/instrumentation"
+	parserimport "github.com/jculley01/observability-module/parser"
+	"io"
+	"os"
+	"time"
+)
+
+const usage = `usage: obsctl <command> [flags]
+
+commands:
+  doctor   check that a configuration can deliver metrics
+  routes   compare the endpoints in the source with the routes served
+`
+
+// hints tell what to look at when a check fails.
+var hints = map[string]string{
+	"config":          "fix the fields listed above in the config file",
+	"tls":             "check that the certificate matches the host name, hasn't expired and is signed by a CA this host trusts (SSL_CERT_FILE)",
+	"registry":        "check registry_url (ws:// or wss://, without /metrics), that the registry is running and that this host can reach it through proxies and firewalls",
+	"influxdb_health": "check influxdb_url and that InfluxDB is running",
+	"influxdb":        "check token (or token_secret), org and bucket; the token needs write access to the bucket",
+	"clock":           "sync this host's clock (NTP); skewed clocks misplace points and windows",
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	switch args[0] {
+	case "doctor":
+		return doctor(args[1:], stdout, stderr)
+	case "routes":
+		return routes(args[1:], stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "obsctl: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+}
+
+// doctor runs instrumentation.CheckConfig against a config file, and exits
+// with 1 when a check fails.
+func doctor(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "", "path of the JSON configuration file")
+	writeProbe := flags.Bool("write-probe", false, "write a probe point to the InfluxDB bucket")
+	timeout := flags.Duration("timeout", 30*time.Second, "time allowed for all the checks")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" {
+		fmt.Fprintln(stderr, "obsctl doctor: -config is required")
+		return 2
+	}
+
+	cfg, err := instrumentation.LoadConfig(*configPath)
+	var validationErr *instrumentation.ValidationError
+	if err != nil && !errors.As(err, &validationErr) {
+		// The config check reports validation problems
+		fmt.Fprintf(stderr, "obsctl doctor: %v\n", err)
+		return 2
+	}
+	if *writeProbe {
+		cfg.SelfCheckWriteProbe = true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	report := instrumentation.CheckConfig(ctx, cfg)
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(stderr, "obsctl doctor: %v\n", err)
+			return 2
+		}
+	} else {
+		printReport(stdout, *configPath, report)
+	}
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+func printReport(w io.Writer, configPath string, report instrumentation.SelfCheckReport) {
+	fmt.Fprintf(w, "Checking %s\n\n", configPath)
+	for _, check := range report.Checks {
+		status := check.Status
+		if status == instrumentation.CheckFailed {
+			status = "FAILED"
+		}
+		fmt.Fprintf(w, "  %-8s %-16s %s\n", status, check.Name, check.Detail)
+		if check.Status == instrumentation.CheckFailed && hints[check.Name] != "" {
+			fmt.Fprintf(w, "  %-8s %-16s -> %s\n", "", "", hints[check.Name])
+		}
+	}
+	if report.OK {
+		fmt.Fprintln(w, "\nNo problems found.")
+	} else {
+		fmt.Fprintln(w, "\nMetrics won't arrive until the failed checks pass.")
+	}
+}
+
+// routes reconciles the endpoints parsed from a source file with the routes
+// listed by instrumentation.Routes, saved as JSON, and exits with 1 when they
+// drifted apart.
+func routes(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("routes", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	sourcePath := flags.String("source", "", "path of the Go file registering the routes")
+	routesPath := flags.String("routes", "", "path of the JSON array of routes served, as returned by instrumentation.Routes")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *sourcePath == "" || *routesPath == "" {
+		fmt.Fprintln(stderr, "obsctl routes: -source and -routes are required")
+		return 2
+	}
+
+	framework, endpoints, err := parserimport.DetectFrameworkAndEndpoints(*sourcePath)
+	if err != nil {
+		fmt.Fprintf(stderr, "obsctl routes: %v\n", err)
+		return 2
+	}
+	data, err := os.ReadFile(*routesPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "obsctl routes: %v\n", err)
+		return 2
+	}
+	var served []parserimport.Route
+	if err := json.Unmarshal(data, &served); err != nil {
+		fmt.Fprintf(stderr, "obsctl routes: %s: %v\n", *routesPath, err)
+		return 2
+	}
+	report := parserimport.Reconcile(endpoints, served)
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(stderr, "obsctl routes: %v\n", err)
+			return 2
+		}
+	} else {
+		printRoutes(stdout, *sourcePath, framework, report)
+	}
+	if report.HasDrift() {
+		return 1
+	}
+	return 0
+}
+
+func printRoutes(w io.Writer, sourcePath, framework string, report parserimport.Reconciliation) {
+	fmt.Fprintf(w, "Routes of %s (%s)\n\n", sourcePath, framework)
+	for _, group := range []struct {
+		status string
+		routes []parserimport.Route
+	}{
+		{"matched", report.Matched},
+		{"source", report.StaticOnly},
+		{"runtime", report.RuntimeOnly},
+	} {
+		for _, route := range group.routes {
+			method := route.Method
+			if method == "" {
+				method = "*"
+			}
+			fmt.Fprintf(w, "  %-8s %-7s %-32s %s\n", group.status, method, route.Pattern, route.Handler)
+		}
+	}
+	fmt.Fprintf(w, "\n%d matched, %d only in the source, %d only served.\n", len(report.Matched), len(report.StaticOnly), len(report.RuntimeOnly))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/jculley01/observability-module/instrumentation"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, cfg map[string]interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "instrumentation.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDoctorPasses(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := upgrader.Upgrade(w, r, nil); err == nil {
+			c.Close()
+		}
+	}))
+	defer registry.Close()
+	path := writeConfig(t, map[string]interface{}{
+		"registry_url": "ws" + strings.TrimPrefix(registry.URL, "http"),
+		"service_name": "orders",
+	})
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"doctor", "-config", path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code %d\n%s%s", code, stdout.String(), stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "ok       registry") || !strings.Contains(stdout.String(), "No problems found.") {
+		t.Errorf("output:\n%s", stdout.String())
+	}
+}
+
+func TestDoctorReportsFailures(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	path := writeConfig(t, map[string]interface{}{
+		"registry_url":  "ws" + strings.TrimPrefix(unreachable.URL, "http"),
+		"max_endpoints": -1,
+	})
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"doctor", "-config", path, "-json"}, &stdout, &stderr); code != 1 {
+		t.Fatalf("exit code %d, want 1\n%s%s", code, stdout.String(), stderr.String())
+	}
+	var report instrumentation.SelfCheckReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	failed := map[string]bool{}
+	for _, check := range report.Checks {
+		failed[check.Name] = check.Status == instrumentation.CheckFailed
+	}
+	if !failed["config"] || !failed["registry"] {
+		t.Errorf("failed checks = %v, want config and registry", failed)
+	}
+
+	stdout.Reset()
+	run([]string{"doctor", "-config", path}, &stdout, &stderr)
+	if !strings.Contains(stdout.String(), "-> "+hints["registry"]) {
+		t.Errorf("output lacks the registry hint:\n%s", stdout.String())
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	for _, args := range [][]string{nil, {"frobnicate"}, {"doctor"}, {"doctor", "-config", "/nonexistent.json"}, {"routes"}} {
+		if code := run(args, &stdout, &stderr); code != 2 {
+			t.Errorf("run(%q) = %d, want 2", args, code)
+		}
+	}
+}
+
+func TestRoutesReportsDrift(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "main.go")
+	err := os.WriteFile(source, []byte(`package main
+
+import "github.com/gin-gonic/gin"
+
+func main() {
+	r := gin.New()
+	r.GET("/users/:id", getUser)
+	r.DELETE("/legacy", legacy)
+}
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := filepath.Join(dir, "routes.json")
+	if err := os.WriteFile(served, []byte(`[{"method":"GET","pattern":"/users/:id"},{"method":"GET","pattern":"/metrics"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"routes", "-source", source, "-routes", served}, &stdout, &stderr); code != 1 {
+		t.Fatalf("exit code %d, want 1\n%s%s", code, stdout.String(), stderr.String())
+	}
+	for _, want := range []string{"matched  GET", "source   DELETE  /legacy", "runtime  GET     /metrics", "1 matched, 1 only in the source, 1 only served."} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, stdout.String())
+		}
+	}
+
+	if err := os.WriteFile(served, []byte(`[{"method":"GET","pattern":"/users/:id"},{"method":"DELETE","pattern":"/legacy"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	if code := run([]string{"routes", "-source", source, "-routes", served, "-json"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code %d without drift\n%s%s", code, stdout.String(), stderr.String())
+	}
+	var report struct {
+		Matched []map[string]string `json:"matched"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil || len(report.Matched) != 2 || report.Matched[0]["handler"] != "getUser" {
+		t.Errorf("report = %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,186 @@
+package instrumentation
+
+import (
+	"net/http"
+	"time"
+)
+
+// Observation is what a framework adapter reports about one request it
+// served. Adapters whose framework can run its handlers through Middleware
+// don't need it; the others (Fiber, fasthttp, ...) fill one in once the
+// handler has returned and pass it to Report.
+type Observation struct {
+	// Endpoint is the matched route template, or the raw path when no route
+	// matched, after OperationPath. Report normalizes and caps it.
+	Endpoint     string
+	UserAgent    string
+	IPAddress    string
+	RequestSize  int64
+	StatusCode   int
+	ResponseSize int
+	Latency      time.Duration
+	// Failed counts the request in error_count, unless an ErrorPredicate
+	// decides otherwise.
+	Failed bool
+	// TimeToFirstByte is how long the first byte of the response took, when
+	// known; it is reported as ttfb_ms. For Streaming responses, whose total
+	// duration says little, it is the latency and Latency is reported as
+	// stream_duration_ms.
+	TimeToFirstByte time.Duration
+	Streaming       bool
+	// Err is the error the handler returned, if any. It refines the
+	// error_class of failed requests, e.g. a context.DeadlineExceeded is a
+	// timeout.
+	Err error
+
+	// Request and ResponseHeader are set by adapters for net/http based
+	// frameworks; they feed WithTagExtractor, WithFieldExtractor and header
+	// capture.
+	Request        *http.Request
+	ResponseHeader http.Header
+	// RequestHeaderFunc and ResponseHeaderFunc look headers up for frameworks
+	// without an *http.Request.
+	RequestHeaderFunc  func(name string) string
+	ResponseHeaderFunc func(name string) string
+	// Context is the framework's own request context, passed to the
+	// ContextTagExtractors and ContextFieldExtractors.
+	Context interface{}
+
+	// Record is the request's RequestRecord, for adapters that made one
+	// available through FromContext.
+	Record *RequestRecord
+
+	// Panic is the value recovered from a panicking handler. Report then
+	// records a failed request with a 500 status and must be called from the
+	// deferred function that recovered it, so the stack trace is still there.
+	Panic interface{}
+}
+
+// Report counts an observed request and sends its metrics point, unless the
+// point is sampled out. It returns the endpoint tag the request was counted
+// under.
+func Report(o Observation) string {
+	path := endpointTag(o.Endpoint)
+	o.Failed = failedOutcome(Outcome{Endpoint: path, Protocol: ProtocolHTTP, StatusCode: o.StatusCode, Err: o.Err, Failed: o.Failed})
+	if o.Record != nil && o.Record.aborted() {
+		o.Failed = true
+	}
+	if o.Panic != nil {
+		o.StatusCode = http.StatusInternalServerError
+		o.Failed = true
+		incrementEndpointPanicCount(path)
+	}
+	latency := o.Latency
+	if o.Streaming && o.TimeToFirstByte > 0 {
+		latency = o.TimeToFirstByte
+	}
+	incrementEndpointRequestCount(path)
+	if o.Failed {
+		incrementEndpointErrorCount(path)
+	}
+
+	tags := map[string]string{
+		"endpoint":   path,
+		"user_agent": o.UserAgent,
+		"ip_address": o.IPAddress,
+	}
+	if p := currentClientProfiles(); p != nil && p.config.OmitIPAddress {
+		delete(tags, "ip_address")
+	}
+	fields := map[string]interface{}{
+		"request_size":  o.RequestSize,
+		"status_code":   o.StatusCode,
+		"response_size": o.ResponseSize,
+		"latency_ms":    latency.Milliseconds(),
+		"request_count": getEndpointRequestCount(path),
+		"error_count":   getEndpointErrorCount(path),
+		"panic_count":   getEndpointPanicCount(path),
+	}
+	countErrorClass(tags, fields, path, observedErrorClass(o))
+	countStatusFamily(fields, path, o.StatusCode)
+	if o.Request != nil {
+		fields["client_canceled"] = clientCanceled(o.Request)
+	}
+	if o.TimeToFirstByte > 0 {
+		fields["ttfb_ms"] = o.TimeToFirstByte.Milliseconds()
+	}
+	if o.Streaming {
+		fields["streaming"] = true
+		fields["stream_duration_ms"] = o.Latency.Milliseconds()
+	}
+	addLatencyHistogram(fields, path, latency)
+	if o.Panic != nil && loadSettings().panicStackTrace {
+		fields["panic_stack"] = panicStack(o.Panic)
+	}
+	if o.Panic != nil {
+		sendPanicReport(path, o.Panic, o.Request, o.Record)
+	}
+
+	requestHeader, responseHeader := o.RequestHeaderFunc, o.ResponseHeaderFunc
+	if requestHeader == nil {
+		requestHeader = func(string) string { return "" }
+		if o.Request != nil {
+			requestHeader = o.Request.Header.Get
+		}
+	}
+	if responseHeader == nil {
+		responseHeader = o.ResponseHeader.Get
+	}
+	if o.Request != nil {
+		extractRequestTags(tags, o.Request)
+	}
+	if o.Context != nil {
+		extractContextTags(tags, o.Context)
+	}
+	captureHeaders(tags, fields, requestHeader, responseHeader)
+	countDuplicate(fields, path, requestHeader)
+	method := ""
+	if o.Request != nil {
+		method = o.Request.Method
+	}
+	discoverEndpoint(path, method)
+	profileClient(o.IPAddress, requestHeader, latency, o.Failed)
+	if o.Request != nil {
+		extractRequestFields(fields, o.Request, ResponseInfo{StatusCode: o.StatusCode, Size: o.ResponseSize, Header: o.ResponseHeader})
+	}
+	if o.Context != nil {
+		extractContextFields(fields, o.Context)
+	}
+	if o.Record != nil {
+		o.Record.apply(tags, fields)
+	}
+	reportError(fields, ErrorReport{Endpoint: path, StatusCode: o.StatusCode}, o.Panic, o.Request, o.Record)
+
+	metrics := Metrics{
+		InfluxDBURL: influxDBURL,
+		Token:       currentToken(),
+		Org:         org,
+		Bucket:      bucket,
+		Measurement: measurement,
+		Tags:        tags,
+		Fields:      fields,
+	}
+
+	recordRollup(path, latency, o.Failed)
+
+	// Send metrics unless aggregated or sampled out
+	if !aggregatePoint(path, latency, o.Failed) && samplePoint(path) {
+		reportPoint(metrics)
+	}
+	return path
+}
+
+// observedErrorClass returns the error_class of o, or "" if it didn't fail.
+func observedErrorClass(o Observation) string {
+	if !o.Failed {
+		return ""
+	}
+	if o.Panic != nil {
+		return ErrorClassServer
+	}
+	var ctxErr error
+	if o.Request != nil {
+		ctxErr = o.Request.Context().Err()
+	}
+	return classifyError(o.StatusCode, ctxErr, o.Err)
+}
@@ -0,0 +1,232 @@
+package instrumentation
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sketchSubBuckets is the number of buckets per power of two in a
+// latencySketch, which bounds the error of its quantiles to about 1.6%.
+const sketchSubBuckets = 64
+
+// latencySketch is a log-linear (HDR style) histogram of latencies in
+// microseconds: exact below sketchSubBuckets, then sketchSubBuckets buckets
+// for each power of two.
+type latencySketch struct {
+	counts []int64
+	count  int64
+	sum    int64
+	min    int64
+	max    int64
+}
+
+func sketchIndex(v int64) int {
+	if v < sketchSubBuckets {
+		return int(v)
+	}
+	// Shift v down to [sketchSubBuckets, 2*sketchSubBuckets)
+	shift := bits.Len64(uint64(v)) - bits.Len64(sketchSubBuckets)
+	return sketchSubBuckets*(shift+1) + int(v>>shift) - sketchSubBuckets
+}
+
+// sketchValue returns the middle of the bucket at index.
+func sketchValue(index int) int64 {
+	if index < sketchSubBuckets {
+		return int64(index)
+	}
+	shift := index/sketchSubBuckets - 1
+	low := int64(index%sketchSubBuckets+sketchSubBuckets) << shift
+	return low + (int64(1)<<shift)/2
+}
+
+func (s *latencySketch) add(latency time.Duration) {
+	v := latency.Microseconds()
+	if v < 0 {
+		v = 0
+	}
+	index := sketchIndex(v)
+	if index >= len(s.counts) {
+		s.counts = append(s.counts, make([]int64, index+1-len(s.counts))...)
+	}
+	s.counts[index]++
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if v > s.max {
+		s.max = v
+	}
+	s.count++
+	s.sum += v
+}
+
+// quantile returns the latency in microseconds below which a fraction q of
+// the observations fall.
+func (s *latencySketch) quantile(q float64) int64 {
+	rank := int64(math.Ceil(q * float64(s.count)))
+	// The extremes are known exactly
+	if rank <= 1 {
+		return s.min
+	}
+	if rank >= s.count {
+		return s.max
+	}
+	var seen int64
+	for index, c := range s.counts {
+		seen += c
+		if seen >= rank {
+			return min(max(sketchValue(index), s.min), s.max)
+		}
+	}
+	return s.max
+}
+
+// merge adds the observations of o to s.
+func (s *latencySketch) merge(o *latencySketch) {
+	if o.count == 0 {
+		return
+	}
+	if len(o.counts) > len(s.counts) {
+		s.counts = append(s.counts, make([]int64, len(o.counts)-len(s.counts))...)
+	}
+	for index, c := range o.counts {
+		s.counts[index] += c
+	}
+	if s.count == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	if o.max > s.max {
+		s.max = o.max
+	}
+	s.count += o.count
+	s.sum += o.sum
+}
+
+// windowStats is what an endpoint saw during the current window.
+type windowStats struct {
+	latency latencySketch
+	errors  int64
+}
+
+// windowAggregator replaces per-request points with one point per endpoint and
+// AggregationWindow, carrying latency percentiles.
+type windowAggregator struct {
+	mu        sync.Mutex
+	window    time.Duration
+	endpoints map[string]*windowStats
+	done      chan struct{}
+}
+
+var (
+	aggregatorMu sync.Mutex
+	aggregator   *windowAggregator
+)
+
+// currentAggregator returns the running aggregator, or nil when points are
+// sent per request.
+func currentAggregator() *windowAggregator {
+	aggregatorMu.Lock()
+	defer aggregatorMu.Unlock()
+	return aggregator
+}
+
+// startAggregation starts flushing a window every AggregationWindow, replacing
+// the aggregator of any previously applied config after flushing what it held.
+func startAggregation(cfg Config) {
+	aggregatorMu.Lock()
+	previous := aggregator
+	aggregator = nil
+	window := time.Duration(cfg.AggregationWindow)
+	if window > 0 {
+		aggregator = &windowAggregator{window: window, endpoints: make(map[string]*windowStats), done: make(chan struct{})}
+		go aggregator.run()
+	}
+	aggregatorMu.Unlock()
+
+	if previous != nil {
+		close(previous.done)
+		previous.flush()
+	}
+}
+
+func (a *windowAggregator) run() {
+	ticker := time.NewTicker(a.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.flush()
+		}
+	}
+}
+
+// aggregatePoint records a request in the current window and reports whether
+// that replaces its own point.
+func aggregatePoint(endpoint string, latency time.Duration, failed bool) bool {
+	a := currentAggregator()
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats, ok := a.endpoints[endpoint]
+	if !ok {
+		stats = &windowStats{}
+		a.endpoints[endpoint] = stats
+	}
+	stats.latency.add(latency)
+	if failed {
+		stats.errors++
+	}
+	return true
+}
+
+// flush sends one point per endpoint seen since the last flush.
+func (a *windowAggregator) flush() {
+	a.mu.Lock()
+	endpoints := a.endpoints
+	a.endpoints = make(map[string]*windowStats)
+	a.mu.Unlock()
+
+	paths := make([]string, 0, len(endpoints))
+	for path := range endpoints {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		stats := endpoints[path]
+		fields := map[string]interface{}{
+			"window_seconds":  a.window.Seconds(),
+			"window_requests": stats.latency.count,
+			"window_errors":   stats.errors,
+			"latency_min_ms":  float64(stats.latency.min) / 1000,
+			"latency_max_ms":  float64(stats.latency.max) / 1000,
+			"latency_mean_ms": float64(stats.latency.sum) / float64(stats.latency.count) / 1000,
+			"latency_p50_ms":  float64(stats.latency.quantile(0.50)) / 1000,
+			"latency_p95_ms":  float64(stats.latency.quantile(0.95)) / 1000,
+			"latency_p99_ms":  float64(stats.latency.quantile(0.99)) / 1000,
+			"request_count":   getEndpointRequestCount(path),
+			"error_count":     getEndpointErrorCount(path),
+			"panic_count":     getEndpointPanicCount(path),
+		}
+		tags := map[string]string{"endpoint": path, "aggregation": "window"}
+		countErrorClass(tags, fields, path, "")
+		countStatusFamily(fields, path, 0)
+		metrics := Metrics{
+			InfluxDBURL: influxDBURL,
+			Token:       currentToken(),
+			Org:         org,
+			Bucket:      bucket,
+			Measurement: measurement,
+			Tags:        tags,
+			Fields:      fields,
+		}
+		if err := enqueuePoint(aggregatePoints, metrics); err != nil {
+			logSendError(err)
+		}
+	}
+}
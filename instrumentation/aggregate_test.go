@@ -0,0 +1,79 @@
+package instrumentation
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatencySketchQuantiles(t *testing.T) {
+	var s latencySketch
+	for ms := 1; ms <= 1000; ms++ {
+		s.add(time.Duration(ms) * time.Millisecond)
+	}
+	for q, want := range map[float64]float64{0.5: 500_000, 0.95: 950_000, 0.99: 990_000} {
+		got := float64(s.quantile(q))
+		if math.Abs(got-want)/want > 0.02 {
+			t.Errorf("quantile(%g) = %gµs, want %gµs within 2%%", q, got, want)
+		}
+	}
+	if s.quantile(0) != 1000 || s.quantile(1) != 1_000_000 {
+		t.Errorf("quantile(0), quantile(1) = %d, %d, want the min and max", s.quantile(0), s.quantile(1))
+	}
+}
+
+func TestSketchIndexIsMonotonic(t *testing.T) {
+	previous := -1
+	for v := int64(0); v < 1<<20; v += 7 {
+		index := sketchIndex(v)
+		if index < previous {
+			t.Fatalf("sketchIndex(%d) = %d, below the previous %d", v, index, previous)
+		}
+		if mid := sketchValue(index); math.Abs(float64(mid-v)) > float64(v)/sketchSubBuckets+1 {
+			t.Fatalf("sketchValue(sketchIndex(%d)) = %d, too far off", v, mid)
+		}
+		previous = index
+	}
+}
+
+func TestAggregationWindowReplacesPoints(t *testing.T) {
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithAggregationWindow(time.Hour), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	for i := 0; i < 10; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/aggregate/orders", nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/aggregate/orders?fail=1", nil))
+	select {
+	case metrics := <-received:
+		t.Fatalf("per-request point sent while aggregating: %v", metrics.Tags)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	currentAggregator().flush()
+	metrics := nextMetrics(t)
+	if metrics.Tags["endpoint"] != "/aggregate/orders" || metrics.Tags["aggregation"] != "window" {
+		t.Errorf("tags = %v", metrics.Tags)
+	}
+	if metrics.Fields["window_requests"] != float64(11) || metrics.Fields["window_errors"] != float64(1) {
+		t.Errorf("window_requests, window_errors = %v, %v, want 11, 1", metrics.Fields["window_requests"], metrics.Fields["window_errors"])
+	}
+	for _, name := range []string{"latency_p50_ms", "latency_p95_ms", "latency_p99_ms"} {
+		if _, ok := metrics.Fields[name].(float64); !ok {
+			t.Errorf("%s = %v, want a number", name, metrics.Fields[name])
+		}
+	}
+}
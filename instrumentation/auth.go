@@ -0,0 +1,52 @@
+package instrumentation
+
+import (
+	"context"
+	"fmt"
+)
+
+// RegistryAuthConfig authenticates the WebSocket handshakes with the registry.
+// The token is sent as "Authorization: Bearer <token>" unless QueryParam is
+// set.
+type RegistryAuthConfig struct {
+	Token string `json:"token"`
+	// TokenSecret names the secret holding the token, fetched from the
+	// SecretProvider of the config for every connection, so that a rotated
+	// token is used from the next reconnection on.
+	TokenSecret string `json:"token_secret"`
+	// QueryParam sends the token as this query parameter of the registry
+	// URL instead, for proxies that drop the Authorization header.
+	QueryParam string `json:"query_param"`
+}
+
+var (
+	// registryAuth is the RegistryAuth of the applied config.
+	registryAuth RegistryAuthConfig
+	// registrySecrets is the SecretProvider of the applied config.
+	registrySecrets SecretProvider
+)
+
+// registryToken returns the transport token function of auth, nil when it
+// has no token. Secrets are fetched from provider.
+func registryToken(auth RegistryAuthConfig, provider SecretProvider) func(ctx context.Context) (string, error) {
+	switch {
+	case auth.TokenSecret != "":
+		return func(ctx context.Context) (string, error) {
+			if provider == nil {
+				return "", fmt.Errorf("registry_auth.token_secret %q is set but no SecretProvider is configured", auth.TokenSecret)
+			}
+			ctx, cancel := context.WithTimeout(ctx, secretFetchTimeout)
+			defer cancel()
+			t, err := provider.GetSecret(ctx, auth.TokenSecret)
+			if err != nil {
+				return "", fmt.Errorf("error fetching registry token secret %q: %w", auth.TokenSecret, err)
+			}
+			return t, nil
+		}
+	case auth.Token != "":
+		return func(context.Context) (string, error) {
+			return auth.Token, nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package instrumentation
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// authRegistry is a fake registry accepting connections that present want,
+// as a bearer token or the token query parameter. It passes on the token of
+// every accepted connection, and closes each after one message.
+func authRegistry(t *testing.T, want func() string) (url string, accepted chan string) {
+	accepted = make(chan string, 4)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if q := r.URL.Query().Get("token"); q != "" {
+			token = q
+		}
+		if token != want() {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, _, err := c.ReadMessage(); err != nil {
+			return
+		}
+		accepted <- token
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http"), accepted
+}
+
+func nextToken(t *testing.T, accepted chan string) string {
+	t.Helper()
+	select {
+	case token := <-accepted:
+		return token
+	case <-time.After(5 * time.Second):
+		t.Fatal("no authenticated connection")
+		return ""
+	}
+}
+
+func TestRegistryAuthReauthenticatesOnReconnect(t *testing.T) {
+	var secret atomic.Value
+	secret.Store("token-1")
+	registryURL, accepted := authRegistry(t, func() string { return secret.Load().(string) })
+
+	provider := SecretProviderFunc(func(ctx context.Context, name string) (string, error) {
+		return secret.Load().(string), nil
+	})
+	err := Configure(registryURL, "test-service", "", "", "", "", func(c *Config) {
+		c.SecretProvider = provider
+	}, WithRegistryAuth(RegistryAuthConfig{TokenSecret: "registry#token"}), WithoutSendQueue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := sendMetrics(Metrics{Measurement: "test-service"}); err != nil {
+		t.Fatal(err)
+	}
+	if token := nextToken(t, accepted); token != "token-1" {
+		t.Errorf("token = %q, want token-1", token)
+	}
+
+	// The registry closed the connection; the next one uses the rotated token
+	secret.Store("token-2")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, connected := currentRegistry().Connection(); !connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the registry connection wasn't dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := sendMetrics(Metrics{Measurement: "test-service"}); err != nil {
+		t.Fatal(err)
+	}
+	if token := nextToken(t, accepted); token != "token-2" {
+		t.Errorf("token = %q after reconnecting, want token-2", token)
+	}
+}
+
+func TestRegistryAuthQueryParam(t *testing.T) {
+	registryURL, accepted := authRegistry(t, func() string { return "query-token" })
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := Configure(registryURL, "test-service", "", "", "", "", WithRegistryAuth(RegistryAuthConfig{Token: "wrong"}), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	err := sendMetrics(Metrics{Measurement: "test-service"})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("sendMetrics with a rejected token = %v, want a 401 error", err)
+	}
+
+	if err := Configure(registryURL, "test-service", "", "", "", "", WithRegistryAuth(RegistryAuthConfig{Token: "query-token", QueryParam: "token"}), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendMetrics(Metrics{Measurement: "test-service"}); err != nil {
+		t.Fatal(err)
+	}
+	if token := nextToken(t, accepted); token != "query-token" {
+		t.Errorf("token = %q, want query-token", token)
+	}
+}
+
+func TestRegistryAuthValidation(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "orders", RegistryAuth: RegistryAuthConfig{Token: "t", TokenSecret: "s", QueryParam: "token"}}
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cannot be combined with registry_auth.token") || !strings.Contains(err.Error(), "requires a SecretProvider") {
+		t.Errorf("Validate = %v", err)
+	}
+	cfg.RegistryAuth = RegistryAuthConfig{QueryParam: "token"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "registry_auth.query_param") {
+		t.Errorf("Validate = %v, want a query_param error", err)
+	}
+}
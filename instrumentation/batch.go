@@ -0,0 +1,134 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchSize = 500
+	// batchMaxPending bounds the points waiting while the registry is
+	// unreachable, in batches
+	batchMaxPending = 10
+)
+
+var (
+	batchingMu sync.Mutex
+	// batching accumulates the points sent to the registry and writes them
+	// as one frame holding a JSON array every interval, or as soon as size
+	// are pending
+	batching *pendingBatch[Metrics]
+)
+
+// startBatching replaces the batcher of any previously applied config, keeping
+// it when BatchInterval and BatchSize are unchanged. A replaced batcher writes
+// its pending points in the background.
+func startBatching(cfg Config) {
+	batchingMu.Lock()
+	defer batchingMu.Unlock()
+	size := cfg.BatchSize
+	if size == 0 {
+		size = defaultBatchSize
+	}
+	if batching != nil && batching.interval == time.Duration(cfg.BatchInterval) && batching.size == size {
+		return
+	}
+	if previous := batching; previous != nil {
+		previous.stop()
+		go func() {
+			if err := previous.flush(context.Background()); err != nil {
+				logSendError(err)
+			}
+		}()
+		batching = nil
+	}
+	if cfg.BatchInterval == 0 {
+		return
+	}
+	batching = &pendingBatch[Metrics]{
+		size:          size,
+		maxBatches:    batchMaxPending,
+		interval:      time.Duration(cfg.BatchInterval),
+		submit:        submitBatch,
+		logError:      logSendError,
+		droppedFormat: "Dropped %d points while the registry was unreachable\n",
+	}
+	batching.start()
+}
+
+// stopBatching writes the pending points and stops the batcher. The write is
+// bounded by the connection's write deadline rather than ctx.
+func stopBatching(ctx context.Context) error {
+	batchingMu.Lock()
+	b := batching
+	batching = nil
+	batchingMu.Unlock()
+	if b == nil {
+		return nil
+	}
+	b.stop()
+	flushed := make(chan error, 1)
+	go func() { flushed <- b.flush(context.Background()) }()
+	select {
+	case err := <-flushed:
+		if err != nil {
+			return fmt.Errorf("error sending the batched metrics: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error sending the batched metrics: %w", ctx.Err())
+	}
+}
+
+// batchPoint queues a point for the registry when batching is enabled, and
+// reports whether it did.
+func batchPoint(metrics Metrics) bool {
+	batchingMu.Lock()
+	b := batching
+	batchingMu.Unlock()
+	if b == nil {
+		return false
+	}
+	if dropped := b.add(metrics); dropped > 0 {
+		currentPipeline().recordDropped(dropped)
+	}
+	return true
+}
+
+// submitBatch writes a batch of points to the registry. Writes are bounded by
+// the connection's write deadline rather than ctx. A batch that can't be
+// written is spilled to disk when a spill is configured, and dropped
+// otherwise.
+func submitBatch(ctx context.Context, batch []Metrics) error {
+	if err := writeBatch(batch); err != nil {
+		if errors.Is(err, errRateLimited) {
+			currentPipeline().recordRateLimited(len(batch))
+			return nil
+		}
+		if spillPoints(batch) {
+			return nil
+		}
+		currentPipeline().recordFailed(len(batch))
+		return fmt.Errorf("dropped %d points: %w", len(batch), err)
+	}
+	return nil
+}
+
+// writeBatch writes points to the registry as one frame. Their token is read
+// now rather than when they were queued, in case it was rotated meanwhile.
+func writeBatch(points []Metrics) error {
+	token := currentToken()
+	for i := range points {
+		if points[i].InfluxDBURL == influxDBURL {
+			points[i].Token = token
+		}
+	}
+	wire := make([]Metrics, len(points))
+	for i, point := range points {
+		wire[i] = wirePoint(point)
+	}
+	return writeFrame(wire)
+}
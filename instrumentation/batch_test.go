@@ -0,0 +1,129 @@
+package instrumentation
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/jculley01/observability-module/protocol"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// batchRegistry is a fake registry passing on the frames it reads.
+func batchRegistry(t *testing.T) (url string, frames chan []byte) {
+	frames = make(chan []byte, 16)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			frames <- data
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http"), frames
+}
+
+func nextBatch(t *testing.T, frames chan []byte) []Metrics {
+	t.Helper()
+	_, batch := nextSessionBatch(t, frames)
+	return batch
+}
+
+// nextSessionBatch returns the next batch, and the last session frame read
+// before it, if any.
+func nextSessionBatch(t *testing.T, frames chan []byte) (protocol.Session, []Metrics) {
+	t.Helper()
+	var session protocol.Session
+	for {
+		select {
+		case data := <-frames:
+			if s, ok := protocol.DecodeSession(data); ok {
+				session = s
+				continue
+			}
+			var batch []Metrics
+			if err := json.Unmarshal(data, &batch); err != nil {
+				t.Fatalf("frame %s isn't a batch: %v", data, err)
+			}
+			return session, batch
+		case <-time.After(5 * time.Second):
+			t.Fatal("no batch received")
+			return session, nil
+		}
+	}
+}
+
+func TestBatchingWritesFullBatches(t *testing.T) {
+	registryURL, frames := batchRegistry(t)
+	if err := Configure(registryURL, "test-service", "http://influxdb:8086", "old-token", "", "", WithBatching(time.Hour, 3), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		if err := Send(Metrics{Fields: map[string]interface{}{"i": i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := nextBatch(t, frames)
+	if len(batch) != 3 || batch[0].Fields["i"] != float64(0) || batch[2].Fields["i"] != float64(2) {
+		t.Fatalf("first batch = %+v, want points 0 to 2", batch)
+	}
+	if err := Send(Metrics{Fields: map[string]interface{}{"i": 3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last point is written on Shutdown, after the session with the
+	// token current then
+	RotateToken("new-token")
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	session, batch := nextSessionBatch(t, frames)
+	if len(batch) == 0 || batch[0].Fields["i"] != float64(3) || batch[0].Token != "" || session.Token != "new-token" {
+		t.Errorf("batch written on Shutdown = %+v after %+v, want point 3 after a session with the new token", batch, session)
+	}
+}
+
+func TestBatchingFlushesEveryInterval(t *testing.T) {
+	registryURL, frames := batchRegistry(t)
+	if err := Configure(registryURL, "test-service", "", "", "", "", WithBatching(10*time.Millisecond, 0), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Closes the connection to registryURL
+	defer Shutdown(context.Background())
+
+	for i := 0; i < 2; i++ {
+		if err := Send(Metrics{Fields: map[string]interface{}{"i": i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var points int
+	for points < 2 {
+		points += len(nextBatch(t, frames))
+	}
+	if points != 2 {
+		t.Errorf("got %d points, want 2", points)
+	}
+}
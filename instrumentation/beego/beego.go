@@ -0,0 +1,46 @@
+// Package beego instruments Beego v2 applications. It lives in its own module so
+// that services not using Beego never pull it into their dependency graph.
+// Importing it (even blank) lets InstrumentEndpoint accept a *web.HttpServer.
+package beego
+
+import (
+	"github.com/beego/beego/v2/server/web"
+	beecontext "github.com/beego/beego/v2/server/web/context"
+	"github.com/jculley01/observability-module/instrumentation"
+	"net/http"
+)
+
+// filterPattern matches every route; it is the pattern Beego's own
+// filter/prometheus chain is installed with.
+const filterPattern = "*"
+
+func init() {
+	instrumentation.RegisterFrameworkAdapter(func(routerOrServer interface{}) bool {
+		app, ok := routerOrServer.(*web.HttpServer)
+		if !ok {
+			return false
+		}
+		app.InsertFilterChain(filterPattern, FilterChain)
+		return true
+	})
+}
+
+// FilterChain reports the same Metrics payload as the other framework
+// middlewares by running the rest of the Beego chain inside
+// instrumentation.Middleware.
+func FilterChain(next web.FilterFunc) web.FilterFunc {
+	return func(ctx *beecontext.Context) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Beego writes through ctx, so point it at the instrumented writer
+			ctx.ResponseWriter.ResponseWriter = w
+			ctx.Request = r
+			next(ctx)
+			// Routing happens inside the chain; Beego's prometheus filter reads
+			// the matched pattern the same way
+			if route, ok := ctx.Input.GetData("RouterPattern").(string); ok && route != "" {
+				instrumentation.SetRoute(r, route)
+			}
+		})
+		instrumentation.Middleware(handler).ServeHTTP(ctx.ResponseWriter.ResponseWriter, ctx.Request)
+	}
+}
@@ -0,0 +1,67 @@
+package beego
+
+import (
+	"github.com/beego/beego/v2/server/web"
+	beecontext "github.com/beego/beego/v2/server/web/context"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/instrumentation/instrumentationtest"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// collector is shared by the tests, as the registry connection is global.
+var collector *instrumentationtest.Collector
+
+func TestMain(m *testing.M) {
+	collector = instrumentationtest.NewCollector()
+	code := m.Run()
+	collector.Close()
+	os.Exit(code)
+}
+
+func TestFilterChainReportsRequests(t *testing.T) {
+	app := web.NewHttpSever()
+	app.Get("/", func(ctx *beecontext.Context) {
+		ctx.Output.Body([]byte("home"))
+	})
+	app.Get("/users/:id", func(ctx *beecontext.Context) {
+		ctx.Output.SetStatus(http.StatusNotFound)
+		ctx.Output.Body([]byte("missing"))
+	})
+	if err := instrumentation.InstrumentEndpoint(app, collector.URL, "beego-test", "", "", "", ""); err != nil {
+		t.Fatalf("InstrumentEndpoint: %v", err)
+	}
+	// Run builds the filter chains; serving the handlers directly doesn't
+	app.Handlers.Init()
+
+	cases := []struct {
+		path     string
+		endpoint string
+		status   float64
+		size     float64
+	}{
+		// The root path must be matched by the "*" filter pattern too
+		{"/", "/", http.StatusOK, 4},
+		{"/users/42", "/users/:id", http.StatusNotFound, 7},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		app.Handlers.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != int(tc.status) {
+			t.Fatalf("%s: handler status = %d, want %v", tc.path, rec.Code, tc.status)
+		}
+
+		m := collector.Next(t)
+		if m.Tags["endpoint"] != tc.endpoint {
+			t.Errorf("endpoint tag = %q, want %q", m.Tags["endpoint"], tc.endpoint)
+		}
+		if m.Fields["status_code"] != tc.status {
+			t.Errorf("%s: status_code = %v, want %v", tc.path, m.Fields["status_code"], tc.status)
+		}
+		if m.Fields["response_size"] != tc.size {
+			t.Errorf("%s: response_size = %v, want %v", tc.path, m.Fields["response_size"], tc.size)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package instrumentation
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// defaultBodyPeekLimit caps how much of a request body is buffered when it has
+// to be inspected, so large uploads are never read into memory.
+const defaultBodyPeekLimit = 64 << 10
+
+// bodyPeekLimit returns the configured peek cap.
+func bodyPeekLimit() int {
+	if limit := loadSettings().bodyPeekLimit; limit > 0 {
+		return limit
+	}
+	return defaultBodyPeekLimit
+}
+
+// peekRequestBody reads up to limit bytes of the body before the handler runs
+// and replays those bytes ahead of the rest of the stream. It reports false
+// when there is no body or the read failed, in which case the partial bytes
+// shouldn't be used; the handler will see the same read error.
+func peekRequestBody(r *http.Request, limit int) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, false
+	}
+	peeked, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)))
+	r.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(peeked), r.Body), Closer: r.Body}
+	return peeked, err == nil
+}
+
+// teeRequestBody copies the first bytes the handler reads from the body into a
+// capped buffer, without reading anything itself. It suits features that look
+// at the payload after the handler has run.
+func teeRequestBody(r *http.Request) *cappedBuffer {
+	captured := &cappedBuffer{limit: bodyPeekLimit()}
+	if r.Body == nil || r.Body == http.NoBody {
+		return captured
+	}
+	r.Body = &replayBody{Reader: io.TeeReader(r.Body, captured), Closer: r.Body}
+	return captured
+}
+
+// replayBody serves a substitute reader for a request body while still closing
+// the original body.
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// cappedBuffer keeps the first limit bytes written to it and silently drops the
+// rest, recording that it did.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// Write never fails, so it can sit behind an io.TeeReader without affecting
+// the handler's reads.
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	b.buf.Write(p)
+	return len(p), nil
+}
+
+// Bytes returns the captured bytes.
+func (b *cappedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// Truncated reports whether more bytes were seen than were kept.
+func (b *cappedBuffer) Truncated() bool {
+	return b.truncated
+}
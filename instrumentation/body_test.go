@@ -0,0 +1,49 @@
+package instrumentation
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPeekRequestBodyHonoursLimit(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{WithBodyPeekLimit(4)})
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789"))
+	peeked, ok := peekRequestBody(r, bodyPeekLimit())
+	if !ok || string(peeked) != "0123" {
+		t.Errorf("peeked = %q, %v; want \"0123\", true", peeked, ok)
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != "0123456789" {
+		t.Errorf("handler body = %q, want the full body", body)
+	}
+}
+
+func TestPeekRequestBodyWithoutBody(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, ok := peekRequestBody(r, bodyPeekLimit()); ok {
+		t.Error("peekRequestBody reported a body for a request without one")
+	}
+}
+
+func TestTeeRequestBodyCapturesWhatHandlerReads(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{WithBodyPeekLimit(6)})
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello, world"))
+	captured := teeRequestBody(r)
+	if len(captured.Bytes()) != 0 {
+		t.Fatal("teeRequestBody read the body before the handler did")
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	if string(body) != "hello, world" {
+		t.Errorf("handler body = %q", body)
+	}
+	if string(captured.Bytes()) != "hello," || !captured.Truncated() {
+		t.Errorf("captured = %q (truncated %v), want \"hello,\" truncated", captured.Bytes(), captured.Truncated())
+	}
+}
@@ -0,0 +1,215 @@
+package instrumentation
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultCoolDown is how long an open circuit breaker refuses sends when
+// CircuitBreakerConfig.CoolDown is zero.
+const defaultCoolDown = 30 * time.Second
+
+// Circuit breaker states, as returned by CircuitBreakerStates and tagged on
+// circuit_breaker events.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// registryBackend names the registry's circuit breaker.
+const registryBackend = "registry"
+
+// ErrCircuitOpen is returned for points that weren't sent to the registry
+// because its circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreakerConfig stops sending to a backend, the registry or an
+// exporter, that keeps failing, so a delivery problem doesn't cost every
+// request a timeout and a log line.
+type CircuitBreakerConfig struct {
+	// Failures is how many consecutive failed sends open the breaker of a
+	// backend; zero disables the breakers.
+	Failures int `json:"failures"`
+	// CoolDown is how long an open breaker refuses sends before letting one
+	// through to probe the backend (30s if zero). A successful probe closes
+	// it; a failed one opens it for another CoolDown.
+	CoolDown Duration `json:"cool_down"`
+}
+
+// circuitBreaker guards the sends to one backend. A nil breaker allows
+// everything.
+type circuitBreaker struct {
+	backend  string
+	failures int
+	coolDown time.Duration
+
+	mu    sync.Mutex
+	state string
+	// consecutive counts the failed sends since the last successful one
+	consecutive int
+	openedAt    time.Time
+	// probing is set while the send probing a half-open backend is in flight
+	probing bool
+}
+
+// newCircuitBreaker returns the breaker of a backend, nil when cfg disables
+// breakers.
+func newCircuitBreaker(backend string, cfg CircuitBreakerConfig) *circuitBreaker {
+	if cfg.Failures <= 0 {
+		return nil
+	}
+	coolDown := time.Duration(cfg.CoolDown)
+	if coolDown <= 0 {
+		coolDown = defaultCoolDown
+	}
+	return &circuitBreaker{backend: backend, failures: cfg.Failures, coolDown: coolDown, state: BreakerClosed}
+}
+
+// allow reports whether a send may be attempted; each allowed send must be
+// followed by record. Once the cool-down of an open breaker has passed, one
+// send at a time is let through to probe the backend.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.coolDown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+	default:
+		return true
+	}
+	b.probing = true
+	return true
+}
+
+// record records the outcome of a send allowed by allow. Opening and closing
+// the breaker is logged and reported as a circuit_breaker event.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	from := b.state
+	b.probing = false
+	if err == nil {
+		b.consecutive = 0
+		b.state = BreakerClosed
+	} else {
+		b.consecutive++
+		if from == BreakerHalfOpen || b.consecutive >= b.failures {
+			b.state = BreakerOpen
+			b.openedAt = time.Now()
+		}
+	}
+	to, consecutive := b.state, b.consecutive
+	b.mu.Unlock()
+
+	switch {
+	case from == BreakerClosed && to == BreakerOpen:
+		log.Printf("Circuit breaker for %s opened after %d failed sends, last: %v; retrying in %s\n", b.backend, consecutive, err, b.coolDown)
+	case from != BreakerClosed && to == BreakerClosed:
+		log.Printf("Circuit breaker for %s closed\n", b.backend)
+	default:
+		return
+	}
+	// Not sent inline: the send may be running under the lock of a batcher
+	// or exporter
+	breakerEvents.Add(1)
+	go func() {
+		defer breakerEvents.Done()
+		sendEvent("circuit_breaker", map[string]string{"backend": b.backend, "state": to}, map[string]interface{}{
+			"consecutive_failures": consecutive,
+			"cool_down_seconds":    b.coolDown.Seconds(),
+		})
+	}()
+}
+
+func (b *circuitBreaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+var (
+	breakersMu sync.Mutex
+	// breakerConfig is the CircuitBreaker of the applied config
+	breakerConfig   CircuitBreakerConfig
+	registryBreaker *circuitBreaker
+	// breakerEvents tracks the circuit_breaker events being sent
+	breakerEvents sync.WaitGroup
+)
+
+// startCircuitBreakers replaces the registry's breaker of any previously
+// applied config, keeping it, and its state, when the config is unchanged.
+// Exporters get theirs from startExporters.
+func startCircuitBreakers(cfg Config) {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	if registryBreaker != nil && breakerConfig == cfg.CircuitBreaker {
+		return
+	}
+	breakerConfig = cfg.CircuitBreaker
+	registryBreaker = newCircuitBreaker(registryBackend, cfg.CircuitBreaker)
+}
+
+func loadRegistryBreaker() *circuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	return registryBreaker
+}
+
+// CircuitBreakerStates returns the state of the circuit breaker of the
+// registry and of each exporter, e.g. for a health check. It is empty when
+// breakers are disabled.
+func CircuitBreakerStates() map[string]string {
+	states := map[string]string{}
+	if b := loadRegistryBreaker(); b != nil {
+		states[b.backend] = b.currentState()
+	}
+	exportersMu.Lock()
+	workers := exportWorkers
+	exportersMu.Unlock()
+	for _, w := range workers {
+		if w.breaker != nil {
+			states[w.breaker.backend] = w.breaker.currentState()
+		}
+	}
+	return states
+}
+
+// sendGuarded runs send unless the registry's breaker is open.
+func sendGuarded(send func() error) error {
+	b := loadRegistryBreaker()
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+	err := send()
+	b.record(err)
+	return err
+}
+
+// logSendError logs a failed send, except for sends refused by an open
+// circuit breaker, which was logged once when it opened.
+func logSendError(err error) {
+	if !errors.Is(err, ErrCircuitOpen) {
+		log.Printf("Error sending metrics: %v\n", err)
+	}
+}
+
+// exporterBackend names the breaker of the i-th exporter.
+func exporterBackend(i int, exporter Exporter) string {
+	return fmt.Sprintf("exporter_%d_%T", i, exporter)
+}
@@ -0,0 +1,176 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyExporter fails while failing is set, counting the request points
+// passed to it.
+type flakyExporter struct {
+	failing atomic.Bool
+	mu      sync.Mutex
+	calls   int
+}
+
+func (e *flakyExporter) Export(point Metrics) error {
+	if point.Tags["event"] == "" {
+		e.mu.Lock()
+		e.calls++
+		e.mu.Unlock()
+	}
+	if e.failing.Load() {
+		return errors.New("backend down")
+	}
+	return nil
+}
+
+func (e *flakyExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (e *flakyExporter) callCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls
+}
+
+// nextBreakerEvent skips the points received until a circuit_breaker event of
+// backend.
+func nextBreakerEvent(t *testing.T, backend string) Metrics {
+	t.Helper()
+	for {
+		if metrics := nextMetrics(t); metrics.Tags["event"] == "circuit_breaker" && metrics.Tags["backend"] == backend {
+			return metrics
+		}
+	}
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	b := newCircuitBreaker("test", CircuitBreakerConfig{Failures: 2, CoolDown: Duration(50 * time.Millisecond)})
+	failure := errors.New("unreachable")
+
+	b.record(failure)
+	if !b.allow() {
+		t.Fatal("breaker opened before 2 failures")
+	}
+	b.record(failure)
+	if b.allow() || b.currentState() != BreakerOpen {
+		t.Fatalf("breaker %s after 2 failures, want open", b.currentState())
+	}
+
+	// After the cool-down, a single probe goes through, and reopens it
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() || b.allow() {
+		t.Fatal("want exactly one probe once the cool-down passed")
+	}
+	b.record(failure)
+	if b.allow() {
+		t.Fatal("a failed probe didn't reopen the breaker")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("no probe after the second cool-down")
+	}
+	b.record(nil)
+	if !b.allow() || !b.allow() || b.currentState() != BreakerClosed {
+		t.Fatalf("breaker %s after a successful probe, want closed", b.currentState())
+	}
+
+	if newCircuitBreaker("test", CircuitBreakerConfig{}) != nil {
+		t.Error("breakers are enabled without failures")
+	}
+
+	// Opening and closing were reported, not the failed probe
+	for _, want := range []string{BreakerOpen, BreakerClosed} {
+		if event := nextBreakerEvent(t, "test"); event.Tags["state"] != want {
+			t.Errorf("event state = %s, want %s", event.Tags["state"], want)
+		}
+	}
+}
+
+func TestCircuitBreakerFailsFastOnUnreachableRegistry(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	registryURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	server.Close()
+
+	if err := Configure(registryURL, "test-service", "", "", "", "", WithCircuitBreaker(2, time.Hour), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := sendMetrics(Metrics{Measurement: "test-service"}); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("send %d = %v, want a dial error", i, err)
+		}
+	}
+	if err := sendMetrics(Metrics{Measurement: "test-service"}); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("send with the breaker open = %v, want ErrCircuitOpen", err)
+	}
+	if state := CircuitBreakerStates()[registryBackend]; state != BreakerOpen {
+		t.Errorf("registry breaker = %q, want open", state)
+	}
+	// Not to send the event to the collector of the next tests
+	breakerEvents.Wait()
+}
+
+func TestCircuitBreakerSkipsFailingExporter(t *testing.T) {
+	exporter := &flakyExporter{}
+	exporter.failing.Store(true)
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithExporter(exporter), WithCircuitBreaker(2, 200*time.Millisecond), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	backend := exporterBackend(0, exporter)
+
+	for i := 0; i < 4; i++ {
+		export(Metrics{Measurement: "test-service"})
+	}
+	event := nextBreakerEvent(t, backend)
+	if event.Tags["state"] != BreakerOpen || event.Fields["consecutive_failures"] != float64(2) {
+		t.Errorf("event = %+v, want %s opened after 2 failures", event, backend)
+	}
+	if state := CircuitBreakerStates()[backend]; state != BreakerOpen {
+		t.Errorf("exporter breaker = %q, want open", state)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if calls := exporter.callCount(); calls != 2 {
+		t.Errorf("exporter called %d times, want 2 before its breaker opened", calls)
+	}
+
+	// Once the backend is back, the probe after the cool-down closes it
+	exporter.failing.Store(false)
+	time.Sleep(250 * time.Millisecond)
+	export(Metrics{Measurement: "test-service"})
+	event = nextBreakerEvent(t, backend)
+	if event.Tags["state"] != BreakerClosed {
+		t.Errorf("event = %+v, want %s closed", event, backend)
+	}
+	if calls := exporter.callCount(); calls != 3 {
+		t.Errorf("exporter called %d times, want 3", calls)
+	}
+}
+
+func TestCircuitBreakerValidation(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "orders", CircuitBreaker: CircuitBreakerConfig{Failures: -1, CoolDown: Duration(-time.Second)}}
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "circuit_breaker.failures") || !strings.Contains(err.Error(), "circuit_breaker.cool_down") {
+		t.Errorf("Validate = %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package instrumentation
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/jculley01/observability-module/protocol"
+	"github.com/jculley01/observability-module/transport"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pcapngContentType = "application/x-pcapng"
+	// linktypeWiresharkUpperPDU carries payloads with the name of the
+	// Wireshark dissector to decode them with
+	linktypeWiresharkUpperPDU = 252
+	// captureStreamBuffer is how many frames a DebugCaptureHandler client can
+	// lag behind before frames are dropped
+	captureStreamBuffer = 256
+	redactedSecret      = "[REDACTED]"
+)
+
+var (
+	captureMu sync.Mutex
+	// captureFile is the DebugCaptureFile of the applied config
+	captureFile    *os.File
+	capturePath    string
+	captureStreams = map[chan []byte]struct{}{}
+)
+
+// capturing is set while frames are captured, so they are only copied and
+// redacted then.
+var capturing atomic.Bool
+
+// startDebugCapture replaces the capture file of any previously applied
+// config, keeping it when its path is unchanged. Captures are appended to the
+// file, each as a section of its own.
+func startDebugCapture(cfg Config) error {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	if captureFile != nil && capturePath == cfg.DebugCaptureFile {
+		return nil
+	}
+	if captureFile != nil {
+		if err := captureFile.Close(); err != nil {
+			log.Printf("Error closing the debug capture: %v\n", err)
+		}
+		captureFile, capturePath = nil, ""
+	}
+	if cfg.DebugCaptureFile != "" {
+		file, err := os.OpenFile(cfg.DebugCaptureFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("error opening the debug capture: %w", err)
+		}
+		if _, err := file.Write(pcapngHeader()); err != nil {
+			file.Close()
+			return fmt.Errorf("error writing the debug capture: %w", err)
+		}
+		captureFile, capturePath = file, cfg.DebugCaptureFile
+	}
+	capturing.Store(captureFile != nil || len(captureStreams) > 0)
+	return nil
+}
+
+// DebugCaptureHandler streams the frames sent to the registry while the
+// request lasts, like DebugCaptureFile, for Wireshark to read live:
+//
+//	curl -sN http://localhost:6060/debug/capture | wireshark -k -i -
+//
+// Mount it on an internal port only: points carry request details.
+func DebugCaptureHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", pcapngContentType)
+		if _, err := w.Write(pcapngHeader()); err != nil {
+			return
+		}
+		flusher, _ := w.(http.Flusher)
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		frames := make(chan []byte, captureStreamBuffer)
+		captureMu.Lock()
+		captureStreams[frames] = struct{}{}
+		capturing.Store(true)
+		captureMu.Unlock()
+		defer func() {
+			captureMu.Lock()
+			delete(captureStreams, frames)
+			capturing.Store(captureFile != nil || len(captureStreams) > 0)
+			captureMu.Unlock()
+		}()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case block := <-frames:
+				if _, err := w.Write(block); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+	})
+}
+
+// captureRegistryFrame captures a frame written to the registry, with the
+// tokens of the session and of the points of text and binary frames
+// redacted.
+func captureRegistryFrame(conn transport.ConnInfo, frameType string, payload []byte) {
+	if !capturing.Load() {
+		return
+	}
+	if frameType != "text" && frameType != "binary" {
+		captureFrame(conn, frameType, "data", payload)
+		return
+	}
+	var redacted []byte
+	var err error
+	dissector := "json"
+	if session, ok := protocol.DecodeSession(payload); ok && frameType == "text" {
+		if session.Token != "" {
+			session.Token = redactedSecret
+		}
+		redacted, err = protocol.EncodeSession(session)
+	} else if _, ok := protocol.DecodeSequence(payload); ok && frameType == "text" {
+		redacted = payload
+	} else if codec := currentCodec(); codec == protocol.JSON {
+		redacted, err = redactTokens(payload)
+	} else {
+		redacted, err = redactCodecTokens(codec, payload)
+		dissector = "data"
+		if frameType == "text" {
+			dissector = "data-text-lines"
+		}
+	}
+	if err != nil {
+		log.Printf("Error redacting a captured frame: %v\n", err)
+		return
+	}
+	captureFrame(conn, frameType, dissector, redacted)
+}
+
+// redactTokens redacts the token of the point, or each point of the batch a
+// JSON frame carries. Numbers are kept as they were written.
+func redactTokens(payload []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if len(payload) > 0 && payload[0] == '[' {
+		var points []Metrics
+		if err := decoder.Decode(&points); err != nil {
+			return nil, err
+		}
+		for i := range points {
+			if points[i].Token != "" {
+				points[i].Token = redactedSecret
+			}
+		}
+		return json.Marshal(points)
+	}
+	var metrics Metrics
+	if err := decoder.Decode(&metrics); err != nil {
+		return nil, err
+	}
+	if metrics.Token != "" {
+		metrics.Token = redactedSecret
+	}
+	return json.Marshal(metrics)
+}
+
+// redactCodecTokens redacts the tokens of the points of a frame of another
+// codec than JSON. Frames without tokens are kept as they were written.
+func redactCodecTokens(codec protocol.Codec, payload []byte) ([]byte, error) {
+	points, err := codec.Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	redacted := false
+	for i := range points {
+		if points[i].Token != "" {
+			points[i].Token = redactedSecret
+			redacted = true
+		}
+	}
+	if !redacted {
+		return payload, nil
+	}
+	return codec.Encode(points)
+}
+
+// captureFrame mirrors a frame sent on conn to the capture file and streams.
+// dissector is the Wireshark dissector of the payload.
+func captureFrame(conn transport.ConnInfo, frameType, dissector string, payload []byte) {
+	comment := fmt.Sprintf("conn %d %s frame %s -> %s", conn.ID, frameType, conn.LocalAddr, conn.RemoteAddr)
+	block := pcapngPacket(time.Now(), dissector, payload, comment)
+
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	if captureFile != nil {
+		if _, err := captureFile.Write(block); err != nil {
+			log.Printf("Error writing the debug capture: %v\n", err)
+		}
+	}
+	for frames := range captureStreams {
+		select {
+		case frames <- block:
+		default:
+			// The client is too slow; Wireshark shows the gap in timestamps
+		}
+	}
+}
+
+// pcapngHeader returns the section header and interface description blocks
+// starting a pcapng capture.
+func pcapngHeader() []byte {
+	var b []byte
+	// Section header: byte-order magic, version 1.0, unknown section length
+	b = binary.LittleEndian.AppendUint32(b, 0x0A0D0D0A)
+	b = binary.LittleEndian.AppendUint32(b, 28)
+	b = binary.LittleEndian.AppendUint32(b, 0x1A2B3C4D)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint64(b, 0xFFFFFFFFFFFFFFFF)
+	b = binary.LittleEndian.AppendUint32(b, 28)
+	// Interface description, with microsecond timestamps by default
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, 20)
+	b = binary.LittleEndian.AppendUint16(b, linktypeWiresharkUpperPDU)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 20)
+	return b
+}
+
+// pcapngPacket returns an enhanced packet block holding payload, to be decoded
+// with dissector, and comment.
+func pcapngPacket(at time.Time, dissector string, payload []byte, comment string) []byte {
+	// Exported PDU tags, big-endian: the dissector name, then the end of tags
+	var data []byte
+	data = binary.BigEndian.AppendUint16(data, 12)
+	data = binary.BigEndian.AppendUint16(data, uint16(padded(len(dissector))))
+	data = append(data, dissector...)
+	data = append(data, make([]byte, padded(len(dissector))-len(dissector))...)
+	data = binary.BigEndian.AppendUint32(data, 0)
+	data = append(data, payload...)
+
+	length := 32 + padded(len(data)) + 4 + padded(len(comment)) + 4
+	micros := uint64(at.UnixMicro())
+	var b []byte
+	b = binary.LittleEndian.AppendUint32(b, 6)
+	b = binary.LittleEndian.AppendUint32(b, uint32(length))
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, uint32(micros>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(micros))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	b = append(b, make([]byte, padded(len(data))-len(data))...)
+	// opt_comment, then opt_endofopt
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(comment)))
+	b = append(b, comment...)
+	b = append(b, make([]byte, padded(len(comment))-len(comment))...)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, uint32(length))
+	return b
+}
+
+// padded rounds n up to a multiple of 4, as pcapng fields are aligned.
+func padded(n int) int {
+	return (n + 3) &^ 3
+}
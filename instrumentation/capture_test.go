@@ -0,0 +1,180 @@
+package instrumentation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/jculley01/observability-module/protocol"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// capturedFrame is an enhanced packet block of a capture.
+type capturedFrame struct {
+	dissector string
+	payload   string
+	comment   string
+}
+
+// readCapture parses the pcapng blocks written by the debug capture.
+func readCapture(t *testing.T, r io.Reader) []capturedFrame {
+	t.Helper()
+	var frames []capturedFrame
+	for {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(r, head); err == io.EOF {
+			return frames
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, binary.LittleEndian.Uint32(head[4:])-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+		switch binary.LittleEndian.Uint32(head) {
+		case 0x0A0D0D0A:
+			if binary.LittleEndian.Uint32(body) != 0x1A2B3C4D {
+				t.Fatal("section header without the byte-order magic")
+			}
+		case 1:
+			if linktype := binary.LittleEndian.Uint16(body); linktype != linktypeWiresharkUpperPDU {
+				t.Fatalf("link type %d", linktype)
+			}
+		case 6:
+			length := int(binary.LittleEndian.Uint32(body[12:]))
+			data := body[20 : 20+length]
+			nameLength := int(binary.BigEndian.Uint16(data[2:]))
+			frame := capturedFrame{
+				dissector: strings.TrimRight(string(data[4:4+nameLength]), "\x00"),
+				payload:   string(data[4+nameLength+4:]),
+			}
+			options := body[20+padded(length):]
+			if binary.LittleEndian.Uint16(options) == 1 {
+				frame.comment = string(options[4 : 4+binary.LittleEndian.Uint16(options[2:])])
+			}
+			frames = append(frames, frame)
+		}
+	}
+}
+
+func TestDebugCaptureFileRedactsToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.pcapng")
+	if err := Configure(collectorURL, "test-service", "http://influxdb:8086", "secret-token", "", "", WithDebugCapture(path), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/capture/orders", nil))
+	nextMetrics(t)
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextMetrics(t); event.Tags["event"] != "service_deregistered" {
+		t.Fatalf("point after Shutdown = %v, want service_deregistered", event.Tags)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret-token")) {
+		t.Error("the capture holds the token")
+	}
+	frames := readCapture(t, bytes.NewReader(data))
+	if len(frames) != 4 {
+		t.Fatalf("captured %d frames, want the session, the point, the service_deregistered event and the close frame: %+v", len(frames), frames)
+	}
+	session, point, closing := frames[0], frames[1], frames[3]
+	if session.dissector != "json" || !strings.Contains(session.payload, `"type":"session"`) || !strings.Contains(session.payload, redactedSecret) {
+		t.Errorf("session frame = %+v", session)
+	}
+	if point.dissector != "json" || !strings.Contains(point.payload, `"/capture/orders"`) {
+		t.Errorf("point frame = %+v", point)
+	}
+	if !strings.HasPrefix(point.comment, "conn ") || !strings.Contains(point.comment, "text frame") {
+		t.Errorf("point frame comment = %q", point.comment)
+	}
+	if closing.dissector != "data" || !strings.Contains(closing.comment, "close frame") {
+		t.Errorf("close frame = %+v", closing)
+	}
+}
+
+func TestDebugCaptureHandlerStreamsFrames(t *testing.T) {
+	server := httptest.NewServer(DebugCaptureHandler())
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != pcapngContentType {
+		t.Errorf("Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+	body := bufio.NewReader(resp.Body)
+	if _, err := body.Peek(len(pcapngHeader())); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Send(Metrics{Fields: map[string]interface{}{"streamed": true}}); err != nil {
+		t.Fatal(err)
+	}
+	nextMetrics(t)
+	header := make([]byte, len(pcapngHeader()))
+	if _, err := io.ReadFull(body, header); err != nil {
+		t.Fatal(err)
+	}
+	// A new registry connection writes its session first
+	for i := 0; i < 2; i++ {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(body, head); err != nil {
+			t.Fatal(err)
+		}
+		block := make([]byte, binary.LittleEndian.Uint32(head[4:])-8)
+		if _, err := io.ReadFull(body, block); err != nil {
+			t.Fatal(err)
+		}
+		frames := readCapture(t, io.MultiReader(bytes.NewReader(header), bytes.NewReader(head), bytes.NewReader(block)))
+		if len(frames) != 1 {
+			t.Fatalf("streamed frames = %+v", frames)
+		}
+		if strings.Contains(frames[0].payload, `"type":"session"`) {
+			continue
+		}
+		if !strings.Contains(frames[0].payload, `"streamed":true`) {
+			t.Errorf("streamed frame = %+v", frames[0])
+		}
+		return
+	}
+	t.Error("the point wasn't streamed")
+}
+
+func TestRedactCodecTokens(t *testing.T) {
+	frame, err := protocol.EncodeBinaryFrame([]Metrics{{Token: "secret-token", Measurement: "orders"}, {Measurement: "orders"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted, err := redactCodecTokens(protocol.Protobuf, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err := protocol.DecodeBinaryFrame(redacted)
+	if err != nil || len(points) != 2 || points[0].Token != redactedSecret || points[1].Token != "" {
+		t.Errorf("redacted points = %+v, %v", points, err)
+	}
+}
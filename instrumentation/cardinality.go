@@ -0,0 +1,130 @@
+package instrumentation
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultMaxEndpoints is the default cap on distinct endpoint tag values.
+const defaultMaxEndpoints = 1000
+
+// overflowEndpoint is the endpoint tag used once the cap has been reached.
+const overflowEndpoint = "endpoint_overflow"
+
+// idPlaceholder replaces path segments that look like identifiers.
+const idPlaceholder = ":id"
+
+var (
+	seenEndpoints     sync.Map
+	seenEndpointCount int64
+)
+
+// endpointTag turns a route or raw path into the value used for the endpoint
+// tag and counters: identifiers are collapsed by the path normalizer and, once
+// the cap on distinct values is reached, new values go to overflowEndpoint.
+func endpointTag(path string) string {
+	normalize := NormalizePath
+	if s := loadSettings(); s.pathNormalizerSet {
+		normalize = s.pathNormalizer
+	}
+	if normalize != nil {
+		path = normalize(path)
+	}
+	return limitEndpoint(path)
+}
+
+// limitEndpoint admits endpoint values until the cap is reached. Values seen
+// before the cap was hit keep being reported under their own tag.
+func limitEndpoint(endpoint string) string {
+	if _, ok := seenEndpoints.Load(endpoint); ok {
+		return endpoint
+	}
+
+	limit := int64(loadSettings().maxEndpoints)
+	if limit <= 0 {
+		limit = defaultMaxEndpoints
+	}
+	if atomic.AddInt64(&seenEndpointCount, 1) > limit {
+		atomic.AddInt64(&seenEndpointCount, -1)
+		return overflowEndpoint
+	}
+	if _, loaded := seenEndpoints.LoadOrStore(endpoint, struct{}{}); loaded {
+		// Another request admitted the same value concurrently
+		atomic.AddInt64(&seenEndpointCount, -1)
+	}
+	return endpoint
+}
+
+// NormalizePath is the default path normalizer. It replaces numeric IDs, UUIDs
+// and hex hashes with ":id", e.g. "/orders/8f3a.../items/42" becomes
+// "/orders/:id/items/:id". Route templates pass through unchanged, and a
+// "#operation" suffix added by SOAP or JSON-RPC extraction is preserved.
+func NormalizePath(path string) string {
+	route, operation, hasOperation := strings.Cut(path, "#")
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		if isIdentifierSegment(segment) {
+			segments[i] = idPlaceholder
+		}
+	}
+	route = strings.Join(segments, "/")
+	if hasOperation {
+		return route + "#" + operation
+	}
+	return route
+}
+
+// isIdentifierSegment reports whether a path segment is a numeric ID, a UUID or
+// a hex hash (16 or more hex digits, with at least one digit).
+func isIdentifierSegment(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	if isDigits(segment) || isUUID(segment) {
+		return true
+	}
+	if len(segment) < 16 {
+		return false
+	}
+	hasDigit := false
+	for _, c := range segment {
+		switch {
+		case c >= '0' && c <= '9':
+			hasDigit = true
+		case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return hasDigit
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isUUID matches the canonical 8-4-4-4-12 hex form.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
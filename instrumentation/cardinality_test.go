@@ -0,0 +1,72 @@
+package instrumentation
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	cases := []struct {
+		path, want string
+	}{
+		{"/orders/8f3a9c2e7b1d4f60a5e3/items/42", "/orders/:id/items/:id"},
+		{"/users/123e4567-e89b-12d3-a456-426614174000", "/users/:id"},
+		{"/commits/da39a3ee5e6b4b0d3255bfef95601890afd80709", "/commits/:id"},
+		{"/users/:id", "/users/:id"},
+		{"/v1/health", "/v1/health"},
+		{"/feed/deadbeefdeadbeef", "/feed/deadbeefdeadbeef"},
+		{"/soap/42#GetUser", "/soap/:id#GetUser"},
+		{"/", "/"},
+	}
+	for _, tc := range cases {
+		if got := NormalizePath(tc.path); got != tc.want {
+			t.Errorf("NormalizePath(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+// resetEndpointLimiter forgets every endpoint admitted so far.
+func resetEndpointLimiter() {
+	seenEndpoints.Range(func(key, _ interface{}) bool {
+		seenEndpoints.Delete(key)
+		return true
+	})
+	atomic.StoreInt64(&seenEndpointCount, 0)
+}
+
+func TestEndpointTagOverflow(t *testing.T) {
+	defer applyOptions(nil)
+	defer resetEndpointLimiter()
+	resetEndpointLimiter()
+	applyOptions([]Option{WithMaxEndpoints(2)})
+
+	if got := endpointTag("/a/1"); got != "/a/:id" {
+		t.Errorf("first endpoint = %q, want /a/:id", got)
+	}
+	if got := endpointTag("/b"); got != "/b" {
+		t.Errorf("second endpoint = %q, want /b", got)
+	}
+	if got := endpointTag("/c"); got != overflowEndpoint {
+		t.Errorf("third endpoint = %q, want %q", got, overflowEndpoint)
+	}
+	// Endpoints admitted before the cap keep their own tag
+	if got := endpointTag("/a/2"); got != "/a/:id" {
+		t.Errorf("known endpoint = %q, want /a/:id", got)
+	}
+}
+
+func TestEndpointTagCustomNormalizer(t *testing.T) {
+	defer applyOptions(nil)
+	defer resetEndpointLimiter()
+	resetEndpointLimiter()
+
+	applyOptions([]Option{WithPathNormalizer(strings.ToLower)})
+	if got := endpointTag("/Users/42"); got != "/users/42" {
+		t.Errorf("custom normalizer: got %q", got)
+	}
+	applyOptions([]Option{WithPathNormalizer(nil)})
+	if got := endpointTag("/Users/42"); got != "/Users/42" {
+		t.Errorf("disabled normalizer: got %q", got)
+	}
+}
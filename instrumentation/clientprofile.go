@@ -0,0 +1,215 @@
+package instrumentation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultClientProfileTop        = 10
+	defaultClientProfileMaxClients = 10000
+	// otherClients is what the requests of clients beyond MaxClients are
+	// counted under
+	otherClients = "other"
+)
+
+// ClientProfileConfig profiles the clients of the service: every Window, the
+// Top clients (10 if zero) by requests are each reported as a point tagged
+// aggregation=client_profile and their client_rank, carrying the client as a
+// field: its IP, or "key:" and a fingerprint of the API key in Header when
+// the request has one. Points also carry the client's request rate, errors
+// and average concurrency over the window. Up to MaxClients clients (10000
+// if zero) are tracked per window; later ones are counted as "other".
+//
+// OmitIPAddress leaves the ip_address tag out of request points, as the
+// profiles tell the top talkers apart without a series per client.
+type ClientProfileConfig struct {
+	Window        Duration `json:"window"`
+	Top           int      `json:"top"`
+	Header        string   `json:"header"`
+	MaxClients    int      `json:"max_clients"`
+	OmitIPAddress bool     `json:"omit_ip_address"`
+}
+
+// clientStats is what a client did during the current window.
+type clientStats struct {
+	requests int64
+	errors   int64
+	// busy is the time its requests took, which over the window is their
+	// average concurrency
+	busy time.Duration
+}
+
+// clientProfiles counts the requests of each client over a window.
+type clientProfiles struct {
+	config     ClientProfileConfig
+	window     time.Duration
+	top        int
+	maxClients int
+	done       chan struct{}
+
+	mu      sync.Mutex
+	clients map[string]*clientStats
+}
+
+var (
+	profilesMu sync.Mutex
+	profiles   *clientProfiles
+)
+
+// startClientProfiles replaces the profiles of any previously applied config
+// after flushing their window, keeping them when their config is unchanged.
+func startClientProfiles(cfg Config) {
+	profilesMu.Lock()
+	if profiles != nil && profiles.config == cfg.ClientProfiles {
+		profilesMu.Unlock()
+		return
+	}
+	previous := profiles
+	profiles = nil
+	if cfg.ClientProfiles.Window > 0 {
+		p := &clientProfiles{
+			config:     cfg.ClientProfiles,
+			window:     time.Duration(cfg.ClientProfiles.Window),
+			top:        cfg.ClientProfiles.Top,
+			maxClients: cfg.ClientProfiles.MaxClients,
+			done:       make(chan struct{}),
+			clients:    make(map[string]*clientStats),
+		}
+		if p.top == 0 {
+			p.top = defaultClientProfileTop
+		}
+		if p.maxClients == 0 {
+			p.maxClients = defaultClientProfileMaxClients
+		}
+		profiles = p
+		go p.run()
+	}
+	profilesMu.Unlock()
+
+	if previous != nil {
+		close(previous.done)
+		previous.flush()
+	}
+}
+
+func currentClientProfiles() *clientProfiles {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	return profiles
+}
+
+func (p *clientProfiles) run() {
+	ticker := time.NewTicker(p.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.flush()
+		}
+	}
+}
+
+// profileClient counts a request in the profile of its client, identified by
+// the API key in the configured header or else by ipAddress.
+func profileClient(ipAddress string, requestHeader func(string) string, latency time.Duration, failed bool) {
+	p := currentClientProfiles()
+	if p == nil {
+		return
+	}
+	client := ""
+	if p.config.Header != "" {
+		if key := requestHeader(p.config.Header); key != "" {
+			client = "key:" + keyFingerprint(key)
+		}
+	}
+	if client == "" {
+		client = clientIP(ipAddress)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats, ok := p.clients[client]
+	if !ok {
+		if len(p.clients) >= p.maxClients {
+			client = otherClients
+			stats = p.clients[client]
+		}
+		if stats == nil {
+			stats = &clientStats{}
+			p.clients[client] = stats
+		}
+	}
+	stats.requests++
+	stats.busy += latency
+	if failed {
+		stats.errors++
+	}
+}
+
+// keyFingerprint identifies an API key without revealing it.
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// clientIP strips the port off a remote address.
+func clientIP(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// flush sends a point for each of the top clients of the window.
+func (p *clientProfiles) flush() {
+	p.mu.Lock()
+	clients := p.clients
+	p.clients = make(map[string]*clientStats)
+	p.mu.Unlock()
+
+	ranked := make([]string, 0, len(clients))
+	for client := range clients {
+		ranked = append(ranked, client)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := clients[ranked[i]], clients[ranked[j]]
+		if a.requests != b.requests {
+			return a.requests > b.requests
+		}
+		return ranked[i] < ranked[j]
+	})
+	if len(ranked) > p.top {
+		ranked = ranked[:p.top]
+	}
+	for i, client := range ranked {
+		stats := clients[client]
+		metrics := Metrics{
+			InfluxDBURL: influxDBURL,
+			Token:       currentToken(),
+			Org:         org,
+			Bucket:      bucket,
+			Measurement: measurement,
+			Tags:        map[string]string{"aggregation": "client_profile", "client_rank": strconv.Itoa(i + 1)},
+			Fields: map[string]interface{}{
+				"client":           client,
+				"window_seconds":   p.window.Seconds(),
+				"window_clients":   len(clients),
+				"window_requests":  stats.requests,
+				"window_errors":    stats.errors,
+				"request_rate":     float64(stats.requests) / p.window.Seconds(),
+				"concurrency_mean": stats.busy.Seconds() / p.window.Seconds(),
+			},
+		}
+		if err := enqueuePoint(aggregatePoints, metrics); err != nil {
+			logSendError(err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package instrumentation
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientProfilesReportTopTalkers(t *testing.T) {
+	cfg := ClientProfileConfig{Window: Duration(time.Hour), Top: 2, Header: "X-API-Key", OmitIPAddress: true}
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithClientProfiles(cfg), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	send := func(remoteAddr, apiKey, target string) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if metrics := nextMetrics(t); metrics.Tags["ip_address"] != "" {
+			t.Errorf("ip_address = %q, want it omitted", metrics.Tags["ip_address"])
+		}
+	}
+	for i := 0; i < 3; i++ {
+		send("10.0.0.1:1234", "", "/profiles/orders")
+	}
+	send("10.0.0.2:1234", "secret-key", "/profiles/orders?fail=1")
+	send("10.0.0.3:1234", "secret-key", "/profiles/orders")
+	send("10.0.0.4:1234", "", "/profiles/orders")
+
+	// Applying another config flushes the window
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	first, second := nextMetrics(t), nextMetrics(t)
+	if first.Tags["aggregation"] != "client_profile" || first.Tags["client_rank"] != "1" || first.Fields["client"] != "10.0.0.1" || first.Fields["window_requests"] != float64(3) {
+		t.Errorf("first profile = %v %v, want 10.0.0.1 with 3 requests", first.Tags, first.Fields)
+	}
+	wantKey := "key:" + keyFingerprint("secret-key")
+	if second.Tags["client_rank"] != "2" || second.Fields["client"] != wantKey || second.Fields["window_requests"] != float64(2) || second.Fields["window_errors"] != float64(1) {
+		t.Errorf("second profile = %v %v, want %s with 2 requests and 1 error", second.Tags, second.Fields, wantKey)
+	}
+	if second.Fields["window_clients"] != float64(3) {
+		t.Errorf("window_clients = %v, want 3", second.Fields["window_clients"])
+	}
+}
+
+func TestClientProfilesCapClients(t *testing.T) {
+	p := &clientProfiles{maxClients: 2, clients: make(map[string]*clientStats)}
+	profiles = p
+	defer func() { profiles = nil }()
+	noHeader := func(string) string { return "" }
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		profileClient(ip, noHeader, 10*time.Millisecond, false)
+	}
+	if len(p.clients) != 3 || p.clients[otherClients].requests != 2 || p.clients[otherClients].busy != 20*time.Millisecond {
+		t.Errorf("clients = %v, want 2 tracked and 2 requests of others", p.clients)
+	}
+}
+
+func TestValidateClientProfiles(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "orders", ClientProfiles: ClientProfileConfig{Window: Duration(-time.Second), Top: -1}}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 2 {
+		t.Errorf("Validate() = %v, want the window and top rejected", err)
+	}
+}
@@ -0,0 +1,791 @@
+package instrumentation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/jculley01/observability-module/protocol"
+	"github.com/jculley01/observability-module/registration"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the full instrumentation configuration. It can be built in code,
+// through the Option helpers, or loaded from a JSON file with LoadConfig. Field
+// rules are declared in `validate` tags and checked by Validate:
+//
+//	required           the field must be set
+//	required_unless=F  the field must be set unless a field of F (a|b) is set
+//	url=a|b            a non-empty value must be an absolute URL with one of the schemes
+//	min=n              a number must be at least n
+//	positive           a non-zero duration must be greater than zero
+//	regexp             a non-empty value must compile as a regular expression
+//
+// Fields tagged `reload:"restart"` only take effect on startup; WatchConfig
+// applies every other field while the service is running.
+type Config struct {
+	// RegistryURL is the central registry's WebSocket base URL; metrics are
+	// sent to RegistryURL + "/metrics". It can be left empty when they are
+	// only scraped from PrometheusListenAddr, or sent to Datadog, MQTT,
+	// Graphite, Elasticsearch, VictoriaMetrics, RemoteWrite or Exporters.
+	RegistryURL string `json:"registry_url" validate:"required_unless=PrometheusListenAddr|Datadog|MQTT|Graphite|Elasticsearch|VictoriaMetrics|RemoteWrite|Exporters,url=ws|wss" reload:"restart"`
+	// ServiceName is used as the InfluxDB measurement.
+	ServiceName string `json:"service_name" validate:"required" reload:"restart"`
+	InfluxDBURL string `json:"influxdb_url" validate:"url=http|https" reload:"restart"`
+	Token       string `json:"token" reload:"restart"`
+	Org         string `json:"org" reload:"restart"`
+	Bucket      string `json:"bucket" reload:"restart"`
+
+	// TokenSecret names the secret holding the InfluxDB token, fetched from
+	// SecretProvider instead of passing Token in plain text, e.g.
+	// "secret/data/influxdb#token" with VaultSecretProvider.
+	TokenSecret    string         `json:"token_secret" reload:"restart"`
+	SecretProvider SecretProvider `json:"-"`
+	// SecretRefreshInterval re-fetches secrets so rotations are picked up
+	// (never if zero).
+	SecretRefreshInterval Duration `json:"secret_refresh_interval" validate:"positive" reload:"restart"`
+
+	// InstanceID tells replicas of the service apart in the instance_id tag.
+	// It defaults to the host name plus a random suffix, stable for the life
+	// of the process.
+	InstanceID string `json:"instance_id" reload:"restart"`
+
+	// ServiceType classifies the service in the service_type tag of every
+	// point: a registration.ServiceType, built-in or registered.
+	ServiceType string `json:"service_type" reload:"restart"`
+
+	// RegistryAuth authenticates the registry connection with a bearer
+	// token, sent again on every reconnection.
+	RegistryAuth RegistryAuthConfig `json:"registry_auth" reload:"restart"`
+	// RegistryTLS configures the TLS of a wss:// RegistryURL: root CAs, a
+	// client certificate and the server name to verify.
+	RegistryTLS RegistryTLSConfig `json:"registry_tls" reload:"restart"`
+
+	// PointCredentials sends InfluxDBURL, the token, Org and Bucket with
+	// every point, as registries predating the session frame expect, rather
+	// than once per connection in a session frame.
+	PointCredentials bool `json:"point_credentials" reload:"restart"`
+
+	// WireFormat is the codec points are encoded with on the registry
+	// connection: WireFormatJSON text frames (the default), or
+	// WireFormatProtobuf or WireFormatMessagePack binary frames, which are
+	// smaller and cheaper to encode and parse; WireFormatLineProtocol text
+	// frames, which the registry can forward to InfluxDB as they are; or the
+	// name of a codec added with protocol.RegisterCodec.
+	WireFormat string `json:"wire_format" reload:"restart"`
+	// SchemaVersion is the version of the point payload written to the
+	// registry, named in the session: protocol.SchemaVersion if zero, or an
+	// older one for a registry not upgraded yet, which points are downgraded
+	// to before they are encoded.
+	SchemaVersion int `json:"schema_version" reload:"restart"`
+
+	// HandshakeTimeout bounds the WebSocket dial to the registry (45s if zero).
+	HandshakeTimeout Duration `json:"handshake_timeout" validate:"positive" reload:"restart"`
+	// KeepaliveInterval pings the registry this often, so proxies don't
+	// close the idle connection and a registry that silently went away is
+	// noticed: a connection with neither a pong nor a message for the
+	// interval plus PongTimeout (the interval if zero) is closed and dialed
+	// again, rather than failing a write much later.
+	KeepaliveInterval Duration `json:"keepalive_interval" validate:"positive" reload:"restart"`
+	PongTimeout       Duration `json:"pong_timeout" validate:"positive" reload:"restart"`
+	// AcknowledgedDelivery numbers the frames written to the registry, keeps
+	// them until the registry acknowledges them and writes them again after
+	// a reconnection: points are delivered at least once, to registries
+	// that acknowledge them; see transport.Config.Acknowledged.
+	AcknowledgedDelivery bool `json:"acknowledged_delivery" reload:"restart"`
+	// HTTPFallback posts the frames to the registry over HTTP(S) when
+	// something on the way, e.g. a corporate proxy, blocks the WebSocket
+	// upgrade, and tries WebSocket again every five minutes; see
+	// transport.Config.HTTPFallback.
+	HTTPFallback bool `json:"http_fallback" reload:"restart"`
+
+	SOAPActionExtraction    bool     `json:"soap_action_extraction"`
+	SOAPOperations          []string `json:"soap_operations"`
+	JSONRPCMethodExtraction bool     `json:"jsonrpc_method_extraction"`
+	JSONRPCMethods          []string `json:"jsonrpc_methods"`
+	// BodyPeekLimit caps buffered request body bytes (64 KiB if zero).
+	BodyPeekLimit int `json:"body_peek_limit" validate:"min=0"`
+
+	// PathNormalizer replaces NormalizePath; it can only be set in code.
+	PathNormalizer           func(path string) string `json:"-"`
+	DisablePathNormalization bool                     `json:"disable_path_normalization"`
+	// MaxEndpoints caps distinct endpoint tag values (1000 if zero).
+	MaxEndpoints int `json:"max_endpoints" validate:"min=0"`
+
+	// IgnorePaths lists request paths (e.g. "/healthz") that produce no metrics.
+	IgnorePaths []string `json:"ignore_paths"`
+	// IgnorePattern is a regular expression; matching request paths produce no
+	// metrics (e.g. `^/static/`).
+	IgnorePattern string `json:"ignore_pattern" validate:"regexp"`
+
+	// Sampling maps endpoint tags (e.g. "/users/:id") to sampling rules; the
+	// "*" rule applies to endpoints without their own.
+	Sampling map[string]SamplingRule `json:"sampling"`
+	// RateLimit caps the points and bytes written to the registry per
+	// second, whatever the endpoint; see RateLimitConfig.
+	RateLimit RateLimitConfig `json:"rate_limit"`
+
+	// Tag extractors add custom tags (tenant, API version, ...) to every point;
+	// they can only be set in code. TagExtractor applies to every net/http
+	// based framework. ContextTagExtractors receive the framework's own
+	// context and return nil for types they don't handle; the adapter
+	// modules' WithTagExtractor options add them.
+	TagExtractor         func(r *http.Request) map[string]string   `json:"-"`
+	ContextTagExtractors []func(ctx interface{}) map[string]string `json:"-"`
+	// Field extractors add custom fields (items_in_cart, cache_hit, ...) to
+	// every point, the same way as the tag extractors.
+	FieldExtractor         func(r *http.Request, resp ResponseInfo) map[string]interface{} `json:"-"`
+	ContextFieldExtractors []func(ctx interface{}) map[string]interface{}                  `json:"-"`
+
+	// ErrorPredicate decides which requests count as errors, in place of the
+	// default of 4xx and 5xx statuses and non-zero gRPC statuses;
+	// EndpointErrorPredicates does for the endpoint tags it names. They can
+	// only be set in code.
+	ErrorPredicate          ErrorPredicate            `json:"-"`
+	EndpointErrorPredicates map[string]ErrorPredicate `json:"-"`
+
+	// CaptureHeaders reports request or response headers as tags or fields.
+	// Credential headers such as Authorization and Cookie are always redacted.
+	CaptureHeaders []HeaderCapture `json:"capture_headers"`
+
+	// MaxTagValues caps distinct values of each custom tag (100 if zero).
+	MaxTagValues int `json:"max_tag_values" validate:"min=0"`
+	// MaxTagValueLength truncates tag values to this many bytes before
+	// points are sent (256 if zero).
+	MaxTagValueLength int `json:"max_tag_value_length" validate:"min=0"`
+
+	// Handler panics are reported with a 500 status and counted in
+	// panic_count. RecoverPanics answers them with a 500 instead of
+	// re-panicking, and PanicStackTrace adds the stack as a panic_stack field.
+	RecoverPanics   bool `json:"recover_panics"`
+	PanicStackTrace bool `json:"panic_stack_trace"`
+	// PanicReports sends a panic_report event for each panic, to the registry
+	// and the exporters, with the panic value and stack, the request's
+	// method, path, request_id and trace_id, and the endpoint's panic_count.
+	// PanicGoroutineDump adds the stacks of every goroutine, which helps with
+	// deadlocks and races but can be large.
+	PanicReports       bool `json:"panic_reports"`
+	PanicGoroutineDump bool `json:"panic_goroutine_dump"`
+
+	// LatencyBuckets are histogram bucket upper bounds in milliseconds, in
+	// increasing order. When set, points carry cumulative latency_bucket_le_*
+	// counts, latency_sum_ms and latency_count next to latency_ms.
+	LatencyBuckets []float64 `json:"latency_buckets"`
+
+	// Requests failing with a 5xx status or a panic are forwarded to
+	// ErrorReporter, or to the Sentry-compatible SentryDSN when it is unset.
+	ErrorReporter ErrorReporter `json:"-"`
+	SentryDSN     string        `json:"sentry_dsn"`
+
+	// AggregationWindow replaces per-request points with one point per
+	// endpoint and window carrying latency percentiles (p50, p95, p99).
+	// Custom tags and fields aren't part of the aggregated points.
+	AggregationWindow Duration `json:"aggregation_window" validate:"positive" reload:"restart"`
+
+	// Reports sends daily and weekly summaries per endpoint; see ReportConfig.
+	Reports ReportConfig `json:"reports" reload:"restart"`
+
+	// ClientProfiles reports the top clients by requests every window; see
+	// ClientProfileConfig.
+	ClientProfiles ClientProfileConfig `json:"client_profiles" reload:"restart"`
+	// StreamProgressInterval sends a progress point at most this often while
+	// a response is streamed, e.g. Server-Sent Events, with the bytes flushed
+	// since the previous one. Streamed responses always report ttfb_ms as
+	// their latency and their total duration as stream_duration_ms.
+	StreamProgressInterval Duration `json:"stream_progress_interval" validate:"positive"`
+	// SlowRequestThreshold sends a request_in_progress event, with the
+	// request's ID and elapsed_ms, for requests still running after it, and
+	// logs the stack of their handler, so stuck handlers show up before they
+	// complete. The request is reported as usual when it completes.
+	SlowRequestThreshold Duration `json:"slow_request_threshold" validate:"positive"`
+
+	// IdempotencyWindow remembers the Idempotency-Key header of requests per
+	// endpoint for this long. Requests carrying a key get a
+	// duplicate_submission field, true when the key was already seen, and
+	// points of the endpoint the count of duplicates as duplicate_count, to
+	// size client retry storms.
+	IdempotencyWindow Duration `json:"idempotency_window" validate:"positive"`
+
+	// EndpointDiscoveryWindow sends an endpoint_discovered event, tagged with
+	// the endpoint and with its first_seen time and method as fields, the
+	// first time a request is counted under an endpoint, and again when it
+	// wasn't served over the window. The registry learns about undocumented
+	// routes as soon as they are served rather than from the next report.
+	EndpointDiscoveryWindow Duration `json:"endpoint_discovery_window" validate:"positive"`
+
+	// AutoscalingWindow enables the p99 latency served by ScalingHandler,
+	// computed over the requests of the last window (e.g. 1m). QueueDepth
+	// reports the application's backlog next to it.
+	AutoscalingWindow Duration     `json:"autoscaling_window" validate:"positive" reload:"restart"`
+	QueueDepth        func() int64 `json:"-"`
+
+	// PushgatewayURL pushes the metrics of WriteOpenMetrics to a Prometheus
+	// Pushgateway every PushInterval and on Shutdown, for batch jobs and
+	// short-lived processes. They are grouped under PushgatewayJob (the service
+	// name if empty) and the instance_id.
+	PushgatewayURL string   `json:"pushgateway_url" validate:"url=http|https" reload:"restart"`
+	PushgatewayJob string   `json:"pushgateway_job" reload:"restart"`
+	PushInterval   Duration `json:"push_interval" validate:"positive" reload:"restart"`
+
+	// Outbox enables domain events sent with EmitEvent; see OutboxConfig.
+	Outbox OutboxConfig `json:"outbox" reload:"restart"`
+
+	// ConsumerLagObjectives maps queues to the lag objective of the messages
+	// reported with ConsumeMessage (e.g. "30s"); the "*" objective applies to
+	// queues without their own. ConsumerLagBuckets are the bounds of the lag
+	// histogram in milliseconds, DefaultConsumerLagBuckets if empty.
+	ConsumerLagObjectives map[string]Duration `json:"consumer_lag_objectives"`
+	ConsumerLagBuckets    []float64           `json:"consumer_lag_buckets"`
+
+	// OTLPEndpoint exports the metrics of WriteOpenMetrics to an
+	// OpenTelemetry collector every OTLPInterval (10s if zero) and on
+	// Shutdown, e.g. "http://otel-collector:4318". OTLPProtocol is "grpc",
+	// "http/protobuf" (the default) or "http/json"; OTLPHeaders are sent with
+	// every export, e.g. an API key.
+	OTLPEndpoint string            `json:"otlp_endpoint" validate:"url=http|https" reload:"restart"`
+	OTLPProtocol string            `json:"otlp_protocol" reload:"restart"`
+	OTLPHeaders  map[string]string `json:"otlp_headers" reload:"restart"`
+	OTLPInterval Duration          `json:"otlp_interval" validate:"positive" reload:"restart"`
+
+	// Datadog sends every point to the Datadog metrics API; see
+	// DatadogConfig.
+	Datadog DatadogConfig `json:"datadog" reload:"restart"`
+
+	// MQTT publishes every point to an MQTT broker; see MQTTConfig.
+	MQTT MQTTConfig `json:"mqtt" reload:"restart"`
+
+	// Graphite writes every point to a Graphite carbon receiver; see
+	// GraphiteConfig.
+	Graphite GraphiteConfig `json:"graphite" reload:"restart"`
+
+	// Elasticsearch bulk-indexes every point into Elasticsearch or
+	// OpenSearch; see ElasticsearchConfig.
+	Elasticsearch ElasticsearchConfig `json:"elasticsearch" reload:"restart"`
+
+	// VictoriaMetrics imports every point into VictoriaMetrics; see
+	// VictoriaMetricsConfig.
+	VictoriaMetrics VictoriaMetricsConfig `json:"victoria_metrics" reload:"restart"`
+
+	// RemoteWrite pushes every point with the Prometheus remote_write
+	// protocol; see RemoteWriteConfig.
+	RemoteWrite RemoteWriteConfig `json:"remote_write" reload:"restart"`
+
+	// Points are put in a queue of up to SendQueueSize points (10000 if
+	// zero), sent by SendQueueWorkers goroutines (4 if zero), so a slow
+	// registry or backend doesn't hold requests up. SendQueuePolicy says
+	// what happens to points reported while the queue is full: DropOldest
+	// (the default), DropNewest or Block. Points carry the count of dropped
+	// points as dropped_points. DisableSendQueue sends the points from the
+	// goroutine reporting them instead.
+	//
+	// Events, aggregates and profiles go through the queue too, and a full
+	// queue drops the points of the lowest priority class first:
+	// PriorityCritical (health and lifecycle events), PriorityAggregate,
+	// PriorityRequest, then PriorityDebug. SendQueuePolicy only applies
+	// within a class. SendQueuePriorities changes the class of a kind of
+	// points, "request", "aggregate", "run" or the name of an event.
+	SendQueueSize       int               `json:"send_queue_size" validate:"min=0" reload:"restart"`
+	SendQueueWorkers    int               `json:"send_queue_workers" validate:"min=0" reload:"restart"`
+	DisableSendQueue    bool              `json:"disable_send_queue" reload:"restart"`
+	SendQueuePolicy     string            `json:"send_queue_policy" reload:"restart"`
+	SendQueuePriorities map[string]string `json:"send_queue_priorities" reload:"restart"`
+
+	// Spill writes the points that can't be sent to the registry to disk,
+	// and replays them once it is reachable again; see SpillConfig.
+	Spill SpillConfig `json:"spill" reload:"restart"`
+
+	// BatchInterval sends the points to the registry in frames holding a
+	// JSON array of up to BatchSize points (500 if zero), written every
+	// BatchInterval or as soon as BatchSize points are pending, instead of a
+	// frame per point. The registry must accept arrays. Points that can't be
+	// written are then logged rather than returned by Send.
+	BatchInterval Duration `json:"batch_interval" validate:"positive" reload:"restart"`
+	BatchSize     int      `json:"batch_size" validate:"min=0" reload:"restart"`
+
+	// Exporters receive every point sent, for backends of their own, each
+	// from a queue of up to ExporterQueueSize points (1000 if zero) so a slow
+	// or failing backend doesn't hold the others back.
+	Exporters         []Exporter `json:"-"`
+	ExporterQueueSize int        `json:"exporter_queue_size" validate:"min=0" reload:"restart"`
+	// ExporterRetry retries the points Exporters failed to export; the
+	// backends above have a retry policy of their own. See RetryPolicy.
+	ExporterRetry RetryPolicy `json:"exporter_retry" reload:"restart"`
+
+	// CircuitBreaker stops sending to the registry, or to an exporter, after
+	// repeated failures, until a cool-down has passed; see
+	// CircuitBreakerConfig.
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker" reload:"restart"`
+
+	// PipelineMetricsInterval sends a pipeline event this often with the
+	// health of the metrics pipeline itself: points sent, failed and
+	// dropped, queue depths, send and export latencies, and registry
+	// reconnections. It is sent even without traffic, so a quiet service can
+	// be told apart from a broken pipeline.
+	PipelineMetricsInterval Duration `json:"pipeline_metrics_interval" validate:"positive"`
+
+	// PrometheusListenAddr serves the metrics of PrometheusHandler on
+	// /metrics at this address (e.g. ":9090"), for Prometheus to scrape.
+	// Latency histograms are only exposed with LatencyBuckets.
+	PrometheusListenAddr string `json:"prometheus_listen_addr" reload:"restart"`
+
+	// TimestampPrecision timestamps points when they are taken, in "s",
+	// "ms" or "ns" (see Metrics.Timestamp), instead of leaving it to the
+	// registry when they arrive. Durations such as latencies are always
+	// measured with the monotonic clock, so wall clock changes don't skew
+	// them.
+	TimestampPrecision string `json:"timestamp_precision" reload:"restart"`
+
+	// DebugCaptureFile appends every frame sent to the registry, with the
+	// token redacted, to this pcapng file for Wireshark, to diagnose
+	// protocol issues. Frames carry the time they were sent and the number
+	// of their connection. See also DebugCaptureHandler.
+	DebugCaptureFile string `json:"debug_capture_file" reload:"restart"`
+
+	// SelfCheckWriteProbe makes SelfCheck write a self_check point to the
+	// bucket to check the token, instead of only looking the bucket up.
+	SelfCheckWriteProbe bool `json:"self_check_write_probe"`
+
+	// LocalStore keeps hourly rollups on disk; see LocalStoreConfig. Reports
+	// start from them after a restart when it retains enough history.
+	LocalStore LocalStoreConfig `json:"local_store" reload:"restart"`
+}
+
+// Duration is a time.Duration that reads and writes as a string such as "10s"
+// in configuration files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// FieldError describes one invalid configuration field, or part of a point;
+// see InvalidPointError.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationError aggregates every problem found in a Config, so they can all
+// be fixed in one go.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid instrumentation config (%d problem", len(e.Errors))
+	if len(e.Errors) != 1 {
+		b.WriteString("s")
+	}
+	b.WriteString("):")
+	for _, fe := range e.Errors {
+		fmt.Fprintf(&b, "\n  - %s: %s", fe.Field, fe.Message)
+	}
+	return b.String()
+}
+
+// LoadConfig reads a JSON configuration file and validates it.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("error reading config file: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the field rules declared in the struct tags plus the rules
+// spanning several fields, and returns a *ValidationError listing all of them.
+func (c Config) Validate() error {
+	var problems []FieldError
+	v := reflect.ValueOf(c)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		rules := field.Tag.Get("validate")
+		if rules == "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		for _, rule := range strings.Split(rules, ",") {
+			if others, ok := strings.CutPrefix(rule, "required_unless="); ok {
+				missing := v.Field(i).IsZero()
+				var otherNames []string
+				for _, other := range strings.Split(others, "|") {
+					missing = missing && v.FieldByName(other).IsZero()
+					otherField, _ := t.FieldByName(other)
+					otherName := strings.Split(otherField.Tag.Get("json"), ",")[0]
+					if otherName == "-" {
+						otherName = other
+					}
+					otherNames = append(otherNames, otherName)
+				}
+				if missing {
+					last := len(otherNames) - 1
+					names := otherNames[last]
+					if last > 0 {
+						names = strings.Join(otherNames[:last], ", ") + " or " + names
+					}
+					problems = append(problems, FieldError{Field: name, Message: "is required unless " + names + " is set"})
+				}
+				continue
+			}
+			if msg := checkRule(v.Field(i), rule); msg != "" {
+				problems = append(problems, FieldError{Field: name, Message: msg})
+			}
+		}
+	}
+
+	if c.PathNormalizer != nil && c.DisablePathNormalization {
+		problems = append(problems, FieldError{Field: "disable_path_normalization", Message: "cannot be combined with a custom PathNormalizer"})
+	}
+	if c.ServiceType != "" {
+		if err := registration.ServiceType(c.ServiceType).Validate(); err != nil {
+			problems = append(problems, FieldError{Field: "service_type", Message: err.Error()})
+		}
+	}
+	if c.RegistryAuth.TokenSecret != "" && c.RegistryAuth.Token != "" {
+		problems = append(problems, FieldError{Field: "registry_auth.token_secret", Message: "cannot be combined with registry_auth.token"})
+	}
+	if c.RegistryAuth.TokenSecret != "" && c.SecretProvider == nil {
+		problems = append(problems, FieldError{Field: "registry_auth.token_secret", Message: "requires a SecretProvider"})
+	}
+	if c.RegistryAuth.QueryParam != "" && c.RegistryAuth.Token == "" && c.RegistryAuth.TokenSecret == "" {
+		problems = append(problems, FieldError{Field: "registry_auth.query_param", Message: "requires registry_auth.token or registry_auth.token_secret"})
+	}
+	if c.CircuitBreaker.Failures < 0 {
+		problems = append(problems, FieldError{Field: "circuit_breaker.failures", Message: "must not be negative"})
+	}
+	if c.CircuitBreaker.CoolDown < 0 {
+		problems = append(problems, FieldError{Field: "circuit_breaker.cool_down", Message: "must not be negative"})
+	}
+	if (c.RegistryTLS.CertFile == "") != (c.RegistryTLS.KeyFile == "") {
+		problems = append(problems, FieldError{Field: "registry_tls", Message: "cert_file and key_file must be set together"})
+	}
+	if c.RegistryTLS.enabled() && !strings.HasPrefix(c.RegistryURL, "wss://") {
+		problems = append(problems, FieldError{Field: "registry_tls", Message: "requires a wss:// registry_url"})
+	}
+	if c.PongTimeout != 0 && c.KeepaliveInterval == 0 {
+		problems = append(problems, FieldError{Field: "pong_timeout", Message: "requires keepalive_interval"})
+	}
+	if c.TokenSecret != "" && c.Token != "" {
+		problems = append(problems, FieldError{Field: "token_secret", Message: "cannot be combined with token"})
+	}
+	if len(c.SOAPOperations) > 0 && !c.SOAPActionExtraction {
+		problems = append(problems, FieldError{Field: "soap_operations", Message: "requires soap_action_extraction"})
+	}
+	if len(c.JSONRPCMethods) > 0 && !c.JSONRPCMethodExtraction {
+		problems = append(problems, FieldError{Field: "jsonrpc_methods", Message: "requires jsonrpc_method_extraction"})
+	}
+
+	for i, capture := range c.CaptureHeaders {
+		if capture.Header == "" {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("capture_headers[%d].header", i), Message: "is required"})
+		}
+	}
+	if c.SentryDSN != "" {
+		if _, err := NewSentryReporter(c.SentryDSN); err != nil {
+			problems = append(problems, FieldError{Field: "sentry_dsn", Message: err.Error()})
+		}
+	}
+	if msg := checkRule(reflect.ValueOf(c.Reports.WebhookURL), "url=http|https"); msg != "" {
+		problems = append(problems, FieldError{Field: "reports.webhook_url", Message: msg})
+	}
+	if c.Reports.WebhookURL != "" && !c.Reports.enabled() {
+		problems = append(problems, FieldError{Field: "reports.webhook_url", Message: "requires reports.daily or reports.weekly"})
+	}
+	if c.Reports.LatencyObjective < 0 {
+		problems = append(problems, FieldError{Field: "reports.latency_objective", Message: "must not be negative"})
+	}
+	if c.Reports.TopRegressions < 0 {
+		problems = append(problems, FieldError{Field: "reports.top_regressions", Message: "must not be negative"})
+	}
+	if c.LocalStore.Retention < 0 {
+		problems = append(problems, FieldError{Field: "local_store.retention", Message: "must not be negative"})
+	}
+	if c.ClientProfiles.Window < 0 {
+		problems = append(problems, FieldError{Field: "client_profiles.window", Message: "must not be negative"})
+	}
+	if c.ClientProfiles.Top < 0 {
+		problems = append(problems, FieldError{Field: "client_profiles.top", Message: "must not be negative"})
+	}
+	if c.ClientProfiles.MaxClients < 0 {
+		problems = append(problems, FieldError{Field: "client_profiles.max_clients", Message: "must not be negative"})
+	}
+	if c.LocalStore.MaxBytes < 0 {
+		problems = append(problems, FieldError{Field: "local_store.max_bytes", Message: "must not be negative"})
+	}
+	switch c.OTLPProtocol {
+	case "", OTLPProtocolGRPC, OTLPProtocolHTTPProtobuf, OTLPProtocolHTTPJSON:
+	default:
+		problems = append(problems, FieldError{Field: "otlp_protocol", Message: fmt.Sprintf("must be %s, %s or %s, got %q", OTLPProtocolGRPC, OTLPProtocolHTTPProtobuf, OTLPProtocolHTTPJSON, c.OTLPProtocol)})
+	}
+	if _, ok := protocol.LookupCodec(c.WireFormat); c.WireFormat != "" && !ok {
+		problems = append(problems, FieldError{Field: "wire_format", Message: fmt.Sprintf("must be %s, %s, %s, %s or a registered codec, got %q", WireFormatJSON, WireFormatProtobuf, WireFormatMessagePack, WireFormatLineProtocol, c.WireFormat)})
+	}
+	if c.SchemaVersion < 0 || c.SchemaVersion > protocol.SchemaVersion {
+		problems = append(problems, FieldError{Field: "schema_version", Message: fmt.Sprintf("must be 1 to %d, got %d", protocol.SchemaVersion, c.SchemaVersion)})
+	}
+	if c.PointCredentials && c.WireFormat == WireFormatLineProtocol {
+		problems = append(problems, FieldError{Field: "point_credentials", Message: "cannot be combined with the line wire format, which has no room for them"})
+	}
+	switch c.TimestampPrecision {
+	case "", PrecisionSeconds, PrecisionMilliseconds, PrecisionNanoseconds:
+	default:
+		problems = append(problems, FieldError{Field: "timestamp_precision", Message: fmt.Sprintf("must be %s, %s or %s, got %q", PrecisionSeconds, PrecisionMilliseconds, PrecisionNanoseconds, c.TimestampPrecision)})
+	}
+	switch c.SendQueuePolicy {
+	case "", DropOldest, DropNewest, Block:
+	default:
+		problems = append(problems, FieldError{Field: "send_queue_policy", Message: fmt.Sprintf("must be %s, %s or %s, got %q", DropOldest, DropNewest, Block, c.SendQueuePolicy)})
+	}
+	kinds := make([]string, 0, len(c.SendQueuePriorities))
+	for kind := range c.SendQueuePriorities {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		if _, ok := priorityRanks[c.SendQueuePriorities[kind]]; !ok {
+			problems = append(problems, FieldError{Field: "send_queue_priorities." + kind, Message: fmt.Sprintf("must be %s, %s, %s or %s, got %q", PriorityCritical, PriorityAggregate, PriorityRequest, PriorityDebug, c.SendQueuePriorities[kind])})
+		}
+	}
+	if c.Spill.MaxBytes < 0 {
+		problems = append(problems, FieldError{Field: "spill.max_bytes", Message: "must not be negative"})
+	}
+	if c.Spill.SegmentBytes < 0 {
+		problems = append(problems, FieldError{Field: "spill.segment_bytes", Message: "must not be negative"})
+	}
+	if c.Spill.ReplayInterval < 0 {
+		problems = append(problems, FieldError{Field: "spill.replay_interval", Message: "must not be negative"})
+	}
+	if c.Outbox.Capacity < 0 {
+		problems = append(problems, FieldError{Field: "outbox.capacity", Message: "must not be negative"})
+	}
+	if c.Outbox.BatchSize < 0 {
+		problems = append(problems, FieldError{Field: "outbox.batch_size", Message: "must not be negative"})
+	}
+	if c.Outbox.FlushInterval < 0 {
+		problems = append(problems, FieldError{Field: "outbox.flush_interval", Message: "must not be negative"})
+	}
+	if c.Datadog.APIKey == "" && !reflect.DeepEqual(c.Datadog, DatadogConfig{}) {
+		problems = append(problems, FieldError{Field: "datadog.api_key", Message: "is required to send metrics to Datadog"})
+	}
+	if msg := checkRule(reflect.ValueOf(c.Datadog.URL), "url=http|https"); msg != "" {
+		problems = append(problems, FieldError{Field: "datadog.url", Message: msg})
+	}
+	if c.Datadog.BatchSize < 0 {
+		problems = append(problems, FieldError{Field: "datadog.batch_size", Message: "must not be negative"})
+	}
+	if c.Datadog.FlushInterval < 0 {
+		problems = append(problems, FieldError{Field: "datadog.flush_interval", Message: "must not be negative"})
+	}
+	if msg := checkRule(reflect.ValueOf(c.MQTT.BrokerURL), "url=tcp|mqtt|ssl|tls|mqtts"); msg != "" {
+		problems = append(problems, FieldError{Field: "mqtt.broker_url", Message: msg})
+	}
+	if c.MQTT.QoS < 0 || c.MQTT.QoS > 2 {
+		problems = append(problems, FieldError{Field: "mqtt.qos", Message: fmt.Sprintf("must be 0, 1 or 2, got %d", c.MQTT.QoS)})
+	}
+	if c.MQTT.KeepAlive < 0 {
+		problems = append(problems, FieldError{Field: "mqtt.keep_alive", Message: "must not be negative"})
+	}
+	if c.MQTT.QueueSize < 0 {
+		problems = append(problems, FieldError{Field: "mqtt.queue_size", Message: "must not be negative"})
+	}
+	if c.Graphite.URL == "" && !reflect.DeepEqual(c.Graphite, GraphiteConfig{}) {
+		problems = append(problems, FieldError{Field: "graphite.url", Message: "is required to write metrics to Graphite"})
+	}
+	if msg := checkRule(reflect.ValueOf(c.Graphite.URL), "url=tcp"); msg != "" {
+		problems = append(problems, FieldError{Field: "graphite.url", Message: msg})
+	}
+	if p := c.Graphite.Protocol; p != "" && p != GraphitePlaintext && p != GraphitePickle {
+		problems = append(problems, FieldError{Field: "graphite.protocol", Message: fmt.Sprintf("must be %s or %s, got %q", GraphitePlaintext, GraphitePickle, p)})
+	}
+	if c.Graphite.QueueSize < 0 {
+		problems = append(problems, FieldError{Field: "graphite.queue_size", Message: "must not be negative"})
+	}
+	if c.Elasticsearch.URL == "" && !reflect.DeepEqual(c.Elasticsearch, ElasticsearchConfig{}) {
+		problems = append(problems, FieldError{Field: "elasticsearch.url", Message: "is required to index metrics into Elasticsearch"})
+	}
+	if msg := checkRule(reflect.ValueOf(c.Elasticsearch.URL), "url=http|https"); msg != "" {
+		problems = append(problems, FieldError{Field: "elasticsearch.url", Message: msg})
+	}
+	if c.Elasticsearch.APIKey != "" && c.Elasticsearch.Username != "" {
+		problems = append(problems, FieldError{Field: "elasticsearch.api_key", Message: "cannot be combined with username"})
+	}
+	if index := c.Elasticsearch.Index; index != strings.ToLower(index) || strings.ContainsAny(index, `\/*?"<>| ,#:`) {
+		problems = append(problems, FieldError{Field: "elasticsearch.index", Message: fmt.Sprintf("must be a lowercase index name, got %q", index)})
+	}
+	if c.Elasticsearch.BatchSize < 0 {
+		problems = append(problems, FieldError{Field: "elasticsearch.batch_size", Message: "must not be negative"})
+	}
+	if c.Elasticsearch.FlushInterval < 0 {
+		problems = append(problems, FieldError{Field: "elasticsearch.flush_interval", Message: "must not be negative"})
+	}
+	if c.VictoriaMetrics.URL == "" && !reflect.DeepEqual(c.VictoriaMetrics, VictoriaMetricsConfig{}) {
+		problems = append(problems, FieldError{Field: "victoria_metrics.url", Message: "is required to import metrics into VictoriaMetrics"})
+	}
+	if msg := checkRule(reflect.ValueOf(c.VictoriaMetrics.URL), "url=http|https"); msg != "" {
+		problems = append(problems, FieldError{Field: "victoria_metrics.url", Message: msg})
+	}
+	if f := c.VictoriaMetrics.Format; f != "" && f != VictoriaMetricsInflux && f != VictoriaMetricsJSON {
+		problems = append(problems, FieldError{Field: "victoria_metrics.format", Message: fmt.Sprintf("must be %s or %s, got %q", VictoriaMetricsInflux, VictoriaMetricsJSON, f)})
+	}
+	if c.VictoriaMetrics.BatchSize < 0 {
+		problems = append(problems, FieldError{Field: "victoria_metrics.batch_size", Message: "must not be negative"})
+	}
+	if c.VictoriaMetrics.FlushInterval < 0 {
+		problems = append(problems, FieldError{Field: "victoria_metrics.flush_interval", Message: "must not be negative"})
+	}
+	if c.RemoteWrite.URL == "" && !reflect.DeepEqual(c.RemoteWrite, RemoteWriteConfig{}) {
+		problems = append(problems, FieldError{Field: "remote_write.url", Message: "is required to push metrics with remote_write"})
+	}
+	if msg := checkRule(reflect.ValueOf(c.RemoteWrite.URL), "url=http|https"); msg != "" {
+		problems = append(problems, FieldError{Field: "remote_write.url", Message: msg})
+	}
+	if c.RemoteWrite.BearerToken != "" && c.RemoteWrite.Username != "" {
+		problems = append(problems, FieldError{Field: "remote_write.bearer_token", Message: "cannot be combined with username"})
+	}
+	if c.RemoteWrite.BatchSize < 0 {
+		problems = append(problems, FieldError{Field: "remote_write.batch_size", Message: "must not be negative"})
+	}
+	if c.RemoteWrite.FlushInterval < 0 {
+		problems = append(problems, FieldError{Field: "remote_write.flush_interval", Message: "must not be negative"})
+	}
+	for i, bound := range c.LatencyBuckets {
+		field := fmt.Sprintf("latency_buckets[%d]", i)
+		if bound <= 0 {
+			problems = append(problems, FieldError{Field: field, Message: fmt.Sprintf("must be greater than 0, got %g", bound)})
+		} else if i > 0 && bound <= c.LatencyBuckets[i-1] {
+			problems = append(problems, FieldError{Field: field, Message: fmt.Sprintf("must be greater than the previous bound, got %g", bound)})
+		}
+	}
+	for i, bound := range c.ConsumerLagBuckets {
+		field := fmt.Sprintf("consumer_lag_buckets[%d]", i)
+		if bound <= 0 {
+			problems = append(problems, FieldError{Field: field, Message: fmt.Sprintf("must be greater than 0, got %g", bound)})
+		} else if i > 0 && bound <= c.ConsumerLagBuckets[i-1] {
+			problems = append(problems, FieldError{Field: field, Message: fmt.Sprintf("must be greater than the previous bound, got %g", bound)})
+		}
+	}
+	queues := make([]string, 0, len(c.ConsumerLagObjectives))
+	for queue := range c.ConsumerLagObjectives {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	for _, queue := range queues {
+		if objective := c.ConsumerLagObjectives[queue]; objective <= 0 {
+			problems = append(problems, FieldError{Field: "consumer_lag_objectives[" + queue + "]", Message: fmt.Sprintf("must be a positive duration, got %s", time.Duration(objective))})
+		}
+	}
+	endpoints := make([]string, 0, len(c.Sampling))
+	for endpoint := range c.Sampling {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		rule := c.Sampling[endpoint]
+		field := "sampling[" + endpoint + "]"
+		if rule.Rate < 0 || rule.Rate > 1 {
+			problems = append(problems, FieldError{Field: field + ".rate", Message: fmt.Sprintf("must be between 0 and 1, got %g", rule.Rate)})
+		}
+		if rule.MaxPerSecond < 0 {
+			problems = append(problems, FieldError{Field: field + ".max_per_second", Message: fmt.Sprintf("must be at least 0, got %g", rule.MaxPerSecond)})
+		}
+	}
+	for _, retry := range []struct {
+		field  string
+		policy RetryPolicy
+	}{
+		{"datadog.retry", c.Datadog.Retry},
+		{"mqtt.retry", c.MQTT.Retry},
+		{"graphite.retry", c.Graphite.Retry},
+		{"elasticsearch.retry", c.Elasticsearch.Retry},
+		{"victoria_metrics.retry", c.VictoriaMetrics.Retry},
+		{"remote_write.retry", c.RemoteWrite.Retry},
+		{"exporter_retry", c.ExporterRetry},
+	} {
+		problems = append(problems, retry.policy.validate(retry.field)...)
+	}
+	if c.RateLimit.PointsPerSecond < 0 {
+		problems = append(problems, FieldError{Field: "rate_limit.points_per_second", Message: fmt.Sprintf("must be at least 0, got %g", c.RateLimit.PointsPerSecond)})
+	}
+	if c.RateLimit.BytesPerSecond < 0 {
+		problems = append(problems, FieldError{Field: "rate_limit.bytes_per_second", Message: fmt.Sprintf("must be at least 0, got %g", c.RateLimit.BytesPerSecond)})
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Errors: problems}
+	}
+	return nil
+}
+
+// checkRule returns a human-readable message when value breaks rule.
+func checkRule(value reflect.Value, rule string) string {
+	name, arg, _ := strings.Cut(rule, "=")
+	switch name {
+	case "required":
+		if value.IsZero() {
+			return "is required"
+		}
+	case "url":
+		s := value.String()
+		if s == "" {
+			return ""
+		}
+		schemes := strings.Split(arg, "|")
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" || !contains(schemes, u.Scheme) {
+			return fmt.Sprintf("%q must be a URL with scheme %s", s, strings.Join(schemes, " or "))
+		}
+	case "min":
+		limit, _ := strconv.ParseInt(arg, 10, 64)
+		if value.Int() < limit {
+			return fmt.Sprintf("must be at least %d, got %d", limit, value.Int())
+		}
+	case "regexp":
+		if s := value.String(); s != "" {
+			if _, err := regexp.Compile(s); err != nil {
+				return fmt.Sprintf("invalid regular expression: %v", err)
+			}
+		}
+	case "positive":
+		if value.Int() < 0 {
+			return fmt.Sprintf("must be a positive duration, got %s", time.Duration(value.Int()))
+		}
+	}
+	return ""
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
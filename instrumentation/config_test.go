@@ -0,0 +1,111 @@
+package instrumentation
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateAggregatesProblems(t *testing.T) {
+	cfg := Config{
+		RegistryURL:              "http://registry:8090",
+		InfluxDBURL:              "influx:8086",
+		HandshakeTimeout:         Duration(-time.Second),
+		MaxEndpoints:             -1,
+		SOAPOperations:           []string{"GetUser"},
+		PathNormalizer:           strings.ToLower,
+		DisablePathNormalization: true,
+	}
+
+	err := cfg.Validate()
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Validate() = %v, want a *ValidationError", err)
+	}
+
+	want := []string{"registry_url", "service_name", "influxdb_url", "handshake_timeout", "max_endpoints", "disable_path_normalization", "soap_operations"}
+	var got []string
+	for _, fe := range validationErr.Errors {
+		got = append(got, fe.Field)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("invalid fields = %v, want %v", got, want)
+	}
+	if !strings.Contains(err.Error(), "7 problems") || !strings.Contains(err.Error(), "service_name: is required") {
+		t.Errorf("unexpected message:\n%s", err)
+	}
+}
+
+func TestValidateAcceptsMinimalConfig(t *testing.T) {
+	cfg := Config{RegistryURL: "wss://registry.example.com", ServiceName: "orders"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "observability.json")
+	data := `{"registry_url": "ws://registry:8090", "service_name": "orders", "handshake_timeout": "5s", "max_endpoints": 50}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if time.Duration(cfg.HandshakeTimeout) != 5*time.Second || cfg.MaxEndpoints != 50 {
+		t.Errorf("loaded %+v", cfg)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"registry_url": "ws://r", "servce_name": "typo"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "servce_name") {
+		t.Errorf("LoadConfig with unknown field = %v, want an error naming it", err)
+	}
+}
+
+func TestApplyConfigRejectsInvalidConfig(t *testing.T) {
+	if err := Configure("not a url", "svc", "", "", "", "", WithoutSendQueue()); err == nil {
+		t.Error("Configure accepted an invalid registry URL")
+	}
+	// The previous, valid configuration is kept
+	if !strings.HasPrefix(wsSocketURL, collectorURL) {
+		t.Errorf("wsSocketURL = %q, want it unchanged", wsSocketURL)
+	}
+}
+
+func TestValidatePongTimeoutRequiresKeepalive(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "orders", PongTimeout: Duration(time.Second)}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 1 || validationErr.Errors[0].Field != "pong_timeout" {
+		t.Errorf("Validate() = %v, want pong_timeout rejected", err)
+	}
+	WithKeepalive(10*time.Second, time.Second)(&cfg)
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+func TestKeepaliveReplacesRegistryClient(t *testing.T) {
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	before := registryClient()
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithKeepalive(time.Minute, 0), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	after := registryClient()
+	if after == before {
+		t.Error("registry client kept after the keepalive changed")
+	}
+	if registryClient() != after {
+		t.Error("registry client replaced without a change")
+	}
+}
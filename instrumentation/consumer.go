@@ -0,0 +1,130 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultConsumerLagBuckets are the bucket upper bounds, in milliseconds, of
+// the lag histogram of consumed messages when ConsumerLagBuckets is unset.
+var DefaultConsumerLagBuckets = []float64{100, 500, 1000, 5000, 10000, 30000, 60000, 300000, 900000, 3600000}
+
+// consumerCounts are the cumulative counts of a queue.
+type consumerCounts struct {
+	messages atomic.Int64
+	errors   atomic.Int64
+	// checked counts the messages whose lag was held to an objective
+	checked    atomic.Int64
+	violations atomic.Int64
+}
+
+// queueCounts holds a *consumerCounts per queue.
+var queueCounts sync.Map
+
+func countsOf(queue string) *consumerCounts {
+	val, _ := queueCounts.LoadOrStore(queue, &consumerCounts{})
+	return val.(*consumerCounts)
+}
+
+// ConsumeMessage runs handle for a message consumed from queue and reports
+// it, tagged with the queue. The point carries the message's lag (its age
+// when handle started, from publishedAt) as lag_ms, the cumulative
+// lag_bucket_le_* histogram of the queue, how long handle took as
+// processing_ms, and the message_count and error_count of the queue.
+//
+// Queues with an objective set with WithConsumerLagObjective also get
+// lag_objective_ms, lag_slo_violated when the lag exceeded it, and the
+// queue's lag_slo_violation_count and lag_slo_compliance, the fraction of its
+// messages processed within the objective.
+//
+// The queue must come from the code, not from the message, as every queue is
+// its own series. A zero publishedAt reports no lag.
+//
+//	err := instrumentation.ConsumeMessage(ctx, "orders", msg.Timestamp, func(ctx context.Context) error {
+//		return process(ctx, msg)
+//	})
+func ConsumeMessage(ctx context.Context, queue string, publishedAt time.Time, handle func(ctx context.Context) error) (err error) {
+	start := time.Now()
+	lag := time.Duration(-1)
+	if !publishedAt.IsZero() {
+		// Clocks of publishers may be ahead of ours
+		lag = max(start.Sub(publishedAt), 0)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			reportMessage(ctx, queue, lag, time.Since(start), errPanicked)
+			panic(p)
+		}
+	}()
+	err = handle(ctx)
+	reportMessage(ctx, queue, lag, time.Since(start), err)
+	return err
+}
+
+// errPanicked stands for the error of a panicking handler.
+var errPanicked = errors.New("handler panicked")
+
+// reportMessage counts a consumed message and sends its point; lag is
+// negative when unknown.
+func reportMessage(ctx context.Context, queue string, lag, processing time.Duration, err error) {
+	s := loadSettings()
+	counts := countsOf(queue)
+	counts.messages.Add(1)
+	if err != nil {
+		counts.errors.Add(1)
+	}
+
+	tags := map[string]string{
+		"queue": queue,
+	}
+	fields := map[string]interface{}{
+		"processing_ms": processing.Milliseconds(),
+		"message_count": counts.messages.Load(),
+		"error_count":   counts.errors.Load(),
+	}
+	if err != nil {
+		tags["error_class"] = classifyError(0, ctx.Err(), err)
+	}
+	if lag >= 0 {
+		fields["lag_ms"] = lag.Milliseconds()
+		if s.consumerLagHistogram != nil {
+			s.consumerLagHistogram.observe(fields, queue, lag)
+		}
+		if objective, ok := consumerLagObjective(s, queue); ok {
+			counts.checked.Add(1)
+			violated := lag > objective
+			if violated {
+				counts.violations.Add(1)
+			}
+			checked, violations := counts.checked.Load(), counts.violations.Load()
+			fields["lag_objective_ms"] = objective.Milliseconds()
+			fields["lag_slo_violated"] = violated
+			fields["lag_slo_violation_count"] = violations
+			fields["lag_slo_compliance"] = float64(checked-violations) / float64(checked)
+		}
+	}
+
+	metrics := Metrics{
+		InfluxDBURL: influxDBURL,
+		Token:       currentToken(),
+		Org:         org,
+		Bucket:      bucket,
+		Measurement: measurement,
+		Tags:        tags,
+		Fields:      fields,
+	}
+	reportPoint(metrics)
+}
+
+// consumerLagObjective returns the lag objective of queue, or of "*" if it
+// has none.
+func consumerLagObjective(s *settings, queue string) (time.Duration, bool) {
+	objective, ok := s.consumerLagObjectives[queue]
+	if !ok {
+		objective, ok = s.consumerLagObjectives[sampleAll]
+	}
+	return objective, ok
+}
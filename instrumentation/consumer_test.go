@@ -0,0 +1,93 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConsumeMessageReportsLagAgainstObjective(t *testing.T) {
+	applyOptions([]Option{
+		WithConsumerLagObjective("lag-orders", time.Minute),
+		WithConsumerLagBuckets(1000, 60000),
+	})
+	defer applyOptions(nil)
+
+	ctx := context.Background()
+	for _, age := range []time.Duration{10 * time.Second, 5 * time.Minute} {
+		if err := ConsumeMessage(ctx, "lag-orders", time.Now().Add(-age), func(context.Context) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fresh, stale := nextMetrics(t), nextMetrics(t)
+
+	if fresh.Tags["queue"] != "lag-orders" || fresh.Fields["lag_slo_violated"] != false {
+		t.Errorf("fresh message = %v %v, want within the objective", fresh.Tags, fresh.Fields)
+	}
+	want := map[string]interface{}{
+		"lag_objective_ms":        float64(60000),
+		"lag_slo_violated":        true,
+		"lag_slo_violation_count": float64(1),
+		"lag_slo_compliance":      0.5,
+		"lag_bucket_le_1000":      float64(0),
+		"lag_bucket_le_60000":     float64(1),
+		"lag_bucket_le_inf":       float64(2),
+		"lag_count":               float64(2),
+		"message_count":           float64(2),
+		"error_count":             float64(0),
+	}
+	for field, value := range want {
+		if stale.Fields[field] != value {
+			t.Errorf("%s = %v, want %v", field, stale.Fields[field], value)
+		}
+	}
+	if lag := stale.Fields["lag_ms"].(float64); lag < 300000 {
+		t.Errorf("lag_ms = %v, want at least 5m", lag)
+	}
+}
+
+func TestConsumeMessageWithoutObjective(t *testing.T) {
+	failure := errors.New("poison message")
+	err := ConsumeMessage(context.Background(), "lag-audit", time.Time{}, func(context.Context) error { return failure })
+	if err != failure {
+		t.Fatalf("err = %v, want the handler's", err)
+	}
+	point := nextMetrics(t)
+	if point.Tags["error_class"] != ErrorClassServer || point.Fields["error_count"] != float64(1) {
+		t.Errorf("failed message = %v %v", point.Tags, point.Fields)
+	}
+	for _, field := range []string{"lag_ms", "lag_count", "lag_slo_violated"} {
+		if _, ok := point.Fields[field]; ok {
+			t.Errorf("%s reported for a message without a publish time", field)
+		}
+	}
+}
+
+func TestConsumeMessageReportsPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("the panic wasn't propagated")
+		}
+		if point := nextMetrics(t); point.Fields["error_count"] != float64(1) {
+			t.Errorf("error_count = %v, want 1", point.Fields["error_count"])
+		}
+	}()
+	ConsumeMessage(context.Background(), "lag-panics", time.Now(), func(context.Context) error { panic("boom") })
+}
+
+func TestValidateConsumerLag(t *testing.T) {
+	cfg := Config{
+		RegistryURL:           "ws://registry:8090",
+		ServiceName:           "orders",
+		ConsumerLagObjectives: map[string]Duration{"orders": 0, "*": Duration(time.Minute)},
+		ConsumerLagBuckets:    []float64{1000, 500},
+	}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 2 {
+		t.Fatalf("Validate() = %v, want 2 problems", err)
+	}
+	if fields := validationErr.Errors[0].Field + "," + validationErr.Errors[1].Field; fields != "consumer_lag_buckets[1],consumer_lag_objectives[orders]" {
+		t.Errorf("invalid fields = %s", fields)
+	}
+}
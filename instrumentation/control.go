@@ -0,0 +1,80 @@
+package instrumentation
+
+import (
+	"github.com/jculley01/observability-module/transport"
+	"log"
+	"sync"
+)
+
+// Control event types sent by the registry. Others are passed to handlers
+// registered for them, or for every type, as they are.
+const (
+	// ControlHeartbeatMissed: the registry hasn't heard from this service in
+	// time and may consider it dead.
+	ControlHeartbeatMissed = transport.ControlHeartbeatMissed
+	// ControlCollectorMigrating: the collector is moving to URL; connect there
+	// (e.g. with a new Configure) before the current one goes away.
+	ControlCollectorMigrating = transport.ControlCollectorMigrating
+)
+
+// ControlEvent is a message the registry sent over the metrics connection.
+type ControlEvent = transport.Control
+
+type controlHandler struct {
+	eventType string
+	handle    func(ControlEvent)
+}
+
+var (
+	controlMu       sync.RWMutex
+	controlHandlers = map[*controlHandler]struct{}{}
+)
+
+// OnControlEvent calls handle for every control event of the given type, or
+// of any type when eventType is empty, so the service can log, alert or fail
+// over. Handlers run on the connection's reader and must return quickly. The
+// returned function unregisters the handler.
+func OnControlEvent(eventType string, handle func(ControlEvent)) (remove func()) {
+	h := &controlHandler{eventType: eventType, handle: handle}
+	controlMu.Lock()
+	controlHandlers[h] = struct{}{}
+	controlMu.Unlock()
+	return func() {
+		controlMu.Lock()
+		delete(controlHandlers, h)
+		controlMu.Unlock()
+	}
+}
+
+// dispatchControlMessage passes a message read from the registry connection
+// to the matching handlers. Messages that aren't control events are ignored.
+func dispatchControlMessage(data []byte) {
+	event, ok := transport.ParseControl(data)
+	if !ok {
+		return
+	}
+
+	controlMu.RLock()
+	var handlers []func(ControlEvent)
+	for h := range controlHandlers {
+		if h.eventType == "" || h.eventType == event.Type {
+			handlers = append(handlers, h.handle)
+		}
+	}
+	controlMu.RUnlock()
+
+	for _, handle := range handlers {
+		callControlHandler(handle, event)
+	}
+}
+
+// callControlHandler keeps a panicking handler from taking the connection's
+// reader down with it.
+func callControlHandler(handle func(ControlEvent), event ControlEvent) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Control event handler for %s panicked: %v\n", event.Type, p)
+		}
+	}()
+	handle(event)
+}
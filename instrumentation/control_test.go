@@ -0,0 +1,73 @@
+package instrumentation
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDispatchControlMessage(t *testing.T) {
+	var migrations, all []ControlEvent
+	removeMigrating := OnControlEvent(ControlCollectorMigrating, func(e ControlEvent) { migrations = append(migrations, e) })
+	removeAll := OnControlEvent("", func(e ControlEvent) { all = append(all, e) })
+	removePanicking := OnControlEvent(ControlHeartbeatMissed, func(ControlEvent) { panic("handler bug") })
+	defer removeAll()
+	defer removePanicking()
+
+	dispatchControlMessage([]byte(`{"type":"collector_migrating","url":"wss://collector-2:8090"}`))
+	dispatchControlMessage([]byte(`{"type":"heartbeat_missed","message":"no heartbeat for 90s"}`))
+	dispatchControlMessage([]byte(`not json`))
+	removeMigrating()
+	dispatchControlMessage([]byte(`{"type":"collector_migrating","url":"wss://collector-3:8090"}`))
+
+	if len(migrations) != 1 || migrations[0].URL != "wss://collector-2:8090" {
+		t.Errorf("migration events = %+v, want only the first one", migrations)
+	}
+	if len(all) != 3 || all[1].Message != "no heartbeat for 90s" || !strings.Contains(string(all[1].Raw), "heartbeat_missed") {
+		t.Errorf("events = %+v, want the three control events", all)
+	}
+}
+
+func TestControlEventsArriveOverMetricsConnection(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, _, err := c.ReadMessage(); err != nil {
+			return
+		}
+		c.WriteMessage(websocket.TextMessage, []byte(`{"type":"heartbeat_missed"}`))
+		c.ReadMessage()
+	}))
+	defer registry.Close()
+
+	events := make(chan ControlEvent, 1)
+	defer OnControlEvent(ControlHeartbeatMissed, func(e ControlEvent) { events <- e })()
+
+	// Point the shared connection at this registry for the duration of the test
+	resetConnection := func(url string) {
+		registryMu.Lock()
+		wsSocketURL = url
+		registryMu.Unlock()
+	}
+	resetConnection("ws" + strings.TrimPrefix(registry.URL, "http"))
+	defer resetConnection(collectorURL + "/metrics")
+
+	if err := sendMetrics(Metrics{Measurement: "test-service"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if e.Type != ControlHeartbeatMissed {
+			t.Errorf("event type = %q", e.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no control event received")
+	}
+}
@@ -0,0 +1,260 @@
+package instrumentation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDatadogURL           = "https://api.datadoghq.com"
+	defaultDatadogNamespace     = "observability"
+	defaultDatadogBatchSize     = 500
+	defaultDatadogFlushInterval = 10 * time.Second
+	datadogSubmitTimeout        = 10 * time.Second
+	// datadogMaxPendingBatches bounds the series waiting to be submitted while
+	// the API is slow, in batches
+	datadogMaxPendingBatches = 10
+	// datadogGauge is the gauge type of the v2 series API
+	datadogGauge = 3
+)
+
+// DatadogConfig sends every point to the Datadog metrics API, next to the
+// registry or instead of it when RegistryURL is empty. Each numeric or boolean
+// field becomes a gauge named Namespace + "." + the field ("observability" if
+// Namespace is empty), tagged with the point's tags, service:<ServiceName>
+// and Tags, e.g. "env:prod". Datadog bills every tag combination, so the
+// client-controlled ip_address and user_agent tags are left out. Series are
+// submitted in batches of up to BatchSize (500 if zero) every FlushInterval
+// (10s if zero).
+//
+// Datadog keeps one value per series and second, so use WithAggregationWindow
+// for endpoints serving more than one request a second.
+type DatadogConfig struct {
+	APIKey string `json:"api_key"`
+	// URL is the API of the Datadog site, https://api.datadoghq.com if
+	// empty, e.g. "https://api.datadoghq.eu".
+	URL           string   `json:"url"`
+	Namespace     string   `json:"namespace"`
+	Tags          []string `json:"tags"`
+	BatchSize     int      `json:"batch_size"`
+	FlushInterval Duration `json:"flush_interval"`
+	// Retry retries the batches that couldn't be submitted.
+	Retry RetryPolicy `json:"retry"`
+}
+
+// clientTags are point tags with a value per client, left out by the
+// backends where every tag combination is a series of its own.
+var clientTags = map[string]bool{"ip_address": true, "user_agent": true}
+
+// datadogSeries is a series of the v2 series API.
+type datadogSeries struct {
+	Metric string         `json:"metric"`
+	Type   int            `json:"type"`
+	Points []datadogPoint `json:"points"`
+	Tags   []string       `json:"tags,omitempty"`
+}
+
+type datadogPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// datadogExporter submits the series of the points sent.
+type datadogExporter struct {
+	config    DatadogConfig
+	url       string
+	namespace string
+	batch     *pendingBatch[datadogSeries]
+}
+
+var (
+	datadogMu sync.Mutex
+	datadog   *datadogExporter
+)
+
+// startDatadog replaces the exporter of any previously applied config, keeping
+// it when its config is unchanged. A replaced exporter submits its pending
+// series in the background.
+func startDatadog(cfg Config) {
+	datadogMu.Lock()
+	defer datadogMu.Unlock()
+	if datadog != nil && reflect.DeepEqual(datadog.config, cfg.Datadog) {
+		return
+	}
+	if previous := datadog; previous != nil {
+		previous.batch.stop()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), datadogSubmitTimeout)
+			defer cancel()
+			if err := previous.batch.flush(ctx); err != nil {
+				log.Printf("Error submitting metrics to Datadog: %v\n", err)
+			}
+		}()
+		datadog = nil
+	}
+	if cfg.Datadog.APIKey == "" {
+		return
+	}
+	e := &datadogExporter{
+		config:    cfg.Datadog,
+		url:       strings.TrimSuffix(cfg.Datadog.URL, "/"),
+		namespace: cfg.Datadog.Namespace,
+	}
+	if e.url == "" {
+		e.url = defaultDatadogURL
+	}
+	if e.namespace == "" {
+		e.namespace = defaultDatadogNamespace
+	}
+	e.batch = &pendingBatch[datadogSeries]{
+		size:       cfg.Datadog.BatchSize,
+		maxBatches: datadogMaxPendingBatches,
+		interval:   time.Duration(cfg.Datadog.FlushInterval),
+		timeout:    datadogSubmitTimeout,
+		submit:     e.submit,
+		logError: func(err error) {
+			log.Printf("Error submitting metrics to Datadog: %v\n", err)
+		},
+		droppedFormat: "Dropped %d Datadog series while the API was slow\n",
+	}
+	if e.batch.size == 0 {
+		e.batch.size = defaultDatadogBatchSize
+	}
+	if e.batch.interval == 0 {
+		e.batch.interval = defaultDatadogFlushInterval
+	}
+	datadog = e
+	e.batch.start()
+}
+
+// stopDatadog submits the pending series and stops the exporter.
+func stopDatadog(ctx context.Context) error {
+	datadogMu.Lock()
+	e := datadog
+	datadog = nil
+	datadogMu.Unlock()
+	if e == nil {
+		return nil
+	}
+	e.batch.stop()
+	if err := e.batch.flush(ctx); err != nil {
+		return fmt.Errorf("error submitting metrics to Datadog: %w", err)
+	}
+	return nil
+}
+
+// sendToDatadog queues the series of a point when Datadog is configured.
+func sendToDatadog(metrics Metrics) {
+	datadogMu.Lock()
+	e := datadog
+	datadogMu.Unlock()
+	if e != nil {
+		e.batch.add(datadogSeriesOf(metrics, e.namespace, e.config.Tags, time.Now())...)
+	}
+}
+
+// datadogSeriesOf converts the numeric and boolean fields of a point to
+// gauges; other fields are left out.
+func datadogSeriesOf(metrics Metrics, namespace string, extraTags []string, now time.Time) []datadogSeries {
+	tags := make([]string, 0, len(metrics.Tags)+len(extraTags)+1)
+	for key, value := range metrics.Tags {
+		if value != "" && !clientTags[key] {
+			tags = append(tags, key+":"+value)
+		}
+	}
+	tags = append(tags, "service:"+metrics.Measurement)
+	tags = append(tags, extraTags...)
+
+	var series []datadogSeries
+	for key, value := range metrics.Fields {
+		v, ok := gaugeValue(value)
+		if !ok {
+			continue
+		}
+		series = append(series, datadogSeries{
+			Metric: namespace + "." + datadogMetricName(key),
+			Type:   datadogGauge,
+			Points: []datadogPoint{{Timestamp: now.Unix(), Value: v}},
+			Tags:   tags,
+		})
+	}
+	return series
+}
+
+// gaugeValue converts a numeric or boolean field to the value of a gauge,
+// reporting false for the other fields.
+func gaugeValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// datadogMetricName replaces the characters Datadog doesn't allow in metric
+// names with underscores.
+func datadogMetricName(field string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, field)
+}
+
+// submit submits a batch of series. A batch that can't be submitted, retries
+// included, is dropped.
+func (e *datadogExporter) submit(ctx context.Context, series []datadogSeries) error {
+	if err := retry(ctx, e.config.Retry, func() error { return e.post(ctx, series) }); err != nil {
+		return fmt.Errorf("dropped %d series: %w", len(series), err)
+	}
+	return nil
+}
+
+// post posts series to the v2 series API.
+func (e *datadogExporter) post(ctx context.Context, series []datadogSeries) error {
+	body, err := json.Marshal(map[string][]datadogSeries{"series": series})
+	if err != nil {
+		return NonRetryable(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url+"/api/v2/series", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", e.config.APIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &StatusError{StatusCode: resp.StatusCode, Message: "Datadog answered " + resp.Status}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package instrumentation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDatadog records the series submitted to it.
+func fakeDatadog(t *testing.T) (*httptest.Server, chan []datadogSeries) {
+	t.Helper()
+	submissions := make(chan []datadogSeries, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/series" || r.Header.Get("DD-API-KEY") != "dd-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var body struct {
+			Series []datadogSeries `json:"series"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		submissions <- body.Series
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+	return server, submissions
+}
+
+func TestDatadogSubmitsPointsOnShutdown(t *testing.T) {
+	server, submissions := fakeDatadog(t)
+	if err := Configure(collectorURL, "test-service", "", "", "", "",
+		WithDatadog(DatadogConfig{APIKey: "dd-key", URL: server.URL, Tags: []string{"env:test"}, FlushInterval: Duration(time.Hour)}),
+		WithoutSendQueue(),
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/datadog/orders", nil))
+	nextMetrics(t)
+
+	if err := stopDatadog(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	series := <-submissions
+	var latency *datadogSeries
+	for i := range series {
+		if series[i].Metric == "observability.latency_ms" {
+			latency = &series[i]
+		}
+	}
+	if latency == nil {
+		t.Fatalf("no observability.latency_ms series in %v", series)
+	}
+	for _, tag := range []string{"endpoint:/datadog/orders", "service:test-service", "env:test", "instance_id:" + instanceID} {
+		if !slices.Contains(latency.Tags, tag) {
+			t.Errorf("tags %v lack %s", latency.Tags, tag)
+		}
+	}
+	for _, tag := range latency.Tags {
+		if strings.HasPrefix(tag, "ip_address:") || strings.HasPrefix(tag, "user_agent:") {
+			t.Errorf("client-controlled tag %s sent to Datadog", tag)
+		}
+	}
+	if latency.Type != datadogGauge || len(latency.Points) != 1 {
+		t.Errorf("series = %+v", *latency)
+	}
+}
+
+func TestDatadogSubmitsFullBatches(t *testing.T) {
+	server, submissions := fakeDatadog(t)
+	startDatadog(Config{Datadog: DatadogConfig{APIKey: "dd-key", URL: server.URL, BatchSize: 2, FlushInterval: Duration(time.Hour)}})
+	defer func() {
+		if err := stopDatadog(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	sendToDatadog(Metrics{Measurement: "orders", Fields: map[string]interface{}{"a": 1, "b": 2, "c": 3}})
+	select {
+	case series := <-submissions:
+		if len(series) != 2 {
+			t.Errorf("submitted %d series, want a batch of 2", len(series))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a full batch wasn't submitted before the flush interval")
+	}
+}
+
+func TestDatadogSeriesOf(t *testing.T) {
+	series := datadogSeriesOf(Metrics{
+		Measurement: "orders",
+		Tags:        map[string]string{"endpoint": "/orders"},
+		Fields:      map[string]interface{}{"error": true, "latency ms": int64(12), "error_class": "timeout"},
+	}, "app", nil, time.Unix(1700000000, 0))
+	values := map[string]float64{}
+	for _, s := range series {
+		values[s.Metric] = s.Points[0].Value
+		if s.Points[0].Timestamp != 1700000000 {
+			t.Errorf("%s timestamp = %d", s.Metric, s.Points[0].Timestamp)
+		}
+	}
+	want := map[string]float64{"app.error": 1, "app.latency_ms": 12}
+	if len(values) != len(want) || values["app.error"] != 1 || values["app.latency_ms"] != 12 {
+		t.Errorf("series values = %v, want %v", values, want)
+	}
+}
+
+func TestDatadogRequiresAPIKey(t *testing.T) {
+	var validationErr *ValidationError
+	err := Config{ServiceName: "orders", Datadog: DatadogConfig{Tags: []string{"env:prod"}}}.Validate()
+	if !errors.As(err, &validationErr) || validationErr.Errors[0].Field != "datadog.api_key" {
+		t.Errorf("Validate() = %v", err)
+	}
+	if err := (Config{ServiceName: "orders", Datadog: DatadogConfig{APIKey: "dd-key"}}).Validate(); err != nil {
+		t.Errorf("Validate() without a registry = %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package instrumentation
+
+import (
+	"sync"
+	"time"
+)
+
+// endpointDiscoveredEvent is the event sent for endpoints served for the
+// first time.
+const endpointDiscoveredEvent = "endpoint_discovered"
+
+// endpointDiscovery remembers when each endpoint tag was last served. It holds
+// at most MaxEndpoints entries, as the endpoint tags are capped.
+type endpointDiscovery struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+var discoveredEndpoints = &endpointDiscovery{lastSeen: map[string]time.Time{}}
+
+// observe records that endpoint was served at now, and reports whether it is
+// new: never served before, or not over the last window.
+func (d *endpointDiscovery) observe(endpoint string, window time.Duration, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	last, seen := d.lastSeen[endpoint]
+	d.lastSeen[endpoint] = now
+	return !seen || now.Sub(last) > window
+}
+
+// discoverEndpoint sends an endpoint_discovered event, with the time it was
+// first seen and the method of the request, when a request is counted under
+// an endpoint not served over the last EndpointDiscoveryWindow. It does
+// nothing without a window.
+func discoverEndpoint(endpoint string, method string) {
+	window := loadSettings().endpointDiscoveryWindow
+	if window <= 0 || endpoint == overflowEndpoint {
+		return
+	}
+	now := time.Now()
+	if !discoveredEndpoints.observe(endpoint, window, now) {
+		return
+	}
+	fields := map[string]interface{}{"first_seen": now.UTC().Format(time.RFC3339Nano)}
+	if method != "" {
+		fields["method"] = method
+	}
+	sendEvent(endpointDiscoveredEvent, map[string]string{"endpoint": endpoint}, fields)
+}
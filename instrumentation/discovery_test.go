@@ -0,0 +1,50 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEndpointDiscoveryWindow(t *testing.T) {
+	d := &endpointDiscovery{lastSeen: map[string]time.Time{}}
+	start := time.Now()
+	for i, step := range []struct {
+		at   time.Duration
+		want bool
+	}{{0, true}, {time.Minute, false}, {2 * time.Minute, false}, {4 * time.Minute, true}} {
+		if got := d.observe("/orders", 90*time.Second, start.Add(step.at)); got != step.want {
+			t.Errorf("observation %d = %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestMiddlewareSendsEndpointDiscovered(t *testing.T) {
+	applyOptions([]Option{WithEndpointDiscovery(time.Hour)})
+	defer applyOptions(nil)
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/discovery/shadow", nil))
+	event := nextMetrics(t)
+	if event.Tags["event"] != endpointDiscoveredEvent || event.Tags["endpoint"] != "/discovery/shadow" || event.Fields["method"] != http.MethodPost {
+		t.Errorf("event = %v %v, want endpoint_discovered", event.Tags, event.Fields)
+	}
+	if firstSeen, err := time.Parse(time.RFC3339Nano, event.Fields["first_seen"].(string)); err != nil || time.Since(firstSeen) > time.Minute {
+		t.Errorf("first_seen = %v, want the time of the request", event.Fields["first_seen"])
+	}
+	if metrics := nextMetrics(t); metrics.Tags["endpoint"] != "/discovery/shadow" || metrics.Tags["event"] != "" {
+		t.Errorf("point = %v, want the request", metrics.Tags)
+	}
+
+	// Only the request point the second time
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/discovery/shadow", nil))
+	if metrics := nextMetrics(t); metrics.Tags["event"] != "" {
+		t.Errorf("point = %v, want the request", metrics.Tags)
+	}
+	select {
+	case metrics := <-received:
+		t.Errorf("unexpected point %v", metrics.Tags)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
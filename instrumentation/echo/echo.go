@@ -0,0 +1,90 @@
+// Package echo instruments Echo v4 applications. It lives in its own module so
+// that services not using Echo never pull it into their dependency graph.
+// Importing it (even blank) lets InstrumentEndpoint accept an *echo.Echo.
+package echo
+
+import (
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/protocol"
+	labecho "github.com/labstack/echo/v4"
+	"net/http"
+)
+
+func init() {
+	instrumentation.RegisterFrameworkAdapter(func(routerOrServer interface{}) bool {
+		e, ok := routerOrServer.(*labecho.Echo)
+		if ok {
+			e.Use(Middleware)
+		}
+		return ok
+	})
+	instrumentation.RegisterRouteLister(func(routerOrServer interface{}) ([]protocol.Route, bool) {
+		e, ok := routerOrServer.(*labecho.Echo)
+		if !ok {
+			return nil, false
+		}
+		var routes []protocol.Route
+		for _, route := range e.Routes() {
+			// Not found handlers of RouteNotFound aren't routes clients call
+			if route.Method != labecho.RouteNotFound {
+				routes = append(routes, protocol.Route{Method: route.Method, Pattern: route.Path, Handler: route.Name})
+			}
+		}
+		return routes, true
+	})
+}
+
+// Middleware reports metrics for every request, tagged with the matched route
+// template (e.g. "/users/:id"). It runs the rest of the chain through
+// instrumentation.Middleware; handlers returning an error count as failed.
+func Middleware(next labecho.HandlerFunc) labecho.HandlerFunc {
+	return func(c labecho.Context) (err error) {
+		writer := c.Response().Writer
+		instrumentation.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := c.Path(); route != "" {
+				instrumentation.SetRoute(r, route)
+			}
+			instrumentation.SetClientIP(r, c.RealIP())
+			instrumentation.SetFrameworkContext(r, c)
+			c.SetRequest(r)
+			// Handlers write and flush through c.Response(); routing it
+			// through w lets Middleware see the first byte and the flushes of
+			// streams
+			c.Response().Writer = w
+			// Continue processing
+			err = next(c)
+
+			// Handlers write through c.Response(), which has the final status
+			// and size
+			instrumentation.SetResponse(r, c.Response().Status, int(c.Response().Size))
+			instrumentation.SetError(r, err)
+		})).ServeHTTP(writer, c.Request())
+		return err
+	}
+}
+
+// WithTagExtractor is instrumentation.WithTagExtractor with access to the
+// echo.Context.
+func WithTagExtractor(extract func(c labecho.Context) map[string]string) instrumentation.Option {
+	return func(cfg *instrumentation.Config) {
+		cfg.ContextTagExtractors = append(cfg.ContextTagExtractors, func(ctx interface{}) map[string]string {
+			if c, ok := ctx.(labecho.Context); ok {
+				return extract(c)
+			}
+			return nil
+		})
+	}
+}
+
+// WithFieldExtractor is instrumentation.WithFieldExtractor with access to the
+// echo.Context.
+func WithFieldExtractor(extract func(c labecho.Context) map[string]interface{}) instrumentation.Option {
+	return func(cfg *instrumentation.Config) {
+		cfg.ContextFieldExtractors = append(cfg.ContextFieldExtractors, func(ctx interface{}) map[string]interface{} {
+			if c, ok := ctx.(labecho.Context); ok {
+				return extract(c)
+			}
+			return nil
+		})
+	}
+}
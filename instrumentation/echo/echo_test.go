@@ -0,0 +1,84 @@
+package echo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/instrumentation/instrumentationtest"
+	labecho "github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareUsesRouteTemplate(t *testing.T) {
+	collector := instrumentationtest.NewCollector()
+	defer collector.Close()
+
+	e := labecho.New()
+	err := instrumentation.InstrumentEndpoint(e, collector.URL, "test-service", "", "", "", "",
+		WithTagExtractor(func(c labecho.Context) map[string]string {
+			return map[string]string{"user_id": c.Param("id")}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.GET("/echo/users/:id", func(c labecho.Context) error { return c.String(http.StatusOK, "ok") })
+	e.GET("/echo/broken", func(c labecho.Context) error { return errors.New("broken") })
+	e.GET("/echo/slow", func(c labecho.Context) error { return context.DeadlineExceeded })
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/users/42", nil))
+	metrics := collector.Next(t)
+	if metrics.Tags["endpoint"] != "/echo/users/:id" || metrics.Tags["user_id"] != "42" {
+		t.Errorf("tags = %v, want the route template and user_id 42", metrics.Tags)
+	}
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/broken", nil))
+	if got := collector.Next(t).Fields["error_count"]; got != float64(1) {
+		t.Errorf("error_count = %v, want 1", got)
+	}
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo/slow", nil))
+	if got := collector.Next(t).Tags["error_class"]; got != instrumentation.ErrorClassTimeout {
+		t.Errorf("error_class = %q, want timeout from the returned error", got)
+	}
+}
+
+func TestMiddlewareReportsStreams(t *testing.T) {
+	collector := instrumentationtest.NewCollector()
+	defer collector.Close()
+
+	e := labecho.New()
+	if err := instrumentation.InstrumentEndpoint(e, collector.URL, "test-service", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	e.GET("/echo/events", func(c labecho.Context) error {
+		c.Response().Header().Set(labecho.HeaderContentType, "text/event-stream")
+		for i := 0; i < 3; i++ {
+			if i > 0 {
+				time.Sleep(20 * time.Millisecond)
+			}
+			fmt.Fprintf(c.Response(), "data: %d\n\n", i)
+			http.NewResponseController(c.Response()).Flush()
+		}
+		return nil
+	})
+
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/echo/events", nil))
+	if !rr.Flushed {
+		t.Error("flush didn't reach the underlying writer")
+	}
+	metrics := collector.Next(t)
+	if metrics.Fields["streaming"] != true || metrics.Fields["response_size"] != float64(rr.Body.Len()) {
+		t.Errorf("fields = %v, want a streamed response", metrics.Fields)
+	}
+	duration, _ := metrics.Fields["stream_duration_ms"].(float64)
+	latency, _ := metrics.Fields["latency_ms"].(float64)
+	if duration < 40 || latency >= 20 || metrics.Fields["ttfb_ms"] != latency {
+		t.Errorf("stream_duration_ms = %v, latency_ms = %v, ttfb_ms = %v: want the latency to be the time to first byte", duration, latency, metrics.Fields["ttfb_ms"])
+	}
+}
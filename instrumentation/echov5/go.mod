@@ -0,0 +1,21 @@
+module github.com/jculley01/observability-module/instrumentation/echov5
+
+// Echo v5 requires Go 1.25, newer than the 1.21 of the other modules.
+go 1.25.0
+
+require (
+	github.com/jculley01/observability-module v0.1.0
+	github.com/labstack/echo/v5 v5.0.0
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.7.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/gorilla/websocket v1.5.1 // indirect
+	golang.org/x/net v0.49.0 // indirect
+	golang.org/x/sys v0.40.0 // indirect
+	golang.org/x/text v0.33.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230822172742-b8732ec3820d // indirect
+	google.golang.org/grpc v1.59.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
@@ -0,0 +1,304 @@
+package instrumentation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultElasticsearchIndex         = "metrics-observability"
+	defaultElasticsearchBatchSize     = 500
+	defaultElasticsearchFlushInterval = 10 * time.Second
+	elasticsearchSubmitTimeout        = 10 * time.Second
+	// elasticsearchMaxPendingBatches bounds the documents waiting to be
+	// indexed while the cluster is slow, in batches
+	elasticsearchMaxPendingBatches = 10
+	// elasticsearchIndexDate is the date suffix of the daily indices
+	elasticsearchIndexDate = "2006.01.02"
+)
+
+// ElasticsearchConfig bulk-indexes every point as a document into
+// Elasticsearch or OpenSearch, next to the registry or instead of it when
+// RegistryURL is empty. Documents go to a daily index, Index + "-" + the UTC
+// date of the point, e.g. "metrics-observability-2024.05.31", so retention
+// can drop whole indices. Documents are indexed in batches of up to BatchSize
+// (500 if zero) every FlushInterval (10s if zero).
+//
+// Before the first batch an index template is put for Index + "-*", mapping
+// tags as keywords and, with ILMPolicy, attaching the ILM policy of that name
+// to the indices it creates. Set SkipTemplate when the template is managed
+// elsewhere.
+type ElasticsearchConfig struct {
+	// URL is the cluster, e.g. "https://es:9200".
+	URL string `json:"url"`
+	// Username and Password authenticate with basic auth, APIKey with an
+	// Elasticsearch API key, the base64 of "id:key".
+	Username string `json:"username"`
+	Password string `json:"password"`
+	APIKey   string `json:"api_key"`
+	// Index is the prefix of the daily indices, "metrics-observability" if
+	// empty.
+	Index         string   `json:"index"`
+	ILMPolicy     string   `json:"ilm_policy"`
+	SkipTemplate  bool     `json:"skip_template"`
+	BatchSize     int      `json:"batch_size"`
+	FlushInterval Duration `json:"flush_interval"`
+	// Retry retries the template and the batches that couldn't be indexed.
+	// Batches the cluster partly rejected aren't retried, as the documents
+	// it accepted would be indexed twice.
+	Retry RetryPolicy `json:"retry"`
+}
+
+// elasticsearchDocument is a point as indexed.
+type elasticsearchDocument struct {
+	Timestamp   time.Time              `json:"@timestamp"`
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Fields      map[string]interface{} `json:"fields,omitempty"`
+}
+
+// elasticsearchEntry is a document encoded for the bulk API, with its index.
+type elasticsearchEntry struct {
+	index    string
+	document []byte
+}
+
+// elasticsearchExporter bulk-indexes the documents of the points sent.
+type elasticsearchExporter struct {
+	config ElasticsearchConfig
+	url    string
+	index  string
+	batch  *pendingBatch[elasticsearchEntry]
+	// templatePut is only used by submit, which batches call one at a time
+	templatePut bool
+}
+
+var (
+	elasticsearchMu sync.Mutex
+	elasticsearch   *elasticsearchExporter
+)
+
+// startElasticsearch replaces the exporter of any previously applied config,
+// keeping it when its config is unchanged. A replaced exporter indexes its
+// pending documents in the background.
+func startElasticsearch(cfg Config) {
+	elasticsearchMu.Lock()
+	defer elasticsearchMu.Unlock()
+	if elasticsearch != nil && reflect.DeepEqual(elasticsearch.config, cfg.Elasticsearch) {
+		return
+	}
+	if previous := elasticsearch; previous != nil {
+		previous.batch.stop()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), elasticsearchSubmitTimeout)
+			defer cancel()
+			if err := previous.batch.flush(ctx); err != nil {
+				log.Printf("Error indexing metrics into Elasticsearch: %v\n", err)
+			}
+		}()
+		elasticsearch = nil
+	}
+	if cfg.Elasticsearch.URL == "" {
+		return
+	}
+	e := &elasticsearchExporter{
+		config: cfg.Elasticsearch,
+		url:    strings.TrimSuffix(cfg.Elasticsearch.URL, "/"),
+		index:  cfg.Elasticsearch.Index,
+	}
+	if e.index == "" {
+		e.index = defaultElasticsearchIndex
+	}
+	e.batch = &pendingBatch[elasticsearchEntry]{
+		size:       cfg.Elasticsearch.BatchSize,
+		maxBatches: elasticsearchMaxPendingBatches,
+		interval:   time.Duration(cfg.Elasticsearch.FlushInterval),
+		timeout:    elasticsearchSubmitTimeout,
+		submit:     e.submit,
+		logError: func(err error) {
+			log.Printf("Error indexing metrics into Elasticsearch: %v\n", err)
+		},
+		droppedFormat: "Dropped %d Elasticsearch documents while the cluster was slow\n",
+	}
+	if e.batch.size == 0 {
+		e.batch.size = defaultElasticsearchBatchSize
+	}
+	if e.batch.interval == 0 {
+		e.batch.interval = defaultElasticsearchFlushInterval
+	}
+	elasticsearch = e
+	e.batch.start()
+}
+
+// stopElasticsearch indexes the pending documents and stops the exporter.
+func stopElasticsearch(ctx context.Context) error {
+	elasticsearchMu.Lock()
+	e := elasticsearch
+	elasticsearch = nil
+	elasticsearchMu.Unlock()
+	if e == nil {
+		return nil
+	}
+	e.batch.stop()
+	if err := e.batch.flush(ctx); err != nil {
+		return fmt.Errorf("error indexing metrics into Elasticsearch: %w", err)
+	}
+	return nil
+}
+
+// sendToElasticsearch queues the document of a point when Elasticsearch is
+// configured.
+func sendToElasticsearch(metrics Metrics) {
+	elasticsearchMu.Lock()
+	e := elasticsearch
+	elasticsearchMu.Unlock()
+	if e == nil {
+		return
+	}
+	document := elasticsearchDocument{
+		Timestamp:   pointTime(metrics, time.Now()).UTC(),
+		Measurement: metrics.Measurement,
+		Tags:        metrics.Tags,
+		Fields:      metrics.Fields,
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		log.Printf("Error encoding metrics for Elasticsearch: %v\n", err)
+		return
+	}
+	e.batch.add(elasticsearchEntry{index: e.index + "-" + document.Timestamp.Format(elasticsearchIndexDate), document: data})
+}
+
+// submit indexes a batch of documents, putting the index template first if it
+// wasn't yet. A batch that can't be indexed, retries included, is dropped.
+func (e *elasticsearchExporter) submit(ctx context.Context, batch []elasticsearchEntry) error {
+	if !e.config.SkipTemplate && !e.templatePut {
+		// Documents indexed without the template would be mapped dynamically
+		if err := retry(ctx, e.config.Retry, func() error { return e.putTemplate(ctx) }); err != nil {
+			return fmt.Errorf("dropped %d documents: error putting the index template: %w", len(batch), err)
+		}
+		e.templatePut = true
+	}
+	if err := retry(ctx, e.config.Retry, func() error { return e.bulk(ctx, batch) }); err != nil {
+		return fmt.Errorf("dropped %d documents: %w", len(batch), err)
+	}
+	return nil
+}
+
+// elasticsearchTemplate returns the composable index template of the daily
+// indices of index: tags are keywords, string fields too, other fields
+// are mapped from their first value.
+func elasticsearchTemplate(index, ilmPolicy string) map[string]interface{} {
+	settings := map[string]interface{}{}
+	if ilmPolicy != "" {
+		settings["index.lifecycle.name"] = ilmPolicy
+	}
+	return map[string]interface{}{
+		"index_patterns": []string{index + "-*"},
+		"template": map[string]interface{}{
+			"settings": settings,
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []map[string]interface{}{
+					{"tags": map[string]interface{}{"path_match": "tags.*", "mapping": map[string]string{"type": "keyword"}}},
+					{"strings": map[string]interface{}{"match_mapping_type": "string", "mapping": map[string]string{"type": "keyword"}}},
+				},
+				"properties": map[string]interface{}{
+					"@timestamp":  map[string]string{"type": "date"},
+					"measurement": map[string]string{"type": "keyword"},
+				},
+			},
+		},
+	}
+}
+
+// putTemplate puts the index template of the daily indices.
+func (e *elasticsearchExporter) putTemplate(ctx context.Context) error {
+	body, err := json.Marshal(elasticsearchTemplate(e.index, e.config.ILMPolicy))
+	if err != nil {
+		return err
+	}
+	resp, err := e.do(ctx, http.MethodPut, "/_index_template/"+e.index, "application/json", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// bulk indexes documents with the bulk API, each into its daily index.
+func (e *elasticsearchExporter) bulk(ctx context.Context, entries []elasticsearchEntry) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, entry := range entries {
+		if err := encoder.Encode(map[string]map[string]string{"create": {"_index": entry.index}}); err != nil {
+			return err
+		}
+		body.Write(entry.document)
+		body.WriteByte('\n')
+	}
+	resp, err := e.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The bulk API answers 200 even when documents were rejected
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Error *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error reading the bulk response: %w", err)
+	}
+	if !result.Errors {
+		return nil
+	}
+	rejected := 0
+	var first string
+	for _, item := range result.Items {
+		for _, outcome := range item {
+			if outcome.Error != nil {
+				if rejected == 0 {
+					first = outcome.Error.Type + ": " + outcome.Error.Reason
+				}
+				rejected++
+			}
+		}
+	}
+	return NonRetryable(fmt.Errorf("%d of %d documents rejected, the first with %s", rejected, len(entries), first))
+}
+
+// do sends a request to the cluster, failing on statuses other than 2xx.
+func (e *elasticsearchExporter) do(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, e.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.config.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+e.config.APIKey)
+	} else if e.config.Username != "" {
+		req.SetBasicAuth(e.config.Username, e.config.Password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, &StatusError{StatusCode: resp.StatusCode, Message: "Elasticsearch answered " + resp.Status}
+	}
+	return resp, nil
+}
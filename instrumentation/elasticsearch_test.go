@@ -0,0 +1,121 @@
+package instrumentation
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bulkLine is a line of a bulk request: an action or a document.
+type bulkLine map[string]interface{}
+
+// fakeElasticsearch records the index templates put and the bulk requests
+// sent to it, answering each document with rejected when set.
+func fakeElasticsearch(t *testing.T, rejected bool) (*httptest.Server, chan map[string]interface{}, chan []bulkLine) {
+	t.Helper()
+	templates := make(chan map[string]interface{}, 10)
+	bulks := make(chan []bulkLine, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "ApiKey es-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/_index_template/metrics-test":
+			var template map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+				t.Error(err)
+			}
+			templates <- template
+			w.Write([]byte(`{"acknowledged":true}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/_bulk":
+			var lines []bulkLine
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				var line bulkLine
+				if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+					t.Errorf("invalid bulk line %q: %v", scanner.Text(), err)
+				}
+				lines = append(lines, line)
+			}
+			bulks <- lines
+			if rejected {
+				w.Write([]byte(`{"errors":true,"items":[{"create":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field"}}}]}`))
+				return
+			}
+			w.Write([]byte(`{"errors":false,"items":[]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, templates, bulks
+}
+
+func TestElasticsearchIndexesDailyIndices(t *testing.T) {
+	server, templates, bulks := fakeElasticsearch(t, false)
+	startElasticsearch(Config{Elasticsearch: ElasticsearchConfig{URL: server.URL + "/", APIKey: "es-key", Index: "metrics-test", ILMPolicy: "metrics-30d", FlushInterval: Duration(time.Hour)}})
+	sendToElasticsearch(Metrics{Measurement: "orders", Tags: map[string]string{"endpoint": "/orders"}, Fields: map[string]interface{}{"latency_ms": 12}, Timestamp: 1700000000, Precision: PrecisionSeconds})
+	sendToElasticsearch(Metrics{Measurement: "orders", Fields: map[string]interface{}{"latency_ms": 3}, Timestamp: 1700100000000, Precision: PrecisionMilliseconds})
+	if err := stopElasticsearch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	template := <-templates
+	if patterns, _ := template["index_patterns"].([]interface{}); len(patterns) != 1 || patterns[0] != "metrics-test-*" {
+		t.Errorf("template index patterns = %v", template["index_patterns"])
+	}
+	settings := template["template"].(map[string]interface{})["settings"].(map[string]interface{})
+	if settings["index.lifecycle.name"] != "metrics-30d" {
+		t.Errorf("template settings = %v, want the ILM policy", settings)
+	}
+
+	lines := <-bulks
+	if len(lines) != 4 {
+		t.Fatalf("bulk of %d lines, want an action and a document per point", len(lines))
+	}
+	for i, index := range []string{"metrics-test-2023.11.14", "metrics-test-2023.11.16"} {
+		if action, _ := lines[2*i]["create"].(map[string]interface{}); action["_index"] != index {
+			t.Errorf("action %d = %v, want the create of a document in %s", i, lines[2*i], index)
+		}
+	}
+	document := lines[1]
+	if document["@timestamp"] != "2023-11-14T22:13:20Z" || document["measurement"] != "orders" || document["fields"].(map[string]interface{})["latency_ms"] != float64(12) {
+		t.Errorf("document = %v", document)
+	}
+}
+
+func TestElasticsearchReportsRejectedDocuments(t *testing.T) {
+	server, templates, _ := fakeElasticsearch(t, true)
+	startElasticsearch(Config{Elasticsearch: ElasticsearchConfig{URL: server.URL, APIKey: "es-key", Index: "metrics-test", SkipTemplate: true, FlushInterval: Duration(time.Hour)}})
+	sendToElasticsearch(Metrics{Measurement: "orders", Fields: map[string]interface{}{"latency_ms": 12}})
+	err := stopElasticsearch(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "mapper_parsing_exception") {
+		t.Errorf("stopElasticsearch() = %v, want the rejection reported", err)
+	}
+	if len(templates) != 0 {
+		t.Error("put the index template despite SkipTemplate")
+	}
+}
+
+func TestValidateElasticsearch(t *testing.T) {
+	cfg := Config{ServiceName: "orders", Elasticsearch: ElasticsearchConfig{URL: "tcp://es:9200", Username: "elastic", APIKey: "es-key", Index: "Metrics"}}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 3 {
+		t.Errorf("Validate() = %v, want the URL, credentials and index rejected", err)
+	}
+	cfg.Elasticsearch = ElasticsearchConfig{Index: "metrics"}
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 1 || validationErr.Errors[0].Field != "elasticsearch.url" {
+		t.Errorf("Validate() = %v, want the URL required", err)
+	}
+	cfg.Elasticsearch.URL = "https://es:9200"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package instrumentation
+
+import (
+	"net/http"
+)
+
+// maxOperationLength bounds the operation names accepted as endpoint tags.
+const maxOperationLength = 64
+
+// OperationRequest is the view of a request that SOAP and JSON-RPC extraction
+// needs. It lets adapters for servers that aren't built on net/http (fasthttp,
+// Fiber) use OperationPath.
+type OperationRequest interface {
+	// IsPost reports whether the request method is POST.
+	IsPost() bool
+	// Header returns the value of a request header.
+	Header(name string) string
+	// PeekBody returns up to limit bytes of the body without consuming them,
+	// and false when there is no body or it could not be read.
+	PeekBody(limit int) ([]byte, bool)
+}
+
+// OperationPath replaces a shared POST path with the SOAP operation or JSON-RPC
+// method (e.g. "/rpc#eth_getBalance") when extraction is enabled. It must run
+// before the handler; headers and body are only touched once extraction
+// applies to the request.
+func OperationPath(path string, req OperationRequest) string {
+	s := loadSettings()
+	if (!s.extractSOAPAction && !s.extractJSONRPCMethod) || !req.IsPost() {
+		return path
+	}
+	contentType := req.Header("Content-Type")
+
+	switch {
+	case s.extractSOAPAction && isXMLContentType(contentType):
+		if operation := soapActionOperation(req.Header("SOAPAction"), contentType); operation != "" {
+			return soapEndpoint(path, operation)
+		}
+		if peeked, ok := req.PeekBody(bodyPeekLimit()); ok {
+			return soapEndpoint(path, xmlOperation(peeked))
+		}
+	case s.extractJSONRPCMethod && isJSONContentType(contentType):
+		if peeked, ok := req.PeekBody(bodyPeekLimit()); ok {
+			return jsonRPCEndpoint(path, jsonRPCMethod(peeked))
+		}
+	}
+	return path
+}
+
+// LogicalEndpoint is OperationPath for a net/http request. Any body bytes read
+// while inspecting the request are put back before the handler.
+func LogicalEndpoint(r *http.Request, path string) string {
+	return OperationPath(path, netHTTPRequest{r})
+}
+
+// netHTTPRequest adapts an *http.Request to OperationRequest.
+type netHTTPRequest struct {
+	r *http.Request
+}
+
+func (req netHTTPRequest) IsPost() bool {
+	return req.r.Method == http.MethodPost
+}
+
+func (req netHTTPRequest) Header(name string) string {
+	return req.r.Header.Get(name)
+}
+
+func (req netHTTPRequest) PeekBody(limit int) ([]byte, bool) {
+	return peekRequestBody(req.r, limit)
+}
+
+// operationEndpoint appends the operation to the path when it is acceptable as
+// a tag: well-formed and, if an allowlist is configured, listed in it.
+func operationEndpoint(path, operation string, allowed map[string]struct{}) string {
+	if !validOperation(operation) {
+		return path
+	}
+	if allowed != nil {
+		if _, ok := allowed[operation]; !ok {
+			return path
+		}
+	}
+	return path + "#" + operation
+}
+
+// validOperation accepts identifier-like names only (letters, digits, '_', '.',
+// '-'), so clients can't smuggle arbitrary strings into the endpoint tag.
+func validOperation(operation string) bool {
+	if operation == "" || len(operation) > maxOperationLength {
+		return false
+	}
+	for i, c := range operation {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case i > 0 && (c >= '0' && c <= '9' || c == '.' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
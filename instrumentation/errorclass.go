@@ -0,0 +1,103 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Error classes of the error_class tag, set on failed requests only.
+const (
+	ErrorClassClient   = "client_error"
+	ErrorClassServer   = "server_error"
+	ErrorClassTimeout  = "timeout"
+	ErrorClassCanceled = "canceled"
+)
+
+// errorClasses are the classes with a <class>_count field on every point.
+var errorClasses = []string{ErrorClassClient, ErrorClassServer, ErrorClassTimeout, ErrorClassCanceled}
+
+// errorClassCounts holds an *atomic.Int64 per errorClassKey.
+var errorClassCounts sync.Map
+
+type errorClassKey struct {
+	endpoint string
+	class    string
+}
+
+func incrementEndpointErrorClassCount(endpoint, class string) {
+	incrementCounter(&errorClassCounts, errorClassKey{endpoint, class})
+}
+
+// getEndpointErrorClassCount retrieves the count of errors of a class for an
+// endpoint.
+func getEndpointErrorClassCount(endpoint, class string) int64 {
+	return loadCounter(&errorClassCounts, errorClassKey{endpoint, class})
+}
+
+// classifyError returns the error_class of a failed request: timeout and
+// canceled when the request's context (ctxErr) or err says so, or for 408 and
+// 504 statuses, client_error for other 4xx and server_error for the rest,
+// including requests failing with a successful status.
+func classifyError(statusCode int, ctxErr, err error) string {
+	switch {
+	case errors.Is(ctxErr, context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		return ErrorClassTimeout
+	case errors.Is(ctxErr, context.Canceled) || errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout:
+		return ErrorClassTimeout
+	case statusCode >= 400 && statusCode < 500:
+		return ErrorClassClient
+	default:
+		return ErrorClassServer
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// clientCanceled reports whether the client of r went away before it was
+// answered, telling impatient clients apart from slow handlers.
+func clientCanceled(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// grpcErrorClasses maps the gRPC status codes that aren't server errors to
+// their class.
+var grpcErrorClasses = map[string]string{
+	"1":  ErrorClassCanceled, // CANCELLED
+	"3":  ErrorClassClient,   // INVALID_ARGUMENT
+	"4":  ErrorClassTimeout,  // DEADLINE_EXCEEDED
+	"5":  ErrorClassClient,   // NOT_FOUND
+	"6":  ErrorClassClient,   // ALREADY_EXISTS
+	"7":  ErrorClassClient,   // PERMISSION_DENIED
+	"9":  ErrorClassClient,   // FAILED_PRECONDITION
+	"11": ErrorClassClient,   // OUT_OF_RANGE
+	"16": ErrorClassClient,   // UNAUTHENTICATED
+}
+
+// classifyGRPCStatus returns the error_class of a failed gRPC call.
+func classifyGRPCStatus(grpcStatus string) string {
+	if class, ok := grpcErrorClasses[grpcStatus]; ok {
+		return class
+	}
+	return ErrorClassServer
+}
+
+// countErrorClass counts a failed request of endpoint under class, tags it
+// and adds the per-class counts to its fields. Points of successful requests
+// (class "") carry the counts too.
+func countErrorClass(tags map[string]string, fields map[string]interface{}, endpoint, class string) {
+	if class != "" {
+		incrementEndpointErrorClassCount(endpoint, class)
+		tags["error_class"] = class
+	}
+	for _, c := range errorClasses {
+		fields[c+"_count"] = getEndpointErrorClassCount(endpoint, c)
+	}
+}
@@ -0,0 +1,109 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		ctxErr     error
+		err        error
+		want       string
+	}{
+		{http.StatusNotFound, nil, nil, ErrorClassClient},
+		{http.StatusServiceUnavailable, nil, nil, ErrorClassServer},
+		{http.StatusOK, nil, errors.New("handler failed"), ErrorClassServer},
+		{http.StatusGatewayTimeout, nil, nil, ErrorClassTimeout},
+		{http.StatusRequestTimeout, nil, nil, ErrorClassTimeout},
+		{http.StatusInternalServerError, context.DeadlineExceeded, nil, ErrorClassTimeout},
+		{http.StatusInternalServerError, nil, fmt.Errorf("query: %w", context.DeadlineExceeded), ErrorClassTimeout},
+		{http.StatusInternalServerError, context.Canceled, nil, ErrorClassCanceled},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.statusCode, tt.ctxErr, tt.err); got != tt.want {
+			t.Errorf("classifyError(%d, %v, %v) = %q, want %q", tt.statusCode, tt.ctxErr, tt.err, got, tt.want)
+		}
+	}
+	if classifyGRPCStatus("5") != ErrorClassClient || classifyGRPCStatus("4") != ErrorClassTimeout || classifyGRPCStatus("14") != ErrorClassServer {
+		t.Error("gRPC statuses misclassified")
+	}
+}
+
+func TestMiddlewareTagsErrorClass(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("status") {
+		case "404":
+			w.WriteHeader(http.StatusNotFound)
+		case "500":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/errorclass/ok", nil))
+	metrics := nextMetrics(t)
+	if _, ok := metrics.Tags["error_class"]; ok || metrics.Fields["client_error_count"] != float64(0) || metrics.Fields["client_canceled"] != false {
+		t.Errorf("successful request: tags %v, fields %v", metrics.Tags, metrics.Fields)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/errorclass/ok?status=404", nil))
+	metrics = nextMetrics(t)
+	if metrics.Tags["error_class"] != ErrorClassClient || metrics.Fields["client_error_count"] != float64(1) || metrics.Fields["server_error_count"] != float64(0) {
+		t.Errorf("404: tags %v, fields %v", metrics.Tags, metrics.Fields)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/errorclass/ok?status=500", nil).WithContext(ctx))
+	metrics = nextMetrics(t)
+	if metrics.Tags["error_class"] != ErrorClassCanceled || metrics.Fields["canceled_count"] != float64(1) || metrics.Fields["client_canceled"] != true {
+		t.Errorf("canceled: tags %v, fields %v", metrics.Tags, metrics.Fields)
+	}
+}
+
+func TestWrapTransportTagsTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: WrapTransport(nil)}
+	if _, err := client.Do(req); err == nil {
+		t.Fatal("request didn't time out")
+	}
+	metrics := nextMetrics(t)
+	if metrics.Tags["error_class"] != ErrorClassTimeout || metrics.Fields["timeout_count"] != float64(1) {
+		t.Errorf("tags %v, fields %v", metrics.Tags, metrics.Fields)
+	}
+}
+
+func TestCountErrorClassesConcurrently(t *testing.T) {
+	before := getEndpointErrorClassCount("/errors/concurrent", ErrorClassServer)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				incrementEndpointErrorClassCount("/errors/concurrent", ErrorClassServer)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := getEndpointErrorClassCount("/errors/concurrent", ErrorClassServer) - before; got != 1000 {
+		t.Errorf("counted %d errors, want 1000", got)
+	}
+}
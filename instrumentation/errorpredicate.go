@@ -0,0 +1,66 @@
+package instrumentation
+
+import "slices"
+
+// Protocols of an Outcome.
+const (
+	ProtocolHTTP    = "http"
+	ProtocolGRPCWeb = "grpc-web"
+	ProtocolTwirp   = "twirp"
+)
+
+// Outcome is how a request ended, as passed to an ErrorPredicate.
+type Outcome struct {
+	// Endpoint is the endpoint tag the request is counted under.
+	Endpoint string
+	// Protocol is ProtocolHTTP, or ProtocolGRPCWeb or ProtocolTwirp for the
+	// RPC middleware.
+	Protocol   string
+	StatusCode int
+	// GRPCStatus is the grpc-status of gRPC-web calls, e.g. "5" for
+	// NOT_FOUND; "" otherwise.
+	GRPCStatus string
+	// Err is the error the handler returned, for frameworks whose handlers
+	// return one.
+	Err error
+	// Failed is the default decision: a 4xx or 5xx status, a non-zero gRPC
+	// status, or whatever the framework adapter decided.
+	Failed bool
+}
+
+// ErrorPredicate decides whether a request counts as an error, in
+// error_count, error_class, the error rate and the SLO compliance of reports.
+// Requests that panicked or were aborted with RequestRecord.Abort fail
+// whatever it returns.
+type ErrorPredicate func(o Outcome) bool
+
+// ErrorUnlessStatus is an ErrorPredicate keeping the default decision except
+// for the given status codes, which don't count as errors, e.g. 404 for a
+// lookup API.
+func ErrorUnlessStatus(statusCodes ...int) ErrorPredicate {
+	return func(o Outcome) bool {
+		return o.Failed && !slices.Contains(statusCodes, o.StatusCode)
+	}
+}
+
+// ErrorUnlessGRPCStatus is ErrorUnlessStatus for gRPC status codes, e.g.
+// ErrorUnlessGRPCStatus("5") for calls answering NOT_FOUND.
+func ErrorUnlessGRPCStatus(codes ...string) ErrorPredicate {
+	return func(o Outcome) bool {
+		return o.Failed && (o.GRPCStatus == "" || !slices.Contains(codes, o.GRPCStatus))
+	}
+}
+
+// failedOutcome applies the ErrorPredicate of o's endpoint, or the service's,
+// to o.
+func failedOutcome(o Outcome) bool {
+	s := loadSettings()
+	predicate, ok := s.endpointErrorPredicates[o.Endpoint]
+	if !ok {
+		predicate = s.errorPredicate
+	}
+	if predicate == nil {
+		return o.Failed
+	}
+	return predicate(o)
+}
@@ -0,0 +1,77 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorPredicate(t *testing.T) {
+	applyOptions([]Option{
+		WithErrorPredicate(ErrorUnlessStatus(http.StatusNotFound)),
+		WithEndpointErrorPredicate("/predicate/strict", func(o Outcome) bool { return o.StatusCode >= 300 }),
+	})
+	defer applyOptions(nil)
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("status") {
+		case "302":
+			w.WriteHeader(http.StatusFound)
+		case "404":
+			w.WriteHeader(http.StatusNotFound)
+		case "500":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/predicate/lookup?status=404", nil))
+	metrics := nextMetrics(t)
+	if _, ok := metrics.Tags["error_class"]; ok || metrics.Fields["error_count"] != float64(0) {
+		t.Errorf("404 with ErrorUnlessStatus(404): tags %v, fields %v", metrics.Tags, metrics.Fields)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/predicate/lookup?status=500", nil))
+	if metrics := nextMetrics(t); metrics.Tags["error_class"] != ErrorClassServer || metrics.Fields["error_count"] != float64(1) {
+		t.Errorf("500 with ErrorUnlessStatus(404): tags %v, fields %v", metrics.Tags, metrics.Fields)
+	}
+
+	// The endpoint's own predicate replaces the service's
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/predicate/strict?status=302", nil))
+	if metrics := nextMetrics(t); metrics.Fields["error_count"] != float64(1) {
+		t.Errorf("302 on the strict endpoint: fields %v, want an error", metrics.Fields)
+	}
+}
+
+func TestErrorPredicateDoesNotOverridePanics(t *testing.T) {
+	applyOptions([]Option{WithErrorPredicate(func(Outcome) bool { return false }), WithPanicRecovery()})
+	defer applyOptions(nil)
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/predicate/panic", nil))
+	if metrics := nextMetrics(t); metrics.Fields["error_count"] != float64(1) {
+		t.Errorf("panic: fields %v, want an error", metrics.Fields)
+	}
+}
+
+func TestGRPCErrorPredicate(t *testing.T) {
+	const endpoint = "/acme.Predicates/Lookup"
+	var outcome Outcome
+	applyOptions([]Option{WithEndpointErrorPredicate(endpoint, func(o Outcome) bool {
+		outcome = o
+		return ErrorUnlessGRPCStatus("5")(o)
+	})})
+	defer applyOptions(nil)
+	handler := GRPCWebMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc-web+proto")
+		w.Write(append(grpcWebFrame(0x00, "message"), grpcWebFrame(0x80, "grpc-status: 5\r\n")...))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, endpoint, strings.NewReader("request")))
+	metrics := nextMetrics(t)
+	if _, ok := metrics.Tags["error_class"]; ok || metrics.Fields["error_count"] != float64(0) {
+		t.Errorf("NOT_FOUND with ErrorUnlessGRPCStatus(5): tags %v, fields %v", metrics.Tags, metrics.Fields)
+	}
+	if outcome.Protocol != ProtocolGRPCWeb || outcome.GRPCStatus != "5" || !outcome.Failed {
+		t.Errorf("outcome = %+v", outcome)
+	}
+}
@@ -0,0 +1,243 @@
+package instrumentation
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPendingErrorReports caps the reports SentryReporter sends concurrently;
+// further ones are dropped (and logged) until some complete, so an outage of
+// the error tracker can't pile up goroutines.
+const maxPendingErrorReports = 16
+
+// errorReportTimeout bounds each request to the error tracker.
+const errorReportTimeout = 10 * time.Second
+
+// ErrorReport describes a request that failed with a 5xx status or a panic.
+type ErrorReport struct {
+	Time       time.Time
+	Service    string
+	Endpoint   string
+	StatusCode int
+	// Message is the panic value, or a summary of the failed request.
+	Message string
+	// Stack is the stack trace of a panic.
+	Stack string
+	// RequestID and TraceID correlate the report with logs and traces;
+	// TraceID comes from a W3C traceparent header.
+	RequestID string
+	TraceID   string
+	// Method and URL are only known for net/http based frameworks.
+	Method string
+	URL    string
+}
+
+// ErrorReporter forwards failed requests to an error tracker such as Sentry
+// or Bugsnag. ReportError is called on the request path, so it must not
+// block; it returns the ID the tracker will know the report by, which is
+// added to the request's point as the error_report_id field.
+type ErrorReporter interface {
+	ReportError(report ErrorReport) string
+}
+
+// errorReportFlusher is implemented by ErrorReporters that send in the
+// background, so Shutdown can wait for them.
+type errorReportFlusher interface {
+	Flush(ctx context.Context) error
+}
+
+// reportError forwards a failed request to the configured ErrorReporter, if
+// any. It must be called from the deferred function that recovered a panic
+// so the stack trace is still there.
+func reportError(fields map[string]interface{}, report ErrorReport, panicValue interface{}, r *http.Request, rec *RequestRecord) {
+	reporter := loadSettings().errorReporter
+	if reporter == nil || (report.StatusCode < 500 && panicValue == nil) {
+		return
+	}
+	report.Time = time.Now()
+	report.Service = measurement
+	if panicValue != nil {
+		report.Message = fmt.Sprint(panicValue)
+		report.Stack = panicStack(panicValue)
+	}
+	if r != nil {
+		report.Method = r.Method
+		report.URL = r.URL.String()
+		report.TraceID = traceID(r.Header.Get("Traceparent"))
+	}
+	if report.Message == "" {
+		report.Message = fmt.Sprintf("%s %s returned %d", report.Method, report.Endpoint, report.StatusCode)
+	}
+	if rec != nil {
+		report.RequestID = rec.RequestID()
+	}
+	// A field rather than a tag, as every report has its own ID
+	if id := reporter.ReportError(report); id != "" {
+		fields["error_report_id"] = id
+	}
+}
+
+// traceID returns the trace ID of a W3C traceparent header
+// ("00-<trace-id>-<parent-id>-<flags>"), or "" if it is malformed.
+func traceID(traceparent string) string {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return ""
+	}
+	return parts[1]
+}
+
+// SentryReporter sends error reports to Sentry, or any server accepting
+// Sentry envelopes (GlitchTip, self-hosted Sentry), in the background.
+type SentryReporter struct {
+	// Environment and Release are attached to every event when set.
+	Environment string
+	Release     string
+	// Client defaults to a client with a 10s timeout.
+	Client *http.Client
+
+	envelopeURL string
+	auth        string
+	pending     chan struct{}
+	inFlight    sync.WaitGroup
+}
+
+// NewSentryReporter parses a DSN of the form
+// "https://<public key>@<host>/<project id>".
+func NewSentryReporter(dsn string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentry DSN: %w", err)
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	projectID := u.Path[slash+1:]
+	if (u.Scheme != "http" && u.Scheme != "https") || u.User == nil || u.User.Username() == "" || projectID == "" {
+		return nil, fmt.Errorf("invalid sentry DSN: want https://<public key>@<host>/<project id>")
+	}
+	return &SentryReporter{
+		envelopeURL: fmt.Sprintf("%s://%s%sapi/%s/envelope/", u.Scheme, u.Host, u.Path[:slash+1], projectID),
+		auth:        "Sentry sentry_version=7, sentry_client=observability-module/1.0, sentry_key=" + u.User.Username(),
+		pending:     make(chan struct{}, maxPendingErrorReports),
+	}, nil
+}
+
+// ReportError assigns the event ID and sends the event in the background.
+func (s *SentryReporter) ReportError(report ErrorReport) string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		log.Printf("Error generating sentry event ID: %v\n", err)
+		return ""
+	}
+	eventID := hex.EncodeToString(id[:])
+
+	select {
+	case s.pending <- struct{}{}:
+	default:
+		log.Printf("Dropping sentry event %s: too many reports in flight\n", eventID)
+		return ""
+	}
+	s.inFlight.Add(1)
+	go func() {
+		defer s.inFlight.Done()
+		defer func() { <-s.pending }()
+		if err := s.send(eventID, report); err != nil {
+			log.Printf("Error sending sentry event %s: %v\n", eventID, err)
+		}
+	}()
+	return eventID
+}
+
+// Flush waits for the events being sent, or until ctx is done.
+func (s *SentryReporter) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SentryReporter) send(eventID string, report ErrorReport) error {
+	tags := map[string]string{
+		"route":       report.Endpoint,
+		"status_code": fmt.Sprint(report.StatusCode),
+	}
+	if report.RequestID != "" {
+		tags["request_id"] = report.RequestID
+	}
+	event := map[string]interface{}{
+		"event_id":    eventID,
+		"timestamp":   report.Time.UTC().Format(time.RFC3339Nano),
+		"platform":    "go",
+		"level":       "error",
+		"server_name": report.Service,
+		"transaction": report.Endpoint,
+		"message":     map[string]string{"formatted": report.Message},
+		"tags":        tags,
+	}
+	if s.Environment != "" {
+		event["environment"] = s.Environment
+	}
+	if s.Release != "" {
+		event["release"] = s.Release
+	}
+	if report.TraceID != "" {
+		event["contexts"] = map[string]interface{}{"trace": map[string]string{"trace_id": report.TraceID}}
+	}
+	if report.Method != "" {
+		event["request"] = map[string]string{"method": report.Method, "url": report.URL}
+	}
+	if report.Stack != "" {
+		event["extra"] = map[string]string{"stack": report.Stack}
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, item := range []interface{}{
+		map[string]string{"event_id": eventID, "sent_at": time.Now().UTC().Format(time.RFC3339Nano)},
+		map[string]string{"type": "event"},
+		event,
+	} {
+		if err := enc.Encode(item); err != nil {
+			return fmt.Errorf("error encoding event: %w", err)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.envelopeURL, &body)
+	if err != nil {
+		return fmt.Errorf("error building request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: errorReportTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sentry responded with %s", resp.Status)
+	}
+	return nil
+}
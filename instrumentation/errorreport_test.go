@@ -0,0 +1,117 @@
+package instrumentation
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSentry collects the events posted to it.
+func fakeSentry(t *testing.T) (dsn string, events chan map[string]interface{}) {
+	t.Helper()
+	events = make(chan map[string]interface{}, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/42/envelope/" || !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=public") {
+			t.Errorf("unexpected request %s with auth %q", r.URL.Path, r.Header.Get("X-Sentry-Auth"))
+		}
+		// The envelope header, the item header, then the event
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(nil, 1<<20)
+		var lines []string
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		var event map[string]interface{}
+		if len(lines) != 3 || json.Unmarshal([]byte(lines[2]), &event) != nil {
+			t.Errorf("malformed envelope %q", lines)
+		}
+		events <- event
+	}))
+	t.Cleanup(server.Close)
+	return strings.Replace(server.URL, "http://", "http://public@", 1) + "/42", events
+}
+
+func nextEvent(t *testing.T, events chan map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no sentry event received")
+		return nil
+	}
+}
+
+func TestPanicIsReportedToSentry(t *testing.T) {
+	dsn, events := fakeSentry(t)
+	defer applyOptions(nil)
+	applyOptions([]Option{WithSentryDSN(dsn), WithPanicRecovery()})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/errors/panic", nil)
+	req.Header.Set(RequestIDHeader, "req-42")
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	metrics := nextMetrics(t)
+	event := nextEvent(t, events)
+	if metrics.Fields["error_report_id"] == nil || metrics.Fields["error_report_id"] != event["event_id"] {
+		t.Errorf("error_report_id = %v, event_id = %v, want the same ID", metrics.Fields["error_report_id"], event["event_id"])
+	}
+	tags, _ := event["tags"].(map[string]interface{})
+	if tags["route"] != "/errors/panic" || tags["request_id"] != "req-42" {
+		t.Errorf("event tags = %v", tags)
+	}
+	trace, _ := event["contexts"].(map[string]interface{})["trace"].(map[string]interface{})
+	if trace["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace context = %v", trace)
+	}
+	if message, _ := event["message"].(map[string]interface{}); message["formatted"] != "boom" {
+		t.Errorf("message = %v, want boom", event["message"])
+	}
+}
+
+func TestOnlyServerErrorsAreReported(t *testing.T) {
+	dsn, events := fakeSentry(t)
+	defer applyOptions(nil)
+	applyOptions([]Option{WithSentryDSN(dsn)})
+
+	status := http.StatusNotFound
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/errors/status", nil))
+	if id, ok := nextMetrics(t).Fields["error_report_id"]; ok {
+		t.Errorf("error_report_id = %v for a 404", id)
+	}
+
+	status = http.StatusServiceUnavailable
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/errors/status", nil))
+	if _, ok := nextMetrics(t).Fields["error_report_id"]; !ok {
+		t.Error("no error_report_id for a 503")
+	}
+	if message, _ := nextEvent(t, events)["message"].(map[string]interface{}); message["formatted"] != "GET /errors/status returned 503" {
+		t.Errorf("message = %v", message)
+	}
+}
+
+func TestNewSentryReporterRejectsBadDSN(t *testing.T) {
+	for _, dsn := range []string{"", "https://sentry.example.com/42", "https://key@sentry.example.com/", "ftp://key@sentry.example.com/42"} {
+		if _, err := NewSentryReporter(dsn); err == nil {
+			t.Errorf("NewSentryReporter(%q) succeeded", dsn)
+		}
+	}
+	reporter, err := NewSentryReporter("https://key@sentry.example.com/prefix/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reporter.envelopeURL != "https://sentry.example.com/prefix/api/42/envelope/" {
+		t.Errorf("envelope URL = %q", reporter.envelopeURL)
+	}
+}
@@ -0,0 +1,30 @@
+package instrumentation
+
+import (
+	"errors"
+	"log"
+)
+
+// sendEvent reports something that happened to the instrumentation itself
+// (a config reload, a credential rotation, ...) as a point tagged with the
+// event name, at the send queue priority of the event. Failures are logged,
+// as events are best effort.
+func sendEvent(event string, tags map[string]string, fields map[string]interface{}) {
+	eventTags := map[string]string{"event": event}
+	for key, value := range tags {
+		eventTags[key] = value
+	}
+
+	metrics := Metrics{
+		InfluxDBURL: influxDBURL,
+		Token:       currentToken(),
+		Org:         org,
+		Bucket:      bucket,
+		Measurement: measurement,
+		Tags:        eventTags,
+		Fields:      fields,
+	}
+	if err := enqueuePoint(event, metrics); err != nil && !errors.Is(err, ErrCircuitOpen) {
+		log.Printf("Error sending %s event: %v\n", event, err)
+	}
+}
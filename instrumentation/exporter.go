@@ -0,0 +1,279 @@
+package instrumentation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jculley01/observability-module/protocol"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// defaultExporterQueueSize is how many points an exporter can lag behind when
+// ExporterQueueSize is zero.
+const defaultExporterQueueSize = 1000
+
+// Exporter receives every point sent, next to the registry, e.g. to write it
+// to another backend. Each exporter is called on a goroutine of its own, one
+// point at a time, so it can block on I/O: a slow or failing exporter only
+// delays its own points, and drops them once ExporterQueueSize are waiting.
+// Failed exports are retried as Config.ExporterRetry says, or the exporter's
+// own policy when it is a RetryPolicyExporter. Shutdown calls Shutdown once
+// the points queued for it are exported.
+type Exporter interface {
+	Export(point Metrics) error
+	Shutdown(ctx context.Context) error
+}
+
+// Send sends a custom point, with the InfluxDB settings and measurement of the
+// active config where left empty, to the registry and the exporters.
+func Send(point Metrics) error {
+	if point.InfluxDBURL == "" {
+		point.InfluxDBURL = influxDBURL
+		point.Token = currentToken()
+	}
+	if point.Org == "" {
+		point.Org = org
+	}
+	if point.Bucket == "" {
+		point.Bucket = bucket
+	}
+	if point.Measurement == "" {
+		point.Measurement = measurement
+	}
+	return sendMetrics(point)
+}
+
+// exportWorker passes the points queued for an exporter to it.
+type exportWorker struct {
+	exporter Exporter
+	queue    chan Metrics
+	done     chan struct{}
+	// breaker is nil unless Config.CircuitBreaker is set
+	breaker *circuitBreaker
+	retry   RetryPolicy
+
+	mu      sync.Mutex
+	dropped int64
+}
+
+var (
+	exportersMu sync.Mutex
+	// exporters are the Exporters of the applied config
+	exporters       []Exporter
+	exportersConfig exporterSettings
+	exportWorkers   []*exportWorker
+)
+
+// exporterSettings are the settings of the applied config its exporters are
+// started with.
+type exporterSettings struct {
+	queueSize int
+	breaker   CircuitBreakerConfig
+	retry     RetryPolicy
+}
+
+// startExporters replaces the workers of any previously applied config,
+// keeping them when its exporters are unchanged. Replaced workers export the
+// points queued for them in the background.
+func startExporters(cfg Config) {
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	settings := exporterSettings{queueSize: cfg.ExporterQueueSize, breaker: cfg.CircuitBreaker, retry: cfg.ExporterRetry}
+	if exportWorkers != nil && reflect.DeepEqual(exportersConfig, settings) && sameExporters(exporters, cfg.Exporters) {
+		return
+	}
+	for _, w := range exportWorkers {
+		close(w.queue)
+	}
+	exporters, exportersConfig, exportWorkers = nil, exporterSettings{}, nil
+	if len(cfg.Exporters) == 0 {
+		return
+	}
+	size := cfg.ExporterQueueSize
+	if size == 0 {
+		size = defaultExporterQueueSize
+	}
+	exporters, exportersConfig = cfg.Exporters, settings
+	for i, exporter := range cfg.Exporters {
+		w := &exportWorker{
+			exporter: exporter,
+			queue:    make(chan Metrics, size),
+			done:     make(chan struct{}),
+			breaker:  newCircuitBreaker(exporterBackend(i, exporter), cfg.CircuitBreaker),
+			retry:    cfg.ExporterRetry,
+		}
+		if declared, ok := exporter.(RetryPolicyExporter); ok {
+			w.retry = declared.RetryPolicy()
+		}
+		exportWorkers = append(exportWorkers, w)
+		go w.run()
+	}
+}
+
+// sameExporters reports whether a and b hold the same exporters, compared by
+// identity rather than by content.
+func sameExporters(a, b []Exporter) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == nil || b[i] == nil {
+			if a[i] != b[i] {
+				return false
+			}
+			continue
+		}
+		if reflect.TypeOf(a[i]) != reflect.TypeOf(b[i]) || !reflect.TypeOf(a[i]).Comparable() || a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// stopExporters exports the queued points, then shuts the exporters down.
+func stopExporters(ctx context.Context) error {
+	exportersMu.Lock()
+	workers := exportWorkers
+	exporters, exportersConfig, exportWorkers = nil, exporterSettings{}, nil
+	exportersMu.Unlock()
+
+	for _, w := range workers {
+		close(w.queue)
+	}
+	var errs []error
+	for _, w := range workers {
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("error exporting the queued points: %w", ctx.Err()))
+		}
+		if err := w.exporter.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("error shutting an exporter down: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// export queues a point for each configured exporter, dropping it for the
+// exporters that are too far behind.
+func export(point Metrics) {
+	exportersMu.Lock()
+	workers := exportWorkers
+	exportersMu.Unlock()
+	for _, w := range workers {
+		select {
+		case w.queue <- point:
+		default:
+			w.mu.Lock()
+			w.dropped++
+			w.mu.Unlock()
+			currentPipeline().recordDropped(1)
+		}
+	}
+}
+
+func (w *exportWorker) run() {
+	defer close(w.done)
+	for point := range w.queue {
+		w.mu.Lock()
+		dropped := w.dropped
+		w.dropped = 0
+		w.mu.Unlock()
+		if dropped > 0 {
+			log.Printf("Dropped %d points while exporter %T was slow\n", dropped, w.exporter)
+		}
+		w.export(point)
+	}
+}
+
+// export passes a point to the exporter, unless its circuit breaker is open,
+// retrying as its policy says and recovering its panics so they don't take
+// the other backends down. Points refused by the breaker are dropped, and the
+// breaker records the outcome of the last attempt.
+func (w *exportWorker) export(point Metrics) {
+	if !w.breaker.allow() {
+		return
+	}
+	p := currentPipeline()
+	var start time.Time
+	if p != nil {
+		start = time.Now()
+	}
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Exporter %T panicked: %v\n", w.exporter, r)
+			err = fmt.Errorf("exporter panicked: %v", r)
+		}
+		w.breaker.record(err)
+		if p != nil {
+			p.recordExport(time.Since(start))
+		}
+	}()
+	if err = retry(context.Background(), w.retry, func() error { return w.exporter.Export(point) }); err != nil {
+		log.Printf("Error exporting metrics: %v\n", err)
+	}
+}
+
+// writerExporter writes points to an io.Writer as JSON lines.
+type writerExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterExporter returns an Exporter writing every point to w as a line of
+// JSON, without its InfluxDB token, e.g. to os.Stdout for a log collector.
+func NewWriterExporter(w io.Writer) Exporter {
+	return &writerExporter{w: w}
+}
+
+func (e *writerExporter) Export(point Metrics) error {
+	point.Token = ""
+	line, err := json.Marshal(point)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
+
+func (e *writerExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// lineProtocolExporter writes points to an io.Writer as InfluxDB line
+// protocol.
+type lineProtocolExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLineProtocolExporter returns an Exporter writing every point to w as a
+// line of InfluxDB line protocol, without its destination, e.g. to the stdin
+// of Telegraf's execd input or a file its tail input reads.
+func NewLineProtocolExporter(w io.Writer) Exporter {
+	return &lineProtocolExporter{w: w}
+}
+
+func (e *lineProtocolExporter) Export(point Metrics) error {
+	point.InfluxDBURL, point.Token, point.Org, point.Bucket = "", "", "", ""
+	line, err := protocol.AppendLine(nil, point)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
+
+func (e *lineProtocolExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,221 @@
+package instrumentation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingExporter keeps the points exported to it.
+type recordingExporter struct {
+	mu       sync.Mutex
+	points   []Metrics
+	shutDown bool
+}
+
+func (e *recordingExporter) Export(point Metrics) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.points = append(e.points, point)
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.shutDown = true
+	return nil
+}
+
+// waitForPoints waits for n points to be exported, as exporters run on
+// goroutines of their own.
+func (e *recordingExporter) waitForPoints(t *testing.T, n int) []Metrics {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		e.mu.Lock()
+		points := append([]Metrics(nil), e.points...)
+		e.mu.Unlock()
+		if len(points) >= n {
+			return points
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d exported points, want %d", len(points), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blockingExporter blocks every export until release is closed.
+type blockingExporter struct {
+	release chan struct{}
+}
+
+func (e blockingExporter) Export(point Metrics) error {
+	<-e.release
+	return nil
+}
+
+func (e blockingExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// panickingExporter fails in the worst way.
+type panickingExporter struct{}
+
+func (panickingExporter) Export(point Metrics) error {
+	panic("exporter bug")
+}
+
+func (panickingExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func TestSendExportsCustomPoints(t *testing.T) {
+	exporter := &recordingExporter{}
+	if err := Configure(collectorURL, "test-service", "http://influxdb:8086", "", "", "", WithExporter(exporter), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := Send(Metrics{Tags: map[string]string{"job": "nightly"}, Fields: map[string]interface{}{"rows": 12}}); err != nil {
+		t.Fatal(err)
+	}
+	point := nextMetrics(t)
+	if point.Measurement != "test-service" || point.Tags["job"] != "nightly" {
+		t.Errorf("sent point = %+v", point)
+	}
+
+	if points := exporter.waitForPoints(t, 1); points[0].Tags[instanceIDTag] != instanceID {
+		t.Errorf("exported points = %+v", points)
+	}
+}
+
+func TestShutdownShutsExportersDown(t *testing.T) {
+	exporter := &recordingExporter{}
+	if err := ApplyConfig(Config{ServiceName: "test-service", Exporters: []Exporter{exporter}, DisableSendQueue: true}); err != nil {
+		t.Fatalf("ApplyConfig without a registry = %v", err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !exporter.shutDown {
+		t.Error("exporter wasn't shut down")
+	}
+}
+
+func TestExportersAreIsolated(t *testing.T) {
+	blocked := blockingExporter{release: make(chan struct{})}
+	defer close(blocked.release)
+	healthy := &recordingExporter{}
+	cfg := Config{
+		RegistryURL:       collectorURL,
+		ServiceName:       "test-service",
+		Exporters:         []Exporter{blocked, panickingExporter{}, healthy},
+		ExporterQueueSize: 2,
+		DisableSendQueue:  true,
+	}
+	if err := ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// The blocked exporter holds one point and queues two, then drops the
+	// rest, while the registry and the healthy exporter get every point
+	for i := 0; i < 5; i++ {
+		if err := Send(Metrics{Fields: map[string]interface{}{"i": i}}); err != nil {
+			t.Fatal(err)
+		}
+		if point := nextMetrics(t); point.Fields["i"] != float64(i) {
+			t.Fatalf("point %d sent to the registry = %v", i, point.Fields)
+		}
+	}
+	healthy.waitForPoints(t, 5)
+}
+
+func TestShutdownExportsQueuedPoints(t *testing.T) {
+	exporter := &recordingExporter{}
+	if err := ApplyConfig(Config{ServiceName: "test-service", Exporters: []Exporter{exporter}, DisableSendQueue: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := Send(Metrics{Fields: map[string]interface{}{"i": i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	sent := 0
+	for _, point := range exporter.points {
+		if _, ok := point.Fields["i"]; ok {
+			sent++
+		}
+	}
+	if sent != 100 || !exporter.shutDown {
+		t.Errorf("got %d points and shutDown = %v before Shutdown returned, want 100 and true", sent, exporter.shutDown)
+	}
+}
+
+func TestWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exporter := NewWriterExporter(&buf)
+	point := Metrics{Token: "secret", Measurement: "checkout", Tags: map[string]string{"endpoint": "/pay"}, Fields: map[string]interface{}{"latency_ms": 12}}
+	if err := exporter.Export(point); err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.Export(point); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrote %q, want two lines", buf.String())
+	}
+	var got Metrics
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Token != "" || got.Measurement != "checkout" || got.Tags["endpoint"] != "/pay" || got.Fields["latency_ms"] != float64(12) {
+		t.Errorf("wrote %+v", got)
+	}
+}
+
+func TestLineProtocolExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exporter := NewLineProtocolExporter(&buf)
+	point := Metrics{InfluxDBURL: "http://influxdb:8086", Token: "secret", Measurement: "checkout", Tags: map[string]string{"endpoint": "/pay"}, Fields: map[string]interface{}{"latency_ms": 12}, Timestamp: 1700000000, Precision: "s"}
+	if err := exporter.Export(point); err != nil {
+		t.Fatal(err)
+	}
+	if want := "checkout,endpoint=/pay latency_ms=12i 1700000000000000000\n"; buf.String() != want {
+		t.Errorf("wrote %q, want %q", buf.String(), want)
+	}
+	if err := exporter.Export(Metrics{Measurement: "checkout"}); err == nil {
+		t.Error("exported a point without fields")
+	}
+}
@@ -0,0 +1,122 @@
+// Package fasthttp instruments raw fasthttp handlers. It lives in its own
+// module so that services not using fasthttp never pull it into their
+// dependency graph. The Fiber adapter builds on it.
+package fasthttp
+
+import (
+	"bytes"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/valyala/fasthttp"
+	"io"
+	"time"
+)
+
+// Instrument wraps a raw fasthttp handler so services using fasthttp without
+// Fiber report the same metrics. Call instrumentation.Configure first to set
+// where the metrics are sent. fasthttp has no route templates, so the endpoint
+// tag is ctx.Path() after path normalization (e.g. "/users/42" becomes
+// "/users/:id").
+func Instrument(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if instrumentation.IsIgnoredPath(string(ctx.Path())) {
+			handler(ctx)
+			return
+		}
+		done := instrumentation.TrackInFlight()
+		startTime := time.Now()
+		path := instrumentation.OperationPath(string(ctx.Path()), OperationRequest(&ctx.Request))
+		userAgent := string(ctx.UserAgent())
+		// Lets handlers reach the record with instrumentation.FromContext(ctx)
+		rec := instrumentation.NewRequestRecord(string(ctx.Request.Header.Peek(instrumentation.RequestIDHeader)))
+		rec.StartTime = startTime
+		ctx.SetUserValue(instrumentation.RecordContextKey(), rec)
+		defer func() {
+			done()
+			panicValue := recover()
+			recovered := panicValue != nil && instrumentation.RecoverPanics()
+			if recovered {
+				ctx.Error(fasthttp.StatusMessage(fasthttp.StatusInternalServerError), fasthttp.StatusInternalServerError)
+			}
+
+			instrumentation.Report(instrumentation.Observation{
+				Endpoint:           path,
+				UserAgent:          userAgent,
+				IPAddress:          ctx.RemoteIP().String(),
+				RequestSize:        int64(ctx.Request.Header.ContentLength()),
+				StatusCode:         ctx.Response.StatusCode(),
+				ResponseSize:       len(ctx.Response.Body()),
+				Latency:            time.Since(startTime),
+				Failed:             ctx.Response.StatusCode() >= 400,
+				RequestHeaderFunc:  func(name string) string { return string(ctx.Request.Header.Peek(name)) },
+				ResponseHeaderFunc: func(name string) string { return string(ctx.Response.Header.Peek(name)) },
+				Context:            ctx,
+				Record:             rec,
+				Panic:              panicValue,
+			})
+
+			if panicValue != nil && !recovered {
+				panic(panicValue)
+			}
+		}()
+		// Continue processing
+		handler(ctx)
+	}
+}
+
+// OperationRequest adapts a fasthttp request for instrumentation.OperationPath.
+func OperationRequest(req *fasthttp.Request) instrumentation.OperationRequest {
+	return operationRequest{req}
+}
+
+type operationRequest struct {
+	req *fasthttp.Request
+}
+
+func (r operationRequest) IsPost() bool {
+	return r.req.Header.IsPost()
+}
+
+func (r operationRequest) Header(name string) string {
+	return string(r.req.Header.Peek(name))
+}
+
+// PeekBody slices buffered bodies in place; with StreamRequestBody only the
+// head of the stream is read and then replayed.
+func (r operationRequest) PeekBody(limit int) ([]byte, bool) {
+	if !r.req.IsBodyStream() {
+		body := r.req.Body()
+		if len(body) > limit {
+			body = body[:limit]
+		}
+		return body, true
+	}
+
+	stream := r.req.BodyStream()
+	peeked, err := io.ReadAll(io.LimitReader(stream, int64(limit)))
+	r.req.SetBodyStream(io.MultiReader(bytes.NewReader(peeked), stream), r.req.Header.ContentLength())
+	return peeked, err == nil
+}
+
+// WithTagExtractor is instrumentation.WithTagExtractor for Instrument.
+func WithTagExtractor(extract func(ctx *fasthttp.RequestCtx) map[string]string) instrumentation.Option {
+	return func(cfg *instrumentation.Config) {
+		cfg.ContextTagExtractors = append(cfg.ContextTagExtractors, func(ctx interface{}) map[string]string {
+			if c, ok := ctx.(*fasthttp.RequestCtx); ok {
+				return extract(c)
+			}
+			return nil
+		})
+	}
+}
+
+// WithFieldExtractor is instrumentation.WithFieldExtractor for Instrument.
+func WithFieldExtractor(extract func(ctx *fasthttp.RequestCtx) map[string]interface{}) instrumentation.Option {
+	return func(cfg *instrumentation.Config) {
+		cfg.ContextFieldExtractors = append(cfg.ContextFieldExtractors, func(ctx interface{}) map[string]interface{} {
+			if c, ok := ctx.(*fasthttp.RequestCtx); ok {
+				return extract(c)
+			}
+			return nil
+		})
+	}
+}
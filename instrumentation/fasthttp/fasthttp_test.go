@@ -0,0 +1,144 @@
+package fasthttp
+
+import (
+	"bytes"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/instrumentation/instrumentationtest"
+	"github.com/valyala/fasthttp"
+	"io"
+	"os"
+	"testing"
+)
+
+// collector is shared by the tests, as the registry connection is global.
+var collector *instrumentationtest.Collector
+
+func TestMain(m *testing.M) {
+	collector = instrumentationtest.NewCollector()
+	code := m.Run()
+	collector.Close()
+	os.Exit(code)
+}
+
+func configure(t *testing.T, opts ...instrumentation.Option) {
+	t.Helper()
+	if err := instrumentation.Configure(collector.URL, "test-service", "", "", "", "", opts...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstrumentCountsRequestsAndErrors(t *testing.T) {
+	configure(t)
+	const endpoint = "/fasthttp/orders"
+	status := fasthttp.StatusOK
+	handler := Instrument(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(status)
+		ctx.SetBodyString("orders")
+	})
+
+	serve := func() instrumentation.Metrics {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(endpoint)
+		ctx.Request.Header.SetUserAgent("fasthttp-test")
+		handler(&ctx)
+		return collector.Next(t)
+	}
+
+	metrics := serve()
+	if metrics.Tags["endpoint"] != endpoint || metrics.Tags["user_agent"] != "fasthttp-test" {
+		t.Errorf("tags = %v", metrics.Tags)
+	}
+	if metrics.Fields["response_size"] != float64(len("orders")) {
+		t.Errorf("response_size = %v, want %d", metrics.Fields["response_size"], len("orders"))
+	}
+	if metrics.Fields["error_count"] != float64(0) {
+		t.Errorf("error_count after 200 = %v, want 0", metrics.Fields["error_count"])
+	}
+
+	status = fasthttp.StatusInternalServerError
+	metrics = serve()
+	if metrics.Fields["status_code"] != float64(fasthttp.StatusInternalServerError) {
+		t.Errorf("status_code = %v, want 500", metrics.Fields["status_code"])
+	}
+	if metrics.Fields["request_count"] != float64(2) || metrics.Fields["error_count"] != float64(1) {
+		t.Errorf("request_count = %v, error_count = %v, want 2 and 1",
+			metrics.Fields["request_count"], metrics.Fields["error_count"])
+	}
+}
+
+func TestExtractorsAndHeaderCapture(t *testing.T) {
+	configure(t,
+		WithFieldExtractor(func(ctx *fasthttp.RequestCtx) map[string]interface{} {
+			return map[string]interface{}{"items_in_cart": ctx.UserValue("items")}
+		}),
+		instrumentation.WithHeaderCapture(
+			instrumentation.HeaderCapture{Header: "X-API-Version"},
+			instrumentation.HeaderCapture{Header: "Cookie"},
+		),
+	)
+
+	handler := Instrument(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetUserValue("items", 3)
+	})
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/fasthttp/cart")
+	ctx.Request.Header.Set("X-API-Version", "v3")
+	ctx.Request.Header.Set("Cookie", "session=secret")
+	handler(&ctx)
+
+	metrics := collector.Next(t)
+	if metrics.Fields["items_in_cart"] != float64(3) {
+		t.Errorf("items_in_cart = %v, want 3", metrics.Fields["items_in_cart"])
+	}
+	if metrics.Tags["x_api_version"] != "v3" || metrics.Tags["cookie"] != "redacted" {
+		t.Errorf("tags = %v", metrics.Tags)
+	}
+}
+
+func TestPeekBodyStream(t *testing.T) {
+	var req fasthttp.Request
+	req.SetBodyStream(bytes.NewReader([]byte("abcdef")), 6)
+	peeked, ok := OperationRequest(&req).PeekBody(3)
+	if !ok || string(peeked) != "abc" {
+		t.Errorf("peeked = %q, %v; want \"abc\", true", peeked, ok)
+	}
+	if body, _ := io.ReadAll(req.BodyStream()); string(body) != "abcdef" {
+		t.Errorf("remaining stream = %q, want the full body", body)
+	}
+}
+
+func TestInstrumentRecoversPanics(t *testing.T) {
+	configure(t, instrumentation.WithPanicRecovery())
+	handler := Instrument(func(ctx *fasthttp.RequestCtx) {
+		panic("boom")
+	})
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/fasthttp/panic")
+	handler(&ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusInternalServerError {
+		t.Errorf("response status = %d, want 500", ctx.Response.StatusCode())
+	}
+	metrics := collector.Next(t)
+	if metrics.Fields["panic_count"] != float64(1) || metrics.Fields["error_count"] != float64(1) {
+		t.Errorf("panic_count, error_count = %v, %v, want 1, 1", metrics.Fields["panic_count"], metrics.Fields["error_count"])
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	configure(t)
+	handler := Instrument(func(ctx *fasthttp.RequestCtx) {
+		instrumentation.FromContext(ctx).SetTag("plan", "gold")
+	})
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/fasthttp/record")
+	ctx.Request.Header.Set(instrumentation.RequestIDHeader, "req-42")
+	handler(&ctx)
+
+	metrics := collector.Next(t)
+	if metrics.Tags["plan"] != "gold" || metrics.Fields["request_id"] != "req-42" {
+		t.Errorf("plan = %q, request_id = %v, want gold and req-42", metrics.Tags["plan"], metrics.Fields["request_id"])
+	}
+}
@@ -0,0 +1,133 @@
+// Package fiber instruments Fiber v2 applications. It lives in its own module
+// so that services not using Fiber never pull it into their dependency graph.
+// Importing it (even blank) lets InstrumentEndpoint accept a *fiber.App.
+package fiber
+
+import (
+	"context"
+	gofiber "github.com/gofiber/fiber/v2"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/instrumentation/fasthttp"
+	"github.com/jculley01/observability-module/protocol"
+	"strings"
+	"time"
+)
+
+func init() {
+	instrumentation.RegisterFrameworkAdapter(func(routerOrServer interface{}) bool {
+		app, ok := routerOrServer.(*gofiber.App)
+		if ok {
+			app.Use(Middleware)
+		}
+		return ok
+	})
+	instrumentation.RegisterRouteLister(func(routerOrServer interface{}) ([]protocol.Route, bool) {
+		app, ok := routerOrServer.(*gofiber.App)
+		if !ok {
+			return nil, false
+		}
+		return routes(app), true
+	})
+}
+
+// Middleware reports metrics for every request, tagged with the matched route
+// template (e.g. "/users/:id"). Handlers returning an error count as failed.
+func Middleware(c *gofiber.Ctx) (err error) {
+	if instrumentation.IsIgnoredPath(c.Path()) {
+		return c.Next()
+	}
+	done := instrumentation.TrackInFlight()
+	startTime := time.Now()
+	// Fiber reuses its buffers once the request is done, so copy the raw path
+	rawPath := strings.Clone(c.Path())
+	operationPath := instrumentation.OperationPath(rawPath, fasthttp.OperationRequest(c.Request()))
+	userAgent := c.Get(gofiber.HeaderUserAgent)
+	// Lets handlers reach the record with instrumentation.FromContext, from
+	// either c.Context() or c.UserContext()
+	rec := instrumentation.NewRequestRecord(c.Get(instrumentation.RequestIDHeader))
+	rec.StartTime = startTime
+	c.Locals(instrumentation.RecordContextKey(), rec)
+	c.SetUserContext(context.WithValue(c.UserContext(), instrumentation.RecordContextKey(), rec))
+	// The matched route is only known once the rest of the chain has run; until
+	// then c.Route() is this middleware's own route
+	middlewareRoute := c.Route()
+	defer func() {
+		done()
+		panicValue := recover()
+		recovered := panicValue != nil && instrumentation.RecoverPanics()
+		if recovered {
+			err = c.SendStatus(gofiber.StatusInternalServerError)
+		}
+		path := operationPath
+		if route := c.Route(); route != middlewareRoute {
+			path = route.Path + strings.TrimPrefix(operationPath, rawPath)
+		}
+
+		instrumentation.Report(instrumentation.Observation{
+			Endpoint:           path,
+			UserAgent:          userAgent,
+			IPAddress:          c.IP(),
+			RequestSize:        int64(c.Request().Header.ContentLength()),
+			StatusCode:         c.Response().StatusCode(),
+			ResponseSize:       len(c.Response().Body()), // Fiber may have a better way to get this
+			Latency:            time.Since(startTime),
+			Failed:             err != nil,
+			Err:                err,
+			RequestHeaderFunc:  func(name string) string { return c.Get(name) },
+			ResponseHeaderFunc: func(name string) string { return c.GetRespHeader(name) },
+			Context:            c,
+			Record:             rec,
+			Panic:              panicValue,
+		})
+
+		if panicValue != nil && !recovered {
+			panic(panicValue)
+		}
+	}()
+	// Continue processing
+	return c.Next()
+}
+
+// WithTagExtractor is instrumentation.WithTagExtractor for Fiber apps.
+func WithTagExtractor(extract func(c *gofiber.Ctx) map[string]string) instrumentation.Option {
+	return func(cfg *instrumentation.Config) {
+		cfg.ContextTagExtractors = append(cfg.ContextTagExtractors, func(ctx interface{}) map[string]string {
+			if c, ok := ctx.(*gofiber.Ctx); ok {
+				return extract(c)
+			}
+			return nil
+		})
+	}
+}
+
+// WithFieldExtractor is instrumentation.WithFieldExtractor for Fiber apps.
+func WithFieldExtractor(extract func(c *gofiber.Ctx) map[string]interface{}) instrumentation.Option {
+	return func(cfg *instrumentation.Config) {
+		cfg.ContextFieldExtractors = append(cfg.ContextFieldExtractors, func(ctx interface{}) map[string]interface{} {
+			if c, ok := ctx.(*gofiber.Ctx); ok {
+				return extract(c)
+			}
+			return nil
+		})
+	}
+}
+
+// routes lists the routes of app, leaving out middleware and the HEAD routes
+// Fiber adds for each GET route.
+func routes(app *gofiber.App) []protocol.Route {
+	registered := app.GetRoutes(true)
+	get := make(map[string]bool)
+	for _, route := range registered {
+		if route.Method == gofiber.MethodGet {
+			get[route.Path] = true
+		}
+	}
+	var routes []protocol.Route
+	for _, route := range registered {
+		if route.Method == gofiber.MethodHead && get[route.Path] {
+			continue
+		}
+		routes = append(routes, protocol.Route{Method: route.Method, Pattern: route.Path, Handler: route.Name})
+	}
+	return routes
+}
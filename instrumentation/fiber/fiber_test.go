@@ -0,0 +1,77 @@
+package fiber
+
+import (
+	gofiber "github.com/gofiber/fiber/v2"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/instrumentation/instrumentationtest"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMiddlewareUsesRouteTemplate(t *testing.T) {
+	collector := instrumentationtest.NewCollector()
+	defer collector.Close()
+
+	app := gofiber.New()
+	err := instrumentation.InstrumentEndpoint(app, collector.URL, "test-service", "", "", "", "",
+		WithTagExtractor(func(c *gofiber.Ctx) map[string]string {
+			return map[string]string{"api_version": c.Get("X-API-Version")}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Get("/fiber/users/:id", func(c *gofiber.Ctx) error { return c.SendString("ok") })
+
+	req := httptest.NewRequest(http.MethodGet, "/fiber/users/42?expand=1", nil)
+	req.Header.Set("X-API-Version", "v2")
+	if _, err := app.Test(req); err != nil {
+		t.Fatal(err)
+	}
+	metrics := collector.Next(t)
+	if metrics.Tags["endpoint"] != "/fiber/users/:id" || metrics.Tags["api_version"] != "v2" {
+		t.Errorf("tags = %v, want the route template and api_version v2", metrics.Tags)
+	}
+
+	if _, err := app.Test(httptest.NewRequest(http.MethodGet, "/fiber/missing", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := collector.Next(t).Tags["endpoint"]; got != "/fiber/missing" {
+		t.Errorf("endpoint = %q, want /fiber/missing", got)
+	}
+
+	app.Get("/fiber/record", func(c *gofiber.Ctx) error {
+		instrumentation.FromContext(c.UserContext()).SetTag("plan", "gold")
+		instrumentation.FromContext(c.Context()).SetField("items_in_cart", 3)
+		return nil
+	})
+	if _, err := app.Test(httptest.NewRequest(http.MethodGet, "/fiber/record", nil)); err != nil {
+		t.Fatal(err)
+	}
+	metrics = collector.Next(t)
+	if metrics.Tags["plan"] != "gold" || metrics.Fields["items_in_cart"] != float64(3) {
+		t.Errorf("plan = %q, items_in_cart = %v, want gold and 3", metrics.Tags["plan"], metrics.Fields["items_in_cart"])
+	}
+}
+
+func TestRoutesLeavesOutMiddlewareAndImplicitHead(t *testing.T) {
+	app := gofiber.New()
+	app.Use(func(c *gofiber.Ctx) error { return c.Next() })
+	app.Get("/fiber/users/:id", func(c *gofiber.Ctx) error { return nil }).Name("user")
+	app.Post("/fiber/users", func(c *gofiber.Ctx) error { return nil })
+
+	routes, err := instrumentation.Routes(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, route := range routes {
+		got[route.Method+" "+route.Pattern] = route.Handler
+	}
+	want := map[string]string{"GET /fiber/users/:id": "user", "POST /fiber/users": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Routes = %+v, want %v", routes, want)
+	}
+}
@@ -0,0 +1,46 @@
+package instrumentation
+
+import (
+	"log"
+	"net/http"
+)
+
+// ResponseInfo describes the response a field extractor is computing fields
+// for.
+type ResponseInfo struct {
+	StatusCode int
+	Size       int
+	Header     http.Header
+}
+
+// addCustomFields merges fields returned by a user extractor into a point's
+// fields. Built-in fields such as latency_ms can't be overridden, and values of
+// types InfluxDB can't store are dropped.
+func addCustomFields(fields, extracted map[string]interface{}) {
+	for key, value := range extracted {
+		if _, builtIn := fields[key]; builtIn || key == "" {
+			continue
+		}
+		switch value.(type) {
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool, string:
+			fields[key] = value
+		default:
+			log.Printf("Dropping custom field %q: unsupported type %T\n", key, value)
+		}
+	}
+}
+
+// extractRequestFields applies the WithFieldExtractor hook, if any.
+func extractRequestFields(fields map[string]interface{}, r *http.Request, resp ResponseInfo) {
+	if extract := loadSettings().fieldExtractor; extract != nil {
+		addCustomFields(fields, extract(r, resp))
+	}
+}
+
+// extractContextFields applies the ContextFieldExtractors to a framework
+// context.
+func extractContextFields(fields map[string]interface{}, ctx interface{}) {
+	for _, extract := range loadSettings().contextFieldExtractors {
+		addCustomFields(fields, extract(ctx))
+	}
+}
@@ -0,0 +1,36 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFieldExtractorAddsFields(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{
+		WithFieldExtractor(func(r *http.Request, resp ResponseInfo) map[string]interface{} {
+			return map[string]interface{}{
+				"cache_hit":   resp.Header.Get("X-Cache") == "HIT",
+				"status_code": 999,
+				"unsupported": []int{1},
+			}
+		}),
+	})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cache", "HIT")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fields-test/cart", nil))
+
+	metrics := nextMetrics(t)
+	if metrics.Fields["cache_hit"] != true {
+		t.Errorf("cache_hit = %v, want true", metrics.Fields["cache_hit"])
+	}
+	if metrics.Fields["status_code"] != float64(http.StatusOK) {
+		t.Errorf("status_code = %v, built-in fields must not be overridden", metrics.Fields["status_code"])
+	}
+	if _, ok := metrics.Fields["unsupported"]; ok {
+		t.Error("field of an unsupported type was sent")
+	}
+}
@@ -0,0 +1,140 @@
+// Package gin instruments gin applications. It lives in its own module so that
+// services not using gin never pull it into their dependency graph. Importing
+// it (even blank) lets InstrumentEndpoint accept a *gin.Engine.
+package gin
+
+import (
+	gingonic "github.com/gin-gonic/gin"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/protocol"
+	"net/http"
+)
+
+// abortedField marks requests whose handler chain was aborted, e.g. by an
+// auth middleware calling c.AbortWithStatus.
+const abortedField = "aborted"
+
+func init() {
+	instrumentation.RegisterFrameworkAdapter(func(routerOrServer interface{}) bool {
+		r, ok := routerOrServer.(*gingonic.Engine)
+		if ok {
+			r.Use(Middleware())
+		}
+		return ok
+	})
+	instrumentation.RegisterRouteLister(func(routerOrServer interface{}) ([]protocol.Route, bool) {
+		r, ok := routerOrServer.(*gingonic.Engine)
+		if !ok {
+			return nil, false
+		}
+		var routes []protocol.Route
+		for _, route := range r.Routes() {
+			routes = append(routes, protocol.Route{Method: route.Method, Pattern: route.Path, Handler: route.Handler})
+		}
+		return routes, true
+	})
+}
+
+// Middleware reports metrics for every request, tagged with the matched route
+// template (e.g. "/users/:id"). It runs the rest of the chain through
+// instrumentation.Middleware; requests that recorded an error with c.Error
+// count as failed, and those whose chain was aborted with c.Abort get an
+// aborted=true field. Register it before any middleware that may abort: the
+// requests aborted before it runs aren't reported.
+func Middleware() gingonic.HandlerFunc {
+	return func(c *gingonic.Context) {
+		// Cleared once the chain returns; a panic answered under
+		// WithPanicRecovery must stop gin from running the remaining handlers
+		panicked := true
+		instrumentation.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := c.FullPath(); route != "" {
+				instrumentation.SetRoute(r, route)
+			}
+			instrumentation.SetClientIP(r, c.ClientIP())
+			instrumentation.SetFrameworkContext(r, c)
+			c.Request = r
+			// Middleware further down the chain may swap c.Writer for a
+			// wrapper of their own (gzip, timeouts, caches); what reaches the
+			// client goes through the writer this middleware was given
+			writer := c.Writer
+			// Handlers write and flush through c.Writer; routing it through w
+			// lets Middleware see the first byte and the flushes of streams
+			c.Writer = &responseWriter{ResponseWriter: writer, w: w}
+			// Continue processing
+			c.Next()
+			panicked = false
+
+			// Handlers and middleware write through c.Writer, and gin sets 404
+			// and 405 statuses on it directly, so it has the final status and
+			// size, including when a middleware answered and aborted the chain
+			size := writer.Size()
+			if size < 0 {
+				size = 0
+			}
+			instrumentation.SetResponse(r, writer.Status(), size)
+			if c.IsAborted() {
+				if rec := instrumentation.FromContext(r.Context()); rec != nil {
+					rec.SetField(abortedField, true)
+				}
+			}
+			var err error
+			if last := c.Errors.Last(); last != nil {
+				err = last.Err
+			}
+			instrumentation.SetError(r, err)
+		})).ServeHTTP(c.Writer, c.Request)
+		if panicked {
+			c.Abort()
+		}
+	}
+}
+
+// responseWriter is the gin.ResponseWriter handlers get: it writes through
+// the writer of instrumentation.Middleware, which wraps the original one, and
+// asks the original for everything else.
+type responseWriter struct {
+	gingonic.ResponseWriter
+	w http.ResponseWriter
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.w.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(data []byte) (int, error) {
+	return rw.w.Write(data)
+}
+
+func (rw *responseWriter) WriteString(s string) (int, error) {
+	return rw.w.Write([]byte(s))
+}
+
+func (rw *responseWriter) Flush() {
+	rw.w.(http.Flusher).Flush()
+}
+
+// WithTagExtractor is instrumentation.WithTagExtractor with access to the
+// gin.Context, e.g. to values set by an auth middleware.
+func WithTagExtractor(extract func(c *gingonic.Context) map[string]string) instrumentation.Option {
+	return func(cfg *instrumentation.Config) {
+		cfg.ContextTagExtractors = append(cfg.ContextTagExtractors, func(ctx interface{}) map[string]string {
+			if c, ok := ctx.(*gingonic.Context); ok {
+				return extract(c)
+			}
+			return nil
+		})
+	}
+}
+
+// WithFieldExtractor is instrumentation.WithFieldExtractor with access to the
+// gin.Context.
+func WithFieldExtractor(extract func(c *gingonic.Context) map[string]interface{}) instrumentation.Option {
+	return func(cfg *instrumentation.Config) {
+		cfg.ContextFieldExtractors = append(cfg.ContextFieldExtractors, func(ctx interface{}) map[string]interface{} {
+			if c, ok := ctx.(*gingonic.Context); ok {
+				return extract(c)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package gin
+
+import (
+	"context"
+	"fmt"
+	gingonic "github.com/gin-gonic/gin"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/instrumentation/instrumentationtest"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// collector is shared by the tests, as the registry connection is global.
+var collector *instrumentationtest.Collector
+
+func TestMain(m *testing.M) {
+	collector = instrumentationtest.NewCollector()
+	gingonic.SetMode(gingonic.TestMode)
+	code := m.Run()
+	collector.Close()
+	os.Exit(code)
+}
+
+func TestMiddlewareUsesRouteTemplate(t *testing.T) {
+	r := gingonic.New()
+	if err := instrumentation.InstrumentEndpoint(r, collector.URL, "test-service", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	r.GET("/gin/users/:id", func(c *gingonic.Context) { c.String(http.StatusOK, "ok") })
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/gin/users/42", nil))
+	if got := collector.Next(t).Tags["endpoint"]; got != "/gin/users/:id" {
+		t.Errorf("endpoint = %q, want /gin/users/:id", got)
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/gin/missing", nil))
+	metrics := collector.Next(t)
+	if got := metrics.Tags["endpoint"]; got != "/gin/missing" {
+		t.Errorf("endpoint = %q, want /gin/missing", got)
+	}
+	// gin sets the 404 on its own writer, not through the handler chain
+	if got := metrics.Fields["status_code"]; got != float64(http.StatusNotFound) {
+		t.Errorf("status_code = %v, want 404", got)
+	}
+}
+
+func TestClientCanceled(t *testing.T) {
+	r := gingonic.New()
+	if err := instrumentation.InstrumentEndpoint(r, collector.URL, "test-service", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.GET("/gin/slow", func(c *gingonic.Context) {
+		// The client gives up while the handler is still working
+		cancel()
+		<-c.Request.Context().Done()
+		c.String(http.StatusOK, "too late")
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/gin/slow", nil).WithContext(ctx))
+	if got := collector.Next(t).Fields["client_canceled"]; got != true {
+		t.Errorf("client_canceled = %v, want true", got)
+	}
+}
+
+func TestContextExtractors(t *testing.T) {
+	r := gingonic.New()
+	err := instrumentation.InstrumentEndpoint(r, collector.URL, "test-service", "", "", "", "",
+		WithTagExtractor(func(c *gingonic.Context) map[string]string {
+			return map[string]string{"subject": c.GetString("subject")}
+		}),
+		WithFieldExtractor(func(c *gingonic.Context) map[string]interface{} {
+			return map[string]interface{}{"items_in_cart": c.GetInt("items")}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.GET("/gin/cart", func(c *gingonic.Context) {
+		c.Set("subject", "user-1")
+		c.Set("items", 3)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/gin/cart", nil))
+	metrics := collector.Next(t)
+	if metrics.Tags["subject"] != "user-1" {
+		t.Errorf("subject = %q, want user-1", metrics.Tags["subject"])
+	}
+	if metrics.Fields["items_in_cart"] != float64(3) {
+		t.Errorf("items_in_cart = %v, want 3", metrics.Fields["items_in_cart"])
+	}
+}
+
+func TestRecoveredPanicAbortsChain(t *testing.T) {
+	r := gingonic.New()
+	err := instrumentation.InstrumentEndpoint(r, collector.URL, "test-service", "", "", "", "",
+		instrumentation.WithPanicRecovery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranAfterPanic := false
+	r.Use(func(c *gingonic.Context) {
+		c.Next()
+		ranAfterPanic = true
+	})
+	r.GET("/gin/panic", func(c *gingonic.Context) { panic("boom") }, func(c *gingonic.Context) { ranAfterPanic = true })
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/gin/panic", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("response status = %d, want 500", rec.Code)
+	}
+	if ranAfterPanic {
+		t.Error("handlers after the panic ran")
+	}
+	if got := collector.Next(t).Fields["panic_count"]; got != float64(1) {
+		t.Errorf("panic_count = %v, want 1", got)
+	}
+}
+
+func TestAbortedChainReportsFinalResponse(t *testing.T) {
+	r := gingonic.New()
+	if err := instrumentation.InstrumentEndpoint(r, collector.URL, "test-service", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	// An auth middleware answers for the handler, after swapping the writer
+	// like gzip middleware do
+	r.Use(func(c *gingonic.Context) {
+		c.Writer = &wrappedWriter{ResponseWriter: c.Writer}
+		if c.GetHeader("Authorization") == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gingonic.H{"error": "unauthorized"})
+		}
+	})
+	r.GET("/gin/private", func(c *gingonic.Context) { c.String(http.StatusOK, "secret") })
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/gin/private", nil))
+	metrics := collector.Next(t)
+	if metrics.Fields["status_code"] != float64(http.StatusUnauthorized) || metrics.Fields["response_size"] != float64(rec.Body.Len()) {
+		t.Errorf("status_code = %v, response_size = %v, want 401 and %d", metrics.Fields["status_code"], metrics.Fields["response_size"], rec.Body.Len())
+	}
+	if metrics.Fields["aborted"] != true {
+		t.Errorf("aborted = %v, want true", metrics.Fields["aborted"])
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/gin/private", nil)
+	req.Header.Set("Authorization", "Bearer t")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	metrics = collector.Next(t)
+	if metrics.Fields["status_code"] != float64(http.StatusOK) || metrics.Fields["aborted"] != nil {
+		t.Errorf("status_code = %v, aborted = %v, want 200 and no aborted field", metrics.Fields["status_code"], metrics.Fields["aborted"])
+	}
+}
+
+// wrappedWriter stands in for the writer of compression middleware.
+type wrappedWriter struct {
+	gingonic.ResponseWriter
+}
+
+func TestRoutesListsEngineRoutes(t *testing.T) {
+	r := gingonic.New()
+	r.GET("/gin/users/:id", func(c *gingonic.Context) {})
+	r.POST("/gin/users", func(c *gingonic.Context) {})
+
+	routes, err := instrumentation.Routes(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, route := range routes {
+		got[route.Method+" "+route.Pattern] = true
+	}
+	if len(routes) != 2 || !got["GET /gin/users/:id"] || !got["POST /gin/users"] {
+		t.Errorf("Routes = %+v", routes)
+	}
+}
+
+func TestMiddlewareReportsStreams(t *testing.T) {
+	r := gingonic.New()
+	if err := instrumentation.InstrumentEndpoint(r, collector.URL, "test-service", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	r.GET("/gin/events", func(c *gingonic.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			if i > 0 {
+				time.Sleep(20 * time.Millisecond)
+			}
+			fmt.Fprintf(c.Writer, "data: %d\n\n", i)
+			c.Writer.Flush()
+		}
+	})
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/gin/events", nil))
+	if !rr.Flushed {
+		t.Error("flush didn't reach the underlying writer")
+	}
+	metrics := collector.Next(t)
+	if metrics.Fields["streaming"] != true || metrics.Fields["response_size"] != float64(rr.Body.Len()) {
+		t.Errorf("fields = %v, want a streamed response", metrics.Fields)
+	}
+	duration, _ := metrics.Fields["stream_duration_ms"].(float64)
+	latency, _ := metrics.Fields["latency_ms"].(float64)
+	if duration < 40 || latency >= 20 || metrics.Fields["ttfb_ms"] != latency {
+		t.Errorf("stream_duration_ms = %v, latency_ms = %v, ttfb_ms = %v: want the latency to be the time to first byte", duration, latency, metrics.Fields["ttfb_ms"])
+	}
+}
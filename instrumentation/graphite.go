@@ -0,0 +1,351 @@
+package instrumentation
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocols of the Graphite carbon receiver.
+const (
+	// GraphitePlaintext writes "path value timestamp" lines, to port 2003
+	GraphitePlaintext = "plaintext"
+	// GraphitePickle writes batches as pickled lists, to port 2004
+	GraphitePickle = "pickle"
+)
+
+const (
+	defaultGraphitePath      = "{service}.{endpoint}"
+	defaultGraphiteQueueSize = 1000
+	graphiteTimeout          = 10 * time.Second
+	// graphiteMaxBatch bounds the datapoints written at once
+	graphiteMaxBatch = 500
+)
+
+// graphitePlaceholder matches the placeholders of a path template.
+var graphitePlaceholder = regexp.MustCompile(`\{([a-z0-9_]+)\}`)
+
+// GraphiteConfig writes every point to a Graphite carbon receiver, next to the
+// registry or instead of it when RegistryURL is empty. Each numeric or boolean
+// field becomes a datapoint of the path Prefix + "." + the path rendered from
+// Path ("{service}.{endpoint}" if empty) + "." + the field: {service} is the
+// service name and any other {name} the value of the point's tag, "_" when it
+// has none. Whisper creates a file per path, so only the tags named in Path
+// are part of it.
+type GraphiteConfig struct {
+	// URL is the receiver, e.g. "tcp://graphite:2003".
+	URL string `json:"url"`
+	// Protocol is GraphitePlaintext, the default, or GraphitePickle.
+	Protocol string `json:"protocol"`
+	// Prefix is put before every path, e.g. "prod.observability".
+	Prefix string `json:"prefix"`
+	Path   string `json:"path"`
+	// QueueSize bounds the points waiting to be written, 1000 if zero;
+	// points beyond it are dropped.
+	QueueSize int `json:"queue_size"`
+	// Retry retries the datapoints that couldn't be written, connecting
+	// again first; the points queued meanwhile wait.
+	Retry RetryPolicy `json:"retry"`
+}
+
+// graphiteDatapoint is a value of a Graphite path.
+type graphiteDatapoint struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+// graphiteExporter writes the datapoints of the points sent on a connection
+// of its own.
+type graphiteExporter struct {
+	config GraphiteConfig
+	path   string
+	queue  chan []graphiteDatapoint
+	done   chan struct{}
+	// stopped is closed once the queue is drained and the connection closed
+	stopped chan struct{}
+
+	mu      sync.Mutex
+	dropped int64
+}
+
+var (
+	graphiteMu sync.Mutex
+	graphite   *graphiteExporter
+)
+
+// startGraphite replaces the exporter of any previously applied config,
+// keeping it when its config is unchanged. A replaced exporter writes its
+// queued points in the background.
+func startGraphite(cfg Config) {
+	graphiteMu.Lock()
+	defer graphiteMu.Unlock()
+	if graphite != nil && reflect.DeepEqual(graphite.config, cfg.Graphite) {
+		return
+	}
+	if graphite != nil {
+		close(graphite.done)
+		graphite = nil
+	}
+	if cfg.Graphite.URL == "" {
+		return
+	}
+	e := &graphiteExporter{
+		config:  cfg.Graphite,
+		path:    cfg.Graphite.Path,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if e.path == "" {
+		e.path = defaultGraphitePath
+	}
+	queueSize := cfg.Graphite.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultGraphiteQueueSize
+	}
+	e.queue = make(chan []graphiteDatapoint, queueSize)
+	graphite = e
+	go e.run()
+}
+
+// stopGraphite writes the queued points and disconnects, until ctx is done.
+func stopGraphite(ctx context.Context) error {
+	graphiteMu.Lock()
+	e := graphite
+	graphite = nil
+	graphiteMu.Unlock()
+	if e == nil {
+		return nil
+	}
+	close(e.done)
+	select {
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error writing metrics to Graphite: %w", ctx.Err())
+	}
+}
+
+// sendToGraphite queues the datapoints of a point when Graphite is
+// configured.
+func sendToGraphite(metrics Metrics) {
+	graphiteMu.Lock()
+	e := graphite
+	graphiteMu.Unlock()
+	if e == nil {
+		return
+	}
+	datapoints := graphiteDatapointsOf(metrics, e.config.Prefix, e.path, time.Now())
+	if len(datapoints) == 0 {
+		return
+	}
+	select {
+	case e.queue <- datapoints:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+}
+
+// graphiteDatapointsOf converts the numeric and boolean fields of a point to
+// datapoints; other fields are left out. Points without a timestamp are
+// timestamped now, as Graphite's are in seconds.
+func graphiteDatapointsOf(metrics Metrics, prefix, template string, now time.Time) []graphiteDatapoint {
+	path := graphitePath(template, metrics)
+	if prefix = strings.Trim(prefix, "."); prefix != "" {
+		path = prefix + "." + path
+	}
+	timestamp := pointTime(metrics, now).Unix()
+	var datapoints []graphiteDatapoint
+	for key, value := range metrics.Fields {
+		v, ok := gaugeValue(value)
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		datapoints = append(datapoints, graphiteDatapoint{path: path + "." + graphiteNode(key), value: v, timestamp: timestamp})
+	}
+	return datapoints
+}
+
+// graphitePath renders a path template for a point. Values are made single
+// nodes of the path.
+func graphitePath(template string, metrics Metrics) string {
+	return graphitePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value := metrics.Tags[name]
+		if name == "service" {
+			value = metrics.Measurement
+		}
+		return graphiteNode(value)
+	})
+}
+
+// graphiteNode replaces the characters Graphite doesn't allow in a node of a
+// path, dots included, with underscores, leaving out the slashes at either end
+// of endpoints. Empty nodes become "_".
+func graphiteNode(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.Trim(value, "/"))
+	if value == "" {
+		return "_"
+	}
+	return value
+}
+
+func (e *graphiteExporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(graphiteTimeout)
+	defer ticker.Stop()
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	write := func(datapoints []graphiteDatapoint) {
+		// Datapoints queued meanwhile go in the same write
+	batch:
+		for len(datapoints) < graphiteMaxBatch {
+			select {
+			case more := <-e.queue:
+				datapoints = append(datapoints, more...)
+			default:
+				break batch
+			}
+		}
+		err := retry(context.Background(), e.config.Retry, func() error {
+			if conn == nil {
+				c, err := dialGraphite(e.config)
+				if err != nil {
+					return fmt.Errorf("error connecting: %w", err)
+				}
+				conn = c
+			}
+			if err := writeGraphite(conn, e.config.Protocol, datapoints); err != nil {
+				conn.Close()
+				conn = nil
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error writing %d datapoints to Graphite: %v\n", len(datapoints), err)
+		}
+	}
+
+	for {
+		select {
+		case <-e.done:
+			for {
+				select {
+				case datapoints := <-e.queue:
+					write(datapoints)
+				default:
+					return
+				}
+			}
+		case datapoints := <-e.queue:
+			write(datapoints)
+		case <-ticker.C:
+			e.mu.Lock()
+			dropped := e.dropped
+			e.dropped = 0
+			e.mu.Unlock()
+			if dropped > 0 {
+				log.Printf("Dropped %d points while Graphite was slow\n", dropped)
+			}
+		}
+	}
+}
+
+// dialGraphite connects to the receiver of cfg.
+func dialGraphite(cfg GraphiteConfig) (net.Conn, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", u.Host, graphiteTimeout)
+}
+
+// writeGraphite writes datapoints in protocol.
+func writeGraphite(conn net.Conn, protocol string, datapoints []graphiteDatapoint) error {
+	var data []byte
+	if protocol == GraphitePickle {
+		data = appendGraphitePickle(nil, datapoints)
+	} else {
+		data = appendGraphitePlaintext(nil, datapoints)
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(graphiteTimeout)); err != nil {
+		return err
+	}
+	_, err := conn.Write(data)
+	return err
+}
+
+// appendGraphitePlaintext appends datapoints as lines of the plaintext
+// protocol.
+func appendGraphitePlaintext(b []byte, datapoints []graphiteDatapoint) []byte {
+	for _, d := range datapoints {
+		b = append(b, d.path...)
+		b = append(b, ' ')
+		b = strconv.AppendFloat(b, d.value, 'f', -1, 64)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, d.timestamp, 10)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// Opcodes of pickle protocol 2.
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleStop       = '.'
+)
+
+// appendGraphitePickle appends datapoints as a message of the pickle
+// protocol: the length of the pickle, then the pickled list of
+// (path, (timestamp, value)) tuples carbon expects.
+func appendGraphitePickle(b []byte, datapoints []graphiteDatapoint) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0, pickleProto, 2, pickleEmptyList, pickleMark)
+	for _, d := range datapoints {
+		b = append(b, pickleBinUnicode)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(d.path)))
+		b = append(b, d.path...)
+		if d.timestamp >= math.MinInt32 && d.timestamp <= math.MaxInt32 {
+			b = append(b, pickleBinInt)
+			b = binary.LittleEndian.AppendUint32(b, uint32(int32(d.timestamp)))
+		} else {
+			b = append(b, pickleBinFloat)
+			b = binary.BigEndian.AppendUint64(b, math.Float64bits(float64(d.timestamp)))
+		}
+		b = append(b, pickleBinFloat)
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(d.value))
+		b = append(b, pickleTuple2, pickleTuple2)
+	}
+	b = append(b, pickleAppends, pickleStop)
+	binary.BigEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
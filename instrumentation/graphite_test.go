@@ -0,0 +1,147 @@
+package instrumentation
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCarbon accepts Graphite connections and passes on what each one wrote
+// once it is closed.
+func fakeCarbon(t *testing.T) (string, chan []byte) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(bufio.NewReader(conn))
+				received <- data
+			}()
+		}
+	}()
+	return "tcp://" + listener.Addr().String(), received
+}
+
+func TestGraphiteWritesPlaintext(t *testing.T) {
+	carbonURL, received := fakeCarbon(t)
+	if err := Configure(collectorURL, "test-service", "", "", "", "",
+		WithGraphite(GraphiteConfig{URL: carbonURL, Prefix: "prod.", Path: "{service}.{endpoint}"}),
+		WithoutSendQueue(),
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/graphite/orders", nil))
+	nextMetrics(t)
+	if err := stopGraphite(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		for _, line := range lines {
+			parts := strings.Split(line, " ")
+			if len(parts) != 3 || !strings.HasPrefix(parts[0], "prod.test-service.graphite_orders.") {
+				t.Errorf("wrote %q", line)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing written")
+	}
+}
+
+func TestGraphiteShutdownWritesQueuedPoints(t *testing.T) {
+	carbonURL, received := fakeCarbon(t)
+	startGraphite(Config{Graphite: GraphiteConfig{URL: carbonURL, Protocol: GraphitePickle}})
+	for i := 0; i < 3; i++ {
+		sendToGraphite(Metrics{Measurement: "orders", Fields: map[string]interface{}{"i": i}, Timestamp: 1700000000, Precision: PrecisionSeconds})
+	}
+	if err := stopGraphite(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		// The points are written in one batch or more, depending on timing
+		if strings.Count(string(data), "orders._.i") != 3 || data[4] != pickleProto {
+			t.Errorf("wrote %x, want the pickles of three points", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing written")
+	}
+}
+
+func TestGraphitePickle(t *testing.T) {
+	// As pickle.loads reads it: [('prod.orders.latency_ms', (1700000000, 12.5)), ('a.b', (5000000000.0, -1.0))]
+	want := "0000004d80025d28581600000070726f642e6f72646572732e6c6174656e63795f6d734a00f1536547402900000000000086865803000000612e624741f2a05f2000000047bff00000000000008686652e"
+	got := appendGraphitePickle(nil, []graphiteDatapoint{
+		{path: "prod.orders.latency_ms", value: 12.5, timestamp: 1700000000},
+		{path: "a.b", value: -1, timestamp: 5000000000},
+	})
+	if hex.EncodeToString(got) != want {
+		t.Errorf("pickled %x, want %s", got, want)
+	}
+}
+
+func TestGraphiteDatapointsOf(t *testing.T) {
+	point := Metrics{
+		Measurement: "orders",
+		Tags:        map[string]string{"endpoint": "/orders/{id}", "region": "eu.west 1"},
+		Fields:      map[string]interface{}{"latency_ms": 12, "canceled": true, "status": "ok"},
+		Timestamp:   1700000000123,
+		Precision:   PrecisionMilliseconds,
+	}
+	datapoints := graphiteDatapointsOf(point, ".prod.", "{service}.{region}.{endpoint}.{missing}", time.Now())
+	if len(datapoints) != 2 {
+		t.Fatalf("datapoints = %+v, want the numeric and boolean fields", datapoints)
+	}
+	for _, d := range datapoints {
+		if !strings.HasPrefix(d.path, "prod.orders.eu_west_1.orders__id_._.") || d.timestamp != 1700000000 {
+			t.Errorf("datapoint = %+v", d)
+		}
+	}
+
+	now := time.Unix(1800000000, 0)
+	if datapoints := graphiteDatapointsOf(Metrics{Measurement: "orders", Fields: map[string]interface{}{"n": 1}}, "", defaultGraphitePath, now); len(datapoints) != 1 || datapoints[0].path != "orders._.n" || datapoints[0].timestamp != now.Unix() {
+		t.Errorf("datapoints without a timestamp = %+v", datapoints)
+	}
+}
+
+func TestValidateGraphite(t *testing.T) {
+	cfg := Config{ServiceName: "orders", Graphite: GraphiteConfig{URL: "udp://graphite:2003", Protocol: "json", QueueSize: -1}}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 3 {
+		t.Errorf("Validate() = %v, want the URL, protocol and queue size rejected", err)
+	}
+	cfg.Graphite = GraphiteConfig{Prefix: "prod"}
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 1 || validationErr.Errors[0].Field != "graphite.url" {
+		t.Errorf("Validate() = %v, want the URL required", err)
+	}
+	cfg.Graphite.URL = "tcp://graphite:2003"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package instrumentation
+
+import (
+	"net/http"
+	"strings"
+)
+
+// redactedValue replaces the value of credential-bearing headers.
+const redactedValue = "redacted"
+
+// sensitiveHeaders are never reported as they are, even when configured for
+// capture, since they carry credentials or session state.
+var sensitiveHeaders = map[string]struct{}{
+	"Authorization":       {},
+	"Proxy-Authorization": {},
+	"Cookie":              {},
+	"Set-Cookie":          {},
+	"X-Api-Key":           {},
+	"X-Auth-Token":        {},
+}
+
+// HeaderCapture reports a request or response header as a tag or field.
+type HeaderCapture struct {
+	// Header is the header name, e.g. "X-Request-ID".
+	Header string `json:"header"`
+	// Response captures the header from the response instead of the request.
+	Response bool `json:"response"`
+	// Field sends the value as a field instead of a tag. Prefer it for
+	// per-request values such as request IDs, which would only overflow the
+	// tag value cap.
+	Field bool `json:"field"`
+	// Name is the tag or field name; it defaults to the lower-cased header
+	// name with dashes turned into underscores, e.g. "x_request_id".
+	Name string `json:"name"`
+}
+
+// normalizeHeaderCaptures canonicalises header names and fills in defaults.
+func normalizeHeaderCaptures(captures []HeaderCapture) []HeaderCapture {
+	if len(captures) == 0 {
+		return nil
+	}
+	normalized := make([]HeaderCapture, len(captures))
+	for i, capture := range captures {
+		capture.Header = http.CanonicalHeaderKey(capture.Header)
+		if capture.Name == "" {
+			capture.Name = strings.ToLower(strings.ReplaceAll(capture.Header, "-", "_"))
+		}
+		normalized[i] = capture
+	}
+	return normalized
+}
+
+// captureHeaders adds the configured headers to a point. Headers are looked up
+// through the framework's accessors; missing headers are skipped.
+func captureHeaders(tags map[string]string, fields map[string]interface{}, requestHeader, responseHeader func(name string) string) {
+	for _, capture := range loadSettings().headerCaptures {
+		lookup := requestHeader
+		if capture.Response {
+			lookup = responseHeader
+		}
+		value := lookup(capture.Header)
+		if value == "" {
+			continue
+		}
+		if _, sensitive := sensitiveHeaders[capture.Header]; sensitive {
+			value = redactedValue
+		}
+		if capture.Field {
+			addCustomFields(fields, map[string]interface{}{capture.Name: value})
+		} else {
+			addCustomTags(tags, map[string]string{capture.Name: value})
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCaptureHeaders(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{
+		WithHeaderCapture(
+			HeaderCapture{Header: "x-api-version"},
+			HeaderCapture{Header: "X-Request-ID", Field: true},
+			HeaderCapture{Header: "X-Cache", Response: true, Name: "cache"},
+			HeaderCapture{Header: "Authorization"},
+			HeaderCapture{Header: "Set-Cookie", Response: true, Field: true},
+			HeaderCapture{Header: "X-Missing"},
+		),
+	})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cache", "MISS")
+		w.Header().Set("Set-Cookie", "session=secret")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/headers-test", nil)
+	req.Header.Set("X-API-Version", "2024-01")
+	req.Header.Set("X-Request-ID", "req-123")
+	req.Header.Set("Authorization", "Bearer secret")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	metrics := nextMetrics(t)
+	wantTags := map[string]string{
+		"x_api_version": "2024-01",
+		"cache":         "MISS",
+		"authorization": redactedValue,
+	}
+	for key, want := range wantTags {
+		if got := metrics.Tags[key]; got != want {
+			t.Errorf("tag %s = %q, want %q", key, got, want)
+		}
+	}
+	if _, ok := metrics.Tags["x_missing"]; ok {
+		t.Error("missing header produced a tag")
+	}
+	if got := metrics.Fields["x_request_id"]; got != "req-123" {
+		t.Errorf("field x_request_id = %v, want req-123", got)
+	}
+	if got := metrics.Fields["set_cookie"]; got != redactedValue {
+		t.Errorf("field set_cookie = %v, want it redacted", got)
+	}
+}
@@ -0,0 +1,120 @@
+package instrumentation
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the bucket upper bounds, in milliseconds, used by
+// WithLatencyBuckets when called without any.
+var DefaultLatencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// latencyHistogram keeps cumulative per-endpoint latency histograms. Every
+// point carries its endpoint's bucket counts, sum and count, like
+// request_count, so percentiles can be computed downstream from the increase
+// between two points, whatever the sampling.
+type latencyHistogram struct {
+	// name prefixes the fields, e.g. "latency" for latency_sum_ms
+	name   string
+	bounds []float64
+	// fieldNames holds the field of each bucket, the last one being +Inf
+	fieldNames []string
+
+	mu        sync.Mutex
+	endpoints map[string]*endpointLatency
+}
+
+// endpointLatency is one endpoint's histogram; counts are per bucket, not yet
+// cumulative.
+type endpointLatency struct {
+	counts []int64
+	sumMs  float64
+	count  int64
+}
+
+func newLatencyHistogram(name string, bounds []float64) *latencyHistogram {
+	h := &latencyHistogram{
+		name:      name,
+		bounds:    slices.Clone(bounds),
+		endpoints: make(map[string]*endpointLatency),
+	}
+	for _, bound := range bounds {
+		h.fieldNames = append(h.fieldNames, name+"_bucket_le_"+strconv.FormatFloat(bound, 'f', -1, 64))
+	}
+	h.fieldNames = append(h.fieldNames, name+"_bucket_le_inf")
+	return h
+}
+
+// latencyHistogramFor returns the histogram to use for the given bounds,
+// keeping the current one (and its counts) across reloads that don't change
+// them. It returns nil when bounds is empty.
+func latencyHistogramFor(bounds []float64) *latencyHistogram {
+	return histogramFor(loadSettings().latencyHistogram, "latency", bounds)
+}
+
+// consumerLagHistogramFor returns the lag histogram of consumed messages,
+// keeping the current one across reloads like latencyHistogramFor.
+func consumerLagHistogramFor(bounds []float64) *latencyHistogram {
+	if len(bounds) == 0 {
+		bounds = DefaultConsumerLagBuckets
+	}
+	return histogramFor(loadSettings().consumerLagHistogram, "lag", bounds)
+}
+
+// histogramFor returns current if it has the given bounds, or a new histogram
+// named name. It returns nil when bounds is empty.
+func histogramFor(current *latencyHistogram, name string, bounds []float64) *latencyHistogram {
+	if len(bounds) == 0 {
+		return nil
+	}
+	if current != nil && slices.Equal(current.bounds, bounds) {
+		return current
+	}
+	return newLatencyHistogram(name, bounds)
+}
+
+// observe records latency for endpoint and adds the endpoint's cumulative
+// "le" bucket counts, <name>_sum_ms and <name>_count to fields.
+func (h *latencyHistogram) observe(fields map[string]interface{}, endpoint string, latency time.Duration) {
+	ms := float64(latency) / float64(time.Millisecond)
+	bucket, _ := slices.BinarySearch(h.bounds, ms)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.endpoints[endpoint]
+	if !ok {
+		e = &endpointLatency{counts: make([]int64, len(h.fieldNames))}
+		h.endpoints[endpoint] = e
+	}
+	e.counts[bucket]++
+	e.sumMs += ms
+	e.count++
+
+	var cumulative int64
+	for i, name := range h.fieldNames {
+		cumulative += e.counts[i]
+		fields[name] = cumulative
+	}
+	fields[h.name+"_sum_ms"] = e.sumMs
+	fields[h.name+"_count"] = e.count
+}
+
+// snapshot copies the histogram of every endpoint.
+func (h *latencyHistogram) snapshot() map[string]endpointLatency {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	endpoints := make(map[string]endpointLatency, len(h.endpoints))
+	for endpoint, e := range h.endpoints {
+		endpoints[endpoint] = endpointLatency{counts: slices.Clone(e.counts), sumMs: e.sumMs, count: e.count}
+	}
+	return endpoints
+}
+
+// addLatencyHistogram adds the histogram fields when WithLatencyBuckets is on.
+func addLatencyHistogram(fields map[string]interface{}, endpoint string, latency time.Duration) {
+	if h := loadSettings().latencyHistogram; h != nil {
+		h.observe(fields, endpoint, latency)
+	}
+}
@@ -0,0 +1,80 @@
+package instrumentation
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogramIsCumulative(t *testing.T) {
+	h := newLatencyHistogram("latency", []float64{10, 100})
+	for _, latency := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond, time.Second} {
+		h.observe(map[string]interface{}{}, "/orders", latency)
+	}
+	fields := map[string]interface{}{}
+	h.observe(fields, "/orders", 2*time.Millisecond)
+
+	want := map[string]interface{}{
+		"latency_bucket_le_10":  int64(3),
+		"latency_bucket_le_100": int64(4),
+		"latency_bucket_le_inf": int64(5),
+		"latency_sum_ms":        float64(1067),
+		"latency_count":         int64(5),
+	}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Errorf("%s = %v, want %v", name, fields[name], value)
+		}
+	}
+
+	// Endpoints have their own histograms
+	other := map[string]interface{}{}
+	h.observe(other, "/users", time.Millisecond)
+	if other["latency_count"] != int64(1) {
+		t.Errorf("latency_count for another endpoint = %v, want 1", other["latency_count"])
+	}
+}
+
+func TestMiddlewareReportsLatencyBuckets(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{WithLatencyBuckets(1, 2.5)})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/histogram/fast", nil))
+
+	metrics := nextMetrics(t)
+	for _, name := range []string{"latency_bucket_le_1", "latency_bucket_le_2.5", "latency_bucket_le_inf", "latency_count"} {
+		if metrics.Fields[name] != float64(1) {
+			t.Errorf("%s = %v, want 1", name, metrics.Fields[name])
+		}
+	}
+
+	// Reapplying the same bounds keeps the counts
+	histogram := loadSettings().latencyHistogram
+	applyOptions([]Option{WithLatencyBuckets(1, 2.5)})
+	if loadSettings().latencyHistogram != histogram {
+		t.Error("histogram replaced although the bounds didn't change")
+	}
+}
+
+func TestLatencyBucketsOffByDefault(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/histogram/off", nil))
+
+	if value, ok := nextMetrics(t).Fields["latency_count"]; ok {
+		t.Errorf("latency_count = %v without WithLatencyBuckets", value)
+	}
+}
+
+func TestValidateLatencyBuckets(t *testing.T) {
+	cfg := Config{RegistryURL: "wss://registry.example.com", ServiceName: "orders", LatencyBuckets: []float64{0, 10, 10}}
+	var validationErr *ValidationError
+	if !errors.As(cfg.Validate(), &validationErr) || len(validationErr.Errors) != 2 {
+		t.Fatalf("Validate() = %v, want errors for latency_buckets[0] and [2]", cfg.Validate())
+	}
+	if validationErr.Errors[0].Field != "latency_buckets[0]" || validationErr.Errors[1].Field != "latency_buckets[2]" {
+		t.Errorf("errors = %v", validationErr.Errors)
+	}
+}
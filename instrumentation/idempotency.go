@@ -0,0 +1,106 @@
+package instrumentation
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the request header clients put the idempotency key
+// of a submission in.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeys bounds the keys remembered over IdempotencyWindow; the
+// oldest are forgotten first.
+const maxIdempotencyKeys = 100000
+
+// duplicateCounts holds an *atomic.Int64 per endpoint.
+var duplicateCounts sync.Map
+
+// idempotencyEntry is a key seen for an endpoint, hashed so long keys don't
+// cost memory.
+type idempotencyEntry struct {
+	endpoint string
+	key      uint64
+}
+
+// idempotencyTracker remembers the keys seen over the last window.
+type idempotencyTracker struct {
+	mu   sync.Mutex
+	seed maphash.Seed
+	seen map[idempotencyEntry]time.Time
+	// order holds the entries in the order they were last seen in, with the
+	// time they were; entries seen again since are skipped when expiring.
+	order []idempotencyOrder
+}
+
+type idempotencyOrder struct {
+	entry idempotencyEntry
+	at    time.Time
+}
+
+var idempotencyKeys = newIdempotencyTracker()
+
+func newIdempotencyTracker() *idempotencyTracker {
+	return &idempotencyTracker{seed: maphash.MakeSeed(), seen: map[idempotencyEntry]time.Time{}}
+}
+
+// observe records key for endpoint, and reports whether it was already seen
+// within window.
+func (t *idempotencyTracker) observe(endpoint, key string, window time.Duration, now time.Time) bool {
+	entry := idempotencyEntry{endpoint: endpoint, key: maphash.String(t.seed, key)}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now.Add(-window))
+	last, duplicate := t.seen[entry]
+	duplicate = duplicate && now.Sub(last) <= window
+	t.seen[entry] = now
+	t.order = append(t.order, idempotencyOrder{entry: entry, at: now})
+	return duplicate
+}
+
+// expire forgets the keys last seen before cutoff, and the oldest ones beyond
+// maxIdempotencyKeys.
+func (t *idempotencyTracker) expire(cutoff time.Time) {
+	i := 0
+	for ; i < len(t.order); i++ {
+		o := t.order[i]
+		if !o.at.Before(cutoff) && len(t.seen) < maxIdempotencyKeys {
+			break
+		}
+		if t.seen[o.entry].Equal(o.at) {
+			delete(t.seen, o.entry)
+		}
+	}
+	// The backing array is reallocated, without the expired entries, as
+	// entries are appended
+	t.order = t.order[i:]
+}
+
+func incrementEndpointDuplicateCount(endpoint string) {
+	incrementCounter(&duplicateCounts, endpoint)
+}
+
+// getEndpointDuplicateCount retrieves the count of duplicate submissions to an
+// endpoint.
+func getEndpointDuplicateCount(endpoint string) int64 {
+	return loadCounter(&duplicateCounts, endpoint)
+}
+
+// countDuplicate checks the idempotency key of a request to endpoint against
+// the keys seen over IdempotencyWindow, and adds duplicate_submission and the
+// endpoint's duplicate_count to its fields. It does nothing without a window.
+func countDuplicate(fields map[string]interface{}, endpoint string, requestHeader func(string) string) {
+	window := loadSettings().idempotencyWindow
+	if window <= 0 {
+		return
+	}
+	if key := requestHeader(IdempotencyKeyHeader); key != "" {
+		duplicate := idempotencyKeys.observe(endpoint, key, window, time.Now())
+		if duplicate {
+			incrementEndpointDuplicateCount(endpoint)
+		}
+		fields["duplicate_submission"] = duplicate
+	}
+	fields["duplicate_count"] = getEndpointDuplicateCount(endpoint)
+}
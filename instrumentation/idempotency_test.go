@@ -0,0 +1,86 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareCountsDuplicateSubmissions(t *testing.T) {
+	applyOptions([]Option{WithIdempotencyWindow(time.Hour)})
+	defer applyOptions(nil)
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i, key := range []string{"order-1", "order-2", "order-1", ""} {
+		req := httptest.NewRequest(http.MethodPost, "/idempotency/orders", nil)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		metrics := nextMetrics(t)
+		wantDuplicate := map[int]interface{}{0: false, 1: false, 2: true, 3: nil}[i]
+		wantCount := map[int]float64{0: 0, 1: 0, 2: 1, 3: 1}[i]
+		if metrics.Fields["duplicate_submission"] != wantDuplicate || metrics.Fields["duplicate_count"] != wantCount {
+			t.Errorf("request %d with key %q: duplicate_submission, duplicate_count = %v, %v, want %v, %v", i, key, metrics.Fields["duplicate_submission"], metrics.Fields["duplicate_count"], wantDuplicate, wantCount)
+		}
+	}
+
+	// Keys are tracked per endpoint
+	req := httptest.NewRequest(http.MethodPost, "/idempotency/refunds", nil)
+	req.Header.Set(IdempotencyKeyHeader, "order-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if metrics := nextMetrics(t); metrics.Fields["duplicate_submission"] != false {
+		t.Errorf("duplicate_submission = %v for a key seen on another endpoint", metrics.Fields["duplicate_submission"])
+	}
+}
+
+func TestMiddlewareIgnoresIdempotencyKeysWithoutWindow(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/idempotency/off", nil)
+	req.Header.Set(IdempotencyKeyHeader, "order-1")
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), req)
+	if metrics := nextMetrics(t); metrics.Fields["duplicate_submission"] != nil || metrics.Fields["duplicate_count"] != nil {
+		t.Errorf("fields = %v, want no duplicate tracking", metrics.Fields)
+	}
+}
+
+func TestIdempotencyTrackerForgetsExpiredKeys(t *testing.T) {
+	tracker := newIdempotencyTracker()
+	start := time.Now()
+	if tracker.observe("/pay", "a", time.Minute, start) {
+		t.Error("first submission reported as a duplicate")
+	}
+	if !tracker.observe("/pay", "a", time.Minute, start.Add(30*time.Second)) {
+		t.Error("submission within the window not reported as a duplicate")
+	}
+	// The window slides from the last submission
+	if !tracker.observe("/pay", "a", time.Minute, start.Add(80*time.Second)) {
+		t.Error("submission within the window of the previous one not reported as a duplicate")
+	}
+	if tracker.observe("/pay", "a", time.Minute, start.Add(3*time.Minute)) {
+		t.Error("submission after the window reported as a duplicate")
+	}
+	if len(tracker.seen) != 1 || len(tracker.order) != 1 {
+		t.Errorf("tracker holds %d keys and %d entries, want 1 and 1", len(tracker.seen), len(tracker.order))
+	}
+}
+
+func TestCountDuplicatesConcurrently(t *testing.T) {
+	before := getEndpointDuplicateCount("/idempotency/concurrent")
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				incrementEndpointDuplicateCount("/idempotency/concurrent")
+			}
+		}()
+	}
+	wg.Wait()
+	if got := getEndpointDuplicateCount("/idempotency/concurrent") - before; got != 1000 {
+		t.Errorf("counted %d duplicates, want 1000", got)
+	}
+}
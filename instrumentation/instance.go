@@ -0,0 +1,59 @@
+package instrumentation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"sync"
+)
+
+// instanceIDTag tags every point with the replica that sent it.
+const instanceIDTag = "instance_id"
+
+// serviceTypeTag tags every point with the ServiceType of the config, if any.
+const serviceTypeTag = "service_type"
+
+var (
+	// instanceID is the instance_id tag value of the applied config.
+	instanceID string
+	// serviceType is the service_type tag value of the applied config.
+	serviceType string
+)
+
+var (
+	generatedInstanceIDOnce sync.Once
+	generatedInstanceID     string
+)
+
+// processInstanceID returns the ID generated for this process: the host name
+// (the pod name on Kubernetes) and a random suffix, so replicas sharing a
+// host and restarts of the same pod stay apart. It doesn't change for the life
+// of the process.
+func processInstanceID() string {
+	generatedInstanceIDOnce.Do(func() {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = "instance"
+		}
+		var suffix [4]byte
+		if _, err := rand.Read(suffix[:]); err != nil {
+			log.Printf("Error generating instance ID: %v\n", err)
+		}
+		generatedInstanceID = host + "-" + hex.EncodeToString(suffix[:])
+	})
+	return generatedInstanceID
+}
+
+// resolveInstanceID returns the configured InstanceID or the process's own.
+func resolveInstanceID(cfg Config) string {
+	if cfg.InstanceID != "" {
+		return cfg.InstanceID
+	}
+	return processInstanceID()
+}
+
+// InstanceID returns the instance_id this process tags its points with.
+func InstanceID() string {
+	return instanceID
+}
@@ -0,0 +1,66 @@
+package instrumentation
+
+import (
+	"github.com/jculley01/observability-module/registration"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPointsCarryInstanceID(t *testing.T) {
+	generated := processInstanceID()
+	if generated != processInstanceID() || !strings.Contains(generated, "-") {
+		t.Fatalf("processInstanceID() = %q, want a stable host-suffix ID", generated)
+	}
+	if InstanceID() != generated {
+		t.Errorf("InstanceID() = %q, want the generated %q", InstanceID(), generated)
+	}
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).SetTag(instanceIDTag, "spoofed")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/instance/default", nil))
+	if got := nextMetrics(t).Tags[instanceIDTag]; got != generated {
+		t.Errorf("instance_id = %q, want %q", got, generated)
+	}
+
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithInstanceID("orders-7f9c"), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/instance/configured", nil))
+	if got := nextMetrics(t).Tags[instanceIDTag]; got != "orders-7f9c" {
+		t.Errorf("instance_id = %q, want orders-7f9c", got)
+	}
+}
+
+func TestPointsCarryServiceType(t *testing.T) {
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithServiceType(registration.Worker), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	sendEvent("service_type_check", nil, map[string]interface{}{"ok": true})
+	if got := nextMetrics(t).Tags[serviceTypeTag]; got != "worker" {
+		t.Errorf("service_type = %q, want worker", got)
+	}
+
+	err := Configure(collectorURL, "test-service", "", "", "", "", WithServiceType("lambda"), WithoutSendQueue())
+	if err == nil || !strings.Contains(err.Error(), "service_type") {
+		t.Errorf("Configure with an unknown service type = %v, want a service_type error", err)
+	}
+	if err := registration.RegisterServiceType("lambda"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithServiceType("lambda"), WithoutSendQueue()); err != nil {
+		t.Errorf("Configure with a registered custom type = %v", err)
+	}
+}
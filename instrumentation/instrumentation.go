@@ -1,336 +1,255 @@
 package instrumentation
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"github.com/gin-gonic/gin"
-	"github.com/gofiber/fiber/v2"
-	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
-	"github.com/labstack/echo/v4"
+	"github.com/jculley01/observability-module/protocol"
+	"github.com/jculley01/observability-module/transport"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	requestCounts sync.Map
 	errorCounts   sync.Map
+	panicCounts   sync.Map
 )
 
 var (
-	// ... (existing variable declarations)
-	wsConn    *websocket.Conn
-	connMutex sync.Mutex
+	// registry is the client of the registry connection, replaced when the
+	// registry URL or handshake timeout change
+	registry   *transport.Client
+	registryMu sync.Mutex
+	// registryURL, registryHandshakeTimeout, registryClientTLS,
+	// registryClientAuth, registryKeepalive, registryAcknowledged and
+	// registryHTTPFallback are what registry was made for
+	registryURL              string
+	registryHandshakeTimeout time.Duration
+	registryClientTLS        *tls.Config
+	registryClientAuth       RegistryAuthConfig
+	registryKeepalive        keepalive
+	registryAcknowledged     bool
+	registryHTTPFallback     bool
 )
 
+// keepalive is the ping interval and pong timeout of the registry connection.
+type keepalive struct {
+	interval, pongTimeout time.Duration
+}
+
 var (
 	influxDBURL string
-	token       string
 	org         string
 	bucket      string
 	wsSocketURL string
 	measurement string
+
+	handshakeTimeout     time.Duration
+	keepaliveConfig      keepalive
+	acknowledgedDelivery bool
+	httpFallback         bool
 )
 
+// frameworkAdapters holds instrumentation hooks for framework adapters, both the
+// build-tagged ones in this package and those living in their own modules (e.g.
+// instrumentation/beego). Each hook reports
+// whether it recognised and instrumented the router or server it was given.
+var frameworkAdapters []func(routerOrServer interface{}) bool
+
+// RegisterFrameworkAdapter lets an adapter module extend InstrumentEndpoint with
+// support for another framework. It is meant to be called from the adapter's init.
+func RegisterFrameworkAdapter(instrument func(routerOrServer interface{}) bool) {
+	frameworkAdapters = append(frameworkAdapters, instrument)
+}
+
+// routeListers list the routes of the routers of framework adapters; each
+// reports whether it recognised the router it was given.
+var routeListers []func(routerOrServer interface{}) ([]protocol.Route, bool)
+
+// RegisterRouteLister lets an adapter module list the routes registered with
+// its framework's router, for Routes. It is meant to be called from the
+// adapter's init.
+func RegisterRouteLister(list func(routerOrServer interface{}) ([]protocol.Route, bool)) {
+	routeListers = append(routeListers, list)
+}
+
+// Routes returns the routes registered with a router, through the adapter of
+// its framework, e.g. to compare them with the endpoints found in the source
+// (see parser.Reconcile). Call it once every route is registered.
+func Routes(routerOrServer interface{}) ([]protocol.Route, error) {
+	for _, list := range routeListers {
+		if routes, ok := list(routerOrServer); ok {
+			return routes, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot list the routes of %T", routerOrServer)
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
 	size       int
+	// wroteHeader is set once the response has been started
+	wroteHeader bool
+	// firstByte is when the first byte of the body was written or flushed
+	firstByte time.Time
+	// flushed is set once the handler has flushed, i.e. is streaming
+	flushed bool
+	// onFlush runs after every flush when stream progress is reported
+	onFlush func()
 }
 
-type Metrics struct {
-	InfluxDBURL string                 `json:"influxdb_url"`
-	Token       string                 `json:"token"`
-	Org         string                 `json:"org"`
-	Bucket      string                 `json:"bucket"`
-	Measurement string                 `json:"measurement"`
-	Tags        map[string]string      `json:"tags"`
-	Fields      map[string]interface{} `json:"fields"`
+// Metrics is a point, sent to the registry as JSON; see the protocol package
+// for the wire format. Points are timestamped with the TimestampPrecision of
+// the config; without one, the registry timestamps them when they arrive.
+type Metrics = protocol.Point
+
+// InstrumentEndpoint attaches the metrics middleware like InstrumentWithConfig,
+// with the config's main fields as arguments.
+//
+// Deprecated: use InstrumentWithConfig, or New and Instrumenter.Instrument in
+// github.com/jculley01/observability-module/v2/instrumentation.
+func InstrumentEndpoint(routerOrServer interface{}, centralregWSURL string, serviceName string, influxdburl string, Token string, Org string, Bucket string, opts ...Option) error {
+	return InstrumentWithConfig(routerOrServer, newConfig(centralregWSURL, serviceName, influxdburl, Token, Org, Bucket, opts))
 }
 
-func InstrumentEndpoint(routerOrServer interface{}, centralregWSURL string, serviceName string, influxdburl string, Token string, Org string, Bucket string) error {
-
-	wsSocketURL = centralregWSURL + "/metrics"
-	influxDBURL = influxdburl
-	token = Token
-	org = Org
-	bucket = Bucket
-	measurement = serviceName
+// InstrumentWithConfig validates cfg and attaches the metrics middleware to the
+// given router or server.
+func InstrumentWithConfig(routerOrServer interface{}, cfg Config) error {
+	if err := ApplyConfig(cfg); err != nil {
+		return err
+	}
 
 	switch r := routerOrServer.(type) {
-	case *gin.Engine:
-		r.Use(ginMetricsMiddleware())
-	case *echo.Echo:
-		r.Use(echoMetricsMiddleware)
-	case *mux.Router:
-		r.Use(gorillaMuxMetricsMiddleware)
 	case *http.ServeMux:
 		// Wrap the default ServeMux with the net/http middleware
-		instrumentedHandler := netHttpMetricsMiddleware(r)
+		instrumentedHandler := Middleware(r)
 		http.Handle("/", instrumentedHandler)
-	case *fiber.App:
-		r.Use(fiberMetricsMiddleware)
 	// Add additional cases here for other frameworks...
 	default:
+		// Framework adapters (gin.go, echo.go, ... and adapter modules)
+		// register themselves here
+		for _, instrument := range frameworkAdapters {
+			if instrument(routerOrServer) {
+				return nil
+			}
+		}
 		return fmt.Errorf("unsupported framework or server type: %T", r)
 	}
 
 	return nil
 }
 
-func ginMetricsMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		startTime := time.Now()
-		path := c.Request.URL.Path
-		userAgent := c.Request.UserAgent()
-		ipAddress := c.ClientIP()
-		incrementEndpointRequestCount(path)
-		currentCount := getEndpointRequestCount(path)
-		if len(c.Errors) > 0 {
-			incrementEndpointErrorCount(path)
-		}
-		errorCount := getEndpointErrorCount(path)
-		// Continue processing
-		c.Next()
-
-		latency := time.Since(startTime)
-		statusCode := c.Writer.Status()
-		responseSize := c.Writer.Size()
-
-		tags := map[string]string{
-			"endpoint":   path,
-			"user_agent": userAgent,
-			"ip_address": ipAddress,
-		}
-		fields := map[string]interface{}{
-			"request_size":  c.Request.ContentLength,
-			"status_code":   statusCode,
-			"response_size": responseSize,
-			"latency_ms":    latency.Milliseconds(),
-			"request_count": currentCount,
-			"error_count":   errorCount,
-		}
-
-		metrics := Metrics{
-			InfluxDBURL: influxDBURL,
-			Token:       token,
-			Org:         org,
-			Bucket:      bucket,
-			Measurement: measurement,
-			Tags:        tags,
-			Fields:      fields,
-		}
-
-		// Send metrics
-		if err := sendMetrics(metrics); err != nil {
-			log.Printf("Error sending metrics: %v\n", err)
-		}
-	}
+// Configure sets where metrics are sent without attaching a middleware. It is
+// needed when handlers are wrapped directly (e.g. TwirpMiddleware) instead of
+// going through InstrumentEndpoint.
+//
+// Deprecated: use ApplyConfig, or New in
+// github.com/jculley01/observability-module/v2/instrumentation.
+func Configure(centralregWSURL string, serviceName string, influxdburl string, Token string, Org string, Bucket string, opts ...Option) error {
+	return ApplyConfig(newConfig(centralregWSURL, serviceName, influxdburl, Token, Org, Bucket, opts))
 }
 
-func echoMetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		startTime := time.Now()
-		path := c.Request().URL.Path
-		userAgent := c.Request().UserAgent()
-		ipAddress := c.RealIP()
-		incrementEndpointRequestCount(path)
-		currentCount := getEndpointRequestCount(path)
-		// Continue processing
-		err := next(c)
-		if err != nil {
-			incrementEndpointErrorCount(path)
-		}
-		errorCount := getEndpointErrorCount(path)
-		latency := time.Since(startTime)
-		statusCode := c.Response().Status
-		responseSize := c.Response().Size
-
-		tags := map[string]string{
-			"endpoint":   path,
-			"user_agent": userAgent,
-			"ip_address": ipAddress,
-		}
-		fields := map[string]interface{}{
-			"request_size":  c.Request().ContentLength,
-			"status_code":   statusCode,
-			"response_size": responseSize,
-			"latency_ms":    latency.Milliseconds(),
-			"request_count": currentCount,
-			"error_count":   errorCount,
-		}
-
-		metrics := Metrics{
-			InfluxDBURL: influxDBURL,
-			Token:       token,
-			Org:         org,
-			Bucket:      bucket,
-			Measurement: measurement,
-			Tags:        tags,
-			Fields:      fields,
-		}
-
-		// Send metrics
-		if err := sendMetrics(metrics); err != nil {
-			log.Printf("Error sending metrics: %v\n", err)
-		}
-
+// ApplyConfig validates cfg and makes it the active configuration. Nothing is
+// changed when cfg is invalid or its token or registry TLS files can't be
+// loaded. The exporters that listen or open files are started next: the local
+// store, Prometheus, OTLP, debug capture and the spill buffer, in that order.
+// If one fails, its error is returned with the exporters before it already
+// switched to cfg and the rest of the configuration left as it was.
+func ApplyConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
 		return err
 	}
-}
-
-func gorillaMuxMetricsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		startTime := time.Now()
-		path := r.URL.Path
-		userAgent := r.UserAgent()
-		ipAddress := r.RemoteAddr // You might want to parse out just the IP
-		incrementEndpointRequestCount(path)
-		currentCount := getEndpointRequestCount(path)
-		// Response writer wrapper to capture the status code and size
-		rw := NewResponseWriter(w)
-		next.ServeHTTP(rw, r)
-
-		if rw.StatusCode() >= 400 {
-			incrementEndpointErrorCount(path)
-		}
-		errorCount := getEndpointErrorCount(path)
-		latency := time.Since(startTime)
-		statusCode := rw.StatusCode
-		responseSize := rw.Size
-
-		tags := map[string]string{
-			"endpoint":   path,
-			"user_agent": userAgent,
-			"ip_address": ipAddress,
-		}
-		fields := map[string]interface{}{
-			"request_size":  r.ContentLength,
-			"status_code":   statusCode,
-			"response_size": responseSize,
-			"latency_ms":    latency.Milliseconds(),
-			"request_count": currentCount,
-			"error_count":   errorCount,
-		}
-
-		metrics := Metrics{
-			InfluxDBURL: influxDBURL,
-			Token:       token,
-			Org:         org,
-			Bucket:      bucket,
-			Measurement: measurement,
-			Tags:        tags,
-			Fields:      fields,
-		}
-
-		// Send metrics
-		if err := sendMetrics(metrics); err != nil {
-			log.Printf("Error sending metrics: %v\n", err)
-		}
-
-	})
-}
-
-func netHttpMetricsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		startTime := time.Now()
-		path := r.URL.Path
-		userAgent := r.UserAgent()
-		ipAddress := r.RemoteAddr // You might want to parse out just the IP
-		incrementEndpointRequestCount(path)
-		currentCount := getEndpointRequestCount(path)
-		// Response writer wrapper to capture the status code and size
-		rw := NewResponseWriter(w)
-		next.ServeHTTP(rw, r)
-
-		if rw.StatusCode() >= 400 {
-			incrementEndpointErrorCount(path)
-		}
-
-		latency := time.Since(startTime)
-		statusCode := rw.StatusCode
-		responseSize := rw.Size
-		errorCount := getEndpointErrorCount(path)
-		tags := map[string]string{
-			"endpoint":   path,
-			"user_agent": userAgent,
-			"ip_address": ipAddress,
-		}
-		fields := map[string]interface{}{
-			"request_size":  r.ContentLength,
-			"status_code":   statusCode,
-			"response_size": responseSize,
-			"latency_ms":    latency.Milliseconds(),
-			"request_count": currentCount,
-			"error_count":   errorCount,
-		}
-
-		metrics := Metrics{
-			InfluxDBURL: influxDBURL,
-			Token:       token,
-			Org:         org,
-			Bucket:      bucket,
-			Measurement: measurement,
-			Tags:        tags,
-			Fields:      fields,
-		}
-
-		// Send metrics
-		if err := sendMetrics(metrics); err != nil {
-			log.Printf("Error sending metrics: %v\n", err)
-		}
-	})
-}
-
-func fiberMetricsMiddleware(c *fiber.Ctx) error {
-	startTime := time.Now()
-	path := c.OriginalURL()
-	userAgent := c.Get(fiber.HeaderUserAgent)
-	ipAddress := c.IP()
-	incrementEndpointRequestCount(path)
-	currentCount := getEndpointRequestCount(path)
-	// Continue processing
-	err := c.Next()
+	resolvedToken, err := resolveToken(cfg)
 	if err != nil {
-		incrementEndpointErrorCount(path)
+		return err
 	}
-	errorCount := getEndpointErrorCount(path)
-	latency := time.Since(startTime)
-	statusCode := c.Response().StatusCode()
-	responseSize := len(c.Response().Body()) // Fiber may have a better way to get this
-
-	tags := map[string]string{
-		"endpoint":   path,
-		"user_agent": userAgent,
-		"ip_address": ipAddress,
+	tlsConfig, err := loadRegistryTLS(cfg.RegistryTLS)
+	if err != nil {
+		return err
 	}
-	fields := map[string]interface{}{
-		"request_size":  c.Request().Header.ContentLength(),
-		"status_code":   statusCode,
-		"response_size": responseSize,
-		"latency_ms":    latency.Milliseconds(),
-		"request_count": currentCount,
-		"error_count":   errorCount,
+	if err := startLocalStore(cfg); err != nil {
+		return err
 	}
-
-	metrics := Metrics{
-		InfluxDBURL: influxDBURL,
-		Token:       token,
-		Org:         org,
-		Bucket:      bucket,
-		Measurement: measurement,
-		Tags:        tags,
-		Fields:      fields,
+	if err := startPrometheus(cfg); err != nil {
+		return err
+	}
+	if err := startOTLP(cfg); err != nil {
+		return err
+	}
+	if err := startDebugCapture(cfg); err != nil {
+		return err
+	}
+	if err := startSpill(cfg); err != nil {
+		return err
 	}
 
-	// Send metrics
-	if err := sendMetrics(metrics); err != nil {
-		log.Printf("Error sending metrics: %v\n", err)
+	storeSettings(newSettings(cfg))
+	activeConfig.Store(&cfg)
+	wsSocketURL = ""
+	if cfg.RegistryURL != "" {
+		wsSocketURL = cfg.RegistryURL + "/metrics"
 	}
+	handshakeTimeout = time.Duration(cfg.HandshakeTimeout)
+	keepaliveConfig = keepalive{interval: time.Duration(cfg.KeepaliveInterval), pongTimeout: time.Duration(cfg.PongTimeout)}
+	acknowledgedDelivery = cfg.AcknowledgedDelivery
+	httpFallback = cfg.HTTPFallback
+	storeRegistryTLS(cfg.RegistryTLS, tlsConfig)
+	registryAuth, registrySecrets = cfg.RegistryAuth, cfg.SecretProvider
+	influxDBURL = cfg.InfluxDBURL
+	org = cfg.Org
+	bucket = cfg.Bucket
+	measurement = cfg.ServiceName
+	instanceID = resolveInstanceID(cfg)
+	serviceType = cfg.ServiceType
+	pointCredentials.Store(cfg.PointCredentials)
+	storeWireCodec(cfg.WireFormat)
+	storeSchemaVersion(cfg.SchemaVersion)
+	setToken(resolvedToken)
+	startSecretRefresh(cfg)
+	startAggregation(cfg)
+	startReports(cfg)
+	startClientProfiles(cfg)
+	startScaling(cfg)
+	startPushing(cfg)
+	startOutbox(cfg)
+	startDatadog(cfg)
+	startMQTT(cfg)
+	startGraphite(cfg)
+	startElasticsearch(cfg)
+	startVictoriaMetrics(cfg)
+	startRemoteWrite(cfg)
+	startCircuitBreakers(cfg)
+	startExporters(cfg)
+	startPipelineMetrics(cfg)
+	startBatching(cfg)
+	startSendQueue(cfg)
+	updateSession()
+	stopped.Store(false)
+	return nil
+}
 
-	return err
+func newConfig(centralregWSURL string, serviceName string, influxdburl string, Token string, Org string, Bucket string, opts []Option) Config {
+	cfg := Config{
+		RegistryURL: centralregWSURL,
+		ServiceName: serviceName,
+		InfluxDBURL: influxdburl,
+		Token:       Token,
+		Org:         Org,
+		Bucket:      Bucket,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
 }
 
 func incrementEndpointRequestCount(endpoint string) {
@@ -363,25 +282,95 @@ func getEndpointErrorCount(endpoint string) int64 {
 	return val.(int64)
 }
 
+func incrementEndpointPanicCount(endpoint string) {
+	incrementCounter(&panicCounts, endpoint)
+}
+
+// getEndpointPanicCount retrieves the current panic count for a given endpoint.
+func getEndpointPanicCount(endpoint string) int64 {
+	return loadCounter(&panicCounts, endpoint)
+}
+
+// incrementCounter adds one to the *atomic.Int64 counts holds for key, so
+// requests counted concurrently all count, and returns the new count.
+func incrementCounter(counts *sync.Map, key interface{}) int64 {
+	val, ok := counts.Load(key)
+	if !ok {
+		val, _ = counts.LoadOrStore(key, new(atomic.Int64))
+	}
+	return val.(*atomic.Int64).Add(1)
+}
+
+// loadCounter retrieves the count counts holds for key.
+func loadCounter(counts *sync.Map, key interface{}) int64 {
+	val, _ := counts.Load(key)
+	if val == nil {
+		return 0
+	}
+	return val.(*atomic.Int64).Load()
+}
+
 func NewResponseWriter(w http.ResponseWriter) *responseWriter {
 	// Default the status code to 200 for HTTP, since if WriteHeader is not called explicitly,
 	// the net/http package assumes a "200 OK" response.
-	return &responseWriter{w, http.StatusOK, 0}
+	return &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 }
 
 // WriteHeader captures the status code and calls the underlying WriteHeader method
 func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
+	rw.wroteHeader = true
 	rw.ResponseWriter.WriteHeader(code)
 }
 
 // Write captures the size of the response and calls the underlying Write method
 func (rw *responseWriter) Write(data []byte) (int, error) {
+	if rw.firstByte.IsZero() {
+		rw.firstByte = time.Now()
+	}
 	size, err := rw.ResponseWriter.Write(data)
 	rw.size += size
+	rw.wroteHeader = true
 	return size, err
 }
 
+// Flush sends buffered data to the client, for streaming handlers such as
+// Server-Sent Events.
+func (rw *responseWriter) Flush() {
+	if rw.firstByte.IsZero() {
+		rw.firstByte = time.Now()
+	}
+	rw.wroteHeader = true
+	rw.flushed = true
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	if rw.onFlush != nil {
+		rw.onFlush()
+	}
+}
+
+// streaming reports whether the response is streamed rather than sent at
+// once: the handler flushed it, or it is an event stream.
+func (rw *responseWriter) streaming() bool {
+	return rw.flushed || strings.HasPrefix(rw.Header().Get("Content-Type"), "text/event-stream")
+}
+
+// Hijack lets WebSocket upgrades through the wrapper; the request is then
+// reported with a 101 status.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err == nil {
+		rw.statusCode = http.StatusSwitchingProtocols
+		rw.wroteHeader = true
+	}
+	return conn, buf, err
+}
+
 // StatusCode exposes the captured status code
 func (rw *responseWriter) StatusCode() int {
 	return rw.statusCode
@@ -393,46 +382,130 @@ func (rw *responseWriter) Size() int {
 }
 
 func sendMetrics(metrics Metrics) error {
-	if err := ensureWebSocketConnection(wsSocketURL); err != nil {
-		return err
+	if stopped.Load() {
+		return ErrStopped
 	}
-
-	jsonData, err := json.Marshal(metrics)
-	if err != nil {
+	// Set here so every point, events included, carries them and extractors
+	// can't override them
+	if metrics.Tags == nil {
+		metrics.Tags = map[string]string{}
+	}
+	metrics.Tags[instanceIDTag] = instanceID
+	if serviceType != "" {
+		metrics.Tags[serviceTypeTag] = serviceType
+	}
+	stampPoint(&metrics, time.Now())
+	if err := sanitizePoint(&metrics); err != nil {
+		currentPipeline().recordInvalid(1)
 		return err
 	}
-
-	if err := wsConn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
-		return fmt.Errorf("failed to write message: %v", err)
+	sendToDatadog(metrics)
+	sendToMQTT(metrics)
+	sendToGraphite(metrics)
+	sendToElasticsearch(metrics)
+	sendToVictoriaMetrics(metrics)
+	sendToRemoteWrite(metrics)
+	export(metrics)
+
+	if wsSocketURL == "" {
+		// Metrics are only scraped or exported
+		return nil
+	}
+	if batchPoint(metrics) {
+		return nil
+	}
+	if err := writePoint(metrics); err != nil {
+		if errors.Is(err, errRateLimited) {
+			currentPipeline().recordRateLimited(1)
+			return nil
+		}
+		if spillPoints([]Metrics{metrics}) {
+			return nil
+		}
+		currentPipeline().recordFailed(1)
+		return err
 	}
-
 	return nil
 }
 
-func ensureWebSocketConnection(centralRegisterWSURL string) error {
-	connMutex.Lock()
-	defer connMutex.Unlock()
+// writePoint writes a point to the registry as a frame of its own.
+func writePoint(metrics Metrics) error {
+	return writeFrame([]Metrics{wirePoint(metrics)})
+}
 
-	if wsConn != nil {
-		return nil // Connection is already established
+// sendFrame writes a frame of points to the registry, a binary one if binary
+// is set, unless it is over the rate limit or the circuit breaker is open.
+func sendFrame(points int, data []byte, binary bool) error {
+	if !loadSettings().rateLimiter.allow(points, len(data), time.Now()) {
+		return errRateLimited
 	}
+	return sendGuarded(func() error {
+		p := currentPipeline()
+		var start time.Time
+		if p != nil {
+			start = time.Now()
+		}
+		var err error
+		if binary {
+			err = registryClient().SendBinary(data)
+		} else {
+			err = registryClient().Send(data)
+		}
+		p.recordSend(points, start, err)
+		return err
+	})
+}
 
-	var err error
-	wsConn, _, err = websocket.DefaultDialer.Dial(centralRegisterWSURL, nil)
-	if err != nil {
-		return fmt.Errorf("failed to dial WebSocket: %v", err)
+// registryClient returns the client of the registry at wsSocketURL. A client
+// for another URL, handshake timeout, TLS config or authentication is closed
+// and replaced.
+func registryClient() *transport.Client {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	cfg := transport.Config{
+		URL:               wsSocketURL,
+		HandshakeTimeout:  handshakeTimeout,
+		Token:             registryToken(registryAuth, registrySecrets),
+		TokenQueryParam:   registryAuth.QueryParam,
+		TLSClientConfig:   currentRegistryTLS(),
+		HeartbeatInterval: keepaliveConfig.interval,
+		PongTimeout:       keepaliveConfig.pongTimeout,
+		// Control events from the registry go to OnControlEvent handlers
+		OnMessage: dispatchControlMessage,
+		OnFrame:   captureRegistryFrame,
+		OnConnect: recordConnect,
+		Session:   sessionFrame,
+		OnStale: func(conn transport.ConnInfo) {
+			log.Printf("Registry connection %d stopped answering pings, reconnecting\n", conn.ID)
+		},
+		Acknowledged: acknowledgedDelivery,
+		OnUnackedDropped: func(frames int) {
+			log.Printf("Dropped %d frames the registry didn't acknowledge\n", frames)
+		},
+		HTTPFallback: httpFallback,
+		OnFallback: func(reason error) {
+			log.Printf("WebSocket upgrade to the registry blocked (%v), posting points over HTTP\n", reason)
+		},
 	}
-
-	// Start a goroutine to keep the connection alive
-	go func() {
-		for {
-			if _, _, err := wsConn.NextReader(); err != nil {
-				wsConn.Close()
-				wsConn = nil
-				return
+	if registry != nil && registryURL == cfg.URL && registryHandshakeTimeout == cfg.HandshakeTimeout && registryClientTLS == cfg.TLSClientConfig && registryClientAuth == registryAuth && registryKeepalive == keepaliveConfig && registryAcknowledged == cfg.Acknowledged && registryHTTPFallback == cfg.HTTPFallback {
+		return registry
+	}
+	if old := registry; old != nil {
+		go func() {
+			if err := old.Close(context.Background()); err != nil {
+				log.Printf("Error closing the previous registry connection: %v\n", err)
 			}
-		}
-	}()
+		}()
+	}
+	registry = transport.NewClient(cfg)
+	registryURL, registryHandshakeTimeout, registryClientTLS, registryClientAuth, registryKeepalive, registryAcknowledged, registryHTTPFallback = cfg.URL, cfg.HandshakeTimeout, cfg.TLSClientConfig, registryAuth, keepaliveConfig, cfg.Acknowledged, cfg.HTTPFallback
+	return registry
+}
 
-	return nil
+// currentRegistry returns the registry client, nil before the first point.
+func currentRegistry() *transport.Client {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return registry
 }
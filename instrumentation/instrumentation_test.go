@@ -0,0 +1,139 @@
+package instrumentation
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/jculley01/observability-module/protocol"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// received collects every payload sent to the fake central registry that is
+// shared by all tests in the package, since the WebSocket connection is global.
+var received = make(chan Metrics, 64)
+
+// sessions collects the session frames sent to the fake registry; those sent
+// once it is full are dropped, see drainSessions.
+var sessions = make(chan protocol.Session, 16)
+
+// collectorURL is the fake registry's base URL, for tests that go through
+// InstrumentEndpoint.
+var collectorURL string
+
+func TestMain(m *testing.M) {
+	upgrader := websocket.Upgrader{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var session protocol.Session
+		// seq numbers the point frames of connections with acknowledged
+		// delivery, each acknowledged as it arrives
+		var seq uint64
+		var acknowledged bool
+		for {
+			messageType, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if s, ok := protocol.DecodeSession(data); ok && messageType == websocket.TextMessage {
+				session = s
+				select {
+				case sessions <- session:
+				default:
+				}
+				continue
+			}
+			if sequence, ok := protocol.DecodeSequence(data); ok && messageType == websocket.TextMessage {
+				seq, acknowledged = sequence.Next-1, true
+				continue
+			}
+			codec, ok := session.FrameCodec(messageType == websocket.BinaryMessage)
+			if !ok {
+				continue
+			}
+			if acknowledged {
+				seq++
+				ack, _ := protocol.EncodeControl(protocol.Control{Type: protocol.ControlAck, Sequence: seq})
+				c.WriteMessage(websocket.TextMessage, ack)
+			}
+			points, err := codec.Decode(data)
+			if err != nil {
+				continue
+			}
+			// Points go through JSON, so tests read the same values
+			// whatever the wire format
+			data, _ = protocol.EncodeBatch(points)
+			var batch []Metrics
+			if err := json.Unmarshal(data, &batch); err == nil {
+				for _, metrics := range batch {
+					received <- metrics
+				}
+			}
+		}
+	}))
+
+	collectorURL = "ws" + strings.TrimPrefix(collector.URL, "http")
+	// Most tests expect their points to reach the collector before they
+	// return, in order, so the tests configure the instrumentation without
+	// the send queue.
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	collector.Close()
+	os.Exit(code)
+}
+
+// nextMetrics waits for the next payload to reach the fake registry.
+func nextMetrics(t *testing.T) Metrics {
+	t.Helper()
+	select {
+	case metrics := <-received:
+		return metrics
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metrics received")
+		return Metrics{}
+	}
+}
+
+// drainSessions empties sessions, for a test to read the sessions it causes.
+func drainSessions() {
+	for {
+		select {
+		case <-sessions:
+		default:
+			return
+		}
+	}
+}
+
+func TestMiddlewareReportsStatusAndSize(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/middleware/teapot", nil))
+
+	metrics := nextMetrics(t)
+	if metrics.Tags["endpoint"] != "/middleware/teapot" {
+		t.Errorf("endpoint = %q, want /middleware/teapot", metrics.Tags["endpoint"])
+	}
+	if metrics.Fields["status_code"] != float64(http.StatusTeapot) {
+		t.Errorf("status_code = %v, want %d", metrics.Fields["status_code"], http.StatusTeapot)
+	}
+	if metrics.Fields["response_size"] != float64(len("short and stout")) {
+		t.Errorf("response_size = %v, want %d", metrics.Fields["response_size"], len("short and stout"))
+	}
+	if got := getEndpointErrorCount("/middleware/teapot"); got != 1 {
+		t.Errorf("error count = %d, want 1", got)
+	}
+}
@@ -0,0 +1,107 @@
+// Package instrumentationtest provides a fake central registry for testing
+// services and adapter modules that report through the instrumentation
+// package.
+package instrumentationtest
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/protocol"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Collector is a WebSocket server standing in for the central registry. It
+// records every metrics payload it receives, in any registered codec, with the
+// InfluxDB destination of the connection's session applied and upgraded to
+// protocol.SchemaVersion as the registry would, and acknowledges every frame
+// of connections with acknowledged delivery.
+type Collector struct {
+	// URL is the registry base URL to pass to InstrumentEndpoint or Configure.
+	URL string
+
+	received chan instrumentation.Metrics
+	server   *httptest.Server
+}
+
+// NewCollector starts a Collector; Close it when done.
+func NewCollector() *Collector {
+	c := &Collector{received: make(chan instrumentation.Metrics, 64)}
+	upgrader := websocket.Upgrader{}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var session protocol.Session
+		var seq uint64
+		var acknowledged bool
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			binary := messageType == websocket.BinaryMessage
+			if s, ok := protocol.DecodeSession(data); ok && !binary {
+				session = s
+				continue
+			}
+			if sequence, ok := protocol.DecodeSequence(data); ok && !binary {
+				seq, acknowledged = sequence.Next-1, true
+				continue
+			}
+			codec, ok := session.FrameCodec(binary)
+			if !ok {
+				continue
+			}
+			if acknowledged {
+				seq++
+				ack, _ := protocol.EncodeControl(protocol.Control{Type: protocol.ControlAck, Sequence: seq})
+				if err := conn.WriteMessage(websocket.TextMessage, ack); err != nil {
+					return
+				}
+			}
+			var points []instrumentation.Metrics
+			if codec == protocol.JSON {
+				var metrics instrumentation.Metrics
+				if err := json.Unmarshal(data, &metrics); err != nil {
+					continue
+				}
+				points = []instrumentation.Metrics{metrics}
+			} else if points, err = codec.Decode(data); err != nil {
+				continue
+			}
+			if points, err = protocol.UpgradePoints(points, session.Version()); err != nil {
+				continue
+			}
+			for _, metrics := range points {
+				session.Apply(&metrics)
+				c.received <- metrics
+			}
+		}
+	}))
+	c.URL = "ws" + strings.TrimPrefix(c.server.URL, "http")
+	return c
+}
+
+// Next waits for the next payload, failing the test after five seconds.
+func (c *Collector) Next(t testing.TB) instrumentation.Metrics {
+	t.Helper()
+	select {
+	case metrics := <-c.received:
+		return metrics
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metrics received")
+		return instrumentation.Metrics{}
+	}
+}
+
+// Close shuts the server down.
+func (c *Collector) Close() {
+	c.server.Close()
+}
@@ -0,0 +1,66 @@
+package instrumentation
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+)
+
+// jsonRPCBatch is the operation recorded for JSON-RPC batch requests, which
+// carry several methods in one call.
+const jsonRPCBatch = "batch"
+
+// jsonRPCEndpoint appends the JSON-RPC method to the path when it is acceptable
+// as a tag. Batches are always tagged as such.
+func jsonRPCEndpoint(path, method string) string {
+	if method == jsonRPCBatch {
+		return path + "#" + jsonRPCBatch
+	}
+	return operationEndpoint(path, method, loadSettings().jsonRPCMethods)
+}
+
+// isJSONContentType reports whether a request may carry a JSON-RPC body.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "application/json-rpc"
+}
+
+// jsonRPCMethod returns the top-level "method" member of a JSON-RPC request, or
+// jsonRPCBatch for a batch. The body is walked token by token so a method that
+// precedes a large or truncated "params" is still found.
+func jsonRPCMethod(data []byte) string {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	tok, err := decoder.Token()
+	if err != nil {
+		return ""
+	}
+	if tok == json.Delim('[') {
+		return jsonRPCBatch
+	}
+	if tok != json.Delim('{') {
+		return ""
+	}
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if key == "method" {
+			value, err := decoder.Token()
+			if err != nil {
+				return ""
+			}
+			method, _ := value.(string)
+			return method
+		}
+		var skipped json.RawMessage
+		if err := decoder.Decode(&skipped); err != nil {
+			return ""
+		}
+	}
+	return ""
+}
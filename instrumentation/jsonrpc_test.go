@@ -0,0 +1,61 @@
+package instrumentation
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONRPCMethod(t *testing.T) {
+	cases := []struct {
+		name, body, want string
+	}{
+		{"method first", `{"method":"eth_getBalance","params":[],"id":1}`, "eth_getBalance"},
+		{"method after params", `{"jsonrpc":"2.0","params":{"a":[1,2,{"b":"c"}]},"method":"users.get","id":"x"}`, "users.get"},
+		{"truncated params after method", `{"jsonrpc":"2.0","method":"upload","params":["aaaa`, "upload"},
+		{"truncated before method", `{"jsonrpc":"2.0","params":["aaaa`, ""},
+		{"batch", `[{"method":"a"},{"method":"b"}]`, jsonRPCBatch},
+		{"non-string method", `{"method":42}`, ""},
+		{"no method", `{"result":1}`, ""},
+		{"not json", `<methodCall/>`, ""},
+	}
+	for _, tc := range cases {
+		if got := jsonRPCMethod([]byte(tc.body)); got != tc.want {
+			t.Errorf("%s: jsonRPCMethod = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLogicalEndpointJSONRPC(t *testing.T) {
+	defer applyOptions(nil)
+
+	cases := []struct {
+		name        string
+		opts        []Option
+		contentType string
+		body        string
+		want        string
+	}{
+		{"disabled", nil, "application/json", `{"method":"ping"}`, "/rpc"},
+		{"enabled", []Option{WithJSONRPCMethodExtraction()}, "application/json; charset=utf-8", `{"method":"ping"}`, "/rpc#ping"},
+		{"batch", []Option{WithJSONRPCMethodExtraction("ping")}, "application/json", `[{"method":"ping"}]`, "/rpc#batch"},
+		{"xml not peeked", []Option{WithJSONRPCMethodExtraction()}, "text/xml", `{"method":"ping"}`, "/rpc"},
+		{"invalid method", []Option{WithJSONRPCMethodExtraction()}, "application/json", `{"method":"a b\n"}`, "/rpc"},
+		{"not allowlisted", []Option{WithJSONRPCMethodExtraction("ping")}, "application/json", `{"method":"pong"}`, "/rpc"},
+	}
+	for _, tc := range cases {
+		applyOptions(tc.opts)
+		r := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", tc.contentType)
+
+		if got := LogicalEndpoint(r, r.URL.Path); got != tc.want {
+			t.Errorf("%s: LogicalEndpoint = %q, want %q", tc.name, got, tc.want)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil || string(body) != tc.body {
+			t.Errorf("%s: handler body = %q (err %v), want it unchanged", tc.name, body, err)
+		}
+	}
+}
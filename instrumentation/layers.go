@@ -0,0 +1,65 @@
+package instrumentation
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// layerFieldPrefix and layerFieldSuffix make the field of a middleware layer,
+// e.g. middleware_auth_ms.
+const (
+	layerFieldPrefix = "middleware_"
+	layerFieldSuffix = "_ms"
+)
+
+// layerTiming is the time spent in the handlers a layer called, for one
+// request.
+type layerTiming struct {
+	// inner is atomic, for middleware calling the handler on a goroutine
+	// of its own
+	inner atomic.Int64
+}
+
+// layerTimingKey is the context key of the layerTiming of the innermost
+// layer.
+type layerTimingKey struct{}
+
+// Instrument wraps a middleware so the time a request spends in it, not
+// counting the handlers it calls, is added to the request's point as the
+// middleware_<name>_ms field, to attribute latency between the layers of a
+// chain: authentication, rate limiting and so on. A layer used twice adds up.
+// The handlers wrapped must run under Middleware (or an adapter); otherwise
+// the middleware runs untimed.
+//
+//	handler := instrumentation.Middleware(
+//		instrumentation.Instrument("auth", authMiddleware)(
+//			instrumentation.Instrument("rate_limit", rateLimiter)(mux)))
+func Instrument(name string, middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	field := layerFieldPrefix + name + layerFieldSuffix
+	return func(next http.Handler) http.Handler {
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timing, _ := r.Context().Value(layerTimingKey{}).(*layerTiming)
+			if timing == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			start := time.Now()
+			defer func() { timing.inner.Add(int64(time.Since(start))) }()
+			next.ServeHTTP(w, r)
+		})
+		layer := middleware(inner)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := FromContext(r.Context())
+			if rec == nil {
+				layer.ServeHTTP(w, r)
+				return
+			}
+			timing := &layerTiming{}
+			start := time.Now()
+			defer func() { rec.addLayerTime(field, time.Since(start)-time.Duration(timing.inner.Load())) }()
+			layer.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), layerTimingKey{}, timing)))
+		})
+	}
+}
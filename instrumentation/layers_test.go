@@ -0,0 +1,48 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// sleepingMiddleware sleeps for d before calling the next handler.
+func sleepingMiddleware(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(d)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestInstrumentTimesMiddlewareLayers(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(40 * time.Millisecond)
+	})
+	chain := Middleware(
+		Instrument("auth", sleepingMiddleware(20*time.Millisecond))(
+			Instrument("rate_limit", sleepingMiddleware(0))(handler)))
+	chain.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/layers/orders", nil))
+
+	metrics := nextMetrics(t)
+	auth, ok := metrics.Fields["middleware_auth_ms"].(float64)
+	if !ok || auth < 20 || auth >= 40 {
+		t.Errorf("middleware_auth_ms = %v, want the 20ms of the layer without the handler", metrics.Fields["middleware_auth_ms"])
+	}
+	if rateLimit, ok := metrics.Fields["middleware_rate_limit_ms"].(float64); !ok || rateLimit >= 20 {
+		t.Errorf("middleware_rate_limit_ms = %v, want the time of the layer alone", metrics.Fields["middleware_rate_limit_ms"])
+	}
+}
+
+func TestInstrumentOutsideMiddleware(t *testing.T) {
+	called := false
+	handler := Instrument("auth", sleepingMiddleware(0))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !called {
+		t.Error("handler not called")
+	}
+}
@@ -0,0 +1,106 @@
+package instrumentation
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// leaseReleaseTimeout bounds releasing the lease once RunAsLeader is done.
+const leaseReleaseTimeout = 5 * time.Second
+
+// LeaseStore holds the leases RunAsLeader campaigns for. Implement it on a
+// store all replicas share: etcd (a key attached to a lease, created in a
+// transaction comparing its create revision to 0), Redis (SET NX PX), or a SQL
+// row with an expiry.
+type LeaseStore interface {
+	// Acquire takes the lease on key for holder, or renews it if holder
+	// already has it, for ttl. It reports whether holder holds it now.
+	Acquire(ctx context.Context, key, holder string, ttl time.Duration) (bool, error)
+	// Release gives the lease on key up if holder holds it.
+	Release(ctx context.Context, key, holder string) error
+}
+
+// RunAsLeader runs fn on a single replica of the fleet: the one holding the
+// lease on key, identified by its InstanceID. Use it for work whose metrics
+// should be emitted once per fleet, such as synthetic checks or dependency
+// probes. fn's context is cancelled when the lease is lost; RunAsLeader keeps
+// campaigning and runs fn again whenever it wins the lease back. It returns
+// once ctx is done and fn has returned, after releasing the lease.
+// leader_elected and leader_lost events are reported as leadership changes.
+func RunAsLeader(ctx context.Context, store LeaseStore, key string, ttl time.Duration, fn func(ctx context.Context)) error {
+	if ttl <= 0 {
+		return fmt.Errorf("lease ttl must be positive, got %v", ttl)
+	}
+	holder := InstanceID()
+	renewEvery := ttl / 3
+	ticker := time.NewTicker(renewEvery)
+	defer ticker.Stop()
+
+	// current is the running fn while this replica leads
+	var current *leadership
+	var lastRenewed time.Time
+	stepDown := func() {
+		current.stop()
+		current = nil
+		sendEvent("leader_lost", map[string]string{"lease": key}, map[string]interface{}{"instance_id": holder})
+	}
+
+	for {
+		acquired, err := store.Acquire(ctx, key, holder, ttl)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("Error acquiring lease %q: %v\n", key, err)
+			// The lease may still be ours; step down before it could expire
+			if current != nil && time.Since(lastRenewed) >= ttl-renewEvery {
+				stepDown()
+			}
+		case err == nil && acquired:
+			lastRenewed = time.Now()
+			if current == nil {
+				current = lead(ctx, fn)
+				sendEvent("leader_elected", map[string]string{"lease": key}, map[string]interface{}{"instance_id": holder})
+			}
+		case err == nil && current != nil:
+			stepDown()
+		}
+
+		select {
+		case <-ctx.Done():
+			if current == nil {
+				return nil
+			}
+			current.stop()
+			releaseCtx, cancel := context.WithTimeout(context.Background(), leaseReleaseTimeout)
+			defer cancel()
+			if err := store.Release(releaseCtx, key, holder); err != nil {
+				return fmt.Errorf("error releasing lease %q: %w", key, err)
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// leadership is fn running on the replica holding a lease.
+type leadership struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func lead(ctx context.Context, fn func(ctx context.Context)) *leadership {
+	leadCtx, cancel := context.WithCancel(ctx)
+	l := &leadership{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		fn(leadCtx)
+	}()
+	return l
+}
+
+// stop cancels fn and waits for it to return.
+func (l *leadership) stop() {
+	l.cancel()
+	<-l.done
+}
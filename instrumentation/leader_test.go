@@ -0,0 +1,98 @@
+package instrumentation
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryLeaseStore is a LeaseStore for a single process; the holder can be
+// changed under RunAsLeader to simulate other replicas.
+type memoryLeaseStore struct {
+	mu       sync.Mutex
+	holder   string
+	released bool
+}
+
+func (s *memoryLeaseStore) Acquire(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.holder == "" {
+		s.holder = holder
+	}
+	return s.holder == holder, nil
+}
+
+func (s *memoryLeaseStore) Release(ctx context.Context, key, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.holder == holder {
+		s.holder = ""
+		s.released = true
+	}
+	return nil
+}
+
+func (s *memoryLeaseStore) setHolder(holder string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holder = holder
+}
+
+func TestRunAsLeader(t *testing.T) {
+	store := &memoryLeaseStore{holder: "other-replica"}
+	started := make(chan struct{}, 4)
+	stoppedLeading := make(chan struct{}, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- RunAsLeader(ctx, store, "synthetic-checks", 30*time.Millisecond, func(ctx context.Context) {
+			started <- struct{}{}
+			<-ctx.Done()
+			stoppedLeading <- struct{}{}
+		})
+	}()
+
+	wait := func(ch chan struct{}, what string) {
+		t.Helper()
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+	expectEvent := func(event string) {
+		t.Helper()
+		if got := nextMetrics(t).Tags["event"]; got != event {
+			t.Fatalf("event = %q, want %s", got, event)
+		}
+	}
+
+	select {
+	case <-started:
+		t.Fatal("fn ran while another replica held the lease")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	store.setHolder("")
+	wait(started, "fn to start")
+	expectEvent("leader_elected")
+
+	store.setHolder("other-replica")
+	wait(stoppedLeading, "fn to stop after losing the lease")
+	expectEvent("leader_lost")
+
+	store.setHolder("")
+	wait(started, "fn to start again")
+	expectEvent("leader_elected")
+
+	cancel()
+	if err := <-result; err != nil {
+		t.Errorf("RunAsLeader() = %v", err)
+	}
+	wait(stoppedLeading, "fn to stop on cancel")
+	if !store.released {
+		t.Error("lease not released")
+	}
+}
@@ -0,0 +1,171 @@
+package instrumentation
+
+import (
+	"net/http"
+	"time"
+)
+
+// Middleware instruments any http.Handler and is the primitive every adapter
+// builds on: any router that accepts standard middleware can use it directly,
+// without a case in InstrumentWithConfig. Points are tagged with the raw path
+// unless the router reports the matched route template through SetRoute.
+// Handler panics are reported and then re-panicked, or answered with a 500
+// under WithPanicRecovery.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsIgnoredPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		done := TrackInFlight()
+		startTime := time.Now()
+		// The SOAP/JSON-RPC operation (e.g. "#eth_getBalance") has to be read
+		// before the handler consumes the body, but the route is only known
+		// once the router has run, so it is appended afterwards.
+		operation := LogicalEndpoint(r, "")
+		rec := NewRequestRecord(r.Header.Get(RequestIDHeader))
+		rec.StartTime = startTime
+		r = r.WithContext(contextWithRecord(r.Context(), rec))
+		// Response writer wrapper to capture the status code and size
+		rw := NewResponseWriter(w)
+		if interval := loadSettings().streamProgressInterval; interval > 0 {
+			progress := &streamProgress{rw: rw, interval: interval, start: startTime, last: startTime}
+			progress.endpoint = func() string {
+				if rec.route != "" {
+					return rec.route + operation
+				}
+				return r.URL.Path + operation
+			}
+			rw.onFlush = progress.flushed
+		}
+		// The route is set by the handler's goroutine, so the watchdog reports
+		// the normalized path
+		stopWatchdog := watchRequest(func() string { return endpointTag(r.URL.Path + operation) }, rec)
+		defer func() {
+			done()
+			stopWatchdog()
+			panicValue := recover()
+			if panicValue == http.ErrAbortHandler {
+				// Handlers abort this way on purpose; leave it to the server
+				panic(panicValue)
+			}
+			recovered := panicValue != nil && RecoverPanics()
+			if recovered {
+				writePanicResponse(rw)
+			}
+
+			// Requests that matched no route fall back to the raw path
+			route := rec.route
+			if route == "" {
+				route = r.URL.Path
+			}
+			ipAddress := rec.clientIP
+			if ipAddress == "" {
+				ipAddress = r.RemoteAddr // You might want to parse out just the IP
+			}
+			statusCode, responseSize := rw.StatusCode(), rw.Size()
+			if rec.responseSet {
+				statusCode, responseSize = rec.statusCode, rec.responseSize
+			}
+			failed := statusCode >= 400
+			if rec.failed != nil {
+				failed = *rec.failed
+			}
+			var ttfb time.Duration
+			if !rw.firstByte.IsZero() {
+				ttfb = rw.firstByte.Sub(startTime)
+			}
+			Report(Observation{
+				Endpoint:        route + operation,
+				UserAgent:       r.UserAgent(),
+				IPAddress:       ipAddress,
+				RequestSize:     r.ContentLength,
+				StatusCode:      statusCode,
+				ResponseSize:    responseSize,
+				Latency:         time.Since(startTime),
+				Failed:          failed,
+				Err:             rec.err,
+				TimeToFirstByte: ttfb,
+				Streaming:       rw.streaming(),
+				Request:         r,
+				ResponseHeader:  rw.Header(),
+				Context:         rec.frameworkContext,
+				Record:          rec,
+				Panic:           panicValue,
+			})
+
+			if panicValue != nil && !recovered {
+				panic(panicValue)
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// WrapHandlerFunc is Middleware for a single handler function, for routers
+// that register plain functions.
+func WrapHandlerFunc(next http.HandlerFunc) http.HandlerFunc {
+	return Middleware(next).ServeHTTP
+}
+
+// recordOf returns the RequestRecord of r, or nil when r isn't being served
+// through Middleware.
+func recordOf(r *http.Request) *RequestRecord {
+	return FromContext(r.Context())
+}
+
+// SetRoute records the route template r matched (e.g. "/users/{id}"), so the
+// enclosing Middleware tags the point with it instead of the raw path. Routers
+// call it from their own middleware once routing is done; it does nothing
+// outside Middleware.
+func SetRoute(r *http.Request, route string) {
+	if rec := recordOf(r); rec != nil {
+		rec.route = route
+	}
+}
+
+// SetClientIP overrides the remote address reported as ip_address, e.g. with
+// one resolved from X-Forwarded-For by the framework.
+func SetClientIP(r *http.Request, ip string) {
+	if rec := recordOf(r); rec != nil {
+		rec.clientIP = ip
+	}
+}
+
+// SetFailed decides whether r counts in error_count, overriding the default of
+// failing on status codes from 400 up. Adapters use it for frameworks that
+// signal errors differently (gin's c.Errors, errors returned by echo handlers).
+func SetFailed(r *http.Request, failed bool) {
+	if rec := recordOf(r); rec != nil {
+		rec.failed = &failed
+	}
+}
+
+// SetError records the error the handler returned, for frameworks whose
+// handlers return one: r fails when err isn't nil, as with SetFailed, and err
+// refines its error_class (e.g. a context.DeadlineExceeded is a timeout).
+func SetError(r *http.Request, err error) {
+	if rec := recordOf(r); rec != nil {
+		failed := err != nil
+		rec.failed = &failed
+		rec.err = err
+	}
+}
+
+// SetResponse overrides the status code and size captured from the
+// ResponseWriter, for frameworks whose handlers write through their own
+// writer rather than the one Middleware passed down.
+func SetResponse(r *http.Request, statusCode, size int) {
+	if rec := recordOf(r); rec != nil {
+		rec.responseSet = true
+		rec.statusCode, rec.responseSize = statusCode, size
+	}
+}
+
+// SetFrameworkContext hands the framework's own request context (*gin.Context,
+// echo.Context, ...) to the ContextTagExtractors and ContextFieldExtractors.
+func SetFrameworkContext(r *http.Request, ctx interface{}) {
+	if rec := recordOf(r); rec != nil {
+		rec.frameworkContext = ctx
+	}
+}
@@ -0,0 +1,64 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// routeMiddleware stands in for a router that reports its matched template
+// from its own middleware, the way the gorilla/mux adapter does.
+func routeMiddleware(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetRoute(r, route)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestMiddlewareUsesReportedRoute(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{WithJSONRPCMethodExtraction()})
+
+	handler := Middleware(routeMiddleware("/generic/rpc/{version}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	req := httptest.NewRequest(http.MethodPost, "/generic/rpc/v1", strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getBalance","id":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := nextMetrics(t).Tags["endpoint"]; got != "/generic/rpc/{version}#eth_getBalance" {
+		t.Errorf("endpoint = %q, want /generic/rpc/{version}#eth_getBalance", got)
+	}
+}
+
+func TestWrapHandlerFuncOverrides(t *testing.T) {
+	handler := WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetClientIP(r, "203.0.113.7")
+		SetFailed(r, true)
+		SetResponse(r, http.StatusAccepted, 42)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/generic/wrapped", nil))
+
+	metrics := nextMetrics(t)
+	if metrics.Tags["endpoint"] != "/generic/wrapped" {
+		t.Errorf("endpoint = %q, want the raw path without a reported route", metrics.Tags["endpoint"])
+	}
+	if metrics.Tags["ip_address"] != "203.0.113.7" {
+		t.Errorf("ip_address = %q, want 203.0.113.7", metrics.Tags["ip_address"])
+	}
+	if metrics.Fields["status_code"] != float64(http.StatusAccepted) || metrics.Fields["response_size"] != float64(42) {
+		t.Errorf("status_code, response_size = %v, %v, want 202, 42", metrics.Fields["status_code"], metrics.Fields["response_size"])
+	}
+	if got := getEndpointErrorCount("/generic/wrapped"); got != 1 {
+		t.Errorf("error count = %d, want 1", got)
+	}
+}
+
+func TestSettersOutsideMiddleware(t *testing.T) {
+	// Handlers may run without Middleware, e.g. in their own unit tests
+	r := httptest.NewRequest(http.MethodGet, "/generic/bare", nil)
+	SetRoute(r, "/generic/{name}")
+	SetClientIP(r, "203.0.113.7")
+	SetFailed(r, true)
+	SetResponse(r, http.StatusOK, 0)
+	SetFrameworkContext(r, struct{}{})
+}
@@ -0,0 +1,473 @@
+package instrumentation
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMQTTTopic     = "metrics/{service}/{endpoint}"
+	defaultMQTTKeepAlive = 60 * time.Second
+	defaultMQTTQueueSize = 1000
+	mqttTimeout          = 10 * time.Second
+)
+
+// MQTT control packet types, shifted into the fixed header.
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPuback     = 4 << 4
+	mqttPubrec     = 5 << 4
+	mqttPubrel     = 6<<4 | 0x02
+	mqttPubcomp    = 7 << 4
+	mqttPingreq    = 12 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// mqttPlaceholder matches the placeholders of a topic template.
+var mqttPlaceholder = regexp.MustCompile(`\{([a-z0-9_]+)\}`)
+
+// MQTTConfig publishes every point to an MQTT broker, next to the registry or
+// instead of it when RegistryURL is empty, e.g. from edge gateways where MQTT
+// is the only egress. Points are published as JSON, without the token, with
+// QoS 0, 1 or 2 to the topic rendered from Topic ("metrics/{service}/{endpoint}"
+// if empty): {service} is the service name and any other {name} the value of
+// the point's tag, "_" when it has none.
+type MQTTConfig struct {
+	// BrokerURL is e.g. "tcp://broker:1883", or "ssl://broker:8883" for TLS
+	// (tls:// and mqtts:// too).
+	BrokerURL string `json:"broker_url"`
+	// ClientID defaults to the service's instance_id.
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	QoS      int    `json:"qos"`
+	Topic    string `json:"topic"`
+	// KeepAlive is how long the connection can stay idle before the broker
+	// drops it, 60s if zero; the exporter pings it meanwhile.
+	KeepAlive Duration `json:"keep_alive"`
+	// QueueSize bounds the points waiting to be published, 1000 if zero;
+	// points beyond it are dropped.
+	QueueSize int `json:"queue_size"`
+	// Retry retries the points that couldn't be published, connecting again
+	// first; the points queued meanwhile wait.
+	Retry RetryPolicy `json:"retry"`
+}
+
+// mqttMessage is a point ready to be published.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// mqttExporter publishes the points sent on a connection of its own.
+type mqttExporter struct {
+	config MQTTConfig
+	topic  string
+	queue  chan mqttMessage
+	done   chan struct{}
+	// stopped is closed once the queue is drained and the connection closed
+	stopped chan struct{}
+
+	mu      sync.Mutex
+	dropped int64
+}
+
+var (
+	mqttMu sync.Mutex
+	mqtt   *mqttExporter
+)
+
+// startMQTT replaces the exporter of any previously applied config, keeping it
+// when its config is unchanged. A replaced exporter publishes its queued
+// points in the background.
+func startMQTT(cfg Config) {
+	mqttMu.Lock()
+	defer mqttMu.Unlock()
+	if mqtt != nil && reflect.DeepEqual(mqtt.config, cfg.MQTT) {
+		return
+	}
+	if mqtt != nil {
+		close(mqtt.done)
+		mqtt = nil
+	}
+	if cfg.MQTT.BrokerURL == "" {
+		return
+	}
+	e := &mqttExporter{
+		config:  cfg.MQTT,
+		topic:   cfg.MQTT.Topic,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if e.topic == "" {
+		e.topic = defaultMQTTTopic
+	}
+	queueSize := cfg.MQTT.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultMQTTQueueSize
+	}
+	e.queue = make(chan mqttMessage, queueSize)
+	mqtt = e
+	go e.run()
+}
+
+// stopMQTT publishes the queued points and disconnects, until ctx is done.
+func stopMQTT(ctx context.Context) error {
+	mqttMu.Lock()
+	e := mqtt
+	mqtt = nil
+	mqttMu.Unlock()
+	if e == nil {
+		return nil
+	}
+	close(e.done)
+	select {
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error publishing metrics over MQTT: %w", ctx.Err())
+	}
+}
+
+// sendToMQTT queues a point when MQTT is configured.
+func sendToMQTT(metrics Metrics) {
+	mqttMu.Lock()
+	e := mqtt
+	mqttMu.Unlock()
+	if e == nil {
+		return
+	}
+	metrics.Token = ""
+	payload, err := json.Marshal(metrics)
+	if err != nil {
+		log.Printf("Error encoding metrics for MQTT: %v\n", err)
+		return
+	}
+	select {
+	case e.queue <- mqttMessage{topic: mqttTopic(e.topic, metrics), payload: payload}:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+}
+
+// mqttTopic renders a topic template for a point. Tag values can't add
+// wildcards, nor empty levels at either end.
+func mqttTopic(template string, metrics Metrics) string {
+	return mqttPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value := metrics.Tags[name]
+		if name == "service" {
+			value = metrics.Measurement
+		}
+		value = strings.Trim(strings.NewReplacer("+", "_", "#", "_").Replace(value), "/")
+		if value == "" {
+			return "_"
+		}
+		return value
+	})
+}
+
+func (e *mqttExporter) run() {
+	defer close(e.stopped)
+	keepAlive := time.Duration(e.config.KeepAlive)
+	if keepAlive == 0 {
+		keepAlive = defaultMQTTKeepAlive
+	}
+	ticker := time.NewTicker(keepAlive / 2)
+	defer ticker.Stop()
+	var client *mqttClient
+	defer func() {
+		if client != nil {
+			client.disconnect()
+		}
+	}()
+	publish := func(message mqttMessage) {
+		err := retry(context.Background(), e.config.Retry, func() error {
+			if client == nil {
+				c, err := dialMQTT(e.config, keepAlive)
+				if err != nil {
+					return fmt.Errorf("error connecting to the broker: %w", err)
+				}
+				client = c
+			}
+			if err := client.publish(message.topic, message.payload, byte(e.config.QoS)); err != nil {
+				client.close()
+				client = nil
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error publishing metrics over MQTT: %v\n", err)
+		}
+	}
+
+	for {
+		select {
+		case <-e.done:
+			for {
+				select {
+				case message := <-e.queue:
+					publish(message)
+				default:
+					return
+				}
+			}
+		case message := <-e.queue:
+			publish(message)
+		case <-ticker.C:
+			e.mu.Lock()
+			dropped := e.dropped
+			e.dropped = 0
+			e.mu.Unlock()
+			if dropped > 0 {
+				log.Printf("Dropped %d points while the MQTT broker was slow\n", dropped)
+			}
+			if client != nil {
+				if err := client.ping(); err != nil {
+					log.Printf("Error pinging the MQTT broker: %v\n", err)
+					client.close()
+					client = nil
+				}
+			}
+		}
+	}
+}
+
+// mqttClient is an MQTT 3.1.1 connection that only publishes, waiting for
+// the acknowledgements of each message in turn.
+type mqttClient struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	packetID uint16
+}
+
+// dialMQTT connects to the broker of cfg.
+func dialMQTT(cfg MQTTConfig, keepAlive time.Duration) (*mqttClient, error) {
+	u, err := url.Parse(cfg.BrokerURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts":
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		conn, err = dialer.Dial("tcp", u.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = instanceID
+	}
+	// Protocol name and level 4 (3.1.1), then a clean session
+	body := appendMQTTString(nil, "MQTT")
+	flags := byte(0x02)
+	if cfg.Username != "" {
+		flags |= 0x80
+	}
+	if cfg.Password != "" {
+		flags |= 0x40
+	}
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(keepAlive/time.Second))
+	body = appendMQTTString(body, clientID)
+	if cfg.Username != "" {
+		body = appendMQTTString(body, cfg.Username)
+	}
+	if cfg.Password != "" {
+		body = appendMQTTString(body, cfg.Password)
+	}
+	if err := c.write(mqttConnect, body); err != nil {
+		c.close()
+		return nil, err
+	}
+	ack, err := c.expect(mqttConnack)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	if len(ack) != 2 || ack[1] != 0 {
+		c.close()
+		return nil, fmt.Errorf("the MQTT broker refused the connection: %s", mqttConnackReason(ack))
+	}
+	return c, nil
+}
+
+func mqttConnackReason(ack []byte) string {
+	if len(ack) != 2 {
+		return "malformed CONNACK"
+	}
+	switch ack[1] {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	}
+	return fmt.Sprintf("return code %d", ack[1])
+}
+
+// publish sends a message with qos, and waits for its acknowledgements.
+func (c *mqttClient) publish(topic string, payload []byte, qos byte) error {
+	body := appendMQTTString(nil, topic)
+	var id uint16
+	if qos > 0 {
+		c.packetID++
+		if c.packetID == 0 {
+			c.packetID = 1
+		}
+		id = c.packetID
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	body = append(body, payload...)
+	if err := c.write(mqttPublish|qos<<1, body); err != nil {
+		return err
+	}
+	switch qos {
+	case 1:
+		return c.expectID(mqttPuback, id)
+	case 2:
+		if err := c.expectID(mqttPubrec, id); err != nil {
+			return err
+		}
+		if err := c.write(mqttPubrel, binary.BigEndian.AppendUint16(nil, id)); err != nil {
+			return err
+		}
+		return c.expectID(mqttPubcomp, id)
+	}
+	return nil
+}
+
+// ping keeps an idle connection open. The PINGRESP is skipped over by the next
+// read.
+func (c *mqttClient) ping() error {
+	return c.write(mqttPingreq, nil)
+}
+
+func (c *mqttClient) disconnect() {
+	if err := c.write(mqttDisconnect, nil); err != nil {
+		log.Printf("Error disconnecting from the MQTT broker: %v\n", err)
+	}
+	c.close()
+}
+
+func (c *mqttClient) close() {
+	c.conn.Close()
+}
+
+// write sends a control packet.
+func (c *mqttClient) write(header byte, body []byte) error {
+	packet := appendMQTTLength([]byte{header}, len(body))
+	packet = append(packet, body...)
+	if err := c.conn.SetWriteDeadline(time.Now().Add(mqttTimeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// expect reads packets until one of type packetType, returning its body.
+func (c *mqttClient) expect(packetType byte) ([]byte, error) {
+	if err := c.conn.SetReadDeadline(time.Now().Add(mqttTimeout)); err != nil {
+		return nil, err
+	}
+	for {
+		header, body, err := readMQTTPacket(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if header&0xF0 == packetType&0xF0 {
+			return body, nil
+		}
+	}
+}
+
+// expectID reads the acknowledgement of type packetType of packet id.
+func (c *mqttClient) expectID(packetType byte, id uint16) error {
+	body, err := c.expect(packetType)
+	if err != nil {
+		return err
+	}
+	if len(body) < 2 || binary.BigEndian.Uint16(body) != id {
+		return errors.New("the MQTT broker acknowledged another packet")
+	}
+	return nil
+}
+
+// readMQTTPacket reads a control packet, returning its fixed header byte and
+// its body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed MQTT packet length")
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// appendMQTTLength appends a remaining length, 7 bits per byte.
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,157 @@
+package instrumentation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// publishedMessage is a PUBLISH received by fakeMQTTBroker.
+type publishedMessage struct {
+	qos     byte
+	topic   string
+	payload []byte
+}
+
+// fakeMQTTBroker accepts MQTT connections, acknowledging connections and
+// publishes, and records the CONNECT bodies and the messages published.
+func fakeMQTTBroker(t *testing.T) (string, chan []byte, chan publishedMessage) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	connects := make(chan []byte, 10)
+	published := make(chan publishedMessage, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				reply := func(header byte, body []byte) {
+					conn.Write(append(appendMQTTLength([]byte{header}, len(body)), body...))
+				}
+				for {
+					header, body, err := readMQTTPacket(reader)
+					if err != nil {
+						return
+					}
+					switch header & 0xF0 {
+					case mqttConnect:
+						connects <- body
+						reply(mqttConnack, []byte{0, 0})
+					case mqttPublish:
+						qos := header >> 1 & 0x03
+						topicLength := int(binary.BigEndian.Uint16(body))
+						message := publishedMessage{qos: qos, topic: string(body[2 : 2+topicLength])}
+						rest := body[2+topicLength:]
+						if qos > 0 {
+							id := rest[:2]
+							rest = rest[2:]
+							if qos == 1 {
+								reply(mqttPuback, id)
+							} else {
+								reply(mqttPubrec, id)
+							}
+						}
+						message.payload = rest
+						published <- message
+					case mqttPubrel & 0xF0:
+						reply(mqttPubcomp, body)
+					}
+				}
+			}()
+		}
+	}()
+	return "tcp://" + listener.Addr().String(), connects, published
+}
+
+func TestMQTTPublishesPoints(t *testing.T) {
+	for _, qos := range []int{0, 1, 2} {
+		brokerURL, connects, published := fakeMQTTBroker(t)
+		if err := Configure(collectorURL, "test-service", "", "secret-token", "", "",
+			WithMQTT(MQTTConfig{BrokerURL: brokerURL, ClientID: "gateway-7", Username: "edge", Password: "pw", QoS: qos}),
+			WithoutSendQueue(),
+		); err != nil {
+			t.Fatal(err)
+		}
+		Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+			ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/mqtt/orders", nil))
+		nextMetrics(t)
+
+		select {
+		case message := <-published:
+			if message.qos != byte(qos) || message.topic != "metrics/test-service/mqtt/orders" {
+				t.Errorf("QoS %d: published with QoS %d to %q", qos, message.qos, message.topic)
+			}
+			var point Metrics
+			if err := json.Unmarshal(message.payload, &point); err != nil {
+				t.Fatal(err)
+			}
+			if point.Token != "" || point.Tags["endpoint"] != "/mqtt/orders" {
+				t.Errorf("QoS %d: published point = %+v", qos, point)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("QoS %d: nothing published", qos)
+		}
+		connect := <-connects
+		for _, want := range []string{"MQTT", "gateway-7", "edge", "pw"} {
+			if !bytes.Contains(connect, []byte(want)) {
+				t.Errorf("CONNECT lacks %q", want)
+			}
+		}
+		if err := stopMQTT(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMQTTShutdownPublishesQueuedPoints(t *testing.T) {
+	brokerURL, _, published := fakeMQTTBroker(t)
+	startMQTT(Config{MQTT: MQTTConfig{BrokerURL: brokerURL, QoS: 1}})
+	for i := 0; i < 3; i++ {
+		sendToMQTT(Metrics{Measurement: "orders", Fields: map[string]interface{}{"i": i}})
+	}
+	if err := stopMQTT(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 3 {
+		t.Errorf("%d points published before stopMQTT returned, want 3", len(published))
+	}
+}
+
+func TestMQTTTopic(t *testing.T) {
+	point := Metrics{Measurement: "orders", Tags: map[string]string{"endpoint": "/orders/{id}", "queue": "a+b#"}}
+	for template, want := range map[string]string{
+		"metrics/{service}/{endpoint}": "metrics/orders/orders/{id}",
+		"edge/{queue}/{missing}":       "edge/a_b_/_",
+	} {
+		if got := mqttTopic(template, point); got != want {
+			t.Errorf("mqttTopic(%q) = %q, want %q", template, got, want)
+		}
+	}
+}
+
+func TestValidateMQTT(t *testing.T) {
+	cfg := Config{ServiceName: "orders", MQTT: MQTTConfig{BrokerURL: "http://broker", QoS: 3}}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 2 {
+		t.Errorf("Validate() = %v, want the broker URL and QoS rejected", validationErr)
+	}
+}
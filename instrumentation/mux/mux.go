@@ -0,0 +1,76 @@
+// Package mux instruments gorilla/mux routers. It lives in its own module so
+// that services not using gorilla/mux never pull it into their dependency
+// graph. Importing it (even blank) lets InstrumentEndpoint accept a
+// *mux.Router.
+package mux
+
+import (
+	gorillamux "github.com/gorilla/mux"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/protocol"
+	"net/http"
+)
+
+func init() {
+	instrumentation.RegisterFrameworkAdapter(func(routerOrServer interface{}) bool {
+		r, ok := routerOrServer.(*gorillamux.Router)
+		if ok {
+			r.Use(Middleware)
+		}
+		return ok
+	})
+	instrumentation.RegisterRouteLister(func(routerOrServer interface{}) ([]protocol.Route, bool) {
+		r, ok := routerOrServer.(*gorillamux.Router)
+		if !ok {
+			return nil, false
+		}
+		return routes(r), true
+	})
+}
+
+// Middleware reports metrics for every request, tagged with the matched route
+// template (e.g. "/users/{id}"). Routers run it after matching, so it only
+// has to hand the template to instrumentation.Middleware.
+func Middleware(next http.Handler) http.Handler {
+	return instrumentation.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := pathTemplate(r); route != "" {
+			instrumentation.SetRoute(r, route)
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// pathTemplate returns the template of the route that matched r.
+func pathTemplate(r *http.Request) string {
+	route := gorillamux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return template
+}
+
+// routes lists the routes of r with a path template, once per method;
+// routes without methods match any.
+func routes(r *gorillamux.Router) []protocol.Route {
+	var routes []protocol.Route
+	r.Walk(func(route *gorillamux.Route, router *gorillamux.Router, ancestors []*gorillamux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			// Subrouters matching on hosts or headers only
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{""}
+		}
+		for _, method := range methods {
+			routes = append(routes, protocol.Route{Method: method, Pattern: template, Handler: route.GetName()})
+		}
+		return nil
+	})
+	return routes
+}
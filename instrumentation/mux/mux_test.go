@@ -0,0 +1,53 @@
+package mux
+
+import (
+	gorillamux "github.com/gorilla/mux"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/instrumentation/instrumentationtest"
+	"github.com/jculley01/observability-module/protocol"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMiddlewareUsesRouteTemplate(t *testing.T) {
+	collector := instrumentationtest.NewCollector()
+	defer collector.Close()
+
+	r := gorillamux.NewRouter()
+	if err := instrumentation.InstrumentEndpoint(r, collector.URL, "test-service", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	r.HandleFunc("/mux/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/mux/users/42", nil))
+	metrics := collector.Next(t)
+	if metrics.Tags["endpoint"] != "/mux/users/{id}" {
+		t.Errorf("endpoint = %q, want /mux/users/{id}", metrics.Tags["endpoint"])
+	}
+	if metrics.Fields["status_code"] != float64(http.StatusNotFound) || metrics.Fields["error_count"] != float64(1) {
+		t.Errorf("fields = %v, want a counted 404", metrics.Fields)
+	}
+}
+
+func TestRoutesListsMethodsAndTemplates(t *testing.T) {
+	r := gorillamux.NewRouter()
+	r.HandleFunc("/mux/users/{id}", func(w http.ResponseWriter, r *http.Request) {}).Methods(http.MethodGet, http.MethodPut)
+	r.HandleFunc("/mux/health", func(w http.ResponseWriter, r *http.Request) {}).Name("health")
+
+	routes, err := instrumentation.Routes(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []protocol.Route{
+		{Method: http.MethodGet, Pattern: "/mux/users/{id}"},
+		{Method: http.MethodPut, Pattern: "/mux/users/{id}"},
+		{Method: "", Pattern: "/mux/health", Handler: "health"},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("Routes = %+v, want %+v", routes, want)
+	}
+}
@@ -0,0 +1,232 @@
+package instrumentation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	prometheusTextContentType = "text/plain; version=0.0.4; charset=utf-8"
+	pushTimeout               = 10 * time.Second
+)
+
+// WriteOpenMetrics writes the counters kept for every inbound endpoint, and
+// the latency histograms under WithLatencyBuckets, in the OpenMetrics text
+// format:
+//
+//	http_requests_total{service, instance_id, endpoint}
+//	http_request_errors_total{service, instance_id, endpoint, error_class}
+//	http_request_panics_total{service, instance_id, endpoint}
+//	http_request_duration_seconds{service, instance_id, endpoint}
+func WriteOpenMetrics(w io.Writer) error {
+	return writeExposition(w, true)
+}
+
+// exposedCounters is a snapshot of the counters of an endpoint.
+type exposedCounters struct {
+	requests int64
+	panics   int64
+	errors   map[string]int64
+}
+
+// exposedEndpoints snapshots the counters of every inbound endpoint, and
+// returns them with the endpoints in order.
+func exposedEndpoints() ([]string, map[string]*exposedCounters) {
+	endpoints := make(map[string]*exposedCounters)
+	counters := func(endpoint string) *exposedCounters {
+		c, ok := endpoints[endpoint]
+		if !ok {
+			c = &exposedCounters{errors: make(map[string]int64)}
+			endpoints[endpoint] = c
+		}
+		return c
+	}
+	inbound := func(endpoint string) bool {
+		return !strings.HasPrefix(endpoint, outboundCounterPrefix)
+	}
+	requestCounts.Range(func(key, value interface{}) bool {
+		if endpoint := key.(string); inbound(endpoint) {
+			counters(endpoint).requests = value.(int64)
+		}
+		return true
+	})
+	panicCounts.Range(func(key, value interface{}) bool {
+		if endpoint := key.(string); inbound(endpoint) {
+			counters(endpoint).panics = value.(*atomic.Int64).Load()
+		}
+		return true
+	})
+	errorClassCounts.Range(func(key, value interface{}) bool {
+		if k := key.(errorClassKey); inbound(k.endpoint) {
+			counters(k.endpoint).errors[k.class] = value.(*atomic.Int64).Load()
+		}
+		return true
+	})
+	names := make([]string, 0, len(endpoints))
+	for endpoint := range endpoints {
+		names = append(names, endpoint)
+	}
+	sort.Strings(names)
+	return names, endpoints
+}
+
+// writeExposition writes the metrics in the OpenMetrics text format, or in the
+// Prometheus text format it extends (which names counter families after their
+// samples and has no "# EOF").
+func writeExposition(w io.Writer, openMetrics bool) error {
+	names, endpoints := exposedEndpoints()
+
+	bw := bufio.NewWriter(w)
+	base := fmt.Sprintf(`service="%s",instance_id="%s"`, escapeLabelValue(measurement), escapeLabelValue(instanceID))
+	labels := func(endpoint string) string {
+		return base + `,endpoint="` + escapeLabelValue(endpoint) + `"`
+	}
+	counterHeader := func(family, help string) {
+		typeName := family
+		if !openMetrics {
+			typeName += "_total"
+		}
+		fmt.Fprintf(bw, "# TYPE %s counter\n# HELP %s %s\n", typeName, typeName, help)
+	}
+
+	counterHeader("http_requests", "Requests served.")
+	for _, endpoint := range names {
+		fmt.Fprintf(bw, "http_requests_total{%s} %d\n", labels(endpoint), endpoints[endpoint].requests)
+	}
+	counterHeader("http_request_errors", "Failed requests, by error class.")
+	for _, endpoint := range names {
+		for _, class := range errorClasses {
+			if count, ok := endpoints[endpoint].errors[class]; ok {
+				fmt.Fprintf(bw, "http_request_errors_total{%s,error_class=\"%s\"} %d\n", labels(endpoint), class, count)
+			}
+		}
+	}
+	counterHeader("http_request_panics", "Requests whose handler panicked.")
+	for _, endpoint := range names {
+		fmt.Fprintf(bw, "http_request_panics_total{%s} %d\n", labels(endpoint), endpoints[endpoint].panics)
+	}
+
+	if h := loadSettings().latencyHistogram; h != nil {
+		histograms := h.snapshot()
+		fmt.Fprint(bw, "# TYPE http_request_duration_seconds histogram\n# HELP http_request_duration_seconds Request latency.\n# UNIT http_request_duration_seconds seconds\n")
+		for _, endpoint := range names {
+			e, ok := histograms[endpoint]
+			if !ok {
+				continue
+			}
+			var cumulative int64
+			for i, count := range e.counts {
+				cumulative += count
+				le := "+Inf"
+				if i < len(h.bounds) {
+					le = strconv.FormatFloat(h.bounds[i]/1000, 'g', -1, 64)
+				}
+				fmt.Fprintf(bw, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels(endpoint), le, cumulative)
+			}
+			fmt.Fprintf(bw, "http_request_duration_seconds_sum{%s} %g\n", labels(endpoint), e.sumMs/1000)
+			fmt.Fprintf(bw, "http_request_duration_seconds_count{%s} %d\n", labels(endpoint), e.count)
+		}
+	}
+	if openMetrics {
+		fmt.Fprint(bw, "# EOF\n")
+	}
+	return bw.Flush()
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// PushToGateway pushes the metrics of WriteOpenMetrics to the Prometheus
+// Pushgateway at gatewayURL, grouped under job and the instance_id of this
+// process, replacing what was pushed for that group before. They are sent in
+// the Prometheus text format, which the Pushgateway parses.
+func PushToGateway(ctx context.Context, gatewayURL, job string) error {
+	var body bytes.Buffer
+	if err := writeExposition(&body, false); err != nil {
+		return err
+	}
+	target := strings.TrimSuffix(gatewayURL, "/") + "/metrics/job/" + url.PathEscape(job) + "/instance/" + url.PathEscape(instanceID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", prometheusTextContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("pushgateway answered %s", resp.Status)
+	}
+	return nil
+}
+
+// gatewayPusher pushes to PushgatewayURL every PushInterval.
+type gatewayPusher struct {
+	url      string
+	job      string
+	interval time.Duration
+	done     chan struct{}
+}
+
+var (
+	pusherMu sync.Mutex
+	pusher   *gatewayPusher
+)
+
+// startPushing replaces the pusher of any previously applied config.
+func startPushing(cfg Config) {
+	pusherMu.Lock()
+	defer pusherMu.Unlock()
+	if pusher != nil {
+		close(pusher.done)
+		pusher = nil
+	}
+	if cfg.PushgatewayURL == "" {
+		return
+	}
+	pusher = &gatewayPusher{url: cfg.PushgatewayURL, job: cfg.PushgatewayJob, interval: time.Duration(cfg.PushInterval), done: make(chan struct{})}
+	if pusher.job == "" {
+		pusher.job = cfg.ServiceName
+	}
+	if pusher.interval > 0 {
+		go pusher.run()
+	}
+}
+
+func currentPusher() *gatewayPusher {
+	pusherMu.Lock()
+	defer pusherMu.Unlock()
+	return pusher
+}
+
+func (p *gatewayPusher) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+			if err := PushToGateway(ctx, p.url, p.job); err != nil {
+				log.Printf("Error pushing metrics to the Pushgateway: %v\n", err)
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package instrumentation
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteOpenMetrics(t *testing.T) {
+	applyOptions([]Option{WithLatencyBuckets(100, 1000)})
+	defer applyOptions(nil)
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/openmetrics/orders", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/openmetrics/orders?fail=1", nil))
+	nextMetrics(t)
+	nextMetrics(t)
+
+	var out bytes.Buffer
+	if err := WriteOpenMetrics(&out); err != nil {
+		t.Fatal(err)
+	}
+	labels := `service="test-service",instance_id="` + InstanceID() + `",endpoint="/openmetrics/orders"`
+	for _, want := range []string{
+		"# TYPE http_requests counter\n",
+		"http_requests_total{" + labels + "} 2\n",
+		"http_request_errors_total{" + labels + `,error_class="client_error"} 1` + "\n",
+		"http_request_panics_total{" + labels + "} 0\n",
+		"http_request_duration_seconds_bucket{" + labels + `,le="0.1"} 2` + "\n",
+		"http_request_duration_seconds_bucket{" + labels + `,le="+Inf"} 2` + "\n",
+		"http_request_duration_seconds_count{" + labels + "} 2\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+	if !strings.HasSuffix(out.String(), "# EOF\n") {
+		t.Error("output doesn't end with # EOF")
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	if got := escapeLabelValue("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("escapeLabelValue() = %s", got)
+	}
+}
+
+func TestPushToGateway(t *testing.T) {
+	type push struct {
+		method, path, contentType, body string
+	}
+	pushes := make(chan push, 4)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushes <- push{r.Method, r.URL.Path, r.Header.Get("Content-Type"), string(body)}
+	}))
+	defer gateway.Close()
+
+	if err := PushToGateway(context.Background(), gateway.URL, "nightly-export"); err != nil {
+		t.Fatal(err)
+	}
+	p := <-pushes
+	if p.method != http.MethodPut || p.path != "/metrics/job/nightly-export/instance/"+InstanceID() {
+		t.Errorf("pushed with %s %s", p.method, p.path)
+	}
+	if p.contentType != prometheusTextContentType || !strings.Contains(p.body, "# TYPE http_requests_total counter\n") || strings.Contains(p.body, "# EOF") {
+		t.Errorf("pushed %s:\n%s", p.contentType, p.body)
+	}
+
+	startPushing(Config{ServiceName: "test-service", PushgatewayURL: gateway.URL, PushInterval: Duration(10 * time.Millisecond)})
+	defer startPushing(Config{})
+	select {
+	case p := <-pushes:
+		if p.path != "/metrics/job/test-service/instance/"+InstanceID() {
+			t.Errorf("periodic push to %s, want the service name as job", p.path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no periodic push")
+	}
+}
@@ -0,0 +1,784 @@
+package instrumentation
+
+import (
+	"github.com/jculley01/observability-module/registration"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Option customises the Config built by InstrumentEndpoint or Configure.
+type Option func(*Config)
+
+// settings is the form of Config read on the request path.
+type settings struct {
+	extractSOAPAction       bool
+	soapOperations          map[string]struct{}
+	extractJSONRPCMethod    bool
+	jsonRPCMethods          map[string]struct{}
+	bodyPeekLimit           int
+	pathNormalizer          func(string) string
+	pathNormalizerSet       bool
+	maxEndpoints            int
+	ignorePaths             map[string]struct{}
+	ignorePattern           *regexp.Regexp
+	samplers                map[string]*sampler
+	rateLimiter             *rateLimiter
+	tagExtractor            func(*http.Request) map[string]string
+	maxTagValues            int
+	maxTagValueLength       int
+	contextTagExtractors    []func(interface{}) map[string]string
+	fieldExtractor          func(*http.Request, ResponseInfo) map[string]interface{}
+	contextFieldExtractors  []func(interface{}) map[string]interface{}
+	headerCaptures          []HeaderCapture
+	errorPredicate          ErrorPredicate
+	endpointErrorPredicates map[string]ErrorPredicate
+	recoverPanics           bool
+	panicStackTrace         bool
+	panicReports            bool
+	panicGoroutineDump      bool
+	latencyHistogram        *latencyHistogram
+	errorReporter           ErrorReporter
+	queueDepth              func() int64
+	streamProgressInterval  time.Duration
+	slowRequestThreshold    time.Duration
+	idempotencyWindow       time.Duration
+	endpointDiscoveryWindow time.Duration
+	consumerLagObjectives   map[string]time.Duration
+	consumerLagHistogram    *latencyHistogram
+	timestampPrecision      string
+}
+
+// currentSettings is swapped atomically so configuration can be reloaded while
+// requests are being served.
+var currentSettings atomic.Pointer[settings]
+
+func loadSettings() *settings {
+	if s := currentSettings.Load(); s != nil {
+		return s
+	}
+	return &settings{}
+}
+
+func storeSettings(s settings) {
+	currentSettings.Store(&s)
+}
+
+func newSettings(cfg Config) settings {
+	s := settings{
+		extractSOAPAction:       cfg.SOAPActionExtraction,
+		soapOperations:          allowlist(cfg.SOAPOperations),
+		extractJSONRPCMethod:    cfg.JSONRPCMethodExtraction,
+		jsonRPCMethods:          allowlist(cfg.JSONRPCMethods),
+		bodyPeekLimit:           cfg.BodyPeekLimit,
+		maxEndpoints:            cfg.MaxEndpoints,
+		ignorePaths:             allowlist(cfg.IgnorePaths),
+		samplers:                samplers(cfg.Sampling),
+		rateLimiter:             newRateLimiter(cfg.RateLimit),
+		tagExtractor:            cfg.TagExtractor,
+		maxTagValues:            cfg.MaxTagValues,
+		maxTagValueLength:       cfg.MaxTagValueLength,
+		contextTagExtractors:    cfg.ContextTagExtractors,
+		fieldExtractor:          cfg.FieldExtractor,
+		contextFieldExtractors:  cfg.ContextFieldExtractors,
+		headerCaptures:          normalizeHeaderCaptures(cfg.CaptureHeaders),
+		errorPredicate:          cfg.ErrorPredicate,
+		endpointErrorPredicates: cfg.EndpointErrorPredicates,
+		recoverPanics:           cfg.RecoverPanics,
+		panicStackTrace:         cfg.PanicStackTrace,
+		panicReports:            cfg.PanicReports,
+		panicGoroutineDump:      cfg.PanicGoroutineDump,
+		latencyHistogram:        latencyHistogramFor(cfg.LatencyBuckets),
+		errorReporter:           cfg.ErrorReporter,
+		queueDepth:              cfg.QueueDepth,
+		streamProgressInterval:  time.Duration(cfg.StreamProgressInterval),
+		slowRequestThreshold:    time.Duration(cfg.SlowRequestThreshold),
+		idempotencyWindow:       time.Duration(cfg.IdempotencyWindow),
+		endpointDiscoveryWindow: time.Duration(cfg.EndpointDiscoveryWindow),
+		consumerLagHistogram:    consumerLagHistogramFor(cfg.ConsumerLagBuckets),
+		timestampPrecision:      cfg.TimestampPrecision,
+	}
+	if len(cfg.ConsumerLagObjectives) > 0 {
+		s.consumerLagObjectives = make(map[string]time.Duration, len(cfg.ConsumerLagObjectives))
+		for queue, objective := range cfg.ConsumerLagObjectives {
+			s.consumerLagObjectives[queue] = time.Duration(objective)
+		}
+	}
+	if cfg.IgnorePattern != "" {
+		// Validate has already made sure the pattern compiles
+		s.ignorePattern, _ = regexp.Compile(cfg.IgnorePattern)
+	}
+	if s.errorReporter == nil && cfg.SentryDSN != "" {
+		// Validate has already made sure the DSN parses
+		s.errorReporter, _ = NewSentryReporter(cfg.SentryDSN)
+	}
+	if cfg.PathNormalizer != nil || cfg.DisablePathNormalization {
+		s.pathNormalizer = cfg.PathNormalizer
+		s.pathNormalizerSet = true
+	}
+	return s
+}
+
+// WithSOAPActionExtraction tags SOAP and XML-RPC requests with their operation
+// (e.g. "/soap#GetUser") instead of the single shared POST path. The operation
+// is taken from the SOAPAction header, or from the XML body of requests with an
+// XML content type.
+//
+// Operation names come from the client, so pass the service's operations to
+// restrict tagging to them; anything else keeps the plain path. Without an
+// allowlist any well-formed name is accepted and the number of endpoint
+// series is bounded only by the cardinality limit.
+func WithSOAPActionExtraction(operations ...string) Option {
+	return func(c *Config) {
+		c.SOAPActionExtraction = true
+		c.SOAPOperations = operations
+	}
+}
+
+// WithJSONRPCMethodExtraction tags JSON-RPC requests (a single POST endpoint
+// with a JSON body) with their method, e.g. "/rpc#eth_getBalance". The body is
+// peeked up to a fixed size and replayed to the handler untouched; batches are
+// tagged "#batch". As with SOAP, pass the known methods to restrict tagging.
+func WithJSONRPCMethodExtraction(methods ...string) Option {
+	return func(c *Config) {
+		c.JSONRPCMethodExtraction = true
+		c.JSONRPCMethods = methods
+	}
+}
+
+// WithBodyPeekLimit changes how many bytes of a request body may be buffered
+// when the body has to be inspected (64 KiB by default).
+func WithBodyPeekLimit(bytes int) Option {
+	return func(c *Config) {
+		c.BodyPeekLimit = bytes
+	}
+}
+
+// WithPathNormalizer replaces the default NormalizePath stage applied to every
+// endpoint tag. Pass nil to report paths as they are.
+func WithPathNormalizer(normalize func(path string) string) Option {
+	return func(c *Config) {
+		c.PathNormalizer = normalize
+		c.DisablePathNormalization = normalize == nil
+	}
+}
+
+// WithMaxEndpoints caps the number of distinct endpoint tag values (1000 by
+// default). Once reached, requests to new endpoints are reported under
+// "endpoint_overflow" so unmatched routes can't explode InfluxDB series.
+func WithMaxEndpoints(n int) Option {
+	return func(c *Config) {
+		c.MaxEndpoints = n
+	}
+}
+
+// WithIgnorePaths stops the given request paths (e.g. "/healthz", "/metrics")
+// from producing metrics. Paths are matched exactly against the request path.
+func WithIgnorePaths(paths []string) Option {
+	return func(c *Config) {
+		c.IgnorePaths = append(c.IgnorePaths, paths...)
+	}
+}
+
+// WithIgnorePattern stops request paths matching pattern (e.g. static assets
+// under `^/static/`) from producing metrics.
+func WithIgnorePattern(pattern *regexp.Regexp) Option {
+	return func(c *Config) {
+		if pattern != nil {
+			c.IgnorePattern = pattern.String()
+		}
+	}
+}
+
+// WithSampling reduces the per-request points sent for an endpoint tag, e.g.
+// WithSampling("/search", SamplingRule{Rate: 0.1}). Use "*" to set the rule for
+// every endpoint without its own. Request and error counts stay exact.
+func WithSampling(endpoint string, rule SamplingRule) Option {
+	return func(c *Config) {
+		if c.Sampling == nil {
+			c.Sampling = make(map[string]SamplingRule)
+		}
+		c.Sampling[endpoint] = rule
+	}
+}
+
+// WithTagExtractor adds the tags returned by extract (e.g. tenant ID, API
+// version or auth subject) to each request's point. It runs after the handler
+// and applies to gin, echo, gorilla/mux, net/http, gRPC-web and Twirp; use the
+// framework-specific variants for fiber and fasthttp, or to read values the
+// framework stores in its own context. Returned keys can't replace built-in
+// tags, and each key is capped at MaxTagValues distinct values, beyond which
+// "tag_overflow" is reported.
+func WithTagExtractor(extract func(r *http.Request) map[string]string) Option {
+	return func(c *Config) {
+		c.TagExtractor = extract
+	}
+}
+
+// WithMaxTagValues caps the distinct values of each custom tag (100 by default).
+func WithMaxTagValues(n int) Option {
+	return func(c *Config) {
+		c.MaxTagValues = n
+	}
+}
+
+// WithMaxTagValueLength truncates tag values to n bytes (256 by default).
+func WithMaxTagValueLength(n int) Option {
+	return func(c *Config) {
+		c.MaxTagValueLength = n
+	}
+}
+
+// WithFieldExtractor adds the fields returned by extract (business metrics
+// such as items_in_cart or cache_hit) to each request's point. It runs after
+// the handler, for the same frameworks as WithTagExtractor. Returned keys can't
+// replace built-in fields; values must be numbers, booleans or strings.
+func WithFieldExtractor(extract func(r *http.Request, resp ResponseInfo) map[string]interface{}) Option {
+	return func(c *Config) {
+		c.FieldExtractor = extract
+	}
+}
+
+// WithErrorPredicate decides which requests count as errors, for every
+// endpoint without a predicate of its own; e.g.
+// WithErrorPredicate(ErrorUnlessStatus(http.StatusNotFound)).
+func WithErrorPredicate(predicate ErrorPredicate) Option {
+	return func(c *Config) {
+		c.ErrorPredicate = predicate
+	}
+}
+
+// WithEndpointErrorPredicate decides which requests to an endpoint tag (e.g.
+// "/users/:id") count as errors, in place of WithErrorPredicate.
+func WithEndpointErrorPredicate(endpoint string, predicate ErrorPredicate) Option {
+	return func(c *Config) {
+		if c.EndpointErrorPredicates == nil {
+			c.EndpointErrorPredicates = make(map[string]ErrorPredicate)
+		}
+		c.EndpointErrorPredicates[endpoint] = predicate
+	}
+}
+
+// WithHeaderCapture reports request or response headers, e.g.
+// HeaderCapture{Header: "X-API-Version"} as an "x_api_version" tag. Authorization,
+// Cookie and other credential headers are reported as "redacted" whatever the
+// configuration says.
+func WithHeaderCapture(captures ...HeaderCapture) Option {
+	return func(c *Config) {
+		c.CaptureHeaders = append(c.CaptureHeaders, captures...)
+	}
+}
+
+// WithTokenSecret fetches the InfluxDB token from a secret store when the
+// configuration is applied, instead of passing it as a plain string; leave the
+// Token argument empty. See VaultSecretProvider for the name format.
+func WithTokenSecret(provider SecretProvider, name string) Option {
+	return func(c *Config) {
+		c.SecretProvider = provider
+		c.TokenSecret = name
+	}
+}
+
+// WithSecretRefresh re-fetches secrets at the given interval so rotated
+// credentials are picked up without a restart.
+func WithSecretRefresh(interval time.Duration) Option {
+	return func(c *Config) {
+		c.SecretRefreshInterval = Duration(interval)
+	}
+}
+
+// WithPanicRecovery answers requests whose handler panicked with a 500 instead
+// of re-panicking to the server or the framework's own recovery middleware.
+// The panic is reported either way.
+func WithPanicRecovery() Option {
+	return func(c *Config) {
+		c.RecoverPanics = true
+	}
+}
+
+// WithPanicStackTrace adds the panic value and stack trace of a panicking
+// handler to its point as a panic_stack field.
+func WithPanicStackTrace() Option {
+	return func(c *Config) {
+		c.PanicStackTrace = true
+	}
+}
+
+// WithPanicReports sends a panic_report event for each panic, with the stacks
+// of every goroutine when goroutineDump is set; see Config.PanicReports.
+func WithPanicReports(goroutineDump bool) Option {
+	return func(c *Config) {
+		c.PanicReports = true
+		c.PanicGoroutineDump = goroutineDump
+	}
+}
+
+// WithLatencyBuckets reports a cumulative latency histogram with the given
+// bucket upper bounds in milliseconds (DefaultLatencyBuckets if none), so
+// percentiles can be computed downstream instead of averaging latency_ms.
+func WithLatencyBuckets(bounds ...float64) Option {
+	return func(c *Config) {
+		if len(bounds) == 0 {
+			bounds = DefaultLatencyBuckets
+		}
+		c.LatencyBuckets = slices.Clone(bounds)
+	}
+}
+
+// WithErrorReporter forwards requests failing with a 5xx status or a panic to
+// reporter, e.g. a SentryReporter, and adds the report's ID to their point.
+func WithErrorReporter(reporter ErrorReporter) Option {
+	return func(c *Config) {
+		c.ErrorReporter = reporter
+	}
+}
+
+// WithSentryDSN forwards failed requests to the Sentry-compatible server of
+// dsn; see WithErrorReporter.
+func WithSentryDSN(dsn string) Option {
+	return func(c *Config) {
+		c.SentryDSN = dsn
+	}
+}
+
+// WithAggregationWindow sends one point per endpoint and window, with latency
+// percentiles, instead of one per request, e.g. every 10s for hot endpoints.
+func WithAggregationWindow(window time.Duration) Option {
+	return func(c *Config) {
+		c.AggregationWindow = Duration(window)
+	}
+}
+
+// WithReports sends daily and/or weekly summaries per endpoint as report
+// events, and to cfg.WebhookURL when set.
+func WithReports(cfg ReportConfig) Option {
+	return func(c *Config) {
+		c.Reports = cfg
+	}
+}
+
+// WithPushgateway pushes the metrics to the Prometheus Pushgateway at
+// gatewayURL every interval (only on Shutdown if zero), grouped under job.
+func WithPushgateway(gatewayURL, job string, interval time.Duration) Option {
+	return func(c *Config) {
+		c.PushgatewayURL = gatewayURL
+		c.PushgatewayJob = job
+		c.PushInterval = Duration(interval)
+	}
+}
+
+// WithPrometheusEndpoint serves the metrics on /metrics at addr (e.g.
+// ":9090") for Prometheus to scrape, with latency histograms on
+// DefaultLatencyBuckets unless WithLatencyBuckets sets others.
+func WithPrometheusEndpoint(addr string) Option {
+	return func(c *Config) {
+		c.PrometheusListenAddr = addr
+		if len(c.LatencyBuckets) == 0 {
+			c.LatencyBuckets = slices.Clone(DefaultLatencyBuckets)
+		}
+	}
+}
+
+// WithOTLP exports the metrics to the OpenTelemetry collector at endpoint
+// over protocol (OTLPProtocolGRPC, OTLPProtocolHTTPProtobuf or
+// OTLPProtocolHTTPJSON) every interval, 10s if zero.
+func WithOTLP(endpoint, protocol string, interval time.Duration) Option {
+	return func(c *Config) {
+		c.OTLPEndpoint = endpoint
+		c.OTLPProtocol = protocol
+		c.OTLPInterval = Duration(interval)
+	}
+}
+
+// WithOTLPHeaders sends headers (gRPC metadata with OTLPProtocolGRPC) with
+// every OTLP export.
+func WithOTLPHeaders(headers map[string]string) Option {
+	return func(c *Config) {
+		c.OTLPHeaders = headers
+	}
+}
+
+// WithLocalStore keeps hourly rollups on disk, readable with Rollups, e.g.
+// LocalStoreConfig{Dir: "/var/lib/myservice/rollups", Retention: Duration(14 * 24 * time.Hour)}
+// so reports survive restarts.
+func WithLocalStore(cfg LocalStoreConfig) Option {
+	return func(c *Config) {
+		c.LocalStore = cfg
+	}
+}
+
+// WithStreamProgress reports streamed responses, such as Server-Sent Events,
+// every interval while they last; see Config.StreamProgressInterval.
+func WithStreamProgress(interval time.Duration) Option {
+	return func(c *Config) {
+		c.StreamProgressInterval = Duration(interval)
+	}
+}
+
+// WithSlowRequestWatchdog reports requests still running after threshold; see
+// Config.SlowRequestThreshold.
+func WithSlowRequestWatchdog(threshold time.Duration) Option {
+	return func(c *Config) {
+		c.SlowRequestThreshold = Duration(threshold)
+	}
+}
+
+// WithIdempotencyWindow counts the requests repeating an Idempotency-Key seen
+// within window, e.g. 24 * time.Hour; see Config.IdempotencyWindow.
+func WithIdempotencyWindow(window time.Duration) Option {
+	return func(c *Config) {
+		c.IdempotencyWindow = Duration(window)
+	}
+}
+
+// WithEndpointDiscovery sends an endpoint_discovered event the first time an
+// endpoint is served, and again once it wasn't over window; see
+// Config.EndpointDiscoveryWindow.
+func WithEndpointDiscovery(window time.Duration) Option {
+	return func(c *Config) {
+		c.EndpointDiscoveryWindow = Duration(window)
+	}
+}
+
+// WithClientProfiles reports the top clients by requests every window; see
+// ClientProfileConfig.
+func WithClientProfiles(cfg ClientProfileConfig) Option {
+	return func(c *Config) {
+		c.ClientProfiles = cfg
+	}
+}
+
+// WithAutoscalingWindow serves the p99 latency of the last window through
+// ScalingHandler, e.g. time.Minute.
+func WithAutoscalingWindow(window time.Duration) Option {
+	return func(c *Config) {
+		c.AutoscalingWindow = Duration(window)
+	}
+}
+
+// WithQueueDepth serves the backlog returned by depth, e.g. the length of a
+// job queue, through ScalingHandler.
+func WithQueueDepth(depth func() int64) Option {
+	return func(c *Config) {
+		c.QueueDepth = depth
+	}
+}
+
+// WithOutbox enables EmitEvent, e.g. OutboxConfig{Capacity: 10000} to keep up
+// to 10000 domain events while the registry is unreachable.
+func WithOutbox(cfg OutboxConfig) Option {
+	return func(c *Config) {
+		c.Outbox = cfg
+	}
+}
+
+// WithDatadog sends every point to the Datadog metrics API, e.g.
+// DatadogConfig{APIKey: os.Getenv("DD_API_KEY"), Tags: []string{"env:prod"}}.
+func WithDatadog(cfg DatadogConfig) Option {
+	return func(c *Config) {
+		c.Datadog = cfg
+	}
+}
+
+// WithMQTT publishes every point to an MQTT broker, e.g.
+// MQTTConfig{BrokerURL: "tcp://gateway:1883", QoS: 1}.
+func WithMQTT(cfg MQTTConfig) Option {
+	return func(c *Config) {
+		c.MQTT = cfg
+	}
+}
+
+// WithGraphite writes every point to a Graphite carbon receiver, e.g.
+// GraphiteConfig{URL: "tcp://graphite:2004", Protocol: GraphitePickle, Prefix: "prod"}.
+func WithGraphite(cfg GraphiteConfig) Option {
+	return func(c *Config) {
+		c.Graphite = cfg
+	}
+}
+
+// WithElasticsearch bulk-indexes every point into Elasticsearch or
+// OpenSearch, e.g. ElasticsearchConfig{URL: "https://es:9200", APIKey: key}.
+func WithElasticsearch(cfg ElasticsearchConfig) Option {
+	return func(c *Config) {
+		c.Elasticsearch = cfg
+	}
+}
+
+// WithVictoriaMetrics imports every point into VictoriaMetrics, e.g.
+// VictoriaMetricsConfig{URL: "http://victoria:8428"}.
+func WithVictoriaMetrics(cfg VictoriaMetricsConfig) Option {
+	return func(c *Config) {
+		c.VictoriaMetrics = cfg
+	}
+}
+
+// WithRemoteWrite pushes every point with the Prometheus remote_write
+// protocol, e.g. RemoteWriteConfig{URL: "http://mimir:9009/api/v1/push"}.
+func WithRemoteWrite(cfg RemoteWriteConfig) Option {
+	return func(c *Config) {
+		c.RemoteWrite = cfg
+	}
+}
+
+// WithExporterRetry retries the points Exporters failed to export as policy
+// says; see Config.ExporterRetry.
+func WithExporterRetry(policy RetryPolicy) Option {
+	return func(c *Config) {
+		c.ExporterRetry = policy
+	}
+}
+
+// WithExporter passes every point sent to exporter as well.
+func WithExporter(exporter Exporter) Option {
+	return func(c *Config) {
+		c.Exporters = append(c.Exporters, exporter)
+	}
+}
+
+// WithSendQueue sends the points from a queue of size points, handling a full
+// queue with policy (DropOldest, DropNewest or Block); see
+// Config.SendQueueSize.
+func WithSendQueue(size int, policy string) Option {
+	return func(c *Config) {
+		c.SendQueueSize = size
+		c.SendQueuePolicy = policy
+	}
+}
+
+// WithSendQueueWorkers sends the points of the send queue from n goroutines.
+func WithSendQueueWorkers(n int) Option {
+	return func(c *Config) {
+		c.SendQueueWorkers = n
+	}
+}
+
+// WithoutSendQueue sends every point from the goroutine reporting it, e.g. the
+// request's, and returns the errors to the callers that take them.
+func WithoutSendQueue() Option {
+	return func(c *Config) {
+		c.DisableSendQueue = true
+	}
+}
+
+// WithSendQueuePriority puts the points of a kind, "request", "aggregate",
+// "run" or the name of an event, in a priority class of the send queue; see
+// Config.SendQueuePriorities.
+func WithSendQueuePriority(kind, priority string) Option {
+	return func(c *Config) {
+		if c.SendQueuePriorities == nil {
+			c.SendQueuePriorities = map[string]string{}
+		}
+		c.SendQueuePriorities[kind] = priority
+	}
+}
+
+// WithSpill writes the points that can't be sent to the registry to disk and
+// replays them once it is back, e.g.
+// SpillConfig{Dir: "/var/lib/myservice/spill", MaxBytes: 1 << 30}.
+func WithSpill(cfg SpillConfig) Option {
+	return func(c *Config) {
+		c.Spill = cfg
+	}
+}
+
+// WithBatching sends the points to the registry in batches of up to size
+// points (500 if zero), at least every interval; see Config.BatchInterval.
+func WithBatching(interval time.Duration, size int) Option {
+	return func(c *Config) {
+		c.BatchInterval = Duration(interval)
+		c.BatchSize = size
+	}
+}
+
+// WithExporterQueueSize sets how many points each exporter can lag behind
+// before its points are dropped; see Config.ExporterQueueSize.
+func WithExporterQueueSize(size int) Option {
+	return func(c *Config) {
+		c.ExporterQueueSize = size
+	}
+}
+
+// WithTimestampPrecision timestamps points when they are taken, in
+// PrecisionSeconds, PrecisionMilliseconds or PrecisionNanoseconds.
+func WithTimestampPrecision(precision string) Option {
+	return func(c *Config) {
+		c.TimestampPrecision = precision
+	}
+}
+
+// WithDebugCapture appends the frames sent to the registry to a pcapng file
+// at path; see Config.DebugCaptureFile.
+func WithDebugCapture(path string) Option {
+	return func(c *Config) {
+		c.DebugCaptureFile = path
+	}
+}
+
+// WithConsumerLagObjective holds the lag of the messages of queue reported
+// with ConsumeMessage to objective, e.g. WithConsumerLagObjective("orders",
+// 30*time.Second). Use "*" to set the objective of every queue without its own.
+func WithConsumerLagObjective(queue string, objective time.Duration) Option {
+	return func(c *Config) {
+		if c.ConsumerLagObjectives == nil {
+			c.ConsumerLagObjectives = make(map[string]Duration)
+		}
+		c.ConsumerLagObjectives[queue] = Duration(objective)
+	}
+}
+
+// WithConsumerLagBuckets sets the bucket upper bounds, in milliseconds, of the
+// lag histogram of consumed messages.
+func WithConsumerLagBuckets(bounds ...float64) Option {
+	return func(c *Config) {
+		c.ConsumerLagBuckets = slices.Clone(bounds)
+	}
+}
+
+// WithSelfCheckWriteProbe makes SelfCheck write a probe point to the InfluxDB
+// bucket, proving the token can write to it.
+func WithSelfCheckWriteProbe() Option {
+	return func(c *Config) {
+		c.SelfCheckWriteProbe = true
+	}
+}
+
+// WithInstanceID sets the instance_id tag, e.g. to a pod name or an ID the
+// deployment already assigns, instead of a generated one.
+func WithInstanceID(id string) Option {
+	return func(c *Config) {
+		c.InstanceID = id
+	}
+}
+
+// WithRegistryAuth authenticates the registry connection, e.g. with
+// RegistryAuthConfig{Token: token} for an "Authorization: Bearer" header.
+func WithRegistryAuth(auth RegistryAuthConfig) Option {
+	return func(c *Config) {
+		c.RegistryAuth = auth
+	}
+}
+
+// WithRegistryTLS configures the TLS of a wss:// registry connection, e.g.
+// with the CA of a registry behind an internal CA or a client certificate.
+func WithRegistryTLS(tlsConfig RegistryTLSConfig) Option {
+	return func(c *Config) {
+		c.RegistryTLS = tlsConfig
+	}
+}
+
+// WithWireFormat encodes the points sent to the registry with the codec of
+// that name, e.g. WireFormatMessagePack; see Config.WireFormat.
+func WithWireFormat(format string) Option {
+	return func(c *Config) {
+		c.WireFormat = format
+	}
+}
+
+// WithSchemaVersion writes points of an older schema version, for a registry
+// not upgraded yet; see Config.SchemaVersion.
+func WithSchemaVersion(version int) Option {
+	return func(c *Config) {
+		c.SchemaVersion = version
+	}
+}
+
+// WithPointCredentials sends the InfluxDB settings with every point, for
+// registries predating the session frame; see Config.PointCredentials.
+func WithPointCredentials() Option {
+	return func(c *Config) {
+		c.PointCredentials = true
+	}
+}
+
+// WithKeepalive pings the registry every interval and reconnects when a pong
+// doesn't come back within pongTimeout (interval if zero); see
+// Config.KeepaliveInterval.
+func WithKeepalive(interval, pongTimeout time.Duration) Option {
+	return func(c *Config) {
+		c.KeepaliveInterval = Duration(interval)
+		c.PongTimeout = Duration(pongTimeout)
+	}
+}
+
+// WithRateLimit caps the points and bytes written to the registry per
+// second, zero leaving either uncapped; see Config.RateLimit.
+func WithRateLimit(pointsPerSecond, bytesPerSecond float64) Option {
+	return func(c *Config) {
+		c.RateLimit = RateLimitConfig{PointsPerSecond: pointsPerSecond, BytesPerSecond: bytesPerSecond}
+	}
+}
+
+// WithAcknowledgedDelivery writes the frames the registry didn't acknowledge
+// again after a reconnection; see Config.AcknowledgedDelivery.
+func WithAcknowledgedDelivery() Option {
+	return func(c *Config) {
+		c.AcknowledgedDelivery = true
+	}
+}
+
+// WithHTTPFallback posts points to the registry over HTTP(S) while WebSocket
+// upgrades are blocked; see Config.HTTPFallback.
+func WithHTTPFallback() Option {
+	return func(c *Config) {
+		c.HTTPFallback = true
+	}
+}
+
+// WithCircuitBreaker stops sending to the registry, or to an exporter, after
+// failures consecutive failed sends, trying again after coolDown; see
+// CircuitBreakerConfig.
+func WithCircuitBreaker(failures int, coolDown time.Duration) Option {
+	return func(c *Config) {
+		c.CircuitBreaker = CircuitBreakerConfig{Failures: failures, CoolDown: Duration(coolDown)}
+	}
+}
+
+// WithPipelineMetrics sends the health of the metrics pipeline every interval;
+// see Config.PipelineMetricsInterval.
+func WithPipelineMetrics(interval time.Duration) Option {
+	return func(c *Config) {
+		c.PipelineMetricsInterval = Duration(interval)
+	}
+}
+
+// WithServiceType tags every point with service_type, e.g. registration.Worker,
+// so dashboards can group services by kind.
+func WithServiceType(t registration.ServiceType) Option {
+	return func(c *Config) {
+		c.ServiceType = string(t)
+	}
+}
+
+// IsIgnoredPath reports whether a request path is excluded from metrics. It is
+// checked before any counter is touched.
+func IsIgnoredPath(path string) bool {
+	s := loadSettings()
+	if _, ok := s.ignorePaths[path]; ok {
+		return true
+	}
+	return s.ignorePattern != nil && s.ignorePattern.MatchString(path)
+}
+
+// allowlist turns an optional list of names into a set; nil means unrestricted.
+func allowlist(names []string) map[string]struct{} {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+	return set
+}
+
+// applyOptions sets the request-path settings from options alone, without the
+// connection details or validation of ApplyConfig.
+func applyOptions(opts []Option) {
+	var cfg Config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	storeSettings(newSettings(cfg))
+}
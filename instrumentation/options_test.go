@@ -0,0 +1,42 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestIgnoredPathsProduceNoMetrics(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{
+		WithIgnorePaths([]string{"/healthz"}),
+		WithIgnorePattern(regexp.MustCompile(`^/static/`)),
+	})
+
+	served := 0
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+	for _, path := range []string{"/healthz", "/static/app.js", "/ignore-test/orders"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if served != 3 {
+		t.Errorf("handler served %d requests, want 3", served)
+	}
+	// Only the last request may reach the registry
+	if got := nextMetrics(t).Tags["endpoint"]; got != "/ignore-test/orders" {
+		t.Errorf("endpoint = %q, want /ignore-test/orders", got)
+	}
+	if got := getEndpointRequestCount("/healthz"); got != 0 {
+		t.Errorf("/healthz request count = %d, want 0", got)
+	}
+}
+
+func TestValidateRejectsBadIgnorePattern(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "svc", IgnorePattern: "(unclosed"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate accepted an invalid ignore_pattern")
+	}
+}
@@ -0,0 +1,477 @@
+package instrumentation
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLP protocols, named like the OTEL_EXPORTER_OTLP_PROTOCOL values.
+const (
+	OTLPProtocolGRPC         = "grpc"
+	OTLPProtocolHTTPProtobuf = "http/protobuf"
+	OTLPProtocolHTTPJSON     = "http/json"
+)
+
+const (
+	defaultOTLPInterval = 10 * time.Second
+	otlpExportTimeout   = 10 * time.Second
+	otlpExportMethod    = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpScopeName       = "github.com/jculley01/observability-module/instrumentation"
+	// aggregationTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE
+	aggregationTemporalityCumulative = 2
+)
+
+// processStart is when the exported cumulative counts started.
+var processStart = time.Now()
+
+// The types below are the parts of the OTLP metrics protocol used by the
+// exporter, with the field names of its JSON encoding. appendProto encodes
+// them with the field numbers of opentelemetry/proto/metrics/v1.
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Unit        string         `json:"unit"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpUint64     `json:"timeUnixNano"`
+	AsInt             int64          `json:"asInt,string"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpUint64     `json:"timeUnixNano"`
+	Count             otlpUint64     `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []otlpUint64   `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+// otlpUint64 is a 64-bit integer, a string in JSON.
+type otlpUint64 uint64
+
+func (n otlpUint64) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatUint(uint64(n), 10) + `"`), nil
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendAttributes(b []byte, num protowire.Number, attributes []otlpKeyValue) []byte {
+	for _, kv := range attributes {
+		value := appendString(nil, 1, kv.Value.StringValue)
+		b = appendMessage(b, num, appendMessage(appendString(nil, 1, kv.Key), 2, value))
+	}
+	return b
+}
+
+func (r otlpMetricsRequest) appendProto(b []byte) []byte {
+	for _, rm := range r.ResourceMetrics {
+		b = appendMessage(b, 1, rm.appendProto(nil))
+	}
+	return b
+}
+
+func (rm otlpResourceMetrics) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, appendAttributes(nil, 1, rm.Resource.Attributes))
+	for _, sm := range rm.ScopeMetrics {
+		b = appendMessage(b, 2, sm.appendProto(nil))
+	}
+	return b
+}
+
+func (sm otlpScopeMetrics) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, appendString(nil, 1, sm.Scope.Name))
+	for _, m := range sm.Metrics {
+		b = appendMessage(b, 2, m.appendProto(nil))
+	}
+	return b
+}
+
+func (m otlpMetric) appendProto(b []byte) []byte {
+	b = appendString(b, 1, m.Name)
+	b = appendString(b, 2, m.Description)
+	b = appendString(b, 3, m.Unit)
+	if m.Sum != nil {
+		var sum []byte
+		for _, dp := range m.Sum.DataPoints {
+			point := appendFixed64(nil, 2, uint64(dp.StartTimeUnixNano))
+			point = appendFixed64(point, 3, uint64(dp.TimeUnixNano))
+			point = appendFixed64(point, 6, uint64(dp.AsInt))
+			point = appendAttributes(point, 7, dp.Attributes)
+			sum = appendMessage(sum, 1, point)
+		}
+		sum = appendVarint(sum, 2, uint64(m.Sum.AggregationTemporality))
+		sum = appendVarint(sum, 3, protowire.EncodeBool(m.Sum.IsMonotonic))
+		b = appendMessage(b, 7, sum)
+	}
+	if m.Histogram != nil {
+		var histogram []byte
+		for _, dp := range m.Histogram.DataPoints {
+			point := appendFixed64(nil, 2, uint64(dp.StartTimeUnixNano))
+			point = appendFixed64(point, 3, uint64(dp.TimeUnixNano))
+			point = appendFixed64(point, 4, uint64(dp.Count))
+			point = appendFixed64(point, 5, math.Float64bits(dp.Sum))
+			var counts, bounds []byte
+			for _, count := range dp.BucketCounts {
+				counts = protowire.AppendFixed64(counts, uint64(count))
+			}
+			for _, bound := range dp.ExplicitBounds {
+				bounds = protowire.AppendFixed64(bounds, math.Float64bits(bound))
+			}
+			point = appendMessage(point, 6, counts)
+			point = appendMessage(point, 7, bounds)
+			point = appendAttributes(point, 9, dp.Attributes)
+			histogram = appendMessage(histogram, 1, point)
+		}
+		histogram = appendVarint(histogram, 2, uint64(m.Histogram.AggregationTemporality))
+		b = appendMessage(b, 9, histogram)
+	}
+	return b
+}
+
+// otlpMetrics maps the metrics of WriteOpenMetrics onto OTLP: the service
+// name and instance_id become the service.name and service.instance.id
+// resource attributes, endpoints the http.route attribute and error classes
+// the error.type attribute.
+func otlpMetrics(now time.Time) otlpMetricsRequest {
+	names, endpoints := exposedEndpoints()
+	start, end := otlpUint64(processStart.UnixNano()), otlpUint64(now.UnixNano())
+	attributes := func(pairs ...string) []otlpKeyValue {
+		var kvs []otlpKeyValue
+		for i := 0; i < len(pairs); i += 2 {
+			kvs = append(kvs, otlpKeyValue{Key: pairs[i], Value: otlpAnyValue{StringValue: pairs[i+1]}})
+		}
+		return kvs
+	}
+	counter := func(name, description string, points []otlpNumberDataPoint) otlpMetric {
+		return otlpMetric{
+			Name:        name,
+			Description: description,
+			Unit:        "{request}",
+			Sum:         &otlpSum{DataPoints: points, AggregationTemporality: aggregationTemporalityCumulative, IsMonotonic: true},
+		}
+	}
+	point := func(count int64, attrs ...string) otlpNumberDataPoint {
+		return otlpNumberDataPoint{Attributes: attributes(attrs...), StartTimeUnixNano: start, TimeUnixNano: end, AsInt: count}
+	}
+
+	var requests, failures, panics []otlpNumberDataPoint
+	for _, endpoint := range names {
+		c := endpoints[endpoint]
+		requests = append(requests, point(c.requests, "http.route", endpoint))
+		for _, class := range errorClasses {
+			if count, ok := c.errors[class]; ok {
+				failures = append(failures, point(count, "http.route", endpoint, "error.type", class))
+			}
+		}
+		panics = append(panics, point(c.panics, "http.route", endpoint))
+	}
+	var metrics []otlpMetric
+	if len(requests) > 0 {
+		metrics = append(metrics,
+			counter("http.server.requests", "Requests served.", requests),
+			counter("http.server.request.panics", "Requests whose handler panicked.", panics))
+	}
+	if len(failures) > 0 {
+		metrics = append(metrics, counter("http.server.request.errors", "Failed requests, by error class.", failures))
+	}
+	if h := loadSettings().latencyHistogram; h != nil {
+		bounds := make([]float64, len(h.bounds))
+		for i, bound := range h.bounds {
+			bounds[i] = bound / 1000
+		}
+		histograms := h.snapshot()
+		var points []otlpHistogramDataPoint
+		for _, endpoint := range names {
+			e, ok := histograms[endpoint]
+			if !ok {
+				continue
+			}
+			counts := make([]otlpUint64, len(e.counts))
+			for i, count := range e.counts {
+				counts[i] = otlpUint64(count)
+			}
+			points = append(points, otlpHistogramDataPoint{
+				Attributes:        attributes("http.route", endpoint),
+				StartTimeUnixNano: start,
+				TimeUnixNano:      end,
+				Count:             otlpUint64(e.count),
+				Sum:               e.sumMs / 1000,
+				BucketCounts:      counts,
+				ExplicitBounds:    bounds,
+			})
+		}
+		if len(points) > 0 {
+			metrics = append(metrics, otlpMetric{
+				Name:        "http.server.request.duration",
+				Description: "Request latency.",
+				Unit:        "s",
+				Histogram:   &otlpHistogram{DataPoints: points, AggregationTemporality: aggregationTemporalityCumulative},
+			})
+		}
+	}
+
+	return otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResource{Attributes: attributes("service.name", measurement, "service.instance.id", instanceID)},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: otlpScopeName}, Metrics: metrics}},
+	}}}
+}
+
+// rawCodec passes messages already encoded as protobuf through gRPC.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec can't marshal %T", v)
+	}
+	return b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec can't unmarshal into %T", v)
+	}
+	*b = data
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// otlpExporter exports to OTLPEndpoint every OTLPInterval.
+type otlpExporter struct {
+	endpoint string
+	protocol string
+	headers  map[string]string
+	interval time.Duration
+	// conn is the connection of the grpc protocol
+	conn *grpc.ClientConn
+	done chan struct{}
+}
+
+var (
+	otlpMu sync.Mutex
+	otlp   *otlpExporter
+)
+
+// startOTLP replaces the exporter of any previously applied config.
+func startOTLP(cfg Config) error {
+	otlpMu.Lock()
+	defer otlpMu.Unlock()
+	if otlp != nil {
+		close(otlp.done)
+		if err := otlp.close(); err != nil {
+			log.Printf("Error closing the OTLP connection: %v\n", err)
+		}
+		otlp = nil
+	}
+	if cfg.OTLPEndpoint == "" {
+		return nil
+	}
+	e := &otlpExporter{
+		endpoint: cfg.OTLPEndpoint,
+		protocol: cfg.OTLPProtocol,
+		headers:  cfg.OTLPHeaders,
+		interval: time.Duration(cfg.OTLPInterval),
+		done:     make(chan struct{}),
+	}
+	if e.protocol == "" {
+		e.protocol = OTLPProtocolHTTPProtobuf
+	}
+	if e.interval == 0 {
+		e.interval = defaultOTLPInterval
+	}
+	if e.protocol == OTLPProtocolGRPC {
+		// Validate has already made sure the endpoint parses
+		u, _ := url.Parse(e.endpoint)
+		creds := insecure.NewCredentials()
+		if u.Scheme == "https" {
+			creds = credentials.NewTLS(&tls.Config{})
+		}
+		conn, err := grpc.Dial(u.Host, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return fmt.Errorf("error connecting to the OTLP endpoint: %w", err)
+		}
+		e.conn = conn
+	}
+	otlp = e
+	go e.run()
+	return nil
+}
+
+// stopOTLP exports a last time and stops the exporter.
+func stopOTLP(ctx context.Context) error {
+	otlpMu.Lock()
+	e := otlp
+	otlp = nil
+	otlpMu.Unlock()
+	if e == nil {
+		return nil
+	}
+	close(e.done)
+	err := e.export(ctx)
+	if err != nil {
+		err = fmt.Errorf("error exporting metrics over OTLP: %w", err)
+	}
+	if closeErr := e.close(); closeErr != nil {
+		log.Printf("Error closing the OTLP connection: %v\n", closeErr)
+	}
+	return err
+}
+
+func (e *otlpExporter) close() error {
+	if e.conn == nil {
+		return nil
+	}
+	return e.conn.Close()
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), otlpExportTimeout)
+			if err := e.export(ctx); err != nil {
+				log.Printf("Error exporting metrics over OTLP: %v\n", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// export sends the current metrics.
+func (e *otlpExporter) export(ctx context.Context) error {
+	request := otlpMetrics(time.Now())
+	if e.protocol == OTLPProtocolGRPC {
+		for key, value := range e.headers {
+			ctx = metadata.AppendToOutgoingContext(ctx, key, value)
+		}
+		var reply []byte
+		return e.conn.Invoke(ctx, otlpExportMethod, request.appendProto(nil), &reply, grpc.ForceCodec(rawCodec{}))
+	}
+
+	body, contentType := request.appendProto(nil), "application/x-protobuf"
+	if e.protocol == OTLPProtocolHTTPJSON {
+		var err error
+		if body, err = json.Marshal(request); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+	target := e.endpoint
+	if u, err := url.Parse(target); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = "/v1/metrics"
+		target = u.String()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP endpoint answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package instrumentation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOTLPHTTPJSONExport(t *testing.T) {
+	type export struct {
+		contentType, apiKey string
+		body                []byte
+	}
+	exports := make(chan export, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/v1/metrics" {
+			exports <- export{r.Header.Get("Content-Type"), r.Header.Get("api-key"), body}
+		}
+	}))
+	defer collector.Close()
+	if err := Configure(collectorURL, "test-service", "", "", "", "",
+		WithOTLP(collector.URL, OTLPProtocolHTTPJSON, time.Hour),
+		WithOTLPHeaders(map[string]string{"api-key": "secret"}),
+		WithLatencyBuckets(100),
+		WithoutSendQueue(),
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/otlp/orders", nil))
+	nextMetrics(t)
+
+	if err := stopOTLP(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := <-exports
+	if got.contentType != "application/json" || got.apiKey != "secret" {
+		t.Errorf("Content-Type, api-key = %q, %q", got.contentType, got.apiKey)
+	}
+	var request struct {
+		ResourceMetrics []struct {
+			Resource struct {
+				Attributes []otlpKeyValue
+			}
+			ScopeMetrics []struct {
+				Metrics []struct {
+					Name string
+					Sum  *struct {
+						DataPoints []struct {
+							Attributes []otlpKeyValue
+							AsInt      string
+						}
+					}
+					Histogram *struct {
+						DataPoints []struct {
+							Attributes   []otlpKeyValue
+							Count        string
+							BucketCounts []string
+						}
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(got.body, &request); err != nil {
+		t.Fatal(err)
+	}
+	rm := request.ResourceMetrics[0]
+	if rm.Resource.Attributes[0] != (otlpKeyValue{"service.name", otlpAnyValue{"test-service"}}) {
+		t.Errorf("resource attributes = %v", rm.Resource.Attributes)
+	}
+	route := otlpKeyValue{"http.route", otlpAnyValue{"/otlp/orders"}}
+	var requests, histogram bool
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		switch {
+		case m.Name == "http.server.requests":
+			for _, dp := range m.Sum.DataPoints {
+				requests = requests || (dp.Attributes[0] == route && dp.AsInt == "1")
+			}
+		case m.Name == "http.server.request.duration":
+			for _, dp := range m.Histogram.DataPoints {
+				histogram = histogram || (dp.Attributes[0] == route && dp.Count == "1" && len(dp.BucketCounts) == 2)
+			}
+		}
+	}
+	if !requests || !histogram {
+		t.Errorf("request count exported: %v, histogram exported: %v\n%s", requests, histogram, got.body)
+	}
+}
+
+func TestOTLPGRPCExport(t *testing.T) {
+	type export struct {
+		method, apiKey string
+		body           []byte
+	}
+	exports := make(chan export, 1)
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		var body []byte
+		if err := stream.RecvMsg(&body); err != nil {
+			return err
+		}
+		method, _ := grpc.MethodFromServerStream(stream)
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		exports <- export{method, md.Get("api-key")[0], body}
+		return stream.SendMsg([]byte{})
+	}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	if err := Configure(collectorURL, "test-service", "", "", "", "",
+		WithOTLP("http://"+listener.Addr().String(), OTLPProtocolGRPC, time.Hour),
+		WithOTLPHeaders(map[string]string{"api-key": "secret"}),
+		WithoutSendQueue(),
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/otlp/grpc", nil))
+	nextMetrics(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := stopOTLP(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got := <-exports
+	if got.method != otlpExportMethod || got.apiKey != "secret" {
+		t.Errorf("method, api-key = %q, %q", got.method, got.apiKey)
+	}
+	// The request is a single well-formed ResourceMetrics (field 1)
+	num, typ, n := protowire.ConsumeTag(got.body)
+	if num != 1 || typ != protowire.BytesType {
+		t.Fatalf("first field = %d/%d, want 1/bytes", num, typ)
+	}
+	if _, m := protowire.ConsumeBytes(got.body[n:]); n+m != len(got.body) {
+		t.Errorf("request isn't a single ResourceMetrics")
+	}
+	for _, want := range []string{"test-service", "http.server.requests", "/otlp/grpc"} {
+		if !bytes.Contains(got.body, []byte(want)) {
+			t.Errorf("request lacks %q", want)
+		}
+	}
+}
+
+func TestValidateOTLPProtocol(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry:8090", ServiceName: "orders", OTLPEndpoint: "http://otel:4318", OTLPProtocol: "thrift"}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || validationErr.Errors[0].Field != "otlp_protocol" {
+		t.Errorf("Validate() = %v, want an otlp_protocol problem", err)
+	}
+}
@@ -0,0 +1,231 @@
+package instrumentation
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOutboxFlushInterval = time.Second
+	defaultOutboxBatchSize     = 100
+)
+
+// ErrOutboxDisabled is returned by EmitEvent when no outbox is configured.
+var ErrOutboxDisabled = errors.New("domain events need an outbox: set Config.Outbox or use WithOutbox")
+
+// OutboxConfig enables EmitEvent. Events wait in an outbox of up to Capacity
+// events and are sent in batches of up to BatchSize (100 if zero) every
+// FlushInterval (1s if zero). Events that can't be sent, e.g. while the
+// registry is unreachable, stay in the outbox and are replayed at the next
+// flush; once it is full the oldest are dropped.
+type OutboxConfig struct {
+	Capacity      int      `json:"capacity"`
+	BatchSize     int      `json:"batch_size"`
+	FlushInterval Duration `json:"flush_interval"`
+}
+
+// DomainEvent is something that happened in the application, e.g. an
+// "order_created", sent next to the metrics for product analytics.
+type DomainEvent struct {
+	// Name is sent as the domain_event tag. Like Tags, it should come from
+	// the code, as every value is its own series.
+	Name string
+	// Time is when the event happened, now if zero. It is sent as
+	// occurred_at_ms, as events can be replayed long after.
+	Time   time.Time
+	Tags   map[string]string
+	Fields map[string]interface{}
+}
+
+// outbox holds the events waiting to be sent, oldest first.
+type outbox struct {
+	capacity  int
+	batchSize int
+	interval  time.Duration
+	done      chan struct{}
+
+	mu      sync.Mutex
+	pending []DomainEvent
+	dropped int64
+	// flushMu makes flushes send one at a time, in order
+	flushMu sync.Mutex
+}
+
+var (
+	outboxMu      sync.Mutex
+	currentOutbox *outbox
+)
+
+// startOutbox replaces the outbox of any previously applied config, keeping
+// its pending events.
+func startOutbox(cfg Config) {
+	outboxMu.Lock()
+	previous := currentOutbox
+	currentOutbox = nil
+	if cfg.Outbox.Capacity > 0 {
+		currentOutbox = &outbox{
+			capacity:  cfg.Outbox.Capacity,
+			batchSize: cfg.Outbox.BatchSize,
+			interval:  time.Duration(cfg.Outbox.FlushInterval),
+			done:      make(chan struct{}),
+		}
+		if currentOutbox.batchSize == 0 {
+			currentOutbox.batchSize = defaultOutboxBatchSize
+		}
+		if currentOutbox.interval == 0 {
+			currentOutbox.interval = defaultOutboxFlushInterval
+		}
+		go currentOutbox.run()
+	}
+	next := currentOutbox
+	outboxMu.Unlock()
+
+	if previous != nil {
+		close(previous.done)
+		previous.flushMu.Lock()
+		defer previous.flushMu.Unlock()
+		previous.mu.Lock()
+		pending, dropped := previous.pending, previous.dropped
+		previous.pending = nil
+		previous.mu.Unlock()
+		if next != nil {
+			next.mu.Lock()
+			next.dropped += dropped
+			next.mu.Unlock()
+			for _, event := range pending {
+				next.add(event)
+			}
+		}
+	}
+}
+
+// stopOutbox sends the events left in the outbox and removes it, returning an
+// error for those that couldn't be sent.
+func stopOutbox() error {
+	outboxMu.Lock()
+	o := currentOutbox
+	currentOutbox = nil
+	outboxMu.Unlock()
+	if o == nil {
+		return nil
+	}
+	close(o.done)
+	o.flush()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) > 0 {
+		return fmt.Errorf("%d domain events were not sent", len(o.pending))
+	}
+	return nil
+}
+
+// EmitEvent queues a domain event, sent as a point tagged with its
+// domain_event name along with its own tags and fields. It returns
+// ErrOutboxDisabled without an outbox.
+//
+//	instrumentation.EmitEvent(instrumentation.DomainEvent{
+//		Name:   "order_created",
+//		Tags:   map[string]string{"plan": "pro"},
+//		Fields: map[string]interface{}{"order_id": id, "amount": 42.5},
+//	})
+func EmitEvent(event DomainEvent) error {
+	if event.Name == "" {
+		return errors.New("domain event without a name")
+	}
+	outboxMu.Lock()
+	o := currentOutbox
+	outboxMu.Unlock()
+	if o == nil {
+		return ErrOutboxDisabled
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	o.add(event)
+	return nil
+}
+
+// add queues event, dropping the oldest event when the outbox is full.
+func (o *outbox) add(event DomainEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) >= o.capacity {
+		o.pending = o.pending[1:]
+		o.dropped++
+	}
+	o.pending = append(o.pending, event)
+}
+
+func (o *outbox) run() {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+			o.flush()
+		}
+	}
+}
+
+// flush sends the pending events in batches, and stops at the first one that
+// can't be sent so it is replayed, in order, at the next flush.
+func (o *outbox) flush() {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+	for {
+		o.mu.Lock()
+		batch := o.pending[:min(len(o.pending), o.batchSize)]
+		dropped := o.dropped
+		o.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		sent := 0
+		for _, event := range batch {
+			if err := sendDomainEvent(event, dropped); err != nil {
+				log.Printf("Error sending %s event, keeping it for the next flush: %v\n", event.Name, err)
+				break
+			}
+			sent++
+		}
+		o.mu.Lock()
+		// Events dropped meanwhile were the oldest, i.e. sent ones
+		o.pending = o.pending[max(sent-int(o.dropped-dropped), 0):]
+		o.mu.Unlock()
+		if sent < len(batch) {
+			return
+		}
+	}
+}
+
+// sendDomainEvent sends an event with the count of events dropped so far.
+func sendDomainEvent(event DomainEvent, dropped int64) error {
+	tags := map[string]string{}
+	for key, value := range event.Tags {
+		tags[key] = value
+	}
+	tags["domain_event"] = event.Name
+	fields := map[string]interface{}{}
+	for key, value := range event.Fields {
+		fields[key] = value
+	}
+	fields["occurred_at_ms"] = event.Time.UnixMilli()
+	fields["events_dropped_count"] = dropped
+
+	metrics := Metrics{
+		InfluxDBURL: influxDBURL,
+		Token:       currentToken(),
+		Org:         org,
+		Bucket:      bucket,
+		Measurement: measurement,
+		Tags:        tags,
+		Fields:      fields,
+	}
+	stampPoint(&metrics, event.Time)
+	return sendMetrics(metrics)
+}
@@ -0,0 +1,71 @@
+package instrumentation
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEmitEventWithoutOutbox(t *testing.T) {
+	if err := EmitEvent(DomainEvent{Name: "order_created"}); !errors.Is(err, ErrOutboxDisabled) {
+		t.Errorf("EmitEvent() = %v, want ErrOutboxDisabled", err)
+	}
+}
+
+func TestEmitEventSendsThroughOutbox(t *testing.T) {
+	if err := Configure(collectorURL, "test-service", "", "", "", "",
+		WithOutbox(OutboxConfig{Capacity: 10, FlushInterval: Duration(10 * time.Millisecond)}),
+		WithoutSendQueue(),
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	occurred := time.Date(2026, 3, 10, 14, 0, 0, 0, time.UTC)
+	err := EmitEvent(DomainEvent{
+		Name:   "order_created",
+		Time:   occurred,
+		Tags:   map[string]string{"plan": "pro", "domain_event": "overridden"},
+		Fields: map[string]interface{}{"amount": 42.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := nextMetrics(t)
+	if point.Tags["domain_event"] != "order_created" || point.Tags["plan"] != "pro" {
+		t.Errorf("event tags = %v", point.Tags)
+	}
+	if point.Fields["amount"] != 42.5 || point.Fields["occurred_at_ms"] != float64(occurred.UnixMilli()) {
+		t.Errorf("event fields = %v", point.Fields)
+	}
+}
+
+func TestOutboxReplaysUnsentEvents(t *testing.T) {
+	o := &outbox{capacity: 2, batchSize: 10}
+	for _, name := range []string{"cart_viewed", "order_created", "order_paid"} {
+		o.add(DomainEvent{Name: name, Time: time.Now()})
+	}
+
+	// Sending fails while stopped
+	stopped.Store(true)
+	o.flush()
+	stopped.Store(false)
+	if len(o.pending) != 2 {
+		t.Fatalf("%d events pending after a failed flush, want 2", len(o.pending))
+	}
+
+	o.flush()
+	for _, name := range []string{"order_created", "order_paid"} {
+		point := nextMetrics(t)
+		if point.Tags["domain_event"] != name || point.Fields["events_dropped_count"] != float64(1) {
+			t.Errorf("replayed event = %v %v, want %s with 1 dropped", point.Tags, point.Fields, name)
+		}
+	}
+	if len(o.pending) != 0 {
+		t.Errorf("%d events pending after replay, want 0", len(o.pending))
+	}
+}
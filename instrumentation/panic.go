@@ -0,0 +1,73 @@
+package instrumentation
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// maxPanicStackBytes caps the panic_stack field.
+const maxPanicStackBytes = 8 << 10
+
+// maxPanicDumpBytes caps the goroutine_dump field of panic reports.
+const maxPanicDumpBytes = 256 << 10
+
+// RecoverPanics reports whether a middleware that recovered a handler panic
+// should answer with a 500 rather than re-panic, as set by WithPanicRecovery.
+// Adapters call it after passing the panic to Report.
+func RecoverPanics() bool {
+	return loadSettings().recoverPanics
+}
+
+// panicStack formats a recovered panic for the panic_stack field. It must be
+// called from the deferred function that recovered it, while the panicking
+// frames are still on the stack.
+func panicStack(panicValue interface{}) string {
+	stack := fmt.Sprintf("panic: %v\n\n%s", panicValue, debug.Stack())
+	if len(stack) > maxPanicStackBytes {
+		stack = stack[:maxPanicStackBytes]
+	}
+	return stack
+}
+
+// sendPanicReport sends a panic_report event for a recovered panic, with the
+// panic value, its stack, the request it happened in and, under
+// PanicGoroutineDump, the stacks of every goroutine. Like panicStack, it must
+// be called from the deferred function that recovered the panic.
+func sendPanicReport(endpoint string, panicValue interface{}, r *http.Request, rec *RequestRecord) {
+	s := loadSettings()
+	if !s.panicReports {
+		return
+	}
+	fields := map[string]interface{}{
+		"panic_value": fmt.Sprint(panicValue),
+		"panic_stack": panicStack(panicValue),
+		"panic_count": getEndpointPanicCount(endpoint),
+	}
+	if rec != nil {
+		fields["request_id"] = rec.RequestID()
+	}
+	if r != nil {
+		fields["method"] = r.Method
+		fields["path"] = r.URL.Path
+		if id := traceID(r.Header.Get("Traceparent")); id != "" {
+			fields["trace_id"] = id
+		}
+	}
+	if s.panicGoroutineDump {
+		dump := goroutineDump()
+		if len(dump) > maxPanicDumpBytes {
+			dump = dump[:maxPanicDumpBytes]
+		}
+		fields["goroutine_dump"] = string(dump)
+	}
+	sendEvent("panic_report", map[string]string{"endpoint": endpoint}, fields)
+}
+
+// writePanicResponse answers a recovered panic, unless the handler had
+// already started the response.
+func writePanicResponse(rw *responseWriter) {
+	if !rw.wroteHeader {
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
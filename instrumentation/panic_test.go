@@ -0,0 +1,148 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMiddlewareReportsAndRepanics(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("recovered %v, want the handler's panic", p)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/panic/repanic", nil))
+	}()
+
+	metrics := nextMetrics(t)
+	if metrics.Fields["status_code"] != float64(http.StatusInternalServerError) {
+		t.Errorf("status_code = %v, want 500", metrics.Fields["status_code"])
+	}
+	if metrics.Fields["panic_count"] != float64(1) || metrics.Fields["error_count"] != float64(1) {
+		t.Errorf("panic_count, error_count = %v, %v, want 1, 1", metrics.Fields["panic_count"], metrics.Fields["error_count"])
+	}
+	if _, ok := metrics.Fields["panic_stack"]; ok {
+		t.Error("panic_stack reported without WithPanicStackTrace")
+	}
+}
+
+func TestMiddlewareRecoversPanics(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{WithPanicRecovery(), WithPanicStackTrace()})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panic/recover", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("response status = %d, want 500", rec.Code)
+	}
+	metrics := nextMetrics(t)
+	stack, _ := metrics.Fields["panic_stack"].(string)
+	if !strings.HasPrefix(stack, "panic: boom") || !strings.Contains(stack, "TestMiddlewareRecoversPanics") {
+		t.Errorf("panic_stack = %q, want the panic value and the panicking frames", stack)
+	}
+	// Requests without a panic keep reporting the endpoint's count
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/panic/recover", nil))
+	if metrics := nextMetrics(t); metrics.Fields["panic_count"] != float64(1) {
+		t.Errorf("panic_count = %v, want 1", metrics.Fields["panic_count"])
+	}
+}
+
+func TestMiddlewareLeavesAbortHandler(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", p)
+		}
+		if got := getEndpointPanicCount("/panic/abort"); got != 0 {
+			t.Errorf("panic count = %d, want 0", got)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/panic/abort", nil))
+}
+
+func TestRPCMiddlewareRecoversPanics(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{WithPanicRecovery()})
+
+	handler := TwirpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/twirp/panic.Service/Method", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("response status = %d, want 500", rec.Code)
+	}
+	metrics := nextMetrics(t)
+	if metrics.Fields["status_code"] != float64(http.StatusInternalServerError) || metrics.Fields["panic_count"] != float64(1) {
+		t.Errorf("status_code, panic_count = %v, %v, want 500, 1", metrics.Fields["status_code"], metrics.Fields["panic_count"])
+	}
+}
+
+func TestMiddlewareSendsPanicReports(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{WithPanicRecovery(), WithPanicReports(true)})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("nil map")
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/panic/report?token=secret", nil)
+	req.Header.Set(RequestIDHeader, "req-7")
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	report := nextMetrics(t)
+	if report.Tags["event"] != "panic_report" || report.Tags["endpoint"] != "/panic/report" {
+		t.Fatalf("tags = %v, want a panic_report event", report.Tags)
+	}
+	fields := report.Fields
+	if fields["panic_value"] != "nil map" || fields["request_id"] != "req-7" || fields["method"] != http.MethodPost || fields["path"] != "/panic/report" || fields["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("report fields = %v", fields)
+	}
+	if fields["panic_count"] != float64(1) {
+		t.Errorf("panic_count = %v, want 1", fields["panic_count"])
+	}
+	if stack, _ := fields["panic_stack"].(string); !strings.Contains(stack, "TestMiddlewareSendsPanicReports") {
+		t.Errorf("panic_stack = %q, want the handler's frames", stack)
+	}
+	if dump, _ := fields["goroutine_dump"].(string); !strings.Contains(dump, "goroutine ") {
+		t.Errorf("goroutine_dump = %q, want every goroutine's stack", dump)
+	}
+
+	if point := nextMetrics(t); point.Tags["endpoint"] != "/panic/report" || point.Fields["panic_count"] != float64(1) {
+		t.Errorf("request point = %v %v", point.Tags, point.Fields)
+	}
+}
+
+func TestCountPanicsConcurrently(t *testing.T) {
+	before := getEndpointPanicCount("/panic/concurrent")
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				incrementEndpointPanicCount("/panic/concurrent")
+			}
+		}()
+	}
+	wg.Wait()
+	if got := getEndpointPanicCount("/panic/concurrent") - before; got != 1000 {
+		t.Errorf("counted %d panics, want 1000", got)
+	}
+}
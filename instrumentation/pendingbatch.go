@@ -0,0 +1,126 @@
+package instrumentation
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// pendingBatch queues what a batching backend sends (points, series,
+// documents...) and submits it in batches of size: every interval, or as soon
+// as a batch is ready. While the backend is slow or unreachable, at most
+// maxBatches batches wait, and the oldest items are dropped beyond that.
+type pendingBatch[T any] struct {
+	size       int
+	maxBatches int
+	interval   time.Duration
+	// timeout bounds each flush of run, retries included; 0 leaves them
+	// unbounded
+	timeout time.Duration
+	// submit submits a batch, which is lost when it returns an error. Flushes
+	// call it one at a time.
+	submit func(ctx context.Context, batch []T) error
+	// logError logs the errors of the flushes of run
+	logError func(err error)
+	// droppedFormat logs the count of the items dropped since the last flush
+	droppedFormat string
+
+	done chan struct{}
+	// full is signaled when a batch is ready
+	full chan struct{}
+
+	mu      sync.Mutex
+	pending []T
+	dropped int64
+	// flushMu makes flushes submit one at a time
+	flushMu sync.Mutex
+}
+
+// start submits the batches in the background until stop is called.
+func (p *pendingBatch[T]) start() {
+	p.done = make(chan struct{})
+	p.full = make(chan struct{}, 1)
+	go p.run()
+}
+
+// stop stops submitting in the background; what is pending is left to flush.
+func (p *pendingBatch[T]) stop() {
+	close(p.done)
+}
+
+// add queues items, dropping the oldest ones when too many are pending, and
+// returns how many it dropped.
+func (p *pendingBatch[T]) add(items ...T) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, items...)
+	excess := len(p.pending) - p.maxBatches*p.size
+	if excess > 0 {
+		p.pending = p.pending[excess:]
+		p.dropped += int64(excess)
+	} else {
+		excess = 0
+	}
+	if len(p.pending) >= p.size {
+		select {
+		case p.full <- struct{}{}:
+		default:
+		}
+	}
+	return excess
+}
+
+// len returns how many items are pending.
+func (p *pendingBatch[T]) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending)
+}
+
+func (p *pendingBatch[T]) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		case <-p.full:
+		}
+		ctx := context.Background()
+		cancel := func() {}
+		if p.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		}
+		if err := p.flush(ctx); err != nil {
+			p.logError(err)
+		}
+		cancel()
+	}
+}
+
+// flush submits the pending items in batches, stopping at the first batch
+// that fails.
+func (p *pendingBatch[T]) flush(ctx context.Context) error {
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+	p.mu.Lock()
+	if p.dropped > 0 {
+		log.Printf(p.droppedFormat, p.dropped)
+		p.dropped = 0
+	}
+	p.mu.Unlock()
+	for {
+		p.mu.Lock()
+		batch := p.pending[:min(len(p.pending), p.size)]
+		p.pending = p.pending[len(batch):]
+		p.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := p.submit(ctx, batch); err != nil {
+			return err
+		}
+	}
+}
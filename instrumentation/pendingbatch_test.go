@@ -0,0 +1,77 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPendingBatchDropsOldest(t *testing.T) {
+	var submitted [][]int
+	p := &pendingBatch[int]{
+		size:       2,
+		maxBatches: 2,
+		submit: func(ctx context.Context, batch []int) error {
+			submitted = append(submitted, append([]int(nil), batch...))
+			return nil
+		},
+		droppedFormat: "Dropped %d test items\n",
+	}
+	if dropped := p.add(1, 2, 3, 4); dropped != 0 {
+		t.Errorf("add dropped %d items, want none", dropped)
+	}
+	if dropped := p.add(5); dropped != 1 {
+		t.Errorf("add dropped %d items, want 1", dropped)
+	}
+	if err := p.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]int{{2, 3}, {4, 5}}; !reflect.DeepEqual(submitted, want) {
+		t.Errorf("submitted %v, want %v", submitted, want)
+	}
+}
+
+func TestPendingBatchStopsAtFailedBatch(t *testing.T) {
+	errDown := errors.New("down")
+	p := &pendingBatch[int]{
+		size:       1,
+		maxBatches: 10,
+		submit: func(ctx context.Context, batch []int) error {
+			return errDown
+		},
+	}
+	p.add(1, 2)
+	if err := p.flush(context.Background()); !errors.Is(err, errDown) {
+		t.Errorf("flush = %v, want the submit error", err)
+	}
+	if p.len() != 1 {
+		t.Errorf("%d items pending, want the one after the failed batch", p.len())
+	}
+}
+
+func TestPendingBatchSubmitsFullBatches(t *testing.T) {
+	submitted := make(chan []int, 1)
+	p := &pendingBatch[int]{
+		size:       2,
+		maxBatches: 10,
+		interval:   time.Hour,
+		timeout:    time.Second,
+		submit: func(ctx context.Context, batch []int) error {
+			submitted <- batch
+			return nil
+		},
+	}
+	p.start()
+	defer p.stop()
+	p.add(1, 2)
+	select {
+	case batch := <-submitted:
+		if !reflect.DeepEqual(batch, []int{1, 2}) {
+			t.Errorf("submitted %v, want [1 2]", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a full batch wasn't submitted before the interval")
+	}
+}
@@ -0,0 +1,259 @@
+package instrumentation
+
+import (
+	"github.com/jculley01/observability-module/transport"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pipelineEvent is the event the pipeline metrics are sent as.
+const pipelineEvent = "pipeline"
+
+// pipelineMetrics counts what happened to the points over a reporting
+// interval, so a quiet service can be told apart from a broken pipeline.
+type pipelineMetrics struct {
+	interval time.Duration
+	done     chan struct{}
+	// exited is closed when run returns
+	exited chan struct{}
+
+	mu sync.Mutex
+	// Points written to the registry, lost, and dropped by full queues
+	sent, failed, dropped int64
+	// Frames written to the registry and the time they took
+	frames       int64
+	sendTime     time.Duration
+	sendTimeMax  time.Duration
+	exports      int64
+	exportTime   time.Duration
+	connections  int64
+	reconnects   int64
+	queueDropped int64
+	// Points dropped over Config.RateLimit, counted in dropped too
+	rateLimited int64
+	// Points rejected by sanitizePoint, counted in dropped too
+	invalid int64
+}
+
+var (
+	pipelineMu sync.Mutex
+	pipeline   *pipelineMetrics
+	// everConnected is set once the registry was connected to, so the later
+	// connections count as reconnections
+	everConnected atomic.Bool
+)
+
+// startPipelineMetrics replaces the pipeline metrics of any previously
+// applied config, keeping them when PipelineMetricsInterval is unchanged.
+// It waits for a report being sent by the replaced ones.
+func startPipelineMetrics(cfg Config) {
+	interval := time.Duration(cfg.PipelineMetricsInterval)
+	pipelineMu.Lock()
+	if pipeline != nil && pipeline.interval == interval {
+		pipelineMu.Unlock()
+		return
+	}
+	previous := pipeline
+	pipeline = nil
+	if interval > 0 {
+		pipeline = &pipelineMetrics{
+			interval:     interval,
+			done:         make(chan struct{}),
+			exited:       make(chan struct{}),
+			queueDropped: droppedPoints.Load(),
+		}
+		go pipeline.run()
+	}
+	pipelineMu.Unlock()
+
+	if previous != nil {
+		close(previous.done)
+		<-previous.exited
+	}
+}
+
+// currentPipeline returns the pipeline metrics, nil unless
+// PipelineMetricsInterval is set. Their methods do nothing on nil.
+func currentPipeline() *pipelineMetrics {
+	pipelineMu.Lock()
+	defer pipelineMu.Unlock()
+	return pipeline
+}
+
+func (p *pipelineMetrics) run() {
+	defer close(p.exited)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.report()
+		}
+	}
+}
+
+// report sends the counts of the interval that ended as a pipeline event,
+// with the current depth of the queues. It is sent even when no point was,
+// as the sign that the pipeline works.
+func (p *pipelineMetrics) report() {
+	queueDropped := droppedPoints.Load()
+	p.mu.Lock()
+	fields := map[string]interface{}{
+		"interval_seconds":     p.interval.Seconds(),
+		"points_sent":          p.sent,
+		"points_failed":        p.failed,
+		"points_dropped":       p.dropped + queueDropped - p.queueDropped,
+		"points_rate_limited":  p.rateLimited,
+		"points_invalid":       p.invalid,
+		"registry_connections": p.connections,
+		"registry_reconnects":  p.reconnects,
+	}
+	if p.frames > 0 {
+		fields["send_latency_ms"] = float64(p.sendTime.Microseconds()) / 1000 / float64(p.frames)
+		fields["send_latency_max_ms"] = float64(p.sendTimeMax.Microseconds()) / 1000
+	}
+	if p.exports > 0 {
+		fields["export_latency_ms"] = float64(p.exportTime.Microseconds()) / 1000 / float64(p.exports)
+	}
+	p.sent, p.failed, p.dropped, p.queueDropped, p.rateLimited, p.invalid = 0, 0, 0, queueDropped, 0, 0
+	p.frames, p.sendTime, p.sendTimeMax = 0, 0, 0
+	p.exports, p.exportTime = 0, 0
+	p.connections, p.reconnects = 0, 0
+	p.mu.Unlock()
+
+	fields["send_queue_depth"] = sendQueueDepth()
+	fields["batch_pending"] = batchPending()
+	fields["exporter_queue_depth"] = exporterQueueDepth()
+	registryMu.Lock()
+	client, fallback := registry, registryHTTPFallback
+	registryMu.Unlock()
+	connected := false
+	if client != nil {
+		_, connected = client.Connection()
+		if fallback {
+			fields["registry_http_fallback"] = client.Fallback()
+		}
+	}
+	fields["registry_connected"] = connected
+	sendEvent(pipelineEvent, nil, fields)
+}
+
+// recordSend records a frame of points written to the registry, or not.
+func (p *pipelineMetrics) recordSend(points int, start time.Time, err error) {
+	if p == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.frames++
+	p.sendTime += elapsed
+	p.sendTimeMax = max(p.sendTimeMax, elapsed)
+	if err == nil {
+		p.sent += int64(points)
+	}
+}
+
+// recordFailed records points neither written to the registry nor spilled.
+func (p *pipelineMetrics) recordFailed(points int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failed += int64(points)
+}
+
+// recordDropped records points dropped by a full batch or exporter queue;
+// the send queue keeps its own count in droppedPoints.
+func (p *pipelineMetrics) recordDropped(points int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropped += int64(points)
+}
+
+// recordRateLimited records points dropped over the rate limit, which count
+// as dropped too.
+func (p *pipelineMetrics) recordRateLimited(points int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropped += int64(points)
+	p.rateLimited += int64(points)
+}
+
+// recordInvalid records points rejected as invalid, which count as dropped
+// too.
+func (p *pipelineMetrics) recordInvalid(points int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropped += int64(points)
+	p.invalid += int64(points)
+}
+
+func (p *pipelineMetrics) recordExport(elapsed time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exports++
+	p.exportTime += elapsed
+}
+
+// recordConnect is the OnConnect hook of the registry connection.
+func recordConnect(conn transport.ConnInfo) {
+	reconnect := everConnected.Swap(true)
+	p := currentPipeline()
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connections++
+	if reconnect {
+		p.reconnects++
+	}
+}
+
+func sendQueueDepth() int {
+	sendQueueMu.Lock()
+	q := queue
+	sendQueueMu.Unlock()
+	if q == nil {
+		return 0
+	}
+	return q.depth()
+}
+
+func batchPending() int {
+	batchingMu.Lock()
+	b := batching
+	batchingMu.Unlock()
+	if b == nil {
+		return 0
+	}
+	return b.len()
+}
+
+func exporterQueueDepth() int {
+	exportersMu.Lock()
+	workers := exportWorkers
+	exportersMu.Unlock()
+	depth := 0
+	for _, w := range workers {
+		depth += len(w.queue)
+	}
+	return depth
+}
@@ -0,0 +1,96 @@
+package instrumentation
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// nextPipelineEvent skips the points received until a pipeline event.
+func nextPipelineEvent(t *testing.T) Metrics {
+	t.Helper()
+	for {
+		if metrics := nextMetrics(t); metrics.Tags["event"] == pipelineEvent {
+			return metrics
+		}
+	}
+}
+
+func TestPipelineMetricsReportDeliveryHealth(t *testing.T) {
+	blocked := blockingExporter{release: make(chan struct{})}
+	err := Configure(collectorURL, "test-service", "", "", "", "",
+		WithPipelineMetrics(time.Hour), WithExporter(blocked), WithExporterQueueSize(1), WithoutSendQueue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		close(blocked.release)
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// Connect, then make the next send reconnect
+	if err := sendMetrics(Metrics{Measurement: "test-service"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeConnection(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); exporterQueueDepth() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the exporter didn't take the first point")
+		}
+	}
+	// Starts the counts over
+	currentPipeline().report()
+	nextPipelineEvent(t)
+
+	// The exporter holds the first point and has queued the event of the
+	// report, so it drops the next three
+	for i := 0; i < 3; i++ {
+		if err := sendMetrics(Metrics{Measurement: "test-service"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	currentPipeline().report()
+	fields := nextPipelineEvent(t).Fields
+	want := map[string]interface{}{
+		"points_sent":          float64(4),
+		"points_failed":        float64(0),
+		"points_dropped":       float64(3),
+		"exporter_queue_depth": float64(1),
+		"send_queue_depth":     float64(0),
+		"registry_connections": float64(1),
+		"registry_reconnects":  float64(1),
+		"registry_connected":   true,
+	}
+	for field, value := range want {
+		if fields[field] != value {
+			t.Errorf("%s = %v, want %v", field, fields[field], value)
+		}
+	}
+	if _, ok := fields["send_latency_ms"].(float64); !ok {
+		t.Errorf("send_latency_ms = %v", fields["send_latency_ms"])
+	}
+
+	// The counts start over with every report; the previous one was sent
+	currentPipeline().report()
+	if fields := nextPipelineEvent(t).Fields; fields["points_sent"] != float64(1) || fields["registry_reconnects"] != float64(0) {
+		t.Errorf("second report = %v, want 1 point sent and no reconnects", fields)
+	}
+}
+
+func TestPipelineMetricsAreSentWithoutTraffic(t *testing.T) {
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithPipelineMetrics(20*time.Millisecond), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if fields := nextPipelineEvent(t).Fields; fields["interval_seconds"] != 0.02 {
+		t.Errorf("interval_seconds = %v, want 0.02", fields["interval_seconds"])
+	}
+}
@@ -0,0 +1,110 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// PrometheusHandler serves the metrics of WriteOpenMetrics for Prometheus to
+// scrape: in the OpenMetrics text format when the scraper accepts it, in the
+// Prometheus text format otherwise. Mount it on the service's own router, or
+// set PrometheusListenAddr to serve it on a port of its own.
+//
+//	http.Handle("/metrics", instrumentation.PrometheusHandler())
+func PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		openMetrics := acceptsOpenMetrics(r.Header.Get("Accept"))
+		if openMetrics {
+			w.Header().Set("Content-Type", openMetricsContentType)
+		} else {
+			w.Header().Set("Content-Type", prometheusTextContentType)
+		}
+		if err := writeExposition(w, openMetrics); err != nil {
+			log.Printf("Error writing Prometheus metrics: %v\n", err)
+		}
+	})
+}
+
+// acceptsOpenMetrics reports whether an Accept header lists the OpenMetrics
+// text format, as Prometheus does first when it supports it.
+func acceptsOpenMetrics(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		if mediaType, _, err := mime.ParseMediaType(part); err == nil && mediaType == "application/openmetrics-text" {
+			return true
+		}
+	}
+	return false
+}
+
+// prometheusServer serves PrometheusHandler on /metrics of its own listener.
+type prometheusServer struct {
+	addr   string
+	server *http.Server
+}
+
+var (
+	prometheusMu       sync.Mutex
+	prometheusExporter *prometheusServer
+)
+
+// startPrometheus replaces the exporter of any previously applied config,
+// keeping it when its address is unchanged. It fails when the address can't
+// be listened on.
+func startPrometheus(cfg Config) error {
+	prometheusMu.Lock()
+	defer prometheusMu.Unlock()
+	if prometheusExporter != nil && prometheusExporter.addr == cfg.PrometheusListenAddr {
+		return nil
+	}
+	if prometheusExporter != nil {
+		if err := prometheusExporter.server.Close(); err != nil {
+			log.Printf("Error stopping the Prometheus exporter: %v\n", err)
+		}
+		prometheusExporter = nil
+	}
+	if cfg.PrometheusListenAddr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", cfg.PrometheusListenAddr)
+	if err != nil {
+		return fmt.Errorf("error starting the Prometheus exporter: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", PrometheusHandler())
+	// Addr holds the address listened on, e.g. the port picked for ":0"
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux}
+	exporter := &prometheusServer{addr: cfg.PrometheusListenAddr, server: server}
+	go func() {
+		if err := exporter.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving Prometheus metrics: %v\n", err)
+		}
+	}()
+	prometheusExporter = exporter
+	return nil
+}
+
+// stopPrometheus stops the exporter, letting scrapes in progress finish
+// until ctx is done.
+func stopPrometheus(ctx context.Context) error {
+	prometheusMu.Lock()
+	exporter := prometheusExporter
+	prometheusExporter = nil
+	prometheusMu.Unlock()
+	if exporter == nil {
+		return nil
+	}
+	if err := exporter.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("error stopping the Prometheus exporter: %w", err)
+	}
+	return nil
+}
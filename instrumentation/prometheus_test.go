@@ -0,0 +1,68 @@
+package instrumentation
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusHandlerNegotiatesFormat(t *testing.T) {
+	for _, tc := range []struct {
+		accept      string
+		contentType string
+		eof         bool
+	}{
+		{"application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5", openMetricsContentType, true},
+		{"text/plain", prometheusTextContentType, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.Header.Set("Accept", tc.accept)
+		rr := httptest.NewRecorder()
+		PrometheusHandler().ServeHTTP(rr, r)
+		if got := rr.Header().Get("Content-Type"); got != tc.contentType {
+			t.Errorf("Accept %q: Content-Type = %q, want %q", tc.accept, got, tc.contentType)
+		}
+		if eof := strings.HasSuffix(rr.Body.String(), "# EOF\n"); eof != tc.eof {
+			t.Errorf("Accept %q: # EOF = %v, want %v", tc.accept, eof, tc.eof)
+		}
+	}
+}
+
+func TestPrometheusEndpointWithoutRegistry(t *testing.T) {
+	if err := ApplyConfig(Config{ServiceName: "test-service", PrometheusListenAddr: "127.0.0.1:0", DisableSendQueue: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Nothing is pushed without a registry
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/prometheus/orders", nil))
+
+	resp, err := http.Get("http://" + prometheusExporter.server.Addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `endpoint="/prometheus/orders"} 1`; !strings.Contains(string(body), want) {
+		t.Errorf("scrape lacks %q:\n%s", want, body)
+	}
+}
+
+func TestValidateRequiresRegistryOrPrometheus(t *testing.T) {
+	var validationErr *ValidationError
+	err := Config{ServiceName: "orders"}.Validate()
+	if !errors.As(err, &validationErr) || validationErr.Errors[0].Message != "is required unless prometheus_listen_addr, datadog, mqtt, graphite, elasticsearch, victoria_metrics, remote_write or Exporters is set" {
+		t.Errorf("Validate() = %v", err)
+	}
+}
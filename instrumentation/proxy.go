@@ -0,0 +1,124 @@
+package instrumentation
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// Classes of the upstream_error_class tag of InstrumentReverseProxy.
+const (
+	UpstreamErrorDNS       = "dns"
+	UpstreamErrorRefused   = "connection_refused"
+	UpstreamErrorTimeout   = "timeout"
+	UpstreamErrorTLS       = "tls"
+	UpstreamErrorCanceled  = "canceled"
+	UpstreamErrorProtocol  = "protocol"
+	UpstreamErrorStatus5xx = "status_5xx"
+)
+
+// InstrumentReverseProxy returns a handler serving requests with a copy of
+// proxy, reporting them tagged component=proxy with the upstream host and
+// attempt, as SetUpstream does; a name passed to SetUpstream, e.g. from
+// Rewrite, is reported instead of the host. The point also gets
+// upstream_latency_ms, the time upstreams took to answer with their headers,
+// to compare with latency_ms, and an upstream_error_class tag when the
+// upstream couldn't be reached (dns, connection_refused, timeout, tls,
+// canceled, protocol) or answered with a 5xx (status_5xx).
+//
+// The proxy's Transport, ErrorHandler and ModifyResponse are kept and wrapped.
+// A Transport retrying requests itself reports its attempts with SetUpstream.
+func InstrumentReverseProxy(proxy *httputil.ReverseProxy) http.Handler {
+	instrumented := *proxy
+	next := proxy.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	instrumented.Transport = &proxyTransport{next: next}
+
+	errorHandler := proxy.ErrorHandler
+	instrumented.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if rec := FromContext(r.Context()); rec != nil {
+			rec.setUpstreamError(upstreamErrorClass(err))
+		}
+		SetError(r, err)
+		if errorHandler != nil {
+			errorHandler(w, r, err)
+			return
+		}
+		// What ReverseProxy does without an ErrorHandler
+		if proxy.ErrorLog != nil {
+			proxy.ErrorLog.Printf("http: proxy error: %v", err)
+		} else {
+			log.Printf("http: proxy error: %v", err)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	modifyResponse := proxy.ModifyResponse
+	instrumented.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode >= 500 {
+			if rec := FromContext(resp.Request.Context()); rec != nil {
+				rec.setUpstreamError(UpstreamErrorStatus5xx)
+			}
+		}
+		if modifyResponse != nil {
+			return modifyResponse(resp)
+		}
+		return nil
+	}
+
+	return Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rec := FromContext(r.Context()); rec != nil {
+			rec.SetTag("component", "proxy")
+		}
+		instrumented.ServeHTTP(w, r)
+	}))
+}
+
+// proxyTransport times the round trips of InstrumentReverseProxy to upstreams.
+type proxyTransport struct {
+	next http.RoundTripper
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := FromContext(req.Context())
+	if rec == nil {
+		return t.next.RoundTrip(req)
+	}
+	rec.startUpstreamTrip(req.URL.Host)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	rec.addUpstreamTime(time.Since(start))
+	return resp, err
+}
+
+// upstreamErrorClass classifies the error of a request that got no response
+// from its upstream.
+func upstreamErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var recordErr tls.RecordHeaderError
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &dnsErr):
+		return UpstreamErrorDNS
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		return UpstreamErrorTimeout
+	case errors.Is(err, context.Canceled):
+		return UpstreamErrorCanceled
+	case errors.As(err, &certErr) || errors.As(err, &unknownAuthority) || errors.As(err, &hostnameErr) || errors.As(err, &recordErr):
+		return UpstreamErrorTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return UpstreamErrorRefused
+	}
+	return UpstreamErrorProtocol
+}
@@ -0,0 +1,127 @@
+package instrumentation
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestInstrumentReverseProxyTagsUpstream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		if r.URL.Path == "/proxy/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	handler := InstrumentReverseProxy(httputil.NewSingleHostReverseProxy(target))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/proxy/ok", nil))
+	metrics := nextMetrics(t)
+	if metrics.Tags["component"] != "proxy" || metrics.Tags["upstream"] != target.Host || metrics.Tags["upstream_attempt"] != "1" {
+		t.Errorf("tags = %v, want component=proxy, upstream=%s, upstream_attempt=1", metrics.Tags, target.Host)
+	}
+	if latency, ok := metrics.Fields["upstream_latency_ms"].(float64); !ok || latency < 5 {
+		t.Errorf("upstream_latency_ms = %v, want at least 5", metrics.Fields["upstream_latency_ms"])
+	}
+	if _, ok := metrics.Tags["upstream_error_class"]; ok {
+		t.Errorf("upstream_error_class = %q on a success", metrics.Tags["upstream_error_class"])
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/proxy/fail", nil))
+	metrics = nextMetrics(t)
+	if metrics.Tags["upstream_error_class"] != UpstreamErrorStatus5xx {
+		t.Errorf("upstream_error_class = %q, want %s", metrics.Tags["upstream_error_class"], UpstreamErrorStatus5xx)
+	}
+}
+
+func TestInstrumentReverseProxyUnreachableUpstream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: addr})
+	proxy.ErrorLog = log.New(io.Discard, "", 0)
+	recorder := httptest.NewRecorder()
+	InstrumentReverseProxy(proxy).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/proxy/down", nil))
+
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusBadGateway)
+	}
+	metrics := nextMetrics(t)
+	if metrics.Tags["upstream_error_class"] != UpstreamErrorRefused || metrics.Tags["upstream"] != addr {
+		t.Errorf("upstream_error_class, upstream = %q, %q, want %s, %s", metrics.Tags["upstream_error_class"], metrics.Tags["upstream"], UpstreamErrorRefused, addr)
+	}
+}
+
+// retryTransport tries the backends in turn, reporting its attempts.
+type retryTransport struct {
+	backends []string
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var err error
+	for i, backend := range t.backends {
+		SetUpstream(req.Context(), backend, i+1)
+		attempt := req.Clone(req.Context())
+		attempt.URL.Host = backend
+		var resp *http.Response
+		if resp, err = http.DefaultTransport.RoundTrip(attempt); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+func TestInstrumentReverseProxyCountsRetries(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := listener.Addr().String()
+	listener.Close()
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = retryTransport{backends: []string{down, target.Host}}
+	InstrumentReverseProxy(proxy).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/proxy/retry", nil))
+
+	metrics := nextMetrics(t)
+	if metrics.Tags["upstream"] != target.Host || metrics.Tags["upstream_attempt"] != "2" || metrics.Fields["upstream_retries"] != float64(1) {
+		t.Errorf("upstream, upstream_attempt, upstream_retries = %q, %q, %v, want %s, 2, 1", metrics.Tags["upstream"], metrics.Tags["upstream_attempt"], metrics.Fields["upstream_retries"], target.Host)
+	}
+}
+
+func TestUpstreamErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "orders.internal", IsNotFound: true}, UpstreamErrorDNS},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, UpstreamErrorRefused},
+		{context.DeadlineExceeded, UpstreamErrorTimeout},
+		{context.Canceled, UpstreamErrorCanceled},
+		{&url.Error{Op: "Get", URL: "https://orders", Err: x509.UnknownAuthorityError{}}, UpstreamErrorTLS},
+		{io.ErrUnexpectedEOF, UpstreamErrorProtocol},
+	}
+	for _, tt := range tests {
+		if got := upstreamErrorClass(tt.err); got != tt.want {
+			t.Errorf("upstreamErrorClass(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
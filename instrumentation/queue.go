@@ -0,0 +1,326 @@
+package instrumentation
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policies of Config.SendQueuePolicy for points reported while the send queue
+// is full.
+const (
+	// DropOldest drops the point that has waited the longest, so the
+	// freshest points get through.
+	DropOldest = "drop_oldest"
+	// DropNewest drops the point being reported.
+	DropNewest = "drop_newest"
+	// Block makes the request reporting the point wait for room.
+	Block = "block"
+)
+
+// droppedPoints counts the points dropped by the send queue.
+var droppedPoints atomic.Int64
+
+// Defaults of Config.SendQueueSize and Config.SendQueueWorkers.
+const (
+	defaultSendQueueSize    = 10000
+	defaultSendQueueWorkers = 4
+)
+
+// DroppedPoints returns how many points the send queue dropped since the
+// process started. Points carry it as the dropped_points field.
+func DroppedPoints() int64 {
+	return droppedPoints.Load()
+}
+
+// Priority classes of the points in the send queue, highest first. Under
+// backpressure the queue drops the points of the lowest class first, so
+// critical signals get through.
+const (
+	// PriorityCritical: the points of RunInstrumented runs, and lifecycle
+	// and health events (service_registered, service_deregistered, pipeline,
+	// circuit_breaker, endpoint_discovered, leadership changes, config
+	// reloads and credential rotations).
+	PriorityCritical = "critical"
+	// PriorityAggregate: aggregation windows, client profiles, reports and
+	// panic reports.
+	PriorityAggregate = "aggregate"
+	// PriorityRequest: the points of requests, messages and streams, and
+	// the events of no other class.
+	PriorityRequest = "request"
+	// PriorityDebug: diagnostic events such as request_in_progress.
+	PriorityDebug = "debug"
+)
+
+// priorityRanks orders the priority classes; the queue holds a list of
+// points per rank.
+var priorityRanks = map[string]int{PriorityDebug: 0, PriorityRequest: 1, PriorityAggregate: 2, PriorityCritical: 3}
+
+// Kinds of the points that aren't events, as keys of SendQueuePriorities.
+const (
+	requestPoints   = "request"
+	aggregatePoints = "aggregate"
+	runPoints       = "run"
+)
+
+// defaultPriorities are the classes of the kinds of points, and of events by
+// name, unless SendQueuePriorities says otherwise.
+var defaultPriorities = map[string]string{
+	requestPoints:           PriorityRequest,
+	aggregatePoints:         PriorityAggregate,
+	runPoints:               PriorityCritical,
+	"service_registered":    PriorityCritical,
+	"service_deregistered":  PriorityCritical,
+	pipelineEvent:           PriorityCritical,
+	"circuit_breaker":       PriorityCritical,
+	"leader_elected":        PriorityCritical,
+	"leader_lost":           PriorityCritical,
+	"config_reloaded":       PriorityCritical,
+	"credential_rotated":    PriorityCritical,
+	endpointDiscoveredEvent: PriorityCritical,
+	"report":                PriorityAggregate,
+	"panic_report":          PriorityAggregate,
+	"request_in_progress":   PriorityDebug,
+}
+
+// sendQueue holds points until one of its workers sends them, so a slow
+// registry or backend doesn't hold the requests up.
+type sendQueue struct {
+	size       int
+	policy     string
+	priorities map[string]string
+	workers    int
+	// done is closed once every worker has exited
+	done chan struct{}
+
+	mu sync.Mutex
+	// changed is signalled when points are queued or taken, or the queue is
+	// closed
+	changed *sync.Cond
+	// queued holds the points of each priority rank, oldest first
+	queued [4][]Metrics
+	count  int
+	closed bool
+}
+
+var (
+	sendQueueMu sync.Mutex
+	queue       *sendQueue
+)
+
+// startSendQueue replaces the queue of any previously applied config, keeping
+// it when its settings are unchanged. A replaced queue sends its points in
+// the background.
+func startSendQueue(cfg Config) {
+	sendQueueMu.Lock()
+	defer sendQueueMu.Unlock()
+	if cfg.DisableSendQueue {
+		if queue != nil {
+			queue.close()
+			queue = nil
+		}
+		return
+	}
+	size, workers, policy := cfg.SendQueueSize, cfg.SendQueueWorkers, cfg.SendQueuePolicy
+	if size == 0 {
+		size = defaultSendQueueSize
+	}
+	if workers == 0 {
+		workers = defaultSendQueueWorkers
+	}
+	if policy == "" {
+		policy = DropOldest
+	}
+	priorities := maps.Clone(defaultPriorities)
+	maps.Copy(priorities, cfg.SendQueuePriorities)
+	if queue != nil && queue.size == size && queue.workers == workers && queue.policy == policy && maps.Equal(queue.priorities, priorities) {
+		return
+	}
+	if queue != nil {
+		queue.close()
+	}
+	queue = newSendQueue(size, policy, priorities)
+	queue.start(workers)
+}
+
+func newSendQueue(size int, policy string, priorities map[string]string) *sendQueue {
+	q := &sendQueue{size: size, policy: policy, priorities: priorities, done: make(chan struct{})}
+	q.changed = sync.NewCond(&q.mu)
+	return q
+}
+
+// start starts the workers sending the points of the queue.
+func (q *sendQueue) start(workers int) {
+	q.workers = workers
+	var running sync.WaitGroup
+	running.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer running.Done()
+			q.run()
+		}()
+	}
+	go func() {
+		running.Wait()
+		close(q.done)
+	}()
+}
+
+// stopSendQueue sends the queued points and stops the queue.
+func stopSendQueue(ctx context.Context) error {
+	sendQueueMu.Lock()
+	q := queue
+	queue = nil
+	sendQueueMu.Unlock()
+	if q == nil {
+		return nil
+	}
+	q.close()
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error sending the queued points: %w", ctx.Err())
+	}
+}
+
+// reportPoint sends the point of a request, through the send queue when there
+// is one. Failures are logged.
+func reportPoint(metrics Metrics) {
+	if err := enqueuePoint(requestPoints, metrics); err != nil {
+		logSendError(err)
+	}
+}
+
+// enqueuePoint sends a point of a kind (requestPoints, aggregatePoints or the
+// name of an event) through the send queue, at the priority of the kind, or
+// right away when there is no queue. Only the errors of points sent right
+// away are returned; the queue logs the others.
+func enqueuePoint(kind string, metrics Metrics) error {
+	sendQueueMu.Lock()
+	q := queue
+	sendQueueMu.Unlock()
+	if q == nil {
+		return sendMetrics(metrics)
+	}
+	// Timestamped now rather than when it leaves the queue
+	stampPoint(&metrics, time.Now())
+	if kind == requestPoints {
+		if metrics.Fields == nil {
+			metrics.Fields = map[string]interface{}{}
+		}
+		metrics.Fields["dropped_points"] = droppedPoints.Load()
+	}
+	if !q.add(metrics, q.rank(kind)) {
+		return sendMetrics(metrics)
+	}
+	return nil
+}
+
+// rank returns the priority rank of a kind of points.
+func (q *sendQueue) rank(kind string) int {
+	if priority, ok := q.priorities[kind]; ok {
+		return priorityRanks[priority]
+	}
+	return priorityRanks[PriorityRequest]
+}
+
+// add queues a point of a priority rank, and reports false if the queue is
+// closed. A full queue first drops the oldest point of the lowest rank below
+// rank, then applies the policy; points of higher ranks are never dropped
+// for it.
+func (q *sendQueue) add(metrics Metrics, rank int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed {
+			return false
+		}
+		if q.count < q.size {
+			q.queued[rank] = append(q.queued[rank], metrics)
+			q.count++
+			q.changed.Broadcast()
+			return true
+		}
+		lowest := q.lowestRank()
+		switch {
+		case lowest < rank:
+			q.dropOldest(lowest)
+		case q.policy == Block:
+			q.changed.Wait()
+		case q.policy == DropOldest && lowest == rank:
+			q.dropOldest(rank)
+		default:
+			droppedPoints.Add(1)
+			return true
+		}
+	}
+}
+
+// lowestRank returns the lowest rank with points queued.
+func (q *sendQueue) lowestRank() int {
+	for rank := range q.queued {
+		if len(q.queued[rank]) > 0 {
+			return rank
+		}
+	}
+	return len(q.queued)
+}
+
+func (q *sendQueue) dropOldest(rank int) {
+	q.queued[rank][0] = Metrics{}
+	q.queued[rank] = q.queued[rank][1:]
+	q.count--
+	droppedPoints.Add(1)
+}
+
+// take returns the oldest point of the highest rank, waiting for one, and
+// false once the queue is closed and empty.
+func (q *sendQueue) take() (Metrics, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.count == 0 && !q.closed {
+		q.changed.Wait()
+	}
+	for rank := len(q.queued) - 1; rank >= 0; rank-- {
+		if len(q.queued[rank]) > 0 {
+			metrics := q.queued[rank][0]
+			q.queued[rank][0] = Metrics{}
+			q.queued[rank] = q.queued[rank][1:]
+			q.count--
+			q.changed.Broadcast()
+			return metrics, true
+		}
+	}
+	return Metrics{}, false
+}
+
+// depth returns how many points are queued.
+func (q *sendQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// close stops accepting points; the workers send the queued ones and exit.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.changed.Broadcast()
+}
+
+func (q *sendQueue) run() {
+	for {
+		metrics, ok := q.take()
+		if !ok {
+			return
+		}
+		if err := sendMetrics(metrics); err != nil {
+			logSendError(err)
+		}
+	}
+}
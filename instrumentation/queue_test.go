@@ -0,0 +1,195 @@
+package instrumentation
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendQueuePolicies(t *testing.T) {
+	for policy, want := range map[string][]int{DropOldest: {1, 2}, DropNewest: {0, 1}} {
+		q := newSendQueue(2, policy, defaultPriorities)
+		before := DroppedPoints()
+		for i := 0; i < 3; i++ {
+			q.add(Metrics{Fields: map[string]interface{}{"i": i}}, q.rank(requestPoints))
+		}
+		if dropped := DroppedPoints() - before; dropped != 1 {
+			t.Errorf("%s dropped %d points, want 1", policy, dropped)
+		}
+		for _, i := range want {
+			if point, _ := q.take(); point.Fields["i"] != i {
+				t.Errorf("%s kept point %v, want %d", policy, point.Fields["i"], i)
+			}
+		}
+	}
+}
+
+func TestSendQueueBlocks(t *testing.T) {
+	q := newSendQueue(1, Block, defaultPriorities)
+	q.add(Metrics{}, q.rank(requestPoints))
+	added := make(chan struct{})
+	go func() {
+		q.add(Metrics{}, q.rank(requestPoints))
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("point added to a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	q.take()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("point not added once the queue had room")
+	}
+}
+
+func TestSendQueueDropsLowPriorityFirst(t *testing.T) {
+	priorities := map[string]string{requestPoints: PriorityRequest, "request_in_progress": PriorityDebug, pipelineEvent: PriorityCritical, aggregatePoints: PriorityAggregate}
+	q := newSendQueue(3, DropNewest, priorities)
+	point := func(kind string) Metrics { return Metrics{Tags: map[string]string{"kind": kind}} }
+	before := DroppedPoints()
+	for _, kind := range []string{"request_in_progress", requestPoints, requestPoints, aggregatePoints, pipelineEvent, requestPoints} {
+		q.add(point(kind), q.rank(kind))
+	}
+	// The debug point and a request point made room for the aggregate and
+	// the pipeline event; the last request point found only higher classes.
+	if dropped := DroppedPoints() - before; dropped != 3 {
+		t.Errorf("dropped %d points, want 3", dropped)
+	}
+	for _, want := range []string{pipelineEvent, aggregatePoints, requestPoints} {
+		if got, _ := q.take(); got.Tags["kind"] != want {
+			t.Errorf("took a %s point, want %s", got.Tags["kind"], want)
+		}
+	}
+	if q.depth() != 0 {
+		t.Errorf("depth = %d, want 0", q.depth())
+	}
+}
+
+func TestSendQueueBlockMakesRoomForHigherPriority(t *testing.T) {
+	q := newSendQueue(1, Block, defaultPriorities)
+	q.add(Metrics{}, q.rank(requestPoints))
+	added := make(chan struct{})
+	go func() {
+		q.add(Metrics{Tags: map[string]string{"event": pipelineEvent}}, q.rank(pipelineEvent))
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("critical point blocked by a request point")
+	}
+	if got, _ := q.take(); got.Tags["event"] != pipelineEvent {
+		t.Errorf("took %v, want the pipeline event", got.Tags)
+	}
+}
+
+func TestMiddlewareSendsThroughQueue(t *testing.T) {
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithSendQueue(16, DropOldest)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/queue/orders", nil))
+	metrics := nextMetrics(t)
+	if metrics.Tags["endpoint"] != "/queue/orders" || metrics.Fields["dropped_points"] != float64(DroppedPoints()) {
+		t.Errorf("point = %v %v, want the request with dropped_points", metrics.Tags, metrics.Fields)
+	}
+}
+
+func TestSendQueueWorkers(t *testing.T) {
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithSendQueueWorkers(3)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	sendQueueMu.Lock()
+	workers := queue.workers
+	sendQueueMu.Unlock()
+	if workers != 3 {
+		t.Errorf("workers = %d, want 3", workers)
+	}
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	want := map[string]bool{}
+	for _, name := range []string{"orders", "users", "carts", "items", "tags"} {
+		endpoint := "/workers/" + name
+		want[endpoint] = true
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, endpoint, nil))
+	}
+	// The workers send the points in any order.
+	for i := len(want); i > 0; i-- {
+		metrics := nextMetrics(t)
+		if !want[metrics.Tags["endpoint"]] {
+			t.Errorf("unexpected point %v", metrics.Tags)
+		}
+		delete(want, metrics.Tags["endpoint"])
+	}
+}
+
+func TestSendQueueByDefault(t *testing.T) {
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := Configure(collectorURL, "test-service", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	sendQueueMu.Lock()
+	q := queue
+	sendQueueMu.Unlock()
+	if q == nil || q.size != defaultSendQueueSize || q.workers != defaultSendQueueWorkers || q.policy != DropOldest {
+		t.Fatalf("queue = %+v, want the default queue", q)
+	}
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/default-queue/orders", nil))
+	if metrics := nextMetrics(t); metrics.Tags["endpoint"] != "/default-queue/orders" {
+		t.Errorf("point = %v, want the request", metrics.Tags)
+	}
+}
+
+func TestWithoutSendQueue(t *testing.T) {
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	sendQueueMu.Lock()
+	q := queue
+	sendQueueMu.Unlock()
+	if q != nil {
+		t.Fatal("send queue started")
+	}
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/sync/orders", nil))
+	if metrics := nextMetrics(t); metrics.Tags["endpoint"] != "/sync/orders" {
+		t.Errorf("point = %v, want the request", metrics.Tags)
+	}
+}
+
+func TestValidateSendQueuePolicy(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "orders", SendQueueSize: 100, SendQueuePolicy: "drop_random"}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 1 || validationErr.Errors[0].Field != "send_queue_policy" {
+		t.Errorf("Validate() = %v, want the policy rejected", err)
+	}
+
+	cfg = Config{RegistryURL: "ws://registry", ServiceName: "orders", SendQueueSize: 100}
+	WithSendQueuePriority("report", "urgent")(&cfg)
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 1 || validationErr.Errors[0].Field != "send_queue_priorities.report" {
+		t.Errorf("Validate() = %v, want the priority rejected", err)
+	}
+}
@@ -0,0 +1,108 @@
+package instrumentation
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errRateLimited is returned for frames not written to the registry because
+// they are over Config.RateLimit.
+var errRateLimited = errors.New("over the registry rate limit")
+
+// RateLimitConfig caps what is written to the registry, so a traffic spike
+// can't saturate the registry link. Each cap is a token bucket holding one
+// second's worth: a frame is written when both buckets hold its points and
+// encoded bytes, which are taken from them. A batch larger than a bucket goes
+// when the bucket is full, leaving it in debt. Frames over a cap are dropped, as sampled out,
+// and counted in the points_dropped and points_rate_limited fields of the
+// pipeline event; spilled points wait for the next replay instead.
+type RateLimitConfig struct {
+	// PointsPerSecond caps the points written per second. Zero means no cap.
+	PointsPerSecond float64 `json:"points_per_second"`
+	// BytesPerSecond caps the bytes of the frames written per second. Zero
+	// means no cap.
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// tokenBucket refills at rate tokens per second, up to a second's worth. A
+// nil bucket never runs out.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate}
+}
+
+// refill adds the tokens earned since the last refill.
+func (b *tokenBucket) refill(now time.Time) {
+	if b == nil {
+		return
+	}
+	if !b.last.IsZero() {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	}
+	b.last = now
+}
+
+// holds reports whether n tokens can be taken: the bucket holds them, or is
+// full when n is more than it can hold.
+func (b *tokenBucket) holds(n int) bool {
+	return b == nil || b.tokens >= min(float64(n), b.rate)
+}
+
+func (b *tokenBucket) take(n int) {
+	if b != nil {
+		b.tokens -= float64(n)
+	}
+}
+
+// rateLimiter applies a RateLimitConfig to the frames written to the
+// registry. A nil limiter allows everything.
+type rateLimiter struct {
+	mu     sync.Mutex
+	points *tokenBucket
+	bytes  *tokenBucket
+	// limited counts the points dropped since the last frame allowed
+	limited int64
+}
+
+// newRateLimiter returns the limiter of cfg, nil when it caps nothing.
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	if cfg.PointsPerSecond <= 0 && cfg.BytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{points: newTokenBucket(cfg.PointsPerSecond), bytes: newTokenBucket(cfg.BytesPerSecond)}
+}
+
+// allow reports whether a frame of points encoded in size bytes may be
+// written now, taking them from the buckets if so.
+func (l *rateLimiter) allow(points, size int, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	l.points.refill(now)
+	l.bytes.refill(now)
+	if !l.points.holds(points) || !l.bytes.holds(size) {
+		l.limited += int64(points)
+		l.mu.Unlock()
+		return false
+	}
+	l.points.take(points)
+	l.bytes.take(size)
+	limited := l.limited
+	l.limited = 0
+	l.mu.Unlock()
+	if limited > 0 {
+		log.Printf("Dropped %d points over the registry rate limit\n", limited)
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package instrumentation
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterPoints(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{PointsPerSecond: 2})
+	start := time.Unix(0, 0)
+	for i, frame := range []struct {
+		at     time.Duration
+		points int
+		want   bool
+	}{
+		{0, 1, true},
+		{0, 1, true},
+		{0, 1, false},
+		{500 * time.Millisecond, 1, true},
+		{500 * time.Millisecond, 1, false},
+		// A batch larger than the bucket goes once it is full, leaving it
+		// in debt
+		{3 * time.Second, 5, true},
+		{4 * time.Second, 1, false},
+		{5500 * time.Millisecond, 2, true},
+	} {
+		if got := l.allow(frame.points, 10, start.Add(frame.at)); got != frame.want {
+			t.Errorf("frame %d of %d points at %v allowed = %v, want %v", i, frame.points, frame.at, got, frame.want)
+		}
+	}
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{BytesPerSecond: 100})
+	start := time.Unix(0, 0)
+	if !l.allow(50, 60, start) {
+		t.Error("first frame refused")
+	}
+	if l.allow(1, 60, start) {
+		t.Error("frame over the bytes left allowed")
+	}
+	if !l.allow(1, 60, start.Add(200*time.Millisecond)) {
+		t.Error("frame refused once the bucket refilled")
+	}
+	if newRateLimiter(RateLimitConfig{}) != nil {
+		t.Error("a limiter was built without caps")
+	}
+	var none *rateLimiter
+	if !none.allow(1000, 1<<20, start) {
+		t.Error("a nil limiter refused a frame")
+	}
+}
+
+func TestRateLimitDropsPointsOverTheCap(t *testing.T) {
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithRateLimit(1, 0), WithPipelineMetrics(time.Hour), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if err := sendMetrics(Metrics{Measurement: "test-service", Fields: map[string]interface{}{"i": i}}); err != nil {
+			t.Errorf("point %d: %v, want points over the cap dropped silently", i, err)
+		}
+	}
+	if point := nextMetrics(t); point.Fields["i"] != float64(0) {
+		t.Errorf("point = %+v, want the first one", point)
+	}
+
+	// Lifts the cap, keeping the pipeline metrics, so the report gets through
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithPipelineMetrics(time.Hour), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	currentPipeline().report()
+	fields := nextPipelineEvent(t).Fields
+	if fields["points_rate_limited"] != float64(2) || fields["points_dropped"] != float64(2) || fields["points_sent"] != float64(1) {
+		t.Errorf("pipeline fields = %v, want 2 points rate limited and dropped, 1 sent", fields)
+	}
+}
+
+func TestValidateRateLimit(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "orders", RateLimit: RateLimitConfig{PointsPerSecond: -1}}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 1 || validationErr.Errors[0].Field != "rate_limit.points_per_second" {
+		t.Errorf("Validate() = %v, want rate_limit.points_per_second rejected", err)
+	}
+}
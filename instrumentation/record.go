@@ -0,0 +1,332 @@
+package instrumentation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestIDHeader is the request header a client- or proxy-assigned request ID
+// is taken from.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request IDs accepted from RequestIDHeader.
+const maxRequestIDLength = 128
+
+// abortReasonTag is the tag Abort sets.
+const abortReasonTag = "abort_reason"
+
+// Hops of a request served through a gateway translating it for a backend,
+// e.g. grpc-gateway in front of a gRPC service, tagged as hop; see SetHop.
+const (
+	HopGateway = "gateway"
+	HopBackend = "backend"
+)
+
+// maxUpstreamAttemptTag caps the upstream_attempt tag: later attempts are
+// tagged "5+".
+const maxUpstreamAttemptTag = 5
+
+// RequestRecord is the in-progress record of a request being instrumented.
+// Application code reaches it with FromContext to read the request ID or add
+// to the point that will be reported once the handler returns. Its methods
+// are safe for concurrent use.
+type RequestRecord struct {
+	// StartTime is when the middleware started timing the request.
+	StartTime time.Time
+
+	mu          sync.Mutex
+	requestID   string
+	tags        map[string]string
+	fields      map[string]interface{}
+	abortReason string
+	// Calls to dependencies made while serving the request
+	downstreamCalls   int64
+	downstreamTime    time.Duration
+	slowestDependency string
+	slowestDownstream time.Duration
+	// The upstream a proxy layer sent the request to, and its attempt
+	upstream        string
+	upstreamAttempt int
+	// The upstream and round trips seen by InstrumentReverseProxy, for when
+	// SetUpstream isn't called
+	upstreamHost       string
+	upstreamTrips      int
+	upstreamTime       time.Duration
+	upstreamErrorClass string
+	// The hop of the request, HopGateway or HopBackend
+	hop string
+	// Time spent in the middleware layers wrapped by Instrument, by field
+	layers map[string]time.Duration
+
+	// Set by adapters through SetRoute and its siblings, from the request's
+	// own goroutine
+	route            string
+	clientIP         string
+	failed           *bool
+	err              error
+	responseSet      bool
+	statusCode       int
+	responseSize     int
+	frameworkContext interface{}
+}
+
+// requestRecordKey is the context key of the RequestRecord of a request.
+type requestRecordKey struct{}
+
+// NewRequestRecord starts the record of a request. requestID is the ID taken
+// from RequestIDHeader, if any; it is ignored unless it looks like an ID.
+// Middleware does this itself; adapters reporting through Report pass the
+// record in Observation.Record and store it under RecordContextKey.
+func NewRequestRecord(requestID string) *RequestRecord {
+	rec := &RequestRecord{StartTime: time.Now()}
+	if ValidRequestID(requestID) {
+		// Framework buffers (fiber, fasthttp) may back requestID
+		rec.requestID = strings.Clone(requestID)
+	}
+	return rec
+}
+
+// RecordContextKey is the key FromContext looks the record up with, for
+// frameworks whose request context stores values by key (fasthttp's
+// SetUserValue, Fiber's Locals).
+func RecordContextKey() interface{} {
+	return requestRecordKey{}
+}
+
+// contextWithRecord returns a copy of ctx carrying rec.
+func contextWithRecord(ctx context.Context, rec *RequestRecord) context.Context {
+	return context.WithValue(ctx, requestRecordKey{}, rec)
+}
+
+// FromContext returns the record of the request ctx belongs to, or nil when
+// the request isn't being instrumented.
+func FromContext(ctx context.Context) *RequestRecord {
+	rec, _ := ctx.Value(requestRecordKey{}).(*RequestRecord)
+	return rec
+}
+
+// RequestID returns the request's ID: the one from RequestIDHeader, or one
+// generated on first use. It is reported as the request_id field.
+func (rec *RequestRecord) RequestID() string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.requestID == "" {
+		var id [8]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			// crypto/rand doesn't fail on supported platforms
+			panic(err)
+		}
+		rec.requestID = hex.EncodeToString(id[:])
+	}
+	return rec.requestID
+}
+
+// Tags returns a copy of the tags added so far with SetTag and Abort.
+func (rec *RequestRecord) Tags() map[string]string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	tags := make(map[string]string, len(rec.tags)+1)
+	for key, value := range rec.tags {
+		tags[key] = value
+	}
+	if rec.abortReason != "" {
+		tags[abortReasonTag] = rec.abortReason
+	}
+	return tags
+}
+
+// SetTag adds a tag to the request's point, with the same rules as
+// WithTagExtractor: built-in tags can't be replaced and each key is capped at
+// MaxTagValues distinct values.
+func (rec *RequestRecord) SetTag(key, value string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.tags == nil {
+		rec.tags = make(map[string]string)
+	}
+	rec.tags[key] = value
+}
+
+// SetField adds a field to the request's point, with the same rules as
+// WithFieldExtractor.
+func (rec *RequestRecord) SetField(key string, value interface{}) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.fields == nil {
+		rec.fields = make(map[string]interface{})
+	}
+	rec.fields[key] = value
+}
+
+// Abort marks the request as failed whatever its status code, and tags the
+// point with reason as abort_reason. Use a fixed set of reasons; the tag is
+// capped like any custom tag.
+func (rec *RequestRecord) Abort(reason string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.abortReason = reason
+}
+
+// RecordDownstreamCall adds a call to dependency (a host, service or
+// database name) that took latency to the request ctx belongs to, if it is
+// being instrumented. The request's point then sums its calls up as
+// downstream_calls, downstream_time_ms, and the slowest_dependency with its
+// slowest_dependency_ms. Calls made through WrapTransport are added with
+// their host; call it for gRPC, database and other clients.
+func RecordDownstreamCall(ctx context.Context, dependency string, latency time.Duration) {
+	rec := FromContext(ctx)
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.downstreamCalls++
+	rec.downstreamTime += latency
+	if rec.slowestDependency == "" || latency > rec.slowestDownstream {
+		rec.slowestDependency = dependency
+		rec.slowestDownstream = latency
+	}
+}
+
+// SetUpstream tags the point of the request ctx belongs to, if it is being
+// instrumented, with the upstream a proxy layer sent it to: target, a backend
+// name or address out of a fixed set, as upstream, and attempt, 1 for the
+// first try, as upstream_attempt. A proxy retrying calls it on each attempt;
+// the last one is reported, with upstream_retries.
+//
+//	proxy.Rewrite = func(r *httputil.ProxyRequest) {
+//		backend := pool.Next()
+//		r.SetURL(backend.URL)
+//		instrumentation.SetUpstream(r.In.Context(), backend.Name, 1)
+//	}
+func SetUpstream(ctx context.Context, target string, attempt int) {
+	rec := FromContext(ctx)
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.upstream = target
+	rec.upstreamAttempt = max(attempt, 1)
+}
+
+// SetHop tags the point of the request ctx belongs to, if it is being
+// instrumented, with its hop, HopGateway or HopBackend; other values are
+// ignored. The gRPC client interceptor of a gateway configured as one calls
+// it, so that the HTTP point and the backend's point of a request, sharing
+// its request_id, tell which side they measured.
+func SetHop(ctx context.Context, hop string) {
+	rec := FromContext(ctx)
+	if rec == nil || (hop != HopGateway && hop != HopBackend) {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.hop = hop
+}
+
+// startUpstreamTrip counts a round trip of the request to host.
+func (rec *RequestRecord) startUpstreamTrip(host string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.upstreamHost = host
+	rec.upstreamTrips++
+}
+
+// addUpstreamTime adds the time an upstream took to answer.
+func (rec *RequestRecord) addUpstreamTime(d time.Duration) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.upstreamTime += d
+}
+
+// setUpstreamError records how the upstream failed.
+func (rec *RequestRecord) setUpstreamError(class string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.upstreamErrorClass = class
+}
+
+// addLayerTime adds the time spent in a middleware layer.
+func (rec *RequestRecord) addLayerTime(field string, d time.Duration) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.layers == nil {
+		rec.layers = make(map[string]time.Duration)
+	}
+	rec.layers[field] += d
+}
+
+// aborted reports whether Abort was called.
+func (rec *RequestRecord) aborted() bool {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.abortReason != ""
+}
+
+// apply adds what was recorded to a point.
+func (rec *RequestRecord) apply(tags map[string]string, fields map[string]interface{}) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	addCustomTags(tags, rec.tags)
+	if rec.abortReason != "" {
+		tags[abortReasonTag] = limitTagValue(abortReasonTag, rec.abortReason)
+	}
+	addCustomFields(fields, rec.fields)
+	if rec.requestID != "" {
+		fields["request_id"] = rec.requestID
+	}
+	if rec.downstreamCalls > 0 {
+		fields["downstream_calls"] = rec.downstreamCalls
+		fields["downstream_time_ms"] = rec.downstreamTime.Milliseconds()
+		fields["slowest_dependency"] = rec.slowestDependency
+		fields["slowest_dependency_ms"] = rec.slowestDownstream.Milliseconds()
+	}
+	upstream, upstreamAttempt := rec.upstream, max(rec.upstreamAttempt, rec.upstreamTrips)
+	if upstream == "" {
+		upstream = rec.upstreamHost
+	}
+	if upstream != "" {
+		tags["upstream"] = limitTagValue("upstream", upstream)
+		attempt := strconv.Itoa(upstreamAttempt)
+		if upstreamAttempt >= maxUpstreamAttemptTag {
+			attempt = strconv.Itoa(maxUpstreamAttemptTag) + "+"
+		}
+		tags["upstream_attempt"] = attempt
+		fields["upstream_retries"] = upstreamAttempt - 1
+	}
+	if rec.upstreamTime > 0 {
+		fields["upstream_latency_ms"] = rec.upstreamTime.Milliseconds()
+	}
+	if rec.upstreamErrorClass != "" {
+		tags["upstream_error_class"] = rec.upstreamErrorClass
+	}
+	if rec.hop != "" {
+		tags["hop"] = rec.hop
+	}
+	for field, d := range rec.layers {
+		fields[field] = float64(d.Microseconds()) / 1000
+	}
+}
+
+// ValidRequestID accepts IDs of up to 128 letters, digits and "-_.:", as the
+// header, or metadata, carrying them comes from the client.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package instrumentation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromContextEnrichesPoint(t *testing.T) {
+	var requestID string
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := FromContext(r.Context())
+		if rec == nil {
+			t.Fatal("FromContext returned nil inside Middleware")
+		}
+		requestID = rec.RequestID()
+		rec.SetTag("plan", "gold")
+		rec.SetTag("endpoint", "/spoofed")
+		rec.SetField("items_in_cart", 3)
+		if got := rec.Tags()["plan"]; got != "gold" {
+			t.Errorf("Tags()[plan] = %q, want gold", got)
+		}
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/record/enrich", nil)
+	req.Header.Set(RequestIDHeader, "req-42")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	metrics := nextMetrics(t)
+	if requestID != "req-42" || metrics.Fields["request_id"] != "req-42" {
+		t.Errorf("request ID = %q, request_id = %v, want req-42", requestID, metrics.Fields["request_id"])
+	}
+	if metrics.Tags["plan"] != "gold" || metrics.Tags["endpoint"] != "/record/enrich" {
+		t.Errorf("tags = %v, want plan added and endpoint untouched", metrics.Tags)
+	}
+	if metrics.Fields["items_in_cart"] != float64(3) {
+		t.Errorf("items_in_cart = %v, want 3", metrics.Fields["items_in_cart"])
+	}
+}
+
+func TestAbortMarksRequestFailed(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Abort("quota_exceeded")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/record/abort", nil)
+	// Not an acceptable ID, so none is reported unless the handler asks
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	metrics := nextMetrics(t)
+	if metrics.Tags["abort_reason"] != "quota_exceeded" {
+		t.Errorf("abort_reason = %q, want quota_exceeded", metrics.Tags["abort_reason"])
+	}
+	if metrics.Fields["error_count"] != float64(1) {
+		t.Errorf("error_count = %v, want 1", metrics.Fields["error_count"])
+	}
+	if id, ok := metrics.Fields["request_id"]; ok {
+		t.Errorf("request_id = %v, want none", id)
+	}
+}
+
+func TestRequestIDIsGenerated(t *testing.T) {
+	rec := NewRequestRecord("")
+	id := rec.RequestID()
+	if len(id) != 16 || rec.RequestID() != id {
+		t.Errorf("RequestID() = %q, want a stable 16 character ID", id)
+	}
+	if FromContext(context.Background()) != nil {
+		t.Error("FromContext found a record in a plain context")
+	}
+}
+
+func TestSetUpstreamTagsPoint(t *testing.T) {
+	for _, attempts := range []int{1, 2, 7} {
+		handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for attempt := 1; attempt <= attempts; attempt++ {
+				SetUpstream(r.Context(), "orders-v2", attempt)
+			}
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/record/upstream", nil))
+
+		metrics := nextMetrics(t)
+		wantAttempt := map[int]string{1: "1", 2: "2", 7: "5+"}[attempts]
+		if metrics.Tags["upstream"] != "orders-v2" || metrics.Tags["upstream_attempt"] != wantAttempt {
+			t.Errorf("%d attempts: upstream, upstream_attempt = %q, %q, want orders-v2, %s", attempts, metrics.Tags["upstream"], metrics.Tags["upstream_attempt"], wantAttempt)
+		}
+		if metrics.Fields["upstream_retries"] != float64(attempts-1) {
+			t.Errorf("%d attempts: upstream_retries = %v", attempts, metrics.Fields["upstream_retries"])
+		}
+	}
+
+	// Outside an instrumented request it does nothing
+	SetUpstream(context.Background(), "orders-v2", 1)
+}
+
+func TestSetHopTagsPoint(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetHop(r.Context(), "edge")
+		SetHop(r.Context(), HopGateway)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/record/hop", nil))
+	if metrics := nextMetrics(t); metrics.Tags["hop"] != HopGateway {
+		t.Errorf("hop = %q, want %s", metrics.Tags["hop"], HopGateway)
+	}
+
+	// Outside an instrumented request it does nothing
+	SetHop(context.Background(), HopGateway)
+}
@@ -0,0 +1,133 @@
+package instrumentation
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+// activeConfig is the configuration last applied by ApplyConfig or a reload.
+var activeConfig atomic.Pointer[Config]
+
+// ConfigChange is one field changed by a configuration reload.
+type ConfigChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// ConfigReload describes the outcome of reloading the configuration file.
+type ConfigReload struct {
+	// Changes lists the settings that were applied.
+	Changes []ConfigChange
+	// Ignored lists changed fields that only take effect after a restart.
+	Ignored []string
+	// Err is set when the file could not be read or failed validation, in
+	// which case the running configuration is left untouched.
+	Err error
+}
+
+// reloadConfig applies the reloadable fields of the file at path on top of the
+// active configuration.
+func reloadConfig(path string) ConfigReload {
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		log.Printf("Config reload rejected, keeping the running config: %v\n", err)
+		return ConfigReload{Err: err}
+	}
+
+	var current Config
+	if active := activeConfig.Load(); active != nil {
+		current = *active
+	}
+	merged, ignored := mergeReloadable(current, loaded)
+	if err := merged.Validate(); err != nil {
+		return ConfigReload{Err: err}
+	}
+	changes := diffConfig(current, merged)
+
+	storeSettings(newSettings(merged))
+	activeConfig.Store(&merged)
+
+	if len(ignored) > 0 {
+		log.Printf("Config reload ignored fields that need a restart: %s\n", strings.Join(ignored, ", "))
+	}
+	if len(changes) > 0 {
+		emitConfigReloaded(changes)
+	}
+	return ConfigReload{Changes: changes, Ignored: ignored}
+}
+
+// mergeReloadable copies every reloadable field of loaded onto current, and
+// lists the restart-only fields that differ.
+func mergeReloadable(current, loaded Config) (Config, []string) {
+	merged := current
+	var ignored []string
+	mv := reflect.ValueOf(&merged).Elem()
+	lv := reflect.ValueOf(loaded)
+	t := mv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := configFieldName(field)
+		if name == "" {
+			// Code-only fields such as PathNormalizer aren't in the file
+			continue
+		}
+		if field.Tag.Get("reload") == "restart" {
+			if !reflect.DeepEqual(mv.Field(i).Interface(), lv.Field(i).Interface()) {
+				ignored = append(ignored, name)
+			}
+			continue
+		}
+		mv.Field(i).Set(lv.Field(i))
+	}
+	return merged, ignored
+}
+
+// diffConfig lists the file-configurable fields that differ between two configs.
+func diffConfig(old, updated Config) []ConfigChange {
+	var changes []ConfigChange
+	ov := reflect.ValueOf(old)
+	uv := reflect.ValueOf(updated)
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := configFieldName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		if before, after := ov.Field(i).Interface(), uv.Field(i).Interface(); !reflect.DeepEqual(before, after) {
+			changes = append(changes, ConfigChange{Field: name, Old: before, New: after})
+		}
+	}
+	return changes
+}
+
+// configFieldName returns a field's name in configuration files, or "" for
+// fields that can only be set in code.
+func configFieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// emitConfigReloaded reports a reload to the registry as an event point.
+func emitConfigReloaded(changes []ConfigChange) {
+	fieldNames := make([]string, len(changes))
+	for i, change := range changes {
+		fieldNames[i] = change.Field
+	}
+	diff, err := json.Marshal(changes)
+	if err != nil {
+		log.Printf("Error encoding config diff: %v\n", err)
+		return
+	}
+
+	sendEvent("config_reloaded", nil, map[string]interface{}{
+		"changed_fields": strings.Join(fieldNames, ","),
+		"diff":           string(diff),
+	})
+}
@@ -0,0 +1,23 @@
+package instrumentation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatchConfigKeepsRunningConfigOnInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instrumentation.json")
+	if err := os.WriteFile(path, []byte(`{"max_endpoints": -1}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	before := activeConfig.Load()
+
+	reload := reloadConfig(path)
+	if reload.Err == nil {
+		t.Fatal("expected a validation error")
+	}
+	if activeConfig.Load() != before {
+		t.Error("invalid config replaced the running config")
+	}
+}
@@ -0,0 +1,332 @@
+package instrumentation
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRemoteWriteBatchSize     = 500
+	defaultRemoteWriteFlushInterval = 10 * time.Second
+	remoteWriteSubmitTimeout        = 10 * time.Second
+	// remoteWriteMaxPendingBatches bounds the series waiting to be written
+	// while the receiver is slow, in batches
+	remoteWriteMaxPendingBatches = 10
+	remoteWriteVersion           = "0.1.0"
+)
+
+// RemoteWriteConfig pushes every point with the Prometheus remote_write
+// protocol, to Mimir, Cortex, Thanos Receive or Prometheus itself, next to
+// the registry or instead of it when RegistryURL is empty. Numeric and
+// boolean fields become the series measurement_field, labeled with Labels and
+// the point's tags but for the client-controlled ip_address and user_agent,
+// as every label combination is a series. Series are written in batches of up
+// to BatchSize (500 if zero) every FlushInterval (10s if zero).
+//
+// Receivers reject a second sample of a series within the same millisecond,
+// so use WithAggregationWindow for busy endpoints.
+type RemoteWriteConfig struct {
+	// URL is the receiver, e.g. "http://mimir:9009/api/v1/push".
+	URL string `json:"url"`
+	// Headers are set on every request, e.g. X-Scope-OrgID for a Mimir
+	// tenant.
+	Headers map[string]string `json:"headers"`
+	// Username and Password authenticate with basic auth, BearerToken with
+	// a bearer token.
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	BearerToken string `json:"bearer_token"`
+	// Labels are added to every series, e.g. {"cluster": "eu-1"}, but for
+	// the tags of the point.
+	Labels        map[string]string `json:"labels"`
+	BatchSize     int               `json:"batch_size"`
+	FlushInterval Duration          `json:"flush_interval"`
+	// Retry retries the batches that couldn't be written.
+	Retry RetryPolicy `json:"retry"`
+}
+
+// remoteWriteLabel is a Label of the remote_write protobuf.
+type remoteWriteLabel struct {
+	name, value string
+}
+
+// remoteWriteSeries is a TimeSeries of the remote_write protobuf, with a
+// single sample.
+type remoteWriteSeries struct {
+	// labels are sorted by name, as receivers expect
+	labels    []remoteWriteLabel
+	value     float64
+	timestamp int64
+}
+
+// remoteWriteExporter writes the series of the points sent.
+type remoteWriteExporter struct {
+	config RemoteWriteConfig
+	batch  *pendingBatch[remoteWriteSeries]
+}
+
+var (
+	remoteWriteMu sync.Mutex
+	remoteWrite   *remoteWriteExporter
+)
+
+// startRemoteWrite replaces the exporter of any previously applied config,
+// keeping it when its config is unchanged. A replaced exporter writes its
+// pending series in the background.
+func startRemoteWrite(cfg Config) {
+	remoteWriteMu.Lock()
+	defer remoteWriteMu.Unlock()
+	if remoteWrite != nil && reflect.DeepEqual(remoteWrite.config, cfg.RemoteWrite) {
+		return
+	}
+	if previous := remoteWrite; previous != nil {
+		previous.batch.stop()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), remoteWriteSubmitTimeout)
+			defer cancel()
+			if err := previous.batch.flush(ctx); err != nil {
+				log.Printf("Error writing metrics to the remote_write receiver: %v\n", err)
+			}
+		}()
+		remoteWrite = nil
+	}
+	if cfg.RemoteWrite.URL == "" {
+		return
+	}
+	e := &remoteWriteExporter{config: cfg.RemoteWrite}
+	e.batch = &pendingBatch[remoteWriteSeries]{
+		size:       cfg.RemoteWrite.BatchSize,
+		maxBatches: remoteWriteMaxPendingBatches,
+		interval:   time.Duration(cfg.RemoteWrite.FlushInterval),
+		timeout:    remoteWriteSubmitTimeout,
+		submit:     e.submit,
+		logError: func(err error) {
+			log.Printf("Error writing metrics to the remote_write receiver: %v\n", err)
+		},
+		droppedFormat: "Dropped %d remote_write series while the receiver was slow\n",
+	}
+	if e.batch.size == 0 {
+		e.batch.size = defaultRemoteWriteBatchSize
+	}
+	if e.batch.interval == 0 {
+		e.batch.interval = defaultRemoteWriteFlushInterval
+	}
+	remoteWrite = e
+	e.batch.start()
+}
+
+// stopRemoteWrite writes the pending series and stops the exporter.
+func stopRemoteWrite(ctx context.Context) error {
+	remoteWriteMu.Lock()
+	e := remoteWrite
+	remoteWrite = nil
+	remoteWriteMu.Unlock()
+	if e == nil {
+		return nil
+	}
+	e.batch.stop()
+	if err := e.batch.flush(ctx); err != nil {
+		return fmt.Errorf("error writing metrics to the remote_write receiver: %w", err)
+	}
+	return nil
+}
+
+// sendToRemoteWrite queues the series of a point when remote_write is
+// configured.
+func sendToRemoteWrite(metrics Metrics) {
+	remoteWriteMu.Lock()
+	e := remoteWrite
+	remoteWriteMu.Unlock()
+	if e != nil {
+		e.batch.add(remoteWriteSeriesOf(metrics, e.config.Labels, time.Now())...)
+	}
+}
+
+// remoteWriteSeriesOf converts the numeric and boolean fields of a point to
+// series; other fields are left out. Points without a timestamp are
+// timestamped now.
+func remoteWriteSeriesOf(metrics Metrics, extraLabels map[string]string, now time.Time) []remoteWriteSeries {
+	labels := make([]remoteWriteLabel, 0, len(metrics.Tags)+len(extraLabels)+1)
+	for key, value := range extraLabels {
+		if _, ok := metrics.Tags[key]; !ok && value != "" {
+			labels = append(labels, remoteWriteLabel{metricName(key), value})
+		}
+	}
+	for key, value := range metrics.Tags {
+		if value != "" && !clientTags[key] {
+			labels = append(labels, remoteWriteLabel{metricName(key), value})
+		}
+	}
+	timestamp := pointTime(metrics, now).UnixMilli()
+
+	var series []remoteWriteSeries
+	for key, value := range metrics.Fields {
+		v, ok := gaugeValue(value)
+		if !ok {
+			continue
+		}
+		s := remoteWriteSeries{
+			labels:    append([]remoteWriteLabel{{"__name__", metricName(metrics.Measurement + "_" + key)}}, labels...),
+			value:     v,
+			timestamp: timestamp,
+		}
+		sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+		series = append(series, s)
+	}
+	return series
+}
+
+// submit writes a batch of series. A batch that can't be written, retries
+// included, is dropped.
+func (e *remoteWriteExporter) submit(ctx context.Context, series []remoteWriteSeries) error {
+	if err := retry(ctx, e.config.Retry, func() error { return e.post(ctx, series) }); err != nil {
+		return fmt.Errorf("dropped %d series: %w", len(series), err)
+	}
+	return nil
+}
+
+// post posts series as a snappy-compressed WriteRequest.
+func (e *remoteWriteExporter) post(ctx context.Context, series []remoteWriteSeries) error {
+	body := appendSnappy(nil, appendWriteRequest(nil, series))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range e.config.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion)
+	if e.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+e.config.BearerToken)
+	} else if e.config.Username != "" {
+		req.SetBasicAuth(e.config.Username, e.config.Password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		// Receivers say which series they rejected and why
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("the remote_write receiver answered %s: %s", resp.Status, bytes.TrimSpace(reason))}
+	}
+	return nil
+}
+
+// appendWriteRequest appends series as a prometheus.WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func appendWriteRequest(b []byte, series []remoteWriteSeries) []byte {
+	var ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, label := range s.labels {
+			msg = protowire.AppendTag(msg[:0], 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, label.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, label.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = protowire.AppendTag(msg[:0], 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
+
+// snappyBlockSize is the span copies can reach back in snappy's reference
+// encoder, which compresses 64KiB blocks independently.
+const snappyBlockSize = 1 << 16
+
+// appendSnappy appends src compressed in the snappy block format, as
+// remote_write requires: the uncompressed length, then literals and copies
+// of 4 bytes or more found with a hash table of the positions of the previous
+// ones.
+func appendSnappy(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	for len(src) > 0 {
+		n := min(len(src), snappyBlockSize)
+		dst = appendSnappyBlock(dst, src[:n])
+		src = src[n:]
+	}
+	return dst
+}
+
+func appendSnappyBlock(dst, src []byte) []byte {
+	// table holds the position + 1 of the last 4 bytes of each hash
+	var table [1 << 14]int32
+	literal := 0
+	for i := 0; i+4 <= len(src); {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := (v * 0x1e35a7bd) >> 18
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != v {
+			i++
+			continue
+		}
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = appendSnappyLiteral(dst, src[literal:i])
+		dst = appendSnappyCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return appendSnappyLiteral(dst, src[literal:])
+}
+
+// appendSnappyLiteral appends a literal of up to snappyBlockSize bytes.
+func appendSnappyLiteral(dst, literal []byte) []byte {
+	n := len(literal) - 1
+	switch {
+	case n < 0:
+		return dst
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	default:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	}
+	return append(dst, literal...)
+}
+
+// appendSnappyCopy appends copies of length bytes from offset back, in the
+// 2-byte form when it fits and 3-byte ones of up to 64 bytes otherwise.
+func appendSnappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := min(length, 64)
+		if n >= 4 && n <= 11 && offset < 2048 {
+			dst = append(dst, byte(offset>>8)<<5|byte(n-4)<<2|1, byte(offset))
+		} else {
+			dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		}
+		length -= n
+	}
+	return dst
+}
@@ -0,0 +1,218 @@
+package instrumentation
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeSnappy decodes the snappy block format, as receivers do.
+func decodeSnappy(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errors.New("invalid length")
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, size int
+		switch tag & 3 {
+		case 0:
+			size = int(tag>>2) + 1
+			src = src[1:]
+			if size > 60 {
+				extra := size - 60
+				size = 1
+				for i := 0; i < extra; i++ {
+					size += int(src[i]) << (8 * i)
+				}
+				src = src[extra:]
+			}
+			if size > len(src) {
+				return nil, errors.New("literal beyond the input")
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+		case 1:
+			size = int(tag>>2&7) + 4
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2:
+			size = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		default:
+			return nil, errors.New("unexpected 5-byte copy")
+		}
+		if offset == 0 || offset > len(dst) {
+			return nil, fmt.Errorf("copy from offset %d of %d bytes", offset, len(dst))
+		}
+		for i := 0; i < size; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != length {
+		return nil, fmt.Errorf("decoded %d bytes, want %d", len(dst), length)
+	}
+	return dst, nil
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 70000)
+	r.Read(random)
+	inputs := [][]byte{nil, []byte("a"), bytes.Repeat([]byte("orders_latency_ms"), 5000), random}
+	for i := 0; i < 20; i++ {
+		b := make([]byte, r.Intn(200000))
+		for j := range b {
+			b[j] = "abcdef"[r.Intn(2+i%4)]
+		}
+		inputs = append(inputs, b)
+	}
+	for i, input := range inputs {
+		compressed := appendSnappy(nil, input)
+		got, err := decodeSnappy(compressed)
+		if err != nil || !bytes.Equal(got, input) {
+			t.Errorf("input %d of %d bytes: decoded %d bytes, %v", i, len(input), len(got), err)
+		}
+	}
+	if compressed := appendSnappy(nil, inputs[2]); len(compressed) > len(inputs[2])/10 {
+		t.Errorf("compressed %d repetitive bytes to %d", len(inputs[2]), len(compressed))
+	}
+}
+
+// decodeWriteRequest decodes the series of a WriteRequest.
+func decodeWriteRequest(t *testing.T, b []byte) []remoteWriteSeries {
+	t.Helper()
+	fields := func(b []byte, each func(num protowire.Number, typ protowire.Type, b []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+			if n = each(num, typ, b); n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	var series []remoteWriteSeries
+	fields(b, func(_ protowire.Number, _ protowire.Type, b []byte) int {
+		ts, n := protowire.ConsumeBytes(b)
+		var s remoteWriteSeries
+		fields(ts, func(num protowire.Number, _ protowire.Type, b []byte) int {
+			msg, n := protowire.ConsumeBytes(b)
+			if num == 1 {
+				var label remoteWriteLabel
+				fields(msg, func(num protowire.Number, _ protowire.Type, b []byte) int {
+					value, n := protowire.ConsumeString(b)
+					if num == 1 {
+						label.name = value
+					} else {
+						label.value = value
+					}
+					return n
+				})
+				s.labels = append(s.labels, label)
+				return n
+			}
+			fields(msg, func(num protowire.Number, _ protowire.Type, b []byte) int {
+				if num == 1 {
+					bits, n := protowire.ConsumeFixed64(b)
+					s.value = math.Float64frombits(bits)
+					return n
+				}
+				v, n := protowire.ConsumeVarint(b)
+				s.timestamp = int64(v)
+				return n
+			})
+			return n
+		})
+		series = append(series, s)
+		return n
+	})
+	return series
+}
+
+func TestRemoteWritePushesSeries(t *testing.T) {
+	requests := make(chan []remoteWriteSeries, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" ||
+			r.Header.Get("X-Prometheus-Remote-Write-Version") != remoteWriteVersion || r.Header.Get("X-Scope-OrgID") != "team-a" ||
+			r.Header.Get("Authorization") != "Bearer rw-token" {
+			t.Errorf("headers = %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		data, err := decodeSnappy(body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests <- decodeWriteRequest(t, data)
+	}))
+	defer server.Close()
+	startRemoteWrite(Config{RemoteWrite: RemoteWriteConfig{
+		URL:           server.URL + "/api/v1/push",
+		Headers:       map[string]string{"X-Scope-OrgID": "team-a"},
+		BearerToken:   "rw-token",
+		Labels:        map[string]string{"cluster": "eu-1", "endpoint": "overridden"},
+		FlushInterval: Duration(time.Hour),
+	}})
+	sendToRemoteWrite(Metrics{
+		Measurement: "orders",
+		Tags:        map[string]string{"endpoint": "/orders", "user_agent": "curl"},
+		Fields:      map[string]interface{}{"latency ms": 12, "error_class": "timeout"},
+		Timestamp:   1700000000123,
+		Precision:   PrecisionMilliseconds,
+	})
+	if err := stopRemoteWrite(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	series := <-requests
+	want := remoteWriteSeries{
+		labels:    []remoteWriteLabel{{"__name__", "orders_latency_ms"}, {"cluster", "eu-1"}, {"endpoint", "/orders"}},
+		value:     12,
+		timestamp: 1700000000123,
+	}
+	if len(series) != 1 || fmt.Sprint(series[0]) != fmt.Sprint(want) {
+		t.Errorf("series = %+v, want %+v", series, want)
+	}
+}
+
+func TestRemoteWriteReportsRejections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	startRemoteWrite(Config{RemoteWrite: RemoteWriteConfig{URL: server.URL, FlushInterval: Duration(time.Hour)}})
+	sendToRemoteWrite(Metrics{Measurement: "orders", Fields: map[string]interface{}{"n": 1}})
+	if err := stopRemoteWrite(context.Background()); err == nil || !strings.Contains(err.Error(), "out of order sample") {
+		t.Errorf("stopRemoteWrite() = %v, want the receiver's reason", err)
+	}
+}
+
+func TestValidateRemoteWrite(t *testing.T) {
+	cfg := Config{ServiceName: "orders", RemoteWrite: RemoteWriteConfig{URL: "ws://mimir", Username: "u", BearerToken: "t"}}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 2 {
+		t.Errorf("Validate() = %v, want the URL and credentials rejected", err)
+	}
+	cfg.RemoteWrite = RemoteWriteConfig{URL: "https://mimir/api/v1/push"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
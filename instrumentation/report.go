@@ -0,0 +1,392 @@
+package instrumentation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// reportRetentionDays is how many daily rollups are kept, enough for a
+	// weekly report and the week before it.
+	reportRetentionDays = 14
+	// defaultTopRegressions is the number of regressions listed when
+	// ReportConfig.TopRegressions is unset.
+	defaultTopRegressions = 5
+	// minRegressionRequests is the number of requests an endpoint needs in
+	// both periods for its p99 to be compared.
+	minRegressionRequests = 20
+	reportWebhookTimeout  = 10 * time.Second
+)
+
+// ReportConfig enables daily and weekly summaries computed from rollups kept
+// in memory by the process. Daily reports cover the previous UTC day and are
+// sent at midnight UTC; weekly ones cover the previous seven days and are sent
+// on Mondays. Each report is sent as report events, one per endpoint, and
+// posted as JSON to WebhookURL when set, e.g. to a chat or email relay.
+type ReportConfig struct {
+	Daily  bool `json:"daily"`
+	Weekly bool `json:"weekly"`
+	// LatencyObjective enables SLO compliance: the fraction of requests that
+	// didn't fail and were served within it.
+	LatencyObjective Duration `json:"latency_objective"`
+	WebhookURL       string   `json:"webhook_url"`
+	// TopRegressions is the number of endpoints with the largest p99 increase
+	// over the previous period listed in a report, 5 by default.
+	TopRegressions int `json:"top_regressions"`
+}
+
+func (c ReportConfig) enabled() bool {
+	return c.Daily || c.Weekly
+}
+
+// PeriodReport summarizes the traffic of every endpoint over a period.
+type PeriodReport struct {
+	Service        string            `json:"service"`
+	InstanceID     string            `json:"instance_id"`
+	Period         string            `json:"period"`
+	Start          time.Time         `json:"start"`
+	End            time.Time         `json:"end"`
+	Endpoints      []EndpointSummary `json:"endpoints"`
+	TopRegressions []Regression      `json:"top_regressions"`
+}
+
+// EndpointSummary is what an endpoint saw during a report period.
+// SLOCompliance is only set when ReportConfig.LatencyObjective is.
+type EndpointSummary struct {
+	Endpoint      string   `json:"endpoint"`
+	Requests      int64    `json:"requests"`
+	Errors        int64    `json:"errors"`
+	ErrorRate     float64  `json:"error_rate"`
+	LatencyP99Ms  float64  `json:"latency_p99_ms"`
+	SLOCompliance *float64 `json:"slo_compliance,omitempty"`
+}
+
+// Regression is an endpoint whose p99 latency grew since the previous period.
+type Regression struct {
+	Endpoint             string  `json:"endpoint"`
+	LatencyP99Ms         float64 `json:"latency_p99_ms"`
+	PreviousLatencyP99Ms float64 `json:"previous_latency_p99_ms"`
+	// Change is the relative increase, 0.5 for 50% slower.
+	Change float64 `json:"change"`
+}
+
+// dailyRollup is what an endpoint saw during one UTC day.
+type dailyRollup struct {
+	latency latencySketch
+	errors  int64
+	// good counts requests that didn't fail and met the latency objective
+	good int64
+}
+
+// rollupStore keeps a dailyRollup per endpoint for the last
+// reportRetentionDays days.
+type rollupStore struct {
+	mu        sync.Mutex
+	objective time.Duration
+	days      map[time.Time]map[string]*dailyRollup
+}
+
+func newRollupStore(objective time.Duration) *rollupStore {
+	return &rollupStore{objective: objective, days: make(map[time.Time]map[string]*dailyRollup)}
+}
+
+// utcDay returns the UTC midnight starting the day of t.
+func utcDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// record adds a request to the rollup of its day and reports whether it met
+// the latency objective.
+func (s *rollupStore) record(endpoint string, latency time.Duration, failed bool, at time.Time) bool {
+	day := utcDay(at)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	endpoints, ok := s.days[day]
+	if !ok {
+		endpoints = make(map[string]*dailyRollup)
+		s.days[day] = endpoints
+		// Drop the days no report will look at anymore
+		oldest := day.AddDate(0, 0, -(reportRetentionDays - 1))
+		for d := range s.days {
+			if d.Before(oldest) {
+				delete(s.days, d)
+			}
+		}
+	}
+	rollup, ok := endpoints[endpoint]
+	if !ok {
+		rollup = &dailyRollup{}
+		endpoints[endpoint] = rollup
+	}
+	rollup.latency.add(latency)
+	if failed {
+		rollup.errors++
+		return false
+	}
+	if s.objective > 0 && latency <= s.objective {
+		rollup.good++
+		return true
+	}
+	return false
+}
+
+// seed adds hourly rollups read from the local store.
+func (s *rollupStore) seed(lines []storedRollup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, line := range lines {
+		sketch, err := line.Latency.sketch()
+		if err != nil {
+			log.Printf("Error loading rollups: %v\n", err)
+			continue
+		}
+		day := utcDay(line.Hour)
+		endpoints, ok := s.days[day]
+		if !ok {
+			endpoints = make(map[string]*dailyRollup)
+			s.days[day] = endpoints
+		}
+		rollup, ok := endpoints[line.Endpoint]
+		if !ok {
+			rollup = &dailyRollup{}
+			endpoints[line.Endpoint] = rollup
+		}
+		rollup.latency.merge(&sketch)
+		rollup.errors += line.Errors
+		rollup.good += line.Good
+	}
+}
+
+// between merges the rollups of each endpoint over the days in [start, end).
+func (s *rollupStore) between(start, end time.Time) map[string]*dailyRollup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	merged := make(map[string]*dailyRollup)
+	for day, endpoints := range s.days {
+		if day.Before(start) || !day.Before(end) {
+			continue
+		}
+		for endpoint, rollup := range endpoints {
+			m, ok := merged[endpoint]
+			if !ok {
+				m = &dailyRollup{}
+				merged[endpoint] = m
+			}
+			m.latency.merge(&rollup.latency)
+			m.errors += rollup.errors
+			m.good += rollup.good
+		}
+	}
+	return merged
+}
+
+// report summarizes [start, end) and compares p99 latencies with the period of
+// the same length before it.
+func (s *rollupStore) report(period string, start, end time.Time, topRegressions int) PeriodReport {
+	current := s.between(start, end)
+	previous := s.between(start.Add(-end.Sub(start)), start)
+
+	report := PeriodReport{Period: period, Start: start, End: end, Endpoints: []EndpointSummary{}, TopRegressions: []Regression{}}
+	for endpoint, rollup := range current {
+		summary := EndpointSummary{
+			Endpoint:     endpoint,
+			Requests:     rollup.latency.count,
+			Errors:       rollup.errors,
+			ErrorRate:    float64(rollup.errors) / float64(rollup.latency.count),
+			LatencyP99Ms: float64(rollup.latency.quantile(0.99)) / 1000,
+		}
+		if s.objective > 0 {
+			compliance := float64(rollup.good) / float64(rollup.latency.count)
+			summary.SLOCompliance = &compliance
+		}
+		report.Endpoints = append(report.Endpoints, summary)
+
+		before, ok := previous[endpoint]
+		if !ok || before.latency.count < minRegressionRequests || rollup.latency.count < minRegressionRequests {
+			continue
+		}
+		previousP99 := float64(before.latency.quantile(0.99)) / 1000
+		if previousP99 > 0 && summary.LatencyP99Ms > previousP99 {
+			report.TopRegressions = append(report.TopRegressions, Regression{
+				Endpoint:             endpoint,
+				LatencyP99Ms:         summary.LatencyP99Ms,
+				PreviousLatencyP99Ms: previousP99,
+				Change:               summary.LatencyP99Ms/previousP99 - 1,
+			})
+		}
+	}
+	sort.Slice(report.Endpoints, func(i, j int) bool {
+		return report.Endpoints[i].Endpoint < report.Endpoints[j].Endpoint
+	})
+	sort.Slice(report.TopRegressions, func(i, j int) bool {
+		a, b := report.TopRegressions[i], report.TopRegressions[j]
+		if a.Change != b.Change {
+			return a.Change > b.Change
+		}
+		return a.Endpoint < b.Endpoint
+	})
+	if topRegressions <= 0 {
+		topRegressions = defaultTopRegressions
+	}
+	if len(report.TopRegressions) > topRegressions {
+		report.TopRegressions = report.TopRegressions[:topRegressions]
+	}
+	return report
+}
+
+// reportScheduler sends the reports of a ReportConfig at every UTC midnight.
+type reportScheduler struct {
+	cfg    ReportConfig
+	store  *rollupStore
+	client *http.Client
+	done   chan struct{}
+}
+
+var (
+	reportsMu sync.Mutex
+	reports   *reportScheduler
+)
+
+// startReports starts the scheduler of cfg.Reports, replacing the one of any
+// previously applied config. Rollups already retained are kept as long as
+// reports stay enabled with the same latency objective.
+func startReports(cfg Config) {
+	reportsMu.Lock()
+	defer reportsMu.Unlock()
+	previous := reports
+	reports = nil
+	if previous != nil {
+		close(previous.done)
+	}
+	if !cfg.Reports.enabled() {
+		return
+	}
+	objective := time.Duration(cfg.Reports.LatencyObjective)
+	var store *rollupStore
+	if previous != nil && previous.store.objective == objective {
+		store = previous.store
+	} else {
+		store = newRollupStore(objective)
+		if local := currentLocalStore(); local != nil {
+			// Pick up the history of previous runs
+			lines, err := local.load(utcDay(time.Now()).AddDate(0, 0, -(reportRetentionDays - 1)))
+			if err != nil {
+				log.Printf("Error loading rollups: %v\n", err)
+			}
+			store.seed(lines)
+		}
+	}
+	reports = &reportScheduler{
+		cfg:    cfg.Reports,
+		store:  store,
+		client: &http.Client{Timeout: reportWebhookTimeout},
+		done:   make(chan struct{}),
+	}
+	go reports.run()
+}
+
+// recordRollup adds a request to the rollups of endpoint kept for reports, in
+// the local store and for autoscaling, when enabled.
+func recordRollup(endpoint string, latency time.Duration, failed bool) {
+	reportsMu.Lock()
+	scheduler := reports
+	reportsMu.Unlock()
+	local := currentLocalStore()
+	window := currentScalingWindow()
+	if scheduler == nil && local == nil && window == nil {
+		return
+	}
+	now := time.Now()
+	if window != nil {
+		window.record(latency, now)
+	}
+	var good bool
+	if scheduler != nil {
+		good = scheduler.store.record(endpoint, latency, failed, now)
+	}
+	if local != nil {
+		local.record(endpoint, latency, failed, good, now)
+	}
+}
+
+func (r *reportScheduler) run() {
+	for {
+		now := time.Now()
+		timer := time.NewTimer(utcDay(now).Add(24 * time.Hour).Sub(now))
+		select {
+		case <-r.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			r.sendDue(utcDay(time.Now()))
+		}
+	}
+}
+
+// sendDue sends the reports ending at the UTC midnight end.
+func (r *reportScheduler) sendDue(end time.Time) {
+	if r.cfg.Daily {
+		r.send(r.store.report("daily", end.AddDate(0, 0, -1), end, r.cfg.TopRegressions))
+	}
+	if r.cfg.Weekly && end.Weekday() == time.Monday {
+		r.send(r.store.report("weekly", end.AddDate(0, 0, -7), end, r.cfg.TopRegressions))
+	}
+}
+
+// send emits one report event per endpoint and posts the report to the
+// webhook, logging failures.
+func (r *reportScheduler) send(report PeriodReport) {
+	report.Service = measurement
+	report.InstanceID = instanceID
+
+	regressions := make(map[string]Regression, len(report.TopRegressions))
+	for _, regression := range report.TopRegressions {
+		regressions[regression.Endpoint] = regression
+	}
+	for _, summary := range report.Endpoints {
+		fields := map[string]interface{}{
+			"report_start":   report.Start.UTC().Format(time.RFC3339),
+			"report_end":     report.End.UTC().Format(time.RFC3339),
+			"requests":       summary.Requests,
+			"errors":         summary.Errors,
+			"error_rate":     summary.ErrorRate,
+			"latency_p99_ms": summary.LatencyP99Ms,
+		}
+		if summary.SLOCompliance != nil {
+			fields["slo_compliance"] = *summary.SLOCompliance
+		}
+		if regression, ok := regressions[summary.Endpoint]; ok {
+			fields["previous_latency_p99_ms"] = regression.PreviousLatencyP99Ms
+			fields["latency_p99_change"] = regression.Change
+		}
+		sendEvent("report", map[string]string{"period": report.Period, "endpoint": summary.Endpoint}, fields)
+	}
+
+	if r.cfg.WebhookURL != "" {
+		if err := r.post(report); err != nil {
+			log.Printf("Error posting %s report: %v\n", report.Period, err)
+		}
+	}
+}
+
+func (r *reportScheduler) post(report PeriodReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Post(r.cfg.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package instrumentation
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRollupReportSummarizesPeriod(t *testing.T) {
+	store := newRollupStore(100 * time.Millisecond)
+	today := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	yesterday := today.AddDate(0, 0, -1)
+	for i := 0; i < 100; i++ {
+		store.record("GET /orders", 50*time.Millisecond, false, yesterday.Add(time.Hour))
+		store.record("GET /orders", 200*time.Millisecond, false, today.Add(time.Hour))
+		store.record("GET /users", 10*time.Millisecond, i%10 == 0, today.Add(2*time.Hour))
+	}
+	// Outside of the report period
+	store.record("GET /users", time.Second, true, today.AddDate(0, 0, 1))
+
+	report := store.report("daily", today, today.AddDate(0, 0, 1), 0)
+	if len(report.Endpoints) != 2 {
+		t.Fatalf("endpoints = %+v, want GET /orders and GET /users", report.Endpoints)
+	}
+	orders, users := report.Endpoints[0], report.Endpoints[1]
+	if orders.Endpoint != "GET /orders" || orders.Requests != 100 || orders.ErrorRate != 0 || *orders.SLOCompliance != 0 {
+		t.Errorf("orders = %+v", orders)
+	}
+	if users.Requests != 100 || users.Errors != 10 || users.ErrorRate != 0.1 || *users.SLOCompliance != 0.9 {
+		t.Errorf("users = %+v", users)
+	}
+	if users.LatencyP99Ms != 10 {
+		t.Errorf("users p99 = %gms, want 10ms", users.LatencyP99Ms)
+	}
+
+	if len(report.TopRegressions) != 1 {
+		t.Fatalf("regressions = %+v, want GET /orders", report.TopRegressions)
+	}
+	if r := report.TopRegressions[0]; r.Endpoint != "GET /orders" || r.PreviousLatencyP99Ms != 50 || r.LatencyP99Ms != 200 || r.Change != 3 {
+		t.Errorf("regression = %+v", r)
+	}
+}
+
+func TestRollupReportWithoutObjective(t *testing.T) {
+	store := newRollupStore(0)
+	day := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	store.record("GET /orders", time.Millisecond, false, day)
+	report := store.report("daily", day, day.AddDate(0, 0, 1), 0)
+	if len(report.Endpoints) != 1 || report.Endpoints[0].SLOCompliance != nil {
+		t.Errorf("endpoints = %+v, want no SLO compliance", report.Endpoints)
+	}
+}
+
+func TestRollupStoreDropsOldDays(t *testing.T) {
+	store := newRollupStore(0)
+	day := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	store.record("GET /orders", time.Millisecond, false, day)
+	store.record("GET /orders", time.Millisecond, false, day.AddDate(0, 0, reportRetentionDays))
+	if len(store.days) != 1 {
+		t.Errorf("%d days retained, want the newest only", len(store.days))
+	}
+}
+
+func TestReportSchedulerSendsEventsAndWebhook(t *testing.T) {
+	posted := make(chan PeriodReport, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report PeriodReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Error(err)
+		}
+		posted <- report
+	}))
+	defer webhook.Close()
+
+	monday := time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC)
+	store := newRollupStore(0)
+	store.record("GET /orders", 20*time.Millisecond, false, monday.Add(-time.Hour))
+	scheduler := &reportScheduler{cfg: ReportConfig{Weekly: true, WebhookURL: webhook.URL}, store: store, client: webhook.Client()}
+	scheduler.sendDue(monday)
+
+	metrics := nextMetrics(t)
+	if metrics.Tags["event"] != "report" || metrics.Tags["period"] != "weekly" || metrics.Tags["endpoint"] != "GET /orders" {
+		t.Errorf("tags = %v", metrics.Tags)
+	}
+	if metrics.Fields["requests"] != float64(1) || metrics.Fields["latency_p99_ms"] != float64(20) {
+		t.Errorf("fields = %v", metrics.Fields)
+	}
+	select {
+	case report := <-posted:
+		if report.Period != "weekly" || report.Service != "test-service" || !report.Start.Equal(monday.AddDate(0, 0, -7)) {
+			t.Errorf("posted report = %+v", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("report not posted")
+	}
+}
+
+func TestRecordRollupOnlyWhenEnabled(t *testing.T) {
+	recordRollup("GET /orders", time.Millisecond, false)
+	if reports != nil {
+		t.Fatal("reports enabled by default")
+	}
+
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithReports(ReportConfig{Daily: true}), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	recordRollup("GET /orders", time.Millisecond, false)
+	rollups := reports.store.between(utcDay(time.Now()), utcDay(time.Now()).AddDate(0, 0, 1))
+	if rollups["GET /orders"] == nil || rollups["GET /orders"].latency.count != 1 {
+		t.Errorf("rollups = %v, want one GET /orders request", rollups)
+	}
+}
+
+func TestValidateReports(t *testing.T) {
+	cfg := newConfig(collectorURL, "test-service", "", "", "", "", []Option{WithReports(ReportConfig{WebhookURL: "ftp://example.com", TopRegressions: -1})})
+	var verr *ValidationError
+	if !errors.As(cfg.Validate(), &verr) {
+		t.Fatalf("Validate() = %v, want a ValidationError", cfg.Validate())
+	}
+	fields := map[string]bool{}
+	for _, problem := range verr.Errors {
+		fields[problem.Field] = true
+	}
+	if !fields["reports.webhook_url"] || !fields["reports.top_regressions"] {
+		t.Errorf("problems = %+v", verr.Errors)
+	}
+}
@@ -0,0 +1,158 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Defaults of RetryPolicy.
+const (
+	defaultRetryInitialBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff     = 5 * time.Second
+)
+
+// RetryPolicy retries the sends of an exporter that failed, a batch at a time
+// for the batching backends and a point at a time for Exporters. The zero
+// policy tries each send once, then logs and drops what couldn't be sent.
+//
+// Network errors and errors of Exporters are retried, but for those wrapped
+// with NonRetryable; of the HTTP statuses backends answer with, only
+// RetryableStatusCodes are. A batching backend retries within the timeout of
+// its flush.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a send is tried, retries included; zero
+	// or one tries once.
+	MaxAttempts int `json:"max_attempts"`
+	// InitialBackoff is the wait before the first retry (100ms if zero),
+	// doubled for each retry after up to MaxBackoff (5s if zero). Each wait
+	// is jittered down by up to half, so exporters of many instances don't
+	// retry in lockstep.
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+	// RetryableStatusCodes are the HTTP statuses retried; 408, 429 and the
+	// 5xx statuses if empty.
+	RetryableStatusCodes []int `json:"retryable_status_codes"`
+}
+
+// RetryPolicyExporter is an Exporter declaring its own retry policy, used
+// instead of Config.ExporterRetry.
+type RetryPolicyExporter interface {
+	Exporter
+	RetryPolicy() RetryPolicy
+}
+
+// StatusError is the error of a backend answering with an HTTP status other
+// than 2xx, which RetryPolicy.RetryableStatusCodes classifies. Exporters
+// talking HTTP can return it too.
+type StatusError struct {
+	StatusCode int
+	// Message is the whole error message
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// nonRetryableError is an error no RetryPolicy retries.
+type nonRetryableError struct {
+	err error
+}
+
+// NonRetryable marks err, e.g. returned by an Exporter for a point its
+// backend can never accept, as not worth retrying.
+func NonRetryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return nonRetryableError{err: err}
+}
+
+func (e nonRetryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e nonRetryableError) Unwrap() error {
+	return e.err
+}
+
+// retryable reports whether err is worth another attempt.
+func (p RetryPolicy) retryable(err error) bool {
+	var permanent nonRetryableError
+	if errors.As(err, &permanent) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var status *StatusError
+	if !errors.As(err, &status) {
+		return true
+	}
+	if len(p.RetryableStatusCodes) > 0 {
+		return slices.Contains(p.RetryableStatusCodes, status.StatusCode)
+	}
+	return status.StatusCode == http.StatusRequestTimeout || status.StatusCode == http.StatusTooManyRequests || status.StatusCode >= 500
+}
+
+// backoff returns the wait before the retry-th retry, from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	wait, limit := time.Duration(p.InitialBackoff), time.Duration(p.MaxBackoff)
+	if wait <= 0 {
+		wait = defaultRetryInitialBackoff
+	}
+	if limit <= 0 {
+		limit = defaultRetryMaxBackoff
+	}
+	for i := 1; i < retry && wait < limit; i++ {
+		wait *= 2
+	}
+	wait = min(wait, limit)
+	return wait - time.Duration(rand.Int63n(int64(wait)/2+1))
+}
+
+// validate returns the problems of the policy of field.
+func (p RetryPolicy) validate(field string) []FieldError {
+	var problems []FieldError
+	if p.MaxAttempts < 0 {
+		problems = append(problems, FieldError{Field: field + ".max_attempts", Message: "must not be negative"})
+	}
+	if p.InitialBackoff < 0 {
+		problems = append(problems, FieldError{Field: field + ".initial_backoff", Message: "must not be negative"})
+	}
+	if p.MaxBackoff < 0 {
+		problems = append(problems, FieldError{Field: field + ".max_backoff", Message: "must not be negative"})
+	}
+	for _, code := range p.RetryableStatusCodes {
+		if code < 100 || code > 599 {
+			problems = append(problems, FieldError{Field: field + ".retryable_status_codes", Message: fmt.Sprintf("must be HTTP statuses, got %d", code)})
+			break
+		}
+	}
+	return problems
+}
+
+// retry calls send until it succeeds, fails with an error not worth
+// retrying, or was tried MaxAttempts times, waiting in between unless ctx is
+// done first. It returns the last error, with the number of attempts when
+// there were several.
+func retry(ctx context.Context, policy RetryPolicy, send func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err) {
+			if err != nil && attempt > 1 {
+				err = fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			return err
+		}
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (after %d attempts)", err, attempt)
+		case <-timer.C:
+		}
+	}
+}
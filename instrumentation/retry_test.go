@@ -0,0 +1,211 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	var defaults RetryPolicy
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection reset"), true},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{fmt.Errorf("wrapped: %w", &StatusError{StatusCode: http.StatusTooManyRequests}), true},
+		{&StatusError{StatusCode: http.StatusBadRequest}, false},
+		{NonRetryable(errors.New("unencodable point")), false},
+		{context.DeadlineExceeded, false},
+	} {
+		if got := defaults.retryable(c.err); got != c.want {
+			t.Errorf("retryable(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+	custom := RetryPolicy{RetryableStatusCodes: []int{http.StatusConflict}}
+	if !custom.retryable(&StatusError{StatusCode: http.StatusConflict}) || custom.retryable(&StatusError{StatusCode: http.StatusBadGateway}) {
+		t.Error("RetryableStatusCodes didn't replace the default statuses")
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: Duration(100 * time.Millisecond), MaxBackoff: Duration(time.Second)}
+	for retry, want := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		for i := 0; i < 20; i++ {
+			if wait := p.backoff(retry); wait < want/2 || wait > want {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", retry, wait, want/2, want)
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: Duration(time.Millisecond)}
+	attempts := 0
+	err := retry(context.Background(), policy, func() error {
+		attempts++
+		return errors.New("backend down")
+	})
+	if attempts != 3 || err == nil || err.Error() != "backend down (after 3 attempts)" {
+		t.Errorf("retry() = %v after %d attempts, want 3", err, attempts)
+	}
+
+	attempts = 0
+	err = retry(context.Background(), policy, func() error {
+		attempts++
+		return &StatusError{StatusCode: http.StatusUnauthorized, Message: "unauthorized"}
+	})
+	var status *StatusError
+	if attempts != 1 || !errors.As(err, &status) {
+		t.Errorf("retry() = %v after %d attempts, want a single one", err, attempts)
+	}
+
+	// The zero policy tries once
+	attempts = 0
+	retry(context.Background(), RetryPolicy{}, func() error {
+		attempts++
+		return errors.New("backend down")
+	})
+	if attempts != 1 {
+		t.Errorf("zero policy made %d attempts", attempts)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	retry(ctx, RetryPolicy{MaxAttempts: 5, InitialBackoff: Duration(time.Hour)}, func() error {
+		attempts++
+		return errors.New("backend down")
+	})
+	if attempts != 1 {
+		t.Errorf("made %d attempts once the context was done", attempts)
+	}
+}
+
+// failingExporter fails the first failures exports of request points.
+type failingExporter struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	exported []Metrics
+	policy   *RetryPolicy
+}
+
+func (e *failingExporter) Export(point Metrics) error {
+	if point.Tags["event"] != "" {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.attempts++
+	if e.attempts <= e.failures {
+		return errors.New("backend down")
+	}
+	e.exported = append(e.exported, point)
+	return nil
+}
+
+func (e *failingExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (e *failingExporter) counts() (attempts, exported int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.attempts, len(e.exported)
+}
+
+// declaringExporter is a failingExporter with a retry policy of its own.
+type declaringExporter struct {
+	*failingExporter
+}
+
+func (e declaringExporter) RetryPolicy() RetryPolicy {
+	return *e.policy
+}
+
+func TestExporterRetry(t *testing.T) {
+	configured := &failingExporter{failures: 2}
+	declaring := declaringExporter{&failingExporter{failures: 2, policy: &RetryPolicy{MaxAttempts: 2, InitialBackoff: Duration(time.Millisecond)}}}
+	err := Configure(collectorURL, "test-service", "", "", "", "",
+		WithExporter(configured), WithExporter(declaring),
+		WithExporterRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: Duration(time.Millisecond)}), WithoutSendQueue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := sendMetrics(Metrics{Measurement: "test-service"}); err != nil {
+		t.Fatal(err)
+	}
+	nextMetrics(t)
+	if err := stopExporters(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if attempts, exported := configured.counts(); attempts != 3 || exported != 1 {
+		t.Errorf("exporter made %d attempts and exported %d points, want 3 and 1", attempts, exported)
+	}
+	// Its own policy gives up after the second failure
+	if attempts, exported := declaring.counts(); attempts != 2 || exported != 0 {
+		t.Errorf("declaring exporter made %d attempts and exported %d points, want 2 and 0", attempts, exported)
+	}
+}
+
+func TestVictoriaMetricsRetriesUnavailable(t *testing.T) {
+	var mu sync.Mutex
+	var statuses []int
+	reject := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		status := http.StatusNoContent
+		if len(statuses) == 0 {
+			status = http.StatusServiceUnavailable
+		} else if reject {
+			status = http.StatusBadRequest
+		}
+		statuses = append(statuses, status)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	startVictoriaMetrics(Config{VictoriaMetrics: VictoriaMetricsConfig{URL: server.URL, FlushInterval: Duration(time.Hour), Retry: RetryPolicy{MaxAttempts: 3, InitialBackoff: Duration(time.Millisecond)}}})
+	sendToVictoriaMetrics(Metrics{Measurement: "orders", Fields: map[string]interface{}{"latency_ms": 12}})
+	if err := stopVictoriaMetrics(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses[1] != http.StatusNoContent {
+		t.Errorf("statuses = %v, want the batch retried once", statuses)
+	}
+
+	// Client errors aren't retried
+	mu.Lock()
+	statuses, reject = []int{http.StatusNoContent}, true
+	mu.Unlock()
+	startVictoriaMetrics(Config{VictoriaMetrics: VictoriaMetricsConfig{URL: server.URL, FlushInterval: Duration(time.Hour), Retry: RetryPolicy{MaxAttempts: 3, InitialBackoff: Duration(time.Millisecond)}}})
+	sendToVictoriaMetrics(Metrics{Measurement: "orders", Fields: map[string]interface{}{"latency_ms": 12}})
+	var status *StatusError
+	if err := stopVictoriaMetrics(context.Background()); !errors.As(err, &status) || status.StatusCode != http.StatusBadRequest {
+		t.Errorf("stopVictoriaMetrics() = %v, want the 400", err)
+	}
+	if len(statuses) != 2 {
+		t.Errorf("statuses = %v, want a single attempt", statuses)
+	}
+}
+
+func TestValidateRetryPolicy(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "orders", ExporterRetry: RetryPolicy{MaxAttempts: -1, RetryableStatusCodes: []int{5000}}}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 2 || validationErr.Errors[0].Field != "exporter_retry.max_attempts" || validationErr.Errors[1].Field != "exporter_retry.retryable_status_codes" {
+		t.Errorf("Validate() = %v, want max_attempts and retryable_status_codes rejected", err)
+	}
+}
@@ -0,0 +1,277 @@
+package instrumentation
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// unmatchedRPCEndpoint is the endpoint tag for requests reaching an RPC
+// middleware whose path isn't "/package.Service/Method" (CORS preflights,
+// probes, typos), so clients can't mint new series with arbitrary paths.
+const unmatchedRPCEndpoint = "rpc_unmatched"
+
+// maxGRPCWebTrailerBytes caps how much of a gRPC-web trailer frame is kept.
+const maxGRPCWebTrailerBytes = 4 << 10
+
+// GRPCWebMiddleware instruments a gRPC-web handler, such as the improbable-eng
+// grpcweb.WrappedGrpcServer, so that every RPC is reported under its own
+// "/package.Service/Method" endpoint. Envoy-proxied gRPC-web reaches the backend
+// as native gRPC and is already covered by the interceptor package.
+func GRPCWebMiddleware(next http.Handler) http.Handler {
+	return rpcMetricsMiddleware(ProtocolGRPCWeb, next)
+}
+
+// TwirpMiddleware instruments a Twirp server handler so that every RPC is
+// reported under its own "/package.Service/Method" endpoint.
+func TwirpMiddleware(next http.Handler) http.Handler {
+	return rpcMetricsMiddleware(ProtocolTwirp, next)
+}
+
+func rpcMetricsMiddleware(rpcSystem string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsIgnoredPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		done := TrackInFlight()
+		startTime := time.Now()
+		path := unmatchedRPCEndpoint
+		service, method, isRPC := parseRPCPath(r.URL.Path)
+		if isRPC {
+			// Match the endpoint format used by the gRPC interceptor
+			path = limitEndpoint("/" + service + "/" + method)
+		}
+		userAgent := r.UserAgent()
+		ipAddress := r.RemoteAddr
+		rec := NewRequestRecord(r.Header.Get(RequestIDHeader))
+		rec.StartTime = startTime
+		r = r.WithContext(contextWithRecord(r.Context(), rec))
+		incrementEndpointRequestCount(path)
+		currentCount := getEndpointRequestCount(path)
+		// Response writer wrapper to capture the status code, size and, for
+		// gRPC-web, the trailer frame carrying grpc-status
+		rw := &rpcResponseWriter{responseWriter: NewResponseWriter(w), grpcWeb: rpcSystem == ProtocolGRPCWeb}
+		stopWatchdog := watchRequest(func() string { return path }, rec)
+		defer func() {
+			done()
+			stopWatchdog()
+			panicValue := recover()
+			if panicValue == http.ErrAbortHandler {
+				// Handlers abort this way on purpose; leave it to the server
+				panic(panicValue)
+			}
+			recovered := panicValue != nil && RecoverPanics()
+			if recovered {
+				writePanicResponse(rw.responseWriter)
+			}
+
+			// gRPC-web answers with HTTP 200 and reports failures through
+			// grpc-status, whereas Twirp maps its error codes onto HTTP status
+			// codes. A panic is reported as a 500 either way.
+			statusCode := rw.StatusCode()
+			grpcStatus := rw.grpcStatus()
+			if panicValue != nil {
+				statusCode = http.StatusInternalServerError
+				incrementEndpointPanicCount(path)
+			}
+			failed := failedOutcome(Outcome{
+				Endpoint:   path,
+				Protocol:   rpcSystem,
+				StatusCode: statusCode,
+				GRPCStatus: grpcStatus,
+				Failed:     statusCode >= 400 || (grpcStatus != "" && grpcStatus != "0"),
+			}) || panicValue != nil || rec.aborted()
+			if failed {
+				incrementEndpointErrorCount(path)
+			}
+			errorCount := getEndpointErrorCount(path)
+			latency := time.Since(startTime)
+
+			tags := map[string]string{
+				"endpoint":   path,
+				"user_agent": userAgent,
+				"ip_address": ipAddress,
+				"rpc_system": rpcSystem,
+			}
+			if p := currentClientProfiles(); p != nil && p.config.OmitIPAddress {
+				delete(tags, "ip_address")
+			}
+			profileClient(ipAddress, r.Header.Get, latency, failed)
+			if isRPC {
+				tags["rpc_service"] = service
+				tags["rpc_method"] = method
+			}
+			if grpcStatus != "" {
+				tags["grpc_status"] = grpcStatus
+			}
+			extractRequestTags(tags, r)
+			fields := map[string]interface{}{
+				"request_size":  r.ContentLength,
+				"status_code":   statusCode,
+				"response_size": rw.Size(),
+				"latency_ms":    latency.Milliseconds(),
+				"request_count": currentCount,
+				"error_count":   errorCount,
+				"panic_count":   getEndpointPanicCount(path),
+			}
+			var class string
+			switch {
+			case !failed:
+			case panicValue != nil:
+				class = ErrorClassServer
+			case grpcStatus != "" && grpcStatus != "0":
+				class = classifyGRPCStatus(grpcStatus)
+			default:
+				class = classifyError(statusCode, r.Context().Err(), nil)
+			}
+			countErrorClass(tags, fields, path, class)
+			countStatusFamily(fields, path, statusCode)
+			fields["client_canceled"] = clientCanceled(r)
+			addLatencyHistogram(fields, path, latency)
+			if panicValue != nil && loadSettings().panicStackTrace {
+				fields["panic_stack"] = panicStack(panicValue)
+			}
+			if panicValue != nil {
+				sendPanicReport(path, panicValue, r, rec)
+			}
+			captureHeaders(tags, fields, r.Header.Get, rw.Header().Get)
+			extractRequestFields(fields, r, ResponseInfo{StatusCode: statusCode, Size: rw.Size(), Header: rw.Header()})
+			rec.apply(tags, fields)
+			reportError(fields, ErrorReport{Endpoint: path, StatusCode: statusCode}, panicValue, r, rec)
+
+			metrics := Metrics{
+				InfluxDBURL: influxDBURL,
+				Token:       currentToken(),
+				Org:         org,
+				Bucket:      bucket,
+				Measurement: measurement,
+				Tags:        tags,
+				Fields:      fields,
+			}
+
+			recordRollup(path, latency, failed)
+
+			// Send metrics unless aggregated or sampled out
+			if !aggregatePoint(path, latency, failed) && samplePoint(path) {
+				reportPoint(metrics)
+			}
+
+			if panicValue != nil && !recovered {
+				panic(panicValue)
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// parseRPCPath extracts the service and method from an RPC-over-HTTP path. Both
+// gRPC-web ("/pkg.Service/Method") and Twirp ("/twirp/pkg.Service/Method", with
+// a configurable prefix) end in the same two segments. The service must be
+// package-qualified, which keeps paths like "/static/app.js" from matching.
+func parseRPCPath(path string) (string, string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	service, method := parts[len(parts)-2], parts[len(parts)-1]
+	if method == "" || strings.Contains(method, ".") {
+		return "", "", false
+	}
+	dot := strings.LastIndex(service, ".")
+	if dot <= 0 || dot == len(service)-1 {
+		return "", "", false
+	}
+	return service, method, true
+}
+
+// rpcResponseWriter additionally follows the gRPC-web frame stream in the
+// response body. Frames are a flag byte and a 4-byte big-endian length followed
+// by the payload; a set high bit in the flag marks the trailer frame, whose
+// payload holds "grpc-status: N" as HTTP/1 style header lines.
+type rpcResponseWriter struct {
+	*responseWriter
+	grpcWeb bool
+
+	frameHeader    [5]byte
+	frameHeaderLen int
+	frameRemaining uint32
+	inTrailer      bool
+	trailer        []byte
+}
+
+func (rw *rpcResponseWriter) Write(data []byte) (int, error) {
+	n, err := rw.responseWriter.Write(data)
+	if rw.grpcWeb {
+		rw.parseFrames(data[:n])
+	}
+	return n, err
+}
+
+// Flush is needed by gRPC-web handlers that stream responses.
+func (rw *rpcResponseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rw *rpcResponseWriter) parseFrames(data []byte) {
+	for len(data) > 0 {
+		if rw.frameRemaining == 0 && rw.frameHeaderLen < len(rw.frameHeader) {
+			n := copy(rw.frameHeader[rw.frameHeaderLen:], data)
+			rw.frameHeaderLen += n
+			data = data[n:]
+			if rw.frameHeaderLen == len(rw.frameHeader) {
+				rw.inTrailer = rw.frameHeader[0]&0x80 != 0
+				rw.frameRemaining = binary.BigEndian.Uint32(rw.frameHeader[1:])
+				rw.frameHeaderLen = 0
+				if rw.inTrailer {
+					rw.trailer = rw.trailer[:0]
+				}
+			}
+			continue
+		}
+
+		n := uint32(len(data))
+		if n > rw.frameRemaining {
+			n = rw.frameRemaining
+		}
+		if rw.inTrailer && len(rw.trailer)+int(n) <= maxGRPCWebTrailerBytes {
+			rw.trailer = append(rw.trailer, data[:n]...)
+		}
+		rw.frameRemaining -= n
+		data = data[n:]
+	}
+}
+
+// grpcStatus returns the gRPC status of the response: from the trailer frame
+// for gRPC-web bodies, otherwise from the headers or HTTP trailers used by
+// trailers-only responses. Base64 (grpc-web-text) bodies fall back to headers.
+func (rw *rpcResponseWriter) grpcStatus() string {
+	if len(rw.trailer) > 0 {
+		scanner := bufio.NewScanner(bytes.NewReader(rw.trailer))
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(scanner.Text(), ":")
+			if ok && strings.EqualFold(strings.TrimSpace(key), "grpc-status") {
+				return strings.TrimSpace(value)
+			}
+		}
+	}
+	if status := rw.Header().Get("Grpc-Status"); status != "" {
+		return status
+	}
+	return rw.Header().Get(http.TrailerPrefix + "Grpc-Status")
+}
+
+// Hijack keeps websocket-based gRPC-web transports working through the wrapper.
+func (rw *rpcResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
@@ -0,0 +1,108 @@
+package instrumentation
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseRPCPath(t *testing.T) {
+	cases := []struct {
+		path            string
+		service, method string
+		ok              bool
+	}{
+		{"/twirp/pkg.Svc/M", "pkg.Svc", "M", true},
+		{"/pkg.Svc/M", "pkg.Svc", "M", true},
+		{"/api/v1/acme.users.v1.UserService/GetUser", "acme.users.v1.UserService", "GetUser", true},
+		{"/static/app.js", "", "", false},
+		{"/users/42", "", "", false},
+		{"/pkg.Svc/", "", "", false},
+		{"/pkg./M", "", "", false},
+		{"/.Svc/M", "", "", false},
+		{"/pkg.Svc", "", "", false},
+		{"/", "", "", false},
+	}
+	for _, tc := range cases {
+		service, method, ok := parseRPCPath(tc.path)
+		if service != tc.service || method != tc.method || ok != tc.ok {
+			t.Errorf("parseRPCPath(%q) = (%q, %q, %v), want (%q, %q, %v)",
+				tc.path, service, method, ok, tc.service, tc.method, tc.ok)
+		}
+	}
+}
+
+// grpcWebFrame encodes a gRPC-web frame with the given flag byte.
+func grpcWebFrame(flag byte, payload string) []byte {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	return frame
+}
+
+func TestGRPCWebMiddlewareReadsTrailerFrame(t *testing.T) {
+	const endpoint = "/acme.Users/Lookup"
+	handler := GRPCWebMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc-web+proto")
+		body := append(grpcWebFrame(0x00, "message"), grpcWebFrame(0x80, "grpc-status: 5\r\ngrpc-message: not found\r\n")...)
+		// Split the writes mid-header to exercise the incremental frame parser
+		w.Write(body[:3])
+		w.Write(body[3:14])
+		w.Write(body[14:])
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, endpoint, strings.NewReader("request")))
+
+	metrics := nextMetrics(t)
+	if metrics.Tags["endpoint"] != endpoint {
+		t.Errorf("endpoint = %q, want %q", metrics.Tags["endpoint"], endpoint)
+	}
+	if metrics.Tags["grpc_status"] != "5" {
+		t.Errorf("grpc_status = %q, want 5", metrics.Tags["grpc_status"])
+	}
+	if metrics.Fields["status_code"] != float64(http.StatusOK) {
+		t.Errorf("status_code = %v, want 200", metrics.Fields["status_code"])
+	}
+	if got := getEndpointErrorCount(endpoint); got != 1 {
+		t.Errorf("error count = %d, want 1", got)
+	}
+}
+
+func TestTwirpMiddlewareCountsErrorStatus(t *testing.T) {
+	const endpoint = "/acme.Orders/Get"
+	handler := TwirpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"code":"not_found","msg":"no such order"}`))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/twirp"+endpoint, strings.NewReader("{}")))
+
+	metrics := nextMetrics(t)
+	if metrics.Tags["endpoint"] != endpoint || metrics.Tags["rpc_method"] != "Get" {
+		t.Errorf("tags = %v, want endpoint %q and rpc_method Get", metrics.Tags, endpoint)
+	}
+	if got := getEndpointErrorCount(endpoint); got != 1 {
+		t.Errorf("error count = %d, want 1", got)
+	}
+}
+
+func TestRPCMiddlewareBucketsUnmatchedPaths(t *testing.T) {
+	handler := TwirpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/static/app.js", nil))
+
+	metrics := nextMetrics(t)
+	if metrics.Tags["endpoint"] != unmatchedRPCEndpoint {
+		t.Errorf("endpoint = %q, want %q", metrics.Tags["endpoint"], unmatchedRPCEndpoint)
+	}
+	if _, ok := metrics.Tags["rpc_service"]; ok {
+		t.Errorf("unexpected rpc_service tag on unmatched path: %v", metrics.Tags)
+	}
+}
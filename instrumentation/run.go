@@ -0,0 +1,125 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+const (
+	// runShutdownTimeout bounds the flush at the end of RunInstrumented.
+	runShutdownTimeout = 10 * time.Second
+	// maxRunErrorBytes caps the error field of a run.
+	maxRunErrorBytes = 1 << 10
+)
+
+// ExitCoder is implemented by errors carrying a process exit code, such as
+// *exec.ExitError. RunInstrumented reports other errors with exit code 1.
+type ExitCoder interface {
+	ExitCode() int
+}
+
+// RunInstrumented runs fn as the batch job or CLI command name, once
+// Configure (or Start) has set where metrics go. It announces the run with a
+// service_registered event, then reports one point tagged run=name and
+// exit_status (success, failure or panic) with its duration_ms, exit_code,
+// error and resource usage (CPU time and peak RSS where the OS reports them,
+// Go heap). Finally it calls Shutdown, flushing everything synchronously and
+// deregistering, so the process can exit right after. fn's ctx is canceled on
+// SIGINT and SIGTERM. It returns fn's error; panics are re-panicked once
+// reported.
+//
+//	func main() {
+//		instrumentation.Configure(registryURL, "nightly-export", "", "", "", "")
+//		if err := instrumentation.RunInstrumented("export", export); err != nil {
+//			os.Exit(1)
+//		}
+//	}
+func RunInstrumented(name string, fn func(ctx context.Context) error) (err error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sendEvent("service_registered", map[string]string{"run": name}, map[string]interface{}{"instance_id": instanceID})
+	startTime := time.Now()
+	startUsage := currentResourceUsage()
+	defer func() {
+		panicValue := recover()
+		reportRun(name, time.Since(startTime), startUsage, err, panicValue)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), runShutdownTimeout)
+		defer cancel()
+		if shutdownErr := Shutdown(shutdownCtx); shutdownErr != nil {
+			log.Printf("Error shutting down the instrumentation: %v\n", shutdownErr)
+		}
+		if panicValue != nil {
+			panic(panicValue)
+		}
+	}()
+	return fn(ctx)
+}
+
+// reportRun sends the point of a finished run.
+func reportRun(name string, duration time.Duration, startUsage resourceUsage, err error, panicValue interface{}) {
+	status, exitCode := "success", 0
+	switch {
+	case panicValue != nil:
+		status, exitCode = "panic", 2
+		err = fmt.Errorf("panic: %v", panicValue)
+	case err != nil:
+		status, exitCode = "failure", 1
+		var coder ExitCoder
+		if errors.As(err, &coder) {
+			exitCode = coder.ExitCode()
+		}
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fields := map[string]interface{}{
+		"duration_ms":       duration.Milliseconds(),
+		"exit_code":         exitCode,
+		"heap_sys_bytes":    mem.HeapSys,
+		"total_alloc_bytes": mem.TotalAlloc,
+		"gc_count":          mem.NumGC,
+	}
+	if err != nil {
+		message := err.Error()
+		if len(message) > maxRunErrorBytes {
+			message = message[:maxRunErrorBytes]
+		}
+		fields["error"] = message
+	}
+	if usage := currentResourceUsage(); usage.known {
+		fields["cpu_user_ms"] = (usage.user - startUsage.user).Milliseconds()
+		fields["cpu_system_ms"] = (usage.system - startUsage.system).Milliseconds()
+		fields["max_rss_bytes"] = usage.maxRSS
+	}
+
+	metrics := Metrics{
+		InfluxDBURL: influxDBURL,
+		Token:       currentToken(),
+		Org:         org,
+		Bucket:      bucket,
+		Measurement: measurement,
+		Tags:        map[string]string{"run": name, "exit_status": status},
+		Fields:      fields,
+	}
+	if err := enqueuePoint(runPoints, metrics); err != nil {
+		logSendError(err)
+	}
+}
+
+// resourceUsage is the CPU time and peak memory of the process so far, when
+// the OS reports them (known).
+type resourceUsage struct {
+	known  bool
+	user   time.Duration
+	system time.Duration
+	maxRSS int64
+}
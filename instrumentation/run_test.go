@@ -0,0 +1,92 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type exitError int
+
+func (e exitError) Error() string { return "exit status" }
+func (e exitError) ExitCode() int { return int(e) }
+
+func runAndCollect(t *testing.T, fn func(ctx context.Context) error) (run Metrics, err error) {
+	t.Helper()
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	err = RunInstrumented("export", fn)
+	if registered := nextMetrics(t); registered.Tags["event"] != "service_registered" || registered.Tags["run"] != "export" {
+		t.Errorf("first point = %v, want service_registered", registered.Tags)
+	}
+	run = nextMetrics(t)
+	if deregistered := nextMetrics(t); deregistered.Tags["event"] != "service_deregistered" {
+		t.Errorf("last point = %v, want service_deregistered", deregistered.Tags)
+	}
+	return run, err
+}
+
+func TestRunInstrumentedReportsSuccess(t *testing.T) {
+	run, err := runAndCollect(t, func(ctx context.Context) error {
+		if ctx.Err() != nil {
+			t.Error("context canceled before the run")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Tags["run"] != "export" || run.Tags["exit_status"] != "success" || run.Fields["exit_code"] != float64(0) {
+		t.Errorf("run point = %v %v", run.Tags, run.Fields)
+	}
+	fields := []string{"duration_ms", "heap_sys_bytes"}
+	if currentResourceUsage().known {
+		fields = append(fields, "cpu_user_ms", "max_rss_bytes")
+	}
+	for _, field := range fields {
+		if _, ok := run.Fields[field]; !ok {
+			t.Errorf("run point lacks %s: %v", field, run.Fields)
+		}
+	}
+	if _, ok := run.Fields["error"]; ok {
+		t.Error("successful run reported an error")
+	}
+}
+
+func TestRunInstrumentedReportsFailure(t *testing.T) {
+	run, err := runAndCollect(t, func(ctx context.Context) error {
+		return exitError(3)
+	})
+	if !errors.Is(err, exitError(3)) {
+		t.Fatalf("RunInstrumented() = %v, want fn's error", err)
+	}
+	if run.Tags["exit_status"] != "failure" || run.Fields["exit_code"] != float64(3) || run.Fields["error"] != "exit status" {
+		t.Errorf("run point = %v %v", run.Tags, run.Fields)
+	}
+}
+
+func TestRunInstrumentedReportsPanics(t *testing.T) {
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	func() {
+		defer func() {
+			if v := recover(); v != "disk full" {
+				t.Errorf("recovered %v, want the panic re-panicked", v)
+			}
+		}()
+		RunInstrumented("export", func(ctx context.Context) error { panic("disk full") })
+	}()
+
+	nextMetrics(t)
+	run := nextMetrics(t)
+	if run.Tags["exit_status"] != "panic" || run.Fields["exit_code"] != float64(2) || run.Fields["error"] != "panic: disk full" {
+		t.Errorf("run point = %v %v", run.Tags, run.Fields)
+	}
+	nextMetrics(t)
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package instrumentation
+
+func currentResourceUsage() resourceUsage {
+	return resourceUsage{}
+}
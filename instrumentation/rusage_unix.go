@@ -0,0 +1,27 @@
+//go:build unix
+
+package instrumentation
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+func currentResourceUsage() resourceUsage {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return resourceUsage{}
+	}
+	maxRSS := int64(ru.Maxrss)
+	// Linux and the BSDs report kilobytes, macOS bytes
+	if runtime.GOOS != "darwin" && runtime.GOOS != "ios" {
+		maxRSS *= 1024
+	}
+	return resourceUsage{
+		known:  true,
+		user:   time.Duration(ru.Utime.Nano()),
+		system: time.Duration(ru.Stime.Nano()),
+		maxRSS: maxRSS,
+	}
+}
@@ -0,0 +1,84 @@
+package instrumentation
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// sampleAll is the Sampling key whose rule applies to endpoints without one.
+const sampleAll = "*"
+
+// SamplingRule limits how many per-request points an endpoint sends. Dropped
+// requests are still counted, and every point carries the cumulative
+// request_count and error_count, so those stay exact.
+type SamplingRule struct {
+	// Rate is the fraction of requests sent, e.g. 0.1 for 10%. Zero sends all.
+	Rate float64 `json:"rate"`
+	// MaxPerSecond caps the points sent per second. Zero means no cap.
+	MaxPerSecond float64 `json:"max_per_second"`
+}
+
+// sampler applies one SamplingRule. Rate limiting uses a token bucket holding
+// at most one second's worth of points.
+type sampler struct {
+	rate         float64
+	maxPerSecond float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newSampler(rule SamplingRule) *sampler {
+	return &sampler{rate: rule.Rate, maxPerSecond: rule.MaxPerSecond, tokens: rule.MaxPerSecond}
+}
+
+func (s *sampler) sample(now time.Time) bool {
+	if s.rate > 0 && s.rate < 1 && rand.Float64() >= s.rate {
+		return false
+	}
+	if s.maxPerSecond <= 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.last.IsZero() {
+		s.tokens += now.Sub(s.last).Seconds() * s.maxPerSecond
+		if burst := max(s.maxPerSecond, 1); s.tokens > burst {
+			s.tokens = burst
+		}
+	}
+	s.last = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// samplers builds one sampler per configured endpoint.
+func samplers(rules map[string]SamplingRule) map[string]*sampler {
+	if len(rules) == 0 {
+		return nil
+	}
+	built := make(map[string]*sampler, len(rules))
+	for endpoint, rule := range rules {
+		built[endpoint] = newSampler(rule)
+	}
+	return built
+}
+
+// samplePoint reports whether the point for a request to endpoint should be
+// sent. Counters must be updated before calling it.
+func samplePoint(endpoint string) bool {
+	s := loadSettings()
+	rule, ok := s.samplers[endpoint]
+	if !ok {
+		if rule, ok = s.samplers[sampleAll]; !ok {
+			return true
+		}
+	}
+	return rule.sample(time.Now())
+}
@@ -0,0 +1,89 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSamplerRateLimit(t *testing.T) {
+	s := newSampler(SamplingRule{MaxPerSecond: 2})
+	start := time.Unix(0, 0)
+
+	var sent []bool
+	for _, at := range []time.Duration{0, 0, 0, 400 * time.Millisecond, 500 * time.Millisecond, 3 * time.Second, 3 * time.Second, 3 * time.Second} {
+		sent = append(sent, s.sample(start.Add(at)))
+	}
+	want := []bool{true, true, false, false, true, true, true, false}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Fatalf("sent = %v, want %v", sent, want)
+		}
+	}
+}
+
+func TestSamplerRate(t *testing.T) {
+	if !newSampler(SamplingRule{}).sample(time.Now()) {
+		t.Error("zero rule dropped a point")
+	}
+	s := newSampler(SamplingRule{Rate: 0.1})
+	sent := 0
+	for i := 0; i < 10000; i++ {
+		if s.sample(time.Now()) {
+			sent++
+		}
+	}
+	if sent < 700 || sent > 1300 {
+		t.Errorf("sent %d of 10000 points at rate 0.1", sent)
+	}
+}
+
+func TestSampledRequestsKeepExactCounts(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{
+		WithSampling("/sampling-test/hot", SamplingRule{MaxPerSecond: 1}),
+	})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sampling-test/hot" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	for _, path := range []string{"/sampling-test/hot", "/sampling-test/hot", "/sampling-test/hot", "/sampling-test/cold"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if got := nextMetrics(t).Tags["endpoint"]; got != "/sampling-test/hot" {
+		t.Errorf("endpoint = %q, want /sampling-test/hot", got)
+	}
+	// The next two hot requests were sampled out
+	if got := nextMetrics(t).Tags["endpoint"]; got != "/sampling-test/cold" {
+		t.Errorf("endpoint = %q, want /sampling-test/cold", got)
+	}
+	if got := getEndpointRequestCount("/sampling-test/hot"); got != 3 {
+		t.Errorf("request count = %d, want 3", got)
+	}
+	if got := getEndpointErrorCount("/sampling-test/hot"); got != 3 {
+		t.Errorf("error count = %d, want 3", got)
+	}
+}
+
+func TestValidateSamplingRules(t *testing.T) {
+	cfg := Config{
+		RegistryURL: "ws://registry",
+		ServiceName: "svc",
+		Sampling: map[string]SamplingRule{
+			"*":       {Rate: 1.5},
+			"/orders": {MaxPerSecond: -1},
+		},
+	}
+	err := cfg.Validate()
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Errors) != 2 {
+		t.Fatalf("Validate() = %v, want two problems", err)
+	}
+	if verr.Errors[0].Field != "sampling[*].rate" || verr.Errors[1].Field != "sampling[/orders].max_per_second" {
+		t.Errorf("fields = %+v", verr.Errors)
+	}
+}
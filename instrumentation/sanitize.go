@@ -0,0 +1,147 @@
+package instrumentation
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultMaxTagValueLength is the default cap on the bytes of a tag value.
+const defaultMaxTagValueLength = 256
+
+// InvalidPointError is returned for a point that wasn't sent, to the registry
+// or any exporter, because it breaks the InfluxDB rules in a way sanitizing
+// can't fix. Rejecting it alone keeps it from failing the whole batch it
+// would have been encoded in.
+type InvalidPointError struct {
+	Measurement string
+	// Errors name the offending parts of the point as measurement,
+	// tags.<key> or fields.<key>
+	Errors []FieldError
+}
+
+func (e *InvalidPointError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid point of measurement %q:", e.Measurement)
+	for i, fe := range e.Errors {
+		if i > 0 {
+			b.WriteString(";")
+		}
+		fmt.Fprintf(&b, " %s: %s", fe.Field, fe.Message)
+	}
+	return b.String()
+}
+
+// newlineStripper removes the newlines line protocol can't escape.
+var newlineStripper = strings.NewReplacer("\r", "", "\n", "")
+
+// sanitizePoint fixes what it can of a point about to be sent: newlines are
+// stripped from the measurement, the tags and the field keys, and tag values
+// are truncated to MaxTagValueLength bytes. It returns an
+// *InvalidPointError for the rest: an empty measurement, keys InfluxDB
+// reserves (time, or starting with an underscore), and field values that are
+// NaN, infinite or of a type no codec encodes. String field values are left
+// as they are.
+func sanitizePoint(p *Metrics) error {
+	limit := loadSettings().maxTagValueLength
+	if limit <= 0 {
+		limit = defaultMaxTagValueLength
+	}
+	var problems []FieldError
+	p.Measurement = stripNewlines(p.Measurement)
+	switch {
+	case p.Measurement == "":
+		problems = append(problems, FieldError{Field: "measurement", Message: "must not be empty"})
+	case strings.HasPrefix(p.Measurement, "_"):
+		problems = append(problems, FieldError{Field: "measurement", Message: "must not start with an underscore, reserved by InfluxDB"})
+	}
+	for key, value := range p.Tags {
+		if stripped := stripNewlines(key); stripped != key {
+			delete(p.Tags, key)
+			key = stripped
+		}
+		p.Tags[key] = truncateTagValue(stripNewlines(value), limit)
+		if problem := checkKey(key); problem != "" {
+			problems = append(problems, FieldError{Field: "tags." + key, Message: problem})
+		}
+	}
+	for key, value := range p.Fields {
+		if stripped := stripNewlines(key); stripped != key {
+			delete(p.Fields, key)
+			key = stripped
+			p.Fields[key] = value
+		}
+		problem := checkKey(key)
+		if problem == "" {
+			problem = checkFieldValue(value)
+		}
+		if problem != "" {
+			problems = append(problems, FieldError{Field: "fields." + key, Message: problem})
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	// Map order would otherwise shuffle the errors of a point between sends
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Field < problems[j].Field })
+	return &InvalidPointError{Measurement: p.Measurement, Errors: problems}
+}
+
+func stripNewlines(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	return newlineStripper.Replace(s)
+}
+
+// truncateTagValue cuts value to at most limit bytes, at a character
+// boundary.
+func truncateTagValue(value string, limit int) string {
+	if len(value) <= limit {
+		return value
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut]
+}
+
+// checkKey returns what is wrong with a tag or field key, if anything.
+func checkKey(key string) string {
+	switch {
+	case key == "":
+		return "must not be empty"
+	case key == "time":
+		return "is reserved by InfluxDB"
+	case strings.HasPrefix(key, "_"):
+		return "must not start with an underscore, reserved by InfluxDB"
+	}
+	return ""
+}
+
+// checkFieldValue returns what is wrong with a field value, if anything: the
+// codecs encode integers, finite floats, booleans and strings.
+func checkFieldValue(value interface{}) string {
+	switch value.(type) {
+	case int, int64, bool, string, json.Number:
+		return ""
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Sprintf("must be a finite number, got %v", f)
+		}
+		return ""
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Bool, reflect.String:
+		return ""
+	}
+	return fmt.Sprintf("unsupported value type %T", value)
+}
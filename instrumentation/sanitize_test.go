@@ -0,0 +1,84 @@
+package instrumentation
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizePoint(t *testing.T) {
+	point := Metrics{
+		Measurement: "orders\n",
+		Tags:        map[string]string{"endpoint\r\n": "/orders\n", "tenant": strings.Repeat("a", 255) + "é"},
+		Fields:      map[string]interface{}{"latency\n": 12.5, "count": uint16(3), "error": "line one\nline two"},
+	}
+	if err := sanitizePoint(&point); err != nil {
+		t.Fatal(err)
+	}
+	want := Metrics{
+		Measurement: "orders",
+		// é straddles the 256th byte, so it goes whole
+		Tags:   map[string]string{"endpoint": "/orders", "tenant": strings.Repeat("a", 255)},
+		Fields: map[string]interface{}{"latency": 12.5, "count": uint16(3), "error": "line one\nline two"},
+	}
+	if !reflect.DeepEqual(point, want) {
+		t.Errorf("sanitized point = %+v, want %+v", point, want)
+	}
+
+	invalid := Metrics{
+		Measurement: "orders",
+		Tags:        map[string]string{"time": "now", "endpoint": "/orders"},
+		Fields:      map[string]interface{}{"latency": math.NaN(), "ratio": math.Inf(1), "_count": 1, "ids": []int{1}},
+	}
+	err := sanitizePoint(&invalid)
+	var pointErr *InvalidPointError
+	if !errors.As(err, &pointErr) {
+		t.Fatalf("sanitizePoint() = %v, want an *InvalidPointError", err)
+	}
+	var fields []string
+	for _, fe := range pointErr.Errors {
+		fields = append(fields, fe.Field)
+	}
+	if want := []string{"fields._count", "fields.ids", "fields.latency", "fields.ratio", "tags.time"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("invalid parts = %v, want %v", fields, want)
+	}
+
+	if err := sanitizePoint(&Metrics{Measurement: "_internal"}); err == nil {
+		t.Error("a measurement reserved by InfluxDB was accepted")
+	}
+}
+
+func TestInvalidPointDoesNotPoisonTheBatch(t *testing.T) {
+	registryURL, frames := batchRegistry(t)
+	if err := Configure(registryURL, "test-service", "", "", "", "", WithBatching(time.Hour, 2), WithMaxTagValueLength(4), WithPipelineMetrics(time.Hour), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	var pointErr *InvalidPointError
+	if err := Send(Metrics{Fields: map[string]interface{}{"latency": math.Inf(-1)}}); !errors.As(err, &pointErr) || pointErr.Errors[0].Field != "fields.latency" {
+		t.Errorf("Send(-Inf) = %v, want fields.latency rejected", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := Send(Metrics{Tags: map[string]string{"tenant": "acme-corp"}, Fields: map[string]interface{}{"i": i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := nextBatch(t, frames)
+	if len(batch) != 2 || batch[0].Tags["tenant"] != "acme" {
+		t.Errorf("batch = %+v, want both valid points with their tenant truncated", batch)
+	}
+	p := currentPipeline()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.invalid != 1 || p.dropped != 1 {
+		t.Errorf("pipeline counted %d invalid and %d dropped points, want 1", p.invalid, p.dropped)
+	}
+}
@@ -0,0 +1,130 @@
+package instrumentation
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scalingSlots is the number of sub-windows the autoscaling window rotates
+// through, so old requests age out in steps of AutoscalingWindow/scalingSlots.
+const scalingSlots = 6
+
+// inFlight counts the requests being served.
+var inFlight atomic.Int64
+
+// TrackInFlight counts a request as in flight until done is called. Middleware,
+// GRPCWebMiddleware and TwirpMiddleware already do; adapters reporting through
+// Report call it when the request starts.
+func TrackInFlight() (done func()) {
+	inFlight.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { inFlight.Add(-1) })
+	}
+}
+
+// ScalingSignals are the saturation signals served by ScalingHandler.
+type ScalingSignals struct {
+	InFlightRequests int64 `json:"in_flight_requests"`
+	// LatencyP99Ms and Requests cover the last AutoscalingWindow, and are
+	// zero without one.
+	LatencyP99Ms  float64 `json:"latency_p99_ms"`
+	Requests      int64   `json:"requests"`
+	WindowSeconds float64 `json:"window_seconds"`
+	// QueueDepth is what the function set with WithQueueDepth returns.
+	QueueDepth int64 `json:"queue_depth"`
+}
+
+// scalingWindow keeps the latencies of the last window, in scalingSlots
+// sub-windows.
+type scalingWindow struct {
+	mu     sync.Mutex
+	window time.Duration
+	slot   time.Duration
+	starts [scalingSlots]time.Time
+	slots  [scalingSlots]latencySketch
+}
+
+var (
+	scalingMu sync.Mutex
+	scaling   *scalingWindow
+)
+
+// startScaling replaces the autoscaling window of any previously applied
+// config.
+func startScaling(cfg Config) {
+	scalingMu.Lock()
+	defer scalingMu.Unlock()
+	scaling = nil
+	if window := time.Duration(cfg.AutoscalingWindow); window > 0 {
+		scaling = &scalingWindow{window: window, slot: window / scalingSlots}
+	}
+}
+
+func currentScalingWindow() *scalingWindow {
+	scalingMu.Lock()
+	defer scalingMu.Unlock()
+	return scaling
+}
+
+func (w *scalingWindow) record(latency time.Duration, at time.Time) {
+	start := at.Truncate(w.slot)
+	index := int(start.UnixNano()/int64(w.slot)) % scalingSlots
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.starts[index].Equal(start) {
+		// The slot last held an older sub-window
+		w.starts[index] = start
+		w.slots[index] = latencySketch{}
+	}
+	w.slots[index].add(latency)
+}
+
+// sketch merges the sub-windows that started within the window before now.
+func (w *scalingWindow) sketch(now time.Time) latencySketch {
+	oldest := now.Truncate(w.slot).Add(-w.slot * (scalingSlots - 1))
+	var merged latencySketch
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for index := range w.slots {
+		if !w.starts[index].Before(oldest) {
+			merged.merge(&w.slots[index])
+		}
+	}
+	return merged
+}
+
+// CurrentScalingSignals returns the current saturation signals.
+func CurrentScalingSignals() ScalingSignals {
+	signals := ScalingSignals{InFlightRequests: inFlight.Load()}
+	if w := currentScalingWindow(); w != nil {
+		sketch := w.sketch(time.Now())
+		signals.Requests = sketch.count
+		signals.WindowSeconds = w.window.Seconds()
+		if sketch.count > 0 {
+			signals.LatencyP99Ms = float64(sketch.quantile(0.99)) / 1000
+		}
+	}
+	if queueDepth := loadSettings().queueDepth; queueDepth != nil {
+		signals.QueueDepth = queueDepth()
+	}
+	return signals
+}
+
+// ScalingHandler serves CurrentScalingSignals as JSON, for autoscalers polling
+// a metrics API, e.g. KEDA's metrics-api scaler with valueLocation set to
+// "latency_p99_ms" or "in_flight_requests":
+//
+//	http.Handle("/scaling", instrumentation.ScalingHandler())
+func ScalingHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(CurrentScalingSignals()); err != nil {
+			log.Printf("Error writing scaling signals: %v\n", err)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package instrumentation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScalingWindowAgesOutSlots(t *testing.T) {
+	w := &scalingWindow{window: time.Minute, slot: 10 * time.Second}
+	start := time.Date(2026, 3, 10, 14, 0, 0, 0, time.UTC)
+	w.record(time.Second, start)
+	for i := 0; i < 99; i++ {
+		w.record(10*time.Millisecond, start.Add(30*time.Second))
+	}
+	if s := w.sketch(start.Add(50 * time.Second)); s.count != 100 || s.quantile(0.99) > 11_000 {
+		t.Errorf("within the window: count %d, p99 %dµs", s.count, s.quantile(0.99))
+	}
+	// The slow request's slot is now out of the window
+	if s := w.sketch(start.Add(time.Minute)); s.count != 99 {
+		t.Errorf("after a minute: count %d, want 99", s.count)
+	}
+	// A slot reused by a later sub-window starts over
+	w.record(time.Millisecond, start.Add(90*time.Second))
+	if s := w.sketch(start.Add(90 * time.Second)); s.count != 1 {
+		t.Errorf("after 90s: count %d, want 1", s.count)
+	}
+}
+
+func TestScalingHandler(t *testing.T) {
+	if err := Configure(collectorURL, "test-service", "", "", "", "",
+		WithAutoscalingWindow(time.Minute),
+		WithQueueDepth(func() int64 { return 7 }),
+		WithoutSendQueue(),
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	inHandler := make(chan ScalingSignals, 1)
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- CurrentScalingSignals()
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/scaling/orders", nil))
+	nextMetrics(t)
+	if signals := <-inHandler; signals.InFlightRequests != 1 {
+		t.Errorf("in flight during the request = %d, want 1", signals.InFlightRequests)
+	}
+
+	rr := httptest.NewRecorder()
+	ScalingHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/scaling", nil))
+	var signals ScalingSignals
+	if err := json.NewDecoder(rr.Body).Decode(&signals); err != nil {
+		t.Fatal(err)
+	}
+	if signals.InFlightRequests != 0 || signals.Requests != 1 || signals.QueueDepth != 7 || signals.WindowSeconds != 60 {
+		t.Errorf("signals = %+v", signals)
+	}
+}
@@ -0,0 +1,196 @@
+package instrumentation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// secretFetchTimeout bounds each call to a SecretProvider.
+const secretFetchTimeout = 10 * time.Second
+
+// SecretProvider fetches secrets such as the InfluxDB token from a secret
+// store. Wrap an AWS Secrets Manager or Google Secret Manager client with
+// SecretProviderFunc, or use VaultSecretProvider.
+type SecretProvider interface {
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+// SecretProviderFunc adapts a function to SecretProvider.
+type SecretProviderFunc func(ctx context.Context, name string) (string, error)
+
+func (f SecretProviderFunc) GetSecret(ctx context.Context, name string) (string, error) {
+	return f(ctx, name)
+}
+
+// VaultSecretProvider reads secrets from HashiCorp Vault's KV engine (v1 or
+// v2) over its HTTP API. Secret names have the form "<path>#<key>", e.g.
+// "secret/data/influxdb#token".
+type VaultSecretProvider struct {
+	// Address is the Vault server, e.g. "https://vault.internal:8200".
+	Address string
+	// Token authenticates to Vault.
+	Token string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+func (v *VaultSecretProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	path, key, ok := strings.Cut(name, "#")
+	if !ok || path == "" || key == "" {
+		return "", fmt.Errorf("vault secret %q must have the form <path>#<key>", name)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(v.Address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", fmt.Errorf("error building vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error reading vault secret %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error reading vault secret %s: %s", path, resp.Status)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("error decoding vault secret %s: %w", path, err)
+	}
+	values := body.Data
+	// KV v2 nests the secret under data.data, next to data.metadata
+	if nested, ok := body.Data["data"]; ok {
+		if _, v2 := body.Data["metadata"]; v2 {
+			values = nil
+			if err := json.Unmarshal(nested, &values); err != nil {
+				return "", fmt.Errorf("error decoding vault secret %s: %w", path, err)
+			}
+		}
+	}
+	raw, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no key %q", path, key)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("vault secret %s key %q is not a string", path, key)
+	}
+	return value, nil
+}
+
+// influxToken holds the InfluxDB token, which may be rotated while requests
+// are being served.
+var influxToken atomic.Pointer[string]
+
+func currentToken() string {
+	if t := influxToken.Load(); t != nil {
+		return *t
+	}
+	return ""
+}
+
+func setToken(t string) {
+	influxToken.Store(&t)
+}
+
+// RotateToken replaces the InfluxDB token the registry writes new points with,
+// logs the rotation and reports it as a credential_rotated event. The token
+// travels in the session frame rather than on the WebSocket handshake, so it
+// is sent again over the open registry connection and nothing reconnects.
+// Only a fingerprint of the token is ever logged or sent.
+func RotateToken(newToken string) {
+	old := currentToken()
+	if newToken == old {
+		return
+	}
+	setToken(newToken)
+	updateSession()
+	log.Printf("InfluxDB token rotated (%s -> %s)\n", tokenFingerprint(old), tokenFingerprint(newToken))
+	sendEvent("credential_rotated", map[string]string{"credential": "influxdb_token"}, map[string]interface{}{
+		"fingerprint": tokenFingerprint(newToken),
+	})
+}
+
+// tokenFingerprint identifies a credential in logs without revealing it.
+func tokenFingerprint(t string) string {
+	if t == "" {
+		return "none"
+	}
+	sum := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(sum[:4])
+}
+
+var (
+	secretRefreshMu   sync.Mutex
+	stopSecretRefresh func()
+)
+
+// resolveToken returns the configured token, fetching it from the secret
+// provider when TokenSecret is set.
+func resolveToken(cfg Config) (string, error) {
+	if cfg.TokenSecret == "" {
+		return cfg.Token, nil
+	}
+	if cfg.SecretProvider == nil {
+		return "", fmt.Errorf("token_secret %q is set but no SecretProvider is configured", cfg.TokenSecret)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+	defer cancel()
+	t, err := cfg.SecretProvider.GetSecret(ctx, cfg.TokenSecret)
+	if err != nil {
+		return "", fmt.Errorf("error fetching token secret %q: %w", cfg.TokenSecret, err)
+	}
+	return t, nil
+}
+
+// startSecretRefresh re-fetches the token every SecretRefreshInterval, replacing
+// the refresh loop of any previously applied config.
+func startSecretRefresh(cfg Config) {
+	secretRefreshMu.Lock()
+	defer secretRefreshMu.Unlock()
+	if stopSecretRefresh != nil {
+		stopSecretRefresh()
+		stopSecretRefresh = nil
+	}
+	interval := time.Duration(cfg.SecretRefreshInterval)
+	if cfg.TokenSecret == "" || interval <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	stopSecretRefresh = func() { close(done) }
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				t, err := resolveToken(cfg)
+				if err != nil {
+					// Keep using the current token until the store is reachable again
+					log.Printf("Error refreshing secrets: %v\n", err)
+					continue
+				}
+				RotateToken(t)
+			}
+		}
+	}()
+}
@@ -0,0 +1,135 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVaultSecretProvider(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/influxdb":
+			w.Write([]byte(`{"data": {"data": {"token": "kv2-token"}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/influxdb":
+			w.Write([]byte(`{"data": {"token": "kv1-token"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	provider := &VaultSecretProvider{Address: vault.URL, Token: "vault-token"}
+
+	cases := []struct {
+		name, want string
+		wantErr    bool
+	}{
+		{"secret/data/influxdb#token", "kv2-token", false},
+		{"kv/influxdb#token", "kv1-token", false},
+		{"secret/data/influxdb#missing", "", true},
+		{"secret/data/other#token", "", true},
+		{"secret/data/influxdb", "", true},
+	}
+	for _, tc := range cases {
+		got, err := provider.GetSecret(context.Background(), tc.name)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("GetSecret(%q) = %q, %v; want %q, error %v", tc.name, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestTokenSecretIsFetchedAndRotated(t *testing.T) {
+	defer Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue())
+
+	var version atomic.Int32
+	provider := SecretProviderFunc(func(ctx context.Context, name string) (string, error) {
+		if name != "influx-token" {
+			return "", errors.New("unknown secret")
+		}
+		if version.Load() == 0 {
+			return "first", nil
+		}
+		return "second", nil
+	})
+	err := Configure(collectorURL, "test-service", "", "", "", "",
+		WithTokenSecret(provider, "influx-token"), WithSecretRefresh(10*time.Millisecond), WithoutSendQueue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := currentToken(); got != "first" {
+		t.Fatalf("token = %q, want first", got)
+	}
+
+	version.Store(1)
+	deadline := time.Now().Add(5 * time.Second)
+	for currentToken() != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal("token was not rotated")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if event := nextMetrics(t); event.Tags["event"] != "credential_rotated" {
+		t.Errorf("event = %q, want credential_rotated", event.Tags["event"])
+	}
+}
+
+func TestRotateTokenKeepsConnectionAndEmitsEvent(t *testing.T) {
+	defer setToken("")
+	// Make sure the registry connection exists before rotating
+	sendEvent("test_connect", nil, map[string]interface{}{"ok": true})
+	nextMetrics(t)
+	conn, _ := currentRegistry().Connection()
+	drainSessions()
+
+	RotateToken("rotated-token")
+	event := nextMetrics(t)
+	if event.Tags["event"] != "credential_rotated" || event.Tags["credential"] != "influxdb_token" {
+		t.Fatalf("tags = %v, want a credential_rotated event", event.Tags)
+	}
+	select {
+	case session := <-sessions:
+		if session.Token != "rotated-token" {
+			t.Errorf("session token = %q, want the new token", session.Token)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("no session with the new token")
+	}
+	if event.Fields["fingerprint"] != tokenFingerprint("rotated-token") {
+		t.Errorf("fingerprint = %v", event.Fields["fingerprint"])
+	}
+	if after, _ := currentRegistry().Connection(); after != conn {
+		t.Error("rotation replaced the registry connection")
+	}
+
+	// Rotating to the same token is a no-op
+	RotateToken("rotated-token")
+	select {
+	case metrics := <-received:
+		t.Errorf("unexpected point after a no-op rotation: %v", metrics.Tags)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTokenSecretErrors(t *testing.T) {
+	failing := SecretProviderFunc(func(ctx context.Context, name string) (string, error) {
+		return "", errors.New("store unavailable")
+	})
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithTokenSecret(failing, "influx-token"), WithoutSendQueue()); err == nil {
+		t.Error("Configure succeeded although the secret could not be fetched")
+	}
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithTokenSecret(nil, "influx-token"), WithoutSendQueue()); err == nil {
+		t.Error("Configure succeeded without a SecretProvider")
+	}
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "svc", Token: "plain", TokenSecret: "influx-token"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate accepted both token and token_secret")
+	}
+}
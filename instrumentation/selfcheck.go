@@ -0,0 +1,315 @@
+package instrumentation
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/jculley01/observability-module/transport"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxInfluxDBResponseBytes caps the InfluxDB responses read by the influxdb
+// checks.
+const maxInfluxDBResponseBytes = 1 << 20
+
+// maxClockSkew is the clock difference beyond which the clock check fails;
+// Date headers only have a one second resolution.
+const maxClockSkew = 5 * time.Second
+
+// Statuses of a SelfCheckResult.
+const (
+	CheckOK      = "ok"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+// SelfCheckReport is the outcome of SelfCheck.
+type SelfCheckReport struct {
+	// OK is false when any check failed.
+	OK     bool              `json:"ok"`
+	Checks []SelfCheckResult `json:"checks"`
+}
+
+// SelfCheckResult is the outcome of one check of SelfCheck.
+type SelfCheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Detail says what failed, or why the check was skipped.
+	Detail     string  `json:"detail,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// SelfCheck runs the checks of the package-level SelfCheck.
+func (*Instrumentor) SelfCheck(ctx context.Context) SelfCheckReport {
+	return SelfCheck(ctx)
+}
+
+// SelfCheck verifies that the active configuration can work, at startup or
+// from a diagnostics command:
+//
+//	config           the configuration is valid
+//	tls              the wss registry and https InfluxDB certificates verify
+//	registry         the registry accepts a WebSocket connection
+//	influxdb_health  InfluxDB reports itself healthy
+//	influxdb         InfluxDB accepts the token for the org and bucket, and
+//	                 with SelfCheckWriteProbe, a probe point written to the
+//	                 bucket
+//	clock            the local clock is within 5s of the registry's or
+//	                 InfluxDB's
+//
+// It doesn't send any metrics. Checks stop early when ctx is done.
+func SelfCheck(ctx context.Context) SelfCheckReport {
+	cfg := activeConfig.Load()
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	return runChecks(ctx, *cfg, func() (string, error) { return currentToken(), nil })
+}
+
+// CheckConfig runs the checks of SelfCheck against cfg without applying it,
+// e.g. to diagnose a configuration file. The token is fetched from the
+// SecretProvider when cfg has a TokenSecret.
+func CheckConfig(ctx context.Context, cfg Config) SelfCheckReport {
+	return runChecks(ctx, cfg, func() (string, error) { return resolveToken(cfg) })
+}
+
+func runChecks(ctx context.Context, cfg Config, token func() (string, error)) SelfCheckReport {
+	report := SelfCheckReport{OK: true}
+	// serverTime is the Date of a response from the registry or InfluxDB
+	var serverTime time.Time
+	run := func(name string, check func() (status, detail string)) {
+		start := time.Now()
+		status, detail := check()
+		report.Checks = append(report.Checks, SelfCheckResult{
+			Name:       name,
+			Status:     status,
+			Detail:     detail,
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+		})
+		if status == CheckFailed {
+			report.OK = false
+		}
+	}
+
+	run("config", func() (string, string) {
+		if err := cfg.Validate(); err != nil {
+			return CheckFailed, err.Error()
+		}
+		return CheckOK, ""
+	})
+	run("tls", func() (string, string) {
+		var details []string
+		registryTLS, err := cfg.RegistryTLS.clientConfig()
+		if err != nil {
+			return CheckFailed, err.Error()
+		}
+		for i, target := range []string{cfg.RegistryURL, cfg.InfluxDBURL} {
+			u, err := url.Parse(target)
+			if err != nil || (u.Scheme != "wss" && u.Scheme != "https") {
+				continue
+			}
+			var base *tls.Config
+			if i == 0 {
+				base = registryTLS
+			}
+			expiry, err := checkTLS(ctx, u, base)
+			if err != nil {
+				return CheckFailed, err.Error()
+			}
+			details = append(details, fmt.Sprintf("%s certificate expires %s", u.Host, expiry.Format(time.DateOnly)))
+		}
+		if len(details) == 0 {
+			return CheckSkipped, "no wss registry_url or https influxdb_url"
+		}
+		return CheckOK, strings.Join(details, "; ")
+	})
+	run("registry", func() (string, string) {
+		if cfg.RegistryURL == "" {
+			return CheckSkipped, "no registry_url"
+		}
+		date, err := checkRegistry(ctx, cfg)
+		if err != nil {
+			return CheckFailed, err.Error()
+		}
+		serverTime = date
+		return CheckOK, ""
+	})
+	run("influxdb_health", func() (string, string) {
+		if cfg.InfluxDBURL == "" {
+			return CheckSkipped, "no influxdb_url"
+		}
+		if err := checkInfluxDBHealth(ctx, cfg); err != nil {
+			return CheckFailed, err.Error()
+		}
+		return CheckOK, ""
+	})
+	run("influxdb", func() (string, string) {
+		if cfg.InfluxDBURL == "" {
+			return CheckSkipped, "no influxdb_url"
+		}
+		t, err := token()
+		if err != nil {
+			return CheckFailed, err.Error()
+		}
+		date, err := checkInfluxDB(ctx, cfg, t)
+		if err != nil {
+			return CheckFailed, err.Error()
+		}
+		if serverTime.IsZero() {
+			serverTime = date
+		}
+		return CheckOK, ""
+	})
+	run("clock", func() (string, string) {
+		if serverTime.IsZero() {
+			return CheckSkipped, "no server answered with a Date"
+		}
+		skew := time.Since(serverTime).Round(time.Second)
+		if skew > maxClockSkew || skew < -maxClockSkew {
+			return CheckFailed, fmt.Sprintf("local clock is %s off the server's", skew)
+		}
+		return CheckOK, ""
+	})
+	return report
+}
+
+// checkTLS verifies the certificate of the server at u, with the root CAs,
+// client certificate and server name of base if not nil, returning when it
+// expires.
+func checkTLS(ctx context.Context, u *url.URL, base *tls.Config) (time.Time, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+	tlsConfig := &tls.Config{}
+	if base != nil {
+		tlsConfig = base.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	dialer := &tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("TLS handshake with %s failed: %w", addr, err)
+	}
+	defer conn.Close()
+	return conn.(*tls.Conn).ConnectionState().PeerCertificates[0].NotAfter, nil
+}
+
+// checkInfluxDBHealth asks InfluxDB's /health whether it can serve requests.
+func checkInfluxDBHealth(ctx context.Context, cfg Config) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(cfg.InfluxDBURL, "/")+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var health struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxInfluxDBResponseBytes)).Decode(&health); err != nil {
+		return fmt.Errorf("InfluxDB answered %s without a health status", resp.Status)
+	}
+	if health.Status != "pass" {
+		return fmt.Errorf("InfluxDB is %s: %s", health.Status, health.Message)
+	}
+	return nil
+}
+
+// checkRegistry opens and closes a connection to the registry, returning the
+// Date of its handshake response.
+func checkRegistry(ctx context.Context, cfg Config) (time.Time, error) {
+	tlsConfig, err := cfg.RegistryTLS.clientConfig()
+	if err != nil {
+		return time.Time{}, err
+	}
+	conn, resp, err := transport.Dial(ctx, transport.Config{
+		URL:              cfg.RegistryURL + "/metrics",
+		Token:            registryToken(cfg.RegistryAuth, cfg.SecretProvider),
+		TokenQueryParam:  cfg.RegistryAuth.QueryParam,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: time.Duration(cfg.HandshakeTimeout),
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to dial WebSocket: %w", err)
+	}
+	conn.Close()
+	return responseDate(resp), nil
+}
+
+// checkInfluxDB looks the bucket up with the token, or writes a probe point
+// to it with SelfCheckWriteProbe, returning the Date of the response.
+func checkInfluxDB(ctx context.Context, cfg Config, token string) (time.Time, error) {
+	base := strings.TrimSuffix(cfg.InfluxDBURL, "/")
+	query := url.Values{"org": {cfg.Org}}
+	method, path := http.MethodGet, "/api/v2/buckets"
+	var body io.Reader
+	if cfg.SelfCheckWriteProbe {
+		method, path = http.MethodPost, "/api/v2/write"
+		query.Set("bucket", cfg.Bucket)
+		query.Set("precision", "s")
+		measurement := strings.NewReplacer(",", `\,`, " ", `\ `).Replace(cfg.ServiceName)
+		body = strings.NewReader(measurement + " self_check=1i")
+	} else {
+		query.Set("name", cfg.Bucket)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+path+"?"+query.Encode(), body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("Authorization", "Token "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return time.Time{}, fmt.Errorf("the token was rejected: %s", resp.Status)
+	case resp.StatusCode == http.StatusNotFound:
+		return time.Time{}, fmt.Errorf("the org or bucket doesn't exist: %s", resp.Status)
+	case resp.StatusCode >= 300:
+		return time.Time{}, fmt.Errorf("InfluxDB answered %s", resp.Status)
+	}
+	if !cfg.SelfCheckWriteProbe {
+		var buckets struct {
+			Buckets []struct {
+				Name string `json:"name"`
+			} `json:"buckets"`
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxInfluxDBResponseBytes)).Decode(&buckets); err != nil {
+			return time.Time{}, fmt.Errorf("error reading the buckets: %w", err)
+		}
+		visible := false
+		for _, b := range buckets.Buckets {
+			visible = visible || b.Name == cfg.Bucket
+		}
+		if !visible {
+			return time.Time{}, fmt.Errorf("bucket %q isn't visible with the token", cfg.Bucket)
+		}
+	}
+	return responseDate(resp), nil
+}
+
+// responseDate returns the Date header of resp, zero without one.
+func responseDate(resp *http.Response) time.Time {
+	if resp == nil {
+		return time.Time{}
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
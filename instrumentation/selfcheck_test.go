@@ -0,0 +1,134 @@
+package instrumentation
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeInfluxDB answers bucket lookups and writes for the "metrics" bucket
+// and the "good" token, and records written lines.
+func fakeInfluxDB(written chan<- string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			io.WriteString(w, `{"name": "influxdb", "status": "pass"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Token good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v2/buckets":
+			io.WriteString(w, `{"buckets": [{"name": "`+r.URL.Query().Get("name")+`"}]}`)
+		case "/api/v2/write":
+			body, _ := io.ReadAll(r.Body)
+			written <- r.URL.Query().Get("bucket") + " " + string(body)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// check returns the result of the check called name.
+func (r SelfCheckReport) check(name string) SelfCheckResult {
+	for _, check := range r.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	return SelfCheckResult{}
+}
+
+func checkStatuses(t *testing.T, report SelfCheckReport, want map[string]string) {
+	t.Helper()
+	for _, check := range report.Checks {
+		if check.Status != want[check.Name] {
+			t.Errorf("%s check = %s (%s), want %s", check.Name, check.Status, check.Detail, want[check.Name])
+		}
+	}
+	if len(report.Checks) != len(want) {
+		t.Errorf("%d checks ran, want %d", len(report.Checks), len(want))
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	written := make(chan string, 1)
+	influx := fakeInfluxDB(written)
+	defer influx.Close()
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	report := SelfCheck(ctx)
+	checkStatuses(t, report, map[string]string{"config": CheckOK, "tls": CheckSkipped, "registry": CheckOK, "influxdb_health": CheckSkipped, "influxdb": CheckSkipped, "clock": CheckSkipped})
+	if !report.OK {
+		t.Error("report isn't OK")
+	}
+
+	if err := Configure(collectorURL, "test-service", influx.URL, "good", "acme", "metrics", WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	checkStatuses(t, SelfCheck(ctx), map[string]string{"config": CheckOK, "tls": CheckSkipped, "registry": CheckOK, "influxdb_health": CheckOK, "influxdb": CheckOK, "clock": CheckOK})
+
+	if err := Configure(collectorURL, "test-service", influx.URL, "bad", "acme", "metrics", WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	if report := SelfCheck(ctx); report.OK || report.check("influxdb").Detail != "the token was rejected: 401 Unauthorized" {
+		t.Errorf("report with a bad token = %+v", report)
+	}
+
+	if err := Configure(collectorURL, "test-service", influx.URL, "good", "acme", "metrics", WithSelfCheckWriteProbe(), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	checkStatuses(t, SelfCheck(ctx), map[string]string{"config": CheckOK, "tls": CheckSkipped, "registry": CheckOK, "influxdb_health": CheckOK, "influxdb": CheckOK, "clock": CheckOK})
+	if line := <-written; line != "metrics test-service self_check=1i" {
+		t.Errorf("probe = %q", line)
+	}
+}
+
+func TestSelfCheckUnreachableRegistry(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	if err := ApplyConfig(Config{RegistryURL: "ws" + unreachable.URL[len("http"):], ServiceName: "test-service", DisableSendQueue: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if report := SelfCheck(context.Background()); report.OK || report.check("registry").Status != CheckFailed {
+		t.Errorf("report = %+v, want a failed registry check", report)
+	}
+}
+
+func TestCheckConfigWithoutApplyingIt(t *testing.T) {
+	influx := httptest.NewTLSServer(http.NotFoundHandler())
+	defer influx.Close()
+	cfg := Config{RegistryURL: collectorURL, ServiceName: "other-service", InfluxDBURL: influx.URL, Token: "good", Bucket: "metrics"}
+
+	report := CheckConfig(context.Background(), cfg)
+	// httptest certificates aren't trusted
+	if tls := report.check("tls"); tls.Status != CheckFailed || !strings.Contains(tls.Detail, "certificate") {
+		t.Errorf("tls check = %+v, want a certificate failure", tls)
+	}
+	if report.check("registry").Status != CheckOK {
+		t.Errorf("registry check = %+v", report.check("registry"))
+	}
+	if active := activeConfig.Load(); active.ServiceName != "test-service" {
+		t.Errorf("CheckConfig applied the config of %s", active.ServiceName)
+	}
+}
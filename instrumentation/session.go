@@ -0,0 +1,83 @@
+package instrumentation
+
+import (
+	"github.com/jculley01/observability-module/protocol"
+	"log"
+	"sync/atomic"
+)
+
+var (
+	// pointCredentials sends the InfluxDB settings with every point instead
+	// of in a session; see Config.PointCredentials
+	pointCredentials atomic.Bool
+	// sentSession is the session last written to the registry, nil until a
+	// connection was made
+	sentSession atomic.Pointer[protocol.Session]
+)
+
+// currentSession is the InfluxDB destination of the points of the active
+// config, their schema version, and their wire format unless it is JSON.
+func currentSession() protocol.Session {
+	session := protocol.Session{Type: protocol.SessionType, InfluxDBURL: influxDBURL, Token: currentToken(), Org: org, Bucket: bucket, SchemaVersion: currentSchemaVersion()}
+	if codec := currentCodec(); codec != protocol.JSON {
+		session.Encoding = codec.Name()
+	}
+	return session
+}
+
+// sessionFrame is the Session of the registry client: the frame written first
+// on every connection. With PointCredentials it only names the wire format
+// and the schema version, and there is none for JSON points of version 1,
+// which registries predating the session read without one.
+func sessionFrame() ([]byte, error) {
+	if pointCredentials.Load() {
+		session := protocol.Session{SchemaVersion: currentSchemaVersion()}
+		if codec := currentCodec(); codec != protocol.JSON {
+			session.Encoding = codec.Name()
+		} else if session.SchemaVersion == 1 {
+			return nil, nil
+		}
+		return protocol.EncodeSession(session)
+	}
+	session := currentSession()
+	sentSession.Store(&session)
+	return protocol.EncodeSession(session)
+}
+
+// wirePoint returns a point as it is written to the registry: without the
+// InfluxDB settings of the session, unless it goes elsewhere or
+// PointCredentials is set.
+func wirePoint(metrics Metrics) Metrics {
+	if pointCredentials.Load() {
+		return metrics
+	}
+	return currentSession().Strip(metrics)
+}
+
+// updateSession writes the session again over the registry connection when
+// the token or the destination changed since it was written. A registry
+// client about to be replaced is left alone: its successor writes the new
+// session when it connects.
+func updateSession() {
+	if pointCredentials.Load() {
+		return
+	}
+	session := currentSession()
+	if sent := sentSession.Load(); sent == nil || *sent == session {
+		return
+	}
+	client := currentRegistry()
+	if client == nil || client.URL() != wsSocketURL {
+		return
+	}
+	if _, connected := client.Connection(); !connected {
+		return
+	}
+	data, err := sessionFrame()
+	if err == nil {
+		err = client.SendSession(data)
+	}
+	if err != nil {
+		log.Printf("Error sending the session to the registry: %v\n", err)
+	}
+}
@@ -0,0 +1,136 @@
+package instrumentation
+
+import (
+	"errors"
+	"github.com/jculley01/observability-module/protocol"
+	"testing"
+	"time"
+)
+
+func nextSession(t *testing.T) protocol.Session {
+	t.Helper()
+	select {
+	case session := <-sessions:
+		return session
+	case <-time.After(2 * time.Second):
+		t.Fatal("no session received")
+		return protocol.Session{}
+	}
+}
+
+func TestSessionCarriesCredentials(t *testing.T) {
+	drainSessions()
+	if err := Configure(collectorURL, "test-service", "http://influxdb:8086", "session-token", "", "", WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := Send(Metrics{Fields: map[string]interface{}{"n": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	point := nextMetrics(t)
+	if point.InfluxDBURL != "" || point.Token != "" {
+		t.Errorf("point carries %q %q, want no credentials", point.InfluxDBURL, point.Token)
+	}
+	if session := nextSession(t); session.InfluxDBURL != "http://influxdb:8086" || session.Token != "session-token" {
+		t.Errorf("session = %+v", session)
+	}
+
+	// A point going elsewhere keeps its destination
+	if err := Send(Metrics{InfluxDBURL: "http://other:8086", Token: "other-token", Fields: map[string]interface{}{"n": 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if point := nextMetrics(t); point.InfluxDBURL != "http://other:8086" || point.Token != "other-token" {
+		t.Errorf("point for another InfluxDB = %q %q", point.InfluxDBURL, point.Token)
+	}
+}
+
+func TestWithPointCredentials(t *testing.T) {
+	if err := Configure(collectorURL, "test-service", "http://influxdb:8086", "point-token", "", "", WithPointCredentials(), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := Send(Metrics{Fields: map[string]interface{}{"n": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if point := nextMetrics(t); point.InfluxDBURL != "http://influxdb:8086" || point.Token != "point-token" {
+		t.Errorf("point carries %q %q, want the credentials", point.InfluxDBURL, point.Token)
+	}
+}
+
+func TestSessionNamesBinaryEncoding(t *testing.T) {
+	defer storeWireCodec("")
+	defer pointCredentials.Store(false)
+	pointCredentials.Store(true)
+	if data, err := sessionFrame(); err != nil || data != nil {
+		t.Errorf("session with PointCredentials and JSON = %s, %v, want none", data, err)
+	}
+	storeWireCodec(WireFormatMessagePack)
+	data, err := sessionFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session, ok := protocol.DecodeSession(data); !ok || session.Encoding != WireFormatMessagePack || session.Token != "" || session.SchemaVersion != protocol.SchemaVersion {
+		t.Errorf("session with PointCredentials and MessagePack = %s", data)
+	}
+}
+
+func TestSessionNamesSchemaVersion(t *testing.T) {
+	drainSessions()
+	if err := Configure(collectorURL, "test-service", "http://influxdb:8086", "secret-token", "", "", WithSchemaVersion(1), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := Send(Metrics{Fields: map[string]interface{}{"count": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	nextMetrics(t)
+	if session := nextSession(t); session.Version() != 1 {
+		t.Errorf("session schema version = %d, want 1", session.Version())
+	}
+
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "orders", SchemaVersion: protocol.SchemaVersion + 1}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || validationErr.Errors[0].Field != "schema_version" {
+		t.Errorf("Validate() = %v, want schema_version rejected", err)
+	}
+}
+
+func TestAcknowledgedDelivery(t *testing.T) {
+	if err := Configure(collectorURL, "test-service", "http://influxdb:8086", "secret-token", "", "", WithAcknowledgedDelivery(), WithWireFormat(WireFormatProtobuf), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		if err := Send(Metrics{Fields: map[string]interface{}{"i": i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if point := nextMetrics(t); point.Fields["i"] != float64(i) {
+			t.Errorf("point %d = %+v", i, point)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for currentRegistry().Unacked() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d frames not acknowledged", currentRegistry().Unacked())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
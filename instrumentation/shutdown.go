@@ -0,0 +1,143 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrStopped is returned for points sent after Shutdown, until a config is
+// applied again.
+var ErrStopped = errors.New("instrumentation is shut down")
+
+// stopped is set by Shutdown and cleared by ApplyConfig.
+var stopped atomic.Bool
+
+// Instrumentor is a handle on the running instrumentation, for its lifecycle.
+// The instrumentation is process-wide, so every Instrumentor (and the
+// package-level Shutdown) controls the same one.
+//
+// Deprecated: use Instrumenter in
+// github.com/jculley01/observability-module/v2/instrumentation.
+type Instrumentor struct{}
+
+// Start applies cfg like ApplyConfig and returns the Instrumentor to shut it
+// down with.
+//
+// Deprecated: use New in
+// github.com/jculley01/observability-module/v2/instrumentation.
+func Start(cfg Config) (*Instrumentor, error) {
+	if err := ApplyConfig(cfg); err != nil {
+		return nil, err
+	}
+	return &Instrumentor{}, nil
+}
+
+// Shutdown stops the instrumentation. See the package-level Shutdown.
+func (*Instrumentor) Shutdown(ctx context.Context) error {
+	return Shutdown(ctx)
+}
+
+// Shutdown drains pending metrics (the current aggregation window, domain
+// events, error reports being sent and the points queued for exporters),
+// tells the registry the service is going away with a service_deregistered
+// event and closes the connection with a close frame.
+// Call it on SIGTERM once the HTTP server has stopped serving, e.g. after
+// http.Server.Shutdown; points reported afterwards fail with ErrStopped.
+func Shutdown(ctx context.Context) error {
+	var errs []error
+	startSecretRefresh(Config{})
+	// Flushes the window in progress
+	startAggregation(Config{})
+	startReports(Config{})
+	startClientProfiles(Config{})
+	startPipelineMetrics(Config{})
+	if err := startLocalStore(Config{}); err != nil {
+		errs = append(errs, err)
+	}
+	if err := stopSendQueue(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if p := currentPusher(); p != nil {
+		startPushing(Config{})
+		if err := PushToGateway(ctx, p.url, p.job); err != nil {
+			errs = append(errs, fmt.Errorf("error pushing metrics to the Pushgateway: %w", err))
+		}
+	}
+	if err := stopOTLP(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := stopOutbox(); err != nil {
+		errs = append(errs, err)
+	}
+	if flusher, ok := loadSettings().errorReporter.(errorReportFlusher); ok {
+		if err := flusher.Flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("error flushing error reports: %w", err))
+		}
+	}
+
+	if err := stopPrometheus(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Without a connection there is nothing to deregister from, and dialing
+	// could outlast ctx
+	connected := false
+	if client := currentRegistry(); client != nil {
+		_, connected = client.Connection()
+	}
+	if connected {
+		sendEvent("service_deregistered", nil, map[string]interface{}{"instance_id": instanceID})
+	}
+	stopped.Store(true)
+	if err := stopDatadog(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := stopMQTT(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := stopGraphite(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := stopElasticsearch(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := stopVictoriaMetrics(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := stopRemoteWrite(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := stopExporters(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := stopBatching(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := stopSpill(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := closeConnection(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := startDebugCapture(Config{}); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// closeConnection sends a close frame and waits for the registry to close its
+// side, or for ctx to be done. With acknowledged delivery, frames the registry
+// didn't acknowledge by then are lost.
+func closeConnection(ctx context.Context) error {
+	client := currentRegistry()
+	if client == nil {
+		return nil
+	}
+	err := client.Close(ctx)
+	if unacked := client.Unacked(); unacked > 0 {
+		err = errors.Join(err, fmt.Errorf("%d frames the registry didn't acknowledge are lost", unacked))
+	}
+	return err
+}
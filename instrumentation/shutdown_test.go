@@ -0,0 +1,49 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownFlushesAndCloses(t *testing.T) {
+	inst, err := Start(Config{RegistryURL: collectorURL, ServiceName: "test-service", AggregationWindow: Duration(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Make sure the connection is up, then leave a request in the window
+	if err := sendMetrics(Metrics{Measurement: "test-service"}); err != nil {
+		t.Fatal(err)
+	}
+	nextMetrics(t)
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/shutdown/pending", nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := inst.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+
+	if metrics := nextMetrics(t); metrics.Tags["endpoint"] != "/shutdown/pending" {
+		t.Errorf("first point after Shutdown = %v, want the flushed window", metrics.Tags)
+	}
+	if metrics := nextMetrics(t); metrics.Tags["event"] != "service_deregistered" {
+		t.Errorf("second point after Shutdown = %v, want service_deregistered", metrics.Tags)
+	}
+	if _, connected := currentRegistry().Connection(); connected {
+		t.Error("connection still open after Shutdown")
+	}
+	if err := sendMetrics(Metrics{}); !errors.Is(err, ErrStopped) {
+		t.Errorf("sendMetrics after Shutdown = %v, want ErrStopped", err)
+	}
+}
@@ -0,0 +1,83 @@
+package instrumentation
+
+import (
+	"bytes"
+	"encoding/xml"
+	"mime"
+	"strings"
+)
+
+// soapEndpoint appends the operation to the path when it is acceptable as a tag.
+func soapEndpoint(path, operation string) string {
+	return operationEndpoint(path, operation, loadSettings().soapOperations)
+}
+
+// isXMLContentType reports whether a request may carry a SOAP or XML-RPC body.
+func isXMLContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/xml" || mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// soapActionOperation extracts the operation name from a SOAP 1.1 SOAPAction
+// header or the action parameter of a SOAP 1.2 Content-Type.
+func soapActionOperation(soapAction, contentType string) string {
+	action := strings.Trim(strings.TrimSpace(soapAction), `"`)
+	if action == "" {
+		if _, params, err := mime.ParseMediaType(contentType); err == nil {
+			action = params["action"]
+		}
+	}
+	if action == "" {
+		return ""
+	}
+
+	// Actions are usually URIs such as "http://tempuri.org/IUserService/GetUser"
+	// or "urn:GetUser"; only the trailing operation name is kept.
+	if i := strings.LastIndexAny(action, "/#:"); i >= 0 {
+		action = action[i+1:]
+	}
+	return action
+}
+
+// xmlOperation returns the operation of a SOAP envelope (the first element in
+// the Body) or the methodName of an XML-RPC call. Other documents yield "".
+func xmlOperation(data []byte) string {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	inBody, inMethodCall, inMethodName := false, false, false
+
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			// Includes bodies truncated by the peek limit before the operation
+			return ""
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 1 && t.Name.Local == "methodCall":
+				inMethodCall = true
+			case depth == 1 && t.Name.Local != "Envelope":
+				return ""
+			case depth == 2 && inMethodCall && t.Name.Local == "methodName":
+				inMethodName = true
+			case depth == 2 && t.Name.Local == "Body":
+				inBody = true
+			case depth == 3 && inBody:
+				return t.Name.Local
+			}
+		case xml.CharData:
+			if inMethodName {
+				return strings.TrimSpace(string(t))
+			}
+		case xml.EndElement:
+			depth--
+			inMethodName = false
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package instrumentation
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const soapEnvelope = `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Header><Auth>secret</Auth></soap:Header>
+  <soap:Body><GetUser xmlns="http://tempuri.org/"><id>42</id></GetUser></soap:Body>
+</soap:Envelope>`
+
+const xmlRPCCall = `<?xml version="1.0"?>
+<methodCall><methodName> users.get </methodName><params/></methodCall>`
+
+func TestSOAPActionOperation(t *testing.T) {
+	cases := []struct {
+		name, soapAction, contentType, want string
+	}{
+		{"soap 1.1 uri", `"http://tempuri.org/IUserService/GetUser"`, "text/xml", "GetUser"},
+		{"soap 1.1 fragment", `"http://example.com/users#DeleteUser"`, "text/xml", "DeleteUser"},
+		{"soap 1.1 empty", `""`, "text/xml; charset=utf-8", ""},
+		{"soap 1.2 content type", "", `application/soap+xml; charset=utf-8; action="urn:ListUsers"`, "ListUsers"},
+		{"header wins", `"urn:GetUser"`, `application/soap+xml; action="urn:ListUsers"`, "GetUser"},
+		{"nothing", "", "application/soap+xml", ""},
+	}
+	for _, tc := range cases {
+		if got := soapActionOperation(tc.soapAction, tc.contentType); got != tc.want {
+			t.Errorf("%s: soapActionOperation(%q, %q) = %q, want %q", tc.name, tc.soapAction, tc.contentType, got, tc.want)
+		}
+	}
+}
+
+func TestXMLOperation(t *testing.T) {
+	cases := []struct {
+		name, body, want string
+	}{
+		{"soap envelope", soapEnvelope, "GetUser"},
+		{"xml-rpc", xmlRPCCall, "users.get"},
+		{"truncated before operation", soapEnvelope[:strings.Index(soapEnvelope, "<soap:Body>")+4], ""},
+		{"plain xml document", `<order><id>1</id></order>`, ""},
+		{"not xml", `{"method":"x"}`, ""},
+	}
+	for _, tc := range cases {
+		if got := xmlOperation([]byte(tc.body)); got != tc.want {
+			t.Errorf("%s: xmlOperation = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLogicalEndpoint(t *testing.T) {
+	defer applyOptions(nil)
+
+	cases := []struct {
+		name        string
+		opts        []Option
+		contentType string
+		soapAction  string
+		body        string
+		want        string
+	}{
+		{"disabled", nil, "text/xml", "", soapEnvelope, "/soap"},
+		{"from body", []Option{WithSOAPActionExtraction()}, "text/xml", "", soapEnvelope, "/soap#GetUser"},
+		{"from header", []Option{WithSOAPActionExtraction()}, "text/xml", `"urn:Ping"`, soapEnvelope, "/soap#Ping"},
+		{"json body not peeked", []Option{WithSOAPActionExtraction()}, "application/json", `"urn:Ping"`, soapEnvelope, "/soap"},
+		{"invalid operation", []Option{WithSOAPActionExtraction()}, "text/xml", `"urn:<script>"`, soapEnvelope, "/soap"},
+		{"allowlisted", []Option{WithSOAPActionExtraction("GetUser")}, "text/xml", "", soapEnvelope, "/soap#GetUser"},
+		{"not allowlisted", []Option{WithSOAPActionExtraction("GetUser")}, "text/xml", `"urn:Ping"`, soapEnvelope, "/soap"},
+	}
+	for _, tc := range cases {
+		applyOptions(tc.opts)
+		r := httptest.NewRequest(http.MethodPost, "/soap", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", tc.contentType)
+		if tc.soapAction != "" {
+			r.Header.Set("SOAPAction", tc.soapAction)
+		}
+
+		if got := LogicalEndpoint(r, r.URL.Path); got != tc.want {
+			t.Errorf("%s: LogicalEndpoint = %q, want %q", tc.name, got, tc.want)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil || string(body) != tc.body {
+			t.Errorf("%s: handler body = %q (err %v), want it unchanged", tc.name, body, err)
+		}
+	}
+}
+
+func TestLogicalEndpointRestoresLargeBody(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{WithSOAPActionExtraction()})
+
+	// Larger than the peek limit, with the operation beyond it
+	large := "<soap:Envelope><soap:Body>" + strings.Repeat(" ", defaultBodyPeekLimit) + "<Upload/></soap:Body></soap:Envelope>"
+	r := httptest.NewRequest(http.MethodPost, "/soap", strings.NewReader(large))
+	r.Header.Set("Content-Type", "text/xml")
+
+	if got := LogicalEndpoint(r, r.URL.Path); got != "/soap" {
+		t.Errorf("LogicalEndpoint = %q, want /soap", got)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil || string(body) != large {
+		t.Errorf("handler body has %d bytes (err %v), want the %d original bytes", len(body), err, len(large))
+	}
+}
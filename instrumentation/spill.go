@@ -0,0 +1,389 @@
+package instrumentation
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSpillMaxBytes       = 256 << 20
+	defaultSpillSegmentBytes   = 8 << 20
+	defaultSpillReplayInterval = 5 * time.Second
+	spillFilePrefix            = "spill-"
+	spillFileSuffix            = ".jsonl"
+)
+
+// SpillConfig writes the points that can't be sent to the registry, e.g.
+// during an outage, to segment files in Dir rather than dropping them, and
+// replays them, oldest first, once the registry is reachable again. This is
+// checked every ReplayInterval (5s if zero), and on startup for points
+// spilled before a restart. Segments are rotated at SegmentBytes (8MiB if
+// zero), and the oldest ones are dropped once they exceed MaxBytes (256MiB
+// if zero).
+//
+// Spilled points are timestamped, so they land at the time they were taken,
+// and written without their token, which is set again on replay.
+type SpillConfig struct {
+	Dir            string   `json:"dir"`
+	MaxBytes       int64    `json:"max_bytes"`
+	SegmentBytes   int64    `json:"segment_bytes"`
+	ReplayInterval Duration `json:"replay_interval"`
+}
+
+// spill is the write-ahead log of the points that couldn't be sent.
+type spill struct {
+	config       SpillConfig
+	maxBytes     int64
+	segmentBytes int64
+	interval     time.Duration
+	done         chan struct{}
+
+	mu sync.Mutex
+	// seq numbers the segments, so their names sort in the order written
+	seq int64
+	// active is the segment being appended to, and its size
+	active     *os.File
+	activeSize int64
+	// spilling is set while points are spilled, to log the start of an
+	// outage once
+	spilling bool
+	// replayMu makes replays run one at a time
+	replayMu sync.Mutex
+}
+
+var (
+	spillMu      sync.Mutex
+	currentSpill *spill
+)
+
+// startSpill replaces the spill of any previously applied config, keeping it
+// when its config is unchanged. Segments left in Dir are replayed.
+func startSpill(cfg Config) error {
+	spillMu.Lock()
+	defer spillMu.Unlock()
+	if currentSpill != nil && currentSpill.config == cfg.Spill {
+		return nil
+	}
+	if previous := currentSpill; previous != nil {
+		close(previous.done)
+		if err := previous.close(); err != nil {
+			log.Printf("Error closing the spill: %v\n", err)
+		}
+		currentSpill = nil
+	}
+	if cfg.Spill.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.Spill.Dir, 0o700); err != nil {
+		return fmt.Errorf("error creating the spill directory: %w", err)
+	}
+	s := &spill{
+		config:       cfg.Spill,
+		maxBytes:     cfg.Spill.MaxBytes,
+		segmentBytes: cfg.Spill.SegmentBytes,
+		interval:     time.Duration(cfg.Spill.ReplayInterval),
+		done:         make(chan struct{}),
+	}
+	if s.maxBytes == 0 {
+		s.maxBytes = defaultSpillMaxBytes
+	}
+	if s.segmentBytes == 0 {
+		s.segmentBytes = defaultSpillSegmentBytes
+	}
+	if s.interval == 0 {
+		s.interval = defaultSpillReplayInterval
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return fmt.Errorf("error reading the spill directory: %w", err)
+	}
+	if len(segments) > 0 {
+		s.seq = segments[len(segments)-1].seq
+	}
+	currentSpill = s
+	go s.run()
+	return nil
+}
+
+// stopSpill closes the active segment; what is spilled is replayed after the
+// next start.
+func stopSpill() error {
+	spillMu.Lock()
+	s := currentSpill
+	currentSpill = nil
+	spillMu.Unlock()
+	if s == nil {
+		return nil
+	}
+	close(s.done)
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+	if err := s.close(); err != nil {
+		return fmt.Errorf("error closing the spill: %w", err)
+	}
+	return nil
+}
+
+// spillPoints writes points that couldn't be sent to the spill, and reports
+// whether it did.
+func spillPoints(points []Metrics) bool {
+	spillMu.Lock()
+	s := currentSpill
+	spillMu.Unlock()
+	if s == nil {
+		return false
+	}
+	if err := s.write(points, time.Now()); err != nil {
+		log.Printf("Error spilling %d points: %v\n", len(points), err)
+		return false
+	}
+	return true
+}
+
+func (s *spill) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.replay()
+		}
+	}
+}
+
+// write appends points to the active segment.
+func (s *spill) write(points []Metrics, now time.Time) error {
+	var buf []byte
+	for _, metrics := range points {
+		if metrics.Timestamp == 0 {
+			metrics.Timestamp = unixTimestamp(now, PrecisionMilliseconds)
+			metrics.Precision = PrecisionMilliseconds
+		}
+		metrics.Token = ""
+		line, err := json.Marshal(metrics)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.spilling {
+		log.Printf("Registry unreachable, spilling points to %s\n", s.config.Dir)
+		s.spilling = true
+	}
+	if s.active == nil || s.activeSize >= s.segmentBytes {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := s.active.Write(buf)
+	s.activeSize += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.evictLocked()
+}
+
+// rotateLocked closes the active segment and starts a new one.
+func (s *spill) rotateLocked() error {
+	if err := s.closeLocked(); err != nil {
+		return err
+	}
+	s.seq++
+	f, err := os.OpenFile(s.path(s.seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	s.active, s.activeSize = f, 0
+	return nil
+}
+
+func (s *spill) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeLocked()
+}
+
+func (s *spill) closeLocked() error {
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active, s.activeSize = nil, 0
+	return err
+}
+
+func (s *spill) path(seq int64) string {
+	return filepath.Join(s.config.Dir, fmt.Sprintf("%s%020d%s", spillFilePrefix, seq, spillFileSuffix))
+}
+
+// spillSegment is a segment file and its sequence number.
+type spillSegment struct {
+	path string
+	seq  int64
+	size int64
+}
+
+// segments lists the segment files, oldest first.
+func (s *spill) segments() ([]spillSegment, error) {
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []spillSegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, spillFilePrefix) || !strings.HasSuffix(name, spillFileSuffix) {
+			continue
+		}
+		var seq int64
+		if _, err := fmt.Sscanf(strings.TrimPrefix(name, spillFilePrefix), "%d", &seq); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, spillSegment{path: filepath.Join(s.config.Dir, name), seq: seq, size: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+	return segments, nil
+}
+
+// evictLocked removes the oldest segments while the spill exceeds maxBytes,
+// keeping the active one.
+func (s *spill) evictLocked() error {
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, segment := range segments {
+		total += segment.size
+	}
+	for _, segment := range segments {
+		if total <= s.maxBytes || segment.seq == s.seq {
+			break
+		}
+		if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= segment.size
+		log.Printf("Dropped spilled points of %s, over the spill's max_bytes\n", filepath.Base(segment.path))
+	}
+	return nil
+}
+
+// replay sends the spilled points, oldest first, and stops at the first one
+// that can't be sent; the rest of its segment is kept for the next replay.
+func (s *spill) replay() {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+	s.mu.Lock()
+	// Points spilled from now on go to a new segment
+	err := s.closeLocked()
+	segments, listErr := s.segments()
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Error closing the spill: %v\n", err)
+	}
+	if listErr != nil {
+		log.Printf("Error reading the spill directory: %v\n", listErr)
+		return
+	}
+	if len(segments) == 0 || wsSocketURL == "" {
+		return
+	}
+	if err := registryClient().Connect(context.Background()); err != nil {
+		return
+	}
+	replayed := 0
+	for _, segment := range segments {
+		n, err := replaySegment(segment.path)
+		replayed += n
+		if err != nil {
+			log.Printf("Error replaying spilled points, retrying in %v: %v\n", s.interval, err)
+			return
+		}
+	}
+	s.mu.Lock()
+	s.spilling = false
+	s.mu.Unlock()
+	log.Printf("Replayed %d spilled points\n", replayed)
+}
+
+// replaySegment sends the points of a segment and removes it. When a point
+// can't be sent, the segment is rewritten with the points left.
+func replaySegment(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	token := currentToken()
+	sent := 0
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		// Integer fields stay integers, as they were sent before the outage
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.UseNumber()
+		var metrics Metrics
+		if err := decoder.Decode(&metrics); err != nil {
+			log.Printf("Skipping a corrupt spilled point in %s: %v\n", filepath.Base(path), err)
+			continue
+		}
+		if metrics.InfluxDBURL == influxDBURL {
+			metrics.Token = token
+		}
+		if err := writePoint(metrics); err != nil {
+			if rewriteErr := rewriteSegment(path, lines[i:]); rewriteErr != nil {
+				return sent, rewriteErr
+			}
+			return sent, err
+		}
+		sent++
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return sent, err
+	}
+	return sent, nil
+}
+
+// rewriteSegment replaces a segment with lines, atomically.
+func rewriteSegment(path string, lines []string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		if _, err := w.WriteString(line); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
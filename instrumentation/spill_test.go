@@ -0,0 +1,203 @@
+package instrumentation
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/jculley01/observability-module/protocol"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpillReplaysPointsOnceRegistryIsBack(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	dir := t.TempDir()
+	spill := SpillConfig{Dir: dir, ReplayInterval: Duration(10 * time.Millisecond)}
+	if err := Configure("ws://"+addr, "test-service", "http://influxdb:8086", "secret-token", "", "", WithSpill(spill), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		if err := Send(Metrics{Fields: map[string]interface{}{"i": i}}); err != nil {
+			t.Fatalf("Send during the outage = %v, want the point spilled", err)
+		}
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "spill-*.jsonl"))
+	if len(segments) == 0 {
+		t.Fatal("no spill segment written")
+	}
+	data, err := os.ReadFile(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret-token") {
+		t.Error("spilled points hold the token")
+	}
+	var spilled Metrics
+	if err := json.Unmarshal([]byte(strings.SplitN(string(data), "\n", 2)[0]), &spilled); err != nil {
+		t.Fatal(err)
+	}
+	if spilled.Timestamp == 0 || spilled.Precision != PrecisionMilliseconds {
+		t.Errorf("spilled point timestamp = %d %q, want one in ms", spilled.Timestamp, spilled.Precision)
+	}
+
+	// The registry comes back on the same address
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("can't listen on %s again: %v", addr, err)
+	}
+	frames := make(chan Metrics, 16)
+	sessions := make(chan protocol.Session, 16)
+	upgrader := websocket.Upgrader{}
+	registry := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if session, ok := protocol.DecodeSession(data); ok {
+				sessions <- session
+				continue
+			}
+			var metrics Metrics
+			if json.Unmarshal(data, &metrics) == nil {
+				frames <- metrics
+			}
+		}
+	}))
+	registry.Listener = listener
+	registry.Start()
+	defer registry.Close()
+	defer Shutdown(context.Background())
+
+	select {
+	case session := <-sessions:
+		if session.Token != "secret-token" {
+			t.Errorf("session token = %q, want secret-token", session.Token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session written to the registry")
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case metrics := <-frames:
+			if metrics.Fields["i"] != float64(i) || metrics.Timestamp != spilled.Timestamp && i == 0 {
+				t.Errorf("replayed point %d = %+v", i, metrics)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("spilled point %d not replayed", i)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if segments, _ := filepath.Glob(filepath.Join(dir, "spill-*.jsonl")); len(segments) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replayed segments not removed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSpillReplayKeepsIntegerFields(t *testing.T) {
+	frames := make(chan string, 16)
+	upgrader := websocket.Upgrader{}
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, ok := protocol.DecodeSession(data); !ok {
+				frames <- string(data)
+			}
+		}
+	}))
+	defer registry.Close()
+	if err := Configure("ws"+strings.TrimPrefix(registry.URL, "http"), "test-service", "", "", "", "", WithWireFormat(WireFormatLineProtocol), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	s := &spill{config: SpillConfig{Dir: t.TempDir()}, maxBytes: defaultSpillMaxBytes, segmentBytes: defaultSpillSegmentBytes}
+	point := Metrics{Measurement: "orders", Fields: map[string]interface{}{"rows": 5, "duration": 0.5}}
+	if err := s.write([]Metrics{point}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := s.segments()
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("segments = %+v, %v", segments, err)
+	}
+	if n, err := replaySegment(segments[0].path); n != 1 || err != nil {
+		t.Fatalf("replaySegment = %d, %v", n, err)
+	}
+	select {
+	case frame := <-frames:
+		// Written as a float, rows would conflict with the live points' type
+		if !strings.Contains(frame, "rows=5i") || !strings.Contains(frame, "duration=0.5") {
+			t.Errorf("replayed frame = %q, want rows=5i and duration=0.5", frame)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("spilled point not replayed")
+	}
+}
+
+func TestSpillDropsOldestSegmentsOverMaxBytes(t *testing.T) {
+	dir := t.TempDir()
+	s := &spill{config: SpillConfig{Dir: dir}, maxBytes: 1000, segmentBytes: 300}
+	point := Metrics{Measurement: "orders", Fields: map[string]interface{}{"padding": strings.Repeat("x", 200)}}
+	for i := 0; i < 10; i++ {
+		if err := s.write([]Metrics{point}, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := s.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, segment := range segments {
+		total += segment.size
+	}
+	if total > 1000 || segments[len(segments)-1].seq != s.seq {
+		t.Errorf("spill holds %d bytes in %+v, want at most 1000 and the newest segment", total, segments)
+	}
+}
@@ -0,0 +1,48 @@
+package instrumentation
+
+import (
+	"sync"
+)
+
+// statusFamilies are the status code families with a status_<family>_count
+// field on every point.
+var statusFamilies = []string{"2xx", "3xx", "4xx", "5xx"}
+
+// statusFamilyCounts holds an *atomic.Int64 per statusFamilyKey.
+var statusFamilyCounts sync.Map
+
+type statusFamilyKey struct {
+	endpoint string
+	family   string
+}
+
+// statusFamily returns the family of a status code, or "" for codes outside
+// of statusFamilies.
+func statusFamily(statusCode int) string {
+	if statusCode < 200 || statusCode >= 600 {
+		return ""
+	}
+	return statusFamilies[statusCode/100-2]
+}
+
+func incrementEndpointStatusFamilyCount(endpoint, family string) {
+	incrementCounter(&statusFamilyCounts, statusFamilyKey{endpoint, family})
+}
+
+// getEndpointStatusFamilyCount retrieves the count of responses of a status
+// family for an endpoint.
+func getEndpointStatusFamilyCount(endpoint, family string) int64 {
+	return loadCounter(&statusFamilyCounts, statusFamilyKey{endpoint, family})
+}
+
+// countStatusFamily counts a response of endpoint under the family of
+// statusCode (none if 0, e.g. for aggregated points) and adds the per-family
+// counts to its fields.
+func countStatusFamily(fields map[string]interface{}, endpoint string, statusCode int) {
+	if family := statusFamily(statusCode); family != "" {
+		incrementEndpointStatusFamilyCount(endpoint, family)
+	}
+	for _, family := range statusFamilies {
+		fields["status_"+family+"_count"] = getEndpointStatusFamilyCount(endpoint, family)
+	}
+}
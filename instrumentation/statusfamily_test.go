@@ -0,0 +1,54 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestStatusFamily(t *testing.T) {
+	for code, want := range map[int]string{0: "", 101: "", 200: "2xx", 204: "2xx", 302: "3xx", 404: "4xx", 503: "5xx", 600: ""} {
+		if got := statusFamily(code); got != want {
+			t.Errorf("statusFamily(%d) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestMiddlewareCountsStatusFamilies(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(status)
+	}))
+	for _, status := range []string{"200", "201", "404", "503"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/families?status="+status, nil))
+		nextMetrics(t)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/families?status=302", nil))
+	metrics := nextMetrics(t)
+	want := map[string]float64{"status_2xx_count": 2, "status_3xx_count": 1, "status_4xx_count": 1, "status_5xx_count": 1}
+	for field, value := range want {
+		if metrics.Fields[field] != value {
+			t.Errorf("%s = %v, want %v", field, metrics.Fields[field], value)
+		}
+	}
+}
+
+func TestCountStatusFamiliesConcurrently(t *testing.T) {
+	before := getEndpointStatusFamilyCount("/families/concurrent", "2xx")
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				incrementEndpointStatusFamilyCount("/families/concurrent", "2xx")
+			}
+		}()
+	}
+	wg.Wait()
+	if got := getEndpointStatusFamilyCount("/families/concurrent", "2xx") - before; got != 1000 {
+		t.Errorf("counted %d responses, want 1000", got)
+	}
+}
@@ -0,0 +1,414 @@
+package instrumentation
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStoreRetention = 24 * time.Hour
+	defaultStoreMaxBytes  = 64 << 20
+	storeFilePrefix       = "rollups-"
+	storeFileSuffix       = ".jsonl"
+	storeHourLayout       = "2006010215"
+)
+
+// LocalStoreConfig keeps hourly rollups per endpoint (request and error
+// counts and a latency sketch) on disk in Dir, so they survive restarts and
+// collector outages. Rollups older than Retention (24h if zero) are dropped,
+// and the oldest hours are dropped first once the files exceed MaxBytes (64MiB
+// if zero).
+type LocalStoreConfig struct {
+	Dir       string   `json:"dir"`
+	Retention Duration `json:"retention"`
+	MaxBytes  int64    `json:"max_bytes"`
+}
+
+// Rollup is what an endpoint saw during one hour.
+type Rollup struct {
+	Hour         time.Time `json:"hour"`
+	Endpoint     string    `json:"endpoint"`
+	Requests     int64     `json:"requests"`
+	Errors       int64     `json:"errors"`
+	LatencyP50Ms float64   `json:"latency_p50_ms"`
+	LatencyP95Ms float64   `json:"latency_p95_ms"`
+	LatencyP99Ms float64   `json:"latency_p99_ms"`
+	LatencyMaxMs float64   `json:"latency_max_ms"`
+}
+
+// storedRollup is a line of a store file. Several lines can hold the same
+// hour and endpoint, e.g. after a restart; they add up.
+type storedRollup struct {
+	Hour     time.Time    `json:"hour"`
+	Endpoint string       `json:"endpoint"`
+	Errors   int64        `json:"errors"`
+	Good     int64        `json:"good"`
+	Latency  storedSketch `json:"latency"`
+}
+
+// storedSketch is a latencySketch with only its non-empty buckets.
+type storedSketch struct {
+	Buckets [][2]int64 `json:"buckets"`
+	Count   int64      `json:"count"`
+	Sum     int64      `json:"sum"`
+	Min     int64      `json:"min"`
+	Max     int64      `json:"max"`
+}
+
+func (s *latencySketch) stored() storedSketch {
+	stored := storedSketch{Buckets: [][2]int64{}, Count: s.count, Sum: s.sum, Min: s.min, Max: s.max}
+	for index, c := range s.counts {
+		if c > 0 {
+			stored.Buckets = append(stored.Buckets, [2]int64{int64(index), c})
+		}
+	}
+	return stored
+}
+
+func (stored storedSketch) sketch() (latencySketch, error) {
+	s := latencySketch{count: stored.Count, sum: stored.Sum, min: stored.Min, max: stored.Max}
+	for _, bucket := range stored.Buckets {
+		index := bucket[0]
+		if index < 0 || index > int64(sketchIndex(1<<62)) {
+			return latencySketch{}, fmt.Errorf("invalid sketch bucket %d", index)
+		}
+		if int(index) >= len(s.counts) {
+			s.counts = append(s.counts, make([]int64, int(index)+1-len(s.counts))...)
+		}
+		s.counts[index] += bucket[1]
+	}
+	return s, nil
+}
+
+// hourlyRollup is what an endpoint saw during the hour in progress.
+type hourlyRollup struct {
+	latency latencySketch
+	errors  int64
+	good    int64
+}
+
+// localStore writes the rollups of each hour to their own file once the hour
+// is over.
+type localStore struct {
+	dir       string
+	retention time.Duration
+	maxBytes  int64
+
+	mu      sync.Mutex
+	hour    time.Time
+	current map[string]*hourlyRollup
+	done    chan struct{}
+}
+
+var (
+	localStoreMu sync.Mutex
+	localRollups *localStore
+)
+
+func currentLocalStore() *localStore {
+	localStoreMu.Lock()
+	defer localStoreMu.Unlock()
+	return localRollups
+}
+
+// startLocalStore opens the store of cfg.LocalStore, replacing the store of
+// any previously applied config after writing what it held.
+func startLocalStore(cfg Config) error {
+	var next *localStore
+	if cfg.LocalStore.Dir != "" {
+		next = &localStore{
+			dir:       cfg.LocalStore.Dir,
+			retention: time.Duration(cfg.LocalStore.Retention),
+			maxBytes:  cfg.LocalStore.MaxBytes,
+			current:   make(map[string]*hourlyRollup),
+			done:      make(chan struct{}),
+		}
+		if next.retention == 0 {
+			next.retention = defaultStoreRetention
+		}
+		if next.maxBytes == 0 {
+			next.maxBytes = defaultStoreMaxBytes
+		}
+		if err := os.MkdirAll(next.dir, 0o755); err != nil {
+			return fmt.Errorf("error creating local store: %w", err)
+		}
+	}
+
+	localStoreMu.Lock()
+	previous := localRollups
+	localRollups = next
+	localStoreMu.Unlock()
+
+	if previous != nil {
+		close(previous.done)
+		if err := previous.flush(); err != nil {
+			log.Printf("Error writing rollups: %v\n", err)
+		}
+	}
+	if next != nil {
+		if err := next.evict(time.Now()); err != nil {
+			log.Printf("Error evicting rollups: %v\n", err)
+		}
+		go next.run()
+	}
+	return nil
+}
+
+func (s *localStore) run() {
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Hour).Add(time.Hour).Sub(now))
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			if err := s.flush(); err != nil {
+				log.Printf("Error writing rollups: %v\n", err)
+			}
+		}
+	}
+}
+
+func (s *localStore) record(endpoint string, latency time.Duration, failed, good bool, at time.Time) {
+	hour := at.UTC().Truncate(time.Hour)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !hour.Equal(s.hour) {
+		if err := s.writeLocked(); err != nil {
+			log.Printf("Error writing rollups: %v\n", err)
+		}
+		s.hour = hour
+	}
+	rollup, ok := s.current[endpoint]
+	if !ok {
+		rollup = &hourlyRollup{}
+		s.current[endpoint] = rollup
+	}
+	rollup.latency.add(latency)
+	if failed {
+		rollup.errors++
+	}
+	if good {
+		rollup.good++
+	}
+}
+
+// flush writes the hour in progress and evicts what is too old or too much.
+func (s *localStore) flush() error {
+	s.mu.Lock()
+	err := s.writeLocked()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.evict(time.Now())
+}
+
+// writeLocked appends the rollups of the hour in progress to its file.
+func (s *localStore) writeLocked() error {
+	if len(s.current) == 0 {
+		return nil
+	}
+	current := s.current
+	s.current = make(map[string]*hourlyRollup)
+
+	f, err := os.OpenFile(s.path(s.hour), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for endpoint, rollup := range current {
+		line := storedRollup{Hour: s.hour, Endpoint: endpoint, Errors: rollup.errors, Good: rollup.good, Latency: rollup.latency.stored()}
+		if err := enc.Encode(line); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *localStore) path(hour time.Time) string {
+	return filepath.Join(s.dir, storeFilePrefix+hour.Format(storeHourLayout)+storeFileSuffix)
+}
+
+// storeFile is a store file and the hour it holds.
+type storeFile struct {
+	path string
+	hour time.Time
+	size int64
+}
+
+// files lists the store files, oldest first.
+func (s *localStore) files() ([]storeFile, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []storeFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, storeFilePrefix) || !strings.HasSuffix(name, storeFileSuffix) {
+			continue
+		}
+		hour, err := time.Parse(storeHourLayout, strings.TrimSuffix(strings.TrimPrefix(name, storeFilePrefix), storeFileSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, storeFile{path: filepath.Join(s.dir, name), hour: hour, size: info.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].hour.Before(files[j].hour) })
+	return files, nil
+}
+
+// evict removes the files past the retention, then the oldest ones while the
+// total exceeds maxBytes.
+func (s *localStore) evict(now time.Time) error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	oldest := now.UTC().Truncate(time.Hour).Add(-s.retention)
+	for _, f := range files {
+		if !f.hour.Before(oldest) && total <= s.maxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= f.size
+	}
+	return nil
+}
+
+// load reads the rollups of the hours from since on, including the hour in
+// progress, merged per hour and endpoint.
+func (s *localStore) load(since time.Time) ([]storedRollup, error) {
+	since = since.UTC().Truncate(time.Hour)
+	type key struct {
+		hour     time.Time
+		endpoint string
+	}
+	merged := make(map[key]*hourlyRollup)
+	add := func(hour time.Time, endpoint string, rollup *hourlyRollup) {
+		k := key{hour, endpoint}
+		m, ok := merged[k]
+		if !ok {
+			m = &hourlyRollup{}
+			merged[k] = m
+		}
+		m.latency.merge(&rollup.latency)
+		m.errors += rollup.errors
+		m.good += rollup.good
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.hour.Before(since) {
+			continue
+		}
+		if err := readStoreFile(f.path, func(line storedRollup) error {
+			sketch, err := line.Latency.sketch()
+			if err != nil {
+				return err
+			}
+			add(line.Hour, line.Endpoint, &hourlyRollup{latency: sketch, errors: line.Errors, good: line.Good})
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", f.path, err)
+		}
+	}
+	s.mu.Lock()
+	if !s.hour.Before(since) {
+		for endpoint, rollup := range s.current {
+			add(s.hour, endpoint, rollup)
+		}
+	}
+	s.mu.Unlock()
+
+	rollups := make([]storedRollup, 0, len(merged))
+	for k, rollup := range merged {
+		rollups = append(rollups, storedRollup{Hour: k.hour, Endpoint: k.endpoint, Errors: rollup.errors, Good: rollup.good, Latency: rollup.latency.stored()})
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		if !rollups[i].Hour.Equal(rollups[j].Hour) {
+			return rollups[i].Hour.Before(rollups[j].Hour)
+		}
+		return rollups[i].Endpoint < rollups[j].Endpoint
+	})
+	return rollups, nil
+}
+
+func readStoreFile(path string, handle func(storedRollup) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var line storedRollup
+		if err := dec.Decode(&line); err != nil {
+			return err
+		}
+		if err := handle(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollups returns the hourly rollups of every endpoint from since on, oldest
+// first, including the hour in progress. It needs a LocalStore.
+func Rollups(since time.Time) ([]Rollup, error) {
+	s := currentLocalStore()
+	if s == nil {
+		return nil, fmt.Errorf("no local store configured")
+	}
+	stored, err := s.load(since)
+	if err != nil {
+		return nil, err
+	}
+	rollups := make([]Rollup, 0, len(stored))
+	for _, line := range stored {
+		sketch, err := line.Latency.sketch()
+		if err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, Rollup{
+			Hour:         line.Hour,
+			Endpoint:     line.Endpoint,
+			Requests:     sketch.count,
+			Errors:       line.Errors,
+			LatencyP50Ms: float64(sketch.quantile(0.50)) / 1000,
+			LatencyP95Ms: float64(sketch.quantile(0.95)) / 1000,
+			LatencyP99Ms: float64(sketch.quantile(0.99)) / 1000,
+			LatencyMaxMs: float64(sketch.max) / 1000,
+		})
+	}
+	return rollups, nil
+}
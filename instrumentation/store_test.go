@@ -0,0 +1,145 @@
+package instrumentation
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestLocalStore(t *testing.T) *localStore {
+	t.Helper()
+	return &localStore{
+		dir:       t.TempDir(),
+		retention: defaultStoreRetention,
+		maxBytes:  defaultStoreMaxBytes,
+		current:   make(map[string]*hourlyRollup),
+		done:      make(chan struct{}),
+	}
+}
+
+func TestLocalStoreWritesPastHours(t *testing.T) {
+	s := newTestLocalStore(t)
+	hour := time.Date(2026, 3, 10, 14, 0, 0, 0, time.UTC)
+	for ms := 1; ms <= 100; ms++ {
+		s.record("GET /orders", time.Duration(ms)*time.Millisecond, ms%10 == 0, false, hour.Add(time.Minute))
+	}
+	s.record("GET /orders", time.Millisecond, false, false, hour.Add(time.Hour))
+	if _, err := os.Stat(s.path(hour)); err != nil {
+		t.Fatalf("hour not written once over: %v", err)
+	}
+
+	// A new store over the same directory, as after a restart
+	reopened := newTestLocalStore(t)
+	reopened.dir = s.dir
+	lines, err := reopened.load(hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0].Endpoint != "GET /orders" || lines[0].Errors != 10 || lines[0].Latency.Count != 100 {
+		t.Fatalf("loaded %+v, want the 14:00 rollup", lines)
+	}
+	sketch, err := lines[0].Latency.sketch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p99 := sketch.quantile(0.99); p99 < 98_000 || p99 > 100_000 {
+		t.Errorf("p99 = %dµs, want about 99ms", p99)
+	}
+}
+
+func TestLocalStoreMergesAppendedLines(t *testing.T) {
+	s := newTestLocalStore(t)
+	hour := time.Now().UTC().Truncate(time.Hour)
+	s.record("GET /orders", time.Millisecond, false, false, hour)
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	s.record("GET /orders", time.Millisecond, true, false, hour)
+
+	lines, err := s.load(hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0].Latency.Count != 2 || lines[0].Errors != 1 {
+		t.Errorf("loaded %+v, want one rollup of 2 requests", lines)
+	}
+}
+
+func TestLocalStoreEviction(t *testing.T) {
+	s := newTestLocalStore(t)
+	now := time.Now().UTC().Truncate(time.Hour)
+	for h := 30; h >= 0; h-- {
+		s.record("GET /orders", time.Millisecond, false, false, now.Add(-time.Duration(h)*time.Hour))
+	}
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := s.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 25 || !files[0].hour.Equal(now.Add(-24*time.Hour)) {
+		t.Fatalf("%d files from %v, want the last 24h and the current hour", len(files), files[0].hour)
+	}
+
+	s.maxBytes = files[0].size * 3
+	if err := s.evict(now); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ = s.files(); len(files) != 3 || !files[2].hour.Equal(now) {
+		t.Errorf("%d files left, want the newest 3", len(files))
+	}
+}
+
+func TestRollups(t *testing.T) {
+	if _, err := Rollups(time.Time{}); err == nil {
+		t.Fatal("Rollups() without a local store succeeded")
+	}
+
+	dir := t.TempDir()
+	if err := Configure(collectorURL, "test-service", "", "", "", "", WithLocalStore(LocalStoreConfig{Dir: dir}), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	recordRollup("GET /orders", 5*time.Millisecond, false)
+	rollups, err := Rollups(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollups) != 1 || rollups[0].Requests != 1 || rollups[0].LatencyMaxMs != 5 {
+		t.Errorf("Rollups() = %+v, want the request of this hour", rollups)
+	}
+}
+
+func TestReportsStartFromLocalStore(t *testing.T) {
+	dir := t.TempDir()
+	previous := newTestLocalStore(t)
+	previous.dir = dir
+	previous.retention = 14 * 24 * time.Hour
+	yesterday := utcDay(time.Now()).AddDate(0, 0, -1)
+	previous.record("GET /orders", time.Millisecond, false, false, yesterday)
+	if err := previous.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Configure(collectorURL, "test-service", "", "", "", "",
+		WithLocalStore(LocalStoreConfig{Dir: dir, Retention: Duration(14 * 24 * time.Hour)}),
+		WithReports(ReportConfig{Daily: true}),
+		WithoutSendQueue(),
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	report := reports.store.report("daily", yesterday, yesterday.AddDate(0, 0, 1), 0)
+	if len(report.Endpoints) != 1 || report.Endpoints[0].Requests != 1 {
+		t.Errorf("endpoints = %+v, want yesterday's request", report.Endpoints)
+	}
+}
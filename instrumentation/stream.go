@@ -0,0 +1,43 @@
+package instrumentation
+
+import (
+	"time"
+)
+
+// streamProgress sends a point at most every StreamProgressInterval while a
+// response is streamed, carrying the bytes flushed since the previous one, so
+// long-lived streams show up before they end.
+type streamProgress struct {
+	rw       *responseWriter
+	endpoint func() string
+	interval time.Duration
+	start    time.Time
+	last     time.Time
+	lastSize int
+}
+
+// flushed runs after every flush of rw.
+func (p *streamProgress) flushed() {
+	now := time.Now()
+	if now.Sub(p.last) < p.interval {
+		return
+	}
+	p.last = now
+	delta := p.rw.size - p.lastSize
+	p.lastSize = p.rw.size
+
+	metrics := Metrics{
+		InfluxDBURL: influxDBURL,
+		Token:       currentToken(),
+		Org:         org,
+		Bucket:      bucket,
+		Measurement: measurement,
+		Tags:        map[string]string{"endpoint": endpointTag(p.endpoint()), "stream": "progress"},
+		Fields: map[string]interface{}{
+			"bytes_streamed":       delta,
+			"bytes_streamed_total": p.rw.size,
+			"stream_elapsed_ms":    now.Sub(p.start).Milliseconds(),
+		},
+	}
+	reportPoint(metrics)
+}
@@ -0,0 +1,71 @@
+package instrumentation
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func sseHandler(events int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < events; i++ {
+			if i > 0 {
+				time.Sleep(20 * time.Millisecond)
+			}
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	})
+}
+
+func TestMiddlewareReportsStreams(t *testing.T) {
+	rr := httptest.NewRecorder()
+	Middleware(sseHandler(3)).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stream/events", nil))
+	if !rr.Flushed {
+		t.Error("flush didn't reach the underlying writer")
+	}
+
+	metrics := nextMetrics(t)
+	if metrics.Fields["streaming"] != true || metrics.Fields["response_size"] != float64(3*len("data: 0\n\n")) {
+		t.Errorf("fields = %v, want a streamed response", metrics.Fields)
+	}
+	duration, latency := metrics.Fields["stream_duration_ms"].(float64), metrics.Fields["latency_ms"].(float64)
+	if duration < 40 || latency >= 20 || metrics.Fields["ttfb_ms"] != latency {
+		t.Errorf("stream_duration_ms = %v, latency_ms = %v, ttfb_ms = %v: want the latency to be the time to first byte", duration, latency, metrics.Fields["ttfb_ms"])
+	}
+}
+
+func TestMiddlewareReportsStreamProgress(t *testing.T) {
+	applyOptions([]Option{WithStreamProgress(time.Nanosecond)})
+	defer applyOptions(nil)
+
+	Middleware(sseHandler(2)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stream/progress", nil))
+	for i := 1; i <= 2; i++ {
+		progress := nextMetrics(t)
+		if progress.Tags["stream"] != "progress" || progress.Tags["endpoint"] != "/stream/progress" {
+			t.Fatalf("tags = %v, want progress point %d", progress.Tags, i)
+		}
+		if progress.Fields["bytes_streamed"] != float64(len("data: 0\n\n")) || progress.Fields["bytes_streamed_total"] != float64(i*len("data: 0\n\n")) {
+			t.Errorf("progress point %d fields = %v", i, progress.Fields)
+		}
+	}
+	if final := nextMetrics(t); final.Tags["stream"] != "" || final.Fields["streaming"] != true {
+		t.Errorf("final point = %v %v", final.Tags, final.Fields)
+	}
+}
+
+func TestMiddlewareDoesNotReportPlainResponsesAsStreams(t *testing.T) {
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stream/plain", nil))
+	metrics := nextMetrics(t)
+	if _, ok := metrics.Fields["streaming"]; ok {
+		t.Errorf("fields = %v, want no stream fields", metrics.Fields)
+	}
+	if _, ok := metrics.Fields["ttfb_ms"]; !ok {
+		t.Errorf("fields = %v, want ttfb_ms", metrics.Fields)
+	}
+}
@@ -0,0 +1,79 @@
+package instrumentation
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// defaultMaxTagValues is the default cap on distinct values of each custom tag.
+const defaultMaxTagValues = 100
+
+// overflowTagValue replaces custom tag values once their key's cap is reached.
+const overflowTagValue = "tag_overflow"
+
+// seenTagValues maps a custom tag key to the *tagValues admitted for it.
+var seenTagValues sync.Map
+
+type tagValues struct {
+	mu     sync.Mutex
+	values map[string]struct{}
+}
+
+// addCustomTags merges tags returned by a user extractor into a point's tags.
+// Built-in tags such as endpoint can't be overridden, empty values are
+// dropped, and each key admits a bounded number of distinct values, as
+// extractors often read client-supplied data.
+func addCustomTags(tags, extracted map[string]string) {
+	for key, value := range extracted {
+		if _, builtIn := tags[key]; builtIn || key == "" || value == "" {
+			continue
+		}
+		tags[key] = limitTagValue(key, value)
+	}
+}
+
+// LimitTagValue returns value while key has fewer than MaxTagValues distinct
+// values, and "tag_overflow" for new values after that, like it does for the
+// tags of extractors. It is for tags set from client-supplied data outside the
+// middleware, e.g. gRPC metadata.
+func LimitTagValue(key, value string) string {
+	return limitTagValue(key, value)
+}
+
+// limitTagValue admits values for a custom tag key until the cap is reached.
+func limitTagValue(key, value string) string {
+	entry, _ := seenTagValues.LoadOrStore(key, &tagValues{values: make(map[string]struct{})})
+	seen := entry.(*tagValues)
+
+	limit := loadSettings().maxTagValues
+	if limit <= 0 {
+		limit = defaultMaxTagValues
+	}
+	seen.mu.Lock()
+	defer seen.mu.Unlock()
+	if _, ok := seen.values[value]; ok {
+		return value
+	}
+	if len(seen.values) >= limit {
+		return overflowTagValue
+	}
+	// Framework buffers (fiber, fasthttp) may back value, so keep a copy
+	value = strings.Clone(value)
+	seen.values[value] = struct{}{}
+	return value
+}
+
+// extractRequestTags applies the WithTagExtractor hook, if any.
+func extractRequestTags(tags map[string]string, r *http.Request) {
+	if extract := loadSettings().tagExtractor; extract != nil {
+		addCustomTags(tags, extract(r))
+	}
+}
+
+// extractContextTags applies the ContextTagExtractors to a framework context.
+func extractContextTags(tags map[string]string, ctx interface{}) {
+	for _, extract := range loadSettings().contextTagExtractors {
+		addCustomTags(tags, extract(ctx))
+	}
+}
@@ -0,0 +1,54 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTagExtractorAddsTags(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{
+		WithTagExtractor(func(r *http.Request) map[string]string {
+			return map[string]string{
+				"tenant":   r.Header.Get("X-Tenant"),
+				"endpoint": "/spoofed",
+			}
+		}),
+	})
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/tags-test/orders", nil)
+	req.Header.Set("X-Tenant", "acme")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	metrics := nextMetrics(t)
+	if metrics.Tags["tenant"] != "acme" {
+		t.Errorf("tenant = %q, want acme", metrics.Tags["tenant"])
+	}
+	if metrics.Tags["endpoint"] != "/tags-test/orders" {
+		t.Errorf("endpoint = %q, built-in tags must not be overridden", metrics.Tags["endpoint"])
+	}
+
+	// A request without the header gets no tenant tag at all
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/tags-test/orders", nil))
+	if tenant, ok := nextMetrics(t).Tags["tenant"]; ok {
+		t.Errorf("tenant = %q, want no tag for an empty value", tenant)
+	}
+}
+
+func TestCustomTagValuesAreCapped(t *testing.T) {
+	defer applyOptions(nil)
+	applyOptions([]Option{WithMaxTagValues(2)})
+
+	var got []string
+	for _, value := range []string{"a", "b", "c", "a"} {
+		got = append(got, limitTagValue("capped-test", value))
+	}
+	want := []string{"a", "b", overflowTagValue, "a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("values = %v, want %v", got, want)
+		}
+	}
+}
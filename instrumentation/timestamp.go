@@ -0,0 +1,57 @@
+package instrumentation
+
+import (
+	"github.com/jculley01/observability-module/protocol"
+	"time"
+)
+
+// Timestamp precisions of Config.TimestampPrecision and Metrics.Precision.
+const (
+	PrecisionSeconds      = protocol.PrecisionSeconds
+	PrecisionMilliseconds = protocol.PrecisionMilliseconds
+	PrecisionNanoseconds  = protocol.PrecisionNanoseconds
+)
+
+// unixTimestamp returns t as Unix time, which is UTC whatever the location
+// of t, in units of precision.
+func unixTimestamp(t time.Time, precision string) int64 {
+	switch precision {
+	case PrecisionSeconds:
+		return t.Unix()
+	case PrecisionMilliseconds:
+		return t.UnixMilli()
+	default:
+		return t.UnixNano()
+	}
+}
+
+// pointTime returns the time of a point's timestamp, or now when it has none.
+func pointTime(metrics Metrics, now time.Time) time.Time {
+	if metrics.Timestamp == 0 {
+		return now
+	}
+	switch metrics.Precision {
+	case PrecisionSeconds:
+		return time.Unix(metrics.Timestamp, 0)
+	case PrecisionMilliseconds:
+		return time.UnixMilli(metrics.Timestamp)
+	default:
+		return time.Unix(0, metrics.Timestamp)
+	}
+}
+
+// stampPoint timestamps a point taken at the given time in the configured
+// precision, unless it has a timestamp already. Without a precision points
+// are left for the registry to timestamp.
+func stampPoint(metrics *Metrics, at time.Time) {
+	precision := loadSettings().timestampPrecision
+	if precision == "" {
+		return
+	}
+	if metrics.Timestamp == 0 {
+		metrics.Timestamp = unixTimestamp(at, precision)
+		metrics.Precision = precision
+	} else if metrics.Precision == "" {
+		metrics.Precision = precision
+	}
+}
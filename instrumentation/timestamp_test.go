@@ -0,0 +1,63 @@
+package instrumentation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPointsTimestampedInPrecision(t *testing.T) {
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	for _, precision := range []string{PrecisionSeconds, PrecisionMilliseconds, PrecisionNanoseconds} {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithTimestampPrecision(precision), WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+		before := unixTimestamp(time.Now(), precision)
+		Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+			ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/timestamp/orders", nil))
+		point := nextMetrics(t)
+		after := unixTimestamp(time.Now(), precision)
+		if point.Precision != precision || point.Timestamp < before || point.Timestamp > after {
+			t.Errorf("%s: timestamp %d %q, want within [%d, %d]", precision, point.Timestamp, point.Precision, before, after)
+		}
+	}
+}
+
+func TestPointsWithoutPrecisionLeftUntimestamped(t *testing.T) {
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/timestamp/orders", nil))
+	if point := nextMetrics(t); point.Timestamp != 0 || point.Precision != "" {
+		t.Errorf("timestamp %d %q, want none", point.Timestamp, point.Precision)
+	}
+}
+
+func TestStampPointKeepsTimestamps(t *testing.T) {
+	applyOptions([]Option{WithTimestampPrecision(PrecisionMilliseconds)})
+	defer applyOptions(nil)
+
+	// Events are timestamped when they occurred, whatever their location
+	occurred := time.Date(2026, 3, 10, 15, 0, 0, 0, time.FixedZone("CET", 3600))
+	var event Metrics
+	stampPoint(&event, occurred)
+	if want := time.Date(2026, 3, 10, 14, 0, 0, 0, time.UTC).UnixMilli(); event.Timestamp != want || event.Precision != PrecisionMilliseconds {
+		t.Errorf("timestamp %d %q, want %d ms", event.Timestamp, event.Precision, want)
+	}
+
+	custom := Metrics{Timestamp: 1700000000}
+	stampPoint(&custom, time.Now())
+	if custom.Timestamp != 1700000000 || custom.Precision != PrecisionMilliseconds {
+		t.Errorf("custom timestamp %d %q, want it kept", custom.Timestamp, custom.Precision)
+	}
+}
+
+func TestValidateTimestampPrecision(t *testing.T) {
+	cfg := Config{RegistryURL: collectorURL, ServiceName: "orders", TimestampPrecision: "us"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() accepted precision us")
+	}
+}
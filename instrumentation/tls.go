@@ -0,0 +1,100 @@
+package instrumentation
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RegistryTLSConfig configures the TLS of a wss:// registry connection, e.g.
+// for a registry behind an internal CA or requiring client certificates.
+type RegistryTLSConfig struct {
+	// CAFile is a PEM bundle of the root CAs the registry's certificate is
+	// verified against, instead of the system ones.
+	CAFile string `json:"ca_file"`
+	// CertFile and KeyFile are a PEM client certificate and its key, for
+	// registries requiring mutual TLS.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ServerName is the host name the registry's certificate is verified
+	// against, when it differs from the host of RegistryURL.
+	ServerName string `json:"server_name"`
+	// Base, which can only be set in code, is the tls.Config the fields above
+	// are applied to, e.g. for certificates that aren't kept in files.
+	Base *tls.Config `json:"-"`
+}
+
+func (c RegistryTLSConfig) enabled() bool {
+	return c != RegistryTLSConfig{}
+}
+
+// clientConfig builds the tls.Config of the registry connection, nil when c
+// is empty.
+func (c RegistryTLSConfig) clientConfig() (*tls.Config, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if c.Base != nil {
+		tlsConfig = c.Base.Clone()
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading registry_tls.ca_file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("registry_tls.ca_file %s holds no PEM certificate", c.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the registry_tls client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.ServerName != "" {
+		tlsConfig.ServerName = c.ServerName
+	}
+	return tlsConfig, nil
+}
+
+var (
+	registryTLSMu sync.Mutex
+	// loadedRegistryTLS is what registryTLSConfig was built from
+	loadedRegistryTLS RegistryTLSConfig
+	// registryTLSConfig is the tls.Config of the applied config, nil without
+	// one
+	registryTLSConfig *tls.Config
+)
+
+// loadRegistryTLS builds the tls.Config of c, reusing the current one when c
+// is unchanged so the registry connection isn't redialed.
+func loadRegistryTLS(c RegistryTLSConfig) (*tls.Config, error) {
+	registryTLSMu.Lock()
+	defer registryTLSMu.Unlock()
+	if c == loadedRegistryTLS {
+		return registryTLSConfig, nil
+	}
+	return c.clientConfig()
+}
+
+// storeRegistryTLS makes tlsConfig, loaded from c, the one of the registry
+// connection.
+func storeRegistryTLS(c RegistryTLSConfig, tlsConfig *tls.Config) {
+	registryTLSMu.Lock()
+	defer registryTLSMu.Unlock()
+	loadedRegistryTLS, registryTLSConfig = c, tlsConfig
+}
+
+// currentRegistryTLS returns the tls.Config of the registry connection.
+func currentRegistryTLS() *tls.Config {
+	registryTLSMu.Lock()
+	defer registryTLSMu.Unlock()
+	return registryTLSConfig
+}
@@ -0,0 +1,125 @@
+package instrumentation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/gorilla/websocket"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClientCertificate writes a self-signed client certificate and its key
+// to dir.
+func writeClientCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "orders-service"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestRegistryMutualTLS(t *testing.T) {
+	clients := make(chan string, 4)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, _, err := c.ReadMessage(); err != nil {
+			return
+		}
+		clients <- r.TLS.PeerCertificates[0].Subject.CommonName
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeClientCertificate(t, dir)
+
+	// The test certificate is issued for example.com and 127.0.0.1
+	registryURL := "wss://" + strings.TrimPrefix(server.URL, "https://")
+	err := Configure(registryURL, "test-service", "", "", "", "", WithRegistryTLS(RegistryTLSConfig{
+		CAFile:     caFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "example.com",
+	}), WithoutSendQueue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := sendMetrics(Metrics{Measurement: "test-service"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case client := <-clients:
+		if client != "orders-service" {
+			t.Errorf("client certificate = %q, want orders-service", client)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the registry received nothing")
+	}
+}
+
+func TestRegistryTLSValidation(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "orders", RegistryTLS: RegistryTLSConfig{CertFile: "client.pem"}}
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cert_file and key_file must be set together") || !strings.Contains(err.Error(), "requires a wss:// registry_url") {
+		t.Errorf("Validate = %v", err)
+	}
+
+	cfg = Config{RegistryURL: "wss://registry", ServiceName: "orders", RegistryTLS: RegistryTLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}}
+	if err := ApplyConfig(cfg); err == nil || !strings.Contains(err.Error(), "ca_file") {
+		t.Errorf("ApplyConfig with a missing CA file = %v", err)
+	}
+}
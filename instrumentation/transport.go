@@ -0,0 +1,97 @@
+package instrumentation
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// outboundPeerTag is the tag holding the destination host of an outbound
+	// call.
+	outboundPeerTag = "peer_host"
+	// outboundCounterPrefix starts the counter keys of outbound hosts, which
+	// share the maps of inbound endpoints, whose keys start with "/".
+	outboundCounterPrefix = "outbound:"
+)
+
+// WrapTransport instruments outgoing HTTP calls made through rt (or
+// http.DefaultTransport if nil), so dependency latency shows up next to the
+// inbound endpoints. Each call is reported with direction=outbound, its
+// method and destination host (capped like custom tags), status code and
+// latency up to the response headers. request_count and error_count are kept
+// per host; failures are 5xx responses and transport errors. Calls made with
+// the context of an instrumented request also count in its downstream_calls.
+//
+//	client := &http.Client{Transport: instrumentation.WrapTransport(nil)}
+func WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &instrumentedTransport{next: rt}
+}
+
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	startTime := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	latency := time.Since(startTime)
+	RecordDownstreamCall(req.Context(), req.URL.Host, latency)
+	reportOutbound(req, resp, err, latency)
+	return resp, err
+}
+
+// reportOutbound sends the point for an outbound call.
+func reportOutbound(req *http.Request, resp *http.Response, err error, latency time.Duration) {
+	host := limitTagValue(outboundPeerTag, req.URL.Host)
+	key := outboundCounterPrefix + host
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	incrementEndpointRequestCount(key)
+	var class string
+	if err != nil || statusCode >= 500 {
+		incrementEndpointErrorCount(key)
+		class = classifyError(statusCode, req.Context().Err(), err)
+	}
+
+	tags := map[string]string{
+		"direction":     "outbound",
+		outboundPeerTag: host,
+		"method":        req.Method,
+	}
+	fields := map[string]interface{}{
+		"status_code":     statusCode,
+		"latency_ms":      latency.Milliseconds(),
+		"request_count":   getEndpointRequestCount(key),
+		"error_count":     getEndpointErrorCount(key),
+		"transport_error": err != nil,
+	}
+	if req.ContentLength >= 0 {
+		fields["request_size"] = req.ContentLength
+	}
+	if resp != nil && resp.ContentLength >= 0 {
+		fields["response_size"] = resp.ContentLength
+	}
+	countErrorClass(tags, fields, key, class)
+	countStatusFamily(fields, key, statusCode)
+	addLatencyHistogram(fields, key, latency)
+
+	metrics := Metrics{
+		InfluxDBURL: influxDBURL,
+		Token:       currentToken(),
+		Org:         org,
+		Bucket:      bucket,
+		Measurement: measurement,
+		Tags:        tags,
+		Fields:      fields,
+	}
+
+	// Send metrics unless sampled out
+	if samplePoint(key) {
+		reportPoint(metrics)
+	}
+}
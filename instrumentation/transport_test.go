@@ -0,0 +1,100 @@
+package instrumentation
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrapTransportReportsCalls(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, "pong")
+	}))
+	defer upstream.Close()
+	client := &http.Client{Transport: WrapTransport(nil)}
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	resp, err := client.Get(upstream.URL + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	metrics := nextMetrics(t)
+	if metrics.Tags["direction"] != "outbound" || metrics.Tags["peer_host"] != host || metrics.Tags["method"] != http.MethodGet {
+		t.Errorf("tags = %v", metrics.Tags)
+	}
+	if metrics.Fields["status_code"] != float64(http.StatusOK) || metrics.Fields["response_size"] != float64(len("pong")) {
+		t.Errorf("status_code, response_size = %v, %v, want 200, 4", metrics.Fields["status_code"], metrics.Fields["response_size"])
+	}
+
+	resp, err = client.Get(upstream.URL + "/fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	metrics = nextMetrics(t)
+	if metrics.Fields["request_count"] != float64(2) || metrics.Fields["error_count"] != float64(1) {
+		t.Errorf("request_count, error_count = %v, %v, want 2, 1", metrics.Fields["request_count"], metrics.Fields["error_count"])
+	}
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestWrapTransportReportsTransportErrors(t *testing.T) {
+	client := &http.Client{Transport: WrapTransport(failingTransport{})}
+	if _, err := client.Get("http://unreachable.transport-test:8080/"); err == nil {
+		t.Fatal("expected the transport error to be returned")
+	}
+	metrics := nextMetrics(t)
+	if metrics.Fields["transport_error"] != true || metrics.Fields["status_code"] != float64(0) || metrics.Fields["error_count"] != float64(1) {
+		t.Errorf("fields = %v", metrics.Fields)
+	}
+}
+
+func TestWrapTransportRollsUpDownstreamCalls(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	}))
+	defer upstream.Close()
+	client := &http.Client{Transport: WrapTransport(nil)}
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, upstream.URL+"/ping", nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}
+		RecordDownstreamCall(r.Context(), "postgres", time.Hour)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/checkout", nil))
+
+	for i := 0; i < 2; i++ {
+		if call := nextMetrics(t); call.Tags["peer_host"] != host {
+			t.Errorf("outbound call tags = %v", call.Tags)
+		}
+	}
+	parent := nextMetrics(t)
+	if parent.Fields["downstream_calls"] != float64(3) || parent.Fields["slowest_dependency"] != "postgres" {
+		t.Errorf("downstream_calls, slowest_dependency = %v, %v, want 3, postgres", parent.Fields["downstream_calls"], parent.Fields["slowest_dependency"])
+	}
+	if ms := parent.Fields["downstream_time_ms"].(float64); ms < float64(time.Hour.Milliseconds()) || parent.Fields["slowest_dependency_ms"] != float64(time.Hour.Milliseconds()) {
+		t.Errorf("downstream_time_ms, slowest_dependency_ms = %v, %v", ms, parent.Fields["slowest_dependency_ms"])
+	}
+}
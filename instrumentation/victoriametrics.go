@@ -0,0 +1,301 @@
+package instrumentation
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jculley01/observability-module/protocol"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of the VictoriaMetrics import.
+const (
+	// VictoriaMetricsInflux writes InfluxDB line protocol to /write, where
+	// each field becomes the series measurement_field
+	VictoriaMetricsInflux = "influx"
+	// VictoriaMetricsJSON writes JSON lines to /api/v1/import, a series per
+	// field named the same way
+	VictoriaMetricsJSON = "json"
+)
+
+const (
+	defaultVictoriaMetricsBatchSize     = 1000
+	defaultVictoriaMetricsFlushInterval = 10 * time.Second
+	victoriaMetricsSubmitTimeout        = 10 * time.Second
+	// victoriaMetricsMaxPendingBatches bounds the lines waiting to be
+	// imported while VictoriaMetrics is slow, in batches
+	victoriaMetricsMaxPendingBatches = 10
+)
+
+// VictoriaMetricsConfig imports every point into VictoriaMetrics, next to the
+// registry or instead of it when RegistryURL is empty, in Format
+// (VictoriaMetricsInflux if empty). Numeric and boolean fields become the
+// series measurement_field, labeled with the point's tags but for the
+// client-controlled ip_address and user_agent, as every label combination is
+// a series. Points are imported in gzipped batches of up to BatchSize (1000
+// if zero) every FlushInterval (10s if zero).
+type VictoriaMetricsConfig struct {
+	// URL is a single-node VictoriaMetrics, e.g. "http://victoria:8428", or
+	// the import path of a vminsert, used as is, e.g.
+	// "http://vminsert:8480/insert/0/influx/write".
+	URL    string `json:"url"`
+	Format string `json:"format"`
+	// Username and Password authenticate with basic auth, e.g. to vmauth.
+	Username      string   `json:"username"`
+	Password      string   `json:"password"`
+	DisableGzip   bool     `json:"disable_gzip"`
+	BatchSize     int      `json:"batch_size"`
+	FlushInterval Duration `json:"flush_interval"`
+	// Retry retries the batches that couldn't be imported.
+	Retry RetryPolicy `json:"retry"`
+}
+
+// victoriaMetricsSeries is a line of the JSON import.
+type victoriaMetricsSeries struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// victoriaMetricsExporter imports the lines of the points sent.
+type victoriaMetricsExporter struct {
+	config VictoriaMetricsConfig
+	url    string
+	// batch holds the lines of a point per item
+	batch *pendingBatch[[]byte]
+}
+
+var (
+	victoriaMetricsMu sync.Mutex
+	victoriaMetrics   *victoriaMetricsExporter
+)
+
+// startVictoriaMetrics replaces the exporter of any previously applied
+// config, keeping it when its config is unchanged. A replaced exporter
+// imports its pending lines in the background.
+func startVictoriaMetrics(cfg Config) {
+	victoriaMetricsMu.Lock()
+	defer victoriaMetricsMu.Unlock()
+	if victoriaMetrics != nil && reflect.DeepEqual(victoriaMetrics.config, cfg.VictoriaMetrics) {
+		return
+	}
+	if previous := victoriaMetrics; previous != nil {
+		previous.batch.stop()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), victoriaMetricsSubmitTimeout)
+			defer cancel()
+			if err := previous.batch.flush(ctx); err != nil {
+				log.Printf("Error importing metrics into VictoriaMetrics: %v\n", err)
+			}
+		}()
+		victoriaMetrics = nil
+	}
+	if cfg.VictoriaMetrics.URL == "" {
+		return
+	}
+	e := &victoriaMetricsExporter{
+		config: cfg.VictoriaMetrics,
+		url:    strings.TrimSuffix(cfg.VictoriaMetrics.URL, "/"),
+	}
+	// A vminsert URL already names the import path
+	if !strings.Contains(e.url, "/insert/") {
+		if cfg.VictoriaMetrics.Format == VictoriaMetricsJSON {
+			e.url += "/api/v1/import"
+		} else {
+			e.url += "/write"
+		}
+	}
+	e.batch = &pendingBatch[[]byte]{
+		size:       cfg.VictoriaMetrics.BatchSize,
+		maxBatches: victoriaMetricsMaxPendingBatches,
+		interval:   time.Duration(cfg.VictoriaMetrics.FlushInterval),
+		timeout:    victoriaMetricsSubmitTimeout,
+		submit:     e.submit,
+		logError: func(err error) {
+			log.Printf("Error importing metrics into VictoriaMetrics: %v\n", err)
+		},
+		droppedFormat: "Dropped %d VictoriaMetrics points while it was slow\n",
+	}
+	if e.batch.size == 0 {
+		e.batch.size = defaultVictoriaMetricsBatchSize
+	}
+	if e.batch.interval == 0 {
+		e.batch.interval = defaultVictoriaMetricsFlushInterval
+	}
+	victoriaMetrics = e
+	e.batch.start()
+}
+
+// stopVictoriaMetrics imports the pending lines and stops the exporter.
+func stopVictoriaMetrics(ctx context.Context) error {
+	victoriaMetricsMu.Lock()
+	e := victoriaMetrics
+	victoriaMetrics = nil
+	victoriaMetricsMu.Unlock()
+	if e == nil {
+		return nil
+	}
+	e.batch.stop()
+	if err := e.batch.flush(ctx); err != nil {
+		return fmt.Errorf("error importing metrics into VictoriaMetrics: %w", err)
+	}
+	return nil
+}
+
+// sendToVictoriaMetrics queues the lines of a point when VictoriaMetrics is
+// configured.
+func sendToVictoriaMetrics(metrics Metrics) {
+	victoriaMetricsMu.Lock()
+	e := victoriaMetrics
+	victoriaMetricsMu.Unlock()
+	if e == nil {
+		return
+	}
+	var lines []byte
+	var err error
+	if e.config.Format == VictoriaMetricsJSON {
+		lines, err = victoriaMetricsJSONLines(metrics, time.Now())
+	} else {
+		lines, err = victoriaMetricsInfluxLine(metrics)
+	}
+	if err != nil {
+		log.Printf("Error encoding metrics for VictoriaMetrics: %v\n", err)
+		return
+	}
+	if len(lines) > 0 {
+		e.batch.add(lines)
+	}
+}
+
+// victoriaMetricsInfluxLine returns the numeric and boolean fields of a point
+// as a line of InfluxDB line protocol, or nothing when it has none.
+func victoriaMetricsInfluxLine(metrics Metrics) ([]byte, error) {
+	point := Metrics{Measurement: metrics.Measurement, Tags: map[string]string{}, Fields: map[string]interface{}{}, Timestamp: metrics.Timestamp, Precision: metrics.Precision}
+	for key, value := range metrics.Tags {
+		if !clientTags[key] {
+			point.Tags[key] = value
+		}
+	}
+	for key, value := range metrics.Fields {
+		if _, ok := victoriaMetricsValue(value); ok {
+			point.Fields[key] = value
+		}
+	}
+	if len(point.Fields) == 0 {
+		return nil, nil
+	}
+	line, err := protocol.AppendLine(nil, point)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// victoriaMetricsJSONLines returns the numeric and boolean fields of a point
+// as lines of the JSON import, timestamped now when the point has no
+// timestamp.
+func victoriaMetricsJSONLines(metrics Metrics, now time.Time) ([]byte, error) {
+	timestamp := pointTime(metrics, now).UnixMilli()
+	var lines []byte
+	for key, value := range metrics.Fields {
+		v, ok := victoriaMetricsValue(value)
+		if !ok {
+			continue
+		}
+		series := victoriaMetricsSeries{
+			Metric:     map[string]string{"__name__": metricName(metrics.Measurement + "_" + key)},
+			Values:     []float64{v},
+			Timestamps: []int64{timestamp},
+		}
+		for tag, value := range metrics.Tags {
+			if value != "" && !clientTags[tag] {
+				series.Metric[metricName(tag)] = value
+			}
+		}
+		line, err := json.Marshal(series)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	return lines, nil
+}
+
+// victoriaMetricsValue is gaugeValue without the NaN and infinite values
+// neither format can carry.
+func victoriaMetricsValue(value interface{}) (float64, bool) {
+	v, ok := gaugeValue(value)
+	return v, ok && !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// metricName replaces the characters Prometheus doesn't allow in metric and
+// label names with underscores.
+func metricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// submit imports a batch of points. A batch that can't be imported, retries
+// included, is dropped.
+func (e *victoriaMetricsExporter) submit(ctx context.Context, batch [][]byte) error {
+	if err := retry(ctx, e.config.Retry, func() error { return e.post(ctx, batch) }); err != nil {
+		return fmt.Errorf("dropped %d points: %w", len(batch), err)
+	}
+	return nil
+}
+
+// post posts the lines of points, gzipped unless DisableGzip is set.
+func (e *victoriaMetricsExporter) post(ctx context.Context, batch [][]byte) error {
+	var body bytes.Buffer
+	if e.config.DisableGzip {
+		for _, lines := range batch {
+			body.Write(lines)
+		}
+	} else {
+		gz := gzip.NewWriter(&body)
+		for _, lines := range batch {
+			if _, err := gz.Write(lines); err != nil {
+				return err
+			}
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, &body)
+	if err != nil {
+		return err
+	}
+	if e.config.Format == VictoriaMetricsJSON {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	} else {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	if !e.config.DisableGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if e.config.Username != "" {
+		req.SetBasicAuth(e.config.Username, e.config.Password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &StatusError{StatusCode: resp.StatusCode, Message: "VictoriaMetrics answered " + resp.Status}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package instrumentation
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// victoriaMetricsImport is a request received by fakeVictoriaMetrics.
+type victoriaMetricsImport struct {
+	path string
+	body string
+}
+
+// fakeVictoriaMetrics records the imports sent to it, gunzipped.
+func fakeVictoriaMetrics(t *testing.T) (*httptest.Server, chan victoriaMetricsImport) {
+	t.Helper()
+	imports := make(chan victoriaMetricsImport, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "vm" || password != "pw" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = gz
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Error(err)
+		}
+		imports <- victoriaMetricsImport{path: r.URL.Path, body: string(data)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server, imports
+}
+
+func TestVictoriaMetricsImportsInflux(t *testing.T) {
+	server, imports := fakeVictoriaMetrics(t)
+	startVictoriaMetrics(Config{VictoriaMetrics: VictoriaMetricsConfig{URL: server.URL, Username: "vm", Password: "pw", FlushInterval: Duration(time.Hour)}})
+	sendToVictoriaMetrics(Metrics{
+		Measurement: "orders",
+		Tags:        map[string]string{"endpoint": "/orders", "ip_address": "10.0.0.7"},
+		Fields:      map[string]interface{}{"latency_ms": 12, "error_class": "timeout"},
+		Timestamp:   1700000000,
+		Precision:   PrecisionSeconds,
+	})
+	sendToVictoriaMetrics(Metrics{Measurement: "orders", Fields: map[string]interface{}{"error_class": "timeout"}})
+	if err := stopVictoriaMetrics(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := <-imports
+	if want := "orders,endpoint=/orders latency_ms=12i 1700000000000000000\n"; got.path != "/write" || got.body != want {
+		t.Errorf("imported %q to %s, want %q to /write", got.body, got.path, want)
+	}
+}
+
+func TestVictoriaMetricsImportsJSONLines(t *testing.T) {
+	server, imports := fakeVictoriaMetrics(t)
+	startVictoriaMetrics(Config{VictoriaMetrics: VictoriaMetricsConfig{URL: server.URL, Format: VictoriaMetricsJSON, Username: "vm", Password: "pw", DisableGzip: true, BatchSize: 2, FlushInterval: Duration(time.Hour)}})
+	defer func() {
+		if err := stopVictoriaMetrics(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		sendToVictoriaMetrics(Metrics{Measurement: "orders", Tags: map[string]string{"endpoint": "/orders", "user_agent": "curl"}, Fields: map[string]interface{}{"latency ms": i}, Timestamp: 1700000000123, Precision: PrecisionMilliseconds})
+	}
+	select {
+	case got := <-imports:
+		lines := strings.Split(strings.TrimSuffix(got.body, "\n"), "\n")
+		if got.path != "/api/v1/import" || len(lines) != 2 {
+			t.Fatalf("imported %q to %s, want a full batch of 2 lines to /api/v1/import", got.body, got.path)
+		}
+		var series victoriaMetricsSeries
+		if err := json.Unmarshal([]byte(lines[1]), &series); err != nil {
+			t.Fatal(err)
+		}
+		if series.Metric["__name__"] != "orders_latency_ms" || series.Metric["endpoint"] != "/orders" || len(series.Metric) != 2 ||
+			series.Values[0] != 1 || series.Timestamps[0] != 1700000000123 {
+			t.Errorf("series = %+v", series)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a full batch wasn't imported before the flush interval")
+	}
+}
+
+func TestValidateVictoriaMetrics(t *testing.T) {
+	cfg := Config{ServiceName: "orders", VictoriaMetrics: VictoriaMetricsConfig{URL: "tcp://victoria:8428", Format: "csv", BatchSize: -1}}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 3 {
+		t.Errorf("Validate() = %v, want the URL, format and batch size rejected", err)
+	}
+	cfg.VictoriaMetrics = VictoriaMetricsConfig{URL: "http://victoria:8428"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !obs_lite || obs_reload
+
+package instrumentation
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// reloadDebounce coalesces the burst of events editors produce for one save.
+const reloadDebounce = 100 * time.Millisecond
+
+// WatchConfig watches a configuration file written for LoadConfig and applies
+// changes to its tunable settings (filters, extraction, limits) without a
+// restart. Each successful reload that changes something is reported to the
+// registry as a config_reloaded event carrying the diff, and every reload
+// attempt is passed to onReload when it is not nil. The returned function
+// stops watching.
+func WatchConfig(path string, onReload func(ConfigReload)) (func() error, error) {
+	path = filepath.Clean(path)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error creating config watcher: %w", err)
+	}
+	// Watch the directory, as editors often replace the file instead of writing it
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("error watching config file: %w", err)
+	}
+
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					debounce = time.After(reloadDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching config file: %v\n", err)
+			case <-debounce:
+				debounce = nil
+				result := reloadConfig(path)
+				if onReload != nil {
+					onReload(result)
+				}
+			}
+		}
+	}()
+
+	return watcher.Close, nil
+}
@@ -0,0 +1,13 @@
+//go:build obs_lite && !obs_reload
+
+package instrumentation
+
+import (
+	"errors"
+)
+
+// WatchConfig is not available in obs_lite builds, which leave out fsnotify;
+// add the obs_reload build tag to get it back.
+func WatchConfig(path string, onReload func(ConfigReload)) (func() error, error) {
+	return nil, errors.New("config watching is not compiled in: build with the obs_reload tag")
+}
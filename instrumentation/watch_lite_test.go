@@ -0,0 +1,13 @@
+//go:build obs_lite && !obs_reload
+
+package instrumentation
+
+import (
+	"testing"
+)
+
+func TestWatchConfigUnavailableInLiteBuilds(t *testing.T) {
+	if _, err := WatchConfig("instrumentation.json", nil); err == nil {
+		t.Error("WatchConfig succeeded without fsnotify compiled in")
+	}
+}
@@ -0,0 +1,71 @@
+//go:build !obs_lite || obs_reload
+
+package instrumentation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfigAppliesTunableFields(t *testing.T) {
+	previous := *activeConfig.Load()
+	t.Cleanup(func() {
+		if err := ApplyConfig(previous); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	path := filepath.Join(t.TempDir(), "instrumentation.json")
+	writeConfig := func(body string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"registry_url": "` + collectorURL + `", "service_name": "test-service", "disable_send_queue": true}`)
+
+	reloads := make(chan ConfigReload, 4)
+	stop, err := WatchConfig(path, func(r ConfigReload) { reloads <- r })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	writeConfig(`{"registry_url": "` + collectorURL + `", "service_name": "renamed", "ignore_paths": ["/healthz"], "max_endpoints": 10, "disable_send_queue": true}`)
+
+	var reload ConfigReload
+	select {
+	case reload = <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config was not reloaded")
+	}
+	if reload.Err != nil {
+		t.Fatalf("reload error: %v", reload.Err)
+	}
+	if len(reload.Ignored) != 1 || reload.Ignored[0] != "service_name" {
+		t.Errorf("ignored = %v, want [service_name]", reload.Ignored)
+	}
+	changed := map[string]bool{}
+	for _, change := range reload.Changes {
+		changed[change.Field] = true
+	}
+	if len(changed) != 2 || !changed["ignore_paths"] || !changed["max_endpoints"] {
+		t.Errorf("changes = %+v, want ignore_paths and max_endpoints", reload.Changes)
+	}
+	if !IsIgnoredPath("/healthz") {
+		t.Error("reloaded ignore_paths not applied")
+	}
+	if measurement != "test-service" {
+		t.Errorf("measurement = %q, want the service name to need a restart", measurement)
+	}
+
+	event := nextMetrics(t)
+	if event.Tags["event"] != "config_reloaded" {
+		t.Fatalf("event tag = %q, want config_reloaded", event.Tags["event"])
+	}
+	if event.Fields["changed_fields"] != "max_endpoints,ignore_paths" {
+		t.Errorf("changed_fields = %v", event.Fields["changed_fields"])
+	}
+}
@@ -0,0 +1,84 @@
+package instrumentation
+
+import (
+	"bytes"
+	"log"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// maxGoroutineDumpBytes caps the dump the stack of a slow request is searched
+// in.
+const maxGoroutineDumpBytes = 4 << 20
+
+// watchRequest reports a request still running after SlowRequestThreshold with
+// a request_in_progress event, and logs the stack of its handler, so stuck
+// handlers show up before they complete or time out. It must be called from
+// the goroutine serving the request; stop is called when the request ends.
+// The request gets an ID, as reported with the request, only if it is slow.
+func watchRequest(endpoint func() string, rec *RequestRecord) (stop func()) {
+	threshold := loadSettings().slowRequestThreshold
+	if threshold <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	goroutine := currentGoroutineID()
+	timer := time.AfterFunc(threshold, func() {
+		elapsed := time.Since(start)
+		requestID := rec.RequestID()
+		log.Printf("Request %s to %s still running after %v:\n%s\n", requestID, endpoint(), elapsed.Round(time.Millisecond), goroutineStack(goroutine))
+		sendEvent("request_in_progress", map[string]string{"endpoint": endpoint()}, map[string]interface{}{
+			"request_id": requestID,
+			"elapsed_ms": elapsed.Milliseconds(),
+		})
+	})
+	return func() { timer.Stop() }
+}
+
+// currentGoroutineID returns the ID of the calling goroutine, as shown in
+// stack dumps.
+func currentGoroutineID() string {
+	var buf [64]byte
+	header := buf[:runtime.Stack(buf[:], false)]
+	// "goroutine 18 [running]:"
+	header = bytes.TrimPrefix(header, []byte("goroutine "))
+	if i := bytes.IndexByte(header, ' '); i > 0 {
+		header = header[:i]
+	}
+	if _, err := strconv.ParseUint(string(header), 10, 64); err != nil {
+		return ""
+	}
+	return string(header)
+}
+
+// goroutineDump returns the stacks of all goroutines, up to
+// maxGoroutineDumpBytes.
+func goroutineDump() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxGoroutineDumpBytes {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// goroutineStack returns the stack of the goroutine with the given ID, capped
+// like panic_stack, or a note when it can't be found.
+func goroutineStack(id string) string {
+	if id == "" {
+		return "(stack unavailable)"
+	}
+	prefix := []byte("goroutine " + id + " [")
+	for _, stack := range bytes.Split(goroutineDump(), []byte("\n\n")) {
+		if bytes.HasPrefix(stack, prefix) {
+			if len(stack) > maxPanicStackBytes {
+				stack = stack[:maxPanicStackBytes]
+			}
+			return string(stack)
+		}
+	}
+	return "(stack unavailable)"
+}
@@ -0,0 +1,78 @@
+package instrumentation
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe to log to from other goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSlowRequestWatchdog(t *testing.T) {
+	applyOptions([]Option{WithSlowRequestWatchdog(10 * time.Millisecond)})
+	defer applyOptions(nil)
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	release := make(chan struct{})
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		req := httptest.NewRequest(http.MethodGet, "/watchdog/stuck", nil)
+		req.Header.Set(RequestIDHeader, "req-stuck")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	event := nextMetrics(t)
+	if event.Tags["event"] != "request_in_progress" || event.Tags["endpoint"] != "/watchdog/stuck" || event.Fields["request_id"] != "req-stuck" {
+		t.Errorf("event = %v %v, want request_in_progress for req-stuck", event.Tags, event.Fields)
+	}
+	if elapsed, _ := event.Fields["elapsed_ms"].(float64); elapsed < 10 {
+		t.Errorf("elapsed_ms = %v, want at least 10", event.Fields["elapsed_ms"])
+	}
+	if got := logs.String(); !strings.Contains(got, "req-stuck") || !strings.Contains(got, "TestSlowRequestWatchdog.func") {
+		t.Errorf("log = %q, want the request ID and the handler's stack", got)
+	}
+
+	close(release)
+	<-served
+	if final := nextMetrics(t); final.Tags["event"] != "" || final.Tags["endpoint"] != "/watchdog/stuck" {
+		t.Errorf("final point = %v, want the request's point", final.Tags)
+	}
+}
+
+func TestSlowRequestWatchdogIgnoresFastRequests(t *testing.T) {
+	applyOptions([]Option{WithSlowRequestWatchdog(time.Hour)})
+	defer applyOptions(nil)
+
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/watchdog/fast", nil))
+	if metrics := nextMetrics(t); metrics.Tags["event"] != "" {
+		t.Errorf("got a %s event for a fast request", metrics.Tags["event"])
+	}
+}
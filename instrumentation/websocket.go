@@ -0,0 +1,195 @@
+package instrumentation
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WebSocketConn is a *websocket.Conn that counts the data messages and bytes
+// going through ReadMessage, WriteMessage, NextReader, NextWriter, ReadJSON
+// and WriteJSON, and reports them when closed. Control frames and prepared
+// messages aren't counted.
+type WebSocketConn struct {
+	*websocket.Conn
+
+	endpoint  string
+	startTime time.Time
+
+	messagesReceived atomic.Int64
+	messagesSent     atomic.Int64
+	bytesReceived    atomic.Int64
+	bytesSent        atomic.Int64
+	// closeCode is the code of the close frame received from the peer
+	closeCode atomic.Int64
+
+	reportOnce sync.Once
+}
+
+// UpgradeWebSocket upgrades r with upgrader like upgrader.Upgrade, and returns
+// a connection that sends one point when closed, tagged protocol=websocket and
+// with the request's endpoint, carrying how long it stayed open and the
+// messages and bytes sent and received. The upgrade request itself is reported
+// by Middleware as usual, with a 101 status.
+//
+//	conn, err := instrumentation.UpgradeWebSocket(&upgrader, w, r, nil)
+//	if err != nil {
+//		return
+//	}
+//	defer conn.Close()
+func UpgradeWebSocket(upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*WebSocketConn, error) {
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := r.URL.Path
+	if rec := recordOf(r); rec != nil && rec.route != "" {
+		endpoint = rec.route
+	}
+	return &WebSocketConn{Conn: conn, endpoint: endpoint, startTime: time.Now()}, nil
+}
+
+// ReadMessage reads a message like websocket.Conn.ReadMessage and counts it.
+func (c *WebSocketConn) ReadMessage() (messageType int, p []byte, err error) {
+	messageType, p, err = c.Conn.ReadMessage()
+	if err != nil {
+		c.readFailed(err)
+		return messageType, p, err
+	}
+	c.messagesReceived.Add(1)
+	c.bytesReceived.Add(int64(len(p)))
+	return messageType, p, nil
+}
+
+// WriteMessage writes a message like websocket.Conn.WriteMessage and counts
+// it.
+func (c *WebSocketConn) WriteMessage(messageType int, data []byte) error {
+	if err := c.Conn.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
+		c.messagesSent.Add(1)
+		c.bytesSent.Add(int64(len(data)))
+	}
+	return nil
+}
+
+// NextReader returns a reader for the next message, counting the bytes read
+// from it.
+func (c *WebSocketConn) NextReader() (messageType int, r io.Reader, err error) {
+	messageType, r, err = c.Conn.NextReader()
+	if err != nil {
+		c.readFailed(err)
+		return messageType, r, err
+	}
+	c.messagesReceived.Add(1)
+	return messageType, &countingReader{Reader: r, n: &c.bytesReceived}, nil
+}
+
+// NextWriter returns a writer for the next message, counting the bytes
+// written to it.
+func (c *WebSocketConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	w, err := c.Conn.NextWriter(messageType)
+	if err != nil {
+		return nil, err
+	}
+	c.messagesSent.Add(1)
+	return &countingWriter{WriteCloser: w, n: &c.bytesSent}, nil
+}
+
+// ReadJSON reads the next message as JSON into v, like
+// websocket.Conn.ReadJSON.
+func (c *WebSocketConn) ReadJSON(v interface{}) error {
+	_, r, err := c.NextReader()
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(r).Decode(v)
+	if err == io.EOF {
+		// One value is expected in the message
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WriteJSON writes v as a JSON text message, like websocket.Conn.WriteJSON.
+func (c *WebSocketConn) WriteJSON(v interface{}) error {
+	w, err := c.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	encodeErr := json.NewEncoder(w).Encode(v)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return encodeErr
+}
+
+// Close reports the connection, the first time, and closes it.
+func (c *WebSocketConn) Close() error {
+	c.reportOnce.Do(c.report)
+	return c.Conn.Close()
+}
+
+// readFailed keeps the close code sent by the peer.
+func (c *WebSocketConn) readFailed(err error) {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		c.closeCode.Store(int64(closeErr.Code))
+	}
+}
+
+func (c *WebSocketConn) report() {
+	tags := map[string]string{
+		"endpoint": endpointTag(c.endpoint),
+		"protocol": "websocket",
+	}
+	fields := map[string]interface{}{
+		"connection_duration_ms": time.Since(c.startTime).Milliseconds(),
+		"messages_received":      c.messagesReceived.Load(),
+		"messages_sent":          c.messagesSent.Load(),
+		"bytes_received":         c.bytesReceived.Load(),
+		"bytes_sent":             c.bytesSent.Load(),
+	}
+	if code := c.closeCode.Load(); code != 0 {
+		fields["close_code"] = code
+	}
+
+	metrics := Metrics{
+		InfluxDBURL: influxDBURL,
+		Token:       currentToken(),
+		Org:         org,
+		Bucket:      bucket,
+		Measurement: measurement,
+		Tags:        tags,
+		Fields:      fields,
+	}
+	reportPoint(metrics)
+}
+
+type countingReader struct {
+	io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,72 @@
+package instrumentation
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpgradeWebSocketReportsConnection(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetRoute(r, "/ws/{room}")
+		conn, err := UpgradeWebSocket(&upgrader, w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		for {
+			var message map[string]string
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("ack:"+message["text"])); err != nil {
+				return
+			}
+		}
+	})))
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/lobby", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"hello", "bye"} {
+		if err := client.WriteJSON(map[string]string{"text": text}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := client.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeFrame := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := client.WriteMessage(websocket.CloseMessage, closeFrame); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn := nextMetrics(t)
+	if conn.Tags["protocol"] != "websocket" || conn.Tags["endpoint"] != "/ws/{room}" {
+		t.Errorf("connection tags = %v", conn.Tags)
+	}
+	want := map[string]float64{
+		"messages_received": 2,
+		"messages_sent":     2,
+		"bytes_received":    float64(len(`{"text":"hello"}`+"\n") + len(`{"text":"bye"}`+"\n")),
+		"bytes_sent":        float64(len("ack:hello") + len("ack:bye")),
+		"close_code":        websocket.CloseNormalClosure,
+	}
+	for field, value := range want {
+		if conn.Fields[field] != value {
+			t.Errorf("%s = %v, want %v", field, conn.Fields[field], value)
+		}
+	}
+
+	upgrade := nextMetrics(t)
+	if upgrade.Tags["endpoint"] != "/ws/{room}" || upgrade.Fields["status_code"] != float64(http.StatusSwitchingProtocols) {
+		t.Errorf("upgrade request = %v %v, want a 101", upgrade.Tags, upgrade.Fields)
+	}
+}
@@ -0,0 +1,71 @@
+package instrumentation
+
+import (
+	"github.com/jculley01/observability-module/protocol"
+	"sync/atomic"
+)
+
+// Wire formats of Config.WireFormat, the names of the built-in codecs.
+const (
+	WireFormatJSON        = "json"
+	WireFormatProtobuf    = "protobuf"
+	WireFormatMessagePack = "msgpack"
+	// WireFormatLineProtocol writes text frames of InfluxDB line protocol,
+	// which the registry can forward to InfluxDB as they are
+	WireFormatLineProtocol = "line"
+)
+
+var (
+	// wireCodec is the codec of Config.WireFormat, nil for JSON
+	wireCodec atomic.Pointer[protocol.Codec]
+	// wireSchemaVersion is Config.SchemaVersion, zero for
+	// protocol.SchemaVersion
+	wireSchemaVersion atomic.Int64
+)
+
+// storeWireCodec makes the codec of format, validated already, the one points
+// are written with.
+func storeWireCodec(format string) {
+	codec, ok := protocol.LookupCodec(format)
+	if !ok {
+		codec = protocol.JSON
+	}
+	wireCodec.Store(&codec)
+}
+
+func currentCodec() protocol.Codec {
+	if codec := wireCodec.Load(); codec != nil {
+		return *codec
+	}
+	return protocol.JSON
+}
+
+// storeSchemaVersion makes version, validated already, the schema version
+// of the points written.
+func storeSchemaVersion(version int) {
+	wireSchemaVersion.Store(int64(version))
+}
+
+func currentSchemaVersion() int {
+	if version := wireSchemaVersion.Load(); version != 0 {
+		return int(version)
+	}
+	return protocol.SchemaVersion
+}
+
+// writeFrame writes points to the registry as one frame of the wire format,
+// of the schema version of the session.
+func writeFrame(points []Metrics) error {
+	if version := currentSchemaVersion(); version != protocol.SchemaVersion {
+		var err error
+		if points, err = protocol.DowngradePoints(points, version); err != nil {
+			return err
+		}
+	}
+	codec := currentCodec()
+	data, err := codec.Encode(points)
+	if err != nil {
+		return err
+	}
+	return sendFrame(len(points), data, codec.Binary())
+}
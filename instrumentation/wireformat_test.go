@@ -0,0 +1,141 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/jculley01/observability-module/protocol"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBinaryWireFormats(t *testing.T) {
+	for _, format := range []string{WireFormatProtobuf, WireFormatMessagePack} {
+		t.Run(format, func(t *testing.T) { testBinaryWireFormat(t, format) })
+	}
+}
+
+func testBinaryWireFormat(t *testing.T, format string) {
+	frames := make(chan []Metrics, 16)
+	upgrader := websocket.Upgrader{}
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var codec protocol.Codec
+		for {
+			messageType, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if session, ok := protocol.DecodeSession(data); ok {
+				codec, _ = session.FrameCodec(true)
+				continue
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			if codec == nil || codec.Name() != format {
+				t.Errorf("binary frame after a session naming %v, want %s", codec, format)
+				continue
+			}
+			points, err := codec.Decode(data)
+			if err != nil {
+				t.Errorf("invalid binary frame: %v", err)
+				continue
+			}
+			frames <- points
+		}
+	}))
+	defer registry.Close()
+	next := func() []Metrics {
+		t.Helper()
+		select {
+		case points := <-frames:
+			return points
+		case <-time.After(5 * time.Second):
+			t.Fatal("no binary frame received")
+			return nil
+		}
+	}
+
+	registryURL := "ws" + strings.TrimPrefix(registry.URL, "http")
+	if err := Configure(registryURL, "test-service", "http://influxdb:8086", "secret-token", "", "", WithWireFormat(format), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := Send(Metrics{Fields: map[string]interface{}{"rows": 12, "ok": true}}); err != nil {
+		t.Fatal(err)
+	}
+	points := next()
+	if len(points) != 1 || points[0].Fields["rows"] != int64(12) || points[0].Fields["ok"] != true || points[0].Token != "" {
+		t.Errorf("points = %+v, want the point without its token", points)
+	}
+
+	// Batches are one binary frame too
+	if err := Configure(registryURL, "test-service", "", "", "", "", WithWireFormat(format), WithBatching(time.Hour, 2), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := Send(Metrics{Fields: map[string]interface{}{"i": i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if points := next(); len(points) != 2 || points[1].Fields["i"] != int64(1) {
+		t.Errorf("batch = %+v", points)
+	}
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateWireFormat(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "orders", WireFormat: "xml"}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 1 || validationErr.Errors[0].Field != "wire_format" {
+		t.Errorf("Validate() = %v, want wire_format rejected", err)
+	}
+	WithWireFormat(WireFormatMessagePack)(&cfg)
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+func TestLineProtocolWireFormat(t *testing.T) {
+	drainSessions()
+	if err := Configure(collectorURL, "test-service", "http://influxdb:8086", "secret-token", "", "", WithWireFormat(WireFormatLineProtocol), WithoutSendQueue()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Configure(collectorURL, "test-service", "", "", "", "", WithoutSendQueue()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := Send(Metrics{Measurement: "orders", Tags: map[string]string{"endpoint": "/pay"}, Fields: map[string]interface{}{"rows": 12, "ok": true}}); err != nil {
+		t.Fatal(err)
+	}
+	point := nextMetrics(t)
+	if point.Measurement != "orders" || point.Tags["endpoint"] != "/pay" || point.Fields["rows"] != float64(12) || point.Fields["ok"] != true {
+		t.Errorf("point = %+v", point)
+	}
+	if session := nextSession(t); session.Encoding != WireFormatLineProtocol || session.Token != "secret-token" {
+		t.Errorf("session = %+v, want the credentials and the line encoding", session)
+	}
+}
+
+func TestValidateLineProtocolWithPointCredentials(t *testing.T) {
+	cfg := Config{RegistryURL: "ws://registry", ServiceName: "orders", WireFormat: WireFormatLineProtocol, PointCredentials: true}
+	var validationErr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &validationErr) || len(validationErr.Errors) != 1 || validationErr.Errors[0].Field != "point_credentials" {
+		t.Errorf("Validate() = %v, want point_credentials rejected", err)
+	}
+}
@@ -0,0 +1,76 @@
+package interceptor
+
+import (
+	"context"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/registration"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"log"
+	"time"
+)
+
+// NewClientMetricsInterceptor returns a unary client interceptor reporting
+// each outbound call to the registry of cfg, like the server interceptors
+// report inbound ones: with direction=outbound, the target of the connection,
+// the method as endpoint and the final status in grpc_status and status_code,
+// and the latency, message sizes, deadline and address of the peer that
+// answered. Calls made with the context of a request the instrumentation
+// package is instrumenting also count in its downstream_calls. A call fails or
+// succeeds as it would without the interceptor. The call carries the ID of
+// the request it is made for in RequestIDMetadata, so the server interceptors
+// of the callee report it as request_id too.
+func NewClientMetricsInterceptor(cfg Config) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		callCtx, requestID := outgoingCorrelation(ctx, cfg.Gateway)
+		var p peer.Peer
+		start := time.Now()
+		err := invoker(callCtx, method, req, reply, cc, append(opts, grpc.Peer(&p))...)
+		latency := time.Since(start)
+
+		target := ""
+		if cc != nil {
+			target = cc.Target()
+		}
+		instrumentation.RecordDownstreamCall(ctx, target, latency)
+
+		code := statusCode(err)
+		fields := map[string]interface{}{
+			"duration":     latency.Seconds(),
+			"latency_ms":   latency.Milliseconds(),
+			"request_size": messageSize(req),
+		}
+		if err == nil {
+			fields["response_size"] = messageSize(reply)
+		}
+		if p.Addr != nil {
+			// A field rather than a tag, as a target may resolve to many
+			// addresses over time
+			fields["peer_address"] = p.Addr.String()
+		}
+		if requestID != "" {
+			fields["request_id"] = requestID
+		}
+		metrics := Metrics{
+			Measurement: cfg.Measurement,
+			Tags: map[string]string{
+				"endpoint":     method,
+				"direction":    "outbound",
+				"target":       target,
+				"rpc_type":     "unary",
+				"service_type": string(registration.GRPC),
+			},
+			Fields: fields,
+		}
+		if cfg.Gateway {
+			metrics.Tags["hop"] = instrumentation.HopGateway
+		}
+		countStatus(metrics.Tags, metrics.Fields, method, code)
+		deadlineFields(ctx, start, code, metrics.Fields)
+		// The call ends as the invoker ended it, whether or not it was reported
+		if metricsErr := sendMetrics(cfg, metrics); metricsErr != nil {
+			log.Printf("observability: sending client metrics: %v", metricsErr)
+		}
+		return err
+	}
+}
@@ -0,0 +1,54 @@
+package interceptor
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jculley01/observability-module/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"net"
+	"testing"
+)
+
+func TestNewClientMetricsInterceptor(t *testing.T) {
+	registryURL, frames := fakeRegistry(t)
+	intercept := NewClientMetricsInterceptor(Config{RegistryURL: registryURL, Measurement: "checkout"})
+	cc, err := grpc.Dial("passthrough:///orders:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		for _, opt := range opts {
+			if p, ok := opt.(grpc.PeerCallOption); ok {
+				*p.PeerAddr = peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 50051}}
+			}
+		}
+		return status.Error(codes.Unavailable, "orders is down")
+	}
+	err = intercept(context.Background(), "/acme.Orders/Get", wrapperspb.String("order-1"), &wrapperspb.StringValue{}, cc, invoker)
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("interceptor returned %v, want the call's error", err)
+	}
+
+	nextFrame(t, frames)
+	points, err := protocol.DecodeFrame(nextFrame(t, frames))
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := points[0]
+	if point.Measurement != "checkout" || point.Tags["direction"] != "outbound" || point.Tags["target"] != "passthrough:///orders:50051" ||
+		point.Tags["endpoint"] != "/acme.Orders/Get" || point.Tags["grpc_status"] != "14" || point.Tags["status_code"] != "Unavailable" {
+		t.Errorf("point = %+v, want an outbound call to orders ending UNAVAILABLE", point)
+	}
+	if point.Fields["peer_address"] != "10.0.0.7:50051" || point.Fields["request_size"] == json.Number("0") {
+		t.Errorf("fields = %v, want the peer and the request size", point.Fields)
+	}
+	if _, ok := point.Fields["response_size"]; ok {
+		t.Error("a failed call reported a response size")
+	}
+}
@@ -0,0 +1,69 @@
+package interceptor
+
+import (
+	"context"
+	"github.com/jculley01/observability-module/instrumentation"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata correlating the points of a request across services: the request
+// ID, like instrumentation.RequestIDHeader for HTTP, and the hop of the
+// caller, set by the client interceptor of a gateway.
+const (
+	RequestIDMetadata = "x-request-id"
+	HopMetadata       = "x-observability-hop"
+)
+
+// outgoingCorrelation returns ctx with the metadata correlating an outbound
+// call with the request it is made for, and that request's ID: the one of the
+// HTTP request the instrumentation package is instrumenting, if ctx belongs
+// to one, or else the one of the RPC being served. A gateway also tags the
+// HTTP request as its hop and marks the call as coming from it.
+func outgoingCorrelation(ctx context.Context, gateway bool) (context.Context, string) {
+	var requestID string
+	if rec := instrumentation.FromContext(ctx); rec != nil {
+		requestID = rec.RequestID()
+		if gateway {
+			instrumentation.SetHop(ctx, instrumentation.HopGateway)
+		}
+	} else {
+		requestID = incomingRequestID(ctx)
+	}
+	var pairs []string
+	if requestID != "" {
+		pairs = append(pairs, RequestIDMetadata, requestID)
+	}
+	if gateway {
+		pairs = append(pairs, HopMetadata, instrumentation.HopGateway)
+	}
+	if len(pairs) == 0 {
+		return ctx, ""
+	}
+	return metadata.AppendToOutgoingContext(ctx, pairs...), requestID
+}
+
+// incomingCorrelation adds the request ID an RPC was called with to its
+// fields as request_id, and tags it hop=backend when a gateway called it.
+func incomingCorrelation(ctx context.Context, tags map[string]string, fields map[string]interface{}) {
+	if requestID := incomingRequestID(ctx); requestID != "" {
+		fields["request_id"] = requestID
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if hop := md.Get(HopMetadata); len(hop) > 0 && hop[0] == instrumentation.HopGateway {
+			tags["hop"] = instrumentation.HopBackend
+		}
+	}
+}
+
+// incomingRequestID returns the request ID of the RPC being served, if it was
+// called with a valid one.
+func incomingRequestID(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if ids := md.Get(RequestIDMetadata); len(ids) > 0 && instrumentation.ValidRequestID(ids[0]) {
+		return ids[0]
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+package interceptor
+
+import (
+	"context"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/instrumentation/instrumentationtest"
+	"github.com/jculley01/observability-module/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGatewayCorrelation(t *testing.T) {
+	collector := instrumentationtest.NewCollector()
+	defer collector.Close()
+	if err := instrumentation.Configure(collector.URL, "gateway", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	gatewayURL, gatewayFrames := fakeRegistry(t)
+	backendURL, backendFrames := fakeRegistry(t)
+
+	backend := NewMetricsInterceptor(Config{RegistryURL: backendURL, Measurement: "orders"})
+	// The invoker stands in for the network between the gateway and the
+	// backend: what the gateway sends is what the backend receives
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return wrapperspb.String("ok"), nil
+		}
+		_, err := backend(metadata.NewIncomingContext(context.Background(), md), req, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+	gateway := NewClientMetricsInterceptor(Config{RegistryURL: gatewayURL, Measurement: "gateway", Gateway: true})
+	handler := instrumentation.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := gateway(r.Context(), "/acme.Orders/Get", wrapperspb.String("order-1"), &wrapperspb.StringValue{}, nil, invoker); err != nil {
+			t.Error(err)
+		}
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/v1/orders/order-1", nil)
+	req.Header.Set(instrumentation.RequestIDHeader, "req-42")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	hops := map[string]protocol.Point{}
+	for name, frames := range map[string]chan []byte{"outbound": gatewayFrames, "backend": backendFrames} {
+		nextFrame(t, frames)
+		points, err := protocol.DecodeFrame(nextFrame(t, frames))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hops[name] = points[0]
+	}
+	if point := hops["backend"]; point.Tags["hop"] != "backend" || point.Fields["request_id"] != "req-42" {
+		t.Errorf("backend point = %+v, want hop=backend and the gateway's request ID", point)
+	}
+	if point := hops["outbound"]; point.Tags["hop"] != "gateway" || point.Fields["request_id"] != "req-42" {
+		t.Errorf("outbound point = %+v, want hop=gateway and the request ID", point)
+	}
+	if point := collector.Next(t); point.Tags["hop"] != "gateway" || point.Fields["request_id"] != "req-42" {
+		t.Errorf("HTTP point = %+v, want hop=gateway and the request ID", point)
+	}
+}
+
+func TestIncomingCorrelation(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(RequestIDMetadata, "req 42\n", HopMetadata, "backend"))
+	tags, fields := map[string]string{}, map[string]interface{}{}
+	incomingCorrelation(ctx, tags, fields)
+	if len(tags) != 0 || len(fields) != 0 {
+		t.Errorf("tags, fields = %v, %v, want an invalid request ID and an unknown hop ignored", tags, fields)
+	}
+
+	// A service forwards the ID of the RPC it serves, without a hop
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(RequestIDMetadata, "req-42"))
+	ctx, requestID := outgoingCorrelation(ctx, false)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if requestID != "req-42" || len(md.Get(RequestIDMetadata)) != 1 || len(md.Get(HopMetadata)) != 0 {
+		t.Errorf("outgoing metadata = %v, want the request ID only", md)
+	}
+}
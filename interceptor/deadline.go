@@ -0,0 +1,19 @@
+package interceptor
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"time"
+)
+
+// deadlineFields adds the deadline pressure of an RPC to its fields:
+// deadline_set, deadline_remaining_ms, what was left of the deadline when the
+// handler or the call started, if one was set, and deadline_exceeded.
+func deadlineFields(ctx context.Context, start time.Time, code codes.Code, fields map[string]interface{}) {
+	deadline, ok := ctx.Deadline()
+	fields["deadline_set"] = ok
+	if ok {
+		fields["deadline_remaining_ms"] = deadline.Sub(start).Milliseconds()
+	}
+	fields["deadline_exceeded"] = code == codes.DeadlineExceeded
+}
@@ -0,0 +1,25 @@
+package interceptor
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"testing"
+	"time"
+)
+
+func TestDeadlineFields(t *testing.T) {
+	start := time.Now()
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(250*time.Millisecond))
+	defer cancel()
+	fields := map[string]interface{}{}
+	deadlineFields(ctx, start, codes.DeadlineExceeded, fields)
+	if fields["deadline_set"] != true || fields["deadline_remaining_ms"] != int64(250) || fields["deadline_exceeded"] != true {
+		t.Errorf("fields = %v, want a 250ms deadline that was exceeded", fields)
+	}
+
+	fields = map[string]interface{}{}
+	deadlineFields(context.Background(), start, codes.OK, fields)
+	if _, ok := fields["deadline_remaining_ms"]; ok || fields["deadline_set"] != false || fields["deadline_exceeded"] != false {
+		t.Errorf("fields = %v, want no deadline", fields)
+	}
+}
@@ -0,0 +1,96 @@
+package interceptor
+
+import (
+	"context"
+	"github.com/jculley01/observability-module/instrumentation"
+	"google.golang.org/grpc/metadata"
+	"strings"
+)
+
+// redactedValue replaces the value of credential-bearing metadata.
+const redactedValue = "redacted"
+
+// sensitiveMetadata are never reported as they are, even when configured for
+// capture, since they carry credentials or session state.
+var sensitiveMetadata = map[string]struct{}{
+	"authorization":       {},
+	"proxy-authorization": {},
+	"cookie":              {},
+	"set-cookie":          {},
+	"x-api-key":           {},
+	"x-auth-token":        {},
+}
+
+// MetadataCapture reports an incoming metadata key of the server
+// interceptors as a tag or field.
+type MetadataCapture struct {
+	// Key is the metadata key, e.g. "x-tenant-id"; gRPC lower-cases keys, so
+	// it is matched case-insensitively.
+	Key string
+	// Field sends the value as a field instead of a tag. Prefer it for
+	// per-request values such as request IDs, which would make a series per
+	// request; tags are capped at MaxTagValues distinct values, beyond which
+	// "tag_overflow" is reported.
+	Field bool
+	// Name is the tag or field name; it defaults to the key with dashes
+	// turned into underscores, e.g. "x_tenant_id".
+	Name string
+	// Redact reports the value as "redacted", for keys carrying secrets
+	// beyond the credential keys that always are, e.g. authorization.
+	Redact bool
+}
+
+// normalizeMetadataCaptures lower-cases keys and fills in defaults.
+func normalizeMetadataCaptures(captures []MetadataCapture) []MetadataCapture {
+	if len(captures) == 0 {
+		return nil
+	}
+	normalized := make([]MetadataCapture, 0, len(captures))
+	for _, capture := range captures {
+		capture.Key = strings.ToLower(strings.TrimSpace(capture.Key))
+		if capture.Key == "" {
+			continue
+		}
+		if capture.Name == "" {
+			capture.Name = strings.ReplaceAll(capture.Key, "-", "_")
+		}
+		if _, sensitive := sensitiveMetadata[capture.Key]; sensitive || strings.HasSuffix(capture.Key, "-bin") {
+			// Binary values aren't fit for tags either
+			capture.Redact = true
+		}
+		normalized = append(normalized, capture)
+	}
+	return normalized
+}
+
+// captureMetadata adds the captured keys of the incoming metadata of ctx to
+// a point, with the first value of each; missing keys are skipped, and so
+// are names the interceptor already tags the point with. Tags are capped at
+// the instrumentation package's MaxTagValues distinct values per name, as
+// clients choose them.
+func captureMetadata(ctx context.Context, captures []MetadataCapture, tags map[string]string, fields map[string]interface{}) {
+	if len(captures) == 0 {
+		return
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return
+	}
+	for _, capture := range captures {
+		values := md.Get(capture.Key)
+		if len(values) == 0 || values[0] == "" {
+			continue
+		}
+		value := values[0]
+		if capture.Redact {
+			value = redactedValue
+		}
+		if capture.Field {
+			if _, taken := fields[capture.Name]; !taken {
+				fields[capture.Name] = value
+			}
+		} else if _, taken := tags[capture.Name]; !taken {
+			tags[capture.Name] = instrumentation.LimitTagValue(capture.Name, value)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package interceptor
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/metadata"
+	"reflect"
+	"testing"
+)
+
+func TestCaptureMetadata(t *testing.T) {
+	captures := normalizeMetadataCaptures([]MetadataCapture{
+		{Key: " X-Tenant-ID "},
+		{Key: "x-request-id", Field: true},
+		{Key: "authorization"},
+		{Key: "x-session", Name: "session", Redact: true},
+		{Key: "x-trace-bin"},
+		{Key: "x-endpoint", Name: "endpoint"},
+		{Key: "x-missing"},
+		{Key: ""},
+	})
+	if len(captures) != 7 || captures[0].Key != "x-tenant-id" || captures[0].Name != "x_tenant_id" {
+		t.Fatalf("normalized captures = %+v", captures)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-tenant-id", "acme", "x-tenant-id", "globex",
+		"x-request-id", "req-42",
+		"authorization", "Bearer secret",
+		"x-session", "s3cr3t",
+		"x-trace-bin", "\x00\x01",
+		"x-endpoint", "/spoofed",
+	))
+	tags := map[string]string{"endpoint": "/acme.Orders/Get"}
+	fields := map[string]interface{}{}
+	captureMetadata(ctx, captures, tags, fields)
+	wantTags := map[string]string{
+		"endpoint":      "/acme.Orders/Get",
+		"x_tenant_id":   "acme",
+		"authorization": redactedValue,
+		"session":       redactedValue,
+		"x_trace_bin":   redactedValue,
+	}
+	if !reflect.DeepEqual(tags, wantTags) {
+		t.Errorf("tags = %v, want %v", tags, wantTags)
+	}
+	if !reflect.DeepEqual(fields, map[string]interface{}{"x_request_id": "req-42"}) {
+		t.Errorf("fields = %v, want the request ID", fields)
+	}
+}
+
+func TestCaptureMetadataCapsTagValues(t *testing.T) {
+	captures := normalizeMetadataCaptures([]MetadataCapture{{Key: "x-client-nonce"}})
+	values := map[string]bool{}
+	for i := 0; i < 150; i++ {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-client-nonce", fmt.Sprintf("nonce-%d", i)))
+		tags := map[string]string{}
+		captureMetadata(ctx, captures, tags, map[string]interface{}{})
+		values[tags["x_client_nonce"]] = true
+	}
+	// The default cap of 100 values, and tag_overflow for the rest
+	if len(values) != 101 || !values["tag_overflow"] {
+		t.Errorf("reported %d distinct values, want 100 and tag_overflow", len(values))
+	}
+}
@@ -2,163 +2,175 @@ package interceptor
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"github.com/gorilla/websocket"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/jculley01/observability-module/instrumentation"
+	"github.com/jculley01/observability-module/protocol"
+	"github.com/jculley01/observability-module/registration"
+	"github.com/jculley01/observability-module/transport"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
-	"google.golang.org/protobuf/proto"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
-const (
-	serverURL      = "http://35.236.200.122:8086/"
-	influxDBToken  = "AxNHAn8hBBhsHz0o6HVJ2iM9gfGqybVWugTx5crw0o2yvkPTURsZqztPjxOXp4YWR2Hy9jiQPZePyilXFh7lcg=="
-	influxDBOrg    = "API-Observability"
-	influxDBBucket = "combined_metrics"
-)
-
-type Metrics struct {
-	InfluxDBURL string                 `json:"influxdb_url"`
-	Token       string                 `json:"token"`
-	Org         string                 `json:"org"`
-	Bucket      string                 `json:"bucket"`
-	Measurement string                 `json:"measurement"`
-	Tags        map[string]string      `json:"tags"`
-	Fields      map[string]interface{} `json:"fields"`
+// Config is where the interceptors report: the metrics endpoint of the
+// central registry, and the InfluxDB destination the registry writes the
+// points to, sent once per connection in the session rather than with every
+// point.
+type Config struct {
+	// RegistryURL is the metrics endpoint of the registry, e.g.
+	// wss://registry.example.com/metrics. Without one, the server
+	// interceptors only call the handler.
+	RegistryURL string
+	InfluxDBURL string
+	Token       string
+	Org         string
+	Bucket      string
+	// Measurement names the points, usually after the service.
+	Measurement string
+	// Metadata are the incoming metadata keys the server interceptors report,
+	// e.g. x-tenant-id as a tag and x-request-id as a field. Credentials such
+	// as authorization are reported as "redacted".
+	Metadata []MetadataCapture
+	// Gateway marks the client interceptor as that of a gateway translating
+	// HTTP requests into the calls it makes, e.g. grpc-gateway: its points,
+	// the points of the HTTP requests and those of the backend are tagged
+	// with their hop, gateway or backend.
+	Gateway bool
 }
 
-func MetricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	start := time.Now()
-	resp, err := handler(ctx, req)
-	duration := time.Since(start)
-	// Measure request and response size (assuming they can be converted to string)
-	reqSize := proto.Size(req.(proto.Message))
-	respSize := 0
-	if resp != nil {
-		respSize = proto.Size(resp.(proto.Message))
-	}
-
-	// Get method name
-	methodName := info.FullMethod
-	//statusCode := status.Code(err).String()
-
-	// Extract peer information
-	p, ok := peer.FromContext(ctx)
-	ipAddress := ""
-	if ok && p.Addr != net.Addr(nil) {
-		host, _, err := net.SplitHostPort(p.Addr.String())
-		if err == nil {
-			ipAddress = host
-		} else {
-			log.Fatalf("Error while parsing peer address: %v", err)
+// Metrics is the point sent to the registry, the same type as the
+// instrumentation package's.
+//
+// Deprecated: use instrumentation.Metrics, or Point in
+// github.com/jculley01/observability-module/v2/instrumentation.
+type Metrics = instrumentation.Metrics
+
+// NewMetricsInterceptor returns a unary server interceptor reporting each RPC
+// to the registry of cfg, with its duration, message sizes, peer address and
+// user agent, its status in the grpc_status and status_code tags, and its
+// deadline.
+func NewMetricsInterceptor(cfg Config) grpc.UnaryServerInterceptor {
+	if cfg.RegistryURL == "" {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			return handler(ctx, req)
 		}
 	}
+	captures := normalizeMetadataCaptures(cfg.Metadata)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		duration := time.Since(start)
+		// Measure request and response size, 0 for messages of other codecs
+		reqSize := messageSize(req)
+		respSize := messageSize(resp)
+
+		// Get method name
+		methodName := info.FullMethod
+
+		// Extract peer information
+		p, ok := peer.FromContext(ctx)
+		ipAddress := ""
+		if ok && p.Addr != net.Addr(nil) {
+			host, _, err := net.SplitHostPort(p.Addr.String())
+			if err == nil {
+				ipAddress = host
+			} else {
+				log.Printf("observability: parsing peer address: %v", err)
+			}
+		}
 
-	// Increment request count
-	requestCount := 1
+		// Increment request count
+		requestCount := 1
 
-	// Error rate
-	errorRate := 0
-	if err != nil {
-		errorRate = 1
-	}
+		// Error rate
+		errorRate := 0
+		if err != nil {
+			errorRate = 1
+		}
 
-	// Extract metadata from context
-	md, ok := metadata.FromIncomingContext(ctx)
-	userAgent := ""
-	if ok {
-		// Metadata keys are normalized to lowercase
-		if ua, exists := md["user-agent"]; exists && len(ua) > 0 {
-			userAgent = ua[0]
+		// Extract metadata from context
+		md, ok := metadata.FromIncomingContext(ctx)
+		userAgent := ""
+		if ok {
+			// Metadata keys are normalized to lowercase
+			if ua, exists := md["user-agent"]; exists && len(ua) > 0 {
+				userAgent = ua[0]
+			}
 		}
-	}
 
-	metrics := Metrics{
-		InfluxDBURL: serverURL,
-		Token:       influxDBToken,
-		Org:         influxDBOrg,
-		Bucket:      influxDBBucket,
-		Measurement: "Student-Info gRPC Service",
-		Tags:        map[string]string{"endpoint": methodName, "ip_address": ipAddress, "user_agent": userAgent},
-		Fields: map[string]interface{}{
-			"duration":      duration.Seconds(),
-			"error":         err != nil,
-			"request_size":  reqSize,
-			"response_size": respSize,
-			"request_count": requestCount,
-			"error_rate":    errorRate,
-		},
+		metrics := Metrics{
+			Measurement: cfg.Measurement,
+			Tags:        map[string]string{"endpoint": methodName, "ip_address": ipAddress, "user_agent": userAgent, "service_type": string(registration.GRPC)},
+			Fields: map[string]interface{}{
+				"duration":      duration.Seconds(),
+				"request_size":  reqSize,
+				"response_size": respSize,
+				"request_count": requestCount,
+				"error_rate":    errorRate,
+			},
+		}
+		incomingCorrelation(ctx, metrics.Tags, metrics.Fields)
+		captureMetadata(ctx, captures, metrics.Tags, metrics.Fields)
+		code := statusCode(err)
+		countStatus(metrics.Tags, metrics.Fields, methodName, code)
+		deadlineFields(ctx, start, code, metrics.Fields)
+
+		// The RPC ends as the handler ended it, whether or not it was reported
+		if metricsErr := sendMetrics(cfg, metrics); metricsErr != nil {
+			log.Printf("observability: sending metrics: %v", metricsErr)
+		}
+		return resp, err
 	}
+}
 
-	//fmt.Printf("metrics %v", metrics)
+// DefaultConfig is where MetricsInterceptor reports. It is read once, by the
+// first RPC MetricsInterceptor intercepts, so set it before serving; without
+// a RegistryURL, MetricsInterceptor reports nothing.
+var DefaultConfig Config
 
-	metricsErr := sendMetrics(metrics, "wss://centralreg-necuf5ddgq-ue.a.run.app/metrics")
-	if metricsErr != nil {
-		fmt.Printf("%v", metricsErr)
-		return nil, metricsErr
-	}
+var (
+	defaultInterceptor     grpc.UnaryServerInterceptor
+	defaultInterceptorOnce sync.Once
+)
 
-	// Record metrics to InfluxDB (or print to console, log, etc.)
-	//writeMetrics(duration, err, reqSize, respSize, methodName, statusCode, requestCount, errorRate, ipAddress, userAgent)
-	return resp, err
+// MetricsInterceptor is a unary server interceptor reporting each RPC like
+// NewMetricsInterceptor does, to DefaultConfig.
+//
+// Deprecated: use NewMetricsInterceptor, which takes the Config to report to.
+func MetricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	defaultInterceptorOnce.Do(func() {
+		defaultInterceptor = NewMetricsInterceptor(DefaultConfig)
+	})
+	return defaultInterceptor(ctx, req, info, handler)
 }
 
-func writeMetrics(duration time.Duration, err error, reqSize, respSize int, methodName, statusCode string, requestCount, errorRate int, ipAddress, userAgent string) {
-	// Create a new InfluxDB client
-	client := influxdb2.NewClient(serverURL, influxDBToken)
-	defer client.Close()
-
-	// Create a write API (this can be reused)
-	writeAPI := client.WriteAPI(influxDBOrg, influxDBBucket)
-
-	// Create a point to write (measurement name is "gRPCMetrics")
-	point := influxdb2.NewPoint(
-		"gRPCMetrics",
-		map[string]string{"endpoint": methodName, "ip_address": ipAddress, "user_agent": userAgent},
-		map[string]interface{}{
-			"duration":      duration.Seconds(),
-			"error":         err != nil,
-			"request_size":  reqSize,
-			"response_size": respSize,
-			"request_count": requestCount,
-			"error_rate":    errorRate,
-		},
-		time.Now(),
-	)
-
-	// Write the point
-	writeAPI.WritePoint(point)
-
-	// Ensure data is written
-	writeAPI.Flush()
+// registryClients holds a client per registry, so that RPCs share a
+// connection rather than dialing one each.
+var registryClients sync.Map
+
+// registry is the part of a Config its registry connection depends on.
+type registry struct {
+	url, influxDBURL, token, org, bucket string
 }
 
-func sendMetrics(metrics Metrics, centralRegisterWSURL string) error {
-	// Serialize the Metrics struct into JSON
-	jsonData, err := json.Marshal(metrics)
-	if err != nil {
-		return err
-	}
+func (cfg Config) registry() registry {
+	return registry{url: cfg.RegistryURL, influxDBURL: cfg.InfluxDBURL, token: cfg.Token, org: cfg.Org, bucket: cfg.Bucket}
+}
 
-	// Connect to the WebSocket server
-	c, _, err := websocket.DefaultDialer.Dial(centralRegisterWSURL, nil)
-	if err != nil {
-		log.Println("dial:", err)
-		return err
-	}
-	defer c.Close()
+// session is the session written first on every registry connection, so the
+// points themselves don't carry the InfluxDB credentials.
+func (r registry) session() ([]byte, error) {
+	return protocol.EncodeSession(protocol.Session{InfluxDBURL: r.influxDBURL, Token: r.token, Org: r.org, Bucket: r.bucket})
+}
 
-	// Send the JSON data to the WebSocket server
-	err = c.WriteMessage(websocket.TextMessage, jsonData)
-	if err != nil {
-		log.Println("write:", err)
-		return err
+func sendMetrics(cfg Config, metrics Metrics) error {
+	r := cfg.registry()
+	client, ok := registryClients.Load(r)
+	if !ok {
+		client, _ = registryClients.LoadOrStore(r, transport.NewClient(transport.Config{URL: r.url, Session: r.session}))
 	}
-
-	return nil
+	return client.(*transport.Client).SendJSON(metrics)
 }
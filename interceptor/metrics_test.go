@@ -0,0 +1,111 @@
+package interceptor
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/jculley01/observability-module/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRegistry returns the metrics URL of a registry passing on the frames
+// it reads.
+func fakeRegistry(t *testing.T) (url string, frames chan []byte) {
+	frames = make(chan []byte, 16)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			frames <- data
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/metrics", frames
+}
+
+func nextFrame(t *testing.T, frames chan []byte) []byte {
+	t.Helper()
+	select {
+	case data := <-frames:
+		return data
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame received")
+		return nil
+	}
+}
+
+func TestNewMetricsInterceptor(t *testing.T) {
+	registryURL, frames := fakeRegistry(t)
+	cfg := Config{RegistryURL: registryURL, InfluxDBURL: "http://influxdb:8086", Token: "secret", Org: "acme", Bucket: "grpc", Measurement: "orders",
+		Metadata: []MetadataCapture{{Key: "x-tenant-id"}}}
+	intercept := NewMetricsInterceptor(cfg)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant-id", "acme"))
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := intercept(ctx, wrapperspb.String("order-1"), &grpc.UnaryServerInfo{FullMethod: "/acme.Orders/Get"}, handler); err != context.DeadlineExceeded {
+		t.Fatalf("interceptor returned %v, want the handler's error", err)
+	}
+
+	session, ok := protocol.DecodeSession(nextFrame(t, frames))
+	if !ok || session.InfluxDBURL != cfg.InfluxDBURL || session.Token != "secret" || session.Org != "acme" || session.Bucket != "grpc" {
+		t.Errorf("session = %+v, %v, want the InfluxDB destination of the config", session, ok)
+	}
+	points, err := protocol.DecodeFrame(nextFrame(t, frames))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point := points[0]; point.Measurement != "orders" || point.Tags["endpoint"] != "/acme.Orders/Get" || point.Tags["status_code"] != "DeadlineExceeded" || point.Tags["grpc_status"] != "4" || point.Tags["x_tenant_id"] != "acme" || point.Token != "" {
+		t.Errorf("point = %+v, want a DeadlineExceeded orders point of the tenant without credentials", point)
+	}
+	if point := points[0]; point.Fields["deadline_set"] != true || point.Fields["deadline_exceeded"] != true || point.Fields["deadline_remaining_ms"] == nil {
+		t.Errorf("fields = %v, want the deadline and that it was exceeded", point.Fields)
+	}
+}
+
+func TestMetricsInterceptorKeepsRPCOutcome(t *testing.T) {
+	// Nothing listens on the registry, the messages aren't protobuf and the
+	// peer address has no port: the RPC is answered all the same
+	intercept := NewMetricsInterceptor(Config{RegistryURL: "ws://127.0.0.1:1/metrics", Measurement: "orders"})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "order-1", nil
+	}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.UnixAddr{Name: "/run/orders.sock", Net: "unix"}})
+	resp, err := intercept(ctx, "get order-1", &grpc.UnaryServerInfo{FullMethod: "/acme.Orders/Get"}, handler)
+	if resp != "order-1" || err != nil {
+		t.Errorf("interceptor returned %v, %v, want the handler's response", resp, err)
+	}
+}
+
+func TestMetricsInterceptorWithoutRegistry(t *testing.T) {
+	intercept := NewMetricsInterceptor(Config{Measurement: "orders"})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "order-1", nil
+	}
+	resp, err := intercept(context.Background(), "get order-1", &grpc.UnaryServerInfo{FullMethod: "/acme.Orders/Get"}, handler)
+	if resp != "order-1" || err != nil {
+		t.Errorf("interceptor returned %v, %v, want the handler's response", resp, err)
+	}
+	if _, ok := registryClients.Load(registry{}); ok {
+		t.Error("a registry client was created without a RegistryURL")
+	}
+}
@@ -0,0 +1,58 @@
+package interceptor
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// statusCounts holds an *atomic.Int64 per statusKey.
+var statusCounts sync.Map
+
+type statusKey struct {
+	endpoint string
+	code     codes.Code
+}
+
+// statusCode returns the status an RPC ending with err is reported with:
+// that of a status error, or, as gRPC servers do, DeadlineExceeded or
+// Canceled for context errors and Unknown for the rest.
+func statusCode(err error) codes.Code {
+	if s, ok := status.FromError(err); ok {
+		return s.Code()
+	}
+	return status.FromContextError(err).Code()
+}
+
+// incrementStatusCount counts an RPC of an endpoint that ended with a status
+// code, returning the count.
+func incrementStatusCount(endpoint string, code codes.Code) int64 {
+	val, ok := statusCounts.Load(statusKey{endpoint, code})
+	if !ok {
+		val, _ = statusCounts.LoadOrStore(statusKey{endpoint, code}, new(atomic.Int64))
+	}
+	return val.(*atomic.Int64).Add(1)
+}
+
+// getStatusCount retrieves the count of RPCs of an endpoint that ended with
+// a status code.
+func getStatusCount(endpoint string, code codes.Code) int64 {
+	val, _ := statusCounts.Load(statusKey{endpoint, code})
+	if val == nil {
+		return 0
+	}
+	return val.(*atomic.Int64).Load()
+}
+
+// countStatus counts an RPC of endpoint under its status code, which it tags
+// by name in status_code, e.g. NotFound, and by number in grpc_status, and
+// adds the count of the RPCs of endpoint that ended with that code to its
+// fields as status_code_count. Codes are a fixed set of 17, so the tags stay
+// bounded.
+func countStatus(tags map[string]string, fields map[string]interface{}, endpoint string, code codes.Code) {
+	tags["status_code"] = code.String()
+	tags["grpc_status"] = strconv.Itoa(int(code))
+	fields["status_code_count"] = incrementStatusCount(endpoint, code)
+}
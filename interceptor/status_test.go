@@ -0,0 +1,62 @@
+package interceptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"testing"
+)
+
+func TestStatusCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want codes.Code
+	}{
+		{nil, codes.OK},
+		{status.Error(codes.NotFound, "no such order"), codes.NotFound},
+		{fmt.Errorf("loading the order: %w", status.Error(codes.Internal, "disk full")), codes.Internal},
+		{context.DeadlineExceeded, codes.DeadlineExceeded},
+		{context.Canceled, codes.Canceled},
+		{errors.New("boom"), codes.Unknown},
+	} {
+		if got := statusCode(c.err); got != c.want {
+			t.Errorf("statusCode(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestCountStatus(t *testing.T) {
+	before := getStatusCount("/acme.Orders/Get", codes.NotFound)
+	for i := 0; i < 2; i++ {
+		countStatus(map[string]string{}, map[string]interface{}{}, "/acme.Orders/Get", codes.NotFound)
+	}
+	tags, fields := map[string]string{}, map[string]interface{}{}
+	countStatus(tags, fields, "/acme.Orders/Get", codes.OK)
+	if tags["status_code"] != "OK" || fields["status_code_count"] != getStatusCount("/acme.Orders/Get", codes.OK) {
+		t.Errorf("tags, fields = %v, %v, want the OK status and its count", tags, fields)
+	}
+	if got := getStatusCount("/acme.Orders/Get", codes.NotFound) - before; got != 2 {
+		t.Errorf("counted %d NotFound RPCs, want 2", got)
+	}
+}
+
+func TestCountStatusConcurrently(t *testing.T) {
+	before := getStatusCount("/acme.Orders/List", codes.OK)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				countStatus(map[string]string{}, map[string]interface{}{}, "/acme.Orders/List", codes.OK)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := getStatusCount("/acme.Orders/List", codes.OK) - before; got != 1000 {
+		t.Errorf("counted %d RPCs, want 1000", got)
+	}
+}
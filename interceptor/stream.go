@@ -0,0 +1,184 @@
+package interceptor
+
+import (
+	"github.com/jculley01/observability-module/registration"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// messageSizeBuckets are the upper bounds, in bytes, of the message size
+// histograms of a stream.
+var messageSizeBuckets = []int{256, 1024, 16 << 10, 256 << 10, 1 << 20}
+
+// NewStreamMetricsInterceptor returns a stream server interceptor reporting
+// each streaming RPC to the registry of cfg once it ends: its duration, its
+// final status in the grpc_status and status_code tags and whether the client,
+// the server or both stream in stream_type; its deadline; how long it took
+// until the first message was sent (time_to_first_message_ms); and per
+// direction the messages and bytes, the message size histogram and the average
+// and largest gaps between messages, for long-lived streams.
+func NewStreamMetricsInterceptor(cfg Config) grpc.StreamServerInterceptor {
+	if cfg.RegistryURL == "" {
+		return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return handler(srv, ss)
+		}
+	}
+	captures := normalizeMetadataCaptures(cfg.Metadata)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		stream := newMonitoredStream(ss)
+		err := handler(srv, stream)
+		duration := time.Since(stream.start)
+
+		code := statusCode(err)
+		fields := map[string]interface{}{
+			"duration": duration.Seconds(),
+		}
+		stream.addFields(fields)
+		metrics := Metrics{
+			Measurement: cfg.Measurement,
+			Tags: map[string]string{
+				"endpoint":     info.FullMethod,
+				"rpc_type":     "stream",
+				"stream_type":  streamType(info),
+				"service_type": string(registration.GRPC),
+			},
+			Fields: fields,
+		}
+		incomingCorrelation(ss.Context(), metrics.Tags, metrics.Fields)
+		captureMetadata(ss.Context(), captures, metrics.Tags, metrics.Fields)
+		countStatus(metrics.Tags, metrics.Fields, info.FullMethod, code)
+		deadlineFields(ss.Context(), stream.start, code, metrics.Fields)
+		if metricsErr := sendMetrics(cfg, metrics); metricsErr != nil {
+			log.Printf("observability: sending stream metrics: %v", metricsErr)
+		}
+		return err
+	}
+}
+
+// streamType names who streams in an RPC: client_stream, server_stream or
+// bidi_stream.
+func streamType(info *grpc.StreamServerInfo) string {
+	switch {
+	case info.IsClientStream && info.IsServerStream:
+		return "bidi_stream"
+	case info.IsClientStream:
+		return "client_stream"
+	default:
+		return "server_stream"
+	}
+}
+
+// monitoredStream is a grpc.ServerStream keeping per-message statistics.
+type monitoredStream struct {
+	grpc.ServerStream
+	start time.Time
+
+	mu sync.Mutex
+	// firstSent is when the first message was sent, zero until then
+	firstSent time.Time
+	sent      messageStats
+	received  messageStats
+}
+
+// messageStats are the statistics of the messages of one direction.
+type messageStats struct {
+	count       int
+	bytes       int
+	sizeBuckets []int
+	last        time.Time
+	totalGap    time.Duration
+	maxGap      time.Duration
+}
+
+func newMonitoredStream(ss grpc.ServerStream) *monitoredStream {
+	return &monitoredStream{
+		ServerStream: ss,
+		start:        time.Now(),
+		sent:         messageStats{sizeBuckets: make([]int, len(messageSizeBuckets)+1)},
+		received:     messageStats{sizeBuckets: make([]int, len(messageSizeBuckets)+1)},
+	}
+}
+
+func (s *monitoredStream) SendMsg(m interface{}) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.firstSent.IsZero() {
+		s.firstSent = now
+	}
+	s.sent.add(messageSize(m), now)
+	return nil
+}
+
+func (s *monitoredStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received.add(messageSize(m), now)
+	return nil
+}
+
+// add counts a message of size bytes handled at now.
+func (st *messageStats) add(size int, now time.Time) {
+	if st.count > 0 {
+		gap := now.Sub(st.last)
+		st.totalGap += gap
+		st.maxGap = max(st.maxGap, gap)
+	}
+	st.count++
+	st.bytes += size
+	st.last = now
+	bucket := len(messageSizeBuckets)
+	for i, bound := range messageSizeBuckets {
+		if size <= bound {
+			bucket = i
+			break
+		}
+	}
+	st.sizeBuckets[bucket]++
+}
+
+// addFields adds the statistics of both directions to fields.
+func (s *monitoredStream) addFields(fields map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.firstSent.IsZero() {
+		fields["time_to_first_message_ms"] = s.firstSent.Sub(s.start).Milliseconds()
+	}
+	for direction, st := range map[string]*messageStats{"sent": &s.sent, "received": &s.received} {
+		fields["messages_"+direction] = st.count
+		fields["bytes_"+direction] = st.bytes
+		// Cumulative, like Prometheus "le" buckets
+		cumulative := 0
+		for i, count := range st.sizeBuckets {
+			cumulative += count
+			le := "inf"
+			if i < len(messageSizeBuckets) {
+				le = strconv.Itoa(messageSizeBuckets[i])
+			}
+			fields[direction+"_size_bucket_le_"+le] = cumulative
+		}
+		if st.count > 1 {
+			fields[direction+"_gap_avg_ms"] = (st.totalGap / time.Duration(st.count-1)).Milliseconds()
+			fields[direction+"_gap_max_ms"] = st.maxGap.Milliseconds()
+		}
+	}
+}
+
+// messageSize returns the encoded size of a protobuf message, 0 for others.
+func messageSize(m interface{}) int {
+	if msg, ok := m.(proto.Message); ok {
+		return proto.Size(msg)
+	}
+	return 0
+}
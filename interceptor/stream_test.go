@@ -0,0 +1,118 @@
+package interceptor
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jculley01/observability-module/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"testing"
+	"time"
+)
+
+// fakeStream receives and sends messages without a connection.
+type fakeStream struct {
+	grpc.ServerStream
+}
+
+func (fakeStream) SendMsg(interface{}) error { return nil }
+func (fakeStream) RecvMsg(interface{}) error { return nil }
+func (fakeStream) Context() context.Context  { return context.Background() }
+
+func TestMonitoredStreamCountsMessages(t *testing.T) {
+	stream := newMonitoredStream(fakeStream{})
+	small := wrapperspb.String("hi")
+	large := wrapperspb.Bytes(make([]byte, 2048))
+	for _, m := range []proto.Message{small, large} {
+		if err := stream.SendMsg(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.RecvMsg(small); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := map[string]interface{}{}
+	stream.addFields(fields)
+	want := map[string]interface{}{
+		"messages_sent":               2,
+		"bytes_sent":                  proto.Size(small) + proto.Size(large),
+		"sent_size_bucket_le_256":     1,
+		"sent_size_bucket_le_1024":    1,
+		"sent_size_bucket_le_16384":   2,
+		"sent_size_bucket_le_inf":     2,
+		"messages_received":           1,
+		"received_size_bucket_le_inf": 1,
+	}
+	for field, value := range want {
+		if fields[field] != value {
+			t.Errorf("%s = %v, want %v", field, fields[field], value)
+		}
+	}
+	if _, ok := fields["time_to_first_message_ms"]; !ok {
+		t.Error("time_to_first_message_ms is missing")
+	}
+	if _, ok := fields["received_gap_max_ms"]; ok {
+		t.Error("a gap is reported for a single message")
+	}
+}
+
+func TestMessageStatsGaps(t *testing.T) {
+	st := messageStats{sizeBuckets: make([]int, len(messageSizeBuckets)+1)}
+	start := time.Date(2026, 3, 10, 14, 0, 0, 0, time.UTC)
+	for _, offset := range []time.Duration{0, time.Second, 4 * time.Second} {
+		st.add(10, start.Add(offset))
+	}
+	if st.maxGap != 3*time.Second || st.totalGap != 4*time.Second {
+		t.Errorf("max gap, total gap = %v, %v, want 3s, 4s", st.maxGap, st.totalGap)
+	}
+}
+
+func TestNewStreamMetricsInterceptor(t *testing.T) {
+	registryURL, frames := fakeRegistry(t)
+	intercept := NewStreamMetricsInterceptor(Config{RegistryURL: registryURL, Measurement: "orders"})
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		if err := stream.RecvMsg(wrapperspb.String("order-1")); err != nil {
+			return err
+		}
+		if err := stream.SendMsg(wrapperspb.String("ok")); err != nil {
+			return err
+		}
+		return status.Error(codes.NotFound, "no such order")
+	}
+	info := &grpc.StreamServerInfo{FullMethod: "/acme.Orders/Watch", IsClientStream: true, IsServerStream: true}
+	if err := intercept(nil, fakeStream{}, info, handler); status.Code(err) != codes.NotFound {
+		t.Fatalf("interceptor returned %v, want the handler's error", err)
+	}
+
+	nextFrame(t, frames)
+	points, err := protocol.DecodeFrame(nextFrame(t, frames))
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := points[0]
+	if point.Tags["stream_type"] != "bidi_stream" || point.Tags["grpc_status"] != "5" || point.Tags["status_code"] != "NotFound" || point.Tags["endpoint"] != "/acme.Orders/Watch" {
+		t.Errorf("tags = %v, want a bidi stream ending NOT_FOUND", point.Tags)
+	}
+	if point.Fields["messages_sent"] != json.Number("1") || point.Fields["messages_received"] != json.Number("1") || point.Fields["status_code_count"] == nil {
+		t.Errorf("fields = %v, want one message each way and the count of the status", point.Fields)
+	}
+}
+
+func TestStreamType(t *testing.T) {
+	for _, c := range []struct {
+		info grpc.StreamServerInfo
+		want string
+	}{
+		{grpc.StreamServerInfo{IsServerStream: true}, "server_stream"},
+		{grpc.StreamServerInfo{IsClientStream: true}, "client_stream"},
+		{grpc.StreamServerInfo{IsClientStream: true, IsServerStream: true}, "bidi_stream"},
+	} {
+		if got := streamType(&c.info); got != c.want {
+			t.Errorf("streamType(%+v) = %s, want %s", c.info, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package parserimport
+
+import (
+	"github.com/jculley01/observability-module/protocol"
+	"strings"
+)
+
+// Route is a route registered with a router at run time, as listed by
+// instrumentation.Routes.
+type Route = protocol.Route
+
+// Reconciliation is the report of Reconcile.
+type Reconciliation = protocol.RouteReconciliation
+
+// Reconcile compares the endpoints parsed from a service's source with the
+// routes its router serves. Patterns match whatever the parameter syntax of
+// the framework (":id", "{id}", "*path"), and endpoints parsed without a
+// method (net/http and Gorilla Mux handlers) match any method.
+func Reconcile(endpoints []Endpoint, routes []Route) Reconciliation {
+	report := Reconciliation{Matched: []Route{}, StaticOnly: []Route{}, RuntimeOnly: []Route{}}
+	used := make([]bool, len(endpoints))
+	for _, route := range routes {
+		matched := false
+		for i, endpoint := range endpoints {
+			if !endpointMatches(endpoint, route) {
+				continue
+			}
+			route.Handler = endpoint.Handler
+			used[i], matched = true, true
+			break
+		}
+		if matched {
+			report.Matched = append(report.Matched, route)
+		} else {
+			report.RuntimeOnly = append(report.RuntimeOnly, route)
+		}
+	}
+	for i, endpoint := range endpoints {
+		if !used[i] {
+			report.StaticOnly = append(report.StaticOnly, Route{Method: endpointMethod(endpoint), Pattern: endpoint.Pattern, Handler: endpoint.Handler})
+		}
+	}
+	return report
+}
+
+func endpointMatches(endpoint Endpoint, route Route) bool {
+	method := endpointMethod(endpoint)
+	if method != "" && route.Method != "" && !strings.EqualFold(method, route.Method) {
+		return false
+	}
+	return normalizePattern(endpoint.Pattern) == normalizePattern(route.Pattern)
+}
+
+// endpointMethod returns the method of a parsed endpoint, "" for the
+// handlers registered for any method.
+func endpointMethod(endpoint Endpoint) string {
+	switch endpoint.Method {
+	case "ALL", "CUSTOM":
+		return ""
+	}
+	return strings.ToUpper(endpoint.Method)
+}
+
+// normalizePattern replaces the parameters of a path pattern with "{}" and
+// drops its trailing slash, so patterns compare across frameworks.
+func normalizePattern(pattern string) string {
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") ||
+			(strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")) {
+			segments[i] = "{}"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,44 @@
+package parserimport
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	endpoints := []Endpoint{
+		{Method: "GET", Pattern: "/users/:id", Handler: "getUser"},
+		{Method: "Post", Pattern: "/users", Handler: "createUser"},
+		{Method: "ALL", Pattern: "/health", Handler: "health"},
+		{Method: "DELETE", Pattern: "/legacy", Handler: "legacy"},
+	}
+	routes := []Route{
+		{Method: "GET", Pattern: "/users/{id}", Handler: "main.getUser"},
+		{Method: "POST", Pattern: "/users/", Handler: "main.createUser"},
+		{Method: "GET", Pattern: "/health"},
+		{Method: "HEAD", Pattern: "/health"},
+		{Method: "GET", Pattern: "/debug/pprof/*path"},
+	}
+
+	report := Reconcile(endpoints, routes)
+	want := Reconciliation{
+		Matched: []Route{
+			{Method: "GET", Pattern: "/users/{id}", Handler: "getUser"},
+			{Method: "POST", Pattern: "/users/", Handler: "createUser"},
+			{Method: "GET", Pattern: "/health", Handler: "health"},
+			{Method: "HEAD", Pattern: "/health", Handler: "health"},
+		},
+		StaticOnly:  []Route{{Method: "DELETE", Pattern: "/legacy", Handler: "legacy"}},
+		RuntimeOnly: []Route{{Method: "GET", Pattern: "/debug/pprof/*path"}},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("Reconcile = %+v\nwant %+v", report, want)
+	}
+	if !report.HasDrift() {
+		t.Error("HasDrift = false")
+	}
+
+	if report := Reconcile(endpoints[:1], routes[:1]); report.HasDrift() || report.StaticOnly == nil || report.RuntimeOnly == nil {
+		t.Errorf("Reconcile of matching routes = %+v, want no drift and empty lists", report)
+	}
+}
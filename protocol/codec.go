@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// Codec encodes the points of metrics frames. JSON, Protobuf, MessagePack and
+// LineProtocol are built in; RegisterCodec adds others.
+type Codec interface {
+	// Name identifies the codec, in the Session's Encoding among others.
+	Name() string
+	// Binary reports whether the frames are binary rather than text.
+	Binary() bool
+	Encode(points []Point) ([]byte, error)
+	Decode(data []byte) ([]Point, error)
+}
+
+// Built-in codecs.
+var (
+	// JSON writes a point as a JSON object and several as an array; see
+	// EncodePoint, EncodeBatch and DecodeFrame.
+	JSON Codec = jsonCodec{}
+	// Protobuf writes Frame messages of schema/frame.proto; see
+	// EncodeBinaryFrame.
+	Protobuf Codec = protobufCodec{}
+	// MessagePack writes an array of maps with the properties of
+	// point.schema.json; see EncodeMessagePackFrame.
+	MessagePack Codec = messagePackCodec{}
+	// LineProtocol writes lines of InfluxDB line protocol, for registries to
+	// forward as they are; see AppendLine. Its points take their destination
+	// from the Session.
+	LineProtocol Codec = lineProtocolCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	for _, c := range []Codec{JSON, Protobuf, MessagePack, LineProtocol} {
+		codecs[c.Name()] = c
+	}
+}
+
+// RegisterCodec makes a codec available to LookupCodec under its name,
+// replacing any registered under the same one.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// LookupCodec returns the codec registered under name.
+func LookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+func (jsonCodec) Binary() bool { return false }
+
+func (jsonCodec) Encode(points []Point) ([]byte, error) {
+	if len(points) == 1 {
+		return EncodePoint(points[0])
+	}
+	return EncodeBatch(points)
+}
+
+func (jsonCodec) Decode(data []byte) ([]Point, error) { return DecodeFrame(data) }
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string                          { return "protobuf" }
+func (protobufCodec) Binary() bool                          { return true }
+func (protobufCodec) Encode(points []Point) ([]byte, error) { return EncodeBinaryFrame(points) }
+func (protobufCodec) Decode(data []byte) ([]Point, error)   { return DecodeBinaryFrame(data) }
+
+type messagePackCodec struct{}
+
+func (messagePackCodec) Name() string { return "msgpack" }
+func (messagePackCodec) Binary() bool { return true }
+
+func (messagePackCodec) Encode(points []Point) ([]byte, error) {
+	return EncodeMessagePackFrame(points)
+}
+
+func (messagePackCodec) Decode(data []byte) ([]Point, error) {
+	return DecodeMessagePackFrame(data)
+}
+
+type lineProtocolCodec struct{}
+
+func (lineProtocolCodec) Name() string                          { return "line" }
+func (lineProtocolCodec) Binary() bool                          { return false }
+func (lineProtocolCodec) Encode(points []Point) ([]byte, error) { return EncodeLineProtocol(points) }
+func (lineProtocolCodec) Decode(data []byte) ([]Point, error)   { return DecodeLineProtocol(data) }
+
+// fieldValue returns a field value as an int64, a float64, a bool or a
+// string, or as a uint64 beyond the int64 range, for the binary codecs.
+// Named types, such as time.Duration, are taken by their kind.
+func fieldValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case int64, float64, bool, string:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := rv.Uint(); u > math.MaxInt64 {
+			return u, nil
+		}
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.String:
+		return rv.String(), nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", v)
+}
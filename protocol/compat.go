@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"fmt"
+	"maps"
+)
+
+// SchemaVersion is the version of the point payload this package reads and
+// writes. Version 1 is the payload of agents and registries predating
+// versioning, which is what points of a session without a schema_version, or
+// of no session at all, are.
+const SchemaVersion = 1
+
+// Migration is a change of the point payload: how points of schema version
+// Version-1 become points of Version, and back. Renames apply first on the
+// way up and last on the way down, so Upgrade and Downgrade see the names of
+// Version.
+type Migration struct {
+	// Version is the schema version the migration upgrades to.
+	Version int
+	// RenameTags maps the tags renamed in Version from their old names to
+	// their new ones.
+	RenameTags map[string]string
+	// RenameFields maps the fields renamed in Version likewise.
+	RenameFields map[string]string
+	// Upgrade and Downgrade, when set, make the changes renames can't, e.g.
+	// filling a new field in or folding it back into an old one.
+	Upgrade   func(*Point)
+	Downgrade func(*Point)
+}
+
+// migrations are the changes of the point payload, in order: migrations[i]
+// upgrades to version i+2. Bump SchemaVersion along with adding one.
+var migrations []Migration
+
+// UpgradePoints returns points of schema version from as points of
+// SchemaVersion, for registries reading agents older than themselves; see
+// Session.Version. Versions newer than SchemaVersion are an error, as the
+// registry can't know what changed in them.
+func UpgradePoints(points []Point, from int) ([]Point, error) {
+	return migrate(migrations, points, from, SchemaVersion)
+}
+
+// DowngradePoints returns points of SchemaVersion as points of schema version
+// to, for agents writing to registries older than themselves.
+func DowngradePoints(points []Point, to int) ([]Point, error) {
+	return migrate(migrations, points, SchemaVersion, to)
+}
+
+// migrate returns points of version from as points of version to, through
+// each of the migrations in between. The points passed are left as they are.
+func migrate(migrations []Migration, points []Point, from, to int) ([]Point, error) {
+	latest := len(migrations) + 1
+	for _, version := range []int{from, to} {
+		if version < 1 || version > latest {
+			return nil, fmt.Errorf("unsupported schema version %d, want 1 to %d", version, latest)
+		}
+	}
+	if from == to {
+		return points, nil
+	}
+	migrated := make([]Point, len(points))
+	copy(migrated, points)
+	for i := range migrated {
+		p := &migrated[i]
+		p.Tags, p.Fields = maps.Clone(p.Tags), maps.Clone(p.Fields)
+		for version := from + 1; version <= to; version++ {
+			m := migrations[version-2]
+			p.Tags = renameKeys(p.Tags, m.RenameTags)
+			p.Fields = renameKeys(p.Fields, m.RenameFields)
+			if m.Upgrade != nil {
+				m.Upgrade(p)
+			}
+		}
+		for version := from; version > to; version-- {
+			m := migrations[version-2]
+			if m.Downgrade != nil {
+				m.Downgrade(p)
+			}
+			p.Tags = renameKeys(p.Tags, reverse(m.RenameTags))
+			p.Fields = renameKeys(p.Fields, reverse(m.RenameFields))
+		}
+	}
+	return migrated, nil
+}
+
+// renameKeys returns values with the keys of renames renamed.
+func renameKeys[V any](values map[string]V, renames map[string]string) map[string]V {
+	if len(values) == 0 || len(renames) == 0 {
+		return values
+	}
+	renamed := make(map[string]V, len(values))
+	for key, value := range values {
+		if to, ok := renames[key]; ok {
+			key = to
+		}
+		renamed[key] = value
+	}
+	return renamed
+}
+
+func reverse(renames map[string]string) map[string]string {
+	reversed := make(map[string]string, len(renames))
+	for from, to := range renames {
+		reversed[to] = from
+	}
+	return reversed
+}
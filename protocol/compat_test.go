@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	testMigrations := []Migration{
+		{Version: 2, RenameTags: map[string]string{"service": "service_name"}},
+		{
+			Version:      3,
+			RenameFields: map[string]string{"latency": "latency_ms"},
+			Upgrade: func(p *Point) {
+				p.Fields["latency_ms"] = p.Fields["latency_ms"].(float64) * 1000
+			},
+			Downgrade: func(p *Point) {
+				p.Fields["latency_ms"] = p.Fields["latency_ms"].(float64) / 1000
+			},
+		},
+	}
+	v1 := []Point{{Measurement: "orders", Tags: map[string]string{"service": "orders", "endpoint": "/orders"}, Fields: map[string]interface{}{"latency": 0.25}}}
+	upgraded, err := migrate(testMigrations, v1, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Point{Measurement: "orders", Tags: map[string]string{"service_name": "orders", "endpoint": "/orders"}, Fields: map[string]interface{}{"latency_ms": 250.0}}
+	if !reflect.DeepEqual(upgraded[0], want) {
+		t.Errorf("upgraded = %+v, want %+v", upgraded[0], want)
+	}
+	if _, ok := v1[0].Tags["service"]; !ok || v1[0].Fields["latency"] != 0.25 {
+		t.Errorf("upgrading changed the points passed: %+v", v1[0])
+	}
+
+	downgraded, err := migrate(testMigrations, upgraded, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(downgraded, v1) {
+		t.Errorf("downgraded = %+v, want %+v", downgraded, v1)
+	}
+	if partly, err := migrate(testMigrations, upgraded, 3, 2); err != nil || partly[0].Tags["service_name"] != "orders" || partly[0].Fields["latency"] != 0.25 {
+		t.Errorf("downgraded to 2 = %+v, %v", partly, err)
+	}
+
+	for _, version := range []int{0, 4} {
+		if _, err := migrate(testMigrations, v1, version, 3); err == nil {
+			t.Errorf("version %d accepted", version)
+		}
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	if len(migrations)+1 != SchemaVersion {
+		t.Errorf("%d migrations for schema version %d", len(migrations), SchemaVersion)
+	}
+	for i, m := range migrations {
+		if m.Version != i+2 {
+			t.Errorf("migration %d upgrades to version %d, want %d", i, m.Version, i+2)
+		}
+	}
+	if v := (Session{}).Version(); v != 1 {
+		t.Errorf("version of an unversioned session = %d, want 1", v)
+	}
+	if _, err := UpgradePoints(nil, SchemaVersion+1); err == nil {
+		t.Error("UpgradePoints accepted a version newer than SchemaVersion")
+	}
+	points := []Point{{Measurement: "orders"}}
+	if current, err := UpgradePoints(points, SchemaVersion); err != nil || !reflect.DeepEqual(current, points) {
+		t.Errorf("UpgradePoints(SchemaVersion) = %+v, %v", current, err)
+	}
+}
@@ -0,0 +1,18 @@
+package protocol
+
+// Headers and content types of the HTTP binding of the registry endpoints,
+// for agents behind proxies that block WebSocket upgrades. Such an agent
+// POSTs each frame it would have written on a connection, as it is, to the
+// endpoint's http:// or https:// URL: a text frame with ContentTypeText, a
+// binary one with ContentTypeBinary. With no connection for a Session to
+// apply to, every POST carries it in SessionHeader; with acknowledged
+// delivery, SequenceHeader carries a Sequence whose Next numbers the frame of
+// the POST. A 2xx answer acknowledges the frame, and its body, when there is
+// one, is a Control message.
+const (
+	SessionHeader  = "X-Observability-Session"
+	SequenceHeader = "X-Observability-Sequence"
+
+	ContentTypeText   = "text/plain; charset=utf-8"
+	ContentTypeBinary = "application/octet-stream"
+)
@@ -0,0 +1,279 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// AppendLine appends p to dst as a line of InfluxDB line protocol, without
+// the trailing newline, e.g.
+//
+//	orders,endpoint=/orders latency_ms=12.5,request_count=3i 1700000000000000000
+//
+// Tags are sorted, and those with empty values left out as InfluxDB has no
+// empty tags. The timestamp, if any, is converted to nanoseconds, InfluxDB's
+// default precision. Line protocol has no room for a destination, so points
+// naming one are rejected: it is the Session's, or the writer's.
+func AppendLine(dst []byte, p Point) ([]byte, error) {
+	if p.InfluxDBURL != "" || p.Token != "" || p.Org != "" || p.Bucket != "" {
+		return nil, errors.New("line protocol can't carry the destination of a point")
+	}
+	if p.Measurement == "" {
+		return nil, errors.New("point without a measurement")
+	}
+	if len(p.Fields) == 0 {
+		return nil, fmt.Errorf("point of %s without fields", p.Measurement)
+	}
+	if err := appendLineName(&dst, p.Measurement, measurementEscaper); err != nil {
+		return nil, err
+	}
+	for _, key := range sortedKeys(p.Tags) {
+		if p.Tags[key] == "" {
+			continue
+		}
+		dst = append(dst, ',')
+		if err := appendLineName(&dst, key, keyEscaper); err != nil {
+			return nil, err
+		}
+		dst = append(dst, '=')
+		if err := appendLineName(&dst, p.Tags[key], keyEscaper); err != nil {
+			return nil, err
+		}
+	}
+	for i, key := range sortedKeys(p.Fields) {
+		if i == 0 {
+			dst = append(dst, ' ')
+		} else {
+			dst = append(dst, ',')
+		}
+		if err := appendLineName(&dst, key, keyEscaper); err != nil {
+			return nil, err
+		}
+		dst = append(dst, '=')
+		v, err := fieldValue(p.Fields[key])
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", key, err)
+		}
+		switch v := v.(type) {
+		case int64:
+			dst = append(strconv.AppendInt(dst, v, 10), 'i')
+		case uint64:
+			dst = append(strconv.AppendUint(dst, v, 10), 'u')
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("field %s: %v can't be written", key, v)
+			}
+			dst = strconv.AppendFloat(dst, v, 'g', -1, 64)
+		case bool:
+			dst = strconv.AppendBool(dst, v)
+		default:
+			dst = append(dst, '"')
+			dst = append(dst, stringFieldEscaper.Replace(v.(string))...)
+			dst = append(dst, '"')
+		}
+	}
+	if p.Timestamp != 0 {
+		ns, err := nanoseconds(p.Timestamp, p.Precision)
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, ' ')
+		dst = strconv.AppendInt(dst, ns, 10)
+	}
+	return dst, nil
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	keyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+	stringFieldEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// appendLineName appends a measurement, tag or field key, or tag value,
+// escaped. Line protocol can't escape newlines in them.
+func appendLineName(dst *[]byte, s string, escaper *strings.Replacer) error {
+	if strings.ContainsAny(s, "\r\n") {
+		return fmt.Errorf("%q holds a newline", s)
+	}
+	*dst = append(*dst, escaper.Replace(s)...)
+	return nil
+}
+
+// nanoseconds converts a timestamp of precision to nanoseconds.
+func nanoseconds(timestamp int64, precision string) (int64, error) {
+	switch precision {
+	case PrecisionSeconds:
+		return timestamp * 1e9, nil
+	case PrecisionMilliseconds:
+		return timestamp * 1e6, nil
+	case PrecisionNanoseconds, "":
+		return timestamp, nil
+	}
+	return 0, fmt.Errorf("unknown timestamp precision %q", precision)
+}
+
+// EncodeLineProtocol returns the points as lines of InfluxDB line protocol,
+// each ended by a newline; see AppendLine.
+func EncodeLineProtocol(points []Point) ([]byte, error) {
+	var data []byte
+	for _, p := range points {
+		var err error
+		if data, err = AppendLine(data, p); err != nil {
+			return nil, err
+		}
+		data = append(data, '\n')
+	}
+	return data, nil
+}
+
+// DecodeLineProtocol returns the points of lines of InfluxDB line protocol,
+// with timestamps in PrecisionNanoseconds. Integer field values decode as
+// int64, unsigned ones as uint64, the others as float64, bool or string.
+// Empty lines and comments are skipped.
+func DecodeLineProtocol(data []byte) ([]Point, error) {
+	var points []Point
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(bytes.TrimSpace(line)) == 0 || line[0] == '#' {
+			continue
+		}
+		p, err := decodeLine(string(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid line protocol, line %d: %w", n+1, err)
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+func decodeLine(line string) (Point, error) {
+	p := Point{Tags: map[string]string{}, Fields: map[string]interface{}{}}
+	series, rest, ok := cutUnescaped(line, ' ')
+	if !ok {
+		return Point{}, errors.New("no fields")
+	}
+	name, tags, _ := cutUnescaped(series, ',')
+	p.Measurement = unescapeLine(name)
+	for tags != "" {
+		var tag string
+		tag, tags, _ = cutUnescaped(tags, ',')
+		key, value, ok := cutUnescaped(tag, '=')
+		if !ok {
+			return Point{}, fmt.Errorf("tag %q without a value", tag)
+		}
+		p.Tags[unescapeLine(key)] = unescapeLine(value)
+	}
+	fields, timestamp, hasTimestamp := cutFields(rest)
+	for fields != "" {
+		var key string
+		var ok bool
+		key, fields, ok = cutUnescaped(fields, '=')
+		if !ok {
+			return Point{}, fmt.Errorf("field %q without a value", key)
+		}
+		var value interface{}
+		var err error
+		value, fields, err = decodeLineValue(fields)
+		if err != nil {
+			return Point{}, fmt.Errorf("field %s: %w", unescapeLine(key), err)
+		}
+		p.Fields[unescapeLine(key)] = value
+	}
+	if hasTimestamp {
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid timestamp %q", timestamp)
+		}
+		p.Timestamp, p.Precision = ts, PrecisionNanoseconds
+	}
+	return p, nil
+}
+
+// cutUnescaped is strings.Cut for a separator not escaped with a backslash.
+func cutUnescaped(s string, sep byte) (before, after string, found bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// cutFields splits the fields of a line from its timestamp, at the first
+// space outside a string field value.
+func cutFields(s string) (fields, timestamp string, found bool) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ' ' && !quoted:
+			return s[:i], strings.TrimSpace(s[i+1:]), true
+		}
+	}
+	return s, "", false
+}
+
+// decodeLineValue decodes the field value s starts with, returning the fields
+// after it.
+func decodeLineValue(s string) (interface{}, string, error) {
+	if strings.HasPrefix(s, `"`) {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				if i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+				}
+			case '"':
+				rest := s[i+1:]
+				if rest != "" && rest[0] != ',' {
+					return nil, "", errors.New("text after a string value")
+				}
+				return b.String(), strings.TrimPrefix(rest, ","), nil
+			}
+			b.WriteByte(s[i])
+		}
+		return nil, "", errors.New("unterminated string value")
+	}
+	raw, rest, _ := strings.Cut(s, ",")
+	switch {
+	case strings.HasSuffix(raw, "i"):
+		i, err := strconv.ParseInt(strings.TrimSuffix(raw, "i"), 10, 64)
+		return i, rest, err
+	case strings.HasSuffix(raw, "u"):
+		u, err := strconv.ParseUint(strings.TrimSuffix(raw, "u"), 10, 64)
+		return u, rest, err
+	}
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return true, rest, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, rest, nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	return f, rest, err
+}
+
+func unescapeLine(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, =\`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLineProtocol(t *testing.T) {
+	point := Point{
+		Measurement: "http requests",
+		Tags:        map[string]string{"endpoint": "/orders,pay", "method": "GET", "empty": ""},
+		Fields: map[string]interface{}{
+			"request_count": 3,
+			"huge":          uint64(math.MaxUint64),
+			"latency_ms":    12.5,
+			"canceled":      false,
+			"status":        `say "ok"\`,
+			"timeout":       2 * time.Second,
+		},
+		Timestamp: 1700000000000,
+		Precision: PrecisionMilliseconds,
+	}
+	data, err := EncodeLineProtocol([]Point{point, {Measurement: "up", Fields: map[string]interface{}{"n": 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `http\ requests,endpoint=/orders\,pay,method=GET canceled=false,huge=18446744073709551615u,latency_ms=12.5,request_count=3i,status="say \"ok\"\\",timeout=2000000000i 1700000000000000000` + "\n" +
+		"up n=1i\n"
+	if string(data) != want {
+		t.Fatalf("encoded\n%s\nwant\n%s", data, want)
+	}
+
+	points, err := DecodeLineProtocol(append([]byte("# comment\n\n"), data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("decoded %d points, want 2", len(points))
+	}
+	got := points[0]
+	if got.Measurement != "http requests" || got.Tags["endpoint"] != "/orders,pay" || len(got.Tags) != 2 {
+		t.Errorf("decoded %+v", got)
+	}
+	if got.Fields["request_count"] != int64(3) || got.Fields["huge"] != uint64(math.MaxUint64) || got.Fields["latency_ms"] != 12.5 ||
+		got.Fields["canceled"] != false || got.Fields["status"] != `say "ok"\` {
+		t.Errorf("decoded fields %+v", got.Fields)
+	}
+	if got.Timestamp != 1700000000000000000 || got.Precision != PrecisionNanoseconds {
+		t.Errorf("decoded timestamp %d %s", got.Timestamp, got.Precision)
+	}
+	if points[1].Timestamp != 0 || points[1].Fields["n"] != int64(1) {
+		t.Errorf("decoded %+v", points[1])
+	}
+}
+
+func TestLineProtocolRejects(t *testing.T) {
+	fields := map[string]interface{}{"n": 1}
+	for name, point := range map[string]Point{
+		"destination":    {Token: "secret", Measurement: "up", Fields: fields},
+		"no measurement": {Fields: fields},
+		"no fields":      {Measurement: "up"},
+		"newline":        {Measurement: "up", Tags: map[string]string{"k": "a\nb"}, Fields: fields},
+		"NaN":            {Measurement: "up", Fields: map[string]interface{}{"n": math.NaN()}},
+		"precision":      {Measurement: "up", Fields: fields, Timestamp: 1, Precision: "us"},
+	} {
+		if line, err := AppendLine(nil, point); err == nil {
+			t.Errorf("%s: encoded %q", name, line)
+		}
+	}
+	for _, line := range []string{"up", "up n=", "up n=1x", `up s="open`, "up n=1i notatime"} {
+		if points, err := DecodeLineProtocol([]byte(line)); err == nil {
+			t.Errorf("decoded %q as %+v", line, points)
+		}
+	}
+}
+
+func TestLineProtocolCodec(t *testing.T) {
+	codec, ok := LookupCodec("line")
+	if !ok || codec.Binary() {
+		t.Fatalf("LookupCodec(line) = %v, %v", codec, ok)
+	}
+	session := Session{Encoding: "line"}
+	if c, ok := session.FrameCodec(false); !ok || c != LineProtocol {
+		t.Errorf("FrameCodec(false) = %v, %v, want the line protocol", c, ok)
+	}
+}
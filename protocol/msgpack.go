@@ -0,0 +1,389 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// EncodeMessagePackFrame returns the MessagePack frame of one or more points:
+// an array of maps with the properties of point.schema.json, empty ones left
+// out. It is smaller than JSON and needs no schema to decode. Field values
+// must be numbers, booleans or strings, or of types based on them.
+func EncodeMessagePackFrame(points []Point) ([]byte, error) {
+	data := appendMsgpackArrayHeader(nil, len(points))
+	for _, p := range points {
+		var err error
+		if data, err = appendMsgpackPoint(data, p); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func appendMsgpackPoint(data []byte, p Point) ([]byte, error) {
+	properties := []struct{ key, value string }{
+		{"influxdb_url", p.InfluxDBURL},
+		{"token", p.Token},
+		{"org", p.Org},
+		{"bucket", p.Bucket},
+		{"precision", p.Precision},
+	}
+	entries := 3 // measurement, tags and fields
+	for _, s := range properties {
+		if s.value != "" {
+			entries++
+		}
+	}
+	if p.Timestamp != 0 {
+		entries++
+	}
+
+	data = appendMsgpackMapHeader(data, entries)
+	for _, s := range properties {
+		if s.value != "" {
+			data = appendMsgpackString(data, s.key)
+			data = appendMsgpackString(data, s.value)
+		}
+	}
+	data = appendMsgpackString(data, "measurement")
+	data = appendMsgpackString(data, p.Measurement)
+	data = appendMsgpackString(data, "tags")
+	data = appendMsgpackMapHeader(data, len(p.Tags))
+	for _, key := range sortedKeys(p.Tags) {
+		data = appendMsgpackString(data, key)
+		data = appendMsgpackString(data, p.Tags[key])
+	}
+	data = appendMsgpackString(data, "fields")
+	data = appendMsgpackMapHeader(data, len(p.Fields))
+	for _, key := range sortedKeys(p.Fields) {
+		v, err := fieldValue(p.Fields[key])
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", key, err)
+		}
+		data = appendMsgpackString(data, key)
+		switch v := v.(type) {
+		case int64:
+			data = appendMsgpackInt(data, v)
+		case uint64:
+			data = binary.BigEndian.AppendUint64(append(data, 0xcf), v)
+		case float64:
+			data = binary.BigEndian.AppendUint64(append(data, 0xcb), math.Float64bits(v))
+		case bool:
+			data = appendMsgpackBool(data, v)
+		default:
+			data = appendMsgpackString(data, v.(string))
+		}
+	}
+	if p.Timestamp != 0 {
+		data = appendMsgpackString(data, "timestamp")
+		data = appendMsgpackInt(data, p.Timestamp)
+	}
+	return data, nil
+}
+
+func appendMsgpackArrayHeader(data []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(data, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(data, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(data, 0xdd), uint32(n))
+	}
+}
+
+func appendMsgpackMapHeader(data []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(data, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(data, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(data, 0xdf), uint32(n))
+	}
+}
+
+func appendMsgpackString(data []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		data = append(data, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		data = append(data, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		data = binary.BigEndian.AppendUint16(append(data, 0xda), uint16(n))
+	default:
+		data = binary.BigEndian.AppendUint32(append(data, 0xdb), uint32(n))
+	}
+	return append(data, s...)
+}
+
+// appendMsgpackInt appends i in the smallest of the integer formats.
+func appendMsgpackInt(data []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i < 128:
+		return append(data, byte(i))
+	case i >= -32 && i < 0:
+		return append(data, byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		return append(data, 0xcc, byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(data, 0xcd), uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(data, 0xce), uint32(i))
+	case i >= 0:
+		return binary.BigEndian.AppendUint64(append(data, 0xcf), uint64(i))
+	case i >= math.MinInt8:
+		return append(data, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(data, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(data, 0xd2), uint32(i))
+	default:
+		return binary.BigEndian.AppendUint64(append(data, 0xd3), uint64(i))
+	}
+}
+
+func appendMsgpackBool(data []byte, b bool) []byte {
+	if b {
+		return append(data, 0xc3)
+	}
+	return append(data, 0xc2)
+}
+
+// errMsgpackTruncated is returned for frames ending within a value.
+var errMsgpackTruncated = errors.New("truncated MessagePack value")
+
+// DecodeMessagePackFrame returns the points of a MessagePack frame. Integer
+// field values decode as int64, or uint64 beyond its range; the others as
+// float64, bool or string. Unknown properties are skipped.
+func DecodeMessagePackFrame(data []byte) ([]Point, error) {
+	d := msgpackDecoder{data: data}
+	value, err := d.value()
+	if err == nil && len(d.data) > 0 {
+		err = errors.New("trailing data")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid MessagePack frame: %w", err)
+	}
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid MessagePack frame: not an array")
+	}
+	points := make([]Point, 0, len(array))
+	for _, v := range array {
+		p, err := msgpackPoint(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MessagePack frame: %w", err)
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+func msgpackPoint(v interface{}) (Point, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return Point{}, errors.New("point is not a map")
+	}
+	p := Point{Tags: map[string]string{}, Fields: map[string]interface{}{}}
+	for key, value := range m {
+		switch key {
+		case "influxdb_url", "token", "org", "bucket", "measurement", "precision":
+			s, ok := value.(string)
+			if !ok {
+				return Point{}, fmt.Errorf("%s is not a string", key)
+			}
+			switch key {
+			case "influxdb_url":
+				p.InfluxDBURL = s
+			case "token":
+				p.Token = s
+			case "org":
+				p.Org = s
+			case "bucket":
+				p.Bucket = s
+			case "measurement":
+				p.Measurement = s
+			case "precision":
+				p.Precision = s
+			}
+		case "timestamp":
+			ts, ok := value.(int64)
+			if !ok {
+				return Point{}, errors.New("timestamp is not an integer")
+			}
+			p.Timestamp = ts
+		case "tags":
+			tags, ok := value.(map[string]interface{})
+			if !ok {
+				return Point{}, errors.New("tags is not a map")
+			}
+			for k, tag := range tags {
+				s, ok := tag.(string)
+				if !ok {
+					return Point{}, fmt.Errorf("tag %s is not a string", k)
+				}
+				p.Tags[k] = s
+			}
+		case "fields":
+			fields, ok := value.(map[string]interface{})
+			if !ok {
+				return Point{}, errors.New("fields is not a map")
+			}
+			for k, field := range fields {
+				switch field.(type) {
+				case int64, uint64, float64, bool, string:
+					p.Fields[k] = field
+				default:
+					return Point{}, fmt.Errorf("field %s is not a number, boolean or string", k)
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+// msgpackDecoder decodes the MessagePack values the points are made of:
+// nil, booleans, numbers, strings, arrays and maps with string keys. Binary
+// and extension values are rejected.
+type msgpackDecoder struct {
+	data []byte
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if len(d.data) < n {
+		return nil, errMsgpackTruncated
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (d *msgpackDecoder) value() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (c - 0xcc))
+		if u > math.MaxInt64 {
+			return u, err
+		}
+		return int64(u), err
+	case 0xd0:
+		u, err := d.uint(1)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := d.uint(2)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := d.uint(4)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := d.uint(8)
+		return int64(u), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(int(n))
+	}
+	return nil, fmt.Errorf("unsupported MessagePack type 0x%02x", c)
+}
+
+func (d *msgpackDecoder) str(n int) (string, error) {
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) arrayOf(n int) ([]interface{}, error) {
+	// Every element takes a byte at least, so a bogus length can't allocate
+	// more than the frame
+	if n > len(d.data) {
+		return nil, errMsgpackTruncated
+	}
+	array := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, v)
+	}
+	return array, nil
+}
+
+func (d *msgpackDecoder) mapOf(n int) (map[string]interface{}, error) {
+	if n > len(d.data)/2 {
+		return nil, errMsgpackTruncated
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("map key is not a string")
+		}
+		if m[key], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
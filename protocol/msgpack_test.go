@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessagePackFrame(t *testing.T) {
+	point := Point{
+		Token:       "secret",
+		Measurement: "orders",
+		Tags:        map[string]string{"endpoint": "/orders", "long": strings.Repeat("x", 300)},
+		Fields: map[string]interface{}{
+			"request_count": 9007199254740993,
+			"latency_ms":    12.5,
+			"small":         -3,
+			"negative":      int64(math.MinInt64),
+			"huge":          uint64(math.MaxUint64),
+			"canceled":      false,
+			"status":        "ok",
+			"timeout":       2 * time.Second,
+		},
+		Timestamp: 1700000000000,
+		Precision: PrecisionMilliseconds,
+	}
+	points := make([]Point, 20)
+	points[0] = point
+	for i := 1; i < len(points); i++ {
+		points[i] = Point{Measurement: "empty"}
+	}
+	data, err := EncodeMessagePackFrame(points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, _ := EncodeBatch(points)
+	if len(data) >= len(json) {
+		t.Errorf("MessagePack frame of %d bytes, JSON %d", len(data), len(json))
+	}
+
+	decoded, err := DecodeMessagePackFrame(data)
+	if err != nil || len(decoded) != len(points) {
+		t.Fatalf("DecodeMessagePackFrame = %d points, %v", len(decoded), err)
+	}
+	got := decoded[0]
+	if got.Token != "secret" || got.Measurement != "orders" || got.Timestamp != 1700000000000 || got.Precision != "ms" || got.Tags["long"] != point.Tags["long"] || got.InfluxDBURL != "" {
+		t.Errorf("point = %+v", got)
+	}
+	want := map[string]interface{}{
+		"request_count": int64(9007199254740993),
+		"latency_ms":    12.5,
+		"small":         int64(-3),
+		"negative":      int64(math.MinInt64),
+		"huge":          uint64(math.MaxUint64),
+		"canceled":      false,
+		"status":        "ok",
+		"timeout":       int64(2 * time.Second),
+	}
+	for key, value := range want {
+		if got.Fields[key] != value {
+			t.Errorf("field %s = %#v, want %#v", key, got.Fields[key], value)
+		}
+	}
+	if decoded[19].Measurement != "empty" {
+		t.Errorf("last point = %+v", decoded[19])
+	}
+
+	for _, bad := range [][]byte{data[:len(data)-1], append(bytes.Clone(data), 0x00), {0x81, 0xa1, 'x'}, {0xdd, 0xff, 0xff, 0xff, 0xff}} {
+		if _, err := DecodeMessagePackFrame(bad); err == nil {
+			t.Errorf("DecodeMessagePackFrame accepted % x", bad)
+		}
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	point := Point{Measurement: "orders", Tags: map[string]string{"endpoint": "/orders"}, Fields: map[string]interface{}{"request_count": 1}}
+	for _, name := range []string{"json", "protobuf", "msgpack"} {
+		codec, ok := LookupCodec(name)
+		if !ok || codec.Name() != name {
+			t.Fatalf("LookupCodec(%s) = %v, %v", name, codec, ok)
+		}
+		data, err := codec.Encode([]Point{point})
+		if err != nil {
+			t.Fatal(err)
+		}
+		points, err := codec.Decode(data)
+		if err != nil || len(points) != 1 || points[0].Tags["endpoint"] != "/orders" {
+			t.Errorf("%s round trip = %+v, %v", name, points, err)
+		}
+	}
+	if data, _ := JSON.Encode([]Point{point}); data[0] != '{' || JSON.Binary() {
+		t.Errorf("JSON frame of a point = %s", data)
+	}
+	if !Protobuf.Binary() || !MessagePack.Binary() {
+		t.Error("binary codecs write text frames")
+	}
+
+	RegisterCodec(upperCodec{})
+	if codec, ok := LookupCodec("upper"); !ok || codec.Name() != "upper" {
+		t.Errorf("registered codec not found")
+	}
+	if _, ok := LookupCodec("xml"); ok {
+		t.Error("found an unregistered codec")
+	}
+}
+
+type upperCodec struct{ jsonCodec }
+
+func (upperCodec) Name() string { return "upper" }
@@ -0,0 +1,279 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"slices"
+)
+
+// Field numbers of schema/frame.proto.
+const (
+	frameFieldPoints = 1
+
+	pointFieldInfluxDBURL = 1
+	pointFieldToken       = 2
+	pointFieldOrg         = 3
+	pointFieldBucket      = 4
+	pointFieldMeasurement = 5
+	pointFieldTags        = 6
+	pointFieldFields      = 7
+	pointFieldTimestamp   = 8
+	pointFieldPrecision   = 9
+
+	mapFieldKey   = 1
+	mapFieldValue = 2
+
+	valueFieldDouble = 1
+	valueFieldInt    = 2
+	valueFieldBool   = 3
+	valueFieldString = 4
+)
+
+// EncodeBinaryFrame returns the binary frame of one or more points, the Frame
+// message of schema/frame.proto. Field values must be numbers, booleans or
+// strings, or of types based on them such as time.Duration.
+func EncodeBinaryFrame(points []Point) ([]byte, error) {
+	var data []byte
+	for _, p := range points {
+		point, err := appendPoint(nil, p)
+		if err != nil {
+			return nil, err
+		}
+		data = protowire.AppendTag(data, frameFieldPoints, protowire.BytesType)
+		data = protowire.AppendBytes(data, point)
+	}
+	return data, nil
+}
+
+func appendPoint(data []byte, p Point) ([]byte, error) {
+	data = appendString(data, pointFieldInfluxDBURL, p.InfluxDBURL)
+	data = appendString(data, pointFieldToken, p.Token)
+	data = appendString(data, pointFieldOrg, p.Org)
+	data = appendString(data, pointFieldBucket, p.Bucket)
+	data = appendString(data, pointFieldMeasurement, p.Measurement)
+	for _, key := range sortedKeys(p.Tags) {
+		var entry []byte
+		entry = appendString(entry, mapFieldKey, key)
+		entry = appendString(entry, mapFieldValue, p.Tags[key])
+		data = protowire.AppendTag(data, pointFieldTags, protowire.BytesType)
+		data = protowire.AppendBytes(data, entry)
+	}
+	for _, key := range sortedKeys(p.Fields) {
+		value, err := appendValue(nil, p.Fields[key])
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", key, err)
+		}
+		var entry []byte
+		entry = appendString(entry, mapFieldKey, key)
+		entry = protowire.AppendTag(entry, mapFieldValue, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, value)
+		data = protowire.AppendTag(data, pointFieldFields, protowire.BytesType)
+		data = protowire.AppendBytes(data, entry)
+	}
+	if p.Timestamp != 0 {
+		data = protowire.AppendTag(data, pointFieldTimestamp, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(p.Timestamp))
+	}
+	data = appendString(data, pointFieldPrecision, p.Precision)
+	return data, nil
+}
+
+// appendString appends a string field, unless it is empty, as proto3 does.
+func appendString(data []byte, field protowire.Number, s string) []byte {
+	if s == "" {
+		return data
+	}
+	data = protowire.AppendTag(data, field, protowire.BytesType)
+	return protowire.AppendString(data, s)
+}
+
+func appendValue(data []byte, v interface{}) ([]byte, error) {
+	v, err := fieldValue(v)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case int64:
+		return appendInt(data, v), nil
+	case uint64:
+		return appendDouble(data, float64(v)), nil
+	case float64:
+		return appendDouble(data, v), nil
+	case bool:
+		data = protowire.AppendTag(data, valueFieldBool, protowire.VarintType)
+		return protowire.AppendVarint(data, protowire.EncodeBool(v)), nil
+	default:
+		data = protowire.AppendTag(data, valueFieldString, protowire.BytesType)
+		return protowire.AppendString(data, v.(string)), nil
+	}
+}
+
+func appendDouble(data []byte, f float64) []byte {
+	data = protowire.AppendTag(data, valueFieldDouble, protowire.Fixed64Type)
+	return protowire.AppendFixed64(data, math.Float64bits(f))
+}
+
+func appendInt(data []byte, i int64) []byte {
+	data = protowire.AppendTag(data, valueFieldInt, protowire.VarintType)
+	return protowire.AppendVarint(data, uint64(i))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// DecodeBinaryFrame returns the points of a binary frame. Integer field
+// values decode as int64, the others as float64, bool or string.
+func DecodeBinaryFrame(data []byte) ([]Point, error) {
+	var points []Point
+	err := consumeFields(data, func(field protowire.Number, typ protowire.Type, value []byte) error {
+		if field != frameFieldPoints || typ != protowire.BytesType {
+			return nil
+		}
+		p, err := decodePoint(value)
+		if err != nil {
+			return err
+		}
+		points = append(points, p)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid binary frame: %w", err)
+	}
+	return points, nil
+}
+
+func decodePoint(data []byte) (Point, error) {
+	p := Point{Tags: map[string]string{}, Fields: map[string]interface{}{}}
+	err := consumeFields(data, func(field protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case field == pointFieldTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(value)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			p.Timestamp = int64(v)
+		case typ != protowire.BytesType:
+		case field == pointFieldInfluxDBURL:
+			p.InfluxDBURL = string(value)
+		case field == pointFieldToken:
+			p.Token = string(value)
+		case field == pointFieldOrg:
+			p.Org = string(value)
+		case field == pointFieldBucket:
+			p.Bucket = string(value)
+		case field == pointFieldMeasurement:
+			p.Measurement = string(value)
+		case field == pointFieldPrecision:
+			p.Precision = string(value)
+		case field == pointFieldTags:
+			key, entry, err := decodeMapEntry(value)
+			if err != nil {
+				return err
+			}
+			p.Tags[key] = string(entry)
+		case field == pointFieldFields:
+			key, entry, err := decodeMapEntry(value)
+			if err != nil {
+				return err
+			}
+			v, err := decodeValue(entry)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", key, err)
+			}
+			p.Fields[key] = v
+		}
+		return nil
+	})
+	return p, err
+}
+
+// decodeMapEntry returns the key and the encoded value of a map entry.
+func decodeMapEntry(data []byte) (string, []byte, error) {
+	var key string
+	var value []byte
+	err := consumeFields(data, func(field protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch field {
+		case mapFieldKey:
+			key = string(v)
+		case mapFieldValue:
+			value = v
+		}
+		return nil
+	})
+	return key, value, err
+}
+
+func decodeValue(data []byte) (interface{}, error) {
+	var value interface{}
+	err := consumeFields(data, func(field protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case field == valueFieldDouble && typ == protowire.Fixed64Type:
+			bits, n := protowire.ConsumeFixed64(v)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value = math.Float64frombits(bits)
+		case field == valueFieldInt && typ == protowire.VarintType:
+			i, n := protowire.ConsumeVarint(v)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value = int64(i)
+		case field == valueFieldBool && typ == protowire.VarintType:
+			b, n := protowire.ConsumeVarint(v)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value = protowire.DecodeBool(b)
+		case field == valueFieldString && typ == protowire.BytesType:
+			value = string(v)
+		}
+		return nil
+	})
+	if err == nil && value == nil {
+		err = errors.New("no value")
+	}
+	return value, err
+}
+
+// consumeFields calls fn with each field of a message: its number, wire type
+// and value, which is the payload of length-delimited fields and the encoded
+// varint or fixed-size bytes of the others.
+func consumeFields(data []byte, fn func(field protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(data) > 0 {
+		field, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		var value []byte
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(field, typ, data)
+			if n >= 0 {
+				value = data[:n]
+			}
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := fn(field, typ, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
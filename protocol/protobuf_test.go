@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"encoding/json"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io/fs"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBinaryFrame(t *testing.T) {
+	point := Point{
+		Token:       "secret",
+		Measurement: "orders",
+		Tags:        map[string]string{"endpoint": "/orders", "method": "GET"},
+		Fields: map[string]interface{}{
+			"request_count": 9007199254740993,
+			"latency_ms":    12.5,
+			"negative":      int64(-3),
+			"canceled":      false,
+			"status":        "ok",
+			"number":        json.Number("7"),
+			"timeout":       2 * time.Second,
+		},
+		Timestamp: 1700000000000,
+		Precision: PrecisionMilliseconds,
+	}
+	data, err := EncodeBinaryFrame([]Point{point, {Measurement: "empty"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fields unknown to this version are skipped
+	data = protowire.AppendTag(data, 15, protowire.VarintType)
+	data = protowire.AppendVarint(data, 1)
+
+	points, err := DecodeBinaryFrame(data)
+	if err != nil || len(points) != 2 {
+		t.Fatalf("DecodeBinaryFrame = %+v, %v", points, err)
+	}
+	got := points[0]
+	if got.Token != "secret" || got.Measurement != "orders" || got.Timestamp != 1700000000000 || got.Precision != "ms" || len(got.Tags) != 2 || got.Tags["method"] != "GET" {
+		t.Errorf("point = %+v", got)
+	}
+	want := map[string]interface{}{
+		"request_count": int64(9007199254740993),
+		"latency_ms":    12.5,
+		"negative":      int64(-3),
+		"canceled":      false,
+		"status":        "ok",
+		"number":        int64(7),
+		"timeout":       int64(2 * time.Second),
+	}
+	for key, value := range want {
+		if got.Fields[key] != value {
+			t.Errorf("field %s = %#v, want %#v", key, got.Fields[key], value)
+		}
+	}
+	if points[1].Measurement != "empty" || len(points[1].Fields) != 0 {
+		t.Errorf("second point = %+v", points[1])
+	}
+
+	if _, err := EncodeBinaryFrame([]Point{{Fields: map[string]interface{}{"list": []int{1}}}}); err == nil {
+		t.Error("EncodeBinaryFrame accepted a list field")
+	}
+	if _, err := DecodeBinaryFrame(data[:len(data)/2]); err == nil {
+		t.Error("DecodeBinaryFrame accepted a truncated frame")
+	}
+}
+
+// TestProtoSchemaMatchesEncoder keeps frame.proto in step with the field
+// numbers of the encoder.
+func TestProtoSchemaMatchesEncoder(t *testing.T) {
+	data, err := fs.ReadFile(Schemas, "schema/frame.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers := map[string]int{}
+	for _, m := range regexp.MustCompile(`(?m)^\s+(?:[\w<>, ]+ )?(\w+) = (\d+);`).FindAllStringSubmatch(string(data), -1) {
+		numbers[m[1]], _ = strconv.Atoi(m[2])
+	}
+	for name, want := range map[string]int{
+		"points":       frameFieldPoints,
+		"influxdb_url": pointFieldInfluxDBURL,
+		"token":        pointFieldToken,
+		"org":          pointFieldOrg,
+		"bucket":       pointFieldBucket,
+		"measurement":  pointFieldMeasurement,
+		"tags":         pointFieldTags,
+		"fields":       pointFieldFields,
+		"timestamp":    pointFieldTimestamp,
+		"precision":    pointFieldPrecision,
+		"double_value": valueFieldDouble,
+		"int_value":    valueFieldInt,
+		"bool_value":   valueFieldBool,
+		"string_value": valueFieldString,
+	} {
+		if numbers[name] != want {
+			t.Errorf("frame.proto numbers %s %d, the encoder %d", name, numbers[name], want)
+		}
+	}
+}
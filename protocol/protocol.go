@@ -0,0 +1,328 @@
+// Package protocol is the wire format of the central registry, for agents in
+// Go and, through the JSON Schemas in Schemas, in any other language.
+//
+// Agents connect to the registry over WebSocket (see the transport package)
+// and send text frames of one JSON document each:
+//
+//   - a Session, then Points or batches of points as JSON arrays, on the
+//     metrics endpoint (schema/session.schema.json, schema/point.schema.json,
+//     schema/frame.schema.json);
+//   - a Registration on the registration endpoint
+//     (schema/registration.schema.json).
+//
+// Points and batches can be encoded with another Codec the Session names:
+// binary frames of one Frame message of schema/frame.proto each by default
+// (see EncodeBinaryFrame) or MessagePack, cheaper to encode and parse than
+// JSON; or text frames of InfluxDB line protocol, for registries to forward as
+// they are.
+//
+// The Session carries the InfluxDB destination and credentials of the points
+// of the connection once, so that points only carry their measurement, tags
+// and fields. Registries holding the credentials themselves need no Session.
+//
+// With acknowledged delivery, a Sequence (schema/sequence.schema.json) follows
+// the Session on every connection and numbers the point frames after it; the
+// registry acknowledges them with ControlAck messages, and the agent writes
+// the ones it didn't acknowledge again on its next connection.
+//
+// Agents whose WebSocket upgrades are blocked POST the same frames over HTTP
+// instead; see SessionHeader.
+//
+// The payload of points is versioned: the Session names the SchemaVersion of
+// the points that follow it, and UpgradePoints and DowngradePoints convert
+// points between versions, so agents and registries of different versions
+// can talk while renaming tags or fields.
+//
+// The registry answers with Control messages (schema/control.schema.json) on
+// the same connection. Unknown properties must be ignored by both sides, so
+// that either can add some without breaking the other.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Timestamp precisions of Point.Precision.
+const (
+	PrecisionSeconds      = "s"
+	PrecisionMilliseconds = "ms"
+	PrecisionNanoseconds  = "ns"
+)
+
+// Point is a metrics point: the tags and fields of a measurement. The InfluxDB
+// bucket the registry writes it to is the one of the Session of the
+// connection, unless the point names one of its own.
+type Point struct {
+	InfluxDBURL string                 `json:"influxdb_url,omitempty"`
+	Token       string                 `json:"token,omitempty"`
+	Org         string                 `json:"org,omitempty"`
+	Bucket      string                 `json:"bucket,omitempty"`
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	// Timestamp is when the point was taken, in Unix time (so UTC) in units
+	// of Precision: PrecisionSeconds, PrecisionMilliseconds or
+	// PrecisionNanoseconds. Without one, the registry timestamps the point
+	// when it arrives.
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Precision string `json:"precision,omitempty"`
+}
+
+// SessionType is the type of Session frames.
+const SessionType = "session"
+
+// Session is the InfluxDB destination of the points sent on a connection to
+// the metrics endpoint. Agents send it as the first frame of each connection,
+// and again when the token rotates or the destination changes; it applies to
+// the points that follow it and name no destination of their own.
+type Session struct {
+	// Type is always SessionType.
+	Type        string `json:"type"`
+	InfluxDBURL string `json:"influxdb_url,omitempty"`
+	Token       string `json:"token,omitempty"`
+	Org         string `json:"org,omitempty"`
+	Bucket      string `json:"bucket,omitempty"`
+	// Encoding is the Codec of the point frames that follow. When empty,
+	// text frames are JSON and binary ones protobuf.
+	Encoding string `json:"encoding,omitempty"`
+	// SchemaVersion is the version of the payload of the point frames that
+	// follow; see Version.
+	SchemaVersion int `json:"schema_version,omitempty"`
+}
+
+// Version returns the schema version of the points following the session:
+// SchemaVersion, or 1 for sessions of agents predating it. Registries pass
+// it to UpgradePoints.
+func (s Session) Version() int {
+	if s.SchemaVersion == 0 {
+		return 1
+	}
+	return s.SchemaVersion
+}
+
+// FrameCodec returns the Codec of the binary or text point frames following
+// the session, reporting false for an Encoding that isn't registered.
+func (s Session) FrameCodec(binary bool) (Codec, bool) {
+	switch {
+	case s.Encoding != "":
+		return LookupCodec(s.Encoding)
+	case binary:
+		return Protobuf, true
+	default:
+		return JSON, true
+	}
+}
+
+// Owns reports whether p goes to the destination of the session, so the
+// agent can leave it out of the point.
+func (s Session) Owns(p Point) bool {
+	return p.InfluxDBURL == s.InfluxDBURL && p.Org == s.Org && p.Bucket == s.Bucket
+}
+
+// Strip returns p without the destination of the session, when it goes to
+// it.
+func (s Session) Strip(p Point) Point {
+	if s.Owns(p) {
+		p.InfluxDBURL, p.Token, p.Org, p.Bucket = "", "", "", ""
+	}
+	return p
+}
+
+// Apply gives p the destination of the session, when it names none, for
+// registries writing a point.
+func (s Session) Apply(p *Point) {
+	if p.InfluxDBURL == "" && p.Org == "" && p.Bucket == "" {
+		p.InfluxDBURL, p.Token, p.Org, p.Bucket = s.InfluxDBURL, s.Token, s.Org, s.Bucket
+	}
+}
+
+// SequenceType is the type of Sequence frames.
+const SequenceType = "sequence"
+
+// Sequence numbers the point frames that follow it on a connection, text or
+// binary: the first is Next, the one after it Next+1, and so on. Agents with
+// acknowledged delivery send it after the Session of every connection, and
+// then first the frames the registry didn't acknowledge on the previous
+// connections, so a registry must skip the frames of Stream numbered up to the
+// last one it wrote.
+type Sequence struct {
+	// Type is always SequenceType.
+	Type string `json:"type"`
+	// Stream identifies the agent whose frames are numbered, across its
+	// connections.
+	Stream string `json:"stream"`
+	Next   uint64 `json:"next"`
+}
+
+// Registration announces a service to the registry.
+type Registration struct {
+	Name string `json:"name"`
+	// Type is the kind of service, e.g. "http-api"; see
+	// registration.ServiceType.
+	Type string `json:"type"`
+	// Routes, when set, compares the endpoints found in the service's source
+	// with the routes its router serves.
+	Routes *RouteReconciliation `json:"routes,omitempty"`
+}
+
+// Route is an HTTP endpoint: a method, or "" for any method, and a path
+// pattern in the syntax of the service's router (e.g. "/users/:id").
+type Route struct {
+	Method  string `json:"method"`
+	Pattern string `json:"pattern"`
+	// Handler names the handler, when known.
+	Handler string `json:"handler,omitempty"`
+}
+
+// RouteReconciliation compares the endpoints parsed from a service's source
+// with the routes registered with its router at run time.
+type RouteReconciliation struct {
+	// Matched are the routes both found in the source and served, as the
+	// router registered them, with the handler named in the source.
+	Matched []Route `json:"matched"`
+	// StaticOnly are found in the source but not served: dead code, or
+	// routes registered under a prefix the parser couldn't follow.
+	StaticOnly []Route `json:"static_only"`
+	// RuntimeOnly are served but not found in the source, e.g. routes built
+	// dynamically or added by a library.
+	RuntimeOnly []Route `json:"runtime_only"`
+}
+
+// HasDrift reports whether the source and the router disagree.
+func (r RouteReconciliation) HasDrift() bool {
+	return len(r.StaticOnly) > 0 || len(r.RuntimeOnly) > 0
+}
+
+// Control message types sent by the registry. Others are passed on as they
+// are.
+const (
+	// ControlHeartbeatMissed: the registry hasn't heard from this service in
+	// time and may consider it dead.
+	ControlHeartbeatMissed = "heartbeat_missed"
+	// ControlCollectorMigrating: the collector is moving to URL; connect there
+	// before the current one goes away.
+	ControlCollectorMigrating = "collector_migrating"
+	// ControlAck: the registry wrote the point frames of the connection's
+	// Sequence numbered up to Sequence, which the agent can forget.
+	ControlAck = "ack"
+)
+
+// Control is a control message the registry sent over a connection.
+type Control struct {
+	Type    string `json:"type"`
+	Message string `json:"message,omitempty"`
+	// URL is the new collector of a ControlCollectorMigrating message.
+	URL string `json:"url,omitempty"`
+	// Sequence is the last frame acknowledged by a ControlAck message.
+	Sequence uint64 `json:"sequence,omitempty"`
+	// Raw is the whole message, for fields specific to a message type.
+	Raw json.RawMessage `json:"-"`
+}
+
+// EncodePoint returns the frame of a single point.
+func EncodePoint(p Point) ([]byte, error) {
+	return json.Marshal(p)
+}
+
+// EncodeSession returns the frame of a session.
+func EncodeSession(s Session) ([]byte, error) {
+	s.Type = SessionType
+	return json.Marshal(s)
+}
+
+// DecodeSession decodes a frame of the metrics endpoint, reporting whether it
+// is a session. Registries check for one before DecodeFrame.
+func DecodeSession(data []byte) (Session, bool) {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) == 0 || data[0] != '{' {
+		return Session{}, false
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil || s.Type != SessionType {
+		return Session{}, false
+	}
+	return s, true
+}
+
+// EncodeSequence returns the frame of a sequence.
+func EncodeSequence(s Sequence) ([]byte, error) {
+	s.Type = SequenceType
+	return json.Marshal(s)
+}
+
+// DecodeSequence decodes a frame of the metrics endpoint, reporting whether it
+// is a sequence. Registries check for one, like for a session, before
+// DecodeFrame.
+func DecodeSequence(data []byte) (Sequence, bool) {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) == 0 || data[0] != '{' {
+		return Sequence{}, false
+	}
+	var s Sequence
+	if err := json.Unmarshal(data, &s); err != nil || s.Type != SequenceType {
+		return Sequence{}, false
+	}
+	return s, true
+}
+
+// EncodeBatch returns the frame of a batch of points.
+func EncodeBatch(points []Point) ([]byte, error) {
+	return json.Marshal(points)
+}
+
+// DecodeFrame returns the points of a metrics frame, a single point or a
+// batch. Numbers in fields decode as json.Number, so integers keep their
+// precision.
+func DecodeFrame(data []byte) ([]Point, error) {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if len(data) > 0 && data[0] == '[' {
+		var points []Point
+		if err := decoder.Decode(&points); err != nil {
+			return nil, fmt.Errorf("invalid batch frame: %w", err)
+		}
+		return points, nil
+	}
+	var p Point
+	if err := decoder.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid point frame: %w", err)
+	}
+	return []Point{p}, nil
+}
+
+// EncodeRegistration returns the frame of a registration.
+func EncodeRegistration(r Registration) ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// DecodeRegistration decodes a registration frame.
+func DecodeRegistration(data []byte) (Registration, error) {
+	var r Registration
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Registration{}, fmt.Errorf("invalid registration frame: %w", err)
+	}
+	if r.Name == "" {
+		return Registration{}, fmt.Errorf("invalid registration frame: no name")
+	}
+	return r, nil
+}
+
+// EncodeControl returns the frame of a control message, for registries and
+// their tests.
+func EncodeControl(c Control) ([]byte, error) {
+	return json.Marshal(c)
+}
+
+// DecodeControl decodes a message from the registry, reporting whether it is
+// a control message: a JSON object with a type.
+func DecodeControl(data []byte) (Control, bool) {
+	var c Control
+	if err := json.Unmarshal(data, &c); err != nil || c.Type == "" {
+		return Control{}, false
+	}
+	c.Raw = json.RawMessage(data)
+	return c, true
+}
@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"encoding/json"
+	"io/fs"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDecodeFrame(t *testing.T) {
+	point := Point{
+		Measurement: "orders",
+		Tags:        map[string]string{"endpoint": "/orders"},
+		Fields:      map[string]interface{}{"request_count": 9007199254740993},
+		Timestamp:   1700000000,
+		Precision:   PrecisionSeconds,
+	}
+	single, err := EncodePoint(point)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := EncodeBatch([]Point{point, point})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := DecodeFrame(single)
+	if err != nil || len(points) != 1 {
+		t.Fatalf("DecodeFrame(point) = %v, %v", points, err)
+	}
+	// Integers beyond float64 precision survive the round trip
+	if got := points[0].Fields["request_count"]; got != json.Number("9007199254740993") {
+		t.Errorf("request_count = %v", got)
+	}
+	if points[0].Tags["endpoint"] != "/orders" || points[0].Timestamp != 1700000000 || points[0].Precision != "s" {
+		t.Errorf("point = %+v", points[0])
+	}
+	if points, err := DecodeFrame(append([]byte("\n "), batch...)); err != nil || len(points) != 2 {
+		t.Errorf("DecodeFrame(batch) = %d points, %v", len(points), err)
+	}
+	if _, err := DecodeFrame([]byte(`{"measurement":`)); err == nil {
+		t.Error("DecodeFrame accepted a truncated frame")
+	}
+}
+
+func TestSession(t *testing.T) {
+	session := Session{InfluxDBURL: "http://influx:8086", Token: "secret", Org: "acme", Bucket: "metrics"}
+	data, err := EncodeSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, ok := DecodeSession(data)
+	if !ok || decoded.Type != SessionType || decoded.Token != "secret" || decoded.Bucket != "metrics" {
+		t.Errorf("DecodeSession = %+v, %v", decoded, ok)
+	}
+	for _, frame := range []string{`{"measurement":"orders","fields":{}}`, `[{"measurement":"orders"}]`, `{"type":"heartbeat_missed"}`} {
+		if _, ok := DecodeSession([]byte(frame)); ok {
+			t.Errorf("%s decoded as a session", frame)
+		}
+	}
+
+	point := Point{InfluxDBURL: "http://influx:8086", Token: "secret", Org: "acme", Bucket: "metrics", Measurement: "orders"}
+	stripped := session.Strip(point)
+	encoded, err := EncodePoint(stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(encoded), "secret") || strings.Contains(string(encoded), "influxdb_url") {
+		t.Errorf("stripped point = %s, want no destination", encoded)
+	}
+	other := Point{InfluxDBURL: "http://influx:8086", Token: "other", Org: "acme", Bucket: "audit", Measurement: "orders"}
+	if kept := session.Strip(other); kept.Token != "other" || kept.Bucket != "audit" {
+		t.Error("a point with a destination of its own was stripped")
+	}
+
+	session.Apply(&stripped)
+	if stripped.Token != "secret" || stripped.Bucket != "metrics" {
+		t.Errorf("applied point = %+v, want the session's destination", stripped)
+	}
+	session.Apply(&other)
+	if other.Token != "other" || other.Bucket != "audit" {
+		t.Errorf("applied point = %+v, want its own destination", other)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	data, err := EncodeSequence(Sequence{Stream: "orders-1", Next: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := DecodeSequence(data); !ok || s.Type != SequenceType || s.Stream != "orders-1" || s.Next != 42 {
+		t.Errorf("DecodeSequence = %+v, %v", s, ok)
+	}
+	for _, frame := range []string{`{"type":"session","token":"secret"}`, `{"measurement":"orders","fields":{}}`, `[{"measurement":"orders"}]`, "orders rows=1i"} {
+		if _, ok := DecodeSequence([]byte(frame)); ok {
+			t.Errorf("%s decoded as a sequence", frame)
+		}
+	}
+
+	data, err = EncodeControl(Control{Type: ControlAck, Sequence: 41})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := DecodeControl(data); !ok || c.Type != ControlAck || c.Sequence != 41 {
+		t.Errorf("DecodeControl(ack) = %+v, %v", c, ok)
+	}
+}
+
+func TestDecodeRegistrationAndControl(t *testing.T) {
+	data, err := EncodeRegistration(Registration{Name: "orders", Type: "http-api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := DecodeRegistration(data); err != nil || r.Name != "orders" || r.Type != "http-api" {
+		t.Errorf("DecodeRegistration = %+v, %v", r, err)
+	}
+	if _, err := DecodeRegistration([]byte(`{"type":"grpc"}`)); err == nil {
+		t.Error("DecodeRegistration accepted a registration without a name")
+	}
+
+	data, err = EncodeControl(Control{Type: ControlHeartbeatMissed, Message: "late"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := DecodeControl(data); !ok || c.Type != ControlHeartbeatMissed || c.Message != "late" || string(c.Raw) != string(data) {
+		t.Errorf("DecodeControl = %+v, %v", c, ok)
+	}
+	if _, ok := DecodeControl([]byte(`{"measurement":"orders"}`)); ok {
+		t.Error("a point was decoded as a control message")
+	}
+}
+
+// TestSchemasMatchTypes keeps the JSON Schemas in step with the Go types.
+func TestSchemasMatchTypes(t *testing.T) {
+	for file, v := range map[string]interface{}{
+		"schema/session.schema.json":      Session{},
+		"schema/sequence.schema.json":     Sequence{},
+		"schema/point.schema.json":        Point{},
+		"schema/registration.schema.json": Registration{},
+		"schema/control.schema.json":      Control{},
+	} {
+		data, err := fs.ReadFile(Schemas, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var schema struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		}
+		if err := json.Unmarshal(data, &schema); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		var inSchema, inType []string
+		for name := range schema.Properties {
+			inSchema = append(inSchema, name)
+		}
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			if name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]; name != "-" {
+				inType = append(inType, name)
+			}
+		}
+		sort.Strings(inSchema)
+		sort.Strings(inType)
+		if !reflect.DeepEqual(inSchema, inType) {
+			t.Errorf("%s properties = %v, %T has %v", file, inSchema, v, inType)
+		}
+	}
+
+	data, err := fs.ReadFile(Schemas, "schema/frame.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(data) {
+		t.Error("frame.schema.json isn't valid JSON")
+	}
+}
@@ -0,0 +1,12 @@
+package protocol
+
+import "embed"
+
+// Schemas holds the JSON Schemas (draft 2020-12) of the wire format, under
+// schema/: session, sequence, point, frame (a session, a
+// sequence, a point or a batch),
+// registration and control; and frame.proto, the protobuf schema of binary
+// frames.
+//
+//go:embed schema/*.schema.json schema/*.proto
+var Schemas embed.FS
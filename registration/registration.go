@@ -1,25 +1,31 @@
 package registration
 
 import (
-	"encoding/json"
 	"fmt"
-	"github.com/gorilla/websocket"
+	"github.com/jculley01/observability-module/protocol"
+	"github.com/jculley01/observability-module/transport"
 	"time"
 )
 
-type Registration struct {
-	Name string `json:"name"`
-	Type string `json:"type"`
+// Registration announces a service to the registry; see the protocol package
+// for the wire format.
+type Registration = protocol.Registration
+
+// responsible for registering the service; serviceType must be a built-in or
+// registered ServiceType
+func RegisterService(webSocketURL, serviceID string, serviceType ServiceType) error {
+	return Register(webSocketURL, Registration{Name: serviceID, Type: string(serviceType)})
 }
 
-// responsible for registering the service
-func RegisterService(webSocketURL, serviceID, serviceType string) error {
-	registrationData := Registration{
-		Name: serviceID,
-		Type: serviceType,
+// Register is RegisterService for a full registration, e.g. with the Routes
+// reconciled by parserimport.Reconcile so the registry can flag drift between
+// the source and the running service.
+func Register(webSocketURL string, registrationData Registration) error {
+	if err := ServiceType(registrationData.Type).Validate(); err != nil {
+		return fmt.Errorf("registration failed: %w", err)
 	}
 
-	jsonData, err := json.Marshal(registrationData)
+	jsonData, err := protocol.EncodeRegistration(registrationData)
 	if err != nil {
 		return fmt.Errorf("error marshalling registration data: %w", err)
 	}
@@ -32,37 +38,24 @@ func RegisterService(webSocketURL, serviceID, serviceType string) error {
 	return nil
 }
 
+// registerWithRegistry sends the registration every 30s over a connection
+// that is redialed whenever it drops, printing what the registry answers.
 func registerWithRegistry(registryURL string, jsonData []byte) error {
+	client := transport.NewClient(transport.Config{
+		URL: registryURL,
+		OnMessage: func(message []byte) {
+			fmt.Printf("Response from server: %s\n", message)
+		},
+	})
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			c, _, err := websocket.DefaultDialer.Dial(registryURL, nil)
-			if err != nil {
-				fmt.Println("Error connecting to WebSocket, retrying...:", err)
-				continue
-			}
-
-			err = c.WriteMessage(websocket.TextMessage, jsonData)
-			if err != nil {
+			if err := client.Send(jsonData); err != nil {
 				fmt.Println("Error sending registration data, retrying...:", err)
-				c.Close()
-				continue
-			}
-
-			_, message, err := c.ReadMessage()
-			if err != nil {
-				fmt.Println("Error reading response, retrying...:", err)
-				c.Close()
-				continue
-			} else {
-				fmt.Printf("Response from server: %s\n", message)
 			}
-			// Consider keeping the connection open if needed for ongoing communication
-			// For now, we close it but don't exit the function
-			c.Close()
 		}
 	}
 }
@@ -0,0 +1,72 @@
+package registration
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ServiceType classifies a service, so that the registry and dashboards group
+// services consistently. It is one of the built-in types or a custom type
+// added with RegisterServiceType.
+type ServiceType string
+
+// Built-in service types.
+const (
+	HTTPAPI ServiceType = "http-api"
+	GRPC    ServiceType = "grpc"
+	Worker  ServiceType = "worker"
+	Cron    ServiceType = "cron"
+	Gateway ServiceType = "gateway"
+)
+
+// serviceTypeFormat is the format of custom types: lowercase letters, digits
+// and dashes, starting with a letter.
+var serviceTypeFormat = regexp.MustCompile(`^[a-z][a-z0-9-]{0,31}$`)
+
+var (
+	serviceTypesMu sync.RWMutex
+	serviceTypes   = map[ServiceType]bool{HTTPAPI: true, GRPC: true, Worker: true, Cron: true, Gateway: true}
+)
+
+// RegisterServiceType adds a custom service type, e.g. "stream-processor".
+// Custom types are up to 32 lowercase letters, digits and dashes, starting with
+// a letter. Registering a type twice is a no-op.
+func RegisterServiceType(t ServiceType) error {
+	if !serviceTypeFormat.MatchString(string(t)) {
+		return fmt.Errorf("invalid service type %q: must be up to 32 lowercase letters, digits and dashes, starting with a letter", t)
+	}
+	serviceTypesMu.Lock()
+	serviceTypes[t] = true
+	serviceTypesMu.Unlock()
+	return nil
+}
+
+// ServiceTypes returns the built-in and custom service types, sorted.
+func ServiceTypes() []ServiceType {
+	serviceTypesMu.RLock()
+	defer serviceTypesMu.RUnlock()
+	types := make([]ServiceType, 0, len(serviceTypes))
+	for t := range serviceTypes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// Validate returns an error unless t is a built-in or registered type.
+func (t ServiceType) Validate() error {
+	serviceTypesMu.RLock()
+	known := serviceTypes[t]
+	serviceTypesMu.RUnlock()
+	if known {
+		return nil
+	}
+	var names []string
+	for _, known := range ServiceTypes() {
+		names = append(names, string(known))
+	}
+	return fmt.Errorf("unknown service type %q: must be %s or a type added with RegisterServiceType", t, strings.Join(names, ", "))
+}
@@ -0,0 +1,37 @@
+package registration
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServiceTypeValidation(t *testing.T) {
+	for _, builtin := range []ServiceType{HTTPAPI, GRPC, Worker, Cron, Gateway} {
+		if err := builtin.Validate(); err != nil {
+			t.Errorf("%s: %v", builtin, err)
+		}
+	}
+	err := ServiceType("stream-processor").Validate()
+	if err == nil || !strings.Contains(err.Error(), "http-api") {
+		t.Fatalf("unregistered type: %v, want an error listing the known types", err)
+	}
+
+	if err := RegisterServiceType("stream-processor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ServiceType("stream-processor").Validate(); err != nil {
+		t.Errorf("registered type: %v", err)
+	}
+	for _, invalid := range []ServiceType{"", "Stream", "9lives", "has space", ServiceType(strings.Repeat("a", 33))} {
+		if err := RegisterServiceType(invalid); err == nil {
+			t.Errorf("RegisterServiceType(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestRegisterServiceRejectsUnknownTypes(t *testing.T) {
+	err := RegisterService("ws://127.0.0.1:1/register", "orders", "lambda-ish")
+	if err == nil || !strings.Contains(err.Error(), "unknown service type") {
+		t.Errorf("RegisterService = %v, want an unknown service type error", err)
+	}
+}
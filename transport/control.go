@@ -0,0 +1,19 @@
+package transport
+
+import "github.com/jculley01/observability-module/protocol"
+
+// Control message types sent by the registry. Others are passed on as they
+// are.
+const (
+	ControlHeartbeatMissed    = protocol.ControlHeartbeatMissed
+	ControlCollectorMigrating = protocol.ControlCollectorMigrating
+)
+
+// Control is a control message the registry sent over a connection.
+type Control = protocol.Control
+
+// ParseControl decodes a message from the registry, reporting whether it is a
+// control message: a JSON object with a type.
+func ParseControl(data []byte) (Control, bool) {
+	return protocol.DecodeControl(data)
+}
@@ -0,0 +1,175 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/jculley01/observability-module/protocol"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultUpgradeRetryInterval is how long a Client that fell back to HTTP
+// posts frames before trying WebSocket again, unless
+// Config.UpgradeRetryInterval is set.
+const DefaultUpgradeRetryInterval = 5 * time.Minute
+
+// defaultPostTimeout bounds each POST unless Config.HandshakeTimeout is set,
+// like the gorilla/websocket default handshake timeout.
+const defaultPostTimeout = 45 * time.Second
+
+// httpFallback is the HTTP binding of a Client whose WebSocket upgrades are
+// blocked.
+type httpFallback struct {
+	info   ConnInfo
+	client *http.Client
+	url    string
+	// retryAt is when the next frame tries WebSocket again
+	retryAt time.Time
+}
+
+// fallbackError is returned by dial while the Client posts frames over HTTP.
+type fallbackError struct {
+	fallback *httpFallback
+}
+
+func (e *fallbackError) Error() string {
+	return "posting to the registry over HTTP"
+}
+
+// upgradeBlocked reports whether a failed handshake looks blocked on the way
+// to the registry: something answered over HTTP but didn't switch protocols,
+// and not because of the token or an overload, which POSTs would hit too.
+func upgradeBlocked(resp *http.Response, err error) bool {
+	if resp == nil || !errors.Is(err, websocket.ErrBadHandshake) {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusProxyAuthRequired, http.StatusTooManyRequests:
+		return false
+	}
+	return resp.StatusCode < 500
+}
+
+// fallBack makes the Client post its frames over HTTP until the next
+// WebSocket retry, reporting false when the URL has no HTTP equivalent. The
+// caller holds mu.
+func (c *Client) fallBack(reason error) bool {
+	retry := c.cfg.UpgradeRetryInterval
+	if retry <= 0 {
+		retry = DefaultUpgradeRetryInterval
+	}
+	if c.fallback == nil {
+		u, err := url.Parse(c.cfg.URL)
+		if err != nil {
+			return false
+		}
+		switch u.Scheme {
+		case "ws":
+			u.Scheme = "http"
+		case "wss":
+			u.Scheme = "https"
+		}
+		timeout := c.cfg.HandshakeTimeout
+		if timeout <= 0 {
+			timeout = defaultPostTimeout
+		}
+		c.fallback = &httpFallback{
+			info: ConnInfo{ID: connectionIDs.Add(1)},
+			client: &http.Client{
+				Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: c.cfg.TLSClientConfig},
+				Timeout:   timeout,
+			},
+			url: u.String(),
+		}
+		if c.cfg.OnFallback != nil {
+			c.cfg.OnFallback(reason)
+		}
+	}
+	c.fallback.retryAt = time.Now().Add(retry)
+	return true
+}
+
+// Fallback reports whether the Client posts its frames over HTTP, its
+// WebSocket upgrades being blocked; see Config.HTTPFallback.
+func (c *Client) Fallback() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fallback != nil
+}
+
+// post writes a frame as a POST of the HTTP binding, numbered seq with
+// Acknowledged.
+func (c *Client) post(f *httpFallback, frameType string, data []byte, seq uint64) error {
+	ctx := context.Background()
+	target, header, err := authorize(ctx, c.cfg, f.url)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+	req.Header.Set("Content-Type", protocol.ContentTypeText)
+	if frameType == "binary" {
+		req.Header.Set("Content-Type", protocol.ContentTypeBinary)
+	}
+	if c.cfg.Session != nil {
+		session, err := c.cfg.Session()
+		if err != nil {
+			return fmt.Errorf("error encoding the session: %w", err)
+		}
+		if session != nil {
+			req.Header.Set(protocol.SessionHeader, string(session))
+		}
+	}
+	if c.cfg.Acknowledged {
+		sequence, err := protocol.EncodeSequence(protocol.Sequence{Stream: c.stream, Next: seq})
+		if err != nil {
+			return fmt.Errorf("error encoding the sequence: %w", err)
+		}
+		req.Header.Set(protocol.SequenceHeader, string(sequence))
+	}
+	if c.cfg.OnFrame != nil {
+		c.cfg.OnFrame(f.info, frameType, data)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post the frame: %v", err)
+	}
+	defer resp.Body.Close()
+	readLimit := c.cfg.ReadLimit
+	if readLimit <= 0 {
+		readLimit = DefaultReadLimit
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, readLimit))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("registry answered the POST with %s", resp.Status)
+	}
+	if err == nil && len(body) > 0 && c.cfg.OnMessage != nil {
+		c.cfg.OnMessage(body)
+	}
+	return nil
+}
+
+// postUnacked posts the frames the registry hasn't acknowledged, in order,
+// until one fails; the caller holds writeMu.
+func (c *Client) postUnacked(f *httpFallback) {
+	c.ackMu.Lock()
+	unacked := append([]unackedFrame(nil), c.unacked...)
+	c.ackMu.Unlock()
+	for _, frame := range unacked {
+		if err := c.post(f, frame.frameType, frame.data, frame.seq); err != nil {
+			return
+		}
+		c.ack(frame.seq)
+	}
+}
@@ -0,0 +1,644 @@
+// Package transport is the client side of the central registry's WebSocket
+// protocol, shared by the instrumentation, interceptor and registration
+// packages.
+//
+// A Client holds one connection to the registry at a time. Every message is a
+// text frame carrying one JSON document: a point, a batch of points (a JSON
+// array) or a registration. The connection is dialed by the first Send and
+// dialed again by the next Send after it drops, so callers only see errors for
+// messages that couldn't be sent. With a HeartbeatInterval, connections that
+// stop answering pings are closed and dialed again right away. Messages from the registry are passed to
+// Config.OnMessage; ParseControl picks out the control messages among them.
+// Close ends the connection with a close handshake.
+//
+// With Config.Acknowledged, delivery is at-least-once: the data frames are
+// numbered with a protocol.Sequence, kept until the registry acknowledges
+// them, and written again on the next connection when it drops first.
+//
+// With Config.HTTPFallback, a Client whose WebSocket upgrades are blocked,
+// e.g. by a proxy, posts its frames over HTTP instead, as the protocol
+// package describes, and tries WebSocket again from time to time.
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/jculley01/observability-module/protocol"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReadLimit caps the messages read from the registry unless
+// Config.ReadLimit is set.
+const DefaultReadLimit = 64 << 10
+
+// DefaultCloseTimeout bounds the wait for the registry to answer a close frame
+// when the context passed to Close has no deadline.
+const DefaultCloseTimeout = 5 * time.Second
+
+// DefaultMaxUnacked caps the frames kept until the registry acknowledges them
+// unless Config.MaxUnacked is set.
+const DefaultMaxUnacked = 1000
+
+// Config configures a Client.
+type Config struct {
+	// URL is the registry endpoint, e.g. wss://registry.example.com/metrics.
+	URL string
+	// Header is sent with the handshake of every connection, e.g. for an
+	// Authorization header.
+	Header http.Header
+	// Token, when set, is called before every handshake and the token sent
+	// as "Authorization: Bearer <token>", so each reconnection authenticates
+	// with the current token.
+	Token func(ctx context.Context) (string, error)
+	// TokenQueryParam sends the token as this query parameter instead of a
+	// header, for proxies that drop the Authorization header.
+	TokenQueryParam string
+	// TLSClientConfig configures the TLS of wss:// URLs, e.g. with the root
+	// CAs of an internal CA or a client certificate. Nil uses the defaults.
+	TLSClientConfig *tls.Config
+	// HandshakeTimeout bounds the WebSocket handshake; zero uses the
+	// gorilla/websocket default of 45s.
+	HandshakeTimeout time.Duration
+	// ReadLimit caps the messages read from the registry, DefaultReadLimit
+	// when zero. A larger message closes the connection.
+	ReadLimit int64
+	// HeartbeatInterval, when set, sends a ping frame that often so proxies
+	// don't close idle connections, and detects stale connections: one the
+	// registry sent neither a pong nor a message on for HeartbeatInterval
+	// plus PongTimeout (HeartbeatInterval if zero) is closed and dialed
+	// again, rather than failing the next write much later.
+	HeartbeatInterval time.Duration
+	PongTimeout       time.Duration
+	// Session, when set, returns the frame written first on every
+	// connection, e.g. a protocol.Session with the credentials the registry
+	// writes the points of the connection with. No frame is written when it
+	// returns nil data; a connection whose session fails is closed.
+	Session func() ([]byte, error)
+	// OnMessage is called with every message the registry sends. It runs on
+	// the connection's reader and must return quickly.
+	OnMessage func(data []byte)
+	// OnFrame is called with every data and close frame before it is
+	// written, e.g. to capture the traffic. Frames are written in the order
+	// OnFrame sees them. frameType is "text", "binary" or "close".
+	OnFrame func(conn ConnInfo, frameType string, payload []byte)
+	// OnConnect is called after every successful handshake, e.g. to count
+	// reconnections.
+	OnConnect func(conn ConnInfo)
+	// OnStale is called with the connections closed as stale, before they
+	// are dialed again.
+	OnStale func(conn ConnInfo)
+	// Acknowledged numbers the data frames for the registry to acknowledge
+	// with protocol.ControlAck messages, and keeps the frames it hasn't
+	// acknowledged yet: a protocol.Sequence follows the session of every
+	// connection, then the frames kept, written again in order. A frame
+	// whose write fails is kept too, so Send only fails when the registry
+	// can't be dialed. The data passed to Send must not be modified after.
+	Acknowledged bool
+	// Stream identifies the frames of the Client across its connections,
+	// random when empty.
+	Stream string
+	// MaxUnacked caps the frames kept until acknowledged, DefaultMaxUnacked
+	// when zero. The oldest are dropped for new ones, and counted in
+	// OnUnackedDropped.
+	MaxUnacked       int
+	OnUnackedDropped func(frames int)
+	// HTTPFallback posts the frames over HTTP when the WebSocket upgrade is
+	// blocked: the handshake got an HTTP answer other than 101, and not 401,
+	// 407, 429 or a 5xx, which are about the token or the registry itself.
+	// Each frame is then POSTed to URL with its http(s) scheme, with the
+	// session (and sequence) in headers, and WebSocket is tried again every
+	// UpgradeRetryInterval, DefaultUpgradeRetryInterval when zero.
+	// OnFallback is called with the failed handshake when the Client falls
+	// back.
+	HTTPFallback         bool
+	UpgradeRetryInterval time.Duration
+	OnFallback           func(reason error)
+}
+
+// ConnInfo describes a connection to the registry.
+type ConnInfo struct {
+	// ID numbers the connections made by the process, starting from 1.
+	ID         int64
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+// connectionIDs numbers the connections of every Client.
+var connectionIDs atomic.Int64
+
+// Dial opens a connection to the registry as configured by cfg, returning the
+// handshake response too. Clients use it for each of their connections;
+// callers only need it to probe the registry.
+func Dial(ctx context.Context, cfg Config) (*websocket.Conn, *http.Response, error) {
+	dialer := *websocket.DefaultDialer
+	if cfg.HandshakeTimeout > 0 {
+		dialer.HandshakeTimeout = cfg.HandshakeTimeout
+	}
+	dialer.TLSClientConfig = cfg.TLSClientConfig
+	target, header, err := authorize(ctx, cfg, cfg.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dialer.DialContext(ctx, target, header)
+}
+
+// authorize returns target and the header of cfg with the token of cfg, if
+// any, for a handshake or a POST.
+func authorize(ctx context.Context, cfg Config, target string) (string, http.Header, error) {
+	if cfg.Token == nil {
+		return target, cfg.Header, nil
+	}
+	token, err := cfg.Token(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting the registry token: %w", err)
+	}
+	header := cfg.Header.Clone()
+	if cfg.TokenQueryParam != "" {
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", nil, err
+		}
+		query := u.Query()
+		query.Set(cfg.TokenQueryParam, token)
+		u.RawQuery = query.Encode()
+		return u.String(), header, nil
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Authorization", "Bearer "+token)
+	return target, header, nil
+}
+
+// Client is a connection to the registry that is redialed as needed. It is
+// safe for concurrent use.
+type Client struct {
+	cfg Config
+
+	mu   sync.Mutex
+	conn *connection
+	// writeMu serialises writes, as a WebSocket connection supports a single
+	// concurrent writer. With Acknowledged it is taken before mu, so that no
+	// frame is written between the sequence of a new connection and the
+	// frames it writes again.
+	writeMu sync.Mutex
+
+	stream string
+	// ackMu guards the frames kept until acknowledged, oldest first, and
+	// lastSeq, the number of the latest frame. Acknowledgements take it
+	// without writeMu, so they are read while a write blocks.
+	ackMu   sync.Mutex
+	unacked []unackedFrame
+	lastSeq uint64
+
+	// fallback is set, under mu, while frames are posted over HTTP
+	fallback *httpFallback
+}
+
+// unackedFrame is a data frame the registry hasn't acknowledged.
+type unackedFrame struct {
+	seq         uint64
+	messageType int
+	frameType   string
+	data        []byte
+}
+
+// connection is one connection of a Client.
+type connection struct {
+	*websocket.Conn
+	info ConnInfo
+	// done is closed when the reader of the connection exits
+	done chan struct{}
+}
+
+// NewClient returns a Client for cfg. It doesn't connect until the first
+// Send or Connect.
+func NewClient(cfg Config) *Client {
+	c := &Client{cfg: cfg, stream: cfg.Stream}
+	if cfg.Acknowledged && c.stream == "" {
+		c.stream = randomStream()
+	}
+	return c
+}
+
+// randomStream returns a random stream identifier.
+func randomStream() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("stream-%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// URL returns the registry endpoint of the Client.
+func (c *Client) URL() string {
+	return c.cfg.URL
+}
+
+// Connection describes the current connection, and reports whether there is
+// one.
+func (c *Client) Connection() (ConnInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return ConnInfo{}, false
+	}
+	return c.conn.info, true
+}
+
+// Connect dials the registry unless the Client is already connected, or
+// posts its frames over HTTP until the next WebSocket retry.
+func (c *Client) Connect(ctx context.Context) error {
+	_, err := c.connect(ctx)
+	var fallback *fallbackError
+	if errors.As(err, &fallback) {
+		return nil
+	}
+	return err
+}
+
+func (c *Client) connect(ctx context.Context) (*connection, error) {
+	if c.cfg.Acknowledged {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+	}
+	return c.dial(ctx)
+}
+
+// dial connects unless the Client is connected. It returns a *fallbackError
+// while the Client posts its frames over HTTP. With Acknowledged, the caller
+// holds writeMu.
+func (c *Client) dial(ctx context.Context) (*connection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	if c.fallback != nil && time.Now().Before(c.fallback.retryAt) {
+		return nil, &fallbackError{fallback: c.fallback}
+	}
+
+	ws, resp, err := Dial(ctx, c.cfg)
+	if err != nil {
+		// A failed retry keeps posting, whatever the reason
+		if c.cfg.HTTPFallback && (c.fallback != nil || upgradeBlocked(resp, err)) {
+			reason := err
+			if resp != nil {
+				reason = fmt.Errorf("%v (%s)", err, resp.Status)
+			}
+			if c.fallBack(reason) {
+				return nil, &fallbackError{fallback: c.fallback}
+			}
+		}
+		if resp != nil {
+			// e.g. 401 when the registry rejects the token
+			return nil, fmt.Errorf("failed to dial WebSocket: %v (%s)", err, resp.Status)
+		}
+		return nil, fmt.Errorf("failed to dial WebSocket: %v", err)
+	}
+	readLimit := c.cfg.ReadLimit
+	if readLimit <= 0 {
+		readLimit = DefaultReadLimit
+	}
+	ws.SetReadLimit(readLimit)
+	if c.fallback != nil {
+		c.fallback.client.CloseIdleConnections()
+		c.fallback = nil
+	}
+	info := ConnInfo{ID: connectionIDs.Add(1), LocalAddr: ws.LocalAddr(), RemoteAddr: ws.RemoteAddr()}
+	if err := c.writeSession(ws, info); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	if c.cfg.Acknowledged {
+		if err := c.writeUnacked(ws, info); err != nil {
+			ws.Close()
+			return nil, err
+		}
+	}
+	if c.cfg.HeartbeatInterval > 0 {
+		ws.SetReadDeadline(time.Now().Add(c.staleAfter()))
+		ws.SetPongHandler(func(string) error {
+			return ws.SetReadDeadline(time.Now().Add(c.staleAfter()))
+		})
+	}
+	conn := &connection{
+		Conn: ws,
+		info: info,
+		done: make(chan struct{}),
+	}
+	c.conn = conn
+	go c.read(conn)
+	if c.cfg.HeartbeatInterval > 0 {
+		go c.heartbeat(conn)
+	}
+	if c.cfg.OnConnect != nil {
+		c.cfg.OnConnect(conn.info)
+	}
+	return conn, nil
+}
+
+// writeSession writes the Session frame to a new connection, before anything
+// else can write to it.
+func (c *Client) writeSession(ws *websocket.Conn, info ConnInfo) error {
+	if c.cfg.Session == nil {
+		return nil
+	}
+	data, err := c.cfg.Session()
+	if err != nil {
+		return fmt.Errorf("error encoding the session: %w", err)
+	}
+	if data == nil {
+		return nil
+	}
+	if c.cfg.OnFrame != nil {
+		c.cfg.OnFrame(info, "text", data)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, data); err != nil {
+		return fmt.Errorf("failed to write the session: %v", err)
+	}
+	return nil
+}
+
+// writeUnacked writes the sequence of a new connection, then the frames the
+// registry hasn't acknowledged, before anything else can write to it.
+func (c *Client) writeUnacked(ws *websocket.Conn, info ConnInfo) error {
+	c.ackMu.Lock()
+	next := c.lastSeq + 1
+	unacked := append([]unackedFrame(nil), c.unacked...)
+	c.ackMu.Unlock()
+	if len(unacked) > 0 {
+		next = unacked[0].seq
+	}
+	data, err := protocol.EncodeSequence(protocol.Sequence{Stream: c.stream, Next: next})
+	if err != nil {
+		return fmt.Errorf("error encoding the sequence: %w", err)
+	}
+	if c.cfg.OnFrame != nil {
+		c.cfg.OnFrame(info, "text", data)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, data); err != nil {
+		return fmt.Errorf("failed to write the sequence: %v", err)
+	}
+	for _, frame := range unacked {
+		if c.cfg.OnFrame != nil {
+			c.cfg.OnFrame(info, frame.frameType, frame.data)
+		}
+		if err := ws.WriteMessage(frame.messageType, frame.data); err != nil {
+			return fmt.Errorf("failed to write unacknowledged frames again: %v", err)
+		}
+	}
+	return nil
+}
+
+// keep numbers a frame and keeps it until acknowledged, dropping the oldest
+// frames beyond MaxUnacked.
+func (c *Client) keep(messageType int, frameType string, data []byte) {
+	limit := c.cfg.MaxUnacked
+	if limit <= 0 {
+		limit = DefaultMaxUnacked
+	}
+	c.ackMu.Lock()
+	c.lastSeq++
+	c.unacked = append(c.unacked, unackedFrame{seq: c.lastSeq, messageType: messageType, frameType: frameType, data: data})
+	excess := len(c.unacked) - limit
+	if excess > 0 {
+		c.unacked = append([]unackedFrame(nil), c.unacked[excess:]...)
+	}
+	c.ackMu.Unlock()
+	if excess > 0 && c.cfg.OnUnackedDropped != nil {
+		c.cfg.OnUnackedDropped(excess)
+	}
+}
+
+// ack forgets the frames numbered up to seq.
+func (c *Client) ack(seq uint64) {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	acked := 0
+	for acked < len(c.unacked) && c.unacked[acked].seq <= seq {
+		acked++
+	}
+	c.unacked = c.unacked[acked:]
+}
+
+// Unacked returns the number of frames the registry hasn't acknowledged yet,
+// always zero without Acknowledged.
+func (c *Client) Unacked() int {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	return len(c.unacked)
+}
+
+// staleAfter is how long a connection may go without a pong or a message.
+func (c *Client) staleAfter() time.Duration {
+	timeout := c.cfg.PongTimeout
+	if timeout <= 0 {
+		timeout = c.cfg.HeartbeatInterval
+	}
+	return c.cfg.HeartbeatInterval + timeout
+}
+
+// read passes the messages of conn to OnMessage until it fails, then forgets
+// conn so that the next Send dials again. A stale conn is dialed again right
+// away.
+func (c *Client) read(conn *connection) {
+	defer close(conn.done)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			stale := errors.As(err, &netErr) && netErr.Timeout()
+			if !c.drop(conn) || !stale {
+				return
+			}
+			if c.cfg.OnStale != nil {
+				c.cfg.OnStale(conn.info)
+			}
+			// A failed dial is retried by the next Send
+			c.Connect(context.Background())
+			return
+		}
+		if c.cfg.HeartbeatInterval > 0 {
+			conn.SetReadDeadline(time.Now().Add(c.staleAfter()))
+		}
+		if c.cfg.Acknowledged {
+			if control, ok := protocol.DecodeControl(data); ok && control.Type == protocol.ControlAck {
+				c.ack(control.Sequence)
+			}
+		}
+		if c.cfg.OnMessage != nil {
+			c.cfg.OnMessage(data)
+		}
+	}
+}
+
+// heartbeat pings the registry every HeartbeatInterval while conn is open.
+func (c *Client) heartbeat(conn *connection) {
+	ticker := time.NewTicker(c.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-ticker.C:
+			// WriteControl may be called concurrently with other writes
+			deadline := time.Now().Add(c.cfg.HeartbeatInterval)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.drop(conn)
+				return
+			}
+		}
+	}
+}
+
+// drop closes conn and forgets it if it is still the current connection,
+// reporting whether it was.
+func (c *Client) drop(conn *connection) bool {
+	conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != conn {
+		return false
+	}
+	c.conn = nil
+	return true
+}
+
+// Send writes data to the registry as a text frame, connecting first if
+// needed. A failed write closes the connection, so the next Send redials.
+func (c *Client) Send(data []byte) error {
+	return c.write(websocket.TextMessage, "text", data)
+}
+
+// SendBinary is Send for binary frames, e.g. protobuf encoded points.
+func (c *Client) SendBinary(data []byte) error {
+	return c.write(websocket.BinaryMessage, "binary", data)
+}
+
+// SendSession writes a session frame, e.g. with a rotated token. Unlike Send
+// it is neither numbered nor kept with Acknowledged, as every connection
+// starts with the current session anyway, and it isn't posted over HTTP, as
+// every POST carries the current session.
+func (c *Client) SendSession(data []byte) error {
+	return c.writeFrame(websocket.TextMessage, "text", data, true)
+}
+
+func (c *Client) write(messageType int, frameType string, data []byte) error {
+	if !c.cfg.Acknowledged {
+		return c.writeFrame(messageType, frameType, data, false)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	conn, err := c.dial(context.Background())
+	var fallback *fallbackError
+	if errors.As(err, &fallback) {
+		// A frame whose POST fails is kept, as is one whose write fails
+		c.keep(messageType, frameType, data)
+		c.postUnacked(fallback.fallback)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.keep(messageType, frameType, data)
+	if c.cfg.OnFrame != nil {
+		c.cfg.OnFrame(conn.info, frameType, data)
+	}
+	if err := conn.WriteMessage(messageType, data); err != nil {
+		// The frame is written again on the next connection
+		c.drop(conn)
+	}
+	return nil
+}
+
+// writeFrame writes a frame that isn't numbered, a session one if session is
+// set.
+func (c *Client) writeFrame(messageType int, frameType string, data []byte, session bool) error {
+	conn, err := c.connect(context.Background())
+	var fallback *fallbackError
+	if errors.As(err, &fallback) {
+		if session {
+			return nil
+		}
+		return c.post(fallback.fallback, frameType, data, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.cfg.OnFrame != nil {
+		c.cfg.OnFrame(conn.info, frameType, data)
+	}
+	if err := conn.WriteMessage(messageType, data); err != nil {
+		c.drop(conn)
+		return fmt.Errorf("failed to write message: %v", err)
+	}
+	return nil
+}
+
+// SendJSON sends the JSON encoding of v.
+func (c *Client) SendJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(data)
+}
+
+// Close sends a close frame and waits for the registry to close its side, or
+// for ctx to be done, then closes the connection. The Client stays usable: a
+// later Send connects again.
+func (c *Client) Close(ctx context.Context) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	if c.fallback != nil {
+		c.fallback.client.CloseIdleConnections()
+		c.fallback = nil
+	}
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultCloseTimeout)
+	}
+	closeFrame := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "shutdown")
+	c.writeMu.Lock()
+	if c.cfg.OnFrame != nil {
+		c.cfg.OnFrame(conn.info, "close", closeFrame)
+	}
+	err := conn.WriteControl(websocket.CloseMessage, closeFrame, deadline)
+	c.writeMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error sending close frame: %w", err)
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-conn.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return fmt.Errorf("registry didn't acknowledge the close frame")
+	}
+}
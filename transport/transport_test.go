@@ -0,0 +1,603 @@
+package transport
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/jculley01/observability-module/protocol"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRegistry records the messages it receives. serve, when set, runs on
+// each connection instead of the default read loop.
+type fakeRegistry struct {
+	server   *httptest.Server
+	received chan string
+	headers  chan http.Header
+	pings    chan struct{}
+	serve    func(conn *websocket.Conn)
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		received: make(chan string, 16),
+		headers:  make(chan http.Header, 16),
+		pings:    make(chan struct{}, 16),
+	}
+	upgrader := websocket.Upgrader{}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r.headers <- req.Header
+		conn.SetPingHandler(func(appData string) error {
+			select {
+			case r.pings <- struct{}{}:
+			default:
+			}
+			return conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+		})
+		if r.serve != nil {
+			r.serve(conn)
+			return
+		}
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			r.received <- string(data)
+		}
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *fakeRegistry) url() string {
+	return "ws" + strings.TrimPrefix(r.server.URL, "http")
+}
+
+func (r *fakeRegistry) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case message := <-r.received:
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return ""
+	}
+}
+
+func TestClientSendsWithHeader(t *testing.T) {
+	registry := newFakeRegistry(t)
+	client := NewClient(Config{URL: registry.url(), Header: http.Header{"Authorization": {"Bearer abc"}}})
+	defer client.Close(context.Background())
+
+	if _, connected := client.Connection(); connected {
+		t.Error("connected before the first Send")
+	}
+	if err := client.SendJSON(map[string]string{"measurement": "orders"}); err != nil {
+		t.Fatal(err)
+	}
+	if message := registry.next(t); message != `{"measurement":"orders"}` {
+		t.Errorf("message = %s", message)
+	}
+	if header := <-registry.headers; header.Get("Authorization") != "Bearer abc" {
+		t.Errorf("Authorization = %q", header.Get("Authorization"))
+	}
+}
+
+func TestClientRedialsAfterTheConnectionDrops(t *testing.T) {
+	registry := newFakeRegistry(t)
+	var dropped sync.Once
+	registry.serve = func(conn *websocket.Conn) {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			registry.received <- string(data)
+			drop := false
+			dropped.Do(func() { drop = true })
+			if drop {
+				return
+			}
+		}
+	}
+	client := NewClient(Config{URL: registry.url()})
+	defer client.Close(context.Background())
+
+	if err := client.Send([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	registry.next(t)
+	first, _ := client.Connection()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, connected := client.Connection(); !connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the dropped connection is still current")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := client.Send([]byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if message := registry.next(t); message != "2" {
+		t.Errorf("message = %s, want 2", message)
+	}
+	second, _ := client.Connection()
+	if second.ID == first.ID {
+		t.Errorf("connection ID = %d after redialing, want a new one", second.ID)
+	}
+}
+
+func TestClientSendsBinaryFrames(t *testing.T) {
+	registry := newFakeRegistry(t)
+	messageTypes := make(chan int, 1)
+	registry.serve = func(conn *websocket.Conn) {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			messageTypes <- messageType
+			registry.received <- string(data)
+		}
+	}
+	var frames []string
+	client := NewClient(Config{
+		URL:     registry.url(),
+		OnFrame: func(conn ConnInfo, frameType string, payload []byte) { frames = append(frames, frameType) },
+	})
+	defer client.Close(context.Background())
+	if err := client.SendBinary([]byte{0x0a, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if message := registry.next(t); message != "\x0a\x00" {
+		t.Errorf("message = %q", message)
+	}
+	if messageType := <-messageTypes; messageType != websocket.BinaryMessage {
+		t.Errorf("message type = %d, want binary", messageType)
+	}
+	if strings.Join(frames, ",") != "binary" {
+		t.Errorf("frames = %v, want binary", frames)
+	}
+}
+
+func TestClientPassesRegistryMessages(t *testing.T) {
+	registry := newFakeRegistry(t)
+	registry.serve = func(conn *websocket.Conn) {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"collector_migrating","url":"wss://new"}`))
+		conn.WriteMessage(websocket.TextMessage, []byte(`ok`))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}
+	messages := make(chan []byte, 2)
+	client := NewClient(Config{URL: registry.url(), OnMessage: func(data []byte) { messages <- data }})
+	defer client.Close(context.Background())
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	control, ok := ParseControl(<-messages)
+	if !ok || control.Type != ControlCollectorMigrating || control.URL != "wss://new" {
+		t.Errorf("control = %+v, %v", control, ok)
+	}
+	if _, ok := ParseControl(<-messages); ok {
+		t.Error("a plain message was parsed as a control message")
+	}
+}
+
+func TestClientCloseHandshake(t *testing.T) {
+	registry := newFakeRegistry(t)
+	var frames []string
+	client := NewClient(Config{
+		URL: registry.url(),
+		OnFrame: func(conn ConnInfo, frameType string, payload []byte) {
+			frames = append(frames, frameType)
+		},
+	})
+	if err := client.Send([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	registry.next(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := client.Close(ctx); err != nil {
+		t.Fatalf("Close = %v, want the registry to acknowledge", err)
+	}
+	if _, connected := client.Connection(); connected {
+		t.Error("still connected after Close")
+	}
+	if strings.Join(frames, ",") != "text,close" {
+		t.Errorf("frames = %v, want text,close", frames)
+	}
+	// Closing again is a no-op
+	if err := client.Close(ctx); err != nil {
+		t.Errorf("second Close = %v", err)
+	}
+}
+
+func TestClientHeartbeat(t *testing.T) {
+	registry := newFakeRegistry(t)
+	client := NewClient(Config{URL: registry.url(), HeartbeatInterval: 20 * time.Millisecond})
+	defer client.Close(context.Background())
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-registry.pings:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no ping within 2s")
+	}
+}
+
+func TestClientRedialsStaleConnections(t *testing.T) {
+	registry := newFakeRegistry(t)
+	var connections sync.WaitGroup
+	connections.Add(1)
+	var first sync.Once
+	stop := make(chan struct{})
+	defer close(stop)
+	registry.serve = func(conn *websocket.Conn) {
+		stale := false
+		first.Do(func() { stale = true })
+		if stale {
+			// Never reading, so never answering pings
+			<-stop
+			return
+		}
+		connections.Done()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}
+	staleConns := make(chan ConnInfo, 1)
+	client := NewClient(Config{
+		URL:               registry.url(),
+		HeartbeatInterval: 20 * time.Millisecond,
+		PongTimeout:       20 * time.Millisecond,
+		OnStale:           func(conn ConnInfo) { staleConns <- conn },
+	})
+	defer client.Close(context.Background())
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := client.Connection()
+
+	select {
+	case conn := <-staleConns:
+		if conn.ID != stale.ID {
+			t.Errorf("stale connection = %d, want %d", conn.ID, stale.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stale connection not detected")
+	}
+	connections.Wait()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if conn, connected := client.Connection(); connected && conn.ID != stale.ID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not reconnected after the stale connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientKeepsAnsweringConnections(t *testing.T) {
+	registry := newFakeRegistry(t)
+	client := NewClient(Config{
+		URL:               registry.url(),
+		HeartbeatInterval: 10 * time.Millisecond,
+		PongTimeout:       50 * time.Millisecond,
+		OnStale:           func(conn ConnInfo) { t.Errorf("connection %d closed as stale", conn.ID) },
+	})
+	defer client.Close(context.Background())
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := client.Connection()
+	time.Sleep(200 * time.Millisecond)
+	if conn, connected := client.Connection(); !connected || conn.ID != first.ID {
+		t.Errorf("connection = %d, %v, want %d", conn.ID, connected, first.ID)
+	}
+}
+
+func TestClientWritesSessionFirst(t *testing.T) {
+	registry := newFakeRegistry(t)
+	sessions := 0
+	client := NewClient(Config{
+		URL: registry.url(),
+		Session: func() ([]byte, error) {
+			sessions++
+			return []byte(`{"type":"session"}`), nil
+		},
+	})
+	defer client.Close(context.Background())
+	if err := client.Send([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send([]byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`{"type":"session"}`, "1", "2"} {
+		if message := registry.next(t); message != want {
+			t.Errorf("message = %s, want %s", message, want)
+		}
+	}
+	if sessions != 1 {
+		t.Errorf("session written %d times on one connection, want 1", sessions)
+	}
+}
+
+func TestClientWritesUnacknowledgedFramesAgain(t *testing.T) {
+	registry := newFakeRegistry(t)
+	var dropped sync.Once
+	registry.serve = func(conn *websocket.Conn) {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			registry.received <- string(data)
+			switch string(data) {
+			case "1", "3":
+				// Frame 2 of the first connection is never acknowledged
+				ack, _ := protocol.EncodeControl(protocol.Control{Type: protocol.ControlAck, Sequence: uint64(data[0] - '0')})
+				conn.WriteMessage(websocket.TextMessage, ack)
+			case "2":
+				drop := false
+				dropped.Do(func() { drop = true })
+				if drop {
+					return
+				}
+			}
+		}
+	}
+	client := NewClient(Config{URL: registry.url(), Acknowledged: true, Stream: "orders"})
+	defer client.Close(context.Background())
+
+	for _, data := range []string{"1", "2"} {
+		if err := client.Send([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{`{"type":"sequence","stream":"orders","next":1}`, "1", "2"} {
+		if message := registry.next(t); message != want {
+			t.Errorf("message = %s, want %s", message, want)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, connected := client.Connection(); !connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the dropped connection is still current")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if unacked := client.Unacked(); unacked != 1 {
+		t.Errorf("Unacked() = %d, want frame 2", unacked)
+	}
+
+	if err := client.Send([]byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`{"type":"sequence","stream":"orders","next":2}`, "2", "3"} {
+		if message := registry.next(t); message != want {
+			t.Errorf("message = %s, want %s", message, want)
+		}
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for client.Unacked() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Unacked() = %d after the registry acknowledged frame 3", client.Unacked())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientDropsTheOldestUnacknowledgedFrames(t *testing.T) {
+	registry := newFakeRegistry(t)
+	dropped := 0
+	client := NewClient(Config{
+		URL:              registry.url(),
+		Acknowledged:     true,
+		MaxUnacked:       2,
+		OnUnackedDropped: func(frames int) { dropped += frames },
+	})
+	defer client.Close(context.Background())
+	for _, data := range []string{"1", "2", "3"} {
+		if err := client.Send([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sequence, ok := protocol.DecodeSequence([]byte(registry.next(t))); !ok || sequence.Stream == "" || sequence.Next != 1 {
+		t.Errorf("sequence = %+v, %v, want a random stream from frame 1", sequence, ok)
+	}
+	if unacked := client.Unacked(); unacked != 2 || dropped != 1 {
+		t.Errorf("Unacked() = %d with %d dropped, want 2 and 1", unacked, dropped)
+	}
+
+	// Sessions are neither numbered nor kept
+	if err := client.SendSession([]byte(`{"type":"session"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if unacked := client.Unacked(); unacked != 2 {
+		t.Errorf("Unacked() = %d after a session, want 2", unacked)
+	}
+}
+
+// post is a frame a blockingProxy passed on over HTTP.
+type post struct {
+	header http.Header
+	body   string
+}
+
+// blockingProxy stands in for a registry behind a proxy stripping WebSocket
+// upgrades: the handshake gets status, until upgrades are allowed, and POSTs
+// are answered by answer, 204 when nil.
+type blockingProxy struct {
+	*fakeRegistry
+	status  int
+	allowed atomic.Bool
+	posts   chan post
+	answer  func(w http.ResponseWriter)
+}
+
+func newBlockingProxy(t *testing.T, status int) *blockingProxy {
+	p := &blockingProxy{fakeRegistry: newFakeRegistry(t), status: status, posts: make(chan post, 16)}
+	upgrades := p.server.Config.Handler
+	p.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			body, _ := io.ReadAll(req.Body)
+			p.posts <- post{header: req.Header, body: string(body)}
+			if p.answer != nil {
+				p.answer(w)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !p.allowed.Load() {
+			http.Error(w, "upgrades not allowed", p.status)
+			return
+		}
+		upgrades.ServeHTTP(w, req)
+	})
+	return p
+}
+
+func (p *blockingProxy) nextPost(t *testing.T) post {
+	t.Helper()
+	select {
+	case post := <-p.posts:
+		return post
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a POST")
+		return post{}
+	}
+}
+
+func TestClientFallsBackToHTTP(t *testing.T) {
+	proxy := newBlockingProxy(t, http.StatusBadRequest)
+	proxy.answer = func(w http.ResponseWriter) {
+		w.Write([]byte(`{"type":"heartbeat_missed"}`))
+	}
+	var reasons []error
+	messages := make(chan string, 4)
+	client := NewClient(Config{
+		URL:                  proxy.url(),
+		Header:               http.Header{"Authorization": {"Bearer abc"}},
+		Session:              func() ([]byte, error) { return []byte(`{"type":"session","bucket":"metrics"}`), nil },
+		HTTPFallback:         true,
+		UpgradeRetryInterval: 50 * time.Millisecond,
+		OnFallback:           func(reason error) { reasons = append(reasons, reason) },
+		OnMessage:            func(data []byte) { messages <- string(data) },
+	})
+	defer client.Close(context.Background())
+
+	if err := client.Send([]byte(`{"measurement":"orders"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendSession([]byte(`{"type":"session"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendBinary([]byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if !client.Fallback() || len(reasons) != 1 || !strings.Contains(reasons[0].Error(), "400") {
+		t.Errorf("Fallback() = %v after %v, want a single fallback on the 400", client.Fallback(), reasons)
+	}
+	text := proxy.nextPost(t)
+	if text.body != `{"measurement":"orders"}` || text.header.Get("Content-Type") != protocol.ContentTypeText ||
+		text.header.Get(protocol.SessionHeader) != `{"type":"session","bucket":"metrics"}` || text.header.Get("Authorization") != "Bearer abc" {
+		t.Errorf("text POST = %+v", text)
+	}
+	// The session went with the POSTs rather than as one of its own
+	if binary := proxy.nextPost(t); binary.body != "\x01\x02" || binary.header.Get("Content-Type") != protocol.ContentTypeBinary {
+		t.Errorf("binary POST = %+v", binary)
+	}
+	if message := <-messages; message != `{"type":"heartbeat_missed"}` {
+		t.Errorf("message = %s, want the answer to the POST", message)
+	}
+
+	// Once upgrades get through, frames go over WebSocket again
+	proxy.allowed.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	if err := client.Send([]byte("upgraded")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`{"type":"session","bucket":"metrics"}`, "upgraded"} {
+		if message := proxy.next(t); message != want {
+			t.Errorf("message = %s, want %s", message, want)
+		}
+	}
+	if client.Fallback() {
+		t.Error("Fallback() = true over WebSocket")
+	}
+}
+
+func TestClientPostsUnacknowledgedFrames(t *testing.T) {
+	proxy := newBlockingProxy(t, http.StatusForbidden)
+	var failed atomic.Bool
+	proxy.answer = func(w http.ResponseWriter) {
+		if failed.CompareAndSwap(false, true) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	client := NewClient(Config{URL: proxy.url(), Acknowledged: true, Stream: "orders", HTTPFallback: true})
+	defer client.Close(context.Background())
+
+	// The POST of frame 1 fails, so it is kept and posted again before 2
+	if err := client.Send([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if unacked := client.Unacked(); unacked != 1 {
+		t.Errorf("Unacked() = %d after a failed POST, want 1", unacked)
+	}
+	if err := client.Send([]byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1", "1", "2"} {
+		post := proxy.nextPost(t)
+		sequence, _ := protocol.DecodeSequence([]byte(post.header.Get(protocol.SequenceHeader)))
+		if post.body != want || sequence.Stream != "orders" || sequence.Next != uint64(want[0]-'0') {
+			t.Errorf("POST of %s numbered %+v, want %s", post.body, sequence, want)
+		}
+	}
+	if unacked := client.Unacked(); unacked != 0 {
+		t.Errorf("Unacked() = %d once posted, want 0", unacked)
+	}
+}
+
+func TestClientDoesNotFallBackOnRejectedTokens(t *testing.T) {
+	proxy := newBlockingProxy(t, http.StatusUnauthorized)
+	client := NewClient(Config{URL: proxy.url(), HTTPFallback: true})
+	if err := client.Send([]byte("1")); err == nil || client.Fallback() {
+		t.Errorf("Send() = %v with Fallback() = %v, want the 401 without falling back", err, client.Fallback())
+	}
+}
@@ -0,0 +1,110 @@
+// Package instrumentation is the v2 API of the observability module: one Point
+// type for HTTP, gRPC and custom metrics, an Instrumenter created with New
+// instead of package-level setup functions, and Exporter for backends of
+// one's own.
+//
+// While services migrate it runs on the v1 package,
+// github.com/jculley01/observability-module/instrumentation, so v1 options,
+// framework adapters and helpers such as SetRoute keep working next to it.
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	v1 "github.com/jculley01/observability-module/instrumentation"
+	"net/http"
+	"sync"
+)
+
+// Config is the full instrumentation configuration; see LoadConfig.
+type Config = v1.Config
+
+// Point is a metrics point: the tags and fields of a measurement, and where
+// it is stored. HTTP requests, RPCs and custom points all use it.
+type Point = v1.Metrics
+
+// Exporter receives every point sent, next to the registry.
+type Exporter = v1.Exporter
+
+// DomainEvent is sent with Instrumenter.EmitEvent.
+type DomainEvent = v1.DomainEvent
+
+// SelfCheckReport is the outcome of Instrumenter.SelfCheck.
+type SelfCheckReport = v1.SelfCheckReport
+
+// ErrRunning is returned by New while another Instrumenter is running: the
+// instrumentation is still process-wide underneath.
+var ErrRunning = errors.New("an Instrumenter is already running, shut it down first")
+
+var (
+	runningMu sync.Mutex
+	running   *Instrumenter
+)
+
+// Instrumenter is the running instrumentation of a service.
+type Instrumenter struct {
+	cfg Config
+}
+
+// New validates cfg, applies it and starts its background work, e.g. the
+// exporters. Call Shutdown on the returned Instrumenter when the service
+// stops.
+func New(cfg Config, exporters ...Exporter) (*Instrumenter, error) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	if running != nil {
+		return nil, ErrRunning
+	}
+	cfg.Exporters = append(cfg.Exporters[:len(cfg.Exporters):len(cfg.Exporters)], exporters...)
+	if err := v1.ApplyConfig(cfg); err != nil {
+		return nil, err
+	}
+	running = &Instrumenter{cfg: cfg}
+	return running, nil
+}
+
+// LoadConfig reads a JSON configuration file.
+func LoadConfig(path string) (Config, error) {
+	return v1.LoadConfig(path)
+}
+
+// Instrument attaches the metrics middleware to an *http.ServeMux, or to the
+// router of a framework whose adapter is imported, e.g.
+// github.com/jculley01/observability-module/instrumentation/gin.
+func (i *Instrumenter) Instrument(routerOrServer interface{}) error {
+	return v1.InstrumentWithConfig(routerOrServer, i.cfg)
+}
+
+// Middleware reports the requests served by next.
+func (i *Instrumenter) Middleware(next http.Handler) http.Handler {
+	return v1.Middleware(next)
+}
+
+// Send sends a custom point, with the InfluxDB settings and measurement of
+// the config where left empty.
+func (i *Instrumenter) Send(point Point) error {
+	return v1.Send(point)
+}
+
+// EmitEvent queues a domain event; it needs Config.Outbox.
+func (i *Instrumenter) EmitEvent(event DomainEvent) error {
+	return v1.EmitEvent(event)
+}
+
+// SelfCheck checks that the config can deliver metrics.
+func (i *Instrumenter) SelfCheck(ctx context.Context) SelfCheckReport {
+	return v1.SelfCheck(ctx)
+}
+
+// Shutdown drains pending metrics, shuts the exporters down and closes the
+// registry connection. A new Instrumenter can be created afterwards; shutting
+// down an Instrumenter already shut down does nothing.
+func (i *Instrumenter) Shutdown(ctx context.Context) error {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	if running != i {
+		return nil
+	}
+	running = nil
+	return v1.Shutdown(ctx)
+}
@@ -0,0 +1,91 @@
+package instrumentation
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// recordingExporter keeps the points exported to it.
+type recordingExporter struct {
+	mu       sync.Mutex
+	points   []Point
+	shutDown bool
+}
+
+func (e *recordingExporter) Export(point Point) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.points = append(e.points, point)
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.shutDown = true
+	return nil
+}
+
+func TestInstrumenterLifecycle(t *testing.T) {
+	exporter := &recordingExporter{}
+	inst, err := New(Config{ServiceName: "orders"}, exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{ServiceName: "orders"}, exporter); !errors.Is(err, ErrRunning) {
+		t.Errorf("second New() = %v, want ErrRunning", err)
+	}
+
+	inst.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders", nil))
+	if err := inst.Send(Point{Fields: map[string]interface{}{"rows": 12}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	exporter.mu.Lock()
+	// The request point goes through the send queue, so it may be exported
+	// after the point sent directly.
+	points := exporter.points
+	if len(points) == 2 && points[0].Fields["rows"] != nil {
+		points = []Point{points[1], points[0]}
+	}
+	if len(points) != 2 || points[0].Tags["endpoint"] != "/orders" || points[1].Measurement != "orders" {
+		t.Errorf("exported points = %+v", exporter.points)
+	}
+	if !exporter.shutDown {
+		t.Error("exporter wasn't shut down")
+	}
+	exporter.mu.Unlock()
+
+	if err := inst.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown() = %v", err)
+	}
+	next, err := New(Config{ServiceName: "orders"}, &recordingExporter{})
+	if err != nil {
+		t.Fatalf("New() after Shutdown = %v", err)
+	}
+	if err := next.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Fatal("New() accepted a config without a service name")
+	}
+	// A failed New doesn't count as running
+	inst, err := New(Config{ServiceName: "orders"}, &recordingExporter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}